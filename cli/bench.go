@@ -0,0 +1,360 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nih.software/cli/ui"
+	"nih.software/daemon"
+	"nih.software/peers"
+	"nih.software/trust"
+)
+
+var benchFlags struct {
+	handshakes  int
+	concurrency int
+	size        byteSize
+}
+
+var cmdBench = &Command{
+	Name:    "bench",
+	Args:    "NODE",
+	Summary: "benchmark handshakes and throughput to a node",
+	Help: `
+Bench measures the mutual TLS connection to the node NODE, the name of a
+peer of the address book or host[:port] with the port of serve -listen by
+default, in two phases.
+
+First, it makes -n connections, -c at a time, each with a full handshake,
+and reports the handshakes per second and the percentiles of the time to
+connect and to hand shake. Then it sends -size bytes to the node's bench
+service and receives as many back, each over one connection, and reports
+the throughput in either direction.
+
+The bench service serves at most 1 GiB per request. Run bench from a host
+that is otherwise idle, as its own load skews the results.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		benchFlags.size = 64 << 20
+		fs.IntVar(&benchFlags.handshakes, "n", 200, "Number of handshakes")
+		fs.IntVar(&benchFlags.concurrency, "c", 4, "Number of handshakes at a time")
+		fs.Var(&benchFlags.size, "size", "`Bytes` to send and receive, with an optional K, M, or G suffix, or 0 to skip")
+	},
+	Credentials: true,
+	Run:         runBench,
+}
+
+func init() {
+	Register(cmdBench)
+}
+
+// A byteSize is a flag.Value for a number of bytes with an optional
+// binary unit suffix, such as 64M.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(v string) error {
+	shift := 0
+	switch {
+	case strings.HasSuffix(v, "K"):
+		shift = 10
+	case strings.HasSuffix(v, "M"):
+		shift = 20
+	case strings.HasSuffix(v, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		v = v[:len(v)-1]
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return errors.New("invalid size")
+	}
+
+	*s = byteSize(n << shift)
+	return nil
+}
+
+func runBench(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need exactly one node")
+	}
+
+	if benchFlags.handshakes < 1 || benchFlags.concurrency < 1 {
+		return Usagef("-n and -c must be at least 1")
+	}
+	if benchFlags.size > daemon.MaxBenchSize {
+		return Usagef("-size must be at most %s", ui.FormatBytes(daemon.MaxBenchSize))
+	}
+
+	addr, expect, err := nodeAddr(args[0])
+	if err != nil {
+		return err
+	}
+	b := Bundle()
+
+	r := &benchResult{Addr: addr, Handshakes: benchFlags.handshakes, Concurrency: benchFlags.concurrency}
+
+	s := ui.NewSpinner(fmt.Sprintf("%d handshakes", benchFlags.handshakes))
+	connect, handshake, elapsed, err := benchHandshakes(ctx, addr, b, expect)
+	s.Stop()
+	if err != nil {
+		return err
+	}
+
+	r.Rate = float64(benchFlags.handshakes) / elapsed.Seconds()
+	r.Connect = newLatencies(connect)
+	r.Handshake = newLatencies(handshake)
+
+	if benchFlags.size > 0 {
+		c := streamClient(b, expect)
+		defer c.CloseIdleConnections()
+
+		s := ui.NewSpinner("upload")
+		r.Upload, err = benchUpload(ctx, c, addr, int64(benchFlags.size))
+		s.Stop()
+		if err != nil {
+			return err
+		}
+
+		s = ui.NewSpinner("download")
+		r.Download, err = benchDownload(ctx, c, addr, int64(benchFlags.size))
+		s.Stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	return Print(r)
+}
+
+// benchHandshakes makes the connections of the handshake phase and returns
+// the time each took to connect and to hand shake, and the time they took
+// in all.
+func benchHandshakes(ctx context.Context, addr string, b *trust.Bundle, expect *peers.Peer) (connect, handshake []time.Duration, elapsed time.Duration, err error) {
+	var (
+		mu    sync.Mutex
+		next  int
+		first error
+	)
+
+	config := nodeTLSConfig(b, expect)
+	config.NextProtos = []string{"http/1.1"}
+
+	one := func() error {
+		ctx, cancel := WithTimeout(ctx)
+		defer cancel()
+
+		start := time.Now()
+		var d net.Dialer
+		raw, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		c := time.Since(start)
+
+		conn := tls.Client(raw, config)
+		defer conn.Close()
+
+		start = time.Now()
+		if err := conn.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		h := time.Since(start)
+
+		mu.Lock()
+		connect = append(connect, c)
+		handshake = append(handshake, h)
+		mu.Unlock()
+		return nil
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range min(benchFlags.concurrency, benchFlags.handshakes) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				mu.Lock()
+				if next == benchFlags.handshakes || first != nil {
+					mu.Unlock()
+					return
+				}
+				next++
+				mu.Unlock()
+
+				if err := one(); err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return connect, handshake, time.Since(start), first
+}
+
+func benchUpload(ctx context.Context, c *http.Client, addr string, size int64) (*throughput, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+addr+"/bench/discard", io.LimitReader(zeros{}, size))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", addr, responseMessage(resp))
+	}
+
+	var res daemon.BenchResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Bytes != size {
+		return nil, fmt.Errorf("%s: received %d bytes of %d", addr, res.Bytes, size)
+	}
+
+	return newThroughput(size, time.Since(start)), nil
+}
+
+func benchDownload(ctx context.Context, c *http.Client, addr string, size int64) (*throughput, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+addr+"/bench/zero?size="+strconv.FormatInt(size, 10), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", addr, responseMessage(resp))
+	}
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("%s: sent %d bytes of %d", addr, n, size)
+	}
+
+	return newThroughput(size, time.Since(start)), nil
+}
+
+// zeros is a reader of endless zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+type benchResult struct {
+	Addr        string      `json:"addr"`
+	Handshakes  int         `json:"handshakes"`
+	Concurrency int         `json:"concurrency"`
+	Rate        float64     `json:"handshakes_per_sec"`
+	Connect     *latencies  `json:"connect"`
+	Handshake   *latencies  `json:"handshake"`
+	Upload      *throughput `json:"upload,omitempty"`
+	Download    *throughput `json:"download,omitempty"`
+}
+
+// latencies summarizes a sample of durations by percentiles.
+type latencies struct {
+	P50 time.Duration `json:"p50_ns"`
+	P90 time.Duration `json:"p90_ns"`
+	P99 time.Duration `json:"p99_ns"`
+	Max time.Duration `json:"max_ns"`
+}
+
+func newLatencies(sample []time.Duration) *latencies {
+	slices.Sort(sample)
+	return &latencies{
+		P50: percentile(sample, 50),
+		P90: percentile(sample, 90),
+		P99: percentile(sample, 99),
+		Max: sample[len(sample)-1],
+	}
+}
+
+// percentile returns the p-th percentile of the sorted sample,
+// by the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+func (l *latencies) String() string {
+	round := func(d time.Duration) string {
+		return d.Round(time.Microsecond).String()
+	}
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s, max %s", round(l.P50), round(l.P90), round(l.P99), round(l.Max))
+}
+
+type throughput struct {
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration_ns"`
+	BytesPerSec float64       `json:"bytes_per_sec"`
+}
+
+func newThroughput(n int64, d time.Duration) *throughput {
+	return &throughput{Bytes: n, Duration: d, BytesPerSec: float64(n) / d.Seconds()}
+}
+
+func (t *throughput) String() string {
+	return fmt.Sprintf("%s in %v, %s/s", ui.FormatBytes(t.Bytes), t.Duration.Round(time.Millisecond), ui.FormatBytes(int64(t.BytesPerSec)))
+}
+
+// WriteText implements output.Texter.
+func (r *benchResult) WriteText(w io.Writer) error {
+	field := func(name, value string) {
+		fmt.Fprintf(w, "%-17s %s\n", name+":", value)
+	}
+
+	field("addr", r.Addr)
+	field("handshakes", fmt.Sprintf("%d, %d at a time, %.1f/s", r.Handshakes, r.Concurrency, r.Rate))
+	field("connect", r.Connect.String())
+	field("handshake", r.Handshake.String())
+	if r.Upload != nil {
+		field("upload", r.Upload.String())
+		field("download", r.Download.String())
+	}
+
+	return nil
+}
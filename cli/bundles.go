@@ -0,0 +1,297 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/confbundle"
+	"nih.software/daemon"
+)
+
+var configPushFlags struct {
+	message string
+}
+
+var configStatusFlags struct {
+	all bool
+}
+
+var cmdConfigPush = &Command{
+	Name:    "push",
+	Args:    "FILE",
+	Summary: "push a configuration bundle to the cluster",
+	Help: `
+Push makes a configuration bundle of the manifest FILE, or of standard
+input for "-", signs it with the key of the daemon under the version after
+the newest it knows of, and has every node apply it: the daemon first,
+then the nodes it knows and reaches, which the others pull it from within
+a peer interval. The manifest is JSON:
+
+    {
+        "message": "raise the limits of the proxy",
+        "settings": {"exec-roles": "ops", "peer-interval": "10s"},
+        "files": [
+            {"path": "/etc/proxy/limits.conf", "source": "limits.conf"},
+            {"path": "/etc/proxy/motd", "mode": "0644", "content": "hello\n"}
+        ],
+        "reload": ["systemctl", "reload", "proxy"]
+    }
+
+Every node writes the files, from the file named by source, relative to
+the directory of FILE, or from content, with mode, 0644 by default,
+removes those the bundle it applied before wrote and this one does not,
+changes the live settings, reloads its credentials as on SIGHUP, and runs
+the reload command. If any of those fails, the node puts the files and
+settings back as they were, and runs the reload command of the bundle
+before again. The settings a bundle leaves out keep their values. -message
+overrides the message of the manifest.
+
+Push prints the version applied on every node, and exits with status 1
+unless every node applied the bundle. With -dry-run, push only validates
+the bundle and prints the changes of the settings of the daemon.
+
+Nodes apply the bundles signed by themselves, or by nodes holding a role
+of their serve -config-roles flag, and exchange bundles with peers holding
+one.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		configControlFlag(fs)
+		fs.StringVar(&configPushFlags.message, "message", "", "Describe the bundle with `text`")
+		fs.BoolVar(&configFlags.dryRun, "dry-run", false, "Validate and print the changes without pushing")
+	},
+	Run: runConfigPush,
+}
+
+var cmdConfigHistory = &Command{
+	Name:    "history",
+	Summary: "list the configuration bundles the daemon applied",
+	Help: `
+History prints the configuration bundles the daemon applied last, newest
+first: the first is the current configuration, and "nih config rollback"
+pushes any of them again.
+`,
+	Flags: configControlFlag,
+	Run:   runConfigHistory,
+}
+
+var cmdConfigStatus = &Command{
+	Name:    "status",
+	Summary: "print the configuration bundles applied on nodes",
+	Help: `
+Status prints the version of the configuration bundle the daemon applied
+last, and that of a later bundle it failed to apply, with the error, if
+any. With -all, it prints those of every node the daemon knows and
+reaches too.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		configControlFlag(fs)
+		fs.BoolVar(&configStatusFlags.all, "all", false, "Print the status of every node the daemon knows")
+	},
+	Run: runConfigStatus,
+}
+
+var cmdConfigRollback = &Command{
+	Name:    "rollback",
+	Args:    "VERSION",
+	Summary: "push a configuration bundle of the history again",
+	Help: `
+Rollback pushes the content of the configuration bundle VERSION of the
+history of the daemon again, under a new version, as push does, so that
+every node returns to it.
+`,
+	Flags: configControlFlag,
+	Run:   runConfigRollback,
+}
+
+// bundleManifest is the manifest of a bundle, as push reads it.
+type bundleManifest struct {
+	Message  string            `json:"message"`
+	Settings map[string]string `json:"settings"`
+	Files    []struct {
+		Path    string  `json:"path"`
+		Mode    string  `json:"mode"`
+		Source  string  `json:"source"`
+		Content *string `json:"content"`
+	} `json:"files"`
+	Reload []string `json:"reload"`
+}
+
+// readBundleManifest returns the push request of the manifest name.
+func readBundleManifest(name string) (*daemon.BundlePush, error) {
+	data, err := ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m bundleManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	dir := "."
+	if name != Stdio {
+		dir = filepath.Dir(name)
+	}
+	p := &daemon.BundlePush{
+		Message: m.Message,
+		Content: confbundle.Content{Settings: m.Settings, Reload: m.Reload},
+	}
+	for _, f := range m.Files {
+		file := confbundle.File{Path: f.Path, Mode: 0644}
+		if f.Mode != "" {
+			mode, err := strconv.ParseUint(f.Mode, 8, 32)
+			if err != nil || mode&^0777 != 0 {
+				return nil, fmt.Errorf("%s: %s: invalid mode %q", name, f.Path, f.Mode)
+			}
+			file.Mode = fs.FileMode(mode)
+		}
+		switch {
+		case f.Content != nil && f.Source != "":
+			return nil, fmt.Errorf("%s: %s: both source and content", name, f.Path)
+		case f.Content != nil:
+			file.Data = []byte(*f.Content)
+		case f.Source != "":
+			src := f.Source
+			if !filepath.IsAbs(src) {
+				src = filepath.Join(dir, src)
+			}
+			if file.Data, err = ReadFile(src); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%s: %s: neither source nor content", name, f.Path)
+		}
+		p.Files = append(p.Files, file)
+	}
+	return p, nil
+}
+
+func runConfigPush(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one FILE")
+	}
+	p, err := readBundleManifest(args[0])
+	if err != nil {
+		return err
+	}
+	if configPushFlags.message != "" {
+		p.Message = configPushFlags.message
+	}
+	p.DryRun = configFlags.dryRun
+
+	var pushed daemon.BundlePushed
+	if err := controlDo(ctx, configFlags.control, "POST", "/bundles/push", p, &pushed); err != nil {
+		return err
+	}
+	if p.DryRun {
+		return Print(&configSetResult{Changes: pushed.Changes, DryRun: true})
+	}
+	return printBundlePushed(&pushed)
+}
+
+func runConfigRollback(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one VERSION")
+	}
+	version, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil || version == 0 {
+		return Usagef("invalid version %q", args[0])
+	}
+
+	var pushed daemon.BundlePushed
+	if err := controlDo(ctx, configFlags.control, "POST", "/bundles/rollback", &daemon.BundleRollback{Version: version}, &pushed); err != nil {
+		return err
+	}
+	return printBundlePushed(&pushed)
+}
+
+// printBundlePushed prints the states of the nodes a bundle was pushed
+// to, and fails unless every node applied it.
+func printBundlePushed(pushed *daemon.BundlePushed) error {
+	if err := printBundleStatuses(pushed, pushed.Nodes); err != nil {
+		return err
+	}
+	for _, s := range pushed.Nodes {
+		if s.Version != pushed.Version || s.Error != "" {
+			return exitStatus(ExitFailure)
+		}
+	}
+	return nil
+}
+
+// printBundleStatuses prints statuses, or v as JSON.
+func printBundleStatuses(v any, statuses []daemon.BundleStatus) error {
+	if Global.Output == output.JSON {
+		return Print(v)
+	}
+	t := output.NewTable("NODE", "VERSION", "APPLIED", "RESULT")
+	for _, s := range statuses {
+		version, applied, result := "-", "-", "ok"
+		if s.Version != 0 {
+			version = strconv.FormatUint(s.Version, 10)
+			applied = s.Applied.Format(time.RFC3339)
+		}
+		switch {
+		case s.Failed != 0:
+			result = fmt.Sprintf("%d failed: %s", s.Failed, s.Error)
+		case s.Error != "":
+			result = s.Error
+		}
+		t.Append(s.Node, version, applied, result)
+	}
+	return Print(t)
+}
+
+func runConfigStatus(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("status takes no arguments")
+	}
+	path := "/bundles/status"
+	if configStatusFlags.all {
+		path += "?all=1"
+	}
+	var statuses []daemon.BundleStatus
+	if err := controlGet(ctx, configFlags.control, path, &statuses); err != nil {
+		return err
+	}
+	return printBundleStatuses(statuses, statuses)
+}
+
+func runConfigHistory(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("history takes no arguments")
+	}
+	var list []daemon.BundleInfo
+	if err := controlGet(ctx, configFlags.control, "/bundles/history", &list); err != nil {
+		return err
+	}
+
+	if Global.Output == output.JSON {
+		return Print(list)
+	}
+	t := output.NewTable("VERSION", "CREATED", "SIGNER", "CONTENT", "MESSAGE")
+	for _, b := range list {
+		var content []string
+		if n := len(b.Settings); n > 0 {
+			content = append(content, fmt.Sprintf("%d settings", n))
+		}
+		if n := len(b.Files); n > 0 {
+			content = append(content, fmt.Sprintf("%d files", n))
+		}
+		if len(b.Reload) > 0 {
+			content = append(content, "reload")
+		}
+		if len(content) == 0 {
+			content = []string{"-"}
+		}
+		t.Append(strconv.FormatUint(b.Version, 10), b.Created.Format(time.RFC3339), b.Signer, strings.Join(content, ", "), b.Message)
+	}
+	return Print(t)
+}
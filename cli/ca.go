@@ -0,0 +1,295 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"nih.software/cli/ui"
+	"nih.software/trust/trustgen"
+)
+
+// defaultCADir is where "nih ca init" creates a CA and "nih ca sign" finds it.
+const defaultCADir = "etc/ca"
+
+// File names of a CA directory.
+const (
+	caRootCert         = "root.pem"
+	caRootKey          = "root.key"
+	caIntermediateCert = "intermediate.pem"
+	caIntermediateKey  = "intermediate.key"
+	caDB               = "issued.json"
+)
+
+var cmdCA = &Command{
+	Name:    "ca",
+	Summary: "create and operate a certificate authority",
+	Help: `
+A CA directory, etc/ca by default, holds a root and an intermediate CA
+and the issuance database of the intermediate:
+
+    root.pem, root.key                  the root CA
+    intermediate.pem, intermediate.key  the intermediate CA, which signs
+    issued.json                         every serial number issued
+
+The directory and the files are only accessible to their owner.
+After "nih ca init", move root.key offline: it is only needed to issue
+another intermediate.
+`,
+	Commands: []*Command{cmdCAInit, cmdCASign},
+}
+
+func init() {
+	Register(cmdCA)
+}
+
+var caFlags struct {
+	dir      string
+	cn       string
+	org      string
+	keyType  string
+	force    bool
+	profile  string
+	lifetime time.Duration
+	out      string
+	g        generator
+}
+
+var cmdCAInit = &Command{
+	Name:    "init",
+	Summary: "create a root and an intermediate CA",
+	Help: `
+Init generates a root CA and an intermediate CA issued by it into -dir,
+which is created with permissions for its owner only.
+
+Existing files are only replaced with -force. The four files of the CAs
+are written all or none.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		caFlags.force = false
+		fs.StringVar(&caFlags.dir, "dir", defaultCADir, "CA `directory`")
+		fs.StringVar(&caFlags.cn, "cn", "nih", "Common `name` of the CAs, followed by \"Root CA\" and \"Intermediate CA\"")
+		fs.StringVar(&caFlags.org, "org", "", "Subject organization `name`")
+		fs.StringVar(&caFlags.keyType, "key-type", "", "Key `type`: ed25519, ecdsa-p256, ecdsa-p384, rsa-2048, or rsa-4096\n(default: ed25519)")
+		fs.BoolVar(&caFlags.force, "force", false, "Overwrite an existing CA")
+	},
+	Run: runCAInit,
+}
+
+func runCAInit(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	dir := caFlags.dir
+
+	// Check before generating, which records serials in the database.
+	if !caFlags.force {
+		for _, name := range []string{caRootKey, caRootCert, caIntermediateKey, caIntermediateCert} {
+			if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, fs.ErrNotExist) {
+				return &Error{Code: ExitFailure, Err: fmt.Errorf("%s already exists", filepath.Join(dir, name)),
+					Hint: "Use -force to replace the CA, which invalidates every certificate it issued."}
+			}
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+
+	db, err := trustgen.OpenDB(filepath.Join(dir, caDB))
+	if err != nil {
+		return err
+	}
+
+	opts := []trustgen.Option{trustgen.WithDB(db)}
+	if caFlags.keyType != "" {
+		t, err := trustgen.ParseKeyType(caFlags.keyType)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, trustgen.WithKeyType(t))
+	}
+
+	name := func(kind string) trustgen.Option {
+		n := pkix.Name{CommonName: caFlags.cn + " " + kind}
+		if caFlags.org != "" {
+			n.Organization = []string{caFlags.org}
+		}
+		return trustgen.WithSubject(n)
+	}
+
+	sp := ui.NewSpinner("generating root and intermediate CAs")
+	rootCert, rootKey, err := trustgen.NewRoot(append(opts, name("Root CA"))...)
+	if err != nil {
+		sp.Stop()
+		return err
+	}
+
+	root, err := trustgen.NewCA(rootCert, rootKey, opts...)
+	if err != nil {
+		sp.Stop()
+		return err
+	}
+
+	inter, err := root.NewIntermediate(name("Intermediate CA"))
+	sp.Stop()
+	if err != nil {
+		return err
+	}
+
+	// The files are written all or none, so that a failure leaves no CA
+	// whose root did not issue the intermediate beside it.
+	files := []outputFile{
+		{filepath.Join(dir, caRootKey), trustgen.PEMEncodePrivateKey(rootKey)},
+		{filepath.Join(dir, caRootCert), trustgen.PEMEncodeCertificates(rootCert)},
+		{filepath.Join(dir, caIntermediateKey), trustgen.PEMEncodePrivateKey(inter.Key)},
+		{filepath.Join(dir, caIntermediateCert), trustgen.PEMEncodeCertificates(inter.Cert)},
+	}
+	if err := writeFiles(files, caFlags.force); err != nil {
+		return err
+	}
+
+	r := &caInitResult{Dir: dir}
+	for _, f := range files {
+		r.Files = append(r.Files, f.name)
+	}
+
+	return Print(r)
+}
+
+type caInitResult struct {
+	Dir   string   `json:"dir"`
+	Files []string `json:"files"`
+}
+
+// WriteText implements output.Texter.
+func (r *caInitResult) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "created CA in %s\n", r.Dir)
+	for _, name := range r.Files {
+		fmt.Fprintf(w, "  wrote %s\n", name)
+	}
+	fmt.Fprintf(w, "Install %s as the CA certificates of every node,\n", filepath.Join(r.Dir, caRootCert))
+	fmt.Fprintf(w, "and move %s offline.\n", filepath.Join(r.Dir, caRootKey))
+	return nil
+}
+
+// Signing profiles of "nih ca sign".
+var caProfiles = map[string]string{
+	"node":         "a node certificate, for client and server authentication",
+	"web":          "a node certificate meeting browser requirements, for HTTPS",
+	"intermediate": "an intermediate CA certificate",
+}
+
+var cmdCASign = &Command{
+	Name:    "sign",
+	Args:    "[FILE]",
+	Summary: "sign a certificate request",
+	Help: `
+Sign issues a certificate for the certificate request in FILE, or on
+standard input if FILE is absent or -, with the intermediate CA in -dir,
+and writes the certificate chain to -out. The subject and subject
+alternative names are copied from the request.
+
+The -profile flag chooses the kind of certificate:
+
+    node          a node certificate, for client and server authentication
+    web           a node certificate meeting browser requirements, for HTTPS
+    intermediate  an intermediate CA certificate
+
+Create requests with "nih trustgen csr" on the machine that keeps the key.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		caFlags.g = generator{}
+		caFlags.force = false
+		fs.StringVar(&caFlags.dir, "dir", defaultCADir, "CA `directory`")
+		fs.StringVar(&caFlags.g.issuerCert, "issuer-cert", "", "Issuing CA certificate `file`\n(default: intermediate.pem in -dir)")
+		fs.StringVar(&caFlags.g.issuerKey, "issuer-key", "", "Issuing CA private key `file`\n(default: intermediate.key in -dir)")
+		fs.StringVar(&caFlags.g.db, "db", "", "Issuance database `file` recording serials and revocations\n(default: issued.json in -dir)")
+		fs.StringVar(&caFlags.profile, "profile", "node", "Certificate `profile`: node, web, or intermediate")
+		fs.DurationVar(&caFlags.lifetime, "lifetime", 0, "Certificate `lifetime`\n(default: 1 year, or 5 years for an intermediate)")
+		fs.StringVar(&caFlags.out, "out", Stdio, "Output certificate chain `file`, or - for standard output")
+		fs.BoolVar(&caFlags.force, "force", false, "Overwrite an existing output file")
+	},
+	Run: runCASign,
+}
+
+func runCASign(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return Usagef("need at most one certificate request")
+	}
+
+	if _, ok := caProfiles[caFlags.profile]; !ok {
+		return Usagef("unknown profile %q", caFlags.profile)
+	}
+
+	in := Stdio
+	if len(args) == 1 {
+		in = args[0]
+	}
+
+	data, err := ReadFile(in)
+	if err != nil {
+		return err
+	}
+
+	csr, err := trustgen.ParseCertificateRequestPEM(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+
+	g := caFlags.g
+	if g.issuerCert == "" {
+		g.issuerCert = filepath.Join(caFlags.dir, caIntermediateCert)
+	}
+	if g.issuerKey == "" {
+		g.issuerKey = filepath.Join(caFlags.dir, caIntermediateKey)
+	}
+	if g.db == "" {
+		g.db = filepath.Join(caFlags.dir, caDB)
+	}
+	g.lifetime = caFlags.lifetime
+	g.web = caFlags.profile == "web"
+
+	opts, err := g.options()
+	if err != nil {
+		return err
+	}
+
+	ca, err := g.loadCA(opts)
+	if err != nil {
+		return err
+	}
+
+	req := []trustgen.Option{trustgen.WithSubject(csr.Subject)}
+	if caFlags.profile != "intermediate" {
+		req = append(req,
+			trustgen.WithDNSNames(csr.DNSNames...),
+			trustgen.WithIPAddresses(csr.IPAddresses...))
+	}
+
+	var crt *x509.Certificate
+	if caFlags.profile == "intermediate" {
+		crt, err = ca.SignIntermediate(csr.PublicKey, req...)
+	} else {
+		crt, err = ca.SignLeaf(csr.PublicKey, req...)
+	}
+	if err != nil {
+		return err
+	}
+
+	ui.Debug("signed %s, serial %s, expires %s", crt.Subject, crt.SerialNumber, crt.NotAfter.Format(time.RFC3339))
+
+	return WriteFile(caFlags.out, trustgen.PEMEncodeCertificates(ca.ChainFor(crt)...), caFlags.force)
+}
@@ -0,0 +1,385 @@
+package cli
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"nih.software/peers"
+	"nih.software/trust"
+)
+
+var cmdCert = &Command{
+	Name:    "cert",
+	Summary: "inspect and manage certificates",
+}
+
+var inspectFlags struct {
+	connect string
+}
+
+var cmdCertInspect = &Command{
+	Name:    "inspect",
+	Args:    "[FILE...]",
+	Summary: "print the details of certificates and check their chain",
+	Help: `
+Inspect reads each FILE, PEM or DER, as a chain: a leaf followed by any
+intermediates, or a single CA certificate. A FILE of "-" is standard input.
+With -connect, it inspects the chain presented by a live peer instead,
+authenticating with the global credentials if they can be loaded.
+
+Every chain is verified against the CA certificates of the global -ca flag,
+by the rules instances apply to each other; run "nih help trust" for them.
+Inspect fails if any chain does not verify.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		inspectFlags.connect = ""
+		fs.StringVar(&inspectFlags.connect, "connect", "", "Inspect the chain of the peer at `host:port`")
+	},
+	Run: runCertInspect,
+}
+
+func init() {
+	cmdCert.Commands = append(cmdCert.Commands, cmdCertInspect)
+	Register(cmdCert)
+}
+
+func runCertInspect(ctx context.Context, args []string) error {
+	if (len(args) == 0) == (inspectFlags.connect == "") {
+		return Usagef("need either files or -connect")
+	}
+
+	var result inspectResult
+	if inspectFlags.connect != "" {
+		chain, err := peerChain(ctx, inspectFlags.connect)
+		if err != nil {
+			return err
+		}
+		result = append(result, newChainInfo(inspectFlags.connect, chain))
+	}
+
+	for _, name := range args {
+		data, err := ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		chain, err := parseCertificates(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		result = append(result, newChainInfo(name, chain))
+	}
+
+	roots, rootsErr := loadRoots()
+	for _, c := range result {
+		c.verify(roots, rootsErr)
+	}
+
+	if err := Print(result); err != nil {
+		return err
+	}
+
+	for _, c := range result {
+		if !c.Verified {
+			return TrustError(fmt.Errorf("%s: %s", c.Source, c.VerifyError), "")
+		}
+	}
+
+	return nil
+}
+
+// parseCertificates parses PEM CERTIFICATE blocks or, failing that, DER certificates.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if blk, _ := pem.Decode(data); blk != nil {
+		certs, err := trust.ParseCertificatesPEM(data)
+		if err == nil && len(certs) == 0 {
+			err = errors.New("no certificate found")
+		}
+		return certs, err
+	}
+
+	return x509.ParseCertificates(data)
+}
+
+// loadRoots loads the CA certificates named by the global -ca flag.
+func loadRoots() ([]*x509.Certificate, error) {
+	data, err := ReadFile(Global.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := parseCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", Global.CAFile, err)
+	}
+	return roots, nil
+}
+
+// peerChain returns the certificate chain presented by the peer at addr.
+// The global credentials are presented as a client certificate if they load.
+func peerChain(ctx context.Context, addr string) ([]*x509.Certificate, error) {
+	config := &tls.Config{
+		// The chain is verified afterwards, and reported rather than rejected.
+		InsecureSkipVerify: true,
+	}
+
+	if b, err := loadCredentials(); err == nil {
+		config.GetClientCertificate = b.TLSConfig().GetClientCertificate
+	}
+
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	d := tls.Dialer{Config: config}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.(*tls.Conn).ConnectionState().PeerCertificates, nil
+}
+
+type inspectResult []*chainInfo
+
+// chainInfo describes a certificate chain read from Source.
+type chainInfo struct {
+	Source       string      `json:"source"`
+	Certificates []*certInfo `json:"certificates"`
+	Verified     bool        `json:"verified"`
+	VerifyError  string      `json:"verify_error,omitempty"`
+
+	chain []*x509.Certificate
+}
+
+type certInfo struct {
+	Subject        string    `json:"subject"`
+	Issuer         string    `json:"issuer"`
+	Serial         string    `json:"serial"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+	DNSNames       []string  `json:"dns_names,omitempty"`
+	IPAddresses    []string  `json:"ip_addresses,omitempty"`
+	URIs           []string  `json:"uris,omitempty"`
+	EmailAddresses []string  `json:"email_addresses,omitempty"`
+	KeyType        string    `json:"key_type"`
+	KeyUsage       []string  `json:"key_usage,omitempty"`
+	ExtKeyUsage    []string  `json:"ext_key_usage,omitempty"`
+	IsCA           bool      `json:"is_ca"`
+	SubjectKeyID   string    `json:"subject_key_id,omitempty"`
+	AuthorityKeyID string    `json:"authority_key_id,omitempty"`
+	SHA256         string    `json:"sha256"`
+	KeyPin         string    `json:"key_pin"`
+}
+
+func newChainInfo(source string, chain []*x509.Certificate) *chainInfo {
+	info := &chainInfo{Source: source, chain: chain}
+	for _, c := range chain {
+		info.Certificates = append(info.Certificates, newCertInfo(c))
+	}
+	return info
+}
+
+func (info *chainInfo) verify(roots []*x509.Certificate, rootsErr error) {
+	err := rootsErr
+	if err == nil {
+		err = trust.VerifyChain(info.chain, roots)
+	}
+
+	info.Verified = err == nil
+	if err != nil {
+		info.VerifyError = err.Error()
+	}
+}
+
+func newCertInfo(c *x509.Certificate) *certInfo {
+	info := &certInfo{
+		Subject:        c.Subject.String(),
+		Issuer:         c.Issuer.String(),
+		Serial:         c.SerialNumber.String(),
+		NotBefore:      c.NotBefore,
+		NotAfter:       c.NotAfter,
+		DNSNames:       c.DNSNames,
+		EmailAddresses: c.EmailAddresses,
+		KeyType:        describeKey(c.PublicKey),
+		KeyUsage:       describeKeyUsage(c.KeyUsage),
+		IsCA:           c.IsCA,
+		SubjectKeyID:   hexColons(c.SubjectKeyId),
+		AuthorityKeyID: hexColons(c.AuthorityKeyId),
+	}
+
+	for _, ip := range c.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	for _, u := range c.URIs {
+		info.URIs = append(info.URIs, u.String())
+	}
+	for _, u := range c.ExtKeyUsage {
+		info.ExtKeyUsage = append(info.ExtKeyUsage, describeExtKeyUsage(u))
+	}
+
+	sum := sha256.Sum256(c.Raw)
+	info.SHA256 = hexColons(sum[:])
+	info.KeyPin = peers.Pin(c)
+
+	return info
+}
+
+func describeKey(pub any) string {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return "ed25519"
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(strings.ReplaceAll(k.Curve.Params().Name, "-", ""))
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", k.N.BitLen())
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
+
+var keyUsageNames = []string{
+	"digital signature",
+	"content commitment",
+	"key encipherment",
+	"data encipherment",
+	"key agreement",
+	"certificate signing",
+	"CRL signing",
+	"encipher only",
+	"decipher only",
+}
+
+func describeKeyUsage(u x509.KeyUsage) []string {
+	var names []string
+	for i, name := range keyUsageNames {
+		if u&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "server auth",
+	x509.ExtKeyUsageClientAuth:      "client auth",
+	x509.ExtKeyUsageCodeSigning:     "code signing",
+	x509.ExtKeyUsageEmailProtection: "email protection",
+	x509.ExtKeyUsageTimeStamping:    "time stamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSP signing",
+}
+
+func describeExtKeyUsage(u x509.ExtKeyUsage) string {
+	if name, ok := extKeyUsageNames[u]; ok {
+		return name
+	}
+	return fmt.Sprintf("ExtKeyUsage(%d)", int(u))
+}
+
+func hexColons(b []byte) string {
+	var s strings.Builder
+	for i, c := range b {
+		if i > 0 {
+			s.WriteByte(':')
+		}
+		fmt.Fprintf(&s, "%02X", c)
+	}
+	return s.String()
+}
+
+// WriteText implements output.Texter.
+func (r inspectResult) WriteText(w io.Writer) error {
+	for i, info := range r {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		if err := info.writeText(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (info *chainInfo) writeText(w io.Writer) error {
+	u := Global.UI()
+
+	fmt.Fprintf(w, "%s\n", info.Source)
+	for i, c := range info.Certificates {
+		fmt.Fprintf(w, "\n  [%d] %s\n", i, orEmpty(c.Subject))
+
+		field := func(name, value string) {
+			if value != "" {
+				fmt.Fprintf(w, "      %-17s %s\n", name+":", value)
+			}
+		}
+
+		field("issuer", orEmpty(c.Issuer))
+		field("serial", c.Serial)
+		field("not before", c.NotBefore.Format(time.RFC3339))
+		field("not after", c.NotAfter.Format(time.RFC3339)+" ("+validity(time.Now(), c.NotBefore, c.NotAfter)+")")
+		field("dns names", strings.Join(c.DNSNames, ", "))
+		field("ip addresses", strings.Join(c.IPAddresses, ", "))
+		field("uris", strings.Join(c.URIs, ", "))
+		field("emails", strings.Join(c.EmailAddresses, ", "))
+		field("key", c.KeyType)
+		field("key usage", strings.Join(c.KeyUsage, ", "))
+		field("ext key usage", strings.Join(c.ExtKeyUsage, ", "))
+		if c.IsCA {
+			field("ca", "yes")
+		}
+		field("subject key id", c.SubjectKeyID)
+		field("authority key id", c.AuthorityKeyID)
+		field("sha256", c.SHA256)
+		field("key pin", c.KeyPin)
+	}
+
+	if info.Verified {
+		_, err := fmt.Fprintf(w, "\n  chain: %s\n", u.Green("OK"))
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n  chain: %s\n", u.Red("ERROR: "+info.VerifyError))
+	return err
+}
+
+func orEmpty(s string) string {
+	if s == "" {
+		return "(empty)"
+	}
+	return s
+}
+
+// validity describes how long a certificate valid from notBefore until notAfter
+// has left at now, such as "expires in 364 days" or "expired 2 days ago".
+func validity(now, notBefore, notAfter time.Time) string {
+	days := func(d time.Duration) string {
+		n := int(math.Round(d.Hours() / 24))
+		if n == 1 {
+			return "1 day"
+		}
+		return fmt.Sprintf("%d days", n)
+	}
+
+	switch {
+	case now.Before(notBefore):
+		return "not valid for " + days(notBefore.Sub(now))
+	case now.After(notAfter):
+		return "expired " + days(now.Sub(notAfter)) + " ago"
+	default:
+		return "expires in " + days(notAfter.Sub(now))
+	}
+}
@@ -0,0 +1,191 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var checkFlags struct {
+	warn     time.Duration
+	critical time.Duration
+	textfile string
+}
+
+// Check statuses, which are also the exit codes of "nih cert check", as in Nagios.
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+)
+
+var checkStatusNames = []string{"OK", "WARNING", "CRITICAL"}
+
+var cmdCertCheck = &Command{
+	Name:    "check",
+	Summary: "check the credentials for monitoring",
+	Help: `
+Check verifies the credentials of the global -cert, -key, and -ca flags
+and prints a one-line summary. Unlike other commands, it exits with the
+status of the check, as Nagios plugins do:
+
+    0  OK        the credentials are valid and not expiring soon
+    1  WARNING   a certificate expires within -warn
+    2  CRITICAL  a certificate expires within -critical,
+                 or the credentials are invalid or missing
+
+With -textfile, check also writes the result as Prometheus metrics, for
+the textfile collector of the node exporter. The file is replaced atomically.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		checkFlags.textfile = ""
+		fs.DurationVar(&checkFlags.warn, "warn", 30*24*time.Hour, "Warn if a certificate expires within `duration`")
+		fs.DurationVar(&checkFlags.critical, "critical", 7*24*time.Hour, "Fail if a certificate expires within `duration`")
+		fs.StringVar(&checkFlags.textfile, "textfile", "", "Also write Prometheus metrics to `file`")
+	},
+	Run: runCertCheck,
+}
+
+func init() {
+	cmdCert.Commands = append(cmdCert.Commands, cmdCertCheck)
+}
+
+func runCertCheck(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	r := checkCredentials(time.Now(), checkFlags.warn, checkFlags.critical)
+
+	if checkFlags.textfile != "" {
+		var b strings.Builder
+		r.writeMetrics(&b)
+		if err := writeFileAtomic(checkFlags.textfile, []byte(b.String())); err != nil {
+			return err
+		}
+	}
+
+	if err := Print(r); err != nil {
+		return err
+	}
+
+	if r.code != checkOK {
+		return exitStatus(r.code)
+	}
+
+	return nil
+}
+
+// checkResult is the result of "nih cert check".
+type checkResult struct {
+	Status       string       `json:"status"`
+	Message      string       `json:"message"`
+	Certificates []*checkCert `json:"certificates,omitempty"`
+
+	code int
+}
+
+type checkCert struct {
+	File     string    `json:"file"`
+	Role     string    `json:"role"` // leaf, intermediate, or root
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+func checkCredentials(now time.Time, warn, critical time.Duration) *checkResult {
+	r := &checkResult{}
+
+	fail := func(err error) *checkResult {
+		r.code, r.Status = checkCritical, checkStatusNames[checkCritical]
+		r.Message = err.Error()
+		return r
+	}
+
+	b, err := loadCredentials()
+	if err != nil {
+		return fail(err)
+	}
+
+	crt, err := b.TLSConfig().GetCertificate(nil)
+	if err != nil {
+		return fail(err)
+	}
+
+	roots, err := loadRoots()
+	if err != nil {
+		return fail(err)
+	}
+
+	add := func(file, role string, c *x509.Certificate) {
+		r.Certificates = append(r.Certificates, &checkCert{
+			File:     file,
+			Role:     role,
+			Serial:   c.SerialNumber.String(),
+			NotAfter: c.NotAfter,
+		})
+	}
+
+	add(Global.CertFile, "leaf", crt.Leaf)
+	for _, der := range crt.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fail(err)
+		}
+		add(Global.CertFile, "intermediate", c)
+	}
+	for _, c := range roots {
+		add(Global.CAFile, "root", c)
+	}
+
+	first := r.Certificates[0]
+	for _, c := range r.Certificates {
+		if c.NotAfter.Before(first.NotAfter) {
+			first = c
+		}
+	}
+
+	left := first.NotAfter.Sub(now)
+	switch {
+	case left <= critical:
+		r.code = checkCritical
+	case left <= warn:
+		r.code = checkWarning
+	}
+
+	r.Status = checkStatusNames[r.code]
+	r.Message = fmt.Sprintf("%s %s (serial %s in %s)", first.Role, validity(now, time.Time{}, first.NotAfter), first.Serial, first.File)
+	return r
+}
+
+// WriteText implements output.Texter.
+func (r *checkResult) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "CERT %s - %s\n", r.Status, r.Message)
+	return err
+}
+
+func (r *checkResult) writeMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP nih_cert_check_status Result of nih cert check: 0 OK, 1 warning, 2 critical.\n")
+	fmt.Fprintf(w, "# TYPE nih_cert_check_status gauge\n")
+	fmt.Fprintf(w, "nih_cert_check_status %d\n", r.code)
+
+	fmt.Fprintf(w, "# HELP nih_cert_not_after_timestamp_seconds Expiry time of each certificate in the credentials.\n")
+	fmt.Fprintf(w, "# TYPE nih_cert_not_after_timestamp_seconds gauge\n")
+	for _, c := range r.Certificates {
+		fmt.Fprintf(w, "nih_cert_not_after_timestamp_seconds{file=%q,role=%q,serial=%q} %d\n",
+			promLabel(c.File), c.Role, c.Serial, c.NotAfter.Unix())
+	}
+}
+
+// promLabel returns the absolute form of file for use as a label value,
+// so that metrics do not depend on the directory check ran in.
+func promLabel(file string) string {
+	if abs, err := filepath.Abs(file); err == nil && file != Stdio {
+		return abs
+	}
+	return file
+}
@@ -0,0 +1,318 @@
+package cli
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"nih.software/cli/ui"
+	"nih.software/trust"
+	"nih.software/trust/join"
+	"nih.software/trust/trustgen"
+)
+
+var rotateFlags struct {
+	caNode     string
+	issuerCert string
+	issuerKey  string
+	db         string
+	lifetime   time.Duration
+	keyType    string
+	pidFile    string
+	control    string
+}
+
+var cmdCertRotate = &Command{
+	Name:    "rotate",
+	Summary: "replace the leaf certificate and key with new ones",
+	Help: `
+Rotate generates a new key and leaf certificate with the subject and names
+of the current leaf, and installs them in place of the global -cert and -key
+files. The certificate is issued by -issuer-cert or, for nodes without the
+CA key, by the CA node listening on the address of -ca-node: rotate
+authenticates to it with the current leaf, and the CA node issues the new
+certificate with the subject and names of that leaf. The new chain must
+verify against the global -ca certificates before anything is replaced.
+
+Before replacing the files, rotate asks for confirmation, unless the global
+-yes is set; without an answer, as in scripts, it fails. The current files
+are kept as backups next to them, suffixed with the time of rotation, such
+as cert.pem.20261018T120000Z.bak. The new files are written in full before
+either replaces its current file, and if the second cannot, the first is
+restored, so that a key is never installed without its certificate.
+
+With -control, the daemon listening on that control socket reloads its
+credentials, as "nih reload" has it. With -pid-file, the daemon whose
+process ID the file contains is sent SIGHUP to reload them instead.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		rotateFlags = struct {
+			caNode     string
+			issuerCert string
+			issuerKey  string
+			db         string
+			lifetime   time.Duration
+			keyType    string
+			pidFile    string
+			control    string
+		}{}
+
+		fs.StringVar(&rotateFlags.caNode, "ca-node", "", "Renew the certificate at the CA node listening on `addr`, host[:port]")
+		fs.StringVar(&rotateFlags.issuerCert, "issuer-cert", "", "Issuing CA certificate `file`, or - for standard input")
+		fs.StringVar(&rotateFlags.issuerKey, "issuer-key", "", "Issuing CA private key `file`, or - for standard input")
+		fs.StringVar(&rotateFlags.db, "db", "", "Issuance database `file` recording serials and revocations")
+		fs.DurationVar(&rotateFlags.lifetime, "lifetime", 0, "Certificate `lifetime`\n(default: 1 year)")
+		fs.StringVar(&rotateFlags.keyType, "key-type", "", "Key `type`: ed25519, ecdsa-p256, ecdsa-p384, rsa-2048, or rsa-4096\n(default: the type of the current key)")
+		fs.StringVar(&rotateFlags.pidFile, "pid-file", "", "Send SIGHUP to the daemon whose process ID is in `file`")
+		fs.StringVar(&rotateFlags.control, "control", "", "Reload the daemon listening on the control socket `file`")
+	},
+	Run: runCertRotate,
+}
+
+func init() {
+	cmdCert.Commands = append(cmdCert.Commands, cmdCertRotate)
+}
+
+func runCertRotate(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	remote := rotateFlags.caNode != ""
+	local := rotateFlags.issuerCert != "" || rotateFlags.issuerKey != "" || rotateFlags.db != "" || rotateFlags.lifetime != 0
+	switch {
+	case remote && local:
+		return Usagef("-ca-node cannot be used with -issuer-cert, -issuer-key, -db, or -lifetime")
+	case !remote && (rotateFlags.issuerCert == "" || rotateFlags.issuerKey == ""):
+		return Usagef("-ca-node, or -issuer-cert and -issuer-key, are required")
+	}
+
+	if Global.CertFile == Stdio || Global.KeyFile == Stdio {
+		return Usagef("-cert and -key must name files to rotate")
+	}
+
+	current, err := trust.LoadCertificates(Global.CertFile)
+	if err != nil {
+		return err
+	}
+	if len(current) == 0 {
+		return fmt.Errorf("%s: no certificate found", Global.CertFile)
+	}
+	leaf := current[0]
+
+	opts := []trustgen.Option{
+		trustgen.WithSubject(leaf.Subject),
+		trustgen.WithDNSNames(leaf.DNSNames...),
+		trustgen.WithIPAddresses(leaf.IPAddresses...),
+	}
+
+	keyType := rotateFlags.keyType
+	if keyType == "" {
+		keyType = describeKey(leaf.PublicKey)
+	}
+	t, err := trustgen.ParseKeyType(keyType)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, trustgen.WithKeyType(t))
+
+	var chain []*x509.Certificate
+	var key crypto.Signer
+	if remote {
+		chain, key, err = renewLeaf(ctx, opts)
+	} else {
+		chain, key, err = issueLeaf(opts)
+	}
+	if err != nil {
+		return err
+	}
+	crt := chain[0]
+
+	roots, err := loadRoots()
+	if err != nil {
+		return err
+	}
+
+	if _, err := trust.NewBundle(chain, key, roots); err != nil {
+		return TrustError(fmt.Errorf("new credentials do not verify: %w", err),
+			"Check that the issuer chains to the CA certificates of -ca.")
+	}
+
+	if err := confirm(fmt.Sprintf("Replace %s and %s, keeping backups?", Global.CertFile, Global.KeyFile)); err != nil {
+		return err
+	}
+
+	suffix := backupSuffix(time.Now())
+	files := []outputFile{
+		{Global.KeyFile, trustgen.PEMEncodePrivateKey(key)},
+		{Global.CertFile, trustgen.PEMEncodeCertificates(chain...)},
+	}
+
+	for _, f := range files {
+		if err := backupFile(f.name, f.name+suffix); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFiles(files, true); err != nil {
+		return err
+	}
+
+	ui.Success("rotated %s and %s, serial %s, expires %s",
+		Global.CertFile, Global.KeyFile, crt.SerialNumber, crt.NotAfter.Format(time.RFC3339))
+	ui.Info("backups: %s, %s", Global.CertFile+suffix, Global.KeyFile+suffix)
+
+	if rotateFlags.control != "" {
+		r, err := controlReload(ctx, rotateFlags.control)
+		if err != nil {
+			return fmt.Errorf("credentials rotated, but reload failed: %w", err)
+		}
+		ui.Info("the daemon at %s reloaded, serving serial %s", rotateFlags.control, r.Serial)
+	} else if rotateFlags.pidFile != "" {
+		if err := signalReload(rotateFlags.pidFile); err != nil {
+			return fmt.Errorf("credentials rotated, but reload failed: %w", err)
+		}
+		ui.Info("sent SIGHUP to the daemon in %s", rotateFlags.pidFile)
+	}
+
+	return nil
+}
+
+// issueLeaf generates a key and a leaf certificate with opts, issued by the
+// CA of -issuer-cert, and returns its chain and key.
+func issueLeaf(opts []trustgen.Option) ([]*x509.Certificate, crypto.Signer, error) {
+	if rotateFlags.lifetime != 0 {
+		opts = append(opts, trustgen.WithLifetime(rotateFlags.lifetime))
+	}
+
+	if rotateFlags.db != "" {
+		db, err := trustgen.OpenDB(rotateFlags.db)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, trustgen.WithDB(db))
+	}
+
+	g := generator{issuerCert: rotateFlags.issuerCert, issuerKey: rotateFlags.issuerKey}
+	ca, err := g.loadCA(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sp := ui.NewSpinner("generating key and certificate")
+	crt, key, err := ca.NewLeaf()
+	sp.Stop()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ca.ChainFor(crt), key, nil
+}
+
+// renewLeaf generates a key with opts and has the CA node of -ca-node
+// renew the current leaf for it, and returns the chain issued and the key.
+func renewLeaf(ctx context.Context, opts []trustgen.Option) ([]*x509.Certificate, crypto.Signer, error) {
+	b, err := loadCredentials()
+	if err != nil {
+		return nil, nil, TrustError(fmt.Errorf("load credentials: %w", err), "")
+	}
+
+	sp := ui.NewSpinner("generating key")
+	csr, key, err := trustgen.NewCSR(opts...)
+	sp.Stop()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr := withDefaultPort(rotateFlags.caNode)
+	rctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	sp = ui.NewSpinner("renewing at " + addr)
+	res, err := join.Renew(rctx, b, addr, csr)
+	sp.Stop()
+
+	switch {
+	case errors.Is(err, join.ErrRenewalRejected):
+		return nil, nil, TrustError(err, "Check that "+addr+" is the CA node that issued the current certificate.")
+	case err != nil:
+		return nil, nil, err
+	}
+
+	return res.Chain, key, nil
+}
+
+// confirm asks the user whether to go on with prompt, a question, as dev
+// preflight does: it goes on without asking with the global -yes, and
+// fails if the user declines or nobody answers, as in scripts without -yes.
+func confirm(prompt string) error {
+	ok, err := ui.Confirm(prompt)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("declined")
+	}
+
+	return nil
+}
+
+// backupSuffix returns the suffix of the backups of files replaced at t,
+// such as .20261018T120000Z.bak.
+func backupSuffix(t time.Time) string {
+	return "." + t.UTC().Format("20060102T150405Z") + ".bak"
+}
+
+// backupFile copies the file src to dst, which must not exist.
+func backupFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return WriteFile(dst, data, false)
+}
+
+// writeFileAtomic replaces the named file with data, with mode 0600,
+// by writing a temporary file in the same directory and renaming it.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := writeTemp(name, data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// signalReload sends SIGHUP to the process whose ID is in pidFile.
+func signalReload(pidFile string) error {
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return errors.New(pidFile + ": invalid process ID")
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return p.Signal(syscall.SIGHUP)
+}
@@ -0,0 +1,203 @@
+// Package clitest runs nih commands in tests and captures their results.
+//
+// Commands run in a child process, so each run gets fresh global state,
+// its own environment and working directory, and a real exit code.
+// The child is the test binary itself, re-executed as nih by Main:
+//
+//	func TestMain(m *testing.M) {
+//		clitest.Main(m)
+//	}
+//
+//	func TestPing(t *testing.T) {
+//		dir := clitest.Credentials(t)
+//		res := clitest.Run(t, clitest.Cmd{Dir: dir, Args: []string{"ping", addr}})
+//		if res.ExitCode != 0 { ... }
+//	}
+package clitest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nih.software/cli"
+	"nih.software/trust/trustgen"
+)
+
+// envChild marks the re-executed test binary as nih.
+const envChild = "NIH_CLITEST_CHILD"
+
+// Main runs the tests, unless the process is a child started by Run,
+// in which case it runs nih with the child's arguments and exits.
+func Main(m *testing.M) {
+	if os.Getenv(envChild) == "1" {
+		os.Exit(cli.Main(os.Args[1:]))
+	}
+
+	os.Exit(m.Run())
+}
+
+// A Cmd describes one run of nih.
+type Cmd struct {
+	// Args are the command-line arguments, not including the program name.
+	Args []string
+
+	// Env holds extra environment variables in "KEY=value" form.
+	// NIH_* variables of the test process are not inherited.
+	Env []string
+
+	// Dir is the working directory. Empty means a new temporary directory.
+	Dir string
+
+	// Stdin is the standard input. Nil means empty input.
+	Stdin io.Reader
+}
+
+// A Result is the outcome of a run.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// Run runs nih as described by c and returns its result.
+// It fails the test if nih could not be started or was killed by a signal.
+// The test binary must call Main from TestMain.
+func Run(t testing.TB, c Cmd) *Result {
+	t.Helper()
+
+	p := Start(t, c)
+	return p.Wait()
+}
+
+// A Process is a run of nih started by Start.
+type Process struct {
+	t      testing.TB
+	args   []string
+	cmd    *exec.Cmd
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+	result *Result
+}
+
+// Start starts nih as described by c without waiting for it to exit,
+// for commands that run until interrupted, such as serve.
+// A process still running at the end of the test is interrupted.
+func Start(t testing.TB, c Cmd) *Process {
+	t.Helper()
+
+	dir := c.Dir
+	if dir == "" {
+		dir = t.TempDir()
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Process{t: t, args: c.Args}
+	p.cmd = exec.Command(exe, c.Args...)
+	p.cmd.Dir = dir
+	p.cmd.Stdin = c.Stdin
+	p.cmd.Stdout = &p.stdout
+	p.cmd.Stderr = &p.stderr
+	p.cmd.Env = append(environ(), envChild+"=1")
+	p.cmd.Env = append(p.cmd.Env, c.Env...)
+
+	if err := p.cmd.Start(); err != nil {
+		t.Fatalf("nih %s: %v", strings.Join(c.Args, " "), err)
+	}
+
+	t.Cleanup(func() {
+		if p.result == nil {
+			p.Stop()
+		}
+	})
+
+	return p
+}
+
+// Stop interrupts the process and waits for it to exit.
+func (p *Process) Stop() *Result {
+	p.t.Helper()
+
+	if p.result == nil {
+		p.cmd.Process.Signal(os.Interrupt)
+	}
+	return p.Wait()
+}
+
+// Wait waits for the process to exit and returns its result.
+// It fails the test if the process was killed by a signal.
+func (p *Process) Wait() *Result {
+	p.t.Helper()
+
+	if p.result != nil {
+		return p.result
+	}
+
+	err := p.cmd.Wait()
+
+	var xerr *exec.ExitError
+	if err != nil && !(errors.As(err, &xerr) && xerr.Exited()) {
+		p.t.Fatalf("nih %s: %v\nstderr:\n%s", strings.Join(p.args, " "), err, p.stderr.String())
+	}
+
+	p.result = &Result{
+		Stdout:   p.stdout.String(),
+		Stderr:   p.stderr.String(),
+		ExitCode: p.cmd.ProcessState.ExitCode(),
+	}
+	return p.result
+}
+
+// environ returns the environment of the test process without NIH_* variables.
+func environ() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "NIH_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// Credentials returns a new temporary directory containing development credentials
+// in etc/trust, where nih looks for them by default.
+func Credentials(t testing.TB) string {
+	t.Helper()
+
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+		Leaves:        1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	WriteFile(t, filepath.Join(dir, "etc/trust/ca.pem"), trustgen.PEMEncodeCertificates(h.Roots()...))
+	WriteFile(t, filepath.Join(dir, "etc/trust/cert.pem"), trustgen.PEMEncodeCertificates(h.Chain(0)...))
+	WriteFile(t, filepath.Join(dir, "etc/trust/key.pem"), trustgen.PEMEncodePrivateKey(h.Leaves[0].Key))
+
+	return dir
+}
+
+// WriteFile writes data to name, creating its parent directories.
+func WriteFile(t testing.TB, name string, data []byte) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
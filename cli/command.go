@@ -0,0 +1,211 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// A Command is a nih subcommand.
+type Command struct {
+	// Name is the name of the command, as typed by the user.
+	Name string
+
+	// Aliases are alternative names, such as "st" for "status".
+	// They are accepted wherever the name is but not listed with the commands.
+	Aliases []string
+
+	// Args describes the positional arguments, e.g. "ADDR [PORT]".
+	Args string
+
+	// Summary is a one-line description of the command.
+	Summary string
+
+	// Help is the full help text printed by "nih help".
+	Help string
+
+	// Flags defines the command's flags on fs.
+	// It is called with a fresh flag set every time the command runs.
+	Flags func(fs *flag.FlagSet)
+
+	// Credentials reports whether the command needs the credentials named by
+	// the global -cert, -key, and -ca flags. They are loaded before Run is called,
+	// which can then get them from Bundle. Other commands run without them.
+	Credentials bool
+
+	// Run runs the command with the arguments remaining after flag parsing.
+	// It is nil for a command that only groups subcommands.
+	Run func(ctx context.Context, args []string) error
+
+	// Commands are the subcommands, e.g. "root" under "trustgen".
+	// A command with both Run and Commands runs the subcommand named by
+	// its first argument, if any, and Run otherwise.
+	Commands []*Command
+}
+
+// A UsageError reports that a command was used incorrectly.
+type UsageError struct {
+	// Path is the full command path, e.g. "nih trustgen root".
+	Path string
+	Err  error
+}
+
+func (e *UsageError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e *UsageError) Unwrap() error {
+	return e.Err
+}
+
+// Usagef returns a UsageError, which Run annotates with the command path.
+func Usagef(format string, args ...any) error {
+	return &UsageError{Err: fmt.Errorf(format, args...)}
+}
+
+var errUnknownCommand = errors.New("unknown command")
+
+// running is the path of the command being run, for error reports.
+var running string
+
+var commands []*Command
+
+// Register adds a top-level command.
+// It panics if the name or one of the aliases is already taken
+// by a command or a help topic.
+func Register(c *Command) {
+	for _, name := range append([]string{c.Name}, c.Aliases...) {
+		if Lookup(name) != nil || LookupTopic(name) != nil {
+			panic("cli: duplicate command " + name)
+		}
+	}
+
+	commands = append(commands, c)
+}
+
+// Lookup returns the top-level command with the given name or alias,
+// or nil if there is none.
+func Lookup(name string) *Command {
+	return lookup(commands, name)
+}
+
+func lookup(cs []*Command, name string) *Command {
+	for _, c := range cs {
+		if c.Name == name || slices.Contains(c.Aliases, name) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Commands returns the top-level commands in name order.
+func Commands() []*Command {
+	cs := append([]*Command(nil), commands...)
+	sort.Slice(cs, func(i, j int) bool {
+		return cs[i].Name < cs[j].Name
+	})
+
+	return cs
+}
+
+// Lookup returns the subcommand with the given name or alias, or nil if there is none.
+func (c *Command) Lookup(name string) *Command {
+	return lookup(c.Commands, name)
+}
+
+// FlagSet returns a new flag set with the command's flags defined.
+func (c *Command) FlagSet(path string) *flag.FlagSet {
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	if c.Flags != nil {
+		c.Flags(fs)
+	}
+
+	return fs
+}
+
+// Run runs the command named by args[0] with the remaining arguments.
+// If there is no such command, Run looks for a plugin executable named
+// nih-COMMAND on PATH and runs it instead.
+func Run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+
+	c := Lookup(args[0])
+	if c == nil {
+		if plugin := lookPlugin(args[0]); plugin != "" {
+			return runPlugin(ctx, plugin, args[1:])
+		}
+
+		return &UsageError{Path: "nih " + args[0], Err: errUnknownCommand}
+	}
+
+	return c.run(ctx, "nih "+c.Name, args[1:])
+}
+
+func (c *Command) run(ctx context.Context, path string, args []string) error {
+	if c.Run == nil {
+		if len(args) == 0 {
+			return &UsageError{Path: path, Err: errors.New("missing subcommand")}
+		}
+
+		sub := c.Lookup(args[0])
+		if sub == nil {
+			return &UsageError{Path: path + " " + args[0], Err: errUnknownCommand}
+		}
+
+		return sub.run(ctx, path+" "+sub.Name, args[1:])
+	}
+
+	if len(args) > 0 {
+		if sub := c.Lookup(args[0]); sub != nil {
+			return sub.run(ctx, path+" "+sub.Name, args[1:])
+		}
+	}
+
+	running = path
+
+	fs := c.FlagSet(path)
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return Help(strings.Fields(path)[1:])
+		}
+
+		return &UsageError{Path: path, Err: err}
+	}
+
+	if err := ApplyEnv(fs, path); err != nil {
+		return &UsageError{Path: path, Err: err}
+	}
+
+	if c.Credentials {
+		if err := loadBundle(path); err != nil {
+			return err
+		}
+	}
+
+	err := c.Run(ctx, fs.Args())
+
+	var uerr *UsageError
+	if errors.As(err, &uerr) {
+		if uerr.Path == "" {
+			uerr.Path = path
+		}
+		return err
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var cmdCompletion = &Command{
+	Name:    "completion",
+	Summary: "print a shell completion script",
+	Help: `
+Load the script in the shell's startup file, for example:
+
+    source <(nih completion bash)     # ~/.bashrc
+    source <(nih completion zsh)      # ~/.zshrc
+    nih completion fish | source      # ~/.config/fish/config.fish
+`,
+	Commands: []*Command{
+		{Name: "bash", Summary: "print a bash completion script", Run: runCompletion(writeBash)},
+		{Name: "zsh", Summary: "print a zsh completion script", Run: runCompletion(writeZsh)},
+		{Name: "fish", Summary: "print a fish completion script", Run: runCompletion(writeFish)},
+	},
+}
+
+func init() {
+	Register(cmdCompletion)
+}
+
+func runCompletion(write func(io.Writer, []completionNode)) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if len(args) != 0 {
+			return Usagef("unexpected arguments")
+		}
+
+		write(os.Stdout, completionTree())
+		return nil
+	}
+}
+
+// completionNode describes what can follow a command path.
+type completionNode struct {
+	path    []string
+	summary string
+	subs    []*Command
+	flags   []*flag.Flag
+}
+
+func completionTree() []completionNode {
+	fs := flag.NewFlagSet("nih", flag.ContinueOnError)
+	new(Globals).Flags(fs)
+
+	nodes := []completionNode{{
+		subs:  Commands(),
+		flags: flagList(fs),
+	}}
+
+	var walk func(path []string, c *Command)
+	walk = func(path []string, c *Command) {
+		path = append(path[:len(path):len(path)], c.Name)
+		nodes = append(nodes, completionNode{
+			path:    path,
+			summary: c.Summary,
+			subs:    c.Commands,
+			flags:   flagList(c.FlagSet(strings.Join(path, " "))),
+		})
+
+		for _, sub := range c.Commands {
+			walk(path, sub)
+		}
+	}
+
+	for _, c := range Commands() {
+		walk(nil, c)
+	}
+
+	return nodes
+}
+
+func flagList(fs *flag.FlagSet) []*flag.Flag {
+	var fl []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) {
+		fl = append(fl, f)
+	})
+	return fl
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// isFileFlag reports whether the flag takes a file name, as documented by its usage.
+func isFileFlag(f *flag.Flag) bool {
+	name, _ := flag.UnquoteUsage(f)
+	return name == "file" || name == "dir"
+}
+
+func fileFlags(nodes []completionNode) []string {
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		for _, f := range n.flags {
+			if isFileFlag(f) {
+				seen["-"+f.Name] = true
+			}
+		}
+	}
+
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeBash(w io.Writer, nodes []completionNode) {
+	fmt.Fprintf(w, "# bash completion for nih, generated by \"nih completion bash\"\n\n")
+	fmt.Fprintf(w, "_nih() {\n")
+	fmt.Fprintf(w, "\tlocal cur prev path w i words\n")
+	fmt.Fprintf(w, "\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(w, "\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n\n")
+
+	if ff := fileFlags(nodes); len(ff) > 0 {
+		fmt.Fprintf(w, "\tcase \"$prev\" in\n")
+		fmt.Fprintf(w, "\t%s)\n", strings.Join(ff, "|"))
+		fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n")
+		fmt.Fprintf(w, "\t\treturn\n")
+		fmt.Fprintf(w, "\t\t;;\n")
+		fmt.Fprintf(w, "\tesac\n\n")
+	}
+
+	fmt.Fprintf(w, "\tpath=\"\"\n")
+	fmt.Fprintf(w, "\tfor ((i = 1; i < COMP_CWORD; i++)); do\n")
+	fmt.Fprintf(w, "\t\tw=\"${COMP_WORDS[i]}\"\n")
+	var paths []string
+	for _, n := range nodes[1:] {
+		paths = append(paths, fmt.Sprintf("%q", strings.Join(n.path, " ")))
+	}
+	fmt.Fprintf(w, "\t\tcase \"${path:+$path }$w\" in\n")
+	fmt.Fprintf(w, "\t\t%s)\n", strings.Join(paths, "|"))
+	fmt.Fprintf(w, "\t\t\tpath=\"${path:+$path }$w\"\n")
+	fmt.Fprintf(w, "\t\t\t;;\n")
+	fmt.Fprintf(w, "\t\tesac\n")
+	fmt.Fprintf(w, "\tdone\n\n")
+
+	fmt.Fprintf(w, "\tcase \"$path\" in\n")
+	for _, n := range nodes {
+		var words []string
+		for _, c := range n.subs {
+			words = append(words, c.Name)
+		}
+		for _, f := range n.flags {
+			words = append(words, "-"+f.Name)
+		}
+		fmt.Fprintf(w, "\t%q) words=%q ;;\n", strings.Join(n.path, " "), strings.Join(words, " "))
+	}
+	fmt.Fprintf(w, "\tesac\n\n")
+
+	fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	fmt.Fprintf(w, "}\n\n")
+	fmt.Fprintf(w, "complete -o default -F _nih nih\n")
+}
+
+func writeZsh(w io.Writer, nodes []completionNode) {
+	fmt.Fprintf(w, "# zsh completion for nih, generated by \"nih completion zsh\"\n\n")
+	fmt.Fprintf(w, "autoload -U +X bashcompinit && bashcompinit\n\n")
+	writeBash(w, nodes)
+}
+
+func writeFish(w io.Writer, nodes []completionNode) {
+	fmt.Fprintf(w, "# fish completion for nih, generated by \"nih completion fish\"\n\n")
+	fmt.Fprintf(w, "complete -c nih -f\n")
+
+	for _, n := range nodes {
+		var names []string
+		for _, c := range n.subs {
+			names = append(names, c.Name)
+		}
+
+		cond := "__fish_use_subcommand"
+		if len(n.path) > 0 {
+			cond = "__fish_seen_subcommand_from " + n.path[len(n.path)-1]
+		}
+
+		for _, c := range n.subs {
+			sub := cond
+			if len(n.path) > 0 {
+				sub += "; and not __fish_seen_subcommand_from " + strings.Join(names, " ")
+			}
+			fmt.Fprintf(w, "complete -c nih -n '%s' -a %s -d %s\n", sub, c.Name, fishQuote(c.Summary))
+		}
+
+		for _, f := range n.flags {
+			_, usage := flag.UnquoteUsage(f)
+			usage, _, _ = strings.Cut(usage, "\n")
+
+			args := []string{"complete", "-c", "nih"}
+			if len(n.path) > 0 {
+				args = append(args, "-n", "'"+cond+"'")
+			}
+
+			args = append(args, "-o", f.Name)
+			switch {
+			case isFileFlag(f):
+				args = append(args, "-r", "-F")
+			case !isBoolFlag(f):
+				args = append(args, "-r")
+			}
+
+			args = append(args, "-d", fishQuote(usage))
+			fmt.Fprintln(w, strings.Join(args, " "))
+		}
+	}
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"nih.software/cli/output"
+	"nih.software/daemon"
+)
+
+var configFlags struct {
+	control string
+	dryRun  bool
+}
+
+var cmdConfig = &Command{
+	Name:    "config",
+	Summary: "show and change the configuration of the running daemon",
+	Help: `
+Config reads and changes the configuration of the daemon started by
+"nih serve", over the control socket of -control. Settings are named after
+the flags of serve that set them, such as exec-roles for -exec-roles.
+
+Live settings take effect at once: the roles of exec-roles, file-roles,
+kv-roles, job-roles, secret-roles, and config-roles apply to the next request, and changes to peers and
+peer-interval start a new round of probes. The limits of max-conns,
+max-peer-conns, handshake-rate, and peer-handshake-rate apply to the next
+connection, and those of max-calls and max-peer-calls to the next call.
+The other settings, such as listen, can only be changed by restarting
+serve.
+
+Changes made with set last until the daemon stops. To keep them, set the
+same values in the flags or environment of serve, or push them to every
+node in a configuration bundle with push, which the nodes keep.
+`,
+	Commands: []*Command{cmdConfigGet, cmdConfigSet, cmdConfigPush, cmdConfigHistory, cmdConfigStatus, cmdConfigRollback},
+}
+
+func init() {
+	Register(cmdConfig)
+}
+
+func configControlFlag(fs *flag.FlagSet) {
+	fs.StringVar(&configFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+}
+
+var cmdConfigGet = &Command{
+	Name:    "get",
+	Args:    "[NAME...]",
+	Summary: "print settings of the running daemon",
+	Help: `
+Get prints every setting of the daemon with its value and whether it is
+live, or with NAME arguments, the value of each named setting on a line.
+`,
+	Flags: configControlFlag,
+	Run:   runConfigGet,
+}
+
+var cmdConfigSet = &Command{
+	Name:    "set",
+	Args:    "NAME=VALUE...",
+	Summary: "change settings of the running daemon",
+	Help: `
+Set changes each named setting to VALUE and prints the changes as a diff.
+Lists, such as the roles of exec-roles, are comma-separated, and an empty
+VALUE clears them.
+
+The daemon validates every value first: if one is invalid, unknown, or not
+live, set fails with status 2 and changes nothing. With -dry-run, set only
+validates the values and prints the changes they would make.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		configControlFlag(fs)
+		fs.BoolVar(&configFlags.dryRun, "dry-run", false, "Validate and print the changes without applying them")
+	},
+	Run: runConfigSet,
+}
+
+func runConfigGet(ctx context.Context, args []string) error {
+	var settings []daemon.Setting
+	if err := controlGet(ctx, configFlags.control, "/admin/config", &settings); err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		t := output.NewTable("NAME", "VALUE", "LIVE")
+		for _, s := range settings {
+			live := "no"
+			if s.Live {
+				live = "yes"
+			}
+			t.Append(s.Name, s.Value, live)
+		}
+		return Print(t)
+	}
+
+	values := make(map[string]string)
+	for _, s := range settings {
+		values[s.Name] = s.Value
+	}
+
+	r := &configValues{}
+	for _, name := range args {
+		v, ok := values[name]
+		if !ok {
+			return Usagef("unknown setting %q", name)
+		}
+		r.names = append(r.names, name)
+		r.values = append(r.values, v)
+	}
+
+	return Print(r)
+}
+
+// configValues are the values of the settings named on the command line.
+type configValues struct {
+	names  []string
+	values []string
+}
+
+// WriteText implements output.Texter.
+func (r *configValues) WriteText(w io.Writer) error {
+	for _, v := range r.values {
+		if _, err := fmt.Fprintln(w, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *configValues) MarshalJSON() ([]byte, error) {
+	m := make(map[string]string, len(r.names))
+	for i, name := range r.names {
+		m[name] = r.values[i]
+	}
+	return json.Marshal(m)
+}
+
+func runConfigSet(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return Usagef("need at least one NAME=VALUE")
+	}
+
+	u := daemon.ConfigUpdate{Set: make(map[string]string), DryRun: configFlags.dryRun}
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return Usagef("%q is not NAME=VALUE", arg)
+		}
+		u.Set[name] = value
+	}
+
+	r := &configSetResult{DryRun: configFlags.dryRun}
+	if err := controlDo(ctx, configFlags.control, "POST", "/admin/config", &u, &r.Changes); err != nil {
+		return err
+	}
+
+	return Print(r)
+}
+
+type configSetResult struct {
+	Changes []daemon.ConfigChange `json:"changes"`
+	DryRun  bool                  `json:"dry_run"`
+}
+
+// WriteText implements output.Texter.
+func (r *configSetResult) WriteText(w io.Writer) error {
+	u := Global.UI()
+
+	if len(r.Changes) == 0 {
+		_, err := fmt.Fprintln(w, "no changes")
+		return err
+	}
+
+	for _, c := range r.Changes {
+		fmt.Fprintln(w, u.Red("-"+c.Name+"="+c.Old))
+		fmt.Fprintln(w, u.Green("+"+c.Name+"="+c.New))
+	}
+
+	if r.DryRun {
+		_, err := fmt.Fprintln(w, u.Faint("dry run: nothing changed"))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// controlGet requests path from the daemon listening on the control socket
+// at control and decodes its JSON response into v.
+func controlGet(ctx context.Context, control, path string, v any) error {
+	return controlDo(ctx, control, "GET", path, nil, v)
+}
+
+// controlDo sends a request with the JSON encoding of body, if not nil,
+// to the daemon listening on the control socket at control, and decodes its
+// JSON response into v. The daemon rejecting the request as invalid is a usage error.
+func controlDo(ctx context.Context, control, method, path string, body, v any) error {
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	resp, err := controlRequest(ctx, control, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// controlRequest is controlDo without the timeout, returning the response
+// for the caller to read and close, as it streams.
+func controlRequest(ctx context.Context, control, method, path string, body any) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	// The host is ignored: every request goes to the control socket.
+	req, err := http.NewRequestWithContext(ctx, method, "http://nih"+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	c := controlClient(control)
+	resp, err := c.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return nil, NetworkError(err, fmt.Sprintf("Is nih serve running with -control %s?", control))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusBadRequest:
+		defer resp.Body.Close()
+		return nil, Usagef("%s", responseMessage(resp))
+	default:
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", path, responseMessage(resp))
+	}
+}
+
+// controlClient returns an HTTP client sending every request, whatever
+// its host, to the daemon listening on the control socket at control.
+// It keeps no idle connections, as every command makes few requests.
+func controlClient(control string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", control)
+		},
+		DisableKeepAlives: true,
+	}}
+}
+
+// controlFlagUsage is the usage of the -control flag of commands that
+// talk to a running daemon.
+const controlFlagUsage = "Location of the daemon's control socket `file`"
@@ -0,0 +1,514 @@
+package cli
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"nih.software/cli/ui"
+	"nih.software/daemon"
+)
+
+var cpFlags struct {
+	recursive bool
+	force     bool
+}
+
+var cmdCp = &Command{
+	Name:    "cp",
+	Args:    "SRC DST",
+	Summary: "copy files to or from a node",
+	Help: `
+Cp copies files between this host and a node, over a mutually
+authenticated TLS connection made with the global credentials.
+Either SRC or DST, not both, names a path on a node, written NODE:PATH,
+where NODE is the name of a peer of the address book, or host or host:port
+with the port of serve -listen by default:
+
+    nih cp nih.tar.gz node1:/usr/local/lib/nih.tar.gz
+    nih cp -r node1:/etc/app ./app
+    nih cp config.json [::1]:7443:config.json
+
+A relative PATH is relative to the working directory of the node's daemon.
+As with cp, a DST that is an existing directory receives SRC under its own
+name. Copying a directory requires -r; only its regular files and
+directories are copied, with their permission bits.
+
+Each file is received into a partial file, DST with the suffix .nihpart,
+and only renamed to DST once its SHA-256 matches that of SRC. If a copy
+is interrupted, running it again resumes every file from the end of its
+partial file. Existing files are only replaced with -force.
+
+The node only accepts peers whose certificate holds one of the roles of
+its serve -file-roles flag, and cp fails with status 3 otherwise.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		cpFlags.recursive = false
+		cpFlags.force = false
+		fs.BoolVar(&cpFlags.recursive, "r", false, "Copy directories recursively")
+		fs.BoolVar(&cpFlags.force, "force", false, "Replace existing files")
+	},
+	Credentials: true,
+	Run:         runCp,
+}
+
+func init() {
+	Register(cmdCp)
+}
+
+func runCp(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return Usagef("need a source and a destination")
+	}
+
+	src, srcRemote := parseRemote(args[0])
+	dst, dstRemote := parseRemote(args[1])
+
+	var r cpResult
+	var err error
+	switch {
+	case srcRemote && dstRemote:
+		return Usagef("cannot copy between two nodes")
+	case srcRemote:
+		fc, ferr := newFilesClient(src.node)
+		if ferr != nil {
+			return ferr
+		}
+		defer fc.c.CloseIdleConnections()
+		err = fc.download(ctx, src.path, args[1], &r)
+	case dstRemote:
+		fc, ferr := newFilesClient(dst.node)
+		if ferr != nil {
+			return ferr
+		}
+		defer fc.c.CloseIdleConnections()
+		err = fc.upload(ctx, args[0], dst.path, &r)
+	default:
+		return Usagef("need a path on a node, written NODE:PATH")
+	}
+
+	if len(r.Files) > 0 {
+		if perr := Print(&r); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// A remotePath is a path on a node, as resolved by nodeAddr.
+type remotePath struct {
+	node, path string
+}
+
+// parseRemote parses s as a path on a node, written NODE:PATH, where NODE is
+// a name, host, host:port, or [ipv6]:port. It reports false if s is a local
+// path.
+func parseRemote(s string) (*remotePath, bool) {
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, ".") {
+		return nil, false
+	}
+
+	var host, rest string
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]:")
+		if end < 0 {
+			return nil, false
+		}
+		host, rest = s[1:end], s[end+2:]
+	} else {
+		var ok bool
+		if host, rest, ok = strings.Cut(s, ":"); !ok || host == "" {
+			return nil, false
+		}
+	}
+
+	node := host
+	if p, after, ok := strings.Cut(rest, ":"); ok {
+		if _, err := strconv.ParseUint(p, 10, 16); err == nil {
+			node, rest = net.JoinHostPort(host, p), after
+		}
+	}
+
+	if rest == "" {
+		rest = "."
+	}
+	return &remotePath{node: node, path: rest}, true
+}
+
+// filesClient talks to the files service of the node at addr.
+type filesClient struct {
+	c    *http.Client
+	addr string
+}
+
+func newFilesClient(node string) (*filesClient, error) {
+	addr, expect, err := nodeAddr(node)
+	if err != nil {
+		return nil, err
+	}
+	return &filesClient{c: streamClient(Bundle(), expect), addr: addr}, nil
+}
+
+var errRemoteNotExist = errors.New("no such file or directory")
+
+// do sends a request to endpoint of the files service with the query q,
+// and returns the response if its status is 2xx.
+func (fc *filesClient) do(ctx context.Context, method, endpoint string, q url.Values, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+fc.addr+"/files/"+endpoint+"?"+q.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := fc.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	err = fmt.Errorf("%s:%s: %s", fc.addr, q.Get("path"), responseMessage(resp))
+	switch resp.StatusCode {
+	case http.StatusForbidden:
+		return nil, TrustError(err, "Use credentials with a role the node allows in serve -file-roles.")
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%s:%s: %w", fc.addr, q.Get("path"), errRemoteNotExist)
+	default:
+		return nil, err
+	}
+}
+
+// call sends a request without a body and decodes the JSON response into v,
+// if v is not nil. The whole exchange is limited by -timeout.
+func (fc *filesClient) call(ctx context.Context, method, endpoint string, q url.Values, v any) error {
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	resp, err := fc.do(ctx, method, endpoint, q, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (fc *filesClient) stat(ctx context.Context, name string, part bool) (*daemon.FileInfo, error) {
+	q := url.Values{"path": {name}}
+	if part {
+		q.Set("part", "1")
+	}
+
+	var fi daemon.FileInfo
+	if err := fc.call(ctx, "GET", "stat", q, &fi); err != nil {
+		return nil, err
+	}
+	return &fi, nil
+}
+
+// upload copies the local file or directory src to dst on the node.
+func (fc *filesClient) upload(ctx context.Context, src, dst string, r *cpResult) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() && !cpFlags.recursive {
+		return Usagef("%s is a directory (not copied without -r)", src)
+	}
+
+	dfi, err := fc.stat(ctx, dst, false)
+	switch {
+	case err == nil && dfi.IsDir:
+		dst = path.Join(dst, filepath.Base(src))
+	case err != nil && !errors.Is(err, errRemoteNotExist):
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fc.uploadFile(ctx, src, dst, fi, r)
+	}
+
+	return filepath.WalkDir(src, func(name string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, filepath.ToSlash(rel))
+
+		fi, err := e.Info()
+		switch {
+		case err != nil:
+			return err
+		case fi.IsDir():
+			q := url.Values{"path": {target}, "mode": {modeString(fi.Mode())}}
+			return fc.call(ctx, "POST", "mkdir", q, nil)
+		case fi.Mode().IsRegular():
+			return fc.uploadFile(ctx, name, target, fi, r)
+		default:
+			ui.Warn("%s: skipped, not a regular file", name)
+			return nil
+		}
+	})
+}
+
+func (fc *filesClient) uploadFile(ctx context.Context, src, dst string, fi fs.FileInfo, r *cpResult) error {
+	if !cpFlags.force {
+		if _, err := fc.stat(ctx, dst, false); err == nil {
+			return &Error{Code: ExitFailure, Err: fmt.Errorf("%s:%s already exists", fc.addr, dst), Hint: "Use -force to replace it."}
+		} else if !errors.Is(err, errRemoteNotExist) {
+			return err
+		}
+	}
+
+	sum, err := localSHA256(src)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if part, err := fc.stat(ctx, dst, true); err == nil && part.Size <= fi.Size() {
+		offset = part.Size
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	bar := ui.NewBar(filepath.Base(src), fi.Size())
+	bar.Add(offset)
+	defer bar.Done()
+
+	body := io.TeeReader(f, bar)
+	q := url.Values{"path": {dst}, "offset": {strconv.FormatInt(offset, 10)}}
+
+	resp, err := fc.do(ctx, "PUT", "content", q, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	q = url.Values{"path": {dst}, "sha256": {sum}, "mode": {modeString(fi.Mode())}}
+	if err := fc.call(ctx, "POST", "commit", q, nil); err != nil {
+		return fmt.Errorf("%w; run cp again to copy the file from the start", err)
+	}
+
+	r.add(src, fc.addr+":"+dst, fi.Size(), offset, sum)
+	return nil
+}
+
+// download copies the file or directory src on the node to the local dst.
+func (fc *filesClient) download(ctx context.Context, src, dst string, r *cpResult) error {
+	var infos []*daemon.FileInfo
+	if err := fc.call(ctx, "GET", "walk", url.Values{"path": {src}}, &infos); err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		return fmt.Errorf("%s:%s: %w", fc.addr, src, errRemoteNotExist)
+	}
+
+	root := infos[0]
+	if root.IsDir && !cpFlags.recursive {
+		return Usagef("%s:%s is a directory (not copied without -r)", fc.addr, src)
+	}
+
+	if dfi, err := os.Stat(dst); err == nil && dfi.IsDir() {
+		dst = filepath.Join(dst, path.Base(src))
+	}
+
+	for _, fi := range infos {
+		name := path.Join(src, fi.Path)
+		target := filepath.Join(dst, filepath.FromSlash(fi.Path))
+
+		if fi.IsDir {
+			// Writable by us at least, to receive the files.
+			if err := os.MkdirAll(target, fi.Mode|0700); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fc.downloadFile(ctx, name, target, fi, r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fc *filesClient) downloadFile(ctx context.Context, src, dst string, fi *daemon.FileInfo, r *cpResult) error {
+	if _, err := os.Stat(dst); err == nil && !cpFlags.force {
+		return &Error{Code: ExitFailure, Err: fmt.Errorf("%s already exists", dst), Hint: "Use -force to replace it."}
+	}
+
+	part := dst + daemon.PartSuffix
+
+	var offset int64
+	if pfi, err := os.Stat(part); err == nil && pfi.Size() <= fi.Size {
+		offset = pfi.Size()
+	}
+
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bar := ui.NewBar(path.Base(src), fi.Size)
+	defer bar.Done()
+
+	if offset < fi.Size {
+		if offset, err = fc.fetch(ctx, src, offset, f, bar); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	sum, err := localSHA256(part)
+	if err != nil {
+		return err
+	}
+
+	var remote daemon.FileSum
+	if err := fc.call(ctx, "GET", "sum", url.Values{"path": {src}}, &remote); err != nil {
+		return err
+	}
+
+	if sum != remote.SHA256 {
+		os.Remove(part)
+		return fmt.Errorf("%s: SHA-256 mismatch with %s:%s, which may have changed during the copy; run cp again to copy it from the start", dst, fc.addr, src)
+	}
+
+	if err := os.Chmod(part, fi.Mode); err != nil {
+		return err
+	}
+	if err := os.Rename(part, dst); err != nil {
+		return err
+	}
+
+	r.add(fc.addr+":"+src, dst, fi.Size, offset, sum)
+	return nil
+}
+
+// fetch writes the content of src on the node from offset on into f,
+// and returns the offset it actually resumed from.
+func (fc *filesClient) fetch(ctx context.Context, src string, offset int64, f *os.File, bar *ui.Bar) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+fc.addr+"/files/content?"+url.Values{"path": {src}}.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := fc.c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		offset = 0
+	case http.StatusForbidden:
+		return 0, TrustError(fmt.Errorf("%s:%s: %s", fc.addr, src, responseMessage(resp)),
+			"Use credentials with a role the node allows in serve -file-roles.")
+	default:
+		return 0, fmt.Errorf("%s:%s: %s", fc.addr, src, responseMessage(resp))
+	}
+
+	if err := f.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	bar.Add(offset)
+	if _, err := io.Copy(io.MultiWriter(f, bar), resp.Body); err != nil {
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+func localSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// modeString formats the permission bits of mode in octal, as the files service expects.
+func modeString(mode fs.FileMode) string {
+	return strconv.FormatUint(uint64(mode.Perm()), 8)
+}
+
+type cpResult struct {
+	Files []*cpFile `json:"files"`
+}
+
+type cpFile struct {
+	Src     string `json:"src"`
+	Dst     string `json:"dst"`
+	Size    int64  `json:"size"`
+	Resumed int64  `json:"resumed,omitempty"` // offset the copy resumed from
+	SHA256  string `json:"sha256"`
+}
+
+func (r *cpResult) add(src, dst string, size, resumed int64, sum string) {
+	r.Files = append(r.Files, &cpFile{Src: src, Dst: dst, Size: size, Resumed: resumed, SHA256: sum})
+}
+
+// WriteText implements output.Texter.
+func (r *cpResult) WriteText(w io.Writer) error {
+	for _, f := range r.Files {
+		resumed := ""
+		if f.Resumed > 0 {
+			resumed = ", resumed at " + ui.FormatBytes(f.Resumed)
+		}
+		fmt.Fprintf(w, "%s -> %s (%s%s)\n", f.Src, f.Dst, ui.FormatBytes(f.Size), resumed)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/cli/ui"
+	"nih.software/daemon"
+	"nih.software/dev/preflight"
+)
+
+var cmdDev = &Command{
+	Name:    "dev",
+	Summary: "prepare a development environment",
+	Help: `
+Dev prepares a checkout of nih, or of a project embedding it, for
+development.
+`,
+	Commands: []*Command{cmdDevPreflight},
+}
+
+func init() {
+	Register(cmdDev)
+}
+
+var preflightFlags struct {
+	dir          string
+	force        bool
+	only         string
+	skip         string
+	config       string
+	nodes        int
+	regen        string
+	check        bool
+	dryRun       bool
+	expiryWindow time.Duration
+}
+
+var cmdDevPreflight = &Command{
+	Name:    "preflight",
+	Summary: "check and prepare the environment for development",
+	Help: `
+Preflight runs in the root of the Go module it is started in, the nearest
+directory above the working directory with a go.mod file, so that it can
+be run from any directory of a checkout. Relative paths, including those of
+-cert, -key, -ca, -dir, and -config, are relative to the root.
+
+Preflight takes the following steps, each named for -only and -skip:
+
+  platform  check that the OS and architecture are supported
+  go        check that the Go toolchain is at least the version go.mod
+            requires
+  dirs      create the directories of the credentials and the control
+            socket, etc/trust and run by default, and make them and their
+            files private to their owner, except on Windows, where their
+            access is that of the user profile they are in
+  clock     check that the system clock is not before the release of the
+            toolchain, nor before the last certificate was issued
+  port      check that the default listen address of serve is free
+  creds     generate a root CA, an intermediate CA, and a leaf, and write
+            them to the files of the global -cert, -key, and -ca flags,
+            or to those in -dir, with the keys of the CAs beside the key
+            for reissuing
+  identity  write the identity of the credentials, the fingerprints and
+            expiry of their certificates, to README-identity.txt beside
+            them, and print a summary
+  nodes     with -nodes N, issue N leaves with keys of their own under the
+            same CA, in node1, node2, and so on beside the certificate
+
+A step is skipped if its test passes, unless -force is set, and is blocked
+if a step it needs failed. -only also takes the steps the named steps need.
+Steps that do not need each other run concurrently; their results are
+printed in order, followed by the duration and outcome of every step.
+With -o json, every result is printed as a JSON object on a line, and the
+counts last, as an object with a summary field. With the global -log-level
+preflight=debug, the start and outcome of every step are also logged as
+they happen.
+
+Before replacing credentials that exist but fail their test, preflight asks
+for confirmation, unless the global -yes is set; without an answer, as in
+scripts, the step fails. Replaced credentials are backed up next to them,
+suffixed with the time, such as cert.pem.20261018T120000Z.bak.
+
+The credentials fail their test if any of their certificates expires within
+-expiry-window. With -regen, preflight regenerates only the named artifacts
+of the credentials, such as just the leaf, and reissues the certificates
+below them for their existing keys.
+
+Programs embedding nih add steps in Go with RegisterStep of the package
+nih.software/dev/preflight, after the built-in steps. Projects add steps
+of their own in etc/preflight.json, or the file of -config, as shell
+commands:
+
+    {"steps": [{
+      "id": "db",
+      "name": "start the development database",
+      "needs": ["dirs"],
+      "test": "pg_isready -q",
+      "do": "pg_ctl start -D etc/db -l etc/db/log"
+    }]}
+
+The commands run with sh, or on Windows without sh on the PATH, such as
+Git for Windows puts there, with cmd. A step passes its test if its
+command exits with status 0, and a step without "do" only checks.
+
+With -dry-run, only the tests run, and the steps that would run print the
+changes they would make instead of making them. With -check, only the tests
+run, so that CI can assert that a checkout is prepared.
+
+Preflight exits with status 1 if any step failed.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&preflightFlags.dir, "dir", "", "Write the credentials to cert.pem, key.pem, and ca.pem in `directory`")
+		fs.BoolVar(&preflightFlags.force, "force", false, "Take every step even if its test passes")
+		fs.StringVar(&preflightFlags.only, "only", "", "Take only these comma-separated `steps` and the steps they need")
+		fs.StringVar(&preflightFlags.skip, "skip", "", "Skip these comma-separated `steps`")
+		fs.StringVar(&preflightFlags.config, "config", defaultPreflightConfig, "Read additional steps from `file`")
+		fs.IntVar(&preflightFlags.nodes, "nodes", 0, "Also generate credentials for `n` nodes")
+		fs.StringVar(&preflightFlags.regen, "regen", "", "Regenerate only these comma-separated `artifacts` of the credentials: root, intermediate, leaf")
+		fs.BoolVar(&preflightFlags.check, "check", false, "Run only the tests")
+		fs.BoolVar(&preflightFlags.dryRun, "dry-run", false, "Run only the tests and print what the steps would change")
+		fs.DurationVar(&preflightFlags.expiryWindow, "expiry-window", 30*24*time.Hour, "Regenerate credentials that expire within `duration`")
+	},
+	Run: runDevPreflight,
+}
+
+// preflightCreds are the files of the credentials preflight generates:
+// those in -dir, or those of the global -cert, -key, and -ca flags.
+var preflightCreds struct {
+	cert, key, ca string
+}
+
+// artifacts are the parts of the credentials that -regen may name.
+var artifacts = []string{"root", "intermediate", "leaf"}
+
+func runDevPreflight(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	if preflightFlags.check && (preflightFlags.dryRun || preflightFlags.force || preflightFlags.regen != "") {
+		return Usagef("-check cannot be used with -dry-run, -force, or -regen")
+	}
+	if preflightFlags.nodes < 0 {
+		return Usagef("-nodes: %d is negative", preflightFlags.nodes)
+	}
+	preflightCreds.cert, preflightCreds.key, preflightCreds.ca = Global.CertFile, Global.KeyFile, Global.CAFile
+	if dir := preflightFlags.dir; dir != "" {
+		preflightCreds.cert = filepath.Join(dir, "cert.pem")
+		preflightCreds.key = filepath.Join(dir, "key.pem")
+		preflightCreds.ca = filepath.Join(dir, "ca.pem")
+	}
+	for _, name := range []string{preflightCreds.cert, preflightCreds.key, preflightCreds.ca} {
+		if name == Stdio {
+			return Usagef("-cert, -key, and -ca must name files")
+		}
+	}
+
+	root, err := moduleRoot()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	ui.Debug("module root: %s", root)
+
+	regen := make(map[string]bool)
+	for _, a := range splitList(preflightFlags.regen) {
+		if !slices.Contains(artifacts, a) {
+			return Usagef("-regen: unknown artifact %q", a)
+		}
+		regen[a] = true
+	}
+
+	steps := []preflight.Step{
+		{ID: "platform", Name: "check the platform", Test: testPlatform},
+		{ID: "go", Name: "check the Go toolchain", Test: testGo},
+		{ID: "dirs", Name: "create private dirs " + strings.Join(privateDirs(), " and "), Do: doDirs, Test: testDirs, Plan: planDirs},
+		{ID: "clock", Name: "check the system clock", Test: testClock},
+		{ID: "port", Name: "check that " + daemon.DefaultAddr + " is free", Test: testPort},
+		{
+			ID:      "creds",
+			Name:    "generate creds in " + filepath.Dir(preflightCreds.cert),
+			Needs:   []string{"dirs", "clock"},
+			Do:      func() error { return doCreds(regen) },
+			Test:    testCreds,
+			Confirm: confirmCreds,
+			Force:   len(regen) > 0,
+			Plan:    func() []string { return planCreds(regen) },
+		},
+	}
+	steps = append(steps, preflight.Step{
+		ID:     "identity",
+		Name:   "write the identity summary to " + identityFile(),
+		Needs:  []string{"creds"},
+		Do:     doIdentity,
+		Test:   testIdentity,
+		Plan:   func() []string { return []string{"write " + identityFile()} },
+		Report: reportIdentity,
+	})
+	if n := preflightFlags.nodes; n > 0 {
+		steps = append(steps, preflight.Step{
+			ID:      "nodes",
+			Name:    fmt.Sprintf("generate creds for %d nodes in %s", n, filepath.Join(filepath.Dir(preflightCreds.cert), "node*")),
+			Needs:   []string{"creds"},
+			Do:      func() error { return doNodes(n) },
+			Test:    func() error { return testNodes(n) },
+			Confirm: func() string { return confirmNodes(n) },
+			Plan:    func() []string { return planNodes(n) },
+		})
+	}
+
+	steps = append(steps, preflight.Registered()...)
+
+	extra, err := loadPreflightConfig(preflightFlags.config, steps)
+	if err != nil {
+		return err
+	}
+
+	steps, err = preflight.Select(append(steps, extra...), splitList(preflightFlags.only), splitList(preflightFlags.skip))
+	if err != nil {
+		return Usagef("%v", err)
+	}
+	if steps, err = preflight.Order(steps); err != nil {
+		return err
+	}
+
+	rn := &preflight.Runner{
+		Force:  preflightFlags.force,
+		Check:  preflightFlags.check,
+		DryRun: preflightFlags.dryRun,
+	}
+	if Global.Output == output.JSON {
+		rn.JSON = os.Stdout
+	}
+	if sum := rn.Run(steps); sum.Failed > 0 {
+		return exitStatus(ExitFailure)
+	}
+	return nil
+}
+
+// moduleRoot returns the nearest directory holding a go.mod file, starting
+// from the working directory and going up.
+func moduleRoot() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	for dir := wd; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		if filepath.Dir(dir) == dir {
+			return "", fmt.Errorf("no go.mod in %s or above; run preflight in a Go module", wd)
+		}
+	}
+}
+
+// supportedPlatforms are the operating systems and architectures nih is
+// developed on, as GOOS/GOARCH.
+var supportedPlatforms = []string{"linux/amd64", "linux/arm64", "darwin/arm64", "windows/amd64", "windows/arm64"}
+
+// testPlatform checks that preflight runs on one of supportedPlatforms.
+func testPlatform() error {
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	if !slices.Contains(supportedPlatforms, platform) {
+		return fmt.Errorf("%s is not supported; nih is developed on %s", platform, strings.Join(supportedPlatforms, ", "))
+	}
+	return nil
+}
+
+// splitList splits a comma-separated flag value.
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
@@ -0,0 +1,108 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"nih.software/dev/preflight"
+)
+
+// defaultPreflightConfig is the file of -config, where projects embedding nih add
+// their own steps. It need not exist.
+const defaultPreflightConfig = "etc/preflight.json"
+
+// A preflightConfig is the contents of a preflight -config file, as
+// described by "nih help dev preflight". Test and Do are shell commands.
+type preflightConfig struct {
+	Steps []preflightConfigStep `json:"steps"`
+}
+
+type preflightConfigStep struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Needs []string `json:"needs"`
+	Test  string   `json:"test"`
+	Do    string   `json:"do"`
+}
+
+// loadPreflightConfig returns the steps of the config file name, which may refer to
+// the steps of builtin by their IDs. A missing default config has no steps.
+func loadPreflightConfig(name string, builtin []preflight.Step) ([]preflight.Step, error) {
+	data, err := ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) && name == defaultPreflightConfig {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var c preflightConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %w", describeFile(name), err)
+	}
+
+	known := make(map[string]bool)
+	for _, s := range builtin {
+		known[s.ID] = true
+	}
+	for _, cs := range c.Steps {
+		switch {
+		case cs.ID == "":
+			return nil, fmt.Errorf("%s: a step has no id", name)
+		case known[cs.ID]:
+			return nil, fmt.Errorf("%s: step %q is defined twice", name, cs.ID)
+		case cs.Test == "":
+			return nil, fmt.Errorf("%s: step %q has no test", name, cs.ID)
+		}
+		known[cs.ID] = true
+	}
+
+	var steps []preflight.Step
+	for _, cs := range c.Steps {
+		for _, id := range cs.Needs {
+			if !known[id] {
+				return nil, fmt.Errorf("%s: step %q needs unknown step %q", name, cs.ID, id)
+			}
+		}
+
+		s := preflight.Step{
+			ID:    cs.ID,
+			Name:  cs.Name,
+			Needs: cs.Needs,
+			Test:  shellCommand(cs.Test),
+		}
+		if s.Name == "" {
+			s.Name = cs.ID
+		}
+		if cs.Do != "" {
+			s.Do = shellCommand(cs.Do)
+			s.Plan = func() []string { return []string{"run " + cs.Do} }
+		}
+		steps = append(steps, s)
+	}
+
+	return steps, nil
+}
+
+// shellCommand returns a function running command with shell, failing with
+// the last line of its output if it fails.
+func shellCommand(command string) func() error {
+	return func() error {
+		out, err := shell(command).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		if last := lines[len(lines)-1]; last != "" {
+			return fmt.Errorf("%s: %w: %s", command, err, last)
+		}
+		return fmt.Errorf("%s: %w", command, err)
+	}
+}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nih.software/trust"
+	"nih.software/trust/join"
+)
+
+// identityFile returns the file of the identity summary of the credentials,
+// beside them.
+func identityFile() string {
+	return filepath.Join(filepath.Dir(preflightCreds.cert), "README-identity.txt")
+}
+
+// identityText returns the identity summary of b: the certificates of the
+// chain and the roots with their fingerprints and expiry. It does not depend
+// on the time, so that it only changes with the credentials.
+func identityText(b *trust.Bundle) string {
+	var w strings.Builder
+	fmt.Fprintf(&w, `These are the development credentials of this checkout, as generated by
+"nih dev preflight". An instance presents the chain and trusts the roots
+below; compare the fingerprints of the roots across checkouts to tell
+which development CA an instance trusts.
+
+cert: %s
+ca:   %s
+`, preflightCreds.cert, preflightCreds.ca)
+
+	cert := func(role string, info *certInfo) {
+		fmt.Fprintf(&w, "  %s %s\n", role, orEmpty(info.Subject))
+		fmt.Fprintf(&w, "    %-10s %s\n", "serial:", info.Serial)
+		fmt.Fprintf(&w, "    %-10s %s\n", "not after:", info.NotAfter.UTC().Format(time.RFC3339))
+		fmt.Fprintf(&w, "    %-10s %s\n", "sha256:", info.SHA256)
+	}
+
+	fmt.Fprintf(&w, "\nchain:\n")
+	for i, c := range b.Chain() {
+		role := "intermediate"
+		if i == 0 {
+			role = "leaf"
+		}
+		cert(role, newCertInfo(c))
+	}
+
+	fmt.Fprintf(&w, "\nroots:\n")
+	for _, c := range b.Roots() {
+		cert("root", newCertInfo(c))
+		fmt.Fprintf(&w, "    %-10s %s\n", "join pin:", join.Pin(c))
+	}
+
+	return w.String()
+}
+
+// testIdentity checks that the identity summary describes the credentials.
+func testIdentity() error {
+	b, err := trust.LoadPEM(preflightCreds.cert, preflightCreds.key, preflightCreds.ca)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(identityFile())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, []byte(identityText(b))) {
+		return fmt.Errorf("%s does not describe the credentials", identityFile())
+	}
+	return nil
+}
+
+// doIdentity writes the identity summary of the credentials.
+func doIdentity() error {
+	b, err := trust.LoadPEM(preflightCreds.cert, preflightCreds.key, preflightCreds.ca)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(identityFile(), []byte(identityText(b)))
+}
+
+// reportIdentity summarizes the identity of the credentials in a few lines:
+// the fingerprints of the roots, and the leaf and when it expires.
+func reportIdentity() []string {
+	b, err := trust.LoadPEM(preflightCreds.cert, preflightCreds.key, preflightCreds.ca)
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	var lines []string
+	for _, c := range b.Roots() {
+		info := newCertInfo(c)
+		lines = append(lines, fmt.Sprintf("root sha256 %s (%s)", info.SHA256, validity(now, info.NotBefore, info.NotAfter)))
+	}
+	leaf := newCertInfo(b.Chain()[0])
+	lines = append(lines, fmt.Sprintf("leaf serial %s (%s)", leaf.Serial, validity(now, leaf.NotBefore, leaf.NotAfter)))
+	lines = append(lines, "details in "+identityFile())
+	return lines
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package cli
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// errAddrInUse is the error of listening on an address in use.
+var errAddrInUse error = syscall.EADDRINUSE
+
+// shell returns the command running the shell command line.
+func shell(command string) *exec.Cmd {
+	return exec.Command("sh", "-c", command)
+}
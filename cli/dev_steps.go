@@ -0,0 +1,627 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/daemon"
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+// testGo checks that the Go toolchain running preflight is at least
+// the version of the go directive in go.mod.
+func testGo() error {
+	want, err := goModVersion("go.mod")
+	if err != nil {
+		return err
+	}
+
+	have := strings.TrimPrefix(runtime.Version(), "go")
+	if strings.HasPrefix(have, "devel") {
+		return nil
+	}
+
+	if compareVersions(have, want) < 0 {
+		return fmt.Errorf("go%s is older than go%s, which go.mod requires", have, want)
+	}
+	return nil
+}
+
+// goModVersion returns the version of the go directive in the go.mod file name.
+func goModVersion(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("%w; run \"nih dev preflight\" in the repository root", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(sc.Text()), "go "); ok {
+			return strings.TrimSpace(v), nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s: no go directive", name)
+}
+
+// compareVersions compares Go versions such as 1.23 and 1.23.4 by their
+// numbers, ignoring suffixes such as rc1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range max(len(as), len(bs)) {
+		var x, y int
+		if i < len(as) {
+			x = leadingInt(as[i])
+		}
+		if i < len(bs) {
+			y = leadingInt(bs[i])
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	return 0
+}
+
+func leadingInt(s string) int {
+	end := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if end >= 0 {
+		s = s[:end]
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// privateDirs returns the directories nih keeps secrets in, which only their
+// owner may enter: those of the credentials and the control socket.
+func privateDirs() []string {
+	var dirs []string
+	for _, name := range []string{preflightCreds.cert, preflightCreds.key, preflightCreds.ca, daemon.DefaultControl} {
+		if dir := filepath.Dir(name); !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// exposed reports whether others may access a file of mode perm. On
+// Windows, which controls access with ACLs rather than modes, files are as
+// private as the user profile the checkout is in.
+func exposed(perm fs.FileMode) bool {
+	return runtime.GOOS != "windows" && perm&0077 != 0
+}
+
+// testDirs checks that privateDirs exist and that neither they nor the files
+// in them are accessible to others.
+func testDirs() error {
+	for _, dir := range privateDirs() {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if exposed(info.Mode().Perm()) {
+				return fmt.Errorf("%s has mode %v, which others may access", path, info.Mode().Perm())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// doDirs creates privateDirs and takes access to them and their files away
+// from others.
+func doDirs() error {
+	for _, dir := range privateDirs() {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if perm := info.Mode().Perm(); exposed(perm) {
+				return os.Chmod(path, perm&^0077)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planDirs describes the changes doDirs would make.
+func planDirs() []string {
+	var changes []string
+	for _, dir := range privateDirs() {
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			changes = append(changes, "create "+dir+" with mode 0700")
+			continue
+		}
+
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if perm := info.Mode().Perm(); exposed(perm) {
+				changes = append(changes, fmt.Sprintf("chmod %s from %#o to %#o", path, perm, perm&^0077))
+			}
+			return nil
+		})
+	}
+	return changes
+}
+
+// minClock is the release date of Go 1.23, the oldest toolchain nih builds
+// with, before which no clock running preflight can be right.
+var minClock = time.Date(2024, time.August, 13, 0, 0, 0, 0, time.UTC)
+
+// issueClockSkew is how far the certificate issued last may seem to be ahead
+// of the clock, as when it was issued on another machine.
+const issueClockSkew = 5 * time.Minute
+
+// testClock checks that the system clock is plausible: not before the
+// release of the toolchain, nor before the certificate issued last, which
+// would then not be valid yet.
+func testClock() error {
+	now := time.Now()
+	if now.Before(minClock) {
+		return fmt.Errorf("the clock reads %s, before the release of Go 1.23; set the system clock", now.Format(time.DateTime))
+	}
+
+	chain, err := trust.LoadCertificates(preflightCreds.cert)
+	if err != nil || len(chain) == 0 {
+		// The credentials step reports missing or broken credentials.
+		return nil
+	}
+
+	if nb := chain[0].NotBefore; now.Add(issueClockSkew).Before(nb) {
+		return fmt.Errorf("the clock reads %s, before %s was issued at %s; set the system clock", now.Format(time.DateTime), preflightCreds.cert, nb.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+// testPort checks that the default listen address of nih serve is free.
+func testPort() error {
+	ln, err := net.Listen("tcp", daemon.DefaultAddr)
+	if errors.Is(err, errAddrInUse) {
+		return fmt.Errorf("%s is in use, by nih serve or another program; stop it, or run nih serve with -listen", daemon.DefaultAddr)
+	}
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
+
+// caKeyFile returns the file of the key of the root or intermediate CA of
+// the development credentials, which preflight keeps beside their key for
+// reissuing.
+func caKeyFile(ca string) string {
+	return filepath.Join(filepath.Dir(preflightCreds.key), ca+"-key.pem")
+}
+
+// doCreds generates the artifacts in regen, or all of them if regen is empty.
+func doCreds(regen map[string]bool) error {
+	for _, dir := range privateDirs() {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	if len(regen) == 0 {
+		h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+			Intermediates: 1,
+			Leaves:        1,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return writeCreds(h.Root, h.Intermediates[0], h.Leaves[0])
+	}
+
+	return reissueCreds(regen)
+}
+
+// reissueCreds generates new keys for the artifacts in regen and reissues
+// the certificates that they, or their issuers, sign, keeping the other keys.
+func reissueCreds(regen map[string]bool) error {
+	chain, err := trust.LoadCertificates(preflightCreds.cert)
+	if err != nil {
+		return err
+	}
+	if len(chain) != 2 {
+		return fmt.Errorf("%s: want a leaf and an intermediate, have %d certificates; regenerate everything with -force", preflightCreds.cert, len(chain))
+	}
+
+	var root, intermediate, leaf trustgen.Credentials
+	intermediate.Cert, leaf.Cert = chain[1], chain[0]
+
+	if regen["root"] {
+		if root.Cert, root.Key, err = trustgen.NewRoot(); err != nil {
+			return err
+		}
+	} else {
+		roots, err := trust.LoadCertificates(preflightCreds.ca)
+		if err != nil {
+			return err
+		}
+		root.Cert = roots[0]
+
+		if regen["intermediate"] {
+			if root.Key, err = loadCAKey(caKeyFile("root")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if regen["intermediate"] {
+		if intermediate.Key, err = trustgen.GenerateKey(trustgen.Ed25519); err != nil {
+			return err
+		}
+	} else if regen["leaf"] || regen["root"] {
+		if intermediate.Key, err = loadCAKey(caKeyFile("intermediate")); err != nil {
+			return err
+		}
+	}
+
+	if regen["root"] || regen["intermediate"] {
+		if intermediate.Cert, err = reissue(root, intermediate.Key, true); err != nil {
+			return err
+		}
+	}
+
+	if regen["leaf"] {
+		if leaf.Key, err = trustgen.GenerateKey(trustgen.Ed25519); err != nil {
+			return err
+		}
+	} else if leaf.Key, err = trust.LoadPrivateKey(preflightCreds.key); err != nil {
+		return err
+	}
+
+	if regen["leaf"] || regen["intermediate"] {
+		if leaf.Cert, err = reissue(intermediate, leaf.Key, false); err != nil {
+			return err
+		}
+	}
+
+	return writeCreds(root, intermediate, leaf)
+}
+
+// planCreds describes the files doCreds would write for regen.
+func planCreds(regen map[string]bool) []string {
+	files := []string{preflightCreds.ca, preflightCreds.cert, preflightCreds.key, caKeyFile("root"), caKeyFile("intermediate")}
+	if len(regen) > 0 {
+		files = []string{preflightCreds.cert}
+		if regen["root"] {
+			files = append(files, preflightCreds.ca, caKeyFile("root"))
+		}
+		if regen["intermediate"] {
+			files = append(files, caKeyFile("intermediate"))
+		}
+		if regen["leaf"] {
+			files = append(files, preflightCreds.key)
+		}
+	}
+
+	var changes []string
+	for _, f := range files {
+		verb := "create"
+		if _, err := os.Stat(f); err == nil {
+			verb = "replace"
+		}
+		changes = append(changes, verb+" "+f)
+	}
+	return changes
+}
+
+// loadCAKey loads the key of a CA, which checkouts from before the keys
+// were kept do not have.
+func loadCAKey(name string) (crypto.Signer, error) {
+	key, err := trust.LoadPrivateKey(name)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w; regenerate everything with -force", err)
+	}
+	return key, err
+}
+
+// reissue issues a certificate for key signed by issuer: an intermediate CA
+// certificate if intermediate is set, and a leaf otherwise.
+func reissue(issuer trustgen.Credentials, key crypto.Signer, intermediate bool) (*x509.Certificate, error) {
+	ca, err := trustgen.NewCA(issuer.Cert, issuer.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if intermediate {
+		return ca.SignIntermediate(key.Public())
+	}
+	return ca.SignLeaf(key.Public())
+}
+
+// writeCreds writes the credentials of leaf, and the keys of its CAs
+// for reissuing. A nil key is left as it is.
+func writeCreds(root, intermediate, leaf trustgen.Credentials) error {
+	files := []credFile{
+		{preflightCreds.ca, trustgen.PEMEncodeCertificates(root.Cert)},
+		{preflightCreds.cert, trustgen.PEMEncodeCertificates(leaf.Cert, intermediate.Cert)},
+		{preflightCreds.key, trustgen.PEMEncodePrivateKey(leaf.Key)},
+	}
+	if root.Key != nil {
+		files = append(files, credFile{caKeyFile("root"), trustgen.PEMEncodePrivateKey(root.Key)})
+	}
+	if intermediate.Key != nil {
+		files = append(files, credFile{caKeyFile("intermediate"), trustgen.PEMEncodePrivateKey(intermediate.Key)})
+	}
+
+	return replaceFiles(files)
+}
+
+// A credFile is a file of credentials to write.
+type credFile struct {
+	name string
+	data []byte
+}
+
+// replaceFiles writes files, first backing up those that exist next to them,
+// as "nih cert rotate" does, so that no certificate is lost. Backups made
+// within the same second are numbered.
+func replaceFiles(files []credFile) error {
+	now := time.Now()
+	suffix := backupSuffix(now)
+	for n := 2; backedUp(files, suffix); n++ {
+		suffix = strings.TrimSuffix(backupSuffix(now), ".bak") + "-" + strconv.Itoa(n) + ".bak"
+	}
+
+	for _, f := range files {
+		err := backupFile(f.name, f.name+suffix)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		if err := writeFileAtomic(f.name, f.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backedUp reports whether any of files has a backup with suffix.
+func backedUp(files []credFile, suffix string) bool {
+	for _, f := range files {
+		if _, err := os.Lstat(f.name + suffix); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmCreds asks before replacing credentials that exist but fail their
+// test, unlike missing credentials, or valid ones replaced with -force or
+// -regen, as asked.
+func confirmCreds() string {
+	if _, err := os.Stat(preflightCreds.cert); err != nil {
+		return ""
+	}
+	if err := testCreds(); err != nil {
+		return fmt.Sprintf("The credentials in %s fail their test: %v.\nReplace them, keeping backups?", filepath.Dir(preflightCreds.cert), err)
+	}
+	return ""
+}
+
+// testCreds checks that the credentials load and do not expire soon.
+func testCreds() error {
+	b, err := trust.LoadPEM(preflightCreds.cert, preflightCreds.key, preflightCreds.ca)
+	if err != nil {
+		return err
+	}
+	return testExpiry(b)
+}
+
+// testExpiry checks that no certificate of b expires within -expiry-window.
+func testExpiry(b *trust.Bundle) error {
+	names := []string{"leaf", "intermediate"}
+	deadline := time.Now().Add(preflightFlags.expiryWindow)
+	for i, c := range append(b.Chain(), b.Roots()...) {
+		name := "root"
+		if i < len(b.Chain()) {
+			name = names[min(i, len(names)-1)]
+		}
+
+		if c.NotAfter.Before(deadline) {
+			return fmt.Errorf("%s certificate expires %s, within -expiry-window %v", name, c.NotAfter.Format(time.DateOnly), preflightFlags.expiryWindow)
+		}
+	}
+
+	return nil
+}
+
+// nodeDir returns the directory of the credentials of node i, counting
+// from 1, for running several instances of nih serve side by side.
+func nodeDir(i int) string {
+	return filepath.Join(filepath.Dir(preflightCreds.cert), fmt.Sprintf("node%d", i))
+}
+
+// nodeFiles returns the certificate, key, and CA files of node i, laid out
+// as the default credentials.
+func nodeFiles(i int) (cert, key, ca string) {
+	dir := nodeDir(i)
+	return filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+}
+
+// testNodes checks that each of n nodes has credentials issued by the
+// intermediate CA of the default credentials, which do not expire within
+// -expiry-window.
+func testNodes(n int) error {
+	chain, err := trust.LoadCertificates(preflightCreds.cert)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= n; i++ {
+		if err := testNode(i, chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testNode checks the credentials of node i against chain, the chain of the
+// default credentials.
+func testNode(i int, chain []*x509.Certificate) error {
+	b, err := trust.LoadPEM(nodeFiles(i))
+	if err != nil {
+		return err
+	}
+
+	have := b.Chain()
+	if len(have) != len(chain) || !bytes.Equal(have[len(have)-1].Raw, chain[len(chain)-1].Raw) {
+		return fmt.Errorf("%s was not issued by the CA of %s", nodeDir(i), preflightCreds.cert)
+	}
+	return testExpiry(b)
+}
+
+// doNodes issues a leaf with a key of its own to each of n nodes whose
+// credentials fail their test, or to every node with -force.
+func doNodes(n int) error {
+	chain, err := trust.LoadCertificates(preflightCreds.cert)
+	if err != nil {
+		return err
+	}
+	if len(chain) != 2 {
+		return fmt.Errorf("%s: want a leaf and an intermediate, have %d certificates; regenerate everything with -force", preflightCreds.cert, len(chain))
+	}
+
+	key, err := loadCAKey(caKeyFile("intermediate"))
+	if err != nil {
+		return err
+	}
+	ca, err := trustgen.NewCA(chain[1], key)
+	if err != nil {
+		return err
+	}
+
+	roots, err := os.ReadFile(preflightCreds.ca)
+	if err != nil {
+		return err
+	}
+
+	for i := 1; i <= n; i++ {
+		if !preflightFlags.force && testNode(i, chain) == nil {
+			continue
+		}
+
+		name := fmt.Sprintf("node%d", i)
+		cert, key, err := ca.NewLeaf(trustgen.WithSubject(pkix.Name{CommonName: name}))
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(nodeDir(i), 0700); err != nil {
+			return err
+		}
+
+		certName, keyName, caName := nodeFiles(i)
+		err = replaceFiles([]credFile{
+			{certName, trustgen.PEMEncodeCertificates(cert, chain[1])},
+			{keyName, trustgen.PEMEncodePrivateKey(key)},
+			{caName, roots},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// confirmNodes asks before replacing the credentials of nodes that exist but
+// fail their test.
+func confirmNodes(n int) string {
+	chain, err := trust.LoadCertificates(preflightCreds.cert)
+	if err != nil {
+		// The credentials are replaced, and so must be those of every node.
+		chain = nil
+	}
+
+	var dirs []string
+	for i := 1; i <= n; i++ {
+		if _, err := os.Stat(nodeDir(i)); err != nil {
+			continue
+		}
+		if chain == nil || testNode(i, chain) != nil {
+			dirs = append(dirs, nodeDir(i))
+		}
+	}
+	if len(dirs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("The credentials in %s fail their test.\nReplace them, keeping backups?", strings.Join(dirs, ", "))
+}
+
+// planNodes describes the files doNodes would write for n nodes.
+func planNodes(n int) []string {
+	chain, _ := trust.LoadCertificates(preflightCreds.cert)
+
+	var changes []string
+	for i := 1; i <= n; i++ {
+		if !preflightFlags.force && chain != nil && testNode(i, chain) == nil {
+			continue
+		}
+
+		verb := "create"
+		if _, err := os.Stat(nodeDir(i)); err == nil {
+			verb = "replace"
+		}
+		changes = append(changes, verb+" the credentials in "+nodeDir(i))
+	}
+	return changes
+}
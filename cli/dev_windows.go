@@ -0,0 +1,20 @@
+package cli
+
+import (
+	"os/exec"
+
+	"golang.org/x/sys/windows"
+)
+
+// errAddrInUse is the error of listening on an address in use.
+var errAddrInUse error = windows.WSAEADDRINUSE
+
+// shell returns the command running the shell command line: with sh if it
+// is on the PATH, as with Git for Windows, so that the steps of projects
+// run on every platform, and with cmd otherwise.
+func shell(command string) *exec.Cmd {
+	if _, err := exec.LookPath("sh"); err == nil {
+		return exec.Command("sh", "-c", command)
+	}
+	return exec.Command("cmd", "/C", command)
+}
@@ -0,0 +1,504 @@
+package cli
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"nih.software/daemon"
+	"nih.software/trust"
+)
+
+var doctorFlags struct {
+	peers   string
+	control string
+	warn    time.Duration
+}
+
+var cmdDoctor = &Command{
+	Name:    "doctor",
+	Summary: "diagnose problems with the credentials and connectivity",
+	Help: `
+Doctor runs a series of checks on this instance and prints, for each
+problem found, what is wrong and how to fix it:
+
+  - the files of the global -cert, -key, and -ca flags exist and parse
+  - private keys, including those of the CA in etc/ca, are readable
+    by their owner only
+  - the key is the key of the leaf certificate
+  - no certificate is expired, expiring within -warn, or not yet valid
+  - the chain leads to one of the roots, by the rules of "nih help trust"
+  - a daemon on the -control socket serves the same credentials, and
+    the peers it probes have clocks within 5 seconds of its own
+  - each peer of -peer is reachable, accepts the credentials and is
+    accepted by them, and has a clock within 5 seconds of this host's
+
+Without -peer, doctor checks the address of the daemon on -control,
+if one is running.
+
+Doctor exits with status 1 if any check failed. Warnings do not count.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		doctorFlags.peers = ""
+		fs.StringVar(&doctorFlags.peers, "peer", "", "Comma-separated `addresses` of peers to check, host[:port]")
+		fs.StringVar(&doctorFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+		fs.DurationVar(&doctorFlags.warn, "warn", 30*24*time.Hour, "Warn if a certificate expires within `duration`")
+	},
+	Run: runDoctor,
+}
+
+func init() {
+	Register(cmdDoctor)
+}
+
+// maxClockSkew is the clock difference with a peer beyond which doctor
+// warns, that beyond which the daemon does.
+const maxClockSkew = daemon.MaxClockSkew
+
+func runDoctor(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	if Global.CertFile == Stdio && Global.CAFile == Stdio {
+		return Usagef("-cert and -ca cannot both be read from standard input")
+	}
+
+	d := &doctor{now: time.Now()}
+
+	chain := d.certificates("cert file", Global.CertFile)
+	key := d.key()
+	roots := d.certificates("ca file", Global.CAFile)
+
+	d.permissions(Global.KeyFile)
+	for _, name := range []string{caRootKey, caIntermediateKey} {
+		if name := filepath.Join(defaultCADir, name); fileExists(name) {
+			d.permissions(name)
+		}
+	}
+
+	var b *trust.Bundle
+	if chain != nil && key != nil && roots != nil {
+		if d.keyMatch(chain[0], key) {
+			d.expiry(chain, roots)
+			if d.chain(chain, roots) {
+				b, _ = trust.NewBundle(chain, key, roots)
+			}
+		}
+	}
+
+	peers := d.daemon(ctx, chain)
+	if doctorFlags.peers != "" {
+		peers = strings.Split(doctorFlags.peers, ",")
+	}
+
+	for _, addr := range peers {
+		d.peer(ctx, withDefaultPort(addr), b, roots)
+	}
+
+	if err := Print(&d.result); err != nil {
+		return err
+	}
+
+	if d.result.Failed > 0 {
+		return exitStatus(ExitFailure)
+	}
+	return nil
+}
+
+// doctor accumulates the results of the checks of "nih doctor".
+type doctor struct {
+	result doctorResult
+	now    time.Time
+}
+
+type doctorResult struct {
+	Checks   []*doctorCheck `json:"checks"`
+	Failed   int            `json:"failed"`
+	Warnings int            `json:"warnings"`
+}
+
+type doctorCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"` // ok, warn, fail, or skip
+	Message string `json:"message"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+func (d *doctor) add(name, status, message, fix string) {
+	d.result.Checks = append(d.result.Checks, &doctorCheck{Name: name, Status: status, Message: message, Fix: fix})
+
+	switch status {
+	case "fail":
+		d.result.Failed++
+	case "warn":
+		d.result.Warnings++
+	}
+}
+
+func (d *doctor) ok(name, message string)        { d.add(name, "ok", message, "") }
+func (d *doctor) skip(name, message string)      { d.add(name, "skip", message, "") }
+func (d *doctor) warn(name, message, fix string) { d.add(name, "warn", message, fix) }
+func (d *doctor) fail(name, message, fix string) { d.add(name, "fail", message, fix) }
+
+// read reads the file name for the check of that name,
+// reporting a missing or unreadable file.
+func (d *doctor) read(check, name string) []byte {
+	data, err := ReadFile(name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		d.fail(check, name+" does not exist",
+			`Get credentials from a CA node with "nih join", or point the global -cert, -key, and -ca flags at them. Run "nih help bootstrap" to create a first hierarchy.`)
+		return nil
+	case errors.Is(err, os.ErrPermission):
+		d.fail(check, err.Error(), "Run nih as the user owning "+name+".")
+		return nil
+	case err != nil:
+		d.fail(check, err.Error(), "")
+		return nil
+	}
+	return data
+}
+
+func (d *doctor) certificates(check, name string) []*x509.Certificate {
+	data := d.read(check, name)
+	if data == nil {
+		return nil
+	}
+
+	certs, err := trust.ParseCertificatesPEM(data)
+	if err == nil && len(certs) == 0 {
+		err = errors.New("no certificate found")
+	}
+	if err != nil {
+		d.fail(check, fmt.Sprintf("%s: %v", name, err),
+			"The file must hold PEM CERTIFICATE blocks. Run \"nih cert inspect "+name+"\" to see what it holds.")
+		return nil
+	}
+
+	d.ok(check, name+": "+plural(len(certs), "certificate"))
+	return certs
+}
+
+func (d *doctor) key() crypto.Signer {
+	const check = "key file"
+
+	data := d.read(check, Global.KeyFile)
+	if data == nil {
+		return nil
+	}
+
+	key, err := trust.ParsePrivateKeyPEM(data)
+	if err != nil {
+		d.fail(check, fmt.Sprintf("%s: %v", Global.KeyFile, err),
+			"The file must hold a single unencrypted PKCS #8 PRIVATE KEY block.")
+		return nil
+	}
+
+	d.ok(check, fmt.Sprintf("%s: %s key", Global.KeyFile, describeKey(key.Public())))
+	return key
+}
+
+// permissions checks that the private key file name is not accessible by others.
+func (d *doctor) permissions(name string) {
+	const check = "key permissions"
+	if name == Stdio {
+		return
+	}
+
+	// Windows controls access with ACLs, which modes do not reflect.
+	if runtime.GOOS == "windows" {
+		d.skip(check, "Windows controls access with ACLs")
+		return
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		d.skip(check, err.Error())
+		return
+	}
+
+	if mode := fi.Mode().Perm(); mode&0077 != 0 {
+		d.fail(check, fmt.Sprintf("%s is accessible by group or others (mode %04o)", name, mode),
+			"Run \"chmod 600 "+name+"\". Anyone who read the key can impersonate this instance until its certificate is revoked.")
+		return
+	}
+
+	d.ok(check, name+" is private to its owner")
+}
+
+func (d *doctor) keyMatch(leaf *x509.Certificate, key crypto.Signer) bool {
+	const check = "key match"
+
+	if !keyMatches(leaf, key) {
+		d.fail(check, fmt.Sprintf("%s is not the key of the certificate in %s", Global.KeyFile, Global.CertFile),
+			"Restore the key the certificate was issued for, or issue a new certificate for this key with \"nih cert rotate\".")
+		return false
+	}
+
+	d.ok(check, "the key is the key of "+orEmpty(leaf.Subject.String()))
+	return true
+}
+
+// expiry checks the validity period of every certificate of chain and roots.
+func (d *doctor) expiry(chain, roots []*x509.Certificate) {
+	check := func(role, file string, c *x509.Certificate, fix string) {
+		const name = "expiry"
+		desc := fmt.Sprintf("%s %s (serial %s in %s) %s", role, orEmpty(c.Subject.String()), c.SerialNumber, file, validity(d.now, c.NotBefore, c.NotAfter))
+
+		switch {
+		case d.now.Before(c.NotBefore):
+			d.fail(name, desc,
+				"The clock of this host is behind the issuer's, or the certificate was issued in advance. Check the system clock and its NTP synchronization.")
+		case d.now.After(c.NotAfter):
+			d.fail(name, desc, fix)
+		case c.NotAfter.Sub(d.now) <= doctorFlags.warn:
+			d.warn(name, desc, fix)
+		default:
+			d.ok(name, desc)
+		}
+	}
+
+	for i, c := range chain {
+		if i == 0 {
+			check("leaf", Global.CertFile, c, "Renew it with \"nih cert rotate\".")
+		} else {
+			check("intermediate", Global.CertFile, c,
+				"Issue a new intermediate from the root with \"nih ca sign -profile intermediate\", then renew the certificates under it.")
+		}
+	}
+
+	for _, c := range roots {
+		check("root", Global.CAFile, c,
+			"Create a new root and distribute it to every instance alongside the old one before moving certificates to it. Run \"nih help trust\" for rotating roots.")
+	}
+}
+
+// chain verifies chain against roots, explaining the common failures.
+func (d *doctor) chain(chain, roots []*x509.Certificate) bool {
+	const check = "chain"
+
+	for i, c := range roots {
+		if err := trust.VerifyChain([]*x509.Certificate{c}, roots); err != nil {
+			msg, fix := explainVerify(err, Global.CAFile)
+			d.fail(check, fmt.Sprintf("root[%d] %s: %s", i, orEmpty(c.Subject.String()), msg), fix)
+			return false
+		}
+	}
+
+	if err := trust.VerifyChain(chain, roots); err != nil {
+		msg, fix := explainVerify(err, Global.CertFile)
+		d.fail(check, msg, fix)
+		return false
+	}
+
+	d.ok(check, fmt.Sprintf("%s leads to a root in %s", Global.CertFile, Global.CAFile))
+	return true
+}
+
+// explainVerify describes a chain verification error of the certificates in file
+// and suggests a fix.
+func explainVerify(err error, file string) (msg, fix string) {
+	var uerr x509.UnknownAuthorityError
+	var ierr x509.CertificateInvalidError
+
+	switch {
+	case errors.As(err, &uerr):
+		return "the chain does not lead to any root in " + Global.CAFile,
+			"The certificate was issued under another root, or " + Global.CAFile + " lacks its root. Compare the roots of \"nih trust show\" with the issuer of \"nih cert inspect " + file + "\"."
+	case errors.As(err, &ierr) && ierr.Reason == x509.Expired:
+		return err.Error(), "See the expiry checks."
+	case strings.Contains(err.Error(), "authority key identifier"):
+		return err.Error(), "The certificates in " + file + " are out of order or from different chains. The leaf must come first, followed by the intermediate that issued it, and so on."
+	case strings.Contains(err.Error(), "key usage"), strings.Contains(err.Error(), "is a CA"), strings.Contains(err.Error(), "not a CA"):
+		return err.Error(), "The certificate was not issued for nih instances. Issue one with \"nih ca sign -profile node\" or \"nih join\"."
+	default:
+		return err.Error(), ""
+	}
+}
+
+// daemon checks the daemon on the control socket, if one is running,
+// and returns its address for the peer checks.
+func (d *doctor) daemon(ctx context.Context, chain []*x509.Certificate) []string {
+	const check = "daemon"
+
+	if !fileExists(doctorFlags.control) {
+		d.skip(check, "no daemon on "+doctorFlags.control)
+		return nil
+	}
+
+	var s daemon.Status
+	if err := controlGet(ctx, doctorFlags.control, "/admin/status", &s); err != nil {
+		d.fail(check, err.Error(),
+			"The socket exists but nothing answers on it. A daemon that crashed leaves it behind, and the next nih serve removes it.")
+		return nil
+	}
+
+	if chain != nil && s.Serial != chain[0].SerialNumber.String() {
+		d.warn(check, fmt.Sprintf("the daemon serves serial %s, not the %s of %s", s.Serial, chain[0].SerialNumber, Global.CertFile),
+			"Reload the daemon with SIGHUP to pick up the new credentials.")
+	} else {
+		d.ok(check, "running, serial "+s.Serial)
+	}
+	d.peerClocks(ctx)
+
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return nil
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+	return []string{net.JoinHostPort(host, port)}
+}
+
+// peerClocks checks the skew of the clocks of the peers the daemon on the
+// control socket measured, if any.
+func (d *doctor) peerClocks(ctx context.Context) {
+	var peers []daemon.Peer
+	if err := controlGet(ctx, doctorFlags.control, "/admin/peers", &peers); err != nil {
+		return
+	}
+
+	measured, skewed := 0, 0
+	for _, p := range peers {
+		if p.Skew == 0 {
+			continue
+		}
+		measured++
+
+		name := orEmpty(p.Name) + " at " + p.Addr
+		skew := time.Duration(p.Skew).Round(time.Millisecond)
+		if skew > maxClockSkew || skew < -maxClockSkew {
+			skewed++
+		}
+		switch {
+		case skew > maxClockSkew:
+			d.warn("clock", fmt.Sprintf("%s: the peer's clock is %v ahead of the daemon's", name, skew),
+				"Certificates issued by the peer's CA are not yet valid on the daemon's host. Synchronize both clocks with NTP.")
+		case skew < -maxClockSkew:
+			d.warn("clock", fmt.Sprintf("%s: the peer's clock is %v behind the daemon's", name, -skew),
+				"The peer rejects certificates issued on the daemon's host until its clock catches up. Synchronize both clocks with NTP.")
+		}
+	}
+	if measured > 0 && skewed == 0 {
+		d.ok("clock", fmt.Sprintf("%s of the daemon within %v of its clock", plural(measured, "peer"), maxClockSkew))
+	}
+}
+
+// peer checks the connection to the peer at addr with the credentials of b.
+func (d *doctor) peer(ctx context.Context, addr string, b *trust.Bundle, roots []*x509.Certificate) {
+	const check = "peer"
+
+	if b == nil {
+		d.skip(check, addr+": no valid credentials to connect with")
+		return
+	}
+
+	p, state, err := probe(ctx, addr, b, nil)
+	if err != nil {
+		msg, fix := explainPeer(ctx, err, addr, roots)
+		d.fail(check, addr+": "+msg, fix)
+		return
+	}
+
+	d.ok(check, fmt.Sprintf("%s: %s, serial %s, rtt %v", addr, orEmpty(state.PeerCertificates[0].Subject.String()),
+		state.PeerCertificates[0].SerialNumber, p.RTT.Round(time.Microsecond)))
+
+	skew := p.skew.Round(time.Millisecond)
+	switch {
+	case skew > maxClockSkew:
+		d.warn("clock", fmt.Sprintf("%s: the peer's clock is %v ahead of this host's", addr, skew),
+			"Certificates issued by the peer's CA are not yet valid here. Synchronize both clocks with NTP.")
+	case skew < -maxClockSkew:
+		d.warn("clock", fmt.Sprintf("%s: the peer's clock is %v behind this host's", addr, -skew),
+			"The peer rejects certificates issued here until its clock catches up. Synchronize both clocks with NTP.")
+	default:
+		d.ok("clock", fmt.Sprintf("%s: within %v of this host's", addr, maxClockSkew))
+	}
+}
+
+// explainPeer describes a failure to probe the peer at addr and suggests a fix.
+func explainPeer(ctx context.Context, err error, addr string, roots []*x509.Certificate) (msg, fix string) {
+	var dnserr *net.DNSError
+	var operr *net.OpError
+	var verr *trust.VerificationError
+
+	switch {
+	case errors.As(err, &dnserr):
+		return err.Error(), "Check the host name, or use the peer's IP address."
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "nothing listens there", "Start nih serve on the peer, and check the port of its -listen flag."
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return "no answer within " + Global.Timeout.String(),
+			"A firewall may be dropping the connection. Check that the port is open between the two hosts."
+	case errors.As(err, &verr):
+		msg, fix = "the peer's certificate was rejected: "+verr.Err.Error(), ""
+		if chain, perr := peerChain(ctx, addr); perr == nil {
+			if _, fix = explainVerify(trust.VerifyChain(chain, roots), addr); fix == "" {
+				fix = "Run \"nih cert inspect -connect " + addr + "\" to see its chain."
+			}
+		}
+		return msg, fix
+	case errors.As(err, &operr) && operr.Op == "remote error":
+		return "the peer rejected this instance's certificate: " + err.Error(),
+			"The peer does not trust the root of this instance, or has revoked its certificate. Compare \"nih trust show\" on both hosts."
+	default:
+		return err.Error(), ""
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// WriteText implements output.Texter.
+func (r *doctorResult) WriteText(w io.Writer) error {
+	u := Global.UI()
+
+	for _, c := range r.Checks {
+		var status string
+		switch c.Status {
+		case "ok":
+			status = u.Green(" OK ")
+		case "warn":
+			status = u.Yellow("WARN")
+		case "fail":
+			status = u.Red("FAIL")
+		default:
+			status = u.Faint("SKIP")
+		}
+
+		fmt.Fprintf(w, "[%s] %-17s %s\n", status, c.Name, c.Message)
+		if c.Fix != "" {
+			fmt.Fprintf(w, "       %s %s\n", u.Faint("fix:"), c.Fix)
+		}
+	}
+
+	if r.Failed == 0 && r.Warnings == 0 {
+		_, err := fmt.Fprintf(w, "\nNo problems found.\n")
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "\n%s, %s\n", plural(r.Failed, "problem"), plural(r.Warnings, "warning"))
+	return err
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
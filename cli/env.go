@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EnvName returns the environment variable bound to the named flag of the command at path.
+// For example, -issuer-cert of "nih trustgen leaf" is bound to NIH_TRUSTGEN_LEAF_ISSUER_CERT,
+// and the global -cert flag (path "nih") to NIH_CERT.
+func EnvName(path, name string) string {
+	r := strings.NewReplacer(" ", "_", "-", "_")
+	return strings.ToUpper(r.Replace(path + "_" + name))
+}
+
+// ApplyEnv sets every flag in fs that was not given on the command line
+// from its environment variable, if that is set.
+// Flags therefore take precedence over the environment, which takes precedence over defaults.
+func ApplyEnv(fs *flag.FlagSet, path string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+
+		env := EnvName(path, f.Name)
+		if v, ok := os.LookupEnv(env); ok {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", v, env, e)
+			}
+		}
+	})
+
+	return err
+}
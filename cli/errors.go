@@ -0,0 +1,228 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"nih.software/cli/output"
+	"nih.software/cli/ui"
+	"nih.software/peers"
+	"nih.software/trust"
+)
+
+// Exit codes, stable for scripts.
+const (
+	ExitOK      = 0
+	ExitFailure = 1 // any other failure
+	ExitUsage   = 2 // incorrect use of a command
+	ExitTrust   = 3 // credentials are missing or invalid, or a peer failed verification
+	ExitNetwork = 4 // a peer could not be reached
+
+	ExitInterrupted = 130 // interrupted by SIGINT or SIGTERM, as in shells
+)
+
+// An Error is a command failure with an exit code and a hint for the user.
+type Error struct {
+	Code int
+	Err  error
+
+	// Hint suggests how to fix the problem. It may be empty.
+	Hint string
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// TrustError wraps err as a credential or verification failure.
+func TrustError(err error, hint string) error {
+	return &Error{Code: ExitTrust, Err: err, Hint: hint}
+}
+
+// NetworkError wraps err as a failure to reach a peer.
+func NetworkError(err error, hint string) error {
+	return &Error{Code: ExitNetwork, Err: err, Hint: hint}
+}
+
+// An exitStatus is the exit code of a plugin, which reports its own errors.
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return "exit status " + strconv.Itoa(int(s))
+}
+
+// ExitCode returns the exit code for err:
+// the code of an Error or plugin, ExitUsage for a UsageError,
+// ExitTrust for a failed TLS handshake with a peer or a peer of another
+// identity than that of the address book,
+// ExitNetwork for a failed or timed-out network operation, and ExitFailure for anything else.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var status exitStatus
+	if errors.As(err, &status) {
+		return int(status)
+	}
+
+	var cerr *Error
+	if errors.As(err, &cerr) {
+		return cerr.Code
+	}
+
+	var uerr *UsageError
+	if errors.As(err, &uerr) {
+		return ExitUsage
+	}
+
+	// Our verification of the peer failed, or the peer's of us,
+	// which arrives as a TLS alert.
+	var verr *trust.VerificationError
+	var operr *net.OpError
+	if errors.As(err, &verr) || errors.As(err, &operr) && operr.Op == "remote error" || errors.Is(err, peers.ErrIdentity) {
+		return ExitTrust
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ExitNetwork
+	}
+
+	// Not net.Error: syscall.Errno implements it, so it would match file errors too.
+	var dnserr *net.DNSError
+	if errors.As(err, &operr) || errors.As(err, &dnserr) {
+		return ExitNetwork
+	}
+
+	return ExitFailure
+}
+
+// Hint returns the hint attached to err, if any.
+func Hint(err error) string {
+	var cerr *Error
+	if errors.As(err, &cerr) && cerr.Hint != "" {
+		return cerr.Hint
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Sprintf("The operation timed out after %v. Set a longer -timeout if the peer is slow to respond.", Global.Timeout)
+	}
+
+	var uerr *UsageError
+	if errors.As(err, &uerr) {
+		args := strings.Fields(uerr.Path)[1:]
+		hint := ""
+		if errors.Is(err, errUnknownCommand) {
+			if s := suggest(args); s != "" {
+				hint = fmt.Sprintf("Did you mean %q?\n", s)
+			}
+			args = args[:len(args)-1]
+		}
+
+		topic := ""
+		if _, path := lookupPath(args); path != "" {
+			topic = strings.TrimPrefix(path, "nih")
+		}
+		return hint + fmt.Sprintf("Run \"nih help%s\" for usage.", topic)
+	}
+
+	return ""
+}
+
+// Report prints err and its hint to standard error, in the format of the
+// global -error-format flag, and returns its exit code.
+// It prints nothing for a nil error.
+func Report(err error) int {
+	var status exitStatus
+	if err == nil || errors.As(err, &status) {
+		return ExitCode(err)
+	}
+
+	if Global.ErrorFormat == output.JSON {
+		json.NewEncoder(os.Stderr).Encode(NewErrorReport(err))
+		return ExitCode(err)
+	}
+
+	ui.Error("%v", err)
+	if hint := Hint(err); hint != "" {
+		ui.Default().Hint(hint)
+	}
+
+	return ExitCode(err)
+}
+
+// An ErrorReport is a command failure as -error-format json prints it,
+// as one JSON object on one line.
+type ErrorReport struct {
+	Code    int          `json:"code"`
+	Message string       `json:"message"`
+	Hint    string       `json:"hint"`
+	Details ErrorDetails `json:"details"`
+}
+
+// ErrorDetails classify the failure of an ErrorReport.
+type ErrorDetails struct {
+	// Kind names the exit code: failure, usage, trust, network,
+	// or interrupted.
+	Kind string `json:"kind"`
+
+	// Command is the path of the command that failed, such as
+	// "nih trust show", if the arguments named one.
+	Command string `json:"command,omitempty"`
+
+	// Cause is the message of the innermost error, such as
+	// "connection refused", if it differs from the message.
+	Cause string `json:"cause,omitempty"`
+}
+
+// NewErrorReport returns the report of err.
+func NewErrorReport(err error) *ErrorReport {
+	r := &ErrorReport{
+		Code:    ExitCode(err),
+		Message: err.Error(),
+		Hint:    Hint(err),
+		Details: ErrorDetails{Command: running},
+	}
+
+	switch r.Code {
+	case ExitUsage:
+		r.Details.Kind = "usage"
+	case ExitTrust:
+		r.Details.Kind = "trust"
+	case ExitNetwork:
+		r.Details.Kind = "network"
+	case ExitInterrupted:
+		r.Details.Kind = "interrupted"
+	default:
+		r.Details.Kind = "failure"
+	}
+
+	var uerr *UsageError
+	if errors.As(err, &uerr) && uerr.Path != "" && !errors.Is(err, errUnknownCommand) {
+		r.Details.Command = uerr.Path
+	}
+
+	cause := err
+	for {
+		next := errors.Unwrap(cause)
+		if next == nil {
+			break
+		}
+		cause = next
+	}
+	if msg := cause.Error(); msg != r.Message {
+		r.Details.Cause = msg
+	}
+
+	return r
+}
@@ -0,0 +1,154 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"nih.software/daemon"
+	"nih.software/peers"
+	"nih.software/trust"
+)
+
+var execFlags struct {
+	dir string
+	env []string
+}
+
+var cmdExec = &Command{
+	Name:    "exec",
+	Args:    "NODE [--] COMMAND [ARG...]",
+	Summary: "run a command on a node",
+	Help: `
+Exec runs COMMAND with its arguments on the node NODE, the name of a peer
+of the address book or host[:port] with the port of serve -listen by
+default, and copies its standard output and error to its own as they
+arrive. It exits with the status of the command.
+The command's standard input is empty.
+
+The node runs the command as the user running serve, looked up in its PATH
+and in its working directory unless -dir is set. It only accepts peers
+whose certificate holds one of the roles of its serve -exec-roles flag,
+and fails with status 3 otherwise. Run "nih help trust" for roles.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		execFlags.dir = ""
+		execFlags.env = nil
+		fs.StringVar(&execFlags.dir, "dir", "", "Working `directory` of the command on the node")
+		fs.Func("env", "Set the environment variable `KEY=value` for the command; may be repeated", func(s string) error {
+			if !strings.Contains(s, "=") {
+				return errors.New("want KEY=value")
+			}
+			execFlags.env = append(execFlags.env, s)
+			return nil
+		})
+	},
+	Credentials: true,
+	Run:         runExec,
+}
+
+func init() {
+	Register(cmdExec)
+}
+
+func runExec(ctx context.Context, args []string) error {
+	if len(args) > 1 && args[1] == "--" {
+		args = append(args[:1:1], args[2:]...)
+	}
+
+	if len(args) < 2 {
+		return Usagef("need a node and a command")
+	}
+
+	addr, expect, err := nodeAddr(args[0])
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(&daemon.ExecRequest{Args: args[1:], Dir: execFlags.dir, Env: execFlags.env})
+	if err != nil {
+		return err
+	}
+
+	c := streamClient(Bundle(), expect)
+	defer c.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+addr+"/exec/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return TrustError(fmt.Errorf("%s: %s", addr, responseMessage(resp)),
+			"Use credentials with a role the node allows in serve -exec-roles.")
+	default:
+		return fmt.Errorf("%s: %s", addr, responseMessage(resp))
+	}
+
+	// Started: from here on, the command runs until it exits or nih is interrupted.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var f daemon.ExecFrame
+		if err := dec.Decode(&f); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("%s: %w", addr, err)
+		}
+
+		switch {
+		case f.Stdout != nil:
+			os.Stdout.Write(f.Stdout)
+		case f.Stderr != nil:
+			os.Stderr.Write(f.Stderr)
+		case f.Error != "":
+			return fmt.Errorf("%s: %s", addr, f.Error)
+		case f.Exit != nil:
+			if *f.Exit != 0 {
+				return exitStatus(*f.Exit)
+			}
+			return nil
+		}
+	}
+}
+
+// streamClient returns an HTTP client of peers for requests whose bodies,
+// in either direction, may take any time, such as a command's output or
+// a file. The -timeout flag bounds each step before the response body:
+// the dial, the handshake, and the wait for the response header.
+// If expect is not nil, the client only accepts nodes of its identity.
+func streamClient(b *trust.Bundle, expect *peers.Peer) *http.Client {
+	d := &net.Dialer{Timeout: Global.Timeout}
+	return &http.Client{Transport: &http.Transport{
+		DialContext:           d.DialContext,
+		TLSClientConfig:       nodeTLSConfig(b, expect),
+		TLSHandshakeTimeout:   Global.Timeout,
+		ResponseHeaderTimeout: Global.Timeout,
+	}}
+}
+
+// responseMessage returns the start of the body of an error response.
+func responseMessage(resp *http.Response) string {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if msg = bytes.TrimSpace(msg); len(msg) == 0 {
+		return resp.Status
+	}
+	return string(msg)
+}
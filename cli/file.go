@@ -0,0 +1,182 @@
+package cli
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Stdio is the file name meaning standard input or output,
+// so that PEM data can be piped between nih and tools like openssl.
+const Stdio = "-"
+
+var stdin struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// ReadFile reads the named file, or standard input if name is "-".
+// Standard input is read once, so several "-" arguments of a command
+// share its data, such as a certificate chain followed by its key.
+func ReadFile(name string) ([]byte, error) {
+	if name != Stdio {
+		return os.ReadFile(name)
+	}
+
+	stdin.once.Do(func() {
+		stdin.data, stdin.err = io.ReadAll(os.Stdin)
+	})
+
+	return stdin.data, stdin.err
+}
+
+// WriteFile writes data to the named file with mode 0600, or to standard output if name is "-".
+// An existing file is only overwritten if force is set.
+func WriteFile(name string, data []byte, force bool) error {
+	if name == Stdio {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !force {
+		flags |= os.O_EXCL
+	}
+
+	f, err := os.OpenFile(name, flags, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// An outputFile is data to write to the named file, or to standard output if name is "-".
+type outputFile struct {
+	name string
+	data []byte
+}
+
+// writeFiles writes files as WriteFile does, but all or none of them, so
+// that a key is never left without its certificate. Each is first written
+// to a temporary file next to it, and the files are only replaced once all
+// were written; those replaced are restored if the others cannot be.
+// Standard output is written last.
+func writeFiles(files []outputFile, force bool) error {
+	if err := checkFiles(files, force); err != nil {
+		return err
+	}
+
+	tmps := make([]string, len(files))
+	defer func() {
+		for _, tmp := range tmps {
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+		}
+	}()
+
+	for i, f := range files {
+		if f.name == Stdio {
+			continue
+		}
+
+		tmp, err := writeTemp(f.name, f.data)
+		if err != nil {
+			return err
+		}
+		tmps[i] = tmp
+	}
+
+	var replaced []outputFile // the previous contents, nil for new files
+	restore := func() {
+		for _, old := range replaced {
+			if old.data == nil {
+				os.Remove(old.name)
+			} else {
+				writeFileAtomic(old.name, old.data)
+			}
+		}
+	}
+
+	for i, f := range files {
+		if f.name == Stdio {
+			continue
+		}
+
+		old, err := os.ReadFile(f.name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			restore()
+			return err
+		}
+
+		if err := os.Rename(tmps[i], f.name); err != nil {
+			restore()
+			return err
+		}
+		tmps[i] = ""
+		replaced = append(replaced, outputFile{f.name, old})
+	}
+
+	for _, f := range files {
+		if f.name == Stdio {
+			if _, err := os.Stdout.Write(f.data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeTemp writes data with mode 0600 to a new temporary file in the
+// directory of name, returning the name of the temporary file.
+func writeTemp(name string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// checkFiles fails as writeFiles would if one of files exists and force is
+// not set, so that a command can find out before it does what cannot be
+// undone.
+func checkFiles(files []outputFile, force bool) error {
+	if force {
+		return nil
+	}
+
+	for _, f := range files {
+		if f.name == Stdio {
+			continue
+		}
+
+		if _, err := os.Lstat(f.name); err == nil {
+			return &fs.PathError{Op: "open", Path: f.name, Err: fs.ErrExist}
+		}
+	}
+
+	return nil
+}
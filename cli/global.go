@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/cli/ui"
+	"nih.software/log"
+)
+
+// Globals holds the values of the global flags.
+type Globals struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+	StateDir string
+	Output   output.Format
+	NoHeader bool
+	NoColor  bool
+	Quiet    bool
+	Verbose  bool
+	Yes      bool
+	Timeout  time.Duration
+
+	LogLevel  log.Levels
+	LogFormat log.Format
+
+	ErrorFormat output.Format
+}
+
+// Global holds the global flags of the running command.
+var Global Globals
+
+// Flags defines the global flags on fs.
+func (g *Globals) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&g.CertFile, "cert", "etc/trust/cert.pem", "Location of the initial certificate chain `file`, or - for standard input")
+	fs.StringVar(&g.KeyFile, "key", "etc/trust/key.pem", "Location of the initial private key `file`, or - for standard input")
+	fs.StringVar(&g.CAFile, "ca", "etc/trust/ca.pem", "Location of the initial CA certificates `file`, or - for standard input")
+	fs.StringVar(&g.StateDir, "state", "var", "State `directory` of the node, holding its address book")
+	fs.Var(&g.Output, "output", "Output `format` of command results: text or json")
+	fs.Var(&g.Output, "o", "`Format`, shorthand for -output")
+	fs.BoolVar(&g.NoHeader, "no-header", false, "Omit the header row of tables in text output")
+	fs.BoolVar(&g.NoColor, "no-color", false, "Disable colored output (also disabled by NO_COLOR or a non-terminal)")
+	fs.BoolVar(&g.Quiet, "quiet", false, "Print only warnings, errors, and results")
+	fs.BoolVar(&g.Verbose, "verbose", false, "Print additional diagnostic messages")
+	fs.BoolVar(&g.Yes, "yes", false, "Answer yes to every confirmation, for non-interactive use")
+	fs.DurationVar(&g.Timeout, "timeout", 30*time.Second, "Time limit for each network operation, such as a dial or a request (0 means none)")
+	fs.TextVar(&g.LogLevel, "log-level", log.Levels{Default: log.LevelWarn}, "Minimum `level` of diagnostic logs: debug, info, warn, or error,\nthen component=level pairs for the logs of components, as in warn,raft=debug")
+	fs.Var(&g.LogFormat, "log-format", "Encoding `format` of diagnostic logs: text or json")
+	fs.Var(&g.ErrorFormat, "error-format", "Encoding `format` of command failures on standard error: text or json")
+}
+
+// UI returns the user interface configured by the global flags.
+func (g *Globals) UI() *ui.UI {
+	return ui.New(os.Stdout, os.Stderr, ui.Options{
+		Color:     !g.NoColor && ui.ColorSupported(os.Stdout),
+		Quiet:     g.Quiet,
+		Verbose:   g.Verbose && !g.Quiet,
+		Progress:  ui.IsTerminal(os.Stderr),
+		AssumeYes: g.Yes,
+	})
+}
+
+// Logger returns the diagnostic logger configured by the global flags.
+// It writes to standard error.
+func (g *Globals) Logger() *slog.Logger {
+	return log.New(os.Stderr, g.LogLevel, g.LogFormat)
+}
+
+// WithTimeout returns a context for one network operation,
+// such as a dial and handshake or a request, limited by the global -timeout flag.
+// Network commands use it for every operation so that no hang is unbounded.
+func WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if Global.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, Global.Timeout)
+}
+
+// Print writes a command result to standard output in the format selected by -o.
+func Print(v any) error {
+	return output.Write(os.Stdout, Global.Output, v)
+}
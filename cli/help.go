@@ -1,25 +1,231 @@
 package cli
 
 import (
+	"context"
+	"flag"
 	"fmt"
-
-	_ "embed"
+	"io"
+	"os"
+	"strings"
 )
 
-//go:embed help.txt
-var helpTxt string
+var helpFlags struct {
+	man bool
+	dir string
+}
+
+var cmdHelp = &Command{
+	Name:    "help",
+	Args:    "[COMMAND...]",
+	Summary: "print help for nih or a command",
+	Help: `
+With -dir, help writes a page for nih and for every command into the directory,
+as plain text or, with -man, as man pages ready for packaging.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&helpFlags.man, "man", false, "Print roff man pages instead of text")
+		fs.StringVar(&helpFlags.dir, "dir", "", "Write pages for all commands into `dir`")
+	},
+	Run: func(ctx context.Context, args []string) error {
+		if helpFlags.dir != "" {
+			if len(args) != 0 {
+				return Usagef("-dir takes no arguments")
+			}
+			return writeDocs(helpFlags.dir, helpFlags.man)
+		}
+
+		if helpFlags.man {
+			return writeMan(os.Stdout, args)
+		}
+
+		return Help(args)
+	},
+}
+
+func init() {
+	Register(cmdHelp)
+}
 
-// Help prints help text for the nih tool.
-// If args[0] is the name of a known command,
+// Help prints help text for the nih tool, generated from the registered commands.
+// If args names a known command, such as "trustgen root",
 // Help prints the help text for that command instead.
-func Help(args []string) {
-	var topic string
-	if len(args) > 0 {
-		topic = args[0]
+func Help(args []string) error {
+	if len(args) == 0 {
+		printHelp(os.Stdout)
+		return nil
+	}
+
+	c, path := lookupPath(args)
+	if c == nil {
+		if t := lookupTopicPath(args); t != nil {
+			t.printHelp(os.Stdout)
+			return nil
+		}
+		return &UsageError{Path: "nih help", Err: fmt.Errorf("unknown help topic %q", strings.Join(args, " "))}
+	}
+
+	c.printHelp(os.Stdout, path)
+	return nil
+}
+
+func writeMan(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		writeManRoot(w)
+		return nil
+	}
+
+	c, path := lookupPath(args)
+	if c == nil {
+		if t := lookupTopicPath(args); t != nil {
+			t.writeMan(w)
+			return nil
+		}
+		return &UsageError{Path: "nih help", Err: fmt.Errorf("unknown help topic %q", strings.Join(args, " "))}
+	}
+
+	c.writeMan(w, path)
+	return nil
+}
+
+// lookupPath returns the command named by a path such as ["trustgen", "root"]
+// and its full path with aliases resolved, such as "nih trustgen root".
+// It returns nil if there is no such command.
+func lookupPath(args []string) (*Command, string) {
+	if len(args) == 0 {
+		return nil, ""
+	}
+
+	c := Lookup(args[0])
+	if c == nil {
+		return nil, ""
+	}
+
+	path := "nih " + c.Name
+	for _, name := range args[1:] {
+		if c = c.Lookup(name); c == nil {
+			return nil, ""
+		}
+		path += " " + c.Name
+	}
+
+	return c, path
+}
+
+// lookupTopicPath returns the help topic named by args, such as ["trust"],
+// or nil if there is none.
+func lookupTopicPath(args []string) *Topic {
+	if len(args) != 1 {
+		return nil
+	}
+
+	return LookupTopic(args[0])
+}
+
+func printHelp(w io.Writer) {
+	fmt.Fprintf(w, "NIH is a single-binary cloud.\n\n")
+	fmt.Fprintf(w, "# Usage\n\n")
+	fmt.Fprintf(w, "    nih [global flags] COMMAND [local flags] [arguments]\n\n")
+	fmt.Fprintf(w, "# Commands\n\n")
+	printCommands(w, Commands())
+	fmt.Fprintf(w, "\nRun \"nih help COMMAND\" for more information about that command.\n\n")
+	fmt.Fprintf(w, "# Global flags\n\n")
+
+	fs := flag.NewFlagSet("nih", flag.ContinueOnError)
+	new(Globals).Flags(fs)
+	printFlags(w, fs, "nih")
+
+	fmt.Fprintf(w, "\n# Help topics\n\n")
+	printTopics(w, Topics())
+	fmt.Fprintf(w, "\nRun \"nih help TOPIC\" for more information about that topic.\n")
+}
+
+func (c *Command) printHelp(w io.Writer, path string) {
+	fmt.Fprintf(w, "Usage:\n\n    %s", path)
+	if len(c.Commands) > 0 && c.Run == nil {
+		fmt.Fprint(w, " COMMAND")
+	}
+	if c.Flags != nil {
+		fmt.Fprint(w, " [flags]")
+	}
+	if c.Args != "" {
+		fmt.Fprint(w, " ", c.Args)
+	}
+	fmt.Fprintf(w, "\n\n%s.\n", capitalize(c.Summary))
+
+	if len(c.Aliases) > 0 {
+		fmt.Fprintf(w, "\nAliases: %s\n", strings.Join(c.Aliases, ", "))
+	}
+
+	if c.Help != "" {
+		fmt.Fprintf(w, "\n%s\n", strings.TrimSpace(c.Help))
+	}
+
+	if len(c.Commands) > 0 {
+		fmt.Fprintf(w, "\n# Commands\n\n")
+		printCommands(w, c.Commands)
+		fmt.Fprintf(w, "\nRun \"nih help %s COMMAND\" for more information about that command.\n", strings.TrimPrefix(path, "nih "))
+	}
+
+	if c.Flags != nil {
+		fmt.Fprintf(w, "\n# Flags\n\n")
+		printFlags(w, c.FlagSet(path), path)
+	}
+}
+
+func (t *Topic) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "%s\n", strings.TrimSpace(t.Text))
+}
+
+func printTopics(w io.Writer, ts []*Topic) {
+	width := 0
+	for _, t := range ts {
+		width = max(width, len(t.Name))
+	}
+
+	for _, t := range ts {
+		fmt.Fprintf(w, "    %-*s    %s\n", width, t.Name, t.Summary)
+	}
+}
+
+func printCommands(w io.Writer, cs []*Command) {
+	width := 0
+	for _, c := range cs {
+		width = max(width, len(c.Name))
 	}
 
-	switch topic {
-	default:
-		fmt.Println(helpTxt)
+	for _, c := range cs {
+		fmt.Fprintf(w, "    %-*s    %s\n", width, c.Name, c.Summary)
+	}
+}
+
+// printFlags prints flag documentation in the style of the rest of the help text.
+// The flags belong to the command at path.
+func printFlags(w io.Writer, fs *flag.FlagSet, path string) {
+	first := true
+	fs.VisitAll(func(f *flag.Flag) {
+		if !first {
+			fmt.Fprintln(w)
+		}
+		first = false
+
+		name, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, "    -%s", f.Name)
+		if name != "" {
+			fmt.Fprintf(w, " %s", strings.ToUpper(name))
+		}
+		fmt.Fprintf(w, "\n        %s\n", strings.ReplaceAll(usage, "\n", "\n        "))
+
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "0s" {
+			fmt.Fprintf(w, "        (default: %s)\n", f.DefValue)
+		}
+
+		fmt.Fprintf(w, "        (env: %s)\n", EnvName(path, f.Name))
+	})
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
 	}
+	return strings.ToUpper(s[:1]) + s[1:]
 }
@@ -0,0 +1,377 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/daemon"
+	"nih.software/jobs"
+)
+
+var jobsFlags struct {
+	control string
+}
+
+// jobFlags are the flags of the spec of a job.
+var jobFlags struct {
+	nodes      []string
+	all        bool
+	task       string
+	dir        string
+	env        []string
+	parallel   int
+	retries    int
+	retryDelay time.Duration
+	timeout    time.Duration
+}
+
+var jobsRunFlags struct {
+	detach bool
+}
+
+var cmdJobs = &Command{
+	Name:    "jobs",
+	Summary: "run jobs across the nodes of the cluster",
+	Help: `
+Jobs runs jobs across the nodes of the cluster through the daemon started
+by "nih serve", over the control socket of -control. A job runs a command,
+or a task the daemons run by name, on one node, some, or all of those the
+daemon knows, and is tried again on the nodes it fails on.
+
+The daemon a job is submitted to runs it on the other nodes as nih exec
+does, so it needs a role of their serve -job-roles flag, and keeps the
+state of the job and the end of the output of every node in memory only:
+"nih jobs list" shows the jobs it ran since it started.
+`,
+	Commands: []*Command{cmdJobsRun, cmdJobsList, cmdJobsShow, cmdJobsCancel, cmdJobsTasks},
+}
+
+func init() {
+	Register(cmdJobs)
+}
+
+func jobsControlFlag(fs *flag.FlagSet) {
+	fs.StringVar(&jobsFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+}
+
+var cmdJobsRun = &Command{
+	Name:    "run",
+	Args:    "[--] COMMAND [ARG...]",
+	Summary: "run a command or task on nodes",
+	Help: `
+Run submits a job running COMMAND with its arguments on the nodes of
+-node, or on every node with -all, waits for it to be done, and prints
+the output of every node. It exits with status 1 unless the command
+succeeded on every node. With -task, the job runs the task of that name,
+as listed by "nih jobs tasks", with the arguments as its own. With
+-detach, run prints the ID of the job and returns at once; "nih jobs show"
+shows the job later. Interrupting run does not cancel the job; "nih jobs
+cancel" does.
+
+A node runs the command as the user running serve, looked up in its PATH
+and in its working directory unless -dir is set. The job runs on at most
+-parallel nodes at a time, all of them by default, and on each node is
+tried again -retries times once it fails, after -retry-delay doubled for
+every retry. -attempt-timeout bounds every attempt.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		jobsControlFlag(fs)
+		jobSpecFlags(fs)
+		fs.BoolVar(&jobsRunFlags.detach, "detach", false, "Print the ID of the job and return without waiting")
+	},
+	Run: runJobsRun,
+}
+
+// jobSpecFlags defines the flags of the spec of a job on fs.
+func jobSpecFlags(fs *flag.FlagSet) {
+	jobFlags.nodes = nil
+	jobFlags.env = nil
+	fs.Func("node", "Run on the node `name`; may be repeated", func(s string) error {
+		jobFlags.nodes = append(jobFlags.nodes, s)
+		return nil
+	})
+	fs.BoolVar(&jobFlags.all, "all", false, "Run on every node the daemon knows, its own included")
+	fs.StringVar(&jobFlags.task, "task", "", "Run the task `name` instead of a command")
+	fs.StringVar(&jobFlags.dir, "dir", "", "Working `directory` of the command on the nodes")
+	fs.Func("env", "Set the environment variable `KEY=value` for the command; may be repeated", func(s string) error {
+		if !strings.Contains(s, "=") {
+			return errors.New("want KEY=value")
+		}
+		jobFlags.env = append(jobFlags.env, s)
+		return nil
+	})
+	fs.IntVar(&jobFlags.parallel, "parallel", 0, "Run on at most `n` nodes at a time, or all if 0")
+	fs.IntVar(&jobFlags.retries, "retries", 0, "Try again `n` times on a node the job fails on")
+	fs.DurationVar(&jobFlags.retryDelay, "retry-delay", jobs.DefaultRetryDelay, "Time before the first retry on a node")
+	fs.DurationVar(&jobFlags.timeout, "attempt-timeout", jobs.DefaultTimeout, "Time limit of every attempt on a node")
+}
+
+// jobSpec returns the spec of the job of the flags of jobSpecFlags, which
+// runs args.
+func jobSpec(args []string) (jobs.Spec, error) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	spec := jobs.Spec{
+		Task:       jobFlags.task,
+		Args:       args,
+		Dir:        jobFlags.dir,
+		Env:        jobFlags.env,
+		Nodes:      jobFlags.nodes,
+		All:        jobFlags.all,
+		Parallel:   jobFlags.parallel,
+		Retries:    jobFlags.retries,
+		RetryDelay: jobFlags.retryDelay,
+		Timeout:    jobFlags.timeout,
+	}
+	if err := spec.Check(); err != nil {
+		return jobs.Spec{}, Usagef("%s", strings.TrimPrefix(err.Error(), "jobs: "))
+	}
+	return spec, nil
+}
+
+var cmdJobsList = &Command{
+	Name:    "list",
+	Summary: "list the jobs of the daemon",
+	Help: `
+List prints the jobs submitted to the daemon, newest first, with their
+state, what they run, and the nodes of their runs by state.
+`,
+	Flags: jobsControlFlag,
+	Run:   runJobsList,
+}
+
+var cmdJobsShow = &Command{
+	Name:    "show",
+	Args:    "ID",
+	Summary: "print the state and output of a job",
+	Help: `
+Show prints the job of ID: its state, the state of its run on every node,
+and the end of the output of every node. With -wait, show waits for the
+job to be done first, and exits as run does.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		jobsControlFlag(fs)
+		fs.BoolVar(&jobsShowFlags.wait, "wait", false, "Wait for the job to be done")
+	},
+	Run: runJobsShow,
+}
+
+var jobsShowFlags struct {
+	wait bool
+}
+
+var cmdJobsCancel = &Command{
+	Name:    "cancel",
+	Args:    "ID",
+	Summary: "cancel a job",
+	Help: `
+Cancel cancels the job of ID: the commands running on its nodes are
+killed, and the job is not started on the nodes it was not yet.
+`,
+	Flags: jobsControlFlag,
+	Run:   runJobsCancel,
+}
+
+var cmdJobsTasks = &Command{
+	Name:    "tasks",
+	Summary: "list the tasks jobs may run",
+	Help: `
+Tasks lists the tasks the daemon runs by name for "nih jobs run -task",
+which every node of the same version of nih runs likewise.
+`,
+	Flags: jobsControlFlag,
+	Run:   runJobsTasks,
+}
+
+func runJobsRun(ctx context.Context, args []string) error {
+	spec, err := jobSpec(args)
+	if err != nil {
+		return err
+	}
+
+	var j jobs.Job
+	if err := controlDo(ctx, jobsFlags.control, "POST", "/jobs/", &spec, &j); err != nil {
+		return err
+	}
+	if jobsRunFlags.detach {
+		return Print(&jobID{ID: j.ID})
+	}
+	return jobsWait(ctx, jobsFlags.control, j.ID)
+}
+
+// jobsWait waits for the job of id of the daemon of control to be done,
+// prints it, and fails unless it succeeded.
+func jobsWait(ctx context.Context, control, id string) error {
+	resp, err := controlRequest(ctx, control, "GET", "/jobs/"+url.PathEscape(id)+"?wait=true", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var j jobs.Job
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		return err
+	}
+	if err := Print(&jobText{j}); err != nil {
+		return err
+	}
+	if j.State != jobs.Succeeded {
+		return exitStatus(ExitFailure)
+	}
+	return nil
+}
+
+type jobID struct {
+	ID string `json:"id"`
+}
+
+// WriteText implements output.Texter.
+func (j *jobID) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintln(w, j.ID)
+	return err
+}
+
+// jobText is a job printed with the output of its runs.
+type jobText struct {
+	jobs.Job
+}
+
+// WriteText implements output.Texter.
+func (j *jobText) WriteText(w io.Writer) error {
+	field := func(name, value string) {
+		fmt.Fprintf(w, "%-9s %s\n", name+":", value)
+	}
+
+	field("id", j.ID)
+	field("state", string(j.State))
+	field("run", jobCommand(&j.Spec))
+	if j.From != "" {
+		field("from", j.From)
+	}
+	field("created", j.Created.Format(time.RFC3339))
+	if !j.Finished.IsZero() {
+		field("took", j.Finished.Sub(j.Created).Round(time.Millisecond).String())
+	}
+
+	fmt.Fprintln(w)
+	t := output.NewTable("NODE", "STATE", "ATTEMPTS", "EXIT", "ERROR")
+	for _, r := range j.Runs {
+		exit := "-"
+		if r.Exit != nil {
+			exit = strconv.Itoa(*r.Exit)
+		}
+		t.Append(r.Node, string(r.State), strconv.Itoa(r.Attempts), exit, r.Error)
+	}
+	if err := t.WriteText(w); err != nil {
+		return err
+	}
+
+	for _, r := range j.Runs {
+		for _, out := range []struct {
+			name string
+			data []byte
+		}{{"stdout", r.Stdout}, {"stderr", r.Stderr}} {
+			if len(out.data) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "\n== %s %s\n", r.Node, out.name)
+			w.Write(out.data)
+			if out.data[len(out.data)-1] != '\n' {
+				fmt.Fprintln(w)
+			}
+		}
+	}
+	return nil
+}
+
+// jobCommand returns what the job of spec runs, as a command line.
+func jobCommand(spec *jobs.Spec) string {
+	cmd := strings.Join(spec.Args, " ")
+	if spec.Task != "" {
+		cmd = strings.TrimSpace("task " + spec.Task + " " + cmd)
+	}
+	return cmd
+}
+
+func runJobsList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("list takes no arguments")
+	}
+
+	var list []jobs.Job
+	if err := controlGet(ctx, jobsFlags.control, "/jobs/", &list); err != nil {
+		return err
+	}
+
+	if Global.Output == output.JSON {
+		return Print(list)
+	}
+	t := output.NewTable("ID", "STATE", "CREATED", "RUN", "NODES")
+	for _, j := range list {
+		counts := make(map[jobs.State]int)
+		var states []string
+		for _, r := range j.Runs {
+			if counts[r.State]++; counts[r.State] == 1 {
+				states = append(states, string(r.State))
+			}
+		}
+		for i, s := range states {
+			states[i] = fmt.Sprintf("%d %s", counts[jobs.State(s)], s)
+		}
+		t.Append(j.ID, string(j.State), j.Created.Format(time.RFC3339), jobCommand(&j.Spec), strings.Join(states, ", "))
+	}
+	return Print(t)
+}
+
+func runJobsShow(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one ID")
+	}
+	if jobsShowFlags.wait {
+		return jobsWait(ctx, jobsFlags.control, args[0])
+	}
+
+	var j jobs.Job
+	if err := controlGet(ctx, jobsFlags.control, "/jobs/"+url.PathEscape(args[0]), &j); err != nil {
+		return err
+	}
+	return Print(&jobText{j})
+}
+
+func runJobsCancel(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one ID")
+	}
+	var ok struct{}
+	return controlDo(ctx, jobsFlags.control, "POST", "/jobs/"+url.PathEscape(args[0])+"/cancel", nil, &ok)
+}
+
+func runJobsTasks(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("tasks takes no arguments")
+	}
+
+	var tasks []daemon.TaskInfo
+	if err := controlGet(ctx, jobsFlags.control, "/jobs/tasks", &tasks); err != nil {
+		return err
+	}
+
+	if Global.Output == output.JSON {
+		return Print(tasks)
+	}
+	t := output.NewTable("TASK", "SUMMARY")
+	for _, task := range tasks {
+		t.Append(task.Name, task.Summary)
+	}
+	return Print(t)
+}
@@ -0,0 +1,173 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"nih.software/cli/ui"
+	"nih.software/trust"
+	"nih.software/trust/join"
+	"nih.software/trust/trustgen"
+)
+
+var joinFlags struct {
+	token string
+	g     generator
+}
+
+var cmdJoin = &Command{
+	Name:    "join",
+	Args:    "ADDR",
+	Summary: "enroll this node in a cluster",
+	Help: `
+Join enrolls this instance as a node of the cluster whose CA node listens
+on ADDR, host[:port] with the port of serve -listen by default. It generates
+a key and a certificate request, redeems the one-time join token of -token
+at the CA node for a certificate, and installs the certificate chain, key,
+and CA certificates as the files of the global -cert, -key, and -ca flags.
+Finally, it checks that the new credentials work by pinging ADDR with them.
+
+The join token ends with a hash of the cluster's root certificate, which
+join uses to authenticate the CA node before sending it the token. Pass the
+token in the environment as NIH_JOIN_TOKEN to keep it out of the process list.
+
+Existing credential files are only replaced with -force.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		joinFlags.token = ""
+		joinFlags.g = generator{}
+		fs.StringVar(&joinFlags.token, "token", "", "Join `token` issued by the CA node")
+		fs.StringVar(&joinFlags.g.cn, "cn", "", "Subject common `name`\n(default: the host name)")
+		fs.StringVar(&joinFlags.g.dns, "dns", "", "Comma-separated subject alternative DNS `names`")
+		fs.StringVar(&joinFlags.g.ip, "ip", "", "Comma-separated subject alternative IP `addresses`")
+		fs.StringVar(&joinFlags.g.keyType, "key-type", "", "Key `type`: ed25519, ecdsa-p256, ecdsa-p384, rsa-2048, or rsa-4096\n(default: ed25519)")
+		fs.BoolVar(&joinFlags.g.force, "force", false, "Replace existing credential files")
+	},
+	Run: runJoin,
+}
+
+func init() {
+	Register(cmdJoin)
+}
+
+func runJoin(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need exactly one address")
+	}
+
+	if joinFlags.token == "" {
+		return Usagef("-token is required")
+	}
+
+	if Global.CertFile == Stdio || Global.KeyFile == Stdio || Global.CAFile == Stdio {
+		return Usagef("-cert, -key, and -ca must name files to install")
+	}
+
+	files := []string{Global.CertFile, Global.KeyFile, Global.CAFile}
+
+	// Check before redeeming the token, which can only be used once.
+	if !joinFlags.g.force {
+		for _, name := range files {
+			if _, err := os.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+				return &Error{Code: ExitFailure, Err: fmt.Errorf("%s already exists", name),
+					Hint: "This instance already has credentials. Use -force to replace them."}
+			}
+		}
+	}
+
+	if joinFlags.g.cn == "" {
+		joinFlags.g.cn, _ = os.Hostname()
+	}
+
+	opts, err := joinFlags.g.options()
+	if err != nil {
+		return err
+	}
+
+	sp := ui.NewSpinner("generating key")
+	csr, key, err := trustgen.NewCSR(opts...)
+	sp.Stop()
+	if err != nil {
+		return err
+	}
+
+	addr := withDefaultPort(args[0])
+
+	jctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	sp = ui.NewSpinner("joining " + addr)
+	res, err := join.Join(jctx, addr, joinFlags.token, csr)
+	sp.Stop()
+
+	var verr *trust.VerificationError
+	switch {
+	case errors.Is(err, join.ErrTokenRejected):
+		return TrustError(err, "Join tokens can only be used once and expire. Create a new one on the CA node.")
+	case errors.As(err, &verr):
+		return TrustError(err, "Check that the token is complete and that "+addr+" is a node of its cluster.")
+	case err != nil:
+		return err
+	}
+
+	b, err := trust.NewBundle(res.Chain, key, res.Roots)
+	if err != nil {
+		return TrustError(fmt.Errorf("issued credentials do not verify: %w", err), "")
+	}
+
+	for i, data := range [][]byte{
+		trustgen.PEMEncodeCertificates(res.Chain...),
+		trustgen.PEMEncodePrivateKey(key),
+		trustgen.PEMEncodeCertificates(res.Roots...),
+	} {
+		if err := os.MkdirAll(filepath.Dir(files[i]), 0700); err != nil {
+			return err
+		}
+		if err := WriteFile(files[i], data, joinFlags.g.force); err != nil {
+			return err
+		}
+	}
+
+	r := &joinResult{
+		Addr:     addr,
+		Subject:  res.Chain[0].Subject.String(),
+		Serial:   res.Chain[0].SerialNumber.String(),
+		NotAfter: res.Chain[0].NotAfter,
+		Files:    files,
+	}
+
+	p, _, err := probe(ctx, addr, b, nil)
+	if err != nil {
+		return NetworkError(fmt.Errorf("joined, but the new credentials failed: %w", err),
+			"The credentials are installed. Retry with \"nih ping "+args[0]+"\".")
+	}
+	r.Ping = p
+
+	return Print(r)
+}
+
+type joinResult struct {
+	Addr     string     `json:"addr"`
+	Subject  string     `json:"subject"`
+	Serial   string     `json:"serial"`
+	NotAfter time.Time  `json:"not_after"`
+	Files    []string   `json:"files"`
+	Ping     *pingProbe `json:"ping"`
+}
+
+// WriteText implements output.Texter.
+func (r *joinResult) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "joined %s as %s, serial %s, expires %s\n", r.Addr, orEmpty(r.Subject), r.Serial, r.NotAfter.Format(time.RFC3339))
+	for _, name := range r.Files {
+		fmt.Fprintf(w, "  wrote %s\n", name)
+	}
+	fmt.Fprintf(w, "  ping: handshake %v, rtt %v\n", r.Ping.Handshake.Round(time.Microsecond), r.Ping.RTT.Round(time.Microsecond))
+	return nil
+}
@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"nih.software/cli/ui"
+	"nih.software/trust/trustgen"
+)
+
+var keygenFlags struct {
+	keyType        string
+	out            string
+	pub            string
+	encrypt        bool
+	passphraseFile string
+	force          bool
+}
+
+var cmdKeygen = &Command{
+	Name:    "keygen",
+	Summary: "generate a private key",
+	Help: `
+Keygen generates a private key and writes it to -out as a PEM PRIVATE KEY
+block in PKCS #8 form, readable by the owner only. With -pub, it also
+writes the public key, as a PEM PUBLIC KEY block, for a CA that issues
+certificates for bare public keys.
+
+With -encrypt, the key is written as an ENCRYPTED PRIVATE KEY block
+instead, under a passphrase that keygen asks for, or reads from the first
+line of -passphrase-file. The key is encrypted with AES-256-CBC under a key
+derived from the passphrase with PBKDF2, which OpenSSL and most TLS
+libraries can read. nih itself only loads unencrypted credentials.
+
+Unless the key is written to standard output, keygen prints its type and
+the SHA-256 fingerprint of its public key.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		keygenFlags.pub = ""
+		keygenFlags.passphraseFile = ""
+		keygenFlags.encrypt = false
+		keygenFlags.force = false
+		fs.StringVar(&keygenFlags.keyType, "key-type", "ed25519", "Key `type`: ed25519, ecdsa-p256, ecdsa-p384, rsa-2048, or rsa-4096")
+		fs.StringVar(&keygenFlags.out, "out", "key.pem", "Output private key `file`, or - for standard output")
+		fs.StringVar(&keygenFlags.pub, "pub", "", "Also write the public key to `file`, or - for standard output")
+		fs.BoolVar(&keygenFlags.encrypt, "encrypt", false, "Encrypt the private key with a passphrase")
+		fs.StringVar(&keygenFlags.passphraseFile, "passphrase-file", "", "Read the passphrase of -encrypt from `file` instead of asking")
+		fs.BoolVar(&keygenFlags.force, "force", false, "Overwrite existing output files")
+	},
+	Run: runKeygen,
+}
+
+func init() {
+	Register(cmdKeygen)
+}
+
+func runKeygen(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	if keygenFlags.out == Stdio && keygenFlags.pub == Stdio {
+		return Usagef("-out and -pub cannot both be standard output")
+	}
+
+	if keygenFlags.passphraseFile != "" && !keygenFlags.encrypt {
+		return Usagef("-passphrase-file requires -encrypt")
+	}
+
+	t, err := trustgen.ParseKeyType(keygenFlags.keyType)
+	if err != nil {
+		return Usagef("%v", err)
+	}
+
+	var passphrase []byte
+	if keygenFlags.encrypt {
+		if passphrase, err = readPassphrase(); err != nil {
+			return err
+		}
+	}
+
+	sp := ui.NewSpinner("generating " + t.String() + " key")
+	key, err := trustgen.GenerateKey(t)
+	sp.Stop()
+	if err != nil {
+		return err
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+
+	keyPEM := trustgen.PEMEncodePrivateKey(key)
+	if passphrase != nil {
+		keyPEM = trustgen.PEMEncodePrivateKeyEncrypted(key, passphrase)
+	}
+
+	if err := WriteFile(keygenFlags.out, keyPEM, keygenFlags.force); err != nil {
+		return err
+	}
+
+	if keygenFlags.pub != "" {
+		pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+		if err := WriteFile(keygenFlags.pub, pubPEM, keygenFlags.force); err != nil {
+			return err
+		}
+	}
+
+	if keygenFlags.out == Stdio || keygenFlags.pub == Stdio {
+		return nil
+	}
+
+	sum := sha256.Sum256(pubDER)
+	return Print(&keygenResult{
+		File:      keygenFlags.out,
+		PublicKey: keygenFlags.pub,
+		KeyType:   t.String(),
+		Encrypted: passphrase != nil,
+		SHA256:    hexColons(sum[:]),
+	})
+}
+
+// readPassphrase returns the passphrase of -passphrase-file, or asks for a new one.
+func readPassphrase() ([]byte, error) {
+	if keygenFlags.passphraseFile == "" {
+		p, err := Global.UI().NewSecret("Passphrase")
+		if err == nil && len(p) == 0 {
+			err = errors.New("empty passphrase")
+		}
+		return p, err
+	}
+
+	data, err := ReadFile(keygenFlags.passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) == 0 {
+		return nil, fmt.Errorf("%s: empty passphrase", keygenFlags.passphraseFile)
+	}
+	return line, nil
+}
+
+type keygenResult struct {
+	File      string `json:"file"`
+	PublicKey string `json:"public_key,omitempty"`
+	KeyType   string `json:"key_type"`
+	Encrypted bool   `json:"encrypted"`
+	SHA256    string `json:"sha256"`
+}
+
+// WriteText implements output.Texter.
+func (r *keygenResult) WriteText(w io.Writer) error {
+	encrypted := ""
+	if r.Encrypted {
+		encrypted = "encrypted "
+	}
+
+	fmt.Fprintf(w, "wrote %s%s key to %s\n", encrypted, r.KeyType, r.File)
+	if r.PublicKey != "" {
+		fmt.Fprintf(w, "wrote public key to %s\n", r.PublicKey)
+	}
+	_, err := fmt.Fprintf(w, "  sha256: %s\n", r.SHA256)
+	return err
+}
@@ -0,0 +1,324 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/daemon"
+	"nih.software/kv"
+	"nih.software/raft"
+)
+
+var kvFlags struct {
+	control string
+	version int64
+}
+
+var cmdKV = &Command{
+	Name:    "kv",
+	Summary: "read and change the replicated key-value store of the cluster",
+	Help: `
+KV reads and changes the key-value store of the cluster through the daemon
+started by "nih serve" with -kv, over the control socket of -control. The
+store holds the metadata of the cluster, such as its peers, revocations,
+and versions of configuration, under keys of segments separated by
+slashes, such as peers/node1.
+
+The nodes keeping the store elect a leader, which makes every change once
+a majority of them has it; the others forward the changes made through
+them to it. Reads are answered by the node read from, which may lag behind
+the leader for a moment, but has a change made through it once "nih kv
+put" or "nih kv delete" returns. While the nodes elect a leader, changes
+fail, and may be tried again.
+
+Every change has a version, greater than that of the change before it.
+With -version, put and delete change a key only if it still has the
+version given, 0 for a key absent, and fail otherwise, so that a script
+reading a key and writing it back loses no change made in the meantime.
+`,
+	Commands: []*Command{cmdKVGet, cmdKVPut, cmdKVDelete, cmdKVList, cmdKVStatus, cmdKVElections, cmdKVRemove},
+}
+
+func init() {
+	Register(cmdKV)
+}
+
+func kvControlFlag(fs *flag.FlagSet) {
+	fs.StringVar(&kvFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+}
+
+func kvChangeFlags(fs *flag.FlagSet) {
+	kvControlFlag(fs)
+	fs.Int64Var(&kvFlags.version, "version", -1, "Change the key only if it has `version`, 0 for absent")
+}
+
+var cmdKVGet = &Command{
+	Name:    "get",
+	Args:    "KEY",
+	Summary: "print the value of a key",
+	Help: `
+Get prints the value of KEY as it is; with -o json, the key, its value in
+base64, and its version.
+`,
+	Flags: kvControlFlag,
+	Run:   runKVGet,
+}
+
+var cmdKVPut = &Command{
+	Name:    "put",
+	Args:    "KEY [VALUE]",
+	Summary: "set the value of a key",
+	Help: `
+Put sets KEY to VALUE, or to standard input without it, and prints the
+version of the change.
+`,
+	Flags: kvChangeFlags,
+	Run:   runKVPut,
+}
+
+var cmdKVDelete = &Command{
+	Name:    "delete",
+	Args:    "KEY",
+	Summary: "delete a key",
+	Help: `
+Delete deletes KEY, if the store has it, and prints the version of the
+change.
+`,
+	Flags: kvChangeFlags,
+	Run:   runKVDelete,
+}
+
+var cmdKVList = &Command{
+	Name:    "list",
+	Args:    "[PREFIX]",
+	Summary: "list the keys of the store",
+	Help: `
+List prints the keys starting with PREFIX, or every key, in order, with
+their version and the size of their value.
+`,
+	Flags: kvControlFlag,
+	Run:   runKVList,
+}
+
+var cmdKVStatus = &Command{
+	Name:    "status",
+	Summary: "print the state of the replica of the node",
+	Help: `
+Status prints the state of the replica of the node in the consensus of the
+store: whether it leads or follows, the leader it knows of, its term, the
+indexes of its log, and the nodes of the cluster.
+`,
+	Flags: kvControlFlag,
+	Run:   runKVStatus,
+}
+
+var cmdKVElections = &Command{
+	Name:    "elections",
+	Summary: "list the leaders of the duties of the cluster",
+	Help: `
+Elections lists the elections the nodes hold in the store, so that one of
+them at a time runs a duty such as publishing revocation lists, with the
+node leading each, the TTL of its lease, and the version of the lease.
+The leader renews its lease a few times a TTL; another node takes over
+once the lease goes unrenewed for a little more than the TTL.
+`,
+	Flags: kvControlFlag,
+	Run:   runKVElections,
+}
+
+var cmdKVRemove = &Command{
+	Name:    "remove",
+	Args:    "NAME",
+	Summary: "remove a node from the cluster of the store",
+	Help: `
+Remove removes the node NAME from the nodes keeping the store, through the
+leader, such as a node that failed for good, so that a majority of the
+others suffices again. A node removed must start with an empty -state
+directory to join again.
+`,
+	Flags: kvControlFlag,
+	Run:   runKVRemove,
+}
+
+func runKVGet(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one KEY")
+	}
+	if !kv.ValidKey(args[0]) {
+		return Usagef("invalid key %q", args[0])
+	}
+
+	var e kv.Entry
+	path := (&url.URL{Path: "/kv/keys/" + args[0]}).EscapedPath()
+	if err := controlGet(ctx, kvFlags.control, path, &e); err != nil {
+		return err
+	}
+	return Print(&kvValue{e})
+}
+
+// kvValue is an entry printed as its value.
+type kvValue struct {
+	kv.Entry
+}
+
+// WriteText implements output.Texter.
+func (v *kvValue) WriteText(w io.Writer) error {
+	_, err := w.Write(v.Value)
+	return err
+}
+
+func runKVPut(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return Usagef("need KEY and at most one VALUE")
+	}
+
+	c := kv.Change{Op: kv.Put, Key: args[0]}
+	if len(args) == 2 {
+		c.Value = []byte(args[1])
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		c.Value = data
+	}
+	return kvApply(ctx, c)
+}
+
+func runKVDelete(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one KEY")
+	}
+	return kvApply(ctx, kv.Change{Op: kv.Delete, Key: args[0]})
+}
+
+// kvApply makes the change c, conditioned on -version, and prints the
+// entry it made.
+func kvApply(ctx context.Context, c kv.Change) error {
+	if kvFlags.version >= 0 {
+		v := uint64(kvFlags.version)
+		c.IfVersion = &v
+	}
+	if err := c.Check(); err != nil {
+		return Usagef("%v", err)
+	}
+
+	var e kv.Entry
+	if err := controlDo(ctx, kvFlags.control, "POST", "/kv/apply", &c, &e); err != nil {
+		return err
+	}
+	return Print(&kvVersion{Key: e.Key, Version: e.Version})
+}
+
+type kvVersion struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+}
+
+// WriteText implements output.Texter.
+func (v *kvVersion) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintln(w, v.Version)
+	return err
+}
+
+func runKVList(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return Usagef("need at most one PREFIX")
+	}
+
+	var entries []kv.Entry
+	path := "/kv/keys"
+	if len(args) == 1 {
+		path += "?" + url.Values{"prefix": {args[0]}}.Encode()
+	}
+	if err := controlGet(ctx, kvFlags.control, path, &entries); err != nil {
+		return err
+	}
+
+	if Global.Output == output.JSON {
+		return Print(entries)
+	}
+	t := output.NewTable("KEY", "VERSION", "SIZE")
+	for _, e := range entries {
+		t.Append(e.Key, strconv.FormatUint(e.Version, 10), strconv.Itoa(len(e.Value)))
+	}
+	return Print(t)
+}
+
+func runKVStatus(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("status takes no arguments")
+	}
+
+	var st kvStatus
+	if err := controlGet(ctx, kvFlags.control, "/kv/status", &st.Status); err != nil {
+		return err
+	}
+	return Print(&st)
+}
+
+type kvStatus struct {
+	raft.Status
+}
+
+// WriteText implements output.Texter.
+func (s *kvStatus) WriteText(w io.Writer) error {
+	field := func(name, value string) {
+		fmt.Fprintf(w, "%-10s %s\n", name+":", value)
+	}
+
+	field("name", s.ID)
+	field("state", string(s.State))
+	leader := s.Leader
+	if leader == "" {
+		leader = "none"
+	}
+	field("leader", leader)
+	field("term", strconv.FormatUint(s.Term, 10))
+	field("index", fmt.Sprintf("%d (committed %d, applied %d, snapshot %d)", s.LastIndex, s.Commit, s.Applied, s.SnapshotIndex))
+	var names []string
+	for _, srv := range s.Servers {
+		names = append(names, srv.ID)
+	}
+	if len(names) == 0 {
+		names = []string{"none"}
+	}
+	field("nodes", strings.Join(names, ", "))
+	return nil
+}
+
+func runKVElections(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("elections takes no arguments")
+	}
+
+	var leases []kv.Lease
+	if err := controlGet(ctx, kvFlags.control, "/kv/elections", &leases); err != nil {
+		return err
+	}
+
+	if Global.Output == output.JSON {
+		return Print(leases)
+	}
+	t := output.NewTable("ELECTION", "LEADER", "TTL", "VERSION")
+	for _, l := range leases {
+		t.Append(l.Election, l.Holder, l.TTL.Round(time.Millisecond).String(), strconv.FormatUint(l.Version, 10))
+	}
+	return Print(t)
+}
+
+func runKVRemove(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one NAME")
+	}
+	var ok struct{}
+	return controlDo(ctx, kvFlags.control, "POST", "/kv/remove", &daemon.KVRemoveRequest{Name: args[0]}, &ok)
+}
@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/daemon"
+	"nih.software/log"
+)
+
+var logsFlags struct {
+	control string
+	follow  bool
+	since   string
+	level   string
+}
+
+var cmdLogs = &Command{
+	Name:    "logs",
+	Summary: "print the logs of the running daemon",
+	Help: `
+Logs prints the recent log entries of the daemon started by "nih serve",
+over the control socket of -control, and with -f keeps printing new ones
+until interrupted. The daemon keeps its last entries at every level,
+including debug, whatever the -log-level of serve, and unlike the
+standard error of serve, it does not sample them: of the entries of a
+message, serve writes at most 100 a second there, then every 100th.
+
+-since keeps the entries from a time, given as RFC 3339 such as
+2006-01-02T15:04:05Z or as a duration before now such as 10m, and -level
+keeps those at or above a level: debug, info, warn, or error.
+
+Entries are printed one per line, as text or with -o json as JSON objects.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&logsFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+		fs.BoolVar(&logsFlags.follow, "f", false, "Keep printing new entries until interrupted")
+		fs.StringVar(&logsFlags.since, "since", "", "Print entries from this `time` or duration ago")
+		fs.StringVar(&logsFlags.level, "level", "debug", "Minimum `level` of entries to print")
+	},
+	Run: runLogs,
+}
+
+func init() {
+	Register(cmdLogs)
+}
+
+func runLogs(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	q := url.Values{}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logsFlags.level)); err != nil {
+		return Usagef("-level: %v", err)
+	}
+	q.Set("level", level.String())
+
+	if logsFlags.since != "" {
+		since, err := parseSince(logsFlags.since, time.Now())
+		if err != nil {
+			return Usagef("-since: %v", err)
+		}
+		q.Set("since", since.Format(time.RFC3339Nano))
+	}
+
+	if logsFlags.follow {
+		q.Set("follow", "1")
+	} else {
+		var cancel context.CancelFunc
+		ctx, cancel = WithTimeout(ctx)
+		defer cancel()
+	}
+
+	resp, err := controlRequest(ctx, logsFlags.control, "GET", "/admin/logs?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	u := Global.UI()
+	enc := json.NewEncoder(os.Stdout)
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e log.Entry
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		if Global.Output == output.JSON {
+			enc.Encode(&e)
+			continue
+		}
+
+		level := fmt.Sprintf("%-5s", e.Level)
+		switch {
+		case e.Level >= log.LevelError:
+			level = u.Red(level)
+		case e.Level >= log.LevelWarn:
+			level = u.Yellow(level)
+		case e.Level < log.LevelInfo:
+			level = u.Faint(level)
+		}
+
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %s %s", e.Time.Format("2006-01-02T15:04:05.000Z07:00"), level, e.Message)
+		for _, a := range e.Attrs {
+			fmt.Fprintf(&b, " %s=%s", a.Key, quoteValue(a.Value))
+		}
+		fmt.Println(b.String())
+	}
+}
+
+// parseSince parses s as an RFC 3339 time, or as a duration before now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, errors.New("want a time such as 2006-01-02T15:04:05Z or a duration such as 10m")
+	}
+
+	return now.Add(-d), nil
+}
+
+// quoteValue quotes a log attribute value if it would not read as one word.
+func quoteValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
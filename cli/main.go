@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"nih.software/cli/output"
+	"nih.software/cli/ui"
+	"nih.software/log"
+	"nih.software/trust"
+)
+
+// Main runs the nih tool with the given command-line arguments,
+// not including the program name, and returns its exit code.
+func Main(args []string) int {
+	fs := flag.NewFlagSet("nih", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	Global.Flags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return Report(Help(nil))
+		}
+		return Report(&UsageError{Path: "nih", Err: err})
+	}
+
+	if err := ApplyEnv(fs, "nih"); err != nil {
+		return Report(&UsageError{Path: "nih", Err: err})
+	}
+
+	ui.SetDefault(Global.UI())
+	log.SetDefault(Global.Logger())
+	output.NoHeader = Global.NoHeader
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// After the first signal, restore the default behavior
+	// so that a second one kills a command that is slow to clean up.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := Run(ctx, fs.Args())
+	if err != nil && ctx.Err() != nil {
+		err = &Error{Code: ExitInterrupted, Err: fmt.Errorf("nih: interrupted")}
+	}
+
+	return Report(err)
+}
+
+var bundle *trust.Bundle
+
+// Bundle returns the credentials named by the global flags.
+// It may only be called by commands that set Credentials.
+func Bundle() *trust.Bundle {
+	if bundle == nil {
+		panic("cli: Bundle called by a command without Credentials")
+	}
+
+	return bundle
+}
+
+// loadBundle loads the credentials for the command at path.
+func loadBundle(path string) error {
+	b, err := loadCredentials()
+
+	var uerr *UsageError
+	if errors.As(err, &uerr) {
+		return err
+	}
+
+	if err != nil {
+		return TrustError(
+			fmt.Errorf("%s: load credentials: %w", path, err),
+			"Run \"nih dev preflight\" to generate development credentials, or set -cert, -key, and -ca.")
+	}
+
+	bundle = b
+	return nil
+}
+
+// loadCredentials loads the credentials named by the global flags,
+// any of which may be "-" for standard input.
+func loadCredentials() (*trust.Bundle, error) {
+	// A single stream cannot tell the chain from the roots.
+	if Global.CertFile == Stdio && Global.CAFile == Stdio {
+		return nil, &UsageError{Path: "nih", Err: errors.New("-cert and -ca cannot both be read from standard input")}
+	}
+
+	certPEM, err := ReadFile(Global.CertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ReadFile(Global.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := ReadFile(Global.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := trust.ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", Global.CertFile, err)
+	}
+
+	key, err := trust.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", Global.KeyFile, err)
+	}
+
+	roots, err := trust.ParseCertificatesPEM(caPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", Global.CAFile, err)
+	}
+
+	return trust.NewBundle(chain, key, roots)
+}
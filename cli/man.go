@@ -0,0 +1,224 @@
+package cli
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeDocs writes a page for nih and one for every command into dir,
+// as roff man pages (nih.1, nih-trustgen.1, ...) or plain text (nih.txt, ...),
+// and a page for every help topic (nih-trust.7 or nih-trust.txt, ...).
+func writeDocs(dir string, man bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	ext := ".txt"
+	if man {
+		ext = ".1"
+	}
+
+	write := func(path string, c *Command) error {
+		var b bytes.Buffer
+		switch {
+		case man && c == nil:
+			writeManRoot(&b)
+		case man:
+			c.writeMan(&b, path)
+		case c == nil:
+			printHelp(&b)
+		default:
+			c.printHelp(&b, path)
+		}
+
+		name := strings.ReplaceAll(path, " ", "-") + ext
+		return os.WriteFile(filepath.Join(dir, name), b.Bytes(), 0644)
+	}
+
+	if err := write("nih", nil); err != nil {
+		return err
+	}
+
+	var walk func(path string, c *Command) error
+	walk = func(path string, c *Command) error {
+		path += " " + c.Name
+		if err := write(path, c); err != nil {
+			return err
+		}
+
+		for _, sub := range c.Commands {
+			if err := walk(path, sub); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, c := range Commands() {
+		if err := walk("nih", c); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range Topics() {
+		var b bytes.Buffer
+		name := "nih-" + t.Name + ".txt"
+		if man {
+			t.writeMan(&b)
+			name = "nih-" + t.Name + ".7"
+		} else {
+			t.printHelp(&b)
+		}
+
+		if err := os.WriteFile(filepath.Join(dir, name), b.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeManRoot(w io.Writer) {
+	fmt.Fprintf(w, ".TH NIH 1\n")
+	fmt.Fprintf(w, ".SH NAME\nnih \\- a single-binary cloud\n")
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B nih\n[global flags] COMMAND [local flags] [arguments]\n")
+	fmt.Fprintf(w, ".SH COMMANDS\n")
+	writeManCommands(w, "nih", Commands())
+
+	fs := flag.NewFlagSet("nih", flag.ContinueOnError)
+	new(Globals).Flags(fs)
+	fmt.Fprintf(w, ".SH OPTIONS\n")
+	writeManFlags(w, fs, "nih")
+
+	fmt.Fprintf(w, ".SH TOPICS\n")
+	for _, t := range Topics() {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s.\nSee\n.BR nih-%s (7).\n",
+			roffEscape(t.Name), roffEscape(capitalize(t.Summary)), roffEscape(t.Name))
+	}
+}
+
+func (t *Topic) writeMan(w io.Writer) {
+	page := "nih-" + t.Name
+
+	fmt.Fprintf(w, ".TH %s 7\n", strings.ToUpper(roffEscape(page)))
+	fmt.Fprintf(w, ".SH NAME\n%s \\- %s\n", roffEscape(page), roffEscape(t.Summary))
+	fmt.Fprintf(w, ".SH DESCRIPTION\n")
+	writeManText(w, t.Text)
+	fmt.Fprintf(w, ".SH SEE ALSO\n.BR nih (1)\n")
+}
+
+func (c *Command) writeMan(w io.Writer, path string) {
+	page := strings.ReplaceAll(path, " ", "-")
+
+	fmt.Fprintf(w, ".TH %s 1\n", strings.ToUpper(roffEscape(page)))
+	fmt.Fprintf(w, ".SH NAME\n%s \\- %s\n", roffEscape(page), roffEscape(c.Summary))
+
+	fmt.Fprintf(w, ".SH SYNOPSIS\n.B %s\n", roffEscape(path))
+	var synopsis []string
+	if len(c.Commands) > 0 && c.Run == nil {
+		synopsis = append(synopsis, "COMMAND")
+	}
+	if c.Flags != nil {
+		synopsis = append(synopsis, "[flags]")
+	}
+	if c.Args != "" {
+		synopsis = append(synopsis, c.Args)
+	}
+	if len(synopsis) > 0 {
+		fmt.Fprintln(w, roffEscape(strings.Join(synopsis, " ")))
+	}
+
+	fmt.Fprintf(w, ".SH DESCRIPTION\n%s.\n", roffEscape(capitalize(c.Summary)))
+	if c.Help != "" {
+		fmt.Fprintf(w, ".PP\n")
+		writeManText(w, c.Help)
+	}
+	if len(c.Aliases) > 0 {
+		fmt.Fprintf(w, ".PP\nAliases: %s.\n", roffEscape(strings.Join(c.Aliases, ", ")))
+	}
+
+	if len(c.Commands) > 0 {
+		fmt.Fprintf(w, ".SH COMMANDS\n")
+		writeManCommands(w, path, c.Commands)
+	}
+
+	if c.Flags != nil {
+		fmt.Fprintf(w, ".SH OPTIONS\n")
+		writeManFlags(w, c.FlagSet(path), path)
+	}
+
+	fmt.Fprintf(w, ".SH SEE ALSO\n")
+	parent := path[:strings.LastIndex(path, " ")]
+	fmt.Fprintf(w, ".BR %s (1)\n", roffEscape(strings.ReplaceAll(parent, " ", "-")))
+}
+
+func writeManCommands(w io.Writer, path string, cs []*Command) {
+	for _, c := range cs {
+		fmt.Fprintf(w, ".TP\n.B %s\n%s.\nSee\n.BR %s (1).\n",
+			roffEscape(c.Name), roffEscape(capitalize(c.Summary)),
+			roffEscape(strings.ReplaceAll(path+" "+c.Name, " ", "-")))
+	}
+}
+
+func writeManFlags(w io.Writer, fs *flag.FlagSet, path string) {
+	fs.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+
+		fmt.Fprintf(w, ".TP\n")
+		if name != "" {
+			fmt.Fprintf(w, ".BI \\-%s \" %s\"\n", roffEscape(f.Name), strings.ToUpper(name))
+		} else {
+			fmt.Fprintf(w, ".B \\-%s\n", roffEscape(f.Name))
+		}
+
+		fmt.Fprintln(w, roffEscape(strings.ReplaceAll(usage, "\n", " ")))
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" && f.DefValue != "0s" {
+			fmt.Fprintf(w, "(default: %s)\n", roffEscape(f.DefValue))
+		}
+		fmt.Fprintf(w, "(env: %s)\n", EnvName(path, f.Name))
+	})
+}
+
+// writeManText converts help text to roff: blank lines separate paragraphs
+// and indented lines are set as literal blocks.
+func writeManText(w io.Writer, text string) {
+	literal := false
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		switch {
+		case line == "":
+			if literal {
+				fmt.Fprintf(w, ".fi\n.RE\n")
+				literal = false
+			}
+			fmt.Fprintf(w, ".PP\n")
+
+		case strings.HasPrefix(line, "    "):
+			if !literal {
+				fmt.Fprintf(w, ".RS 4\n.nf\n")
+				literal = true
+			}
+			fmt.Fprintln(w, roffEscape(strings.TrimPrefix(line, "    ")))
+
+		default:
+			fmt.Fprintln(w, roffEscape(line))
+		}
+	}
+
+	if literal {
+		fmt.Fprintf(w, ".fi\n.RE\n")
+	}
+}
+
+func roffEscape(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s
+}
@@ -0,0 +1,274 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/daemon"
+	"nih.software/peers"
+	"nih.software/trust"
+)
+
+var nodesFlags struct {
+	control string
+	pin     string
+}
+
+var cmdNodes = &Command{
+	Name:    "nodes",
+	Summary: "list the peers known to the running daemon",
+	Help: `
+Nodes asks the daemon started by "nih serve" for the peers it knows, over
+the control socket of -control, and lists their name, the serial number
+of their certificate, their address, when they were last seen, and their
+health.
+
+The daemon knows two sources of peers. Static peers are those of its serve
+-peers flag and of the address book, which it probes every -peer-interval
+over a connection it keeps to each: their health is "ok" if they answered
+the last probe, "suspect" if they failed to answer the last ones in time,
+"down" with the error if they could not be reached or failed three probes
+in a row, and "unknown" until the first probe. Inbound peers are those
+that made requests to it since it started: their health is "ok" if they
+were seen within three probe intervals, and "stale" otherwise. A static
+peer that also connects to the daemon is listed once. With serve -mdns,
+the daemon also probes the nodes it finds on the local network, of
+source "mdns", and with serve -srv, those of DNS SRV records, of source
+"dns", as static peers. With serve -gossip, it also lists the members of
+the cluster it learned of by gossip, of source "gossip": their health is
+"ok" if alive, "suspect" if they failed to answer lately, "down" if they
+failed for longer, and "left" if they left the cluster.
+
+The address book, peers.json in the global -state directory, names the
+nodes this one knows, with their addresses and the identity each must
+present: the common name of its certificate, which is its name in the
+book, and with a pin, the key of its certificate. "nih nodes add",
+"nih nodes remove", and "nih nodes book" change and list it. Commands
+that take a node, such as "nih exec" and "nih ping", accept the name of a
+peer of the book, and fail if the node at its address is another one.
+The daemon reads the book again for every round of probes, and reports a
+peer that presents another identity as down.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&nodesFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+	},
+	Run:      runNodes,
+	Commands: []*Command{cmdNodesAdd, cmdNodesRemove, cmdNodesBook},
+}
+
+var cmdNodesAdd = &Command{
+	Name:    "add",
+	Args:    "NAME ADDR...",
+	Summary: "add a peer to the address book",
+	Help: `
+Add adds the node of common name NAME at the addresses ADDR, tried in
+order, to the address book, or replaces the peer of the same name.
+The port of an address defaults to that of "nih serve".
+
+With -pin, the node must also present a certificate for the key of the
+pin, the unpadded base64url encoding of the SHA-256 hash of the DER
+encoding of its public key, as printed by "nih cert inspect", so that
+a certificate the CA issues for the same name to another node is refused.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&nodesFlags.pin, "pin", "", "`Pin` of the public key the node must present")
+	},
+	Run: runNodesAdd,
+}
+
+var cmdNodesRemove = &Command{
+	Name:    "remove",
+	Aliases: []string{"rm"},
+	Args:    "NAME...",
+	Summary: "remove peers from the address book",
+	Help: `
+Remove removes the peers named NAME from the address book. The daemon
+stops probing them at its next round.
+`,
+	Run: runNodesRemove,
+}
+
+var cmdNodesBook = &Command{
+	Name:    "book",
+	Summary: "list the address book",
+	Help: `
+Book lists the peers of the address book with their addresses, pin, how
+they were added, and when they were last changed.
+`,
+	Run: runNodesBook,
+}
+
+func init() {
+	Register(cmdNodes)
+}
+
+func runNodes(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	var peers []daemon.Peer
+	if err := controlGet(ctx, nodesFlags.control, "/admin/peers", &peers); err != nil {
+		return err
+	}
+
+	return Print(peersTable(peers))
+}
+
+func runNodesAdd(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return Usagef("need a name and at least one address")
+	}
+
+	book, err := openBook()
+	if err != nil {
+		return err
+	}
+
+	p := peers.Peer{Name: args[0], Pin: nodesFlags.pin}
+	for _, addr := range args[1:] {
+		p.Addrs = append(p.Addrs, withDefaultPort(addr))
+	}
+
+	return book.Put(p)
+}
+
+func runNodesRemove(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return Usagef("need at least one name")
+	}
+
+	book, err := openBook()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range args {
+		if err := book.Remove(name); errors.Is(err, peers.ErrNotFound) {
+			return fmt.Errorf("%s: no such peer", name)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runNodesBook(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	book, err := openBook()
+	if err != nil {
+		return err
+	}
+
+	ps, err := book.Peers()
+	if err != nil {
+		return err
+	}
+
+	if Global.Output != output.Text {
+		return Print(ps)
+	}
+
+	t := output.NewTable("NAME", "ADDRS", "PIN", "SOURCE", "UPDATED")
+	for _, p := range ps {
+		t.Append(p.Name, strings.Join(p.Addrs, ","), cellOrDash(p.Pin), p.Source, p.Updated.Format(time.RFC3339))
+	}
+
+	return Print(t)
+}
+
+// openBook opens the address book in the global -state directory.
+func openBook() (*peers.Book, error) {
+	return peers.OpenBook(filepath.Join(Global.StateDir, peers.DefaultFile))
+}
+
+// nodeAddr returns the address of node, the name of a peer of the address
+// book or an address, and the peer to expect there if it is one of the
+// book. The address is the first of the peer, and otherwise node with the
+// port of daemon.DefaultAddr if it has none.
+func nodeAddr(node string) (string, *peers.Peer, error) {
+	if strings.Contains(node, ":") {
+		// Not a name, which has no colon.
+		return withDefaultPort(node), nil, nil
+	}
+
+	book, err := openBook()
+	if err != nil {
+		return "", nil, err
+	}
+
+	p, err := book.Lookup(node)
+	if errors.Is(err, peers.ErrNotFound) {
+		return withDefaultPort(node), nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return p.Addrs[0], p, nil
+}
+
+// nodeTLSConfig returns the TLS configuration of b for connections to a
+// node, which fail unless the node presents the identity of expect, if it
+// is not nil.
+func nodeTLSConfig(b *trust.Bundle, expect *peers.Peer) *tls.Config {
+	config := b.TLSConfig()
+	if expect != nil {
+		config.VerifyConnection = expect.VerifyConnection
+	}
+	return config
+}
+
+// peersTable returns the table of peers printed by nodes and watch.
+func peersTable(peers []daemon.Peer) *output.Table {
+	t := output.NewTable("NAME", "SERIAL", "ADDR", "SOURCE", "LAST SEEN", "SKEW", "HEALTH")
+	for _, p := range peers {
+		seen := "never"
+		if !p.LastSeen.IsZero() {
+			seen = p.LastSeen.Format(time.RFC3339)
+		}
+
+		health := p.Health
+		if p.Error != "" {
+			health += ": " + p.Error
+		}
+
+		skew := "-"
+		if p.Skew != 0 {
+			skew = formatSkew(p.Skew)
+		}
+
+		t.Append(cellOrDash(p.Name), cellOrDash(p.Serial), p.Addr, p.Source, seen, skew, health)
+	}
+
+	return t
+}
+
+// formatSkew returns the skew of the clock of a peer to the millisecond,
+// signed, such as +1.5s for a clock ahead.
+func formatSkew(skew daemon.Duration) string {
+	d := time.Duration(skew).Round(time.Millisecond)
+	if d > 0 {
+		return "+" + d.String()
+	}
+	return d.String()
+}
+
+// cellOrDash returns s, or "-" for a table cell that would be empty.
+func cellOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
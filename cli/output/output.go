@@ -0,0 +1,66 @@
+// Package output renders command results for humans or for scripts.
+//
+// A command builds its result as a plain value and passes it to Write.
+// In text mode the value renders itself through the Texter interface;
+// in JSON mode it is encoded as a single JSON document,
+// so the value's exported fields and json tags are its machine-readable schema.
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Format selects how results are rendered.
+type Format int
+
+const (
+	Text Format = iota
+	JSON
+)
+
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	default:
+		return "text"
+	}
+}
+
+// Set implements flag.Value.
+func (f *Format) Set(s string) error {
+	switch s {
+	case "text":
+		*f = Text
+	case "json":
+		*f = JSON
+	default:
+		return fmt.Errorf("unknown output format %q", s)
+	}
+	return nil
+}
+
+// A Texter renders itself as human-readable text.
+type Texter interface {
+	WriteText(w io.Writer) error
+}
+
+// Write renders v to w in the given format.
+// In text mode, v is rendered by its WriteText method if it has one,
+// and printed with fmt.Fprintln otherwise.
+func Write(w io.Writer, f Format, v any) error {
+	if f == JSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	if t, ok := v.(Texter); ok {
+		return t.WriteText(w)
+	}
+
+	_, err := fmt.Fprintln(w, v)
+	return err
+}
@@ -0,0 +1,68 @@
+package output_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"nih.software/cli/output"
+)
+
+type result struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func (r *result) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%s: %d\n", r.Name, r.Count)
+	return err
+}
+
+func TestWrite(t *testing.T) {
+	r := &result{Name: "peers", Count: 3}
+
+	t.Run("text", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := output.Write(&b, output.Text, r); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := b.String(), "peers: 3\n"; got != want {
+			t.Fatalf("%q != %q", got, want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := output.Write(&b, output.JSON, r); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := b.String(), "{\n  \"name\": \"peers\",\n  \"count\": 3\n}\n"; got != want {
+			t.Fatalf("%q != %q", got, want)
+		}
+	})
+
+	t.Run("text fallback", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := output.Write(&b, output.Text, 42); err != nil {
+			t.Fatal(err)
+		}
+
+		if got, want := b.String(), "42\n"; got != want {
+			t.Fatalf("%q != %q", got, want)
+		}
+	})
+}
+
+func TestFormatSet(t *testing.T) {
+	var f output.Format
+	if err := f.Set("json"); err != nil || f != output.JSON {
+		t.Fatalf("Set(json) = %v, %v", f, err)
+	}
+
+	if err := f.Set("yaml"); err == nil {
+		t.Fatal("no error")
+	}
+}
@@ -0,0 +1,121 @@
+package output
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// NoHeader omits the header row of tables in text output.
+// It is set by the global -no-header flag, for scripts that parse columns.
+var NoHeader bool
+
+// A Table is a result made of rows of cells, such as a list of nodes.
+//
+// In text mode, columns are aligned and separated by two spaces.
+// In JSON mode, each row is an object keyed by the header,
+// lowercased with spaces replaced by underscores.
+type Table struct {
+	Header []string
+	Rows   [][]string
+
+	// MaxWidth truncates cells wider than this many characters, marking them with "…".
+	// Zero means no limit.
+	MaxWidth int
+
+	// Right lists the indexes of columns aligned to the right, such as counts.
+	Right []int
+}
+
+// NewTable returns a table with the given header.
+func NewTable(header ...string) *Table {
+	return &Table{Header: header}
+}
+
+// Append adds a row.
+func (t *Table) Append(cells ...string) {
+	t.Rows = append(t.Rows, cells)
+}
+
+// WriteText implements Texter.
+func (t *Table) WriteText(w io.Writer) error {
+	rows := t.Rows
+	if len(t.Header) > 0 && !NoHeader {
+		rows = append([][]string{t.Header}, rows...)
+	}
+
+	cells := make([][]string, len(rows))
+	var widths []int
+	for i, row := range rows {
+		cells[i] = make([]string, len(row))
+		for j, cell := range row {
+			cell = t.truncate(cell)
+			cells[i][j] = cell
+
+			if j == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[j] = max(widths[j], utf8.RuneCountInString(cell))
+		}
+	}
+
+	right := make(map[int]bool)
+	for _, j := range t.Right {
+		right[j] = true
+	}
+
+	var b strings.Builder
+	for _, row := range cells {
+		b.Reset()
+		for j, cell := range row {
+			pad := strings.Repeat(" ", widths[j]-utf8.RuneCountInString(cell))
+			if j > 0 {
+				b.WriteString("  ")
+			}
+			if right[j] {
+				b.WriteString(pad + cell)
+			} else if j < len(row)-1 {
+				b.WriteString(cell + pad)
+			} else {
+				b.WriteString(cell)
+			}
+		}
+		b.WriteByte('\n')
+
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Table) truncate(s string) string {
+	if t.MaxWidth <= 0 || utf8.RuneCountInString(s) <= t.MaxWidth {
+		return s
+	}
+
+	r := []rune(s)
+	return string(r[:max(t.MaxWidth-1, 0)]) + "…"
+}
+
+// MarshalJSON implements json.Marshaler.
+func (t *Table) MarshalJSON() ([]byte, error) {
+	keys := make([]string, len(t.Header))
+	for i, h := range t.Header {
+		keys[i] = strings.ReplaceAll(strings.ToLower(h), " ", "_")
+	}
+
+	rows := make([]map[string]string, len(t.Rows))
+	for i, row := range t.Rows {
+		rows[i] = make(map[string]string, len(row))
+		for j, cell := range row {
+			if j < len(keys) {
+				rows[i][keys[j]] = cell
+			}
+		}
+	}
+
+	return json.Marshal(rows)
+}
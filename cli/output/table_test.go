@@ -0,0 +1,90 @@
+package output_test
+
+import (
+	"bytes"
+	"testing"
+
+	"nih.software/cli/output"
+)
+
+func TestTable(t *testing.T) {
+	tbl := output.NewTable("NAME", "ADDRESS", "PEERS")
+	tbl.Right = []int{2}
+	tbl.Append("alpha", "10.0.0.1:7000", "3")
+	tbl.Append("b", "[fe80::1]:7000", "12")
+
+	t.Run("text", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := output.Write(&b, output.Text, tbl); err != nil {
+			t.Fatal(err)
+		}
+
+		want := "" +
+			"NAME   ADDRESS         PEERS\n" +
+			"alpha  10.0.0.1:7000       3\n" +
+			"b      [fe80::1]:7000     12\n"
+		if got := b.String(); got != want {
+			t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("no header", func(t *testing.T) {
+		output.NoHeader = true
+		defer func() { output.NoHeader = false }()
+
+		var b bytes.Buffer
+		if err := output.Write(&b, output.Text, tbl); err != nil {
+			t.Fatal(err)
+		}
+
+		want := "" +
+			"alpha  10.0.0.1:7000    3\n" +
+			"b      [fe80::1]:7000  12\n"
+		if got := b.String(); got != want {
+			t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		tbl := &output.Table{Header: []string{"ID", "NOTE"}, MaxWidth: 6}
+		tbl.Append("1", "a very long note")
+		tbl.Append("2", "short")
+
+		var b bytes.Buffer
+		if err := tbl.WriteText(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		want := "" +
+			"ID  NOTE\n" +
+			"1   a ver…\n" +
+			"2   short\n"
+		if got := b.String(); got != want {
+			t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := output.Write(&b, output.JSON, tbl); err != nil {
+			t.Fatal(err)
+		}
+
+		want := `[
+  {
+    "address": "10.0.0.1:7000",
+    "name": "alpha",
+    "peers": "3"
+  },
+  {
+    "address": "[fe80::1]:7000",
+    "name": "b",
+    "peers": "12"
+  }
+]
+`
+		if got := b.String(); got != want {
+			t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/cli/ui"
+	"nih.software/daemon"
+	"nih.software/peers"
+	"nih.software/trust"
+)
+
+var pingFlags struct {
+	count    int
+	interval time.Duration
+}
+
+var cmdPing = &Command{
+	Name:    "ping",
+	Args:    "NODE",
+	Summary: "check mutual TLS connectivity with a peer",
+	Help: `
+Ping connects to the node NODE, the name of a peer of the address book or
+host[:port] with the port of serve -listen by default, completes a mutually authenticated handshake
+with the global credentials, and requests the peer's health service.
+It prints the peer's identity, the negotiated TLS version and application
+protocol, and the time taken to connect, to hand shake, and for the
+request's round trip.
+
+Every probe uses a new connection, limited by -timeout. Ping fails
+if any probe fails, with status 3 if either side rejected the other's
+certificate and status 4 if the peer could not be reached.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.IntVar(&pingFlags.count, "count", 1, "Number of probes to send")
+		fs.DurationVar(&pingFlags.interval, "interval", time.Second, "Time to wait between probes")
+	},
+	Credentials: true,
+	Run:         runPing,
+}
+
+func init() {
+	Register(cmdPing)
+}
+
+func runPing(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need exactly one node")
+	}
+
+	if pingFlags.count < 1 {
+		return Usagef("-count must be at least 1")
+	}
+
+	addr, expect, err := nodeAddr(args[0])
+	if err != nil {
+		return err
+	}
+	result := &pingResult{Addr: addr}
+
+	for i := 0; i < pingFlags.count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(pingFlags.interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		p, state, err := probe(ctx, addr, Bundle(), expect)
+		if err != nil {
+			if Global.Output == output.Text && len(result.Probes) > 0 {
+				Print(result)
+			}
+			return err
+		}
+
+		if result.Peer == nil {
+			result.Peer = newCertInfo(state.PeerCertificates[0])
+			result.TLSVersion = tls.VersionName(state.Version)
+			result.ALPN = state.NegotiatedProtocol
+			result.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		}
+
+		result.Probes = append(result.Probes, p)
+		ui.Debug("probe %d: connect %v, handshake %v, rtt %v", i+1, p.Connect, p.Handshake, p.RTT)
+	}
+
+	return Print(result)
+}
+
+// withDefaultPort adds the port of daemon.DefaultAddr to addr if it has none.
+func withDefaultPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	_, port, _ := net.SplitHostPort(daemon.DefaultAddr)
+	return net.JoinHostPort(addr, port)
+}
+
+type pingResult struct {
+	Addr        string       `json:"addr"`
+	Peer        *certInfo    `json:"peer,omitempty"`
+	TLSVersion  string       `json:"tls_version,omitempty"`
+	ALPN        string       `json:"alpn,omitempty"`
+	CipherSuite string       `json:"cipher_suite,omitempty"`
+	Probes      []*pingProbe `json:"probes"`
+}
+
+type pingProbe struct {
+	Connect   time.Duration `json:"connect_ns"`
+	Handshake time.Duration `json:"handshake_ns"`
+	RTT       time.Duration `json:"rtt_ns"`
+
+	// skew is how far the peer's clock, from the time of its answer, is
+	// ahead of ours, or to the second from the Date of its response if
+	// the answer has no time. It is zero if the peer sent neither.
+	skew time.Duration
+}
+
+// probe connects to addr, hands shake with the credentials of b,
+// and requests the health service, timing each step.
+func probe(ctx context.Context, addr string, b *trust.Bundle, expect *peers.Peer) (*pingProbe, *tls.ConnectionState, error) {
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	var p pingProbe
+
+	start := time.Now()
+	var d net.Dialer
+	raw, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.Connect = time.Since(start)
+
+	// The context bounds the whole probe, not just the dial.
+	stop := context.AfterFunc(ctx, func() { raw.Close() })
+	defer stop()
+
+	config := nodeTLSConfig(b, expect)
+	config.NextProtos = []string{"http/1.1"}
+
+	conn := tls.Client(raw, config)
+	defer conn.Close()
+
+	start = time.Now()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, nil, err
+	}
+	p.Handshake = time.Since(start)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+addr+"/health/", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start = time.Now()
+	if err := req.Write(conn); err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return nil, nil, err
+	}
+	var h daemon.Health
+	json.NewDecoder(resp.Body).Decode(&h)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	p.RTT = time.Since(start)
+
+	// The peer stamped the response around the middle of the round trip.
+	mid := start.Add(p.RTT / 2)
+	if !h.Time.IsZero() {
+		p.skew = h.Time.Sub(mid)
+	} else if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		p.skew = date.Sub(mid.Truncate(time.Second))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("health: %s", resp.Status)
+	}
+
+	state := conn.ConnectionState()
+	return &p, &state, nil
+}
+
+// WriteText implements output.Texter.
+func (r *pingResult) WriteText(w io.Writer) error {
+	if r.Peer != nil {
+		fmt.Fprintf(w, "%s: %s, serial %s, expires %s\n", r.Addr, orEmpty(r.Peer.Subject), r.Peer.Serial, r.Peer.NotAfter.Format(time.RFC3339))
+		fmt.Fprintf(w, "  %s, %s, alpn %s\n", r.TLSVersion, r.CipherSuite, orEmpty(r.ALPN))
+	}
+
+	for i, p := range r.Probes {
+		fmt.Fprintf(w, "  probe %d: connect %v, handshake %v, rtt %v\n", i+1,
+			p.Connect.Round(time.Microsecond), p.Handshake.Round(time.Microsecond), p.RTT.Round(time.Microsecond))
+	}
+
+	return nil
+}
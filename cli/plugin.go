@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PluginPrefix is the prefix of plugin executables:
+// "nih foo" runs nih-foo from PATH if foo is not a built-in command.
+const PluginPrefix = "nih-"
+
+// lookPlugin returns the path of the plugin executable for the named command,
+// or "" if there is none.
+func lookPlugin(name string) string {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return ""
+	}
+
+	path, err := exec.LookPath(PluginPrefix + name)
+	if err != nil {
+		return ""
+	}
+
+	return path
+}
+
+// runPlugin runs the plugin executable at path with args,
+// passing the global flags through the environment as NIH_* variables
+// so that the plugin uses the same credentials and output settings.
+func runPlugin(ctx context.Context, path string, args []string) error {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), Global.Environ()...)
+
+	// On cancellation, give the plugin a chance to clean up before killing it.
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 5 * time.Second
+
+	err := cmd.Run()
+
+	var xerr *exec.ExitError
+	if errors.As(err, &xerr) && xerr.Exited() {
+		// The plugin has reported its own error.
+		return exitStatus(xerr.ExitCode())
+	}
+
+	return err
+}
+
+// Environ returns the global flags as NIH_* environment variables, such as NIH_CERT.
+// File names are made absolute.
+func (g *Globals) Environ() []string {
+	abs := func(name string) string {
+		if p, err := filepath.Abs(name); err == nil {
+			return p
+		}
+		return name
+	}
+
+	return []string{
+		EnvName("nih", "cert") + "=" + abs(g.CertFile),
+		EnvName("nih", "key") + "=" + abs(g.KeyFile),
+		EnvName("nih", "ca") + "=" + abs(g.CAFile),
+		EnvName("nih", "output") + "=" + g.Output.String(),
+		EnvName("nih", "no-header") + "=" + strconv.FormatBool(g.NoHeader),
+		EnvName("nih", "no-color") + "=" + strconv.FormatBool(g.NoColor),
+		EnvName("nih", "quiet") + "=" + strconv.FormatBool(g.Quiet),
+		EnvName("nih", "verbose") + "=" + strconv.FormatBool(g.Verbose),
+		EnvName("nih", "yes") + "=" + strconv.FormatBool(g.Yes),
+		EnvName("nih", "timeout") + "=" + g.Timeout.String(),
+		EnvName("nih", "log-level") + "=" + g.LogLevel.String(),
+		EnvName("nih", "log-format") + "=" + g.LogFormat.String(),
+		EnvName("nih", "error-format") + "=" + g.ErrorFormat.String(),
+	}
+}
@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"sync"
+
+	"nih.software/cli/ui"
+)
+
+var proxyFlags struct {
+	reverse bool
+}
+
+var cmdProxy = &Command{
+	Name:    "proxy",
+	Args:    "LISTEN TARGET",
+	Summary: "tunnel TCP connections over mutual TLS",
+	Help: `
+Proxy accepts plain TCP connections on the local address LISTEN and
+forwards each to TARGET over a mutually authenticated TLS connection made
+with the global credentials. With -reverse, it does the opposite: it
+accepts TLS connections on LISTEN from peers holding credentials of the
+same hierarchy, and forwards each to TARGET in plain TCP.
+
+A pair of proxies bridges a service that knows nothing of TLS. On the
+service's host, run
+
+    nih proxy -reverse :7444 127.0.0.1:5432
+
+and on each client host
+
+    nih proxy 127.0.0.1:5432 db.example.com:7444
+
+Clients then connect to 127.0.0.1:5432 as if the service were local.
+Listen on a loopback address in the forward direction: anything that can
+connect to LISTEN uses the credentials of the proxy.
+
+Proxy runs until interrupted, then closes the tunnels it carries.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		proxyFlags.reverse = false
+		fs.BoolVar(&proxyFlags.reverse, "reverse", false, "Accept TLS connections and forward them in plain TCP")
+	},
+	Credentials: true,
+	Run:         runProxy,
+}
+
+func init() {
+	Register(cmdProxy)
+}
+
+func runProxy(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return Usagef("need a listen address and a target address")
+	}
+
+	listen, target := args[0], args[1]
+	b := Bundle()
+
+	var ln net.Listener
+	var err error
+	if proxyFlags.reverse {
+		ln, err = b.Listen("tcp", listen)
+	} else {
+		ln, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		return err
+	}
+
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	ui.Info("proxying %s to %s", ln.Addr(), target)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tunnel(ctx, conn, target)
+		}()
+	}
+}
+
+// tunnel forwards conn to target until either side closes, or ctx is done.
+func tunnel(ctx context.Context, conn net.Conn, target string) {
+	defer conn.Close()
+
+	src := conn.RemoteAddr()
+
+	dctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	var dst net.Conn
+	var err error
+	if proxyFlags.reverse {
+		tc := conn.(*tls.Conn)
+		if err := tc.HandshakeContext(dctx); err != nil {
+			ui.Warn("%s: %v", src, err)
+			return
+		}
+
+		ui.Debug("%s: accepted %s", src, tc.ConnectionState().PeerCertificates[0].Subject)
+
+		var d net.Dialer
+		dst, err = d.DialContext(dctx, "tcp", target)
+	} else {
+		dst, err = Bundle().Dial(dctx, "tcp", target)
+	}
+	if err != nil {
+		ui.Warn("%s: %v", src, err)
+		return
+	}
+	defer dst.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		dst.Close()
+	})
+	defer stop()
+
+	ui.Debug("%s: connected to %s", src, target)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		splice(dst, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		splice(conn, dst)
+	}()
+	wg.Wait()
+
+	ui.Debug("%s: closed", src)
+}
+
+// splice copies from src to dst, then half-closes dst
+// so that the end of the stream carries through the tunnel.
+func splice(dst, src net.Conn) {
+	io.Copy(dst, src)
+
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"nih.software/cli/output"
+	"nih.software/daemon"
+	"nih.software/pubsub"
+)
+
+var pubsubFlags struct {
+	control string
+}
+
+func pubsubControlFlag(fs *flag.FlagSet) {
+	fs.StringVar(&pubsubFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+}
+
+var cmdPublish = &Command{
+	Name:    "publish",
+	Args:    "TOPIC [DATA]",
+	Summary: "publish a message to a topic of the cluster",
+	Help: `
+Publish publishes DATA, or standard input without it, to TOPIC through the
+daemon started by "nih serve", over the control socket of -control. The
+daemon delivers the message to its subscribers and forwards it to the
+other nodes it knows, which deliver it to theirs. Delivery is at most
+once: subscribers not listening then, or too slow to keep up, miss it.
+
+Topics are names of segments separated by dots, such as trust.anchors.
+Publish prints the ID of the message.
+`,
+	Flags: pubsubControlFlag,
+	Run:   runPublish,
+}
+
+var cmdSubscribe = &Command{
+	Name:    "subscribe",
+	Args:    "PATTERN...",
+	Summary: "print the messages published to topics of the cluster",
+	Help: `
+Subscribe prints the messages published to the topics of every PATTERN
+that reach the daemon started by "nih serve", over the control socket of
+-control, until interrupted. In a pattern, a segment "*" matches any one
+segment, and a last segment ">" matches one or more, so that trust.*
+matches trust.anchors and trust.> matches trust.anchors.v2 as well.
+
+Messages are printed one per line: their time, topic, publisher, and
+data, quoted unless it is a line of text; with -o json, as JSON objects,
+whose data is base64.
+`,
+	Flags: pubsubControlFlag,
+	Run:   runSubscribe,
+}
+
+func init() {
+	Register(cmdPublish)
+	Register(cmdSubscribe)
+}
+
+func runPublish(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return Usagef("need TOPIC and at most one DATA")
+	}
+	if !pubsub.ValidTopic(args[0]) {
+		return Usagef("invalid topic %q", args[0])
+	}
+
+	req := daemon.PublishRequest{Topic: args[0]}
+	if len(args) == 2 {
+		req.Data = []byte(args[1])
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req.Data = data
+	}
+
+	var m pubsub.Message
+	if err := controlDo(ctx, pubsubFlags.control, "POST", "/pubsub/publish", &req, &m); err != nil {
+		return err
+	}
+	return Print(&publishResult{ID: m.ID, Topic: m.Topic})
+}
+
+type publishResult struct {
+	ID    string `json:"id"`
+	Topic string `json:"topic"`
+}
+
+// WriteText implements output.Texter.
+func (r *publishResult) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintln(w, r.ID)
+	return err
+}
+
+func runSubscribe(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return Usagef("need at least one PATTERN")
+	}
+	q := url.Values{}
+	for _, p := range args {
+		if !pubsub.ValidPattern(p) {
+			return Usagef("invalid topic pattern %q", p)
+		}
+		q.Add("topic", p)
+	}
+
+	resp, err := controlRequest(ctx, pubsubFlags.control, "GET", "/pubsub/subscribe?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	u := Global.UI()
+	enc := json.NewEncoder(os.Stdout)
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var m pubsub.Message
+		if err := dec.Decode(&m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		if Global.Output == output.JSON {
+			enc.Encode(&m)
+			continue
+		}
+
+		data := string(m.Data)
+		if !utf8.Valid(m.Data) || strings.ContainsAny(data, "\n\r") {
+			data = strconv.Quote(data)
+		}
+		fmt.Println(m.Time.Format("2006-01-02T15:04:05.000Z07:00"), u.Faint(m.Topic), m.From, data)
+	}
+}
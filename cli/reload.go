@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"nih.software/daemon"
+)
+
+var reloadFlags struct {
+	control string
+}
+
+var cmdReload = &Command{
+	Name:    "reload",
+	Summary: "reload the credentials of the running daemon",
+	Help: `
+Reload asks the daemon started by "nih serve" to load its credentials
+again, over the control socket of -control, as SIGHUP does, and prints the
+serial number and expiry of the certificate it serves. New connections use
+the new credentials; the daemon keeps the current ones if they fail to
+load, and reload fails.
+
+Run it after replacing the certificate and key of the daemon, such as with
+"nih cert rotate", which takes -control to reload the daemon itself.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&reloadFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+	},
+	Run: runReload,
+}
+
+func init() {
+	Register(cmdReload)
+}
+
+func runReload(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	r, err := controlReload(ctx, reloadFlags.control)
+	if err != nil {
+		return err
+	}
+	return Print(r)
+}
+
+// controlReload has the daemon listening on the control socket at control
+// reload its credentials.
+func controlReload(ctx context.Context, control string) (*reloadResult, error) {
+	var s daemon.Status
+	if err := controlDo(ctx, control, "POST", "/admin/reload", nil, &s); err != nil {
+		return nil, err
+	}
+	return &reloadResult{Serial: s.Serial, NotAfter: s.NotAfter}, nil
+}
+
+type reloadResult struct {
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// WriteText implements output.Texter.
+func (r *reloadResult) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "reloaded: serving serial %s, expires %s\n", r.Serial, r.NotAfter.Format(time.RFC3339))
+	return err
+}
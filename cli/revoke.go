@@ -0,0 +1,316 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/cli/ui"
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+// RFC 5280 CRLReason codes, by the names nih revoke accepts.
+var revocationReasons = map[string]int{
+	"unspecified":            0,
+	"key-compromise":         1,
+	"ca-compromise":          2,
+	"affiliation-changed":    3,
+	"superseded":             4,
+	"cessation-of-operation": 5,
+}
+
+var revokeFlags struct {
+	dir      string
+	g        generator
+	reason   string
+	crl      string
+	validity time.Duration
+	push     string
+}
+
+var cmdRevoke = &Command{
+	Name:    "revoke",
+	Args:    "SERIAL|FILE...",
+	Summary: "revoke certificates issued by the CA",
+	Help: `
+Revoke marks certificates as revoked in the issuance database of the CA in
+-dir, then writes a new certificate revocation list signed by the
+intermediate CA to -crl. Each argument is a serial number or a file holding
+the certificate, as PEM or DER. A certificate must be signed by the CA and
+be the one its serial number records in the database.
+
+The CRL file holds an X509 CRL block followed by the chain of its issuer.
+With -push, revoke sends it to the crl service of the nodes at the given
+addresses, which reject the revoked certificates on new connections at once.
+Pushing uses the global credentials. Nodes keep the lists pushed to them
+until they restart.
+
+Before revoking, revoke asks for confirmation, unless the global -yes is
+set; without an answer, as in scripts, it fails. A certificate that is
+already revoked is skipped, so running revoke again only publishes the list.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		revokeFlags.g = generator{}
+		revokeFlags.push = ""
+		fs.StringVar(&revokeFlags.dir, "dir", defaultCADir, "CA `directory`")
+		fs.StringVar(&revokeFlags.g.issuerCert, "issuer-cert", "", "Issuing CA certificate `file`\n(default: intermediate.pem in -dir)")
+		fs.StringVar(&revokeFlags.g.issuerKey, "issuer-key", "", "Issuing CA private key `file`\n(default: intermediate.key in -dir)")
+		fs.StringVar(&revokeFlags.g.db, "db", "", "Issuance database `file` recording serials and revocations\n(default: issued.json in -dir)")
+		fs.StringVar(&revokeFlags.reason, "reason", "unspecified", "Revocation `reason`: "+strings.Join(reasonNames(), ", "))
+		fs.StringVar(&revokeFlags.crl, "crl", "", "Output revocation list `file`\n(default: crl.pem in -dir)")
+		fs.DurationVar(&revokeFlags.validity, "validity", 7*24*time.Hour, "Time until the revocation list must be replaced")
+		fs.StringVar(&revokeFlags.push, "push", "", "Comma-separated `addresses` of nodes to send the revocation list to")
+	},
+	Run: runRevoke,
+}
+
+func init() {
+	Register(cmdRevoke)
+}
+
+func reasonNames() []string {
+	names := make([]string, 0, len(revocationReasons))
+	for name := range revocationReasons {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return revocationReasons[names[i]] < revocationReasons[names[j]]
+	})
+	return names
+}
+
+func runRevoke(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return Usagef("need at least one serial number or certificate file")
+	}
+
+	reason, ok := revocationReasons[revokeFlags.reason]
+	if !ok {
+		return Usagef("unknown reason %q", revokeFlags.reason)
+	}
+
+	g := revokeFlags.g
+	if g.issuerCert == "" {
+		g.issuerCert = filepath.Join(revokeFlags.dir, caIntermediateCert)
+	}
+	if g.issuerKey == "" {
+		g.issuerKey = filepath.Join(revokeFlags.dir, caIntermediateKey)
+	}
+	if g.db == "" {
+		g.db = filepath.Join(revokeFlags.dir, caDB)
+	}
+
+	crlFile := revokeFlags.crl
+	if crlFile == "" {
+		crlFile = filepath.Join(revokeFlags.dir, "crl.pem")
+	}
+
+	db, err := trustgen.OpenDB(g.db)
+	if err != nil {
+		return err
+	}
+
+	ca, err := g.loadCA(nil)
+	if err != nil {
+		return err
+	}
+
+	var pending []int64
+	for _, arg := range args {
+		serial, crt, err := revokeSerial(arg)
+		if err != nil {
+			return err
+		}
+
+		// Serials only identify certificates among those in the
+		// database: a file may hold one of another CA, or one issued
+		// without the database, whose serial is that of another.
+		if crt != nil {
+			if err := crt.CheckSignatureFrom(ca.Cert); err != nil {
+				return fmt.Errorf("%s: not issued by %s: %w", arg, g.issuerCert, err)
+			}
+		}
+
+		rec := db.Lookup(serial)
+		switch {
+		case rec == nil:
+			return fmt.Errorf("serial %d: not issued by this CA", serial)
+		case !rec.IssuedBy(ca.Cert):
+			return fmt.Errorf("serial %d: issued by another CA than %s", serial, g.issuerCert)
+		case crt != nil && !recorded(rec, crt):
+			return fmt.Errorf("%s: not the certificate of serial %d in %s", arg, serial, g.db)
+		case rec.Revoked():
+			ui.Warn("serial %d already revoked", serial)
+			continue
+		}
+		pending = append(pending, serial)
+	}
+
+	if len(pending) > 0 {
+		if err := confirm(fmt.Sprintf("Revoke %s for %s? This cannot be undone.", serialList(pending), revokeFlags.reason)); err != nil {
+			return err
+		}
+	}
+
+	r := &revokeResult{CRL: crlFile}
+	for _, serial := range pending {
+		if err := db.Revoke(serial, reason); err != nil {
+			return err
+		}
+		r.Revoked = append(r.Revoked, serial)
+	}
+
+	der, err := db.CRL(ca.Cert, ca.Key, revokeFlags.validity)
+	if err != nil {
+		return err
+	}
+	crl := append(trustgen.PEMEncodeCRL(der), trustgen.PEMEncodeCertificates(ca.Chain...)...)
+
+	if err := writeFileAtomic(crlFile, crl); err != nil {
+		return err
+	}
+
+	if revokeFlags.push != "" {
+		b, err := loadCredentials()
+		if err != nil {
+			return TrustError(fmt.Errorf("push: load credentials: %w", err), "")
+		}
+
+		var failed int
+		for _, addr := range strings.Split(revokeFlags.push, ",") {
+			addr = withDefaultPort(addr)
+			err := pushCRL(ctx, b, addr, crl)
+			r.Pushed = append(r.Pushed, &pushResult{Addr: addr, Error: errorString(err)})
+			if err != nil {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			Print(r)
+			return fmt.Errorf("push: %d of %d nodes failed", failed, len(r.Pushed))
+		}
+	}
+
+	return Print(r)
+}
+
+// serialList describes serials, as in "serials 3, 5".
+func serialList(serials []int64) string {
+	s := make([]string, len(serials))
+	for i, n := range serials {
+		s[i] = strconv.FormatInt(n, 10)
+	}
+	if len(s) == 1 {
+		return "serial " + s[0]
+	}
+	return "serials " + strings.Join(s, ", ")
+}
+
+// revokeSerial returns the serial number arg, or the certificate in file
+// arg and its serial number.
+func revokeSerial(arg string) (int64, *x509.Certificate, error) {
+	if n, err := strconv.ParseInt(arg, 10, 64); err == nil {
+		return n, nil, nil
+	}
+
+	data, err := ReadFile(arg)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	certs, err := parseCertificates(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", arg, err)
+	}
+	if len(certs) == 0 {
+		return 0, nil, fmt.Errorf("%s: no certificate found", arg)
+	}
+
+	crt := certs[0]
+	if !crt.SerialNumber.IsInt64() {
+		return 0, nil, fmt.Errorf("%s: serial number %v not issued by this CA", arg, crt.SerialNumber)
+	}
+	return crt.SerialNumber.Int64(), crt, nil
+}
+
+// recorded reports whether rec records crt, by its subject and validity.
+func recorded(rec *trustgen.Record, crt *x509.Certificate) bool {
+	return rec.Subject == crt.Subject.String() &&
+		rec.NotBefore.Equal(crt.NotBefore) && rec.NotAfter.Equal(crt.NotAfter)
+}
+
+// pushCRL sends a revocation list to the crl service of the node at addr.
+func pushCRL(ctx context.Context, b *trust.Bundle, addr string, crl []byte) error {
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: b.TLSConfig()}}
+	defer c.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+addr+"/crl/", bytes.NewReader(crl))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-pem-file")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+type revokeResult struct {
+	Revoked []int64       `json:"revoked"`
+	CRL     string        `json:"crl"`
+	Pushed  []*pushResult `json:"pushed,omitempty"`
+}
+
+type pushResult struct {
+	Addr  string `json:"addr"`
+	Error string `json:"error,omitempty"`
+}
+
+// WriteText implements output.Texter.
+func (r *revokeResult) WriteText(w io.Writer) error {
+	for _, serial := range r.Revoked {
+		fmt.Fprintf(w, "revoked serial %d\n", serial)
+	}
+	fmt.Fprintf(w, "wrote %s\n", r.CRL)
+
+	u := Global.UI()
+	for _, p := range r.Pushed {
+		if p.Error != "" {
+			fmt.Fprintf(w, "pushed to %s: %s\n", p.Addr, u.Red("ERROR: "+p.Error))
+		} else {
+			fmt.Fprintf(w, "pushed to %s: %s\n", p.Addr, u.Green("OK"))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/daemon"
+	"nih.software/jobs"
+)
+
+var scheduleFlags struct {
+	control   string
+	jitter    time.Duration
+	singleton bool
+}
+
+var cmdSchedule = &Command{
+	Name:    "schedule",
+	Summary: "run jobs at the times of cron expressions",
+	Help: `
+Schedule reads and changes the schedules of the daemon started by "nih
+serve", over the control socket of -control. A schedule has the daemon
+submit a job, as "nih jobs run" does, at the times of a cron expression
+in the local time of the node: five fields of the minute, hour, day of
+the month, month, and day of the week, such as "0 3 * * *" for 3:00 every
+day or "*/15 * * * mon-fri" for every quarter of an hour on weekdays, or
+one of @hourly, @daily, @weekly, @monthly, @yearly, and "@every 90s".
+
+The daemon keeps its schedules, and the last job of each, in the global
+-state directory across restarts. A schedule does not submit its job while
+its last one runs. A singleton schedule, which needs the key-value store,
+runs on one node at a time of those that have it: the one leading the
+election "schedule", as "nih kv elections" lists, so that the same
+schedule may be added to several nodes for one of them to run it.
+`,
+	Commands: []*Command{cmdScheduleAdd, cmdScheduleList, cmdScheduleRemove, cmdScheduleRun},
+}
+
+func init() {
+	Register(cmdSchedule)
+}
+
+func scheduleControlFlag(fs *flag.FlagSet) {
+	fs.StringVar(&scheduleFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+}
+
+var cmdScheduleAdd = &Command{
+	Name:    "add",
+	Args:    "NAME CRON [--] COMMAND [ARG...]",
+	Summary: "add a schedule",
+	Help: `
+Add adds the schedule NAME, submitting a job running COMMAND at the times
+of the cron expression CRON, quoted as one argument, in place of the
+schedule of that name if any. The flags of the job are those of "nih jobs
+run". With -jitter, every job waits a random time up to it first, so that
+the nodes of the same schedule do not run it at once.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		scheduleControlFlag(fs)
+		jobSpecFlags(fs)
+		fs.DurationVar(&scheduleFlags.jitter, "jitter", 0, "Delay every job by a random time up to `duration`")
+		fs.BoolVar(&scheduleFlags.singleton, "singleton", false, "Run on the node leading the election of the schedules only")
+	},
+	Run: runScheduleAdd,
+}
+
+var cmdScheduleList = &Command{
+	Name:    "list",
+	Summary: "list the schedules of the daemon",
+	Help: `
+List prints the schedules of the daemon with their expression, the next
+time the daemon submits their job, and the last job it submitted. The next
+time of a singleton schedule is empty on the nodes not leading its
+election.
+`,
+	Flags: scheduleControlFlag,
+	Run:   runScheduleList,
+}
+
+var cmdScheduleRemove = &Command{
+	Name:    "remove",
+	Args:    "NAME",
+	Summary: "remove a schedule",
+	Help: `
+Remove removes the schedule NAME. The job it submitted last runs on, if
+it does; "nih jobs cancel" cancels it.
+`,
+	Flags: scheduleControlFlag,
+	Run:   runScheduleRemove,
+}
+
+var cmdScheduleRun = &Command{
+	Name:    "run",
+	Args:    "NAME",
+	Summary: "run the job of a schedule now",
+	Help: `
+Run submits the job of the schedule NAME on this node at once, without
+jitter, and waits for it as "nih jobs run" does.
+`,
+	Flags: scheduleControlFlag,
+	Run:   runScheduleRun,
+}
+
+func runScheduleAdd(ctx context.Context, args []string) error {
+	if len(args) < 3 {
+		return Usagef("need a name, an expression, and a command")
+	}
+	spec, err := jobSpec(args[2:])
+	if err != nil {
+		return err
+	}
+
+	s := daemon.Schedule{
+		Name:      args[0],
+		Cron:      args[1],
+		Jitter:    daemon.Duration(scheduleFlags.jitter),
+		Singleton: scheduleFlags.singleton,
+		Job:       spec,
+	}
+	var st daemon.ScheduleStatus
+	if err := controlDo(ctx, scheduleFlags.control, "POST", "/schedule/", &s, &st); err != nil {
+		return err
+	}
+	return Print(scheduleTable([]daemon.ScheduleStatus{st}))
+}
+
+func runScheduleList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("list takes no arguments")
+	}
+
+	var list []daemon.ScheduleStatus
+	if err := controlGet(ctx, scheduleFlags.control, "/schedule/", &list); err != nil {
+		return err
+	}
+
+	if Global.Output == output.JSON {
+		return Print(list)
+	}
+	return Print(scheduleTable(list))
+}
+
+// scheduleTable returns a table of list.
+func scheduleTable(list []daemon.ScheduleStatus) *output.Table {
+	t := output.NewTable("NAME", "CRON", "NEXT", "LAST", "STATE", "RUN")
+	for _, s := range list {
+		next, last, state := "-", "-", "-"
+		if !s.Next.IsZero() {
+			next = s.Next.Format(time.RFC3339)
+		}
+		if s.Last != nil {
+			last, state = s.Last.Time.Format(time.RFC3339), string(s.Last.State)
+		}
+		cron := s.Cron
+		if s.Singleton {
+			cron += " (singleton)"
+		}
+		t.Append(s.Name, cron, next, last, state, jobCommand(&s.Job))
+	}
+	return t
+}
+
+func runScheduleRemove(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one NAME")
+	}
+	var ok struct{}
+	return controlDo(ctx, scheduleFlags.control, "POST", "/schedule/remove", &daemon.ScheduleRequest{Name: args[0]}, &ok)
+}
+
+func runScheduleRun(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one NAME")
+	}
+	var j jobs.Job
+	if err := controlDo(ctx, scheduleFlags.control, "POST", "/schedule/run", &daemon.ScheduleRequest{Name: args[0]}, &j); err != nil {
+		return err
+	}
+	return jobsWait(ctx, scheduleFlags.control, j.ID)
+}
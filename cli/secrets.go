@@ -0,0 +1,337 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/daemon"
+)
+
+var secretsFlags struct {
+	control string
+	nodes   []string
+	all     bool
+}
+
+var secretsPutFlags struct {
+	file      string
+	mode      string
+	valueFile string
+}
+
+var secretsExecFlags struct {
+	env []string
+}
+
+var cmdSecrets = &Command{
+	Name:    "secrets",
+	Summary: "distribute secrets sealed to the keys of nodes",
+	Help: `
+Secrets puts secrets on the nodes of the cluster, and reads those of this
+node, through the daemon started by "nih serve", over the control socket of
+-control.
+
+A secret is sealed to the public key of the certificate of every node it
+is put to, as the node presented it over mutual TLS, so that only that
+node may open it: the nodes keep their secrets sealed in their -state
+directory, and only serve their values over their control socket, to
+"nih secrets get" and "nih secrets exec". A node whose key changes, as
+with "nih cert rotate", cannot open the secrets put to it before, which
+must be put again.
+
+The daemon puts and deletes the secrets of other nodes with its own
+credentials, so it needs a role of their serve -secret-roles flag.
+`,
+	Commands: []*Command{cmdSecretsPut, cmdSecretsList, cmdSecretsGet, cmdSecretsDelete, cmdSecretsExec},
+}
+
+func init() {
+	Register(cmdSecrets)
+}
+
+func secretsControlFlag(fs *flag.FlagSet) {
+	fs.StringVar(&secretsFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+}
+
+// secretsNodeFlags defines the flags of the nodes of a put or delete on
+// fs.
+func secretsNodeFlags(fs *flag.FlagSet) {
+	secretsControlFlag(fs)
+	secretsFlags.nodes = nil
+	fs.Func("node", "Put to the node `name`; may be repeated", func(s string) error {
+		secretsFlags.nodes = append(secretsFlags.nodes, s)
+		return nil
+	})
+	fs.BoolVar(&secretsFlags.all, "all", false, "Put to every node the daemon knows, its own included")
+}
+
+var cmdSecretsPut = &Command{
+	Name:    "put",
+	Args:    "NAME",
+	Summary: "put a secret on nodes",
+	Help: `
+Put seals the secret NAME, read as is from standard input or from
+-value-file, to the nodes of -node, or to every node with -all, and sends
+it to them, in place of the secret of that name they have, if any. Use
+printf rather than echo to leave out a newline:
+
+    printf %s "$TOKEN" | nih secrets put -all api-token
+
+With -file, every node writes the value of the secret to that file, with
+-mode, whenever its daemon starts or the secret changes, and removes it
+once the secret is deleted, so that a process reads it as a file. Put
+prints the outcome on every node, and exits with status 1 unless it
+succeeded on every node.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		secretsNodeFlags(fs)
+		fs.StringVar(&secretsPutFlags.file, "file", "", "Have the nodes write the value to `path`")
+		fs.StringVar(&secretsPutFlags.mode, "mode", "0600", "Permission bits of -file, in octal")
+		fs.StringVar(&secretsPutFlags.valueFile, "value-file", Stdio, "Read the value from `file`")
+	},
+	Run: runSecretsPut,
+}
+
+var cmdSecretsList = &Command{
+	Name:    "list",
+	Summary: "list the secrets of the daemon",
+	Help: `
+List prints the secrets the daemon keeps, without their values: when and
+by whom each was put, and the file the daemon writes it to.
+`,
+	Flags: secretsControlFlag,
+	Run:   runSecretsList,
+}
+
+var cmdSecretsGet = &Command{
+	Name:    "get",
+	Args:    "NAME",
+	Summary: "print the value of a secret",
+	Help: `
+Get prints the value of the secret NAME of the daemon, as is.
+`,
+	Flags: secretsControlFlag,
+	Run:   runSecretsGet,
+}
+
+var cmdSecretsDelete = &Command{
+	Name:    "delete",
+	Args:    "NAME",
+	Summary: "delete a secret from nodes",
+	Help: `
+Delete deletes the secret NAME, and the file it was written to, from the
+nodes of -node, or from every node with -all, as put does.
+`,
+	Flags: secretsNodeFlags,
+	Run:   runSecretsDelete,
+}
+
+var cmdSecretsExec = &Command{
+	Name:    "exec",
+	Args:    "[--] COMMAND [ARG...]",
+	Summary: "run a command with secrets in its environment",
+	Help: `
+Exec runs COMMAND with its arguments, with the secrets of -env added to
+its environment, and exits with its status. -env VAR=NAME sets the
+variable VAR to the value of the secret NAME of the daemon, and -env NAME
+sets the variable of NAME in upper case, with "-" and "." as "_":
+
+    nih secrets exec -env api-token -env DB_PASSWORD=db -- ./server
+`,
+	Flags: func(fs *flag.FlagSet) {
+		secretsControlFlag(fs)
+		secretsExecFlags.env = nil
+		fs.Func("env", "Set `VAR=NAME`, or NAME, to the value of the secret NAME; may be repeated", func(s string) error {
+			secretsExecFlags.env = append(secretsExecFlags.env, s)
+			return nil
+		})
+	},
+	Run: runSecretsExec,
+}
+
+func runSecretsPut(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one NAME")
+	}
+	mode, err := strconv.ParseUint(secretsPutFlags.mode, 8, 32)
+	if err != nil || mode&^0777 != 0 {
+		return Usagef("invalid mode %q", secretsPutFlags.mode)
+	}
+	value, err := ReadFile(secretsPutFlags.valueFile)
+	if err != nil {
+		return err
+	}
+
+	p := daemon.SecretPut{
+		Name:  args[0],
+		Value: value,
+		Nodes: secretsFlags.nodes,
+		All:   secretsFlags.all,
+		File:  secretsPutFlags.file,
+		Mode:  fs.FileMode(mode),
+	}
+	var results secretResults
+	if err := controlDo(ctx, secretsFlags.control, "POST", "/secrets/", &p, &results); err != nil {
+		return err
+	}
+	return results.print()
+}
+
+func runSecretsDelete(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one NAME")
+	}
+
+	del := daemon.SecretDelete{Name: args[0], Nodes: secretsFlags.nodes, All: secretsFlags.all}
+	var results secretResults
+	if err := controlDo(ctx, secretsFlags.control, "POST", "/secrets/delete", &del, &results); err != nil {
+		return err
+	}
+	return results.print()
+}
+
+// secretResults are the outcomes of a put or delete on its nodes.
+type secretResults []daemon.SecretResult
+
+// print prints rs, and fails unless every node succeeded.
+func (rs secretResults) print() error {
+	if Global.Output == output.JSON {
+		if err := Print([]daemon.SecretResult(rs)); err != nil {
+			return err
+		}
+	} else {
+		t := output.NewTable("NODE", "RESULT")
+		for _, r := range rs {
+			result := "ok"
+			if r.Error != "" {
+				result = r.Error
+			}
+			t.Append(r.Node, result)
+		}
+		if err := Print(t); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range rs {
+		if r.Error != "" {
+			return exitStatus(ExitFailure)
+		}
+	}
+	return nil
+}
+
+func runSecretsList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("list takes no arguments")
+	}
+
+	var list []daemon.Secret
+	if err := controlGet(ctx, secretsFlags.control, "/secrets/", &list); err != nil {
+		return err
+	}
+
+	if Global.Output == output.JSON {
+		return Print(list)
+	}
+	t := output.NewTable("NAME", "UPDATED", "FROM", "FILE")
+	for _, s := range list {
+		file := "-"
+		if s.File != "" {
+			file = fmt.Sprintf("%s (%04o)", s.File, s.Mode.Perm())
+		}
+		t.Append(s.Name, s.Updated.Format(time.RFC3339), s.From, file)
+	}
+	return Print(t)
+}
+
+// secretValue returns the value of the secret of name of the daemon.
+func secretValue(ctx context.Context, name string) (*daemon.SecretValue, error) {
+	var v daemon.SecretValue
+	if err := controlGet(ctx, secretsFlags.control, "/secrets/value?"+url.Values{"name": {name}}.Encode(), &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func runSecretsGet(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need one NAME")
+	}
+	v, err := secretValue(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return Print(&secretText{*v})
+}
+
+// secretText is a secret printed as its value.
+type secretText struct {
+	daemon.SecretValue
+}
+
+// WriteText implements output.Texter.
+func (s *secretText) WriteText(w io.Writer) error {
+	_, err := w.Write(s.Value)
+	return err
+}
+
+// secretEnvName returns the name of the environment variable of the
+// secret name.
+func secretEnvName(name string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+func runSecretsExec(ctx context.Context, args []string) error {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return Usagef("need a command")
+	}
+
+	env := os.Environ()
+	for _, e := range secretsExecFlags.env {
+		name, secret, ok := strings.Cut(e, "=")
+		if !ok {
+			name, secret = secretEnvName(e), e
+		}
+		if name == "" || secret == "" {
+			return Usagef("invalid -env %q, want VAR=NAME or NAME", e)
+		}
+		v, err := secretValue(ctx, secret)
+		if err != nil {
+			return err
+		}
+		env = append(env, name+"="+string(v.Value))
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = env
+
+	// On cancellation, give the command a chance to clean up before
+	// killing it.
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = 5 * time.Second
+
+	err := cmd.Run()
+
+	var xerr *exec.ExitError
+	if errors.As(err, &xerr) && xerr.Exited() {
+		// The command has reported its own error.
+		return exitStatus(xerr.ExitCode())
+	}
+	return err
+}
@@ -0,0 +1,343 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"nih.software/cli/ui"
+)
+
+// releaseURL and releaseKey are the defaults of selfupdate -url and
+// -release-key, pinned at build time with
+//
+//	go build -ldflags "-X nih.software/cli.releaseURL=URL -X nih.software/cli.releaseKey=KEY"
+//
+// where KEY is the base64 body of the PUBLIC KEY block of the Ed25519 key
+// that signs releases, as written by "nih keygen -pub".
+var (
+	releaseURL string
+	releaseKey string
+)
+
+// maxReleaseSize bounds the size of a downloaded binary, and
+// maxManifestSize that of its manifest.
+const (
+	maxReleaseSize  = 512 << 20
+	maxManifestSize = 4 << 10
+)
+
+// A releaseManifest describes a release binary, and is what the release
+// key signs, so that a signature binds the binary to its name, and so its
+// platform, and to its version.
+type releaseManifest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+}
+
+var selfupdateFlags struct {
+	url        string
+	releaseKey string
+	out        string
+	dryRun     bool
+}
+
+var cmdSelfupdate = &Command{
+	Name:    "selfupdate",
+	Summary: "replace nih with the latest signed release",
+	Help: `
+Selfupdate downloads the nih binary for this platform from the release
+endpoint of -url, as URL/nih-OS-ARCH, such as URL/nih-linux-amd64, with its
+manifest, URL/nih-linux-amd64.json, and the detached signature of the
+manifest, URL/nih-linux-amd64.json.sig. The manifest names the binary and
+gives its version and SHA-256 hash:
+
+    {"name": "nih-linux-amd64", "version": "v1.4.0", "sha256": "9f86d0..."}
+
+Selfupdate verifies the signature against the pinned release key, checks
+that the manifest is for this platform, that its version is not older than
+that of the running nih, unless nih was built from a working tree, and that
+the binary has its hash. It then replaces the running executable by
+renaming the new binary over it, so that a failed update leaves the old
+binary in place. As the signature binds all of these, an endpoint reached
+over plain HTTP can at most serve a signed release that is not older.
+
+The signature is a raw Ed25519 signature of the manifest, as written by
+"openssl pkeyutl -sign -rawin -inkey KEY -in nih-linux-amd64.json". The
+release key and the default of -url are pinned when nih is built;
+-release-key overrides the key with a PEM PUBLIC KEY file, as written by
+"nih keygen -pub", for testing releases signed by another key.
+
+A running "nih serve" keeps running the old binary; send it SIGUSR2 to
+switch to the new one without refusing connections. With -dry-run,
+selfupdate downloads and verifies the release without installing it, and
+with -out, it writes the release to another file instead.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&selfupdateFlags.url, "url", releaseURL, "Release endpoint `URL`")
+		fs.StringVar(&selfupdateFlags.releaseKey, "release-key", "", "Release public key `file` to verify against instead of the pinned key")
+		fs.StringVar(&selfupdateFlags.out, "out", "", "Write the release to `file` instead of replacing the running executable")
+		fs.BoolVar(&selfupdateFlags.dryRun, "dry-run", false, "Download and verify the release without installing it")
+	},
+	Run: runSelfupdate,
+}
+
+func init() {
+	Register(cmdSelfupdate)
+}
+
+func runSelfupdate(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	if selfupdateFlags.url == "" {
+		return Usagef("no release endpoint: this nih was built without one, so set -url")
+	}
+
+	pub, err := selfupdateKey()
+	if err != nil {
+		return err
+	}
+
+	name := "nih-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	url := strings.TrimSuffix(selfupdateFlags.url, "/") + "/" + name
+
+	s := ui.NewSpinner("downloading " + name)
+	m, err := releaseManifestFor(ctx, url, name, pub)
+	var bin []byte
+	if err == nil {
+		bin, err = download(ctx, url, maxReleaseSize)
+	}
+	s.Stop()
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(bin)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), m.SHA256) {
+		return TrustError(fmt.Errorf("%s: SHA-256 does not match the manifest", url), "The release was altered on the way, or replaced without its manifest.")
+	}
+	r := &selfupdateResult{URL: url, Version: m.Version, SHA256: hex.EncodeToString(sum[:])}
+
+	target := selfupdateFlags.out
+	if target == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if target, err = filepath.EvalSymlinks(exe); err != nil {
+			return err
+		}
+
+		if cur, err := os.ReadFile(target); err == nil && bytes.Equal(cur, bin) {
+			r.Current = true
+			return Print(r)
+		}
+	}
+
+	if selfupdateFlags.dryRun {
+		return Print(r)
+	}
+
+	if err := installExecutable(target, bin); err != nil {
+		return err
+	}
+	r.Installed = target
+
+	return Print(r)
+}
+
+// releaseManifestFor downloads the manifest of the release binary name at
+// url and returns it if pub signed it, it names the binary, and its version
+// is not older than that of the running nih.
+func releaseManifestFor(ctx context.Context, url, name string, pub ed25519.PublicKey) (*releaseManifest, error) {
+	data, err := download(ctx, url+".json", maxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := download(ctx, url+".json.sig", ed25519.SignatureSize)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return nil, TrustError(fmt.Errorf("%s.json: invalid signature", url), "The release was not signed by the release key, or was altered on the way.")
+	}
+
+	var m releaseManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s.json: %w", url, err)
+	}
+
+	if m.Name != name {
+		return nil, TrustError(fmt.Errorf("%s.json: the manifest of %s, not %s", url, m.Name, name), "The release endpoint served the release of another platform.")
+	}
+
+	if !strings.HasPrefix(m.Version, "v") {
+		return nil, fmt.Errorf("%s.json: invalid version %q", url, m.Version)
+	}
+	if cur := buildVersion().Version; strings.HasPrefix(cur, "v") && compareVersions(m.Version[1:], cur[1:]) < 0 {
+		return nil, TrustError(fmt.Errorf("%s: %s is older than the running %s", url, m.Version, cur), "Selfupdate does not downgrade; install an older release by hand.")
+	}
+
+	return &m, nil
+}
+
+// selfupdateKey returns the key releases are verified against.
+func selfupdateKey() (ed25519.PublicKey, error) {
+	var der []byte
+	if selfupdateFlags.releaseKey != "" {
+		data, err := ReadFile(selfupdateFlags.releaseKey)
+		if err != nil {
+			return nil, err
+		}
+
+		blk, _ := pem.Decode(data)
+		if blk == nil || blk.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("%s: no PUBLIC KEY block", describeFile(selfupdateFlags.releaseKey))
+		}
+		der = blk.Bytes
+	} else {
+		if releaseKey == "" {
+			return nil, Usagef("no release key: this nih was built without one, so set -release-key")
+		}
+
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(releaseKey); err != nil {
+			return nil, fmt.Errorf("pinned release key: %w", err)
+		}
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("release key: %w", err)
+	}
+
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("release key: %T is not an Ed25519 key", key)
+	}
+	return pub, nil
+}
+
+// download returns the body of url, which must be at most limit bytes.
+func download(ctx context.Context, url string, limit int64) ([]byte, error) {
+	ctx, cancel := WithTimeout(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, NetworkError(err, "")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, NetworkError(err, "")
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s: larger than %s", url, ui.FormatBytes(limit))
+	}
+
+	return data, nil
+}
+
+// installExecutable replaces the file name with an executable holding data,
+// by renaming a new file over it.
+func installExecutable(name string, data []byte) error {
+	mode := os.FileMode(0755)
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Windows cannot replace a running executable, but can rename it.
+	if runtime.GOOS == "windows" {
+		old := name + ".old"
+		os.Remove(old)
+		if err := os.Rename(name, old); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+type selfupdateResult struct {
+	URL       string `json:"url"`
+	Version   string `json:"version"`
+	SHA256    string `json:"sha256"`
+	Current   bool   `json:"current,omitempty"`
+	Installed string `json:"installed,omitempty"`
+}
+
+// WriteText implements output.Texter.
+func (r *selfupdateResult) WriteText(w io.Writer) error {
+	field := func(name, value string) {
+		fmt.Fprintf(w, "%-17s %s\n", name+":", value)
+	}
+
+	field("release", r.URL)
+	field("version", r.Version)
+	field("sha256", r.SHA256)
+	field("signature", "valid")
+	switch {
+	case r.Current:
+		field("installed", "already up to date")
+	case r.Installed != "":
+		field("installed", r.Installed)
+	default:
+		field("installed", "no (dry run)")
+	}
+
+	return nil
+}
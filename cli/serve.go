@@ -0,0 +1,549 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"nih.software/daemon"
+	"nih.software/gossip"
+	"nih.software/kv"
+	"nih.software/log"
+	"nih.software/peers/mdns"
+	"nih.software/peers/srv"
+	"nih.software/pubsub"
+	"nih.software/raft"
+	"nih.software/trace"
+	"nih.software/trust/join"
+	"nih.software/trust/trustgen"
+)
+
+var serveFlags struct {
+	listen          string
+	control         string
+	shutdownTimeout time.Duration
+	issuerCert      string
+	issuerKey       string
+	db              string
+	tokens          string
+	lifetime        time.Duration
+	execRoles       string
+	fileRoles       string
+	peers           string
+	peerInterval    time.Duration
+	mdns            bool
+	srv             string
+	gossip          bool
+	topics          string
+	kv              bool
+	kvBootstrap     bool
+	kvRoles         string
+	jobRoles        string
+	secretRoles     string
+	configRoles     string
+	traceEndpoint   string
+	traceRatio      float64
+	maxConns        int
+	maxPeerConns    int
+	handshakeRate   float64
+	peerHandshake   float64
+	maxCalls        int
+	maxPeerCalls    int
+	pidFile         string
+	notify          bool
+	background      bool
+}
+
+var cmdServe = &Command{
+	Name:    "serve",
+	Summary: "run the node daemon",
+	Help: `
+Serve runs this instance as a node: it listens on -listen for mutually
+authenticated TLS connections from other instances and serves the
+registered services until interrupted. Local clients such as "nih status"
+reach the same services over the unix-domain socket of -control, which
+only the user running serve, or root, may use. Dashboards and scripts
+holding a certificate of the CA read the state of the node as JSON from
+https://ADDR/api/v1/status, /api/v1/peers, /api/v1/cert, and
+/api/v1/whoami.
+
+On SIGINT or SIGTERM, serve stops accepting connections and waits up to
+-shutdown-timeout for requests in flight. On SIGHUP, or when asked by
+"nih reload", it reloads the credentials of the global -cert, -key, and
+-ca flags for new connections, and keeps the current ones if the new ones
+fail to load.
+
+With -issuer-cert and -issuer-key, the node is also a CA node: it signs
+the certificates of nodes joining with "nih join" and a token from the
+-tokens file, and serves them the global -ca certificates as roots.
+
+Peers holding a role of -exec-roles may run commands on the node with
+"nih exec", and those holding a role of -file-roles may copy files to and
+from it with "nih cp", and sync its directories with "nih sync". Run "nih
+help trust" for roles.
+
+The node probes the nodes of -peers and of the address book in the global
+-state directory every -peer-interval, and reports them, with the peers
+that connect to it, to "nih nodes". With -mdns, it also announces itself
+on the local network by multicast DNS, and probes the nodes it finds
+there likewise: a node found is only reported ok once it presents a
+certificate of the CA for the name it announced. With -srv, it probes the
+nodes of the DNS SRV records of a name, such as _nih._tcp.example.com,
+asking for them again once their time to live is over; each target of
+the records is a node named after its first label. With -gossip, the node
+keeps the membership of the cluster by gossip with the other nodes that
+gossip, joining them through the nodes it probes, and reports every member
+it learns of, alive or not. "nih config" shows the
+settings of the running node and changes those that apply without a restart,
+and "nih logs" prints its recent log entries.
+
+Messages published to a topic with "nih publish" reach the subscribers of
+the topic on this node and on the other nodes it knows, as with "nih
+subscribe". The -topics file, a JSON array of rules such as
+{"topic": "trust.>", "publish": ["role:ca"], "subscribe": ["*"]}, grants
+peers the right to publish and subscribe to the topics of a pattern, by
+"name:NAME" of their certificate, "role:ROLE", or "*" for any; a node
+forwarding messages to this one needs the right to publish them itself.
+Without -topics, only local clients may publish and subscribe.
+
+With -kv, the node keeps a replica of the key-value store of the cluster
+in the -state directory, as "nih kv" reads and changes it. The nodes
+keeping one elect a leader by Raft consensus, which makes every change
+once a majority of them has it, so that the store survives the failure of
+any minority of them. The first node is started once with -kv-bootstrap,
+to start the cluster alone; the others ask the nodes they know as peers
+to add them, until the leader does. Peers holding a role of -kv-roles may
+use the store, and nodes need one to take part in it.
+
+Peers holding a role of -job-roles may submit jobs to the node with "nih
+jobs run", which runs them on the nodes it knows, and the node needs one
+of them for the other nodes to run the commands of its jobs. The node
+submits the jobs of its schedules, as "nih schedule" changes them and
+keeps them in the -state directory, at their times.
+
+The node keeps the secrets put to it with "nih secrets put" in the -state
+directory, sealed to the key of its certificate, and writes those that
+name a file to it. Peers holding a role of -secret-roles may put secrets
+to the node and delete them, and the node needs one of them to put
+secrets to the other nodes; the values of secrets are only read over the
+control socket.
+
+The node applies the configuration bundles pushed with "nih config push",
+and keeps the last ones it applied in the -state directory, changing its
+live settings to theirs whenever it starts, over those of its flags. It
+applies the bundles of the nodes holding a role of -config-roles too, and
+exchanges bundles with the peers holding one, so that a bundle pushed to
+a node reaches every node.
+
+With -trace-endpoint, the node records the spans of the RPC calls it
+makes and serves, and of the connections it dials, and sends them to that
+collector of OpenTelemetry over OTLP/HTTP, such as http://localhost:4318.
+It samples -trace-ratio of the traces it starts, and those of the other
+nodes as they did, which carry their traces in their calls.
+
+So that a misbehaving peer cannot exhaust the node, it closes the
+connections beyond -max-conns open at once, or -max-peer-conns from one
+address, or beyond -handshake-rate a second, or -peer-handshake-rate from
+one address, before their handshake, and fails the RPC calls beyond
+-max-calls in progress, or -max-peer-calls of one peer, as resource
+exhausted. It logs the connections and calls it refuses, and "nih status"
+counts them. Zero means no limit, and "nih config" changes the limits
+while the node runs.
+
+Once serve accepts connections, it writes its process ID to -pid-file, and
+with -notify, tells the service manager at NOTIFY_SOCKET that it is ready,
+so that it runs as a systemd service of Type=notify. With -background,
+serve starts itself in the background, detached from the terminal, and
+exits once the new process is ready; the log of that process is discarded,
+so read it with "nih logs".
+
+On SIGUSR2, serve starts its executable again, which may have been
+replaced by a new version, and hands it the listening sockets. Once the
+new process is ready, the old one shuts down as on SIGTERM, so that the
+upgrade refuses no connections. Under systemd, set NotifyAccess=all for
+the service to follow the new process.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&serveFlags.listen, "listen", daemon.DefaultAddr, "TCP `address` to listen on")
+		fs.StringVar(&serveFlags.control, "control", daemon.DefaultControl, controlFlagUsage+", or empty for none")
+		fs.DurationVar(&serveFlags.shutdownTimeout, "shutdown-timeout", 10*time.Second, "Time to wait for requests in flight when shutting down")
+		fs.StringVar(&serveFlags.issuerCert, "issuer-cert", "", "CA certificate `file` for signing the certificates of joining nodes")
+		fs.StringVar(&serveFlags.issuerKey, "issuer-key", "", "CA private key `file` for signing the certificates of joining nodes")
+		fs.StringVar(&serveFlags.db, "db", "", "Issuance database `file` recording serials and revocations")
+		fs.StringVar(&serveFlags.tokens, "tokens", defaultTokensFile, "Join token `file`")
+		fs.DurationVar(&serveFlags.lifetime, "lifetime", 0, "Lifetime of the certificates of joining nodes\n(default: 1 year)")
+		fs.StringVar(&serveFlags.execRoles, "exec-roles", "", "Comma-separated `roles` allowed to run commands with nih exec")
+		fs.StringVar(&serveFlags.fileRoles, "file-roles", "", "Comma-separated `roles` allowed to copy files with nih cp and nih sync")
+		fs.StringVar(&serveFlags.peers, "peers", "", "Comma-separated `addresses` of other nodes to probe for nih nodes")
+		fs.DurationVar(&serveFlags.peerInterval, "peer-interval", daemon.DefaultPeerInterval, "Time between probes of -peers")
+		fs.BoolVar(&serveFlags.mdns, "mdns", false, "Announce the node and find other nodes on the local network by multicast DNS")
+		fs.StringVar(&serveFlags.srv, "srv", "", "Find other nodes by the DNS SRV records of `name`")
+		fs.BoolVar(&serveFlags.gossip, "gossip", false, "Learn the members of the cluster by gossip with other nodes")
+		fs.StringVar(&serveFlags.topics, "topics", "", "JSON `file` of the rules of who may publish and subscribe to which topics")
+		fs.BoolVar(&serveFlags.kv, "kv", false, "Keep a replica of the key-value store of the cluster")
+		fs.BoolVar(&serveFlags.kvBootstrap, "kv-bootstrap", false, "Start the key-value store of a new cluster on this node alone, implying -kv")
+		fs.StringVar(&serveFlags.kvRoles, "kv-roles", "", "Comma-separated `roles` allowed to use and replicate the key-value store")
+		fs.StringVar(&serveFlags.jobRoles, "job-roles", "", "Comma-separated `roles` allowed to submit and run jobs with nih jobs")
+		fs.StringVar(&serveFlags.secretRoles, "secret-roles", "", "Comma-separated `roles` allowed to put and delete secrets with nih secrets")
+		fs.StringVar(&serveFlags.configRoles, "config-roles", "", "Comma-separated `roles` allowed to push configuration bundles with nih config push")
+		fs.StringVar(&serveFlags.traceEndpoint, "trace-endpoint", "", "Send the spans of traces to the OTLP/HTTP collector at `URL`")
+		fs.Float64Var(&serveFlags.traceRatio, "trace-ratio", 1, "Fraction of the traces started by the node to sample, from 0 to 1")
+		fs.IntVar(&serveFlags.maxConns, "max-conns", 4096, "Most connections open at once")
+		fs.IntVar(&serveFlags.maxPeerConns, "max-peer-conns", 64, "Most connections open at once from one address")
+		fs.Float64Var(&serveFlags.handshakeRate, "handshake-rate", 200, "Most connections accepted a second")
+		fs.Float64Var(&serveFlags.peerHandshake, "peer-handshake-rate", 20, "Most connections accepted a second from one address")
+		fs.IntVar(&serveFlags.maxCalls, "max-calls", 4096, "Most RPC calls in progress at once")
+		fs.IntVar(&serveFlags.maxPeerCalls, "max-peer-calls", 256, "Most RPC calls in progress at once of one peer")
+		fs.StringVar(&serveFlags.pidFile, "pid-file", "", "Write the process ID to `file` once serving")
+		fs.BoolVar(&serveFlags.notify, "notify", true, "Notify the service manager of NOTIFY_SOCKET of readiness, as systemd expects")
+		fs.BoolVar(&serveFlags.background, "background", false, "Start in the background and exit once it serves")
+	},
+	Credentials: true,
+	Run:         runServe,
+}
+
+func init() {
+	Register(cmdServe)
+}
+
+// serveLogEntries is the number of recent log entries the daemon keeps.
+const serveLogEntries = 1000
+
+// Of the log records of a level and message every second, serve writes
+// the first serveLogFirst to standard error, then every
+// serveLogThereafter-th.
+const (
+	serveLogFirst      = 100
+	serveLogThereafter = 100
+)
+
+func runServe(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+	if u, err := url.Parse(serveFlags.traceEndpoint); serveFlags.traceEndpoint != "" && (err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+		return Usagef("invalid -trace-endpoint %q, want an http or https URL", serveFlags.traceEndpoint)
+	}
+	if serveFlags.traceRatio < 0 || serveFlags.traceRatio > 1 {
+		return Usagef("-trace-ratio %v is not between 0 and 1", serveFlags.traceRatio)
+	}
+	if serveFlags.maxConns < 0 || serveFlags.maxPeerConns < 0 || serveFlags.handshakeRate < 0 ||
+		serveFlags.peerHandshake < 0 || serveFlags.maxCalls < 0 || serveFlags.maxPeerCalls < 0 {
+		return Usagef("negative limit; 0 means no limit")
+	}
+
+	inh, err := inheritedFiles()
+	if err != nil {
+		return err
+	}
+
+	if serveFlags.background && inh == nil {
+		return serveBackground()
+	}
+
+	js, err := joinServer()
+	if err != nil {
+		return err
+	}
+
+	book, err := openBook()
+	if err != nil {
+		return err
+	}
+
+	// Keep entries at every level for nih logs, whatever -log-level shows,
+	// and sample those of standard error, which a misbehaving peer could
+	// otherwise flood.
+	logs := log.NewBuffer(serveLogEntries)
+	stderr := log.Sample(log.Default().Handler(), serveLogFirst, serveLogThereafter, time.Second)
+	log.SetDefault(log.Tee(stderr, logs.Handler(log.LevelDebug)))
+
+	cfg := daemon.Config{
+		Addr:            serveFlags.listen,
+		Control:         serveFlags.control,
+		Credentials:     loadCredentials,
+		ShutdownTimeout: serveFlags.shutdownTimeout,
+		Book:            book,
+		PeerInterval:    serveFlags.peerInterval,
+		Logs:            logs,
+
+		MaxConns:          serveFlags.maxConns,
+		MaxPeerConns:      serveFlags.maxPeerConns,
+		HandshakeRate:     serveFlags.handshakeRate,
+		PeerHandshakeRate: serveFlags.peerHandshake,
+		MaxCalls:          serveFlags.maxCalls,
+		MaxPeerCalls:      serveFlags.maxPeerCalls,
+
+		Ready: func() {
+			if serveFlags.pidFile != "" {
+				if err := writePidFile(serveFlags.pidFile); err != nil {
+					log.Default().Error("serve: write pid file", "err", err)
+				}
+			}
+			if inh != nil && inh.ready != nil {
+				inh.ready.Write([]byte{1})
+				inh.ready.Close()
+			}
+			notify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()))
+		},
+	}
+	if serveFlags.execRoles != "" {
+		cfg.ExecRoles = strings.Split(serveFlags.execRoles, ",")
+	}
+	if serveFlags.fileRoles != "" {
+		cfg.FileRoles = strings.Split(serveFlags.fileRoles, ",")
+	}
+	if serveFlags.peers != "" {
+		for _, addr := range strings.Split(serveFlags.peers, ",") {
+			cfg.Peers = append(cfg.Peers, withDefaultPort(addr))
+		}
+	}
+	if js != nil {
+		cfg.Join = js
+	}
+	if serveFlags.topics != "" {
+		if cfg.Topics, err = pubsub.LoadPolicy(serveFlags.topics); err != nil {
+			return err
+		}
+	}
+	if serveFlags.kv || serveFlags.kvBootstrap {
+		cfg.KV = &kv.Config{Raft: raft.Config{Dir: filepath.Join(Global.StateDir, kv.DefaultDir), Bootstrap: serveFlags.kvBootstrap}}
+	}
+	if serveFlags.kvRoles != "" {
+		cfg.KVRoles = strings.Split(serveFlags.kvRoles, ",")
+	}
+	if serveFlags.jobRoles != "" {
+		cfg.JobRoles = strings.Split(serveFlags.jobRoles, ",")
+	}
+	if serveFlags.secretRoles != "" {
+		cfg.SecretRoles = strings.Split(serveFlags.secretRoles, ",")
+	}
+	if serveFlags.configRoles != "" {
+		cfg.ConfigRoles = strings.Split(serveFlags.configRoles, ",")
+	}
+	cfg.Bundles = filepath.Join(Global.StateDir, daemon.DefaultBundlesFile)
+	cfg.Schedules = filepath.Join(Global.StateDir, daemon.DefaultSchedulesFile)
+	cfg.Secrets = filepath.Join(Global.StateDir, daemon.DefaultSecretsFile)
+	if serveFlags.mdns {
+		cfg.Finders = append(cfg.Finders, &mdns.Browser{})
+	}
+	if serveFlags.srv != "" {
+		cfg.Finders = append(cfg.Finders, &srv.Finder{Name: serveFlags.srv})
+	}
+	if serveFlags.gossip {
+		cfg.Gossip = &gossip.Config{}
+	}
+
+	d, err := daemon.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	if serveFlags.traceEndpoint != "" {
+		otlp := &trace.OTLP{
+			Endpoint: serveFlags.traceEndpoint,
+			Service:  "nih",
+			Instance: d.Bundle().Chain()[0].Subject.CommonName,
+			Client:   &http.Client{Timeout: Global.Timeout},
+		}
+		trace.SetDefault(&trace.Tracer{Exporter: otlp, Ratio: serveFlags.traceRatio})
+
+		// Send the spans left once the daemon stopped.
+		tctx, stopTrace := context.WithCancel(context.WithoutCancel(ctx))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			otlp.Run(tctx)
+		}()
+		defer func() {
+			stopTrace()
+			<-done
+		}()
+	}
+
+	ln, control, err := serveListeners(ctx, inh)
+	if err != nil {
+		return err
+	}
+
+	sctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	if serveFlags.mdns {
+		r := &mdns.Responder{
+			Name: d.Bundle().Chain()[0].Subject.CommonName,
+			Port: ln.Addr().(*net.TCPAddr).Port,
+		}
+		go func() {
+			if err := r.Serve(sctx); err != nil {
+				log.Default().Error("serve: mdns", "err", err)
+			}
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	if upgradeSignal != nil {
+		signal.Notify(sigs, upgradeSignal)
+	}
+	defer signal.Stop(sigs)
+
+	var upgraded atomic.Bool
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if sig == syscall.SIGHUP {
+					notify("RELOADING=1")
+					d.Reload()
+					notify("READY=1")
+					continue
+				}
+
+				p, err := upgrade(ln, control)
+				if err != nil {
+					log.Default().Error("serve: upgrade", "err", err)
+					continue
+				}
+
+				log.Default().Info("serve: upgraded", "pid", p.Pid)
+				notify("MAINPID=" + strconv.Itoa(p.Pid))
+				upgraded.Store(true)
+				stop()
+			case <-sctx.Done():
+				if !upgraded.Load() {
+					notify("STOPPING=1")
+				}
+				return
+			}
+		}
+	}()
+
+	err = d.ServeListeners(sctx, ln, control)
+	if serveFlags.pidFile != "" {
+		removePidFile(serveFlags.pidFile)
+	}
+	return err
+}
+
+// upgrade starts serve again from its executable, handing it ln and control,
+// so that connections keep being accepted while this process shuts down.
+func upgrade(ln, control net.Listener) (*os.Process, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+
+	var (
+		files []*os.File
+		names []string
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range []struct {
+		name string
+		ln   net.Listener
+	}{{"listen", ln}, {"control", control}} {
+		if l.ln == nil {
+			continue
+		}
+
+		f, err := l.ln.(filer).File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		names = append(names, l.name)
+	}
+
+	p, err := startServe(files, names, func(cmd *exec.Cmd) {
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is the new process's now.
+	if u, ok := control.(*net.UnixListener); ok {
+		u.SetUnlinkOnClose(false)
+	}
+
+	return p, nil
+}
+
+// serveBackground starts serve again in the background and returns
+// once it is ready.
+func serveBackground() error {
+	p, err := startServe(nil, nil, detach)
+	if err != nil {
+		return &Error{Code: ExitFailure, Err: err, Hint: "Run serve without -background to see its errors."}
+	}
+	defer p.Release()
+
+	return Print(&serveBackgroundResult{PID: p.Pid})
+}
+
+type serveBackgroundResult struct {
+	PID int `json:"pid"`
+}
+
+// WriteText implements output.Texter.
+func (r *serveBackgroundResult) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "serving in the background as process %d\n", r.PID)
+	return err
+}
+
+// joinServer returns the server for joining nodes configured by the flags,
+// or nil if the node is not a CA node.
+func joinServer() (*join.Server, error) {
+	if serveFlags.issuerCert == "" && serveFlags.issuerKey == "" {
+		return nil, nil
+	}
+
+	if serveFlags.issuerCert == "" || serveFlags.issuerKey == "" {
+		return nil, Usagef("-issuer-cert and -issuer-key must be used together")
+	}
+
+	var opts []trustgen.Option
+	if serveFlags.db != "" {
+		db, err := trustgen.OpenDB(serveFlags.db)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, trustgen.WithDB(db))
+	}
+
+	g := generator{issuerCert: serveFlags.issuerCert, issuerKey: serveFlags.issuerKey}
+	ca, err := g.loadCA(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := loadRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := join.OpenStore(serveFlags.tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return &join.Server{CA: ca, Roots: roots, Tokens: tokens, Lifetime: serveFlags.lifetime}, nil
+}
@@ -0,0 +1,160 @@
+//go:build unix
+
+package cli_test
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"nih.software/cli/clitest"
+)
+
+// notifySocket listens like a service manager on a datagram socket in dir and
+// returns its path and a function returning the next state sent to it.
+func notifySocket(t *testing.T, dir string) (string, func() string) {
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return path, func() string {
+		t.Helper()
+
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+}
+
+// readPid returns the process ID in the pid file name.
+func readPid(t *testing.T, name string) int {
+	t.Helper()
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("pid file %q", data)
+	}
+	return pid
+}
+
+// waitRemoved waits for the file name to be removed.
+func waitRemoved(t *testing.T, name string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return
+		}
+	}
+	t.Fatalf("%s was not removed", name)
+}
+
+func TestServeBackground(t *testing.T) {
+	dir := clitest.Credentials(t)
+	pidFile := filepath.Join(dir, "nih.pid")
+	sock, next := notifySocket(t, dir)
+
+	res := clitest.Run(t, clitest.Cmd{
+		Dir:  dir,
+		Args: []string{"-o", "json", "serve", "-background", "-listen", freeAddr(t), "-pid-file", pidFile},
+		Env:  []string{"NOTIFY_SOCKET=" + sock},
+	})
+	if res.ExitCode != 0 {
+		t.Fatalf("exit code %d\n%s", res.ExitCode, res.Stderr)
+	}
+
+	var result struct{ PID int }
+	if err := json.Unmarshal([]byte(res.Stdout), &result); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Kill(result.PID, syscall.SIGKILL) })
+
+	if pid := readPid(t, pidFile); pid != result.PID {
+		t.Fatalf("pid file holds %d, want %d", pid, result.PID)
+	}
+	if state, want := next(), "READY=1\nMAINPID="+strconv.Itoa(result.PID); state != want {
+		t.Errorf("notified %q, want %q", state, want)
+	}
+
+	res = clitest.Run(t, clitest.Cmd{Dir: dir, Args: []string{"status"}})
+	if res.ExitCode != 0 {
+		t.Fatalf("status: exit code %d\n%s", res.ExitCode, res.Stderr)
+	}
+
+	syscall.Kill(result.PID, syscall.SIGTERM)
+	if state := next(); state != "STOPPING=1" {
+		t.Errorf("notified %q, want STOPPING=1", state)
+	}
+	waitRemoved(t, pidFile)
+}
+
+func TestServeUpgrade(t *testing.T) {
+	dir := clitest.Credentials(t)
+	pidFile := filepath.Join(dir, "nih.pid")
+	sock, next := notifySocket(t, dir)
+
+	p := clitest.Start(t, clitest.Cmd{
+		Dir:  dir,
+		Args: []string{"-log-level", "info", "serve", "-listen", freeAddr(t), "-pid-file", pidFile},
+		Env:  []string{"NOTIFY_SOCKET=" + sock},
+	})
+
+	state := next()
+	old, err := strconv.Atoi(strings.TrimPrefix(state, "READY=1\nMAINPID="))
+	if err != nil {
+		t.Fatalf("notified %q", state)
+	}
+
+	syscall.Kill(old, syscall.SIGUSR2)
+
+	// The new process is ready, then the old one hands over, in either order.
+	var states []string
+	for range 2 {
+		states = append(states, next())
+	}
+
+	pid := readPid(t, pidFile)
+	if pid == old {
+		t.Fatal("pid file still holds the old process")
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+
+	for _, want := range []string{"READY=1\nMAINPID=" + strconv.Itoa(pid), "MAINPID=" + strconv.Itoa(pid)} {
+		if !slices.Contains(states, want) {
+			t.Errorf("notified %q, want %q", states, want)
+		}
+	}
+
+	res := clitest.Run(t, clitest.Cmd{Dir: dir, Args: []string{"status"}})
+	if res.ExitCode != 0 {
+		t.Fatalf("status after upgrade: exit code %d\n%s", res.ExitCode, res.Stderr)
+	}
+
+	// The new process shares the output of the old one, which is only
+	// complete once both exit.
+	syscall.Kill(pid, syscall.SIGTERM)
+	waitRemoved(t, pidFile)
+
+	res = p.Wait()
+	if res.ExitCode != 0 || !strings.Contains(res.Stderr, "serve: upgraded") {
+		t.Errorf("old process: exit code %d\n%s", res.ExitCode, res.Stderr)
+	}
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/daemon"
+)
+
+var statusFlags struct {
+	control string
+}
+
+var cmdStatus = &Command{
+	Name:    "status",
+	Summary: "show the state of the running daemon",
+	Help: `
+Status asks the daemon started by "nih serve" for its state, over the
+control socket of -control: how long it has been running, the addresses
+it listens on, when its leaf certificate expires, how many connections
+from peers are open, and its most recent errors.
+
+The control socket is only accessible to the user running the daemon,
+so status needs no credentials.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&statusFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+	},
+	Run: runStatus,
+}
+
+func init() {
+	Register(cmdStatus)
+}
+
+func runStatus(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	var s daemon.Status
+	if err := controlGet(ctx, statusFlags.control, "/admin/status", &s); err != nil {
+		return err
+	}
+
+	return Print(&statusResult{&s, time.Now()})
+}
+
+type statusResult struct {
+	*daemon.Status
+	now time.Time
+}
+
+// WriteText implements output.Texter.
+func (r *statusResult) WriteText(w io.Writer) error {
+	field := func(name, value string) {
+		fmt.Fprintf(w, "%-17s %s\n", name+":", value)
+	}
+
+	field("addr", r.Addr)
+	field("control", r.Control)
+	field("started", r.Started.Format(time.RFC3339)+" (up "+time.Duration(r.Uptime).String()+")")
+	field("serial", r.Serial)
+	field("not after", r.NotAfter.Format(time.RFC3339)+" ("+validity(r.now, time.Time{}, r.NotAfter)+")")
+	field("peers", strconv.FormatInt(r.Peers, 10))
+	field("clock skew", formatSkew(r.ClockSkew))
+	field("services", strings.Join(r.Services, ", "))
+	field("methods", strings.Join(r.Methods, ", "))
+	field("protocols", strings.Join(r.Protocols, ", "))
+	field("refused", plural(int(r.RefusedConns), "connection")+", "+plural(int(r.RefusedCalls), "call"))
+
+	if len(r.Errors) == 0 {
+		field("errors", "none")
+		return nil
+	}
+
+	field("errors", strconv.Itoa(len(r.Errors))+" recent")
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "  %s  %s\n", e.Time.Format(time.RFC3339), e.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package cli
+
+import "strings"
+
+// suggest returns the full path of the command most likely meant by the
+// unknown last element of args, such as "nih status" for ["stauts"],
+// or "" if nothing is close enough.
+func suggest(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+
+	cs, path := commands, "nih"
+	if parents := args[:len(args)-1]; len(parents) > 0 {
+		parent, p := lookupPath(parents)
+		if parent == nil {
+			return ""
+		}
+		cs, path = parent.Commands, p
+	}
+
+	typed := args[len(args)-1]
+	best, bestDist := "", max(2, len(typed)/3)+1
+	for _, c := range cs {
+		for _, name := range append([]string{c.Name}, c.Aliases...) {
+			d := editDistance(typed, name)
+			if strings.HasPrefix(name, typed) {
+				d = min(d, 1)
+			}
+			if d < bestDist {
+				best, bestDist = c.Name, d
+			}
+		}
+	}
+
+	if best == "" {
+		return ""
+	}
+	return path + " " + best
+}
+
+// editDistance returns the Damerau–Levenshtein distance between a and b,
+// counting an adjacent transposition as a single edit.
+func editDistance(a, b string) int {
+	// d[i][j] is the distance between a[:i] and b[:j].
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+
+	return d[len(a)][len(b)]
+}
@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/daemon"
+	"nih.software/log"
+)
+
+// envInherit describes the files a serve process inherits from the process
+// that started it, for a background start or an upgrade, such as
+// "listen:3,control:4,ready:5". The ready file is a pipe on which the
+// process writes a byte once it accepts connections.
+const envInherit = "NIH_INHERIT"
+
+// readyTimeout bounds how long serve waits for a process it started to be ready.
+const readyTimeout = 30 * time.Second
+
+// inherited are the files of envInherit.
+type inherited struct {
+	listen  net.Listener
+	control net.Listener
+	ready   *os.File
+}
+
+// inheritedFiles returns the files of envInherit, or nil if it is unset.
+// It unsets the variable, so that commands run by the daemon do not see it.
+func inheritedFiles() (*inherited, error) {
+	v, ok := os.LookupEnv(envInherit)
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv(envInherit)
+
+	var inh inherited
+	for _, kv := range strings.Split(v, ",") {
+		name, fd, _ := strings.Cut(kv, ":")
+		n, err := strconv.Atoi(fd)
+		if err != nil || n < 3 {
+			return nil, fmt.Errorf("%s: invalid file descriptor %q", envInherit, fd)
+		}
+
+		f := os.NewFile(uintptr(n), name)
+		switch name {
+		case "listen", "control":
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", envInherit, name, err)
+			}
+			if name == "listen" {
+				inh.listen = ln
+			} else {
+				inh.control = ln
+			}
+		case "ready":
+			inh.ready = f
+		default:
+			return nil, fmt.Errorf("%s: unknown file %q", envInherit, name)
+		}
+	}
+
+	return &inh, nil
+}
+
+// serveListeners returns the listeners of serve: those inherited, if any,
+// and new ones otherwise.
+func serveListeners(ctx context.Context, inh *inherited) (ln, control net.Listener, err error) {
+	if inh != nil && inh.listen != nil {
+		return inh.listen, inh.control, nil
+	}
+
+	var lc net.ListenConfig
+	if ln, err = lc.Listen(ctx, "tcp", serveFlags.listen); err != nil {
+		return nil, nil, err
+	}
+
+	if serveFlags.control == "" {
+		return ln, nil, nil
+	}
+
+	c, err := daemon.ListenControl(ctx, serveFlags.control)
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	return ln, c, nil
+}
+
+// startServe starts serve again from the executable, which may have been
+// replaced since this process started, with the same arguments, handing it
+// files as described by envInherit, with the ready pipe added. It waits
+// until the new process is ready and returns it.
+func startServe(files []*os.File, names []string, setup func(*exec.Cmd)) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	files = append(files, w)
+	names = append(names, "ready")
+
+	var desc []string
+	for i, name := range names {
+		desc = append(desc, name+":"+strconv.Itoa(3+i))
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envInherit+"="+strings.Join(desc, ","))
+	cmd.ExtraFiles = files
+	setup(cmd)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.SetReadDeadline(time.Now().Add(readyTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("the new process exited before it was ready")
+		}
+		return nil, fmt.Errorf("the new process was not ready: %w", err)
+	}
+
+	return cmd.Process, nil
+}
+
+// writePidFile writes the ID of this process to name.
+func writePidFile(name string) error {
+	return writeFileAtomic(name, []byte(strconv.Itoa(os.Getpid())+"\n"))
+}
+
+// removePidFile removes name if it still holds the ID of this process,
+// rather than that of a process that took over.
+func removePidFile(name string) {
+	data, err := os.ReadFile(name)
+	if err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(name)
+	}
+}
+
+// notify sends state to the service manager listening on NOTIFY_SOCKET,
+// as sd_notify(3) does, unless -notify is off or the variable is unset.
+func notify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if !serveFlags.notify || path == "" {
+		return
+	}
+
+	// A leading @ is an abstract socket, which net handles.
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		log.Default().Warn("serve: notify", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Default().Warn("serve: notify", "err", err)
+	}
+}
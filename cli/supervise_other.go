@@ -0,0 +1,13 @@
+//go:build !unix
+
+package cli
+
+import (
+	"os"
+	"os/exec"
+)
+
+// upgradeSignal is nil: there is no signal to upgrade serve.
+var upgradeSignal os.Signal
+
+func detach(cmd *exec.Cmd) {}
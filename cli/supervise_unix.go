@@ -0,0 +1,17 @@
+//go:build unix
+
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// upgradeSignal asks serve to start again from its executable.
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// detach starts cmd in a session of its own, apart from the terminal.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,281 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"nih.software/cli/output"
+	"nih.software/cli/ui"
+	"nih.software/daemon"
+	"nih.software/filesync"
+)
+
+var syncFlags struct {
+	delete   bool
+	conflict string
+	include  []string
+	exclude  []string
+	dryRun   bool
+}
+
+var cmdSync = &Command{
+	Name:    "sync",
+	Args:    "SRC NODE:DST...",
+	Summary: "make directories of nodes match a local one",
+	Help: `
+Sync makes the directory DST on every node match the local directory SRC,
+over a mutually authenticated TLS connection made with the global
+credentials, as nih cp does, so that the same tree of configuration or
+assets is distributed to a fleet:
+
+    nih sync ./conf node1:/etc/app node2:/etc/app
+    nih sync -delete -exclude '*.log' ./site web1:/srv/site
+
+Files are compared by their SHA-256, and only those that differ are sent;
+of those, the blocks of 64 KiB the node has in the version it replaces are
+copied there rather than sent. Every file is received into a partial file
+and only renamed over DST once its SHA-256 matches that of SRC. Only
+regular files and directories are synced, with their permission bits.
+With -delete, the files and directories of DST that SRC does not have are
+deleted.
+
+-include and -exclude select the files to sync by patterns of
+path.Match, matched against the slash-separated path of a file relative
+to SRC or DST, or against its name for a pattern without a slash. With
+-include, only the files matching one of its patterns are synced; with
+-exclude, the files and directories matching one of its patterns, and
+everything under them, are not. Both may be repeated, and the files they
+leave out are neither changed nor deleted in DST.
+
+The node records the SHA-256 of the files it synced in the file .nihsync
+of DST. A file of DST that is not as the last sync left it, such as one
+changed by hand, is a conflict, which -conflict settles: skip leaves the
+file as it is, overwrite replaces or deletes it, and backup renames it to
+its name with the suffix .nihconflict first. A file where SRC has a
+directory, or the other way round, is always skipped. Sync exits with
+status 1 if it skipped a conflict. With -dry-run, sync prints the changes
+it would make without making them.
+
+The node only accepts peers whose certificate holds one of the roles of
+its serve -file-roles flag, and sync fails with status 3 otherwise.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		syncFlags.include = nil
+		syncFlags.exclude = nil
+		fs.BoolVar(&syncFlags.delete, "delete", false, "Delete the files of DST that SRC does not have")
+		fs.StringVar(&syncFlags.conflict, "conflict", string(filesync.Skip), "Settle the conflicts by `policy`: skip, overwrite, or backup")
+		fs.Func("include", "Sync only the files matching `pattern`; may be repeated", func(s string) error {
+			syncFlags.include = append(syncFlags.include, s)
+			return nil
+		})
+		fs.Func("exclude", "Do not sync the files matching `pattern`; may be repeated", func(s string) error {
+			syncFlags.exclude = append(syncFlags.exclude, s)
+			return nil
+		})
+		fs.BoolVar(&syncFlags.dryRun, "dry-run", false, "Print the changes without making them")
+	},
+	Credentials: true,
+	Run:         runSync,
+}
+
+func init() {
+	Register(cmdSync)
+}
+
+func runSync(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return Usagef("need a source and a destination")
+	}
+	if _, remote := parseRemote(args[0]); remote {
+		return Usagef("need a local source, not %s", args[0])
+	}
+	var dsts []*remotePath
+	for _, arg := range args[1:] {
+		dst, remote := parseRemote(arg)
+		if !remote {
+			return Usagef("need a destination on a node, written NODE:PATH, not %s", arg)
+		}
+		dsts = append(dsts, dst)
+	}
+
+	policy, err := filesync.ParsePolicy(syncFlags.conflict)
+	if err != nil {
+		return Usagef("%v", err)
+	}
+	rules := filesync.Rules{Include: syncFlags.include, Exclude: syncFlags.exclude}
+	if err := rules.Check(); err != nil {
+		return Usagef("%v", err)
+	}
+
+	if fi, err := os.Stat(args[0]); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return Usagef("%s is not a directory", args[0])
+	}
+	src, err := filesync.Scan(args[0], rules, false)
+	if err != nil {
+		return err
+	}
+
+	var results syncResults
+	var first error
+	for _, dst := range dsts {
+		r, err := syncTo(ctx, args[0], src, dst, rules, policy)
+		if err != nil {
+			if len(dsts) == 1 {
+				return err
+			}
+			ui.Warn("%s:%s: %v", dst.node, dst.path, err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		results = append(results, r)
+	}
+
+	if err := Print(results); err != nil {
+		return err
+	}
+	if first != nil {
+		return exitStatus(ExitCode(first))
+	}
+	for _, r := range results {
+		if len(r.Stats.Conflicts) > 0 && !syncFlags.dryRun {
+			return exitStatus(ExitFailure)
+		}
+	}
+	return nil
+}
+
+// syncResult is the outcome of the sync of a destination.
+type syncResult struct {
+	Dst   string          `json:"dst"`
+	Stats *filesync.Stats `json:"stats"`
+
+	// Changes are the changes of a dry run.
+	Changes []filesync.Change `json:"changes,omitempty"`
+}
+
+type syncResults []*syncResult
+
+// WriteText implements output.Texter.
+func (rs syncResults) WriteText(w io.Writer) error {
+	if syncFlags.dryRun {
+		for _, r := range rs {
+			for _, c := range r.Changes {
+				conflict := ""
+				if c.Conflict != "" {
+					conflict = " (conflict: " + string(c.Conflict) + ")"
+				}
+				fmt.Fprintf(w, "%s %s %s%s\n", r.Dst, c.Op, c.Path, conflict)
+			}
+		}
+		return nil
+	}
+
+	t := output.NewTable("DST", "DIRS", "FILES", "DELETED", "SENT", "REUSED", "CONFLICTS")
+	for _, r := range rs {
+		st := r.Stats
+		t.Append(r.Dst, strconv.Itoa(st.Dirs), strconv.Itoa(st.Files), strconv.Itoa(st.Deleted),
+			ui.FormatBytes(st.Sent), ui.FormatBytes(st.Reused), strconv.Itoa(len(st.Conflicts)))
+	}
+	if err := t.WriteText(w); err != nil {
+		return err
+	}
+	for _, r := range rs {
+		for _, p := range r.Stats.Conflicts {
+			fmt.Fprintf(w, "%s: conflict skipped: %s\n", r.Dst, p)
+		}
+	}
+	return nil
+}
+
+// syncTo syncs the local directory root, of the manifest src, to dst.
+func syncTo(ctx context.Context, root string, src *filesync.Manifest, dst *remotePath, rules filesync.Rules, policy filesync.Policy) (*syncResult, error) {
+	fc, err := newFilesClient(dst.node)
+	if err != nil {
+		return nil, err
+	}
+	defer fc.c.CloseIdleConnections()
+	r := &syncResult{Dst: fc.addr + ":" + dst.path}
+
+	body, err := json.Marshal(&daemon.SyncRequest{Path: dst.path, Rules: rules})
+	if err != nil {
+		return nil, err
+	}
+	var m filesync.Manifest
+	if err := fc.syncCall(ctx, "manifest", nil, bytes.NewReader(body), &m); err != nil {
+		return nil, err
+	}
+
+	changes := filesync.Plan(src, &m, syncFlags.delete)
+	if syncFlags.dryRun {
+		r.Changes = changes
+		r.Stats = &filesync.Stats{}
+		for _, c := range changes {
+			if c.Conflict == filesync.Kind || c.Conflict == filesync.Changed && policy == filesync.Skip {
+				r.Stats.Conflicts = append(r.Stats.Conflicts, c.Path)
+			}
+		}
+		return r, nil
+	}
+
+	// The frames are sent as they are made, while the node applies them.
+	pr, pw := io.Pipe()
+	sent := make(chan error, 1)
+	go func() {
+		enc := json.NewEncoder(pw)
+		st, err := filesync.Send(root, src, &m, changes, policy, func(f *filesync.Frame) error {
+			return enc.Encode(f)
+		})
+		r.Stats = st
+		pw.CloseWithError(err)
+		sent <- err
+	}()
+
+	err = fc.syncCall(ctx, "apply", url.Values{"path": {dst.path}}, pr, nil)
+	pr.Close()
+	if serr := <-sent; err == nil && serr != nil && !errors.Is(serr, io.ErrClosedPipe) {
+		err = serr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// syncCall sends a request with body to endpoint of the sync service, and
+// decodes the JSON response into v, if v is not nil.
+func (fc *filesClient) syncCall(ctx context.Context, endpoint string, q url.Values, body io.Reader, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", "https://"+fc.addr+"/sync/"+endpoint+"?"+q.Encode(), body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := fc.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		return TrustError(fmt.Errorf("%s: %s", fc.addr, responseMessage(resp)),
+			"Use credentials with a role the node allows in serve -file-roles.")
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%s: %s", fc.addr, responseMessage(resp))
+	case v == nil:
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,225 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/trust"
+	"nih.software/trust/join"
+)
+
+// defaultTokensFile is where a CA node keeps its join tokens.
+const defaultTokensFile = "etc/ca/tokens.json"
+
+var tokenFlags struct {
+	tokens string
+	name   string
+	ttl    time.Duration
+	all    bool
+}
+
+var cmdToken = &Command{
+	Name:    "token",
+	Summary: "manage join tokens on a CA node",
+	Help: `
+Token manages the join tokens with which new nodes enroll by "nih join".
+Every token can be used once, expires after its time to live, and may be
+bound to the common name the joining node must request.
+
+The tokens are kept in the -tokens file of the CA node, which "nih serve"
+reads on every join, so changes apply to the running daemon at once.
+Only a hash of each token's secret is kept: a token is shown once, when
+it is created.
+`,
+	Commands: []*Command{cmdTokenCreate, cmdTokenList, cmdTokenRevoke},
+}
+
+func init() {
+	Register(cmdToken)
+}
+
+func tokensFlag(fs *flag.FlagSet) {
+	fs.StringVar(&tokenFlags.tokens, "tokens", defaultTokensFile, "Join token `file`")
+}
+
+var cmdTokenCreate = &Command{
+	Name:    "create",
+	Summary: "create a join token",
+	Help: `
+Create adds a join token and prints it. The token ends with a pin of the
+root certificate of the CA node's chain, among the global -ca certificates,
+with which the joining node authenticates the CA node.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		tokensFlag(fs)
+		fs.StringVar(&tokenFlags.name, "name", "", "Common `name` the joining node must request\n(default: any)")
+		fs.DurationVar(&tokenFlags.ttl, "ttl", 24*time.Hour, "Time until the token expires")
+	},
+	Run: runTokenCreate,
+}
+
+var cmdTokenList = &Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Summary: "list join tokens",
+	Help: `
+List prints the join tokens that can still be used, or with -all every token
+ever created, with its state: valid, used, expired, or revoked.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		tokensFlag(fs)
+		fs.BoolVar(&tokenFlags.all, "all", false, "Also list used, expired, and revoked tokens")
+	},
+	Run: runTokenList,
+}
+
+var cmdTokenRevoke = &Command{
+	Name:    "revoke",
+	Args:    "ID...",
+	Summary: "revoke join tokens",
+	Help: `
+Revoke makes the tokens with the given IDs, as printed by "nih token list",
+unusable. Nodes that already joined with them keep their certificates.
+`,
+	Flags: tokensFlag,
+	Run:   runTokenRevoke,
+}
+
+func runTokenCreate(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	if tokenFlags.ttl <= 0 {
+		return Usagef("-ttl must be positive")
+	}
+
+	root, err := pinnedRoot()
+	if err != nil {
+		return err
+	}
+
+	tokens, err := join.OpenStore(tokenFlags.tokens)
+	if err != nil {
+		return err
+	}
+
+	token, err := tokens.Create(tokenFlags.name, tokenFlags.ttl)
+	if err != nil {
+		return err
+	}
+
+	return Print(&tokenResult{Token: join.Token(token, root), Expires: time.Now().Add(tokenFlags.ttl).UTC().Truncate(time.Second)})
+}
+
+// pinnedRoot returns the root among the global -ca certificates
+// that the global -cert chain leads to.
+func pinnedRoot() (*x509.Certificate, error) {
+	data, err := ReadFile(Global.CertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := trust.ParseCertificatesPEM(data)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := loadRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range roots {
+		if trust.VerifyChain(chain, []*x509.Certificate{r}) == nil {
+			return r, nil
+		}
+	}
+
+	return nil, TrustError(fmt.Errorf("%s does not lead to a root in %s", Global.CertFile, Global.CAFile),
+		"Run \"nih cert inspect\" to check the chain of this node.")
+}
+
+type tokenResult struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// WriteText implements output.Texter.
+func (r *tokenResult) WriteText(w io.Writer) error {
+	_, err := fmt.Fprintln(w, r.Token)
+	return err
+}
+
+func runTokenList(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	tokens, err := join.OpenStore(tokenFlags.tokens)
+	if err != nil {
+		return err
+	}
+
+	recs, err := tokens.Records()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	t := output.NewTable("ID", "NAME", "CREATED", "EXPIRES", "STATE")
+	for _, rec := range recs {
+		if !tokenFlags.all && !rec.Valid(now) {
+			continue
+		}
+
+		name := rec.Name
+		if name == "" {
+			name = "*"
+		}
+
+		t.Append(rec.ID, name, rec.Created.Format(time.RFC3339), rec.Expires.Format(time.RFC3339), tokenState(rec, now))
+	}
+
+	return Print(t)
+}
+
+func tokenState(rec *join.Record, now time.Time) string {
+	switch {
+	case rec.Revoked():
+		return "revoked"
+	case rec.Used():
+		return "used"
+	case !now.Before(rec.Expires):
+		return "expired"
+	default:
+		return "valid"
+	}
+}
+
+func runTokenRevoke(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return Usagef("need at least one token ID")
+	}
+
+	tokens, err := join.OpenStore(tokenFlags.tokens)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range args {
+		if err := tokens.Revoke(id); errors.Is(err, join.ErrTokenNotFound) {
+			return fmt.Errorf("%s: no such token", id)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
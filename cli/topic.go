@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"sort"
+
+	_ "embed"
+)
+
+// A Topic is a help topic that is not a command, such as "bootstrap",
+// printed by "nih help TOPIC".
+type Topic struct {
+	// Name is the name of the topic, as typed by the user.
+	Name string
+
+	// Summary is a one-line description of the topic.
+	Summary string
+
+	// Text is the full text of the topic.
+	Text string
+}
+
+var topics []*Topic
+
+// RegisterTopic adds a help topic.
+// It panics if the name is already taken by a topic or a command.
+func RegisterTopic(t *Topic) {
+	if LookupTopic(t.Name) != nil || Lookup(t.Name) != nil {
+		panic("cli: duplicate help topic " + t.Name)
+	}
+
+	topics = append(topics, t)
+}
+
+// LookupTopic returns the help topic with the given name, or nil if there is none.
+func LookupTopic(name string) *Topic {
+	for _, t := range topics {
+		if t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// Topics returns the help topics in name order.
+func Topics() []*Topic {
+	ts := append([]*Topic(nil), topics...)
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].Name < ts[j].Name
+	})
+
+	return ts
+}
+
+var (
+	//go:embed topic_bootstrap.txt
+	topicBootstrapTxt string
+
+	//go:embed topic_environment.txt
+	topicEnvironmentTxt string
+
+	//go:embed topic_errors.txt
+	topicErrorsTxt string
+
+	//go:embed topic_plugins.txt
+	topicPluginsTxt string
+)
+
+func init() {
+	RegisterTopic(&Topic{Name: "bootstrap", Summary: "setting up a first certificate hierarchy", Text: topicBootstrapTxt})
+	RegisterTopic(&Topic{Name: "environment", Summary: "environment variables", Text: topicEnvironmentTxt})
+	RegisterTopic(&Topic{Name: "errors", Summary: "exit codes and machine-readable errors", Text: topicErrorsTxt})
+	RegisterTopic(&Topic{Name: "plugins", Summary: "external nih-COMMAND executables", Text: topicPluginsTxt})
+}
@@ -0,0 +1,185 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "embed"
+
+	"nih.software/daemon"
+	"nih.software/trust"
+	"nih.software/trust/join"
+)
+
+//go:embed trust.txt
+var trustTxt string
+
+var cmdTrust = &Command{
+	Name:     "trust",
+	Summary:  "show the trust model and the credentials in use",
+	Help:     trustTxt,
+	Commands: []*Command{cmdTrustShow, cmdTrustExport, cmdTrustImport},
+}
+
+func init() {
+	Register(cmdTrust)
+}
+
+var trustShowFlags struct {
+	control string
+}
+
+var cmdTrustShow = &Command{
+	Name:    "show",
+	Summary: "summarize the credentials of this instance",
+	Help: `
+Show loads the credentials of the global -cert, -key, and -ca flags, as
+any command would, and prints where they were loaded from, the identity and
+expiry of the leaf certificate, the structure of the chain, and the roots
+with their fingerprints. The join pin is that of the root the chain leads
+to, as put in the join tokens of "nih token create".
+
+If a daemon is running with the control socket of -control, show also
+reports whether it serves the same leaf certificate. A daemon that was not
+reloaded after its files changed serves the old one.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&trustShowFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+	},
+	Credentials: true,
+	Run:         runTrustShow,
+}
+
+func runTrustShow(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	b := Bundle()
+	r := &trustShowResult{
+		Files: trustFiles{
+			Cert: describeFile(Global.CertFile),
+			Key:  describeFile(Global.KeyFile),
+			CA:   describeFile(Global.CAFile),
+		},
+		now: time.Now(),
+	}
+
+	chain := b.Chain()
+	for _, c := range chain {
+		r.Chain = append(r.Chain, newCertInfo(c))
+	}
+
+	for _, root := range b.Roots() {
+		r.Roots = append(r.Roots, newCertInfo(root))
+		if r.Pin == "" && trust.VerifyChain(chain, []*x509.Certificate{root}) == nil {
+			r.Pin = join.Pin(root)
+			r.Root = root.Subject.String()
+		}
+	}
+
+	if _, err := os.Stat(trustShowFlags.control); err == nil {
+		var s daemon.Status
+		if err := controlGet(ctx, trustShowFlags.control, "/admin/status", &s); err == nil {
+			r.Daemon = &trustDaemon{Serial: s.Serial, Same: s.Serial == chain[0].SerialNumber.String()}
+		}
+	}
+
+	return Print(r)
+}
+
+// describeFile returns the absolute path of name, or "standard input" for "-".
+func describeFile(name string) string {
+	if name == Stdio {
+		return "standard input"
+	}
+
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
+type trustShowResult struct {
+	Files  trustFiles   `json:"files"`
+	Chain  []*certInfo  `json:"chain"`
+	Roots  []*certInfo  `json:"roots"`
+	Root   string       `json:"root"`
+	Pin    string       `json:"pin"`
+	Daemon *trustDaemon `json:"daemon,omitempty"`
+
+	now time.Time
+}
+
+type trustFiles struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	CA   string `json:"ca"`
+}
+
+type trustDaemon struct {
+	Serial string `json:"serial"`
+	Same   bool   `json:"same"`
+}
+
+// WriteText implements output.Texter.
+func (r *trustShowResult) WriteText(w io.Writer) error {
+	field := func(indent, name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s%-*s %s\n", indent, 17-len(indent), name+":", value)
+		}
+	}
+
+	expires := func(c *certInfo) string {
+		return c.NotAfter.Format(time.RFC3339) + " (" + validity(r.now, c.NotBefore, c.NotAfter) + ")"
+	}
+
+	fmt.Fprintf(w, "files:\n")
+	field("  ", "cert", r.Files.Cert)
+	field("  ", "key", r.Files.Key)
+	field("  ", "ca", r.Files.CA)
+
+	leaf := r.Chain[0]
+	fmt.Fprintf(w, "\n")
+	field("", "leaf", orEmpty(leaf.Subject))
+	field("  ", "serial", leaf.Serial)
+	field("  ", "not after", expires(leaf))
+	field("  ", "key", leaf.KeyType)
+	field("  ", "dns names", strings.Join(leaf.DNSNames, ", "))
+	field("  ", "ip addresses", strings.Join(leaf.IPAddresses, ", "))
+
+	fmt.Fprintf(w, "\nchain:\n")
+	for i, c := range r.Chain {
+		role := "intermediate"
+		if i == 0 {
+			role = "leaf"
+		}
+		fmt.Fprintf(w, "  [%d] %s (%s, serial %s, %s)\n", i, orEmpty(c.Subject), role, c.Serial, validity(r.now, c.NotBefore, c.NotAfter))
+	}
+	fmt.Fprintf(w, "  --> %s (root)\n", orEmpty(r.Root))
+
+	fmt.Fprintf(w, "\nroots:\n")
+	for i, c := range r.Roots {
+		fmt.Fprintf(w, "  [%d] %s (%s)\n", i, orEmpty(c.Subject), validity(r.now, c.NotBefore, c.NotAfter))
+		field("      ", "sha256", c.SHA256)
+	}
+	field("", "join pin", r.Pin)
+
+	if d := r.Daemon; d != nil {
+		fmt.Fprintf(w, "\n")
+		if d.Same {
+			field("", "daemon", "serving these credentials")
+		} else {
+			field("", "daemon", Global.UI().Yellow("serving serial "+d.Serial+", not these credentials; reload it"))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,302 @@
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"nih.software/trust"
+)
+
+// The names of the files in a credentials archive.
+const (
+	archiveCert = "cert.pem"
+	archiveKey  = "key.pem"
+	archiveCA   = "ca.pem"
+)
+
+// maxArchiveFile bounds the size of each file in a credentials archive.
+const maxArchiveFile = 1 << 20
+
+var trustArchiveFlags struct {
+	out   string
+	noKey bool
+	force bool
+}
+
+var cmdTrustExport = &Command{
+	Name:    "export",
+	Summary: "write the credentials of this instance to an archive",
+	Help: `
+Export loads the credentials of the global -cert, -key, and -ca flags and
+writes them to -out, a gzip-compressed tar archive holding cert.pem,
+key.pem, and ca.pem, for "nih trust import" on another machine.
+
+With -no-key, the archive leaves out the private key: it then only serves
+a machine that holds the same key already, or one that only needs the
+roots. An archive with the key grants the identity of this instance to
+whoever can read it, so it is written with mode 0600; move it over
+a trusted channel and delete it after the import.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&trustArchiveFlags.out, "out", "nih-trust.tar.gz", "Archive `file` to write, or - for standard output")
+		fs.BoolVar(&trustArchiveFlags.noKey, "no-key", false, "Leave the private key out of the archive")
+		fs.BoolVar(&trustArchiveFlags.force, "force", false, "Overwrite an existing archive")
+	},
+	Credentials: true,
+	Run:         runTrustExport,
+}
+
+var cmdTrustImport = &Command{
+	Name:    "import",
+	Args:    "ARCHIVE",
+	Summary: "install credentials from an archive",
+	Help: `
+Import reads an archive written by "nih trust export", or standard input
+for "-", validates its credentials, and writes them to the files of the
+global -cert, -key, and -ca flags.
+
+The certificate chain must lead to one of the archive's roots, and the key
+must be the key of the leaf certificate. An archive without a key is only
+imported if the existing -key file holds the key of its certificate.
+
+Nothing is written if validation fails, or if any of the files exists and
+-force is not set.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&trustArchiveFlags.force, "force", false, "Overwrite existing credential files")
+	},
+	Run: runTrustImport,
+}
+
+func runTrustExport(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	// The files as they are, which Bundle has validated.
+	files := []struct{ name, path string }{
+		{archiveCert, Global.CertFile},
+		{archiveKey, Global.KeyFile},
+		{archiveCA, Global.CAFile},
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	now := time.Now()
+
+	for _, f := range files {
+		if f.name == archiveKey && trustArchiveFlags.noKey {
+			continue
+		}
+
+		data, err := ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{Name: f.name, Mode: 0600, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if err := WriteFile(trustArchiveFlags.out, buf.Bytes(), trustArchiveFlags.force); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return &Error{Code: ExitFailure, Err: err, Hint: "Use -force to overwrite it."}
+		}
+		return err
+	}
+
+	if trustArchiveFlags.out == Stdio {
+		return nil
+	}
+
+	leaf := Bundle().Chain()[0]
+	return Print(&trustArchiveResult{
+		File:    trustArchiveFlags.out,
+		Subject: leaf.Subject.String(),
+		Serial:  leaf.SerialNumber.String(),
+		Key:     !trustArchiveFlags.noKey,
+	})
+}
+
+func runTrustImport(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return Usagef("need exactly one archive")
+	}
+
+	data, err := ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	files, err := readCredentialsArchive(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", describeFile(args[0]), err)
+	}
+
+	if files[archiveCert] == nil || files[archiveCA] == nil {
+		return fmt.Errorf("%s: not a credentials archive: want %s and %s", describeFile(args[0]), archiveCert, archiveCA)
+	}
+
+	chain, err := trust.ParseCertificatesPEM(files[archiveCert])
+	if err != nil {
+		return fmt.Errorf("%s: %w", archiveCert, err)
+	}
+
+	roots, err := trust.ParseCertificatesPEM(files[archiveCA])
+	if err != nil {
+		return fmt.Errorf("%s: %w", archiveCA, err)
+	}
+
+	keyPEM, keyFrom := files[archiveKey], archiveKey
+	if keyPEM == nil {
+		if keyPEM, err = os.ReadFile(Global.KeyFile); err != nil {
+			return TrustError(fmt.Errorf("the archive has no key: %w", err),
+				"Export the archive without -no-key, or set -key to the key of its certificate.")
+		}
+		keyFrom = Global.KeyFile
+	}
+
+	key, err := trust.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return fmt.Errorf("%s: %w", keyFrom, err)
+	}
+
+	if !keyMatches(chain[0], key) {
+		return TrustError(fmt.Errorf("%s is not the key of the certificate in %s", keyFrom, archiveCert), "")
+	}
+
+	if _, err := trust.NewBundle(chain, key, roots); err != nil {
+		return TrustError(err, "")
+	}
+
+	type target struct {
+		path string
+		data []byte
+	}
+	targets := []target{{Global.CertFile, files[archiveCert]}, {Global.CAFile, files[archiveCA]}}
+	if files[archiveKey] != nil {
+		targets = append(targets, target{Global.KeyFile, files[archiveKey]})
+	}
+
+	if !trustArchiveFlags.force {
+		for _, t := range targets {
+			if _, err := os.Stat(t.path); err == nil {
+				return &Error{Code: ExitFailure, Err: fmt.Errorf("%s already exists", t.path), Hint: "Use -force to replace the credentials."}
+			}
+		}
+	}
+
+	r := &trustArchiveResult{
+		Subject: chain[0].Subject.String(),
+		Serial:  chain[0].SerialNumber.String(),
+		Key:     files[archiveKey] != nil,
+	}
+
+	for _, t := range targets {
+		if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(t.path, t.data); err != nil {
+			return err
+		}
+		r.Files = append(r.Files, t.path)
+	}
+
+	return Print(r)
+}
+
+// readCredentialsArchive returns the files of a credentials archive by name.
+func readCredentialsArchive(data []byte) (map[string][]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch hdr.Name {
+		case archiveCert, archiveKey, archiveCA:
+		default:
+			return nil, fmt.Errorf("unexpected file %q", hdr.Name)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || hdr.Size > maxArchiveFile {
+			return nil, fmt.Errorf("%s: not a regular file of at most %d bytes", hdr.Name, maxArchiveFile)
+		}
+
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// keyMatches reports whether key is the private key of leaf.
+func keyMatches(leaf *x509.Certificate, key crypto.Signer) bool {
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(key.Public())
+}
+
+type trustArchiveResult struct {
+	File    string   `json:"file,omitempty"`
+	Files   []string `json:"files,omitempty"`
+	Subject string   `json:"subject"`
+	Serial  string   `json:"serial"`
+	Key     bool     `json:"key"`
+}
+
+// WriteText implements output.Texter.
+func (r *trustArchiveResult) WriteText(w io.Writer) error {
+	field := func(name, value string) {
+		fmt.Fprintf(w, "%-17s %s\n", name+":", value)
+	}
+
+	if r.File != "" {
+		field("archive", r.File)
+	}
+	for _, f := range r.Files {
+		field("wrote", f)
+	}
+	field("subject", orEmpty(r.Subject))
+	field("serial", r.Serial)
+
+	key := "included"
+	if !r.Key {
+		key = "not included"
+	}
+	field("private key", key)
+
+	return nil
+}
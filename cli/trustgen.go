@@ -0,0 +1,273 @@
+package cli
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	_ "embed"
+
+	"nih.software/cli/ui"
+	"nih.software/trust/trustgen"
+)
+
+//go:embed trustgen.txt
+var trustgenTxt string
+
+var cmdTrustgen = &Command{
+	Name:    "trustgen",
+	Summary: "generate certificates and keys",
+}
+
+var trustgenKinds = []struct {
+	name, summary string
+}{
+	{"root", "generate a self-signed root CA"},
+	{"intermediate", "generate an intermediate CA issued by -issuer-cert"},
+	{"leaf", "generate a node certificate issued by -issuer-cert"},
+	{"csr", "generate a key and certificate signing request"},
+}
+
+func init() {
+	for _, k := range trustgenKinds {
+		kind := k.name
+
+		var g generator
+		cmdTrustgen.Commands = append(cmdTrustgen.Commands, &Command{
+			Name:    kind,
+			Summary: k.summary,
+			Help:    trustgenTxt,
+			Flags: func(fs *flag.FlagSet) {
+				g = generator{}
+				g.flags(fs, kind)
+			},
+			Run: func(ctx context.Context, args []string) error {
+				if len(args) != 0 {
+					return Usagef("unexpected arguments")
+				}
+
+				switch {
+				case kind == "csr":
+					return g.csr()
+				case g.pivSlot != "":
+					return g.pivLeaf()
+				}
+				return g.cert(kind)
+			},
+		})
+	}
+
+	Register(cmdTrustgen)
+}
+
+type generator struct {
+	cn, org    string
+	roles      string
+	dns, ip    string
+	lifetime   time.Duration
+	keyType    string
+	web        bool
+	db         string
+	issuerCert string
+	issuerKey  string
+	certFile   string
+	keyFile    string
+	force      bool
+
+	pivSlot   string
+	pivReader string
+	pivKey    string
+}
+
+var lifetimeDefaults = map[string]string{
+	"root":         "\n(default: 10 years)",
+	"intermediate": "\n(default: 5 years)",
+	"leaf":         "\n(default: 1 year)",
+}
+
+func (g *generator) flags(fs *flag.FlagSet, kind string) {
+	fs.StringVar(&g.cn, "cn", "", "Subject common `name`")
+	fs.StringVar(&g.org, "org", "", "Subject organization `name`")
+	if kind == "leaf" || kind == "csr" {
+		fs.StringVar(&g.roles, "role", "", "Comma-separated `roles` granted to the holder, as subject organizational units")
+	}
+	fs.StringVar(&g.dns, "dns", "", "Comma-separated subject alternative DNS `names`")
+	fs.StringVar(&g.ip, "ip", "", "Comma-separated subject alternative IP `addresses`")
+	fs.StringVar(&g.keyType, "key-type", "", "Key `type`: ed25519, ecdsa-p256, ecdsa-p384, rsa-2048, or rsa-4096\n(default: ed25519, or ecdsa-p256 with -web)")
+	fs.BoolVar(&g.web, "web", false, "Enforce browser certificate policy, for local HTTPS development")
+
+	if kind != "csr" {
+		fs.DurationVar(&g.lifetime, "lifetime", 0, "Certificate `lifetime`"+lifetimeDefaults[kind])
+		fs.StringVar(&g.db, "db", "", "Issuance database `file` recording serials and revocations")
+	}
+
+	if kind == "intermediate" || kind == "leaf" {
+		fs.StringVar(&g.issuerCert, "issuer-cert", "", "Issuing CA certificate `file`, or - for standard input")
+		fs.StringVar(&g.issuerKey, "issuer-key", "", "Issuing CA private key `file`, or - for standard input")
+	}
+
+	if kind == "leaf" {
+		fs.StringVar(&g.pivSlot, "piv", "", "Generate the key in `slot` 9a, 9c, 9d, or 9e of a PIV card, such as a YubiKey, instead of -key")
+		fs.StringVar(&g.pivReader, "piv-reader", "", "Use the card in the PC/SC reader whose name contains `name`\n(default: the first reader)")
+		fs.StringVar(&g.pivKey, "piv-management-key", "", "Management `key` of the PIV card, in hex\n(default: the factory default)")
+	}
+
+	fs.StringVar(&g.certFile, "cert", kind+".pem", "Output certificate `file`, or - for standard output")
+	fs.StringVar(&g.keyFile, "key", kind+".key", "Output private key `file`, or - for standard output")
+	fs.BoolVar(&g.force, "force", false, "Overwrite existing output files")
+}
+
+func (g *generator) options() ([]trustgen.Option, error) {
+	var opts []trustgen.Option
+
+	if g.cn != "" || g.org != "" || g.roles != "" {
+		name := pkix.Name{CommonName: g.cn}
+		if g.org != "" {
+			name.Organization = []string{g.org}
+		}
+		if g.roles != "" {
+			name.OrganizationalUnit = strings.Split(g.roles, ",")
+		}
+		opts = append(opts, trustgen.WithSubject(name))
+	}
+
+	if g.dns != "" {
+		opts = append(opts, trustgen.WithDNSNames(strings.Split(g.dns, ",")...))
+	}
+
+	if g.ip != "" {
+		var ips []net.IP
+		for _, s := range strings.Split(g.ip, ",") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, Usagef("invalid IP address %q", s)
+			}
+			ips = append(ips, ip)
+		}
+		opts = append(opts, trustgen.WithIPAddresses(ips...))
+	}
+
+	if g.lifetime != 0 {
+		opts = append(opts, trustgen.WithLifetime(g.lifetime))
+	}
+
+	if g.keyType != "" {
+		t, err := trustgen.ParseKeyType(g.keyType)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, trustgen.WithKeyType(t))
+	}
+
+	if g.web {
+		opts = append(opts, trustgen.WithWebPKI())
+	}
+
+	if g.db != "" {
+		db, err := trustgen.OpenDB(g.db)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, trustgen.WithDB(db))
+	}
+
+	return opts, nil
+}
+
+func (g *generator) cert(kind string) error {
+	opts, err := g.options()
+	if err != nil {
+		return err
+	}
+
+	sp := ui.NewSpinner("generating " + kind + " key and certificate")
+	defer sp.Stop()
+
+	var chain []*x509.Certificate
+	var key crypto.Signer
+
+	if kind == "root" {
+		crt, k, err := trustgen.NewRoot(opts...)
+		if err != nil {
+			return err
+		}
+
+		chain, key = []*x509.Certificate{crt}, k
+	} else {
+		if g.issuerCert == "" || g.issuerKey == "" {
+			return Usagef("-issuer-cert and -issuer-key are required")
+		}
+
+		ca, err := g.loadCA(opts)
+		if err != nil {
+			return err
+		}
+
+		var crt *x509.Certificate
+		if kind == "intermediate" {
+			sub, err := ca.NewIntermediate()
+			if err != nil {
+				return err
+			}
+
+			crt, key = sub.Cert, sub.Key
+		} else {
+			crt, key, err = ca.NewLeaf()
+			if err != nil {
+				return err
+			}
+		}
+
+		chain = ca.ChainFor(crt)
+	}
+
+	return g.write(trustgen.PEMEncodePrivateKey(key), trustgen.PEMEncodeCertificates(chain...))
+}
+
+func (g *generator) csr() error {
+	opts, err := g.options()
+	if err != nil {
+		return err
+	}
+
+	sp := ui.NewSpinner("generating key and certificate request")
+	defer sp.Stop()
+
+	csr, key, err := trustgen.NewCSR(opts...)
+	if err != nil {
+		return err
+	}
+
+	return g.write(trustgen.PEMEncodePrivateKey(key), trustgen.PEMEncodeCertificateRequest(csr))
+}
+
+// write writes the key and the certificate or request to their output
+// files, both or neither.
+func (g *generator) write(key, cert []byte) error {
+	return writeFiles([]outputFile{{g.keyFile, key}, {g.certFile, cert}}, g.force)
+}
+
+func (g *generator) loadCA(opts []trustgen.Option) (*trustgen.CA, error) {
+	certPEM, err := ReadFile(g.issuerCert)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ReadFile(g.issuerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := trustgen.ParseCA(certPEM, keyPEM, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("issuer: %w", err)
+	}
+
+	return ca, nil
+}
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"nih.software/cli/ui"
+	"nih.software/trust/piv"
+	"nih.software/trust/trustgen"
+)
+
+// pivLeaf generates the key of a leaf in the slot of -piv, on the card,
+// and issues the leaf for it, storing the certificate in the slot as well
+// as writing its chain to -cert. The key never leaves the card.
+func (g *generator) pivLeaf() error {
+	slot, err := piv.ParseSlot(g.pivSlot)
+	if err != nil {
+		return Usagef("-piv: %v", err)
+	}
+
+	alg := piv.ECCP256
+	if g.keyType != "" {
+		if alg, err = piv.ParseAlgorithm(g.keyType); err != nil {
+			return Usagef("-key-type: %v", err)
+		}
+	}
+
+	mgmt := piv.DefaultManagementKey
+	if g.pivKey != "" {
+		if mgmt, err = hex.DecodeString(g.pivKey); err != nil {
+			return Usagef("-piv-management-key: not a hex key")
+		}
+	}
+
+	if g.issuerCert == "" || g.issuerKey == "" {
+		return Usagef("-issuer-cert and -issuer-key are required")
+	}
+
+	opts, err := g.options()
+	if err != nil {
+		return err
+	}
+
+	// Fail before replacing the key on the card, which cannot be undone.
+	if err := checkFiles([]outputFile{{name: g.certFile}}, g.force); err != nil {
+		return err
+	}
+
+	ca, err := g.loadCA(opts)
+	if err != nil {
+		return err
+	}
+
+	t, err := piv.OpenReader(g.pivReader)
+	if err != nil {
+		return err
+	}
+	card, err := piv.Open(t)
+	if err != nil {
+		t.Close()
+		return err
+	}
+	defer card.Close()
+
+	if err := card.Authenticate(mgmt); err != nil {
+		return err
+	}
+
+	prompt := fmt.Sprintf("Generate a new key in slot %v of the card, replacing any key it holds?", slot)
+	if crt, err := card.Certificate(slot); err == nil {
+		prompt = fmt.Sprintf("Replace the key in slot %v of the card, certified for %s?", slot, crt.Subject)
+	}
+	if err := confirm(prompt); err != nil {
+		return err
+	}
+
+	sp := ui.NewSpinner(fmt.Sprintf("generating %v key in slot %v", alg, slot))
+	pub, err := card.GenerateKey(slot, alg)
+	sp.Stop()
+	if err != nil {
+		return err
+	}
+
+	crt, err := ca.SignLeaf(pub)
+	if err != nil {
+		return err
+	}
+
+	if err := card.SetCertificate(slot, crt); err != nil {
+		return err
+	}
+
+	if err := writeFiles([]outputFile{{g.certFile, trustgen.PEMEncodeCertificates(ca.ChainFor(crt)...)}}, g.force); err != nil {
+		return err
+	}
+
+	ui.Success("generated the key in slot %v of the card, serial %s", slot, crt.SerialNumber)
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package ui
+
+import "os"
+
+// EnableEscapes reports whether the terminal f interprets ANSI escape
+// sequences, such as those of colors, which every terminal but the consoles
+// of old versions of Windows does.
+func EnableEscapes(f *os.File) bool {
+	return true
+}
@@ -0,0 +1,23 @@
+package ui
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// EnableEscapes reports whether the terminal f interprets ANSI escape
+// sequences, such as those of colors, enabling their processing if the
+// console supports it, as Windows 10 and later do.
+func EnableEscapes(f *os.File) bool {
+	h := windows.Handle(f.Fd())
+
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return false
+	}
+	if mode&windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING != 0 {
+		return true
+	}
+	return windows.SetConsoleMode(h, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING) == nil
+}
@@ -0,0 +1,172 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// progress reports whether animated progress indicators are enabled.
+func (u *UI) progress() bool {
+	return u.opts.Progress && !u.opts.Quiet
+}
+
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// A Spinner animates a label while an operation of unknown length runs.
+// It writes nothing unless progress indicators are enabled.
+type Spinner struct {
+	u     *UI
+	label string
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Spinner starts a spinner showing label on the error stream.
+// The caller must call Stop when the operation finishes.
+func (u *UI) Spinner(label string) *Spinner {
+	s := &Spinner{u: u, label: label, stop: make(chan struct{}), done: make(chan struct{})}
+	if !u.progress() {
+		close(s.done)
+		return s
+	}
+
+	go s.run()
+	return s
+}
+
+func (s *Spinner) run() {
+	defer close(s.done)
+
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+
+	for i := 0; ; i++ {
+		fmt.Fprintf(s.u.err, "\r%s %s", s.u.Faint(spinnerFrames[i%len(spinnerFrames)]), s.label)
+
+		select {
+		case <-s.stop:
+			s.u.clearLine(len(s.label) + 2)
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Stop stops the spinner and erases it. It is safe to call more than once.
+func (s *Spinner) Stop() {
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// A Bar shows the progress of an operation of known size, such as a file transfer.
+// It writes nothing unless progress indicators are enabled.
+//
+// A Bar is an io.Writer, so it can count bytes passing through an io.TeeReader
+// or io.MultiWriter.
+type Bar struct {
+	u     *UI
+	label string
+	total int64
+
+	mu    sync.Mutex
+	n     int64
+	drawn time.Time
+	width int
+}
+
+// Bar returns a progress bar for an operation of total units, shown on the error stream.
+// A total of 0 or less means the size is unknown: the bar then shows only the count.
+// The caller must call Done when the operation finishes.
+func (u *UI) Bar(label string, total int64) *Bar {
+	return &Bar{u: u, label: label, total: total}
+}
+
+// Add records n more units of progress.
+func (b *Bar) Add(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.n += n
+	if now := time.Now(); now.Sub(b.drawn) >= 100*time.Millisecond {
+		b.drawn = now
+		b.draw()
+	}
+}
+
+// Write records len(p) units of progress. It never fails.
+func (b *Bar) Write(p []byte) (int, error) {
+	b.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Done erases the bar.
+func (b *Bar) Done() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.width > 0 {
+		b.u.clearLine(b.width)
+		b.width = 0
+	}
+}
+
+const barWidth = 30
+
+func (b *Bar) draw() {
+	if !b.u.progress() {
+		return
+	}
+
+	var line string
+	if b.total > 0 {
+		n := min(b.n, b.total)
+		filled := int(n * barWidth / b.total)
+		line = fmt.Sprintf("%s [%s%s] %3d%% %s/%s", b.label,
+			strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled),
+			n*100/b.total, FormatBytes(n), FormatBytes(b.total))
+	} else {
+		line = fmt.Sprintf("%s %s", b.label, FormatBytes(b.n))
+	}
+
+	// Pad over the remains of a longer previous line.
+	fmt.Fprintf(b.u.err, "\r%-*s", b.width, line)
+	b.width = max(b.width, len(line))
+}
+
+// clearLine erases the last width columns written on the current line of the error stream.
+func (u *UI) clearLine(width int) {
+	fmt.Fprintf(u.err, "\r%s\r", strings.Repeat(" ", width))
+}
+
+// FormatBytes formats n bytes with a binary unit, such as "1.5 MiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// NewSpinner starts a spinner with the default UI.
+func NewSpinner(label string) *Spinner { return std.Spinner(label) }
+
+// NewBar returns a progress bar with the default UI.
+func NewBar(label string, total int64) *Bar { return std.Bar(label, total) }
@@ -0,0 +1,82 @@
+package ui_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"nih.software/cli/ui"
+)
+
+func TestProgressDisabled(t *testing.T) {
+	var out, errs bytes.Buffer
+
+	for _, opts := range []ui.Options{{}, {Progress: true, Quiet: true}} {
+		u := ui.New(&out, &errs, opts)
+
+		sp := u.Spinner("working")
+		time.Sleep(10 * time.Millisecond)
+		sp.Stop()
+		sp.Stop()
+
+		bar := u.Bar("copying", 100)
+		io.Copy(bar, strings.NewReader(strings.Repeat("x", 100)))
+		bar.Done()
+	}
+
+	if out.Len() != 0 || errs.Len() != 0 {
+		t.Fatalf("disabled progress wrote %q, %q", out.String(), errs.String())
+	}
+}
+
+func TestSpinner(t *testing.T) {
+	var errs bytes.Buffer
+
+	u := ui.New(io.Discard, &errs, ui.Options{Progress: true})
+	sp := u.Spinner("working")
+	sp.Stop()
+
+	got := errs.String()
+	if !strings.HasPrefix(got, "\r| working") {
+		t.Fatalf("spinner wrote %q", got)
+	}
+	if !strings.HasSuffix(got, "\r"+strings.Repeat(" ", len("working")+2)+"\r") {
+		t.Fatalf("spinner did not erase itself: %q", got)
+	}
+}
+
+func TestBar(t *testing.T) {
+	var errs bytes.Buffer
+
+	u := ui.New(io.Discard, &errs, ui.Options{Progress: true})
+	bar := u.Bar("copying", 2048)
+	bar.Add(1024)
+
+	got := errs.String()
+	if want := "copying [" + strings.Repeat("=", 15) + strings.Repeat(" ", 15) + "]  50% 1.0 KiB/2.0 KiB"; !strings.Contains(got, want) {
+		t.Fatalf("bar wrote %q, want %q", got, want)
+	}
+
+	bar.Done()
+	if !strings.HasSuffix(errs.String(), "\r") {
+		t.Fatalf("bar did not erase itself: %q", errs.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KiB",
+		1536:          "1.5 KiB",
+		5 << 20:       "5.0 MiB",
+		3 << 30:       "3.0 GiB",
+		1<<40 + 1<<39: "1.5 TiB",
+	} {
+		if got := ui.FormatBytes(n); got != want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package ui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ErrNoAnswer is returned by prompts when the input ends before an answer is read.
+var ErrNoAnswer = errors.New("no answer; use -yes to run non-interactively")
+
+func (u *UI) input() io.Reader {
+	if u.opts.Input != nil {
+		return u.opts.Input
+	}
+	return os.Stdin
+}
+
+func (u *UI) readLine() (string, error) {
+	if u.in == nil {
+		u.in = bufio.NewReader(u.input())
+	}
+
+	line, err := u.in.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", ErrNoAnswer
+	}
+
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Confirm asks a yes/no question, defaulting to no.
+// It returns true without asking if the UI assumes yes.
+func (u *UI) Confirm(prompt string) (bool, error) {
+	if u.opts.AssumeYes {
+		return true, nil
+	}
+
+	for {
+		fmt.Fprintf(u.err, "%s [y/N] ", prompt)
+		answer, err := u.readLine()
+		if err != nil {
+			fmt.Fprintln(u.err)
+			return false, err
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true, nil
+
+		case "", "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// Secret asks for a secret such as a passphrase.
+// If the input is a terminal, the answer is not echoed.
+func (u *UI) Secret(prompt string) ([]byte, error) {
+	fmt.Fprintf(u.err, "%s: ", prompt)
+
+	if f, ok := u.input().(*os.File); ok && u.in == nil && term.IsTerminal(int(f.Fd())) {
+		b, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(u.err)
+		return b, err
+	}
+
+	line, err := u.readLine()
+	if err != nil {
+		fmt.Fprintln(u.err)
+		return nil, err
+	}
+
+	return []byte(line), nil
+}
+
+// NewSecret asks for a new secret twice and returns it if both answers match.
+func (u *UI) NewSecret(prompt string) ([]byte, error) {
+	first, err := u.Secret(prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	second, err := u.Secret("Repeat " + strings.ToLower(prompt[:1]) + prompt[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if string(first) != string(second) {
+		return nil, errors.New("answers do not match")
+	}
+
+	return first, nil
+}
+
+// Select asks the user to pick one of choices and returns its index.
+func (u *UI) Select(prompt string, choices []string) (int, error) {
+	if len(choices) == 0 {
+		return 0, errors.New("nothing to select")
+	}
+
+	fmt.Fprintln(u.err, prompt)
+	for i, c := range choices {
+		fmt.Fprintf(u.err, "  %d) %s\n", i+1, c)
+	}
+
+	for {
+		fmt.Fprintf(u.err, "Enter a number [1-%d]: ", len(choices))
+		answer, err := u.readLine()
+		if err != nil {
+			fmt.Fprintln(u.err)
+			return 0, err
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(answer))
+		if err == nil && n >= 1 && n <= len(choices) {
+			return n - 1, nil
+		}
+	}
+}
+
+// Confirm asks a yes/no question with the default UI.
+func Confirm(prompt string) (bool, error) { return std.Confirm(prompt) }
+
+// Secret asks for a secret with the default UI.
+func Secret(prompt string) ([]byte, error) { return std.Secret(prompt) }
+
+// Select asks the user to pick one of choices with the default UI.
+func Select(prompt string, choices []string) (int, error) { return std.Select(prompt, choices) }
@@ -0,0 +1,78 @@
+package ui_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"nih.software/cli/ui"
+)
+
+func TestConfirm(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"y\n", true},
+		{"YES\n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"maybe\ny\n", true},
+	}
+
+	for _, tt := range tests {
+		u := ui.New(io.Discard, io.Discard, ui.Options{Input: strings.NewReader(tt.input)})
+		got, err := u.Confirm("continue?")
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+
+		if got != tt.want {
+			t.Errorf("%q: %v != %v", tt.input, got, tt.want)
+		}
+	}
+
+	t.Run("assume yes", func(t *testing.T) {
+		u := ui.New(io.Discard, io.Discard, ui.Options{AssumeYes: true, Input: strings.NewReader("")})
+		if ok, err := u.Confirm("continue?"); err != nil || !ok {
+			t.Fatalf("Confirm = %v, %v", ok, err)
+		}
+	})
+
+	t.Run("no input", func(t *testing.T) {
+		u := ui.New(io.Discard, io.Discard, ui.Options{Input: strings.NewReader("")})
+		if _, err := u.Confirm("continue?"); !errors.Is(err, ui.ErrNoAnswer) {
+			t.Fatalf("error %v != %v", err, ui.ErrNoAnswer)
+		}
+	})
+}
+
+func TestNewSecret(t *testing.T) {
+	u := ui.New(io.Discard, io.Discard, ui.Options{Input: strings.NewReader("hunter2\nhunter2\n")})
+	got, err := u.NewSecret("Passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "hunter2" {
+		t.Fatalf("%q != %q", got, "hunter2")
+	}
+
+	u = ui.New(io.Discard, io.Discard, ui.Options{Input: strings.NewReader("hunter2\nhunter3\n")})
+	if _, err := u.NewSecret("Passphrase"); err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	u := ui.New(io.Discard, io.Discard, ui.Options{Input: strings.NewReader("0\nfoo\n2\n")})
+	got, err := u.Select("pick one", []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != 1 {
+		t.Fatalf("%d != 1", got)
+	}
+}
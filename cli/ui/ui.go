@@ -0,0 +1,178 @@
+// Package ui writes user-facing messages with a shared look across commands.
+//
+// Results meant for scripts belong on standard output (see package output);
+// everything written through a UI is for the person at the terminal.
+package ui
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Options configures a UI.
+type Options struct {
+	// Color enables ANSI colors.
+	Color bool
+
+	// Quiet suppresses everything but warnings and errors.
+	Quiet bool
+
+	// Verbose enables Debug messages.
+	Verbose bool
+
+	// Progress enables animated progress indicators on the error stream.
+	// Enable it only if the error stream is a terminal, see IsTerminal.
+	Progress bool
+
+	// AssumeYes answers every confirmation with yes, for non-interactive use.
+	AssumeYes bool
+
+	// Input is where prompts read answers from. Nil means os.Stdin.
+	Input io.Reader
+}
+
+// UI writes messages to an output and an error stream,
+// and reads answers to prompts from its input.
+type UI struct {
+	out, err io.Writer
+	opts     Options
+	in       *bufio.Reader
+}
+
+// New returns a UI writing informational messages to out and problems to err.
+func New(out, err io.Writer, opts Options) *UI {
+	return &UI{out: out, err: err, opts: opts}
+}
+
+// ColorSupported reports whether colored output should be written to f:
+// f must be a terminal that interprets escape sequences, NO_COLOR
+// (https://no-color.org) must be unset or empty, and TERM must not be "dumb".
+func ColorSupported(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+
+	return IsTerminal(f) && EnableEscapes(f)
+}
+
+var std = New(os.Stdout, os.Stderr, Options{
+	Color:    ColorSupported(os.Stdout),
+	Progress: IsTerminal(os.Stderr),
+})
+
+// Default returns the UI used by the package-level functions.
+func Default() *UI {
+	return std
+}
+
+// SetDefault replaces the UI used by the package-level functions.
+func SetDefault(u *UI) {
+	std = u
+}
+
+const (
+	red    = "31"
+	green  = "32"
+	yellow = "33"
+	faint  = "2"
+)
+
+func (u *UI) paint(code, s string) string {
+	if !u.opts.Color {
+		return s
+	}
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+// Green returns s colored green, if colors are enabled.
+func (u *UI) Green(s string) string { return u.paint(green, s) }
+
+// Red returns s colored red, if colors are enabled.
+func (u *UI) Red(s string) string { return u.paint(red, s) }
+
+// Yellow returns s colored yellow, if colors are enabled.
+func (u *UI) Yellow(s string) string { return u.paint(yellow, s) }
+
+// Faint returns s dimmed, if colors are enabled.
+func (u *UI) Faint(s string) string { return u.paint(faint, s) }
+
+// Info prints a message unless the UI is quiet.
+func (u *UI) Info(format string, args ...any) {
+	if u.opts.Quiet {
+		return
+	}
+	fmt.Fprintf(u.out, format+"\n", args...)
+}
+
+// Debug prints a dimmed message if the UI is verbose.
+func (u *UI) Debug(format string, args ...any) {
+	if !u.opts.Verbose {
+		return
+	}
+	fmt.Fprintln(u.err, u.Faint(fmt.Sprintf(format, args...)))
+}
+
+// Success prints a green message unless the UI is quiet.
+func (u *UI) Success(format string, args ...any) {
+	if u.opts.Quiet {
+		return
+	}
+	fmt.Fprintln(u.out, u.Green(fmt.Sprintf(format, args...)))
+}
+
+// Warn prints a yellow warning to the error stream.
+func (u *UI) Warn(format string, args ...any) {
+	fmt.Fprintln(u.err, u.Yellow("warning: "+fmt.Sprintf(format, args...)))
+}
+
+// Error prints a red error to the error stream.
+func (u *UI) Error(format string, args ...any) {
+	fmt.Fprintln(u.err, u.Red(fmt.Sprintf(format, args...)))
+}
+
+// Hint prints a suggestion for fixing a problem to the error stream.
+func (u *UI) Hint(format string, args ...any) {
+	fmt.Fprintf(u.err, format+"\n", args...)
+}
+
+// Status prints the outcome of a named step: "label: OK" in green,
+// or "label: ERROR: err" in red. Failures are printed even if the UI is quiet.
+func (u *UI) Status(label string, err error) {
+	if err != nil {
+		fmt.Fprintf(u.out, "%s: %s\n", label, u.Red(fmt.Sprintf("ERROR: %v", err)))
+		return
+	}
+
+	if !u.opts.Quiet {
+		fmt.Fprintf(u.out, "%s: %s\n", label, u.Green("OK"))
+	}
+}
+
+// Quiet reports whether the UI is quiet.
+func (u *UI) Quiet() bool { return u.opts.Quiet }
+
+// Verbose reports whether the UI is verbose.
+func (u *UI) Verbose() bool { return u.opts.Verbose }
+
+// Color reports whether the UI writes colors.
+func (u *UI) Color() bool { return u.opts.Color }
+
+// Info prints a message with the default UI.
+func Info(format string, args ...any) { std.Info(format, args...) }
+
+// Debug prints a message with the default UI.
+func Debug(format string, args ...any) { std.Debug(format, args...) }
+
+// Success prints a message with the default UI.
+func Success(format string, args ...any) { std.Success(format, args...) }
+
+// Warn prints a warning with the default UI.
+func Warn(format string, args ...any) { std.Warn(format, args...) }
+
+// Error prints an error with the default UI.
+func Error(format string, args ...any) { std.Error(format, args...) }
+
+// Status prints the outcome of a step with the default UI.
+func Status(label string, err error) { std.Status(label, err) }
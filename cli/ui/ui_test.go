@@ -0,0 +1,69 @@
+package ui_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"nih.software/cli/ui"
+)
+
+func TestStatus(t *testing.T) {
+	var out, errs bytes.Buffer
+
+	u := ui.New(&out, &errs, ui.Options{})
+	u.Status("step", nil)
+	u.Status("step", errors.New("boom"))
+
+	if got, want := out.String(), "step: OK\nstep: ERROR: boom\n"; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+}
+
+func TestColor(t *testing.T) {
+	var out bytes.Buffer
+
+	u := ui.New(&out, &out, ui.Options{Color: true})
+	u.Success("done")
+
+	if got, want := out.String(), "\x1b[32mdone\x1b[0m\n"; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	var out, errs bytes.Buffer
+
+	u := ui.New(&out, &errs, ui.Options{Quiet: true})
+	u.Info("hello")
+	u.Success("done")
+	u.Status("step", nil)
+	u.Debug("details")
+	u.Warn("careful")
+
+	if out.Len() != 0 {
+		t.Fatalf("quiet output %q", out.String())
+	}
+
+	if got, want := errs.String(), "warning: careful\n"; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	var out, errs bytes.Buffer
+
+	u := ui.New(&out, &errs, ui.Options{Verbose: true})
+	u.Debug("details %d", 42)
+
+	if got, want := errs.String(), "details 42\n"; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+}
+
+func TestColorSupported(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	if ui.ColorSupported(nil) {
+		t.Fatal("color with NO_COLOR set")
+	}
+}
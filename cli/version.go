@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+var cmdVersion = &Command{
+	Name:    "version",
+	Summary: "print the nih version",
+	Help: `
+The version is the module version nih was built from, or "(devel)"
+for a build from a working tree, followed by the VCS revision if known.
+`,
+	Run: func(ctx context.Context, args []string) error {
+		if len(args) != 0 {
+			return Usagef("unexpected arguments")
+		}
+
+		return Print(buildVersion())
+	},
+}
+
+func init() {
+	Register(cmdVersion)
+}
+
+// Version describes the running nih binary.
+type Version struct {
+	Version  string `json:"version"`
+	Revision string `json:"revision,omitempty"`
+	Modified bool   `json:"modified,omitempty"`
+	Go       string `json:"go"`
+	OS       string `json:"os"`
+	Arch     string `json:"arch"`
+}
+
+func buildVersion() *Version {
+	v := &Version{
+		Version: "(devel)",
+		Go:      runtime.Version(),
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+
+	if info.Main.Version != "" {
+		v.Version = info.Main.Version
+	}
+
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Revision = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+
+	return v
+}
+
+// WriteText implements output.Texter.
+func (v *Version) WriteText(w io.Writer) error {
+	rev := ""
+	if v.Revision != "" {
+		rev = " " + v.Revision
+		if v.Modified {
+			rev += "+modified"
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "nih %s%s %s %s/%s\n", v.Version, rev, v.Go, v.OS, v.Arch)
+	return err
+}
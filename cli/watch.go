@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"nih.software/cli/output"
+	"nih.software/cli/ui"
+	"nih.software/daemon"
+)
+
+var watchFlags struct {
+	control  string
+	interval time.Duration
+	count    int
+}
+
+var cmdWatch = &Command{
+	Name:    "watch",
+	Summary: "watch the health of the peers of the running daemon",
+	Help: `
+Watch asks the daemon started by "nih serve" for its peers every -interval,
+over the control socket of -control, as "nih nodes" does once, and shows
+them with a count of peers by health. On a terminal, the view is redrawn
+in place; otherwise every poll is printed in turn.
+
+With -o json, watch prints one JSON object per poll and line, holding the
+time and the peers, for piping into other tools. A poll that fails, as
+when the daemon restarts, is shown with its error and watch keeps polling.
+
+Watch runs until interrupted, or for -count polls.
+`,
+	Flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&watchFlags.control, "control", daemon.DefaultControl, controlFlagUsage)
+		fs.DurationVar(&watchFlags.interval, "interval", 2*time.Second, "Time between polls")
+		fs.IntVar(&watchFlags.count, "count", 0, "Number of polls, or 0 to poll until interrupted")
+	},
+	Run: runWatch,
+}
+
+func init() {
+	Register(cmdWatch)
+}
+
+// A watchFrame is the result of one poll of watch.
+type watchFrame struct {
+	Time  time.Time     `json:"time"`
+	Peers []daemon.Peer `json:"peers,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+func runWatch(ctx context.Context, args []string) error {
+	if len(args) != 0 {
+		return Usagef("unexpected arguments")
+	}
+
+	if watchFlags.interval <= 0 {
+		return Usagef("-interval must be positive")
+	}
+	if watchFlags.count < 0 {
+		return Usagef("-count must not be negative")
+	}
+
+	redraw := Global.Output == output.Text && ui.IsTerminal(os.Stdout) && ui.EnableEscapes(os.Stdout)
+
+	for i := 0; watchFlags.count == 0 || i < watchFlags.count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(watchFlags.interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		f := &watchFrame{Time: time.Now()}
+		if err := controlGet(ctx, watchFlags.control, "/admin/peers", &f.Peers); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			f.Error = err.Error()
+		}
+
+		if Global.Output == output.JSON {
+			if err := json.NewEncoder(os.Stdout).Encode(f); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var b strings.Builder
+		if redraw {
+			// Home the cursor and clear the screen.
+			b.WriteString("\x1b[H\x1b[2J")
+		} else if i > 0 {
+			b.WriteString("\n")
+		}
+		f.writeText(&b)
+
+		if _, err := io.WriteString(os.Stdout, b.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *watchFrame) writeText(w io.Writer) {
+	u := Global.UI()
+
+	fmt.Fprintf(w, "%s  every %v  %s\n\n", u.Faint(f.Time.Format(time.RFC3339)), watchFlags.interval, watchFlags.control)
+	if f.Error != "" {
+		fmt.Fprintln(w, u.Red("ERROR: "+f.Error))
+		return
+	}
+
+	counts := make(map[string]int)
+	for _, p := range f.Peers {
+		counts[p.Health]++
+	}
+
+	summary := []string{plural(len(f.Peers), "peer")}
+	for _, h := range []string{daemon.PeerOK, daemon.PeerDown, daemon.PeerSuspect, daemon.PeerStale, daemon.PeerUnknown, daemon.PeerLeft} {
+		if counts[h] == 0 {
+			continue
+		}
+
+		s := fmt.Sprintf("%d %s", counts[h], h)
+		switch h {
+		case daemon.PeerOK:
+			s = u.Green(s)
+		case daemon.PeerDown:
+			s = u.Red(s)
+		default:
+			s = u.Yellow(s)
+		}
+		summary = append(summary, s)
+	}
+	fmt.Fprintln(w, strings.Join(summary, ", "))
+
+	if len(f.Peers) > 0 {
+		fmt.Fprintln(w)
+		peersTable(f.Peers).WriteText(w)
+	}
+}
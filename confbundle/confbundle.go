@@ -0,0 +1,196 @@
+// Package confbundle defines the bundles of configuration an operator
+// pushes to the nodes of a cluster: the live settings of nih serve, files
+// written on the nodes, and a command reloading what reads them, under a
+// version the nodes apply in order.
+//
+// A bundle is signed by the node it was pushed to, with the key of its
+// certificate, whose chain the bundle carries, so that every node can
+// verify who made it however the bundle reached it.
+package confbundle
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"nih.software/trust"
+)
+
+// MaxSize is the size limit of the content of a bundle, its files
+// included.
+const MaxSize = 1 << 20
+
+// A File is a file a bundle writes on the nodes.
+type File struct {
+	// Path is the name of the file, relative to the working directory of
+	// the daemon unless absolute.
+	Path string      `json:"path"`
+	Mode fs.FileMode `json:"mode"`
+	Data []byte      `json:"data"`
+}
+
+// Content is what a bundle configures.
+type Content struct {
+	// Settings map the names of live settings, as nih config set takes
+	// them, to their values.
+	Settings map[string]string `json:"settings,omitempty"`
+
+	Files []File `json:"files,omitempty"`
+
+	// Reload, if not empty, is the command the nodes run once they wrote
+	// the files and changed the settings, such as to have a service read
+	// its files again; its failure rolls the bundle back.
+	Reload []string `json:"reload,omitempty"`
+}
+
+// Check returns an error if c is not valid content.
+func (c *Content) Check() error {
+	size := 0
+	paths := make(map[string]bool)
+	for _, f := range c.Files {
+		if f.Path == "" || filepath.Clean(f.Path) != f.Path {
+			return fmt.Errorf("confbundle: invalid path %q", f.Path)
+		}
+		if paths[f.Path] {
+			return fmt.Errorf("confbundle: %s written twice", f.Path)
+		}
+		paths[f.Path] = true
+		if f.Mode&^fs.ModePerm != 0 {
+			return fmt.Errorf("confbundle: %s: invalid mode %o", f.Path, f.Mode)
+		}
+		size += len(f.Data)
+	}
+	for name, v := range c.Settings {
+		size += len(name) + len(v)
+	}
+	if size > MaxSize {
+		return fmt.Errorf("confbundle: content of %d bytes, more than %d", size, MaxSize)
+	}
+	return nil
+}
+
+// A Bundle is a version of the configuration of a cluster.
+type Bundle struct {
+	// Version orders the bundles: every node applies the bundle of the
+	// highest version it knows of.
+	Version uint64    `json:"version"`
+	Created time.Time `json:"created"`
+
+	// Message describes the bundle, as a commit message does.
+	Message string `json:"message,omitempty"`
+
+	Content
+
+	// Chain is the certificate chain of the signer, leaf first, in DER.
+	Chain [][]byte `json:"chain,omitempty"`
+
+	// Signature is that of the signer over the other fields.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// signed returns the bytes b is signed over.
+func (b *Bundle) signed() ([]byte, error) {
+	return json.Marshal(struct {
+		Version uint64    `json:"version"`
+		Created time.Time `json:"created"`
+		Message string    `json:"message"`
+		Content
+		Chain [][]byte `json:"chain"`
+	}{b.Version, b.Created, b.Message, b.Content, b.Chain})
+}
+
+// Sign signs b with signer, the key of the leaf of chain.
+func (b *Bundle) Sign(signer crypto.Signer, chain []*x509.Certificate) error {
+	b.Chain = nil
+	for _, c := range chain {
+		b.Chain = append(b.Chain, c.Raw)
+	}
+	data, err := b.signed()
+	if err != nil {
+		return err
+	}
+
+	// Ed25519 signs the message itself, the others its digest.
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	} else {
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	}
+	b.Signature, err = signer.Sign(rand.Reader, data, opts)
+	return err
+}
+
+// Verify checks that b was signed by the leaf of its chain, which must
+// lead to one of roots, and returns that leaf.
+func (b *Bundle) Verify(roots []*x509.Certificate) (*x509.Certificate, error) {
+	if len(b.Chain) == 0 {
+		return nil, errors.New("confbundle: unsigned bundle")
+	}
+	var chain []*x509.Certificate
+	for _, der := range b.Chain {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("confbundle: %w", err)
+		}
+		chain = append(chain, c)
+	}
+	if err := trust.VerifyChain(chain, roots); err != nil {
+		return nil, fmt.Errorf("confbundle: signer: %w", err)
+	}
+
+	data, err := b.signed()
+	if err != nil {
+		return nil, err
+	}
+	leaf := chain[0]
+	var alg x509.SignatureAlgorithm
+	switch leaf.PublicKeyAlgorithm {
+	case x509.Ed25519:
+		alg = x509.PureEd25519
+	case x509.ECDSA:
+		alg = x509.ECDSAWithSHA256
+	case x509.RSA:
+		alg = x509.SHA256WithRSA
+	default:
+		return nil, fmt.Errorf("confbundle: signer has a key of algorithm %v", leaf.PublicKeyAlgorithm)
+	}
+	if err := leaf.CheckSignature(alg, data, b.Signature); err != nil {
+		return nil, fmt.Errorf("confbundle: bad signature of %s: %w", leaf.Subject.CommonName, err)
+	}
+	return leaf, nil
+}
+
+// Signer returns the common name of the signer of b, or "" if b is not
+// signed.
+func (b *Bundle) Signer() string {
+	if len(b.Chain) == 0 {
+		return ""
+	}
+	c, err := x509.ParseCertificate(b.Chain[0])
+	if err != nil {
+		return ""
+	}
+	return c.Subject.CommonName
+}
+
+// Newer reports whether b comes after other, by version, then time of
+// creation, as of two bundles pushed to two nodes at once.
+func (b *Bundle) Newer(other *Bundle) bool {
+	if other == nil {
+		return true
+	}
+	if b.Version != other.Version {
+		return b.Version > other.Version
+	}
+	return b.Created.After(other.Created)
+}
@@ -0,0 +1,67 @@
+package confbundle_test
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"nih.software/confbundle"
+	"nih.software/trust/trustgen"
+)
+
+func TestBundle(t *testing.T) {
+	root, rootKey, err := trustgen.NewRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := trustgen.NewRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, kt := range []trustgen.KeyType{trustgen.Ed25519, trustgen.ECDSAP256, trustgen.RSA2048} {
+		leaf, key, err := trustgen.NewLeaf(root, rootKey, trustgen.WithKeyType(kt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &confbundle.Bundle{
+			Version: 1,
+			Created: time.Now(),
+			Content: confbundle.Content{
+				Settings: map[string]string{"exec-roles": "ops"},
+				Files:    []confbundle.File{{Path: "app.conf", Mode: 0644, Data: []byte("x")}},
+			},
+		}
+		if err := b.Sign(key, []*x509.Certificate{leaf, root}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := b.Verify([]*x509.Certificate{root}); err != nil || !got.Equal(leaf) {
+			t.Errorf("%v: verify: %v", kt, err)
+		}
+		if _, err := b.Verify([]*x509.Certificate{other}); err == nil {
+			t.Errorf("%v: verified with another root", kt)
+		}
+
+		b.Files[0].Data = []byte("y")
+		if _, err := b.Verify([]*x509.Certificate{root}); err == nil {
+			t.Errorf("%v: verified a changed bundle", kt)
+		}
+	}
+
+	for _, c := range []confbundle.Content{
+		{Files: []confbundle.File{{Path: "a/../b"}}},
+		{Files: []confbundle.File{{Path: ""}}},
+		{Files: []confbundle.File{{Path: "a"}, {Path: "a"}}},
+		{Files: []confbundle.File{{Path: "a", Mode: 01777}}},
+		{Files: []confbundle.File{{Path: "a", Data: make([]byte, confbundle.MaxSize+1)}}},
+	} {
+		if err := c.Check(); err == nil {
+			t.Errorf("%+v: no error", c.Files)
+		}
+	}
+
+	a := &confbundle.Bundle{Version: 2, Created: time.Now()}
+	if !a.Newer(nil) || !a.Newer(&confbundle.Bundle{Version: 1, Created: a.Created.Add(time.Hour)}) || a.Newer(&confbundle.Bundle{Version: 2, Created: a.Created}) {
+		t.Error("wrong order of bundles")
+	}
+}
@@ -0,0 +1,211 @@
+// Package cron parses the expressions of cron, which describe the times a
+// task recurs at, and computes the next of those times.
+//
+// An expression has five fields separated by spaces: the minute (0-59),
+// the hour (0-23), the day of the month (1-31), the month (1-12, or jan to
+// dec), and the day of the week (0-6 from Sunday, 7 for Sunday too, or sun
+// to sat). A field is a comma-separated list of values, ranges such as
+// 1-5, and * for every value, each of which may be followed by a step such
+// as */15 or 0-30/10; a value with a step, such as 5/15, stands for the
+// range from it to the greatest value. A time matches an expression if its
+// minute, hour, and month match their fields, and its day matches that of
+// the month or of the week: either if neither starts with *, or the other
+// if one does.
+//
+// An expression may also be one of @yearly (or @annually), @monthly,
+// @weekly, @daily (or @midnight), and @hourly, which stand for the
+// expressions of their name, or @every followed by a duration such as
+// 90s, for the times that duration apart.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule is a parsed expression.
+type Schedule struct {
+	spec string
+
+	// every is the duration of an expression of @every, if not zero.
+	every time.Duration
+
+	minute, hour, dom, month, dow uint64
+
+	// domAny and dowAny record whether the fields of the days start with
+	// *, which decides how they combine.
+	domAny, dowAny bool
+}
+
+// macros are the expressions of the names of @ expressions.
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// A field describes a field of an expression: its range and the names of
+// its values.
+type field struct {
+	name     string
+	min, max int
+	names    []string // names of the values from min
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	dowField    = field{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// Parse parses the expression spec.
+func Parse(spec string) (*Schedule, error) {
+	s := &Schedule{spec: spec}
+	expr := strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(expr, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("cron: invalid duration in %q, want at least 1s", spec)
+		}
+		s.every = every
+		return s, nil
+	}
+	if strings.HasPrefix(expr, "@") {
+		m, ok := macros[expr]
+		if !ok {
+			return nil, fmt.Errorf("cron: unknown expression %q", spec)
+		}
+		expr = m
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: %q has %d fields, want 5", spec, len(fields))
+	}
+	var err error
+	for i, f := range []struct {
+		field *field
+		bits  *uint64
+	}{
+		{&minuteField, &s.minute},
+		{&hourField, &s.hour},
+		{&domField, &s.dom},
+		{&monthField, &s.month},
+		{&dowField, &s.dow},
+	} {
+		if *f.bits, err = f.field.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("cron: %q: %v", spec, err)
+		}
+	}
+	// Sunday is 0 and 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parse returns the values of the field of f in text as bits.
+func (f *field) parse(text string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(text, ",") {
+		r, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q of %s", stepText, f.name)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		if r != "*" {
+			loText, hiText, isRange := strings.Cut(r, "-")
+			var err error
+			if lo, err = f.value(loText); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = f.value(hiText); err != nil {
+					return 0, err
+				}
+				if hi < lo {
+					return 0, fmt.Errorf("invalid range %q of %s", r, f.name)
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value returns the value of text in the field of f, a number or a name.
+func (f *field) value(text string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(text, name) {
+			return f.min + i, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q", f.name, text)
+	}
+	return v, nil
+}
+
+// String returns the expression s was parsed from.
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Next returns the first time of s after t, in the location of t, or the
+// zero time if there is none within five years, as for February 30.
+func (s *Schedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every).Truncate(time.Second)
+	}
+
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches reports whether the day of t matches the fields of the days
+// of s.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
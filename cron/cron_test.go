@@ -0,0 +1,82 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"nih.software/cron"
+)
+
+func TestNext(t *testing.T) {
+	// A Friday.
+	from := time.Date(2024, 5, 3, 10, 17, 30, 0, time.UTC)
+	for _, tt := range []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 5, 3, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 5, 3, 10, 30, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 5, 3, 10, 25, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, 5, 4, 3, 0, 0, 0, time.UTC)},
+		{"30 9-17/4 * * *", time.Date(2024, 5, 3, 13, 30, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon", time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 feb *", time.Date(2028, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 Jan-Mar,Dec *", time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches once neither is *.
+		{"0 0 13 * fri", time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 5, 3, 11, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2024, 5, 3, 10, 19, 0, 0, time.UTC)},
+		{"0 0 30 feb *", time.Time{}},
+	} {
+		s, err := cron.Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.want) {
+			t.Errorf("Parse(%q).Next = %v, want %v", tt.spec, got, tt.want)
+		}
+		if s.String() != tt.spec {
+			t.Errorf("String = %q, want %q", s, tt.spec)
+		}
+	}
+
+	// Times are those of the location of the time given.
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, _ := cron.Parse("0 3 * * *")
+	if got, want := s.Next(from.In(ny)), time.Date(2024, 5, 4, 3, 0, 0, 0, ny); !got.Equal(want) {
+		t.Errorf("Next in New York = %v, want %v", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"* * * foo *",
+		"@often",
+		"@every 10ms",
+		"@every soon",
+	} {
+		if _, err := cron.Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
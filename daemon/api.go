@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"nih.software/nihnet"
+	"nih.software/peers"
+	"nih.software/trust"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "api",
+		Summary: "serve the state of the node as JSON to dashboards and automation",
+		Handler: apiHandler,
+	})
+}
+
+// APIVersion is the version of the api service, the first segment of the
+// paths of its endpoints. Later versions keep the fields of earlier ones.
+const APIVersion = "v1"
+
+type peerIdentityKey struct{}
+
+// PeerIdentity returns the verified identity of the client of the request
+// whose context is ctx, as Handler puts it there. It reports false for
+// clients of the control socket, which have none.
+func PeerIdentity(ctx context.Context) (nihnet.Identity, bool) {
+	id, ok := ctx.Value(peerIdentityKey{}).(nihnet.Identity)
+	return id, ok
+}
+
+// A Cert describes a certificate, as the api service reports it.
+type Cert struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	Roles       []string  `json:"roles,omitempty"`
+	IsCA        bool      `json:"is_ca"`
+
+	// SHA256 is the hex SHA-256 fingerprint of the certificate, and
+	// KeyPin the pin of its public key, as returned by peers.Pin.
+	SHA256 string `json:"sha256"`
+	KeyPin string `json:"key_pin"`
+}
+
+func newCert(c *x509.Certificate) Cert {
+	sum := sha256.Sum256(c.Raw)
+	cert := Cert{
+		Subject:   c.Subject.String(),
+		Issuer:    c.Issuer.String(),
+		Serial:    c.SerialNumber.String(),
+		NotBefore: c.NotBefore,
+		NotAfter:  c.NotAfter,
+		DNSNames:  c.DNSNames,
+		Roles:     trust.Roles(c),
+		IsCA:      c.IsCA,
+		SHA256:    hex.EncodeToString(sum[:]),
+		KeyPin:    peers.Pin(c),
+	}
+	for _, ip := range c.IPAddresses {
+		cert.IPAddresses = append(cert.IPAddresses, ip.String())
+	}
+	return cert
+}
+
+func newCerts(chain []*x509.Certificate) []Cert {
+	certs := []Cert{}
+	for _, c := range chain {
+		certs = append(certs, newCert(c))
+	}
+	return certs
+}
+
+// CertInfo is the response of the api service's cert endpoint.
+type CertInfo struct {
+	// Chain is the chain the node presents, leaf first.
+	Chain []Cert `json:"chain"`
+
+	// Roots are the CA certificates the node trusts.
+	Roots []Cert `json:"roots"`
+}
+
+// Whoami is the response of the api service's whoami endpoint.
+type Whoami struct {
+	// Control is set for a client of the control socket, which has no
+	// certificate.
+	Control bool `json:"control,omitempty"`
+
+	// Chain is the chain the client presented, leaf first.
+	Chain []Cert `json:"chain,omitempty"`
+}
+
+// The api service has these endpoints, for clients that would rather not
+// speak RPC, such as dashboards:
+//
+//	GET /v1/status  the Status of the node
+//	GET /v1/peers   the peers the node knows, as Peers returns them
+//	GET /v1/cert    the CertInfo of the credentials the node serves
+//	GET /v1/whoami  the Whoami of the client
+//
+// Every response is JSON, errors included, as an object with an "error"
+// string.
+func apiHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	prefix := "/" + APIVersion
+
+	mux.HandleFunc("GET "+prefix+"/status", func(w http.ResponseWriter, r *http.Request) {
+		writeAPI(w, http.StatusOK, d.Status())
+	})
+
+	mux.HandleFunc("GET "+prefix+"/peers", func(w http.ResponseWriter, r *http.Request) {
+		writeAPI(w, http.StatusOK, d.Peers())
+	})
+
+	mux.HandleFunc("GET "+prefix+"/cert", func(w http.ResponseWriter, r *http.Request) {
+		b := d.Bundle()
+		writeAPI(w, http.StatusOK, &CertInfo{Chain: newCerts(b.Chain()), Roots: newCerts(b.Roots())})
+	})
+
+	mux.HandleFunc("GET "+prefix+"/whoami", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := PeerIdentity(r.Context())
+		if !ok {
+			writeAPI(w, http.StatusOK, &Whoami{Control: true})
+			return
+		}
+		writeAPI(w, http.StatusOK, &Whoami{Chain: newCerts(id.Chain)})
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPI(w, http.StatusNotFound, &apiError{Error: "no endpoint " + r.Method + " " + r.URL.Path})
+	})
+
+	return mux
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeAPI responds with the JSON encoding of v and status, which no cache
+// may keep.
+func writeAPI(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,67 @@
+package daemon
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"nih.software/log"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "bench",
+		Summary: "measure throughput to and from the node",
+		Handler: benchHandler,
+	})
+}
+
+// MaxBenchSize bounds the bytes of one request or response of the bench
+// service, so that a peer cannot keep the node busy for long.
+const MaxBenchSize = 1 << 30
+
+// BenchResult is the response of the bench service's discard endpoint.
+type BenchResult struct {
+	Bytes int64 `json:"bytes"`
+}
+
+// The bench service has these endpoints:
+//
+//	POST /discard  read and discard the body, responding with the BenchResult
+//	GET  /zero     respond with size zero bytes
+func benchHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /discard", func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, MaxBenchSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Default().Debug("daemon: bench: discarded", append(peerAttrs(r), "bytes", n)...)
+		writeJSON(w, &BenchResult{Bytes: n})
+	})
+
+	mux.HandleFunc("GET /zero", func(w http.ResponseWriter, r *http.Request) {
+		size, err := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		if err != nil || size < 0 || size > MaxBenchSize {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+
+		log.Default().Debug("daemon: bench: sending", append(peerAttrs(r), "bytes", size)...)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		io.CopyN(w, zeros{}, size)
+	})
+
+	return mux
+}
+
+// zeros is a reader of endless zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
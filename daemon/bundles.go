@@ -0,0 +1,726 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"nih.software/confbundle"
+	"nih.software/log"
+	"nih.software/rpc"
+	"nih.software/trust"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "bundles",
+		Summary: "distribute versioned configuration bundles to the cluster",
+		Handler: bundlesHandler,
+		Methods: bundlesMethods,
+	})
+}
+
+// DefaultBundlesFile is the name of the file of the configuration bundles
+// of a node in its state directory.
+const DefaultBundlesFile = "bundles.json"
+
+// bundleHistory is how many of the bundles it applied last a daemon keeps,
+// to roll back to.
+const bundleHistory = 10
+
+// bundleReloadTimeout bounds how long the reload command of a bundle
+// runs.
+const bundleReloadTimeout = time.Minute
+
+// BundlePush is the request of the push endpoint of the bundles service.
+type BundlePush struct {
+	Message string `json:"message,omitempty"`
+
+	confbundle.Content
+
+	// DryRun validates the content and reports the changes of its
+	// settings on the daemon, without pushing it.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// BundleRollback is the request of the rollback endpoint of the bundles
+// service.
+type BundleRollback struct {
+	Version uint64 `json:"version"`
+}
+
+// BundlePushed is the response of the push and rollback endpoints of the
+// bundles service.
+type BundlePushed struct {
+	// Version is that of the new bundle, zero for a dry run.
+	Version uint64 `json:"version"`
+
+	// Changes are those of the settings on the daemon, for a dry run.
+	Changes []ConfigChange `json:"changes,omitempty"`
+
+	// Nodes are the states of the nodes the bundle was offered to, the
+	// daemon first.
+	Nodes []BundleStatus `json:"nodes,omitempty"`
+}
+
+// BundleStatus is the state of the configuration bundles of a node.
+type BundleStatus struct {
+	Node string `json:"node"`
+
+	// Version is that of the bundle the node applied last, zero for
+	// none, at Applied.
+	Version uint64    `json:"version"`
+	Applied time.Time `json:"applied"`
+
+	// Failed is the version of a later bundle the node failed to apply,
+	// and rolled back, with Error, if any.
+	Failed uint64 `json:"failed,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BundleInfo describes a bundle of the history of a daemon, without the
+// data of its files.
+type BundleInfo struct {
+	Version  uint64            `json:"version"`
+	Created  time.Time         `json:"created"`
+	Message  string            `json:"message,omitempty"`
+	Signer   string            `json:"signer"`
+	Settings map[string]string `json:"settings,omitempty"`
+	Files    []string          `json:"files,omitempty"`
+	Reload   []string          `json:"reload,omitempty"`
+}
+
+// BundleLatest is the request of the bundles.Latest method: the version
+// and time of creation of the newest bundle the caller knows of.
+type BundleLatest struct {
+	Version uint64    `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+// BundleOffer is the response of the bundles.Latest method: a bundle
+// newer than that of the request, or none.
+type BundleOffer struct {
+	Bundle *confbundle.Bundle `json:"bundle,omitempty"`
+}
+
+// bundleState is what a daemon keeps of its bundles across restarts.
+type bundleState struct {
+	// History are the bundles the daemon applied, newest first: the first
+	// is the current configuration.
+	History []*confbundle.Bundle `json:"history,omitempty"`
+	Applied time.Time            `json:"applied"`
+
+	// Seen is the version and time of creation of the newest bundle the
+	// daemon verified, applied or not: it ignores older ones.
+	Seen BundleLatest `json:"seen"`
+
+	// Error is why the daemon failed to apply the bundle of Seen, if it
+	// did.
+	Error string `json:"error,omitempty"`
+}
+
+// bundleStore are the bundles of a daemon.
+type bundleStore struct {
+	// file is the file the state is kept in, if any.
+	file string
+
+	// applying serializes the application of bundles, which mu does not
+	// guard, so that the state may be read while a bundle reloads.
+	applying sync.Mutex
+
+	mu    sync.Mutex
+	state bundleState
+}
+
+// load reads the state of s from its file, if any.
+func (s *bundleStore) load() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.state); err != nil {
+		return fmt.Errorf("daemon: bundles %s: %w", s.file, err)
+	}
+	return nil
+}
+
+// save writes the state of s to its file, if any. The caller must hold
+// s.mu.
+func (s *bundleStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&s.state, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, data, 0600)
+}
+
+// current returns the bundle the daemon applied last, or nil.
+func (s *bundleStore) current() *confbundle.Bundle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.state.History) == 0 {
+		return nil
+	}
+	return s.state.History[0]
+}
+
+// seen reports whether b is not newer than the newest bundle the daemon
+// verified.
+func (s *bundleStore) seen(b *confbundle.Bundle) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !b.Newer(&confbundle.Bundle{Version: s.state.Seen.Version, Created: s.state.Seen.Created})
+}
+
+// configureBundle changes the live settings to those of the bundle the
+// daemon applied last, if any, as when it starts: Configure does not
+// keep them across restarts.
+func (d *Daemon) configureBundle() {
+	b := d.bundles.current()
+	if b == nil || len(b.Settings) == 0 {
+		return
+	}
+	if _, err := d.Configure(b.Settings, false); err != nil {
+		log.Default().Warn("daemon: bundle settings not applied", "version", b.Version, "err", err)
+	}
+}
+
+// BundleStatus returns the state of the bundles of the daemon.
+func (d *Daemon) BundleStatus() BundleStatus {
+	d.bundles.mu.Lock()
+	defer d.bundles.mu.Unlock()
+
+	st := &d.bundles.state
+	s := BundleStatus{Node: d.Bundle().Chain()[0].Subject.CommonName, Applied: st.Applied}
+	if len(st.History) > 0 {
+		s.Version = st.History[0].Version
+	}
+	if st.Error != "" {
+		s.Failed, s.Error = st.Seen.Version, st.Error
+	}
+	return s
+}
+
+// BundleHistory returns the bundles the daemon applied last, newest
+// first.
+func (d *Daemon) BundleHistory() []BundleInfo {
+	d.bundles.mu.Lock()
+	defer d.bundles.mu.Unlock()
+
+	list := []BundleInfo{}
+	for _, b := range d.bundles.state.History {
+		info := BundleInfo{
+			Version:  b.Version,
+			Created:  b.Created,
+			Message:  b.Message,
+			Signer:   b.Signer(),
+			Settings: b.Settings,
+			Reload:   b.Reload,
+		}
+		for _, f := range b.Files {
+			info.Files = append(info.Files, f.Path)
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+// verifyBundle checks that b was signed by the daemon, or by a node of
+// a role of the config roles.
+func (d *Daemon) verifyBundle(b *confbundle.Bundle) error {
+	leaf, err := b.Verify(d.Bundle().Roots())
+	if err != nil {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	}
+	self := d.Bundle().Chain()[0].Subject.CommonName
+	if roles := d.config().ConfigRoles; leaf.Subject.CommonName != self && !trust.HasRole(leaf, roles...) {
+		return rpc.Errorf(rpc.CodePermissionDenied, "bundle %d signed by %s, without a role of %s", b.Version, leaf.Subject.CommonName, strings.Join(roles, ", "))
+	}
+	return nil
+}
+
+// applyBundle applies b, unless the daemon verified a newer bundle, and
+// reports whether it did. It writes the files of b, removing those the
+// bundle it applied last wrote and b does not, changes the settings of
+// b, reloads the credentials of the daemon, as SIGHUP does, and runs the
+// reload command of b. If any of those fails, it puts the files and
+// settings back, and reloads again, before returning the error.
+func (d *Daemon) applyBundle(b *confbundle.Bundle) (bool, error) {
+	d.bundles.applying.Lock()
+	defer d.bundles.applying.Unlock()
+
+	if d.bundles.seen(b) {
+		return false, nil
+	}
+	if err := d.verifyBundle(b); err != nil {
+		return false, err
+	}
+
+	// Mark it seen first, so that a bundle that fails is not retried.
+	d.bundles.mu.Lock()
+	d.bundles.state.Seen = BundleLatest{Version: b.Version, Created: b.Created}
+	d.bundles.state.Error = ""
+	err := d.bundles.save()
+	d.bundles.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	prev := d.bundles.current()
+	if err := d.configureFiles(b, prev); err != nil {
+		log.Default().Error("daemon: bundle failed", "version", b.Version, "signer", b.Signer(), "err", err)
+		d.errs.add(fmt.Sprintf("bundle %d: %v", b.Version, err))
+
+		d.bundles.mu.Lock()
+		defer d.bundles.mu.Unlock()
+		d.bundles.state.Error = err.Error()
+		if serr := d.bundles.save(); serr != nil {
+			log.Default().Error("daemon: bundles not saved", "err", serr)
+		}
+		return true, err
+	}
+
+	log.Default().Info("daemon: bundle applied", "version", b.Version, "signer", b.Signer(), "message", b.Message)
+
+	d.bundles.mu.Lock()
+	defer d.bundles.mu.Unlock()
+	st := &d.bundles.state
+	st.History = append([]*confbundle.Bundle{b}, st.History...)
+	if len(st.History) > bundleHistory {
+		st.History = st.History[:bundleHistory]
+	}
+	st.Applied = time.Now()
+	return true, d.bundles.save()
+}
+
+// A fileSnapshot is the state of a file before a bundle wrote it.
+type fileSnapshot struct {
+	path   string
+	data   []byte
+	mode   fs.FileMode
+	exists bool
+}
+
+// restore puts the file of s back as it was.
+func (s *fileSnapshot) restore() error {
+	if !s.exists {
+		err := os.Remove(s.path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return writeFileAtomic(s.path, s.data, s.mode)
+}
+
+// configureFiles implements applyBundle, with prev the bundle the daemon
+// applied last, if any.
+func (d *Daemon) configureFiles(b, prev *confbundle.Bundle) (err error) {
+	if err := b.Check(); err != nil {
+		return err
+	}
+	if _, err := d.Configure(b.Settings, true); err != nil {
+		return err
+	}
+
+	// Take the files and settings as they are, to put them back.
+	write := make(map[string]bool)
+	var snaps []fileSnapshot
+	snapshot := func(path string) error {
+		s := fileSnapshot{path: path}
+		fi, err := os.Stat(path)
+		if err == nil {
+			s.data, err = os.ReadFile(path)
+			s.mode, s.exists = fi.Mode().Perm(), true
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		snaps = append(snaps, s)
+		return nil
+	}
+	for _, f := range b.Files {
+		write[f.Path] = true
+		if err := snapshot(f.Path); err != nil {
+			return err
+		}
+	}
+	var remove []string
+	if prev != nil {
+		for _, f := range prev.Files {
+			if !write[f.Path] {
+				remove = append(remove, f.Path)
+				if err := snapshot(f.Path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	old := make(map[string]string)
+	for _, s := range d.Settings() {
+		if _, ok := b.Settings[s.Name]; ok {
+			old[s.Name] = s.Value
+		}
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, s := range snaps {
+			if rerr := s.restore(); rerr != nil {
+				log.Default().Error("daemon: bundle file not restored", "file", s.path, "err", rerr)
+			}
+		}
+		if _, rerr := d.Configure(old, false); rerr != nil {
+			log.Default().Error("daemon: bundle settings not restored", "err", rerr)
+		}
+		d.Reload()
+		if prev != nil && len(prev.Reload) > 0 {
+			if rerr := runBundleReload(prev.Reload); rerr != nil {
+				log.Default().Error("daemon: reload of previous bundle failed", "version", prev.Version, "err", rerr)
+			}
+		}
+	}()
+
+	for _, f := range b.Files {
+		mode := f.Mode.Perm()
+		if mode == 0 {
+			mode = 0644
+		}
+		if err := writeFileAtomic(f.Path, f.Data, mode); err != nil {
+			return err
+		}
+	}
+	for _, path := range remove {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if _, err := d.Configure(b.Settings, false); err != nil {
+		return err
+	}
+	if err := d.Reload(); err != nil {
+		return fmt.Errorf("reload credentials: %w", err)
+	}
+	if len(b.Reload) > 0 {
+		return runBundleReload(b.Reload)
+	}
+	return nil
+}
+
+// runBundleReload runs the reload command of args, failing with the end
+// of its output.
+func runBundleReload(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), bundleReloadTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = 5 * time.Second
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	out = bytes.TrimSpace(out)
+	if i := bytes.LastIndexByte(out, '\n'); i >= 0 {
+		out = out[i+1:]
+	}
+	if len(out) > 0 {
+		return fmt.Errorf("reload %s: %v: %s", args[0], err, out)
+	}
+	return fmt.Errorf("reload %s: %v", args[0], err)
+}
+
+// PushBundle signs a bundle of the content of p, at the version after
+// the newest the daemon knows of, applies it, and offers it to every node
+// the daemon knows and reaches. The daemon does not offer a bundle it
+// failed to apply.
+func (d *Daemon) PushBundle(ctx context.Context, p BundlePush) (*BundlePushed, error) {
+	if err := p.Check(); err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	}
+	if p.DryRun {
+		changes, err := d.Configure(p.Settings, true)
+		if err != nil {
+			return nil, rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+		}
+		return &BundlePushed{Changes: changes}, nil
+	}
+
+	d.bundles.mu.Lock()
+	version := d.bundles.state.Seen.Version + 1
+	d.bundles.mu.Unlock()
+
+	b := &confbundle.Bundle{Version: version, Created: time.Now(), Message: p.Message, Content: p.Content}
+	if err := b.Sign(d.Bundle().Signer(), d.Bundle().Chain()); err != nil {
+		return nil, err
+	}
+	pushed := &BundlePushed{Version: version}
+	if _, err := d.applyBundle(b); err != nil {
+		pushed.Nodes = []BundleStatus{d.BundleStatus()}
+		return pushed, nil
+	}
+	pushed.Nodes = append([]BundleStatus{d.BundleStatus()}, d.offerBundle(ctx, b)...)
+	return pushed, nil
+}
+
+// RollbackBundle pushes the content of the bundle of version of the
+// history of the daemon again, as a new version.
+func (d *Daemon) RollbackBundle(ctx context.Context, version uint64) (*BundlePushed, error) {
+	var old *confbundle.Bundle
+	d.bundles.mu.Lock()
+	for _, b := range d.bundles.state.History {
+		if b.Version == version {
+			old = b
+		}
+	}
+	d.bundles.mu.Unlock()
+	if old == nil {
+		return nil, rpc.Errorf(rpc.CodeNotFound, "no bundle %d in the history", version)
+	}
+	return d.PushBundle(ctx, BundlePush{Message: fmt.Sprintf("roll back to %d", version), Content: old.Content})
+}
+
+// offerBundle offers b to every node the daemon knows and reaches at
+// once, returning their states.
+func (d *Daemon) offerBundle(ctx context.Context, b *confbundle.Bundle) []BundleStatus {
+	return d.eachBundleNode(ctx, d.kvNodes(), func(ctx context.Context, client *rpc.Client) (BundleStatus, error) {
+		return rpc.Call[*confbundle.Bundle, BundleStatus](ctx, client, "bundles.Offer", b)
+	})
+}
+
+// BundleStatuses returns the states of the bundles of the daemon and of
+// every node it knows and reaches.
+func (d *Daemon) BundleStatuses(ctx context.Context) []BundleStatus {
+	return append([]BundleStatus{d.BundleStatus()}, d.eachBundleNode(ctx, d.kvNodes(), func(ctx context.Context, client *rpc.Client) (BundleStatus, error) {
+		return rpc.Call[struct{}, BundleStatus](ctx, client, "bundles.Status", struct{}{})
+	})...)
+}
+
+// eachBundleNode calls f for every node of nodes at once, with a client
+// connected to it, returning the states f returns, or the errors.
+func (d *Daemon) eachBundleNode(ctx context.Context, nodes []string, f func(ctx context.Context, client *rpc.Client) (BundleStatus, error)) []BundleStatus {
+	statuses := make([]BundleStatus, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := d.callBundleNode(ctx, node, f)
+			if err != nil {
+				s = BundleStatus{Error: err.Error()}
+			}
+			statuses[i] = s
+			statuses[i].Node = node
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+// callBundleNode calls f with the client of node.
+func (d *Daemon) callBundleNode(ctx context.Context, node string, f func(ctx context.Context, client *rpc.Client) (BundleStatus, error)) (BundleStatus, error) {
+	p, ok := d.node(node)
+	if !ok {
+		return BundleStatus{}, fmt.Errorf("%s unreachable", node)
+	}
+	client, err := d.client(ctx, p.Addr, p.Name)
+	if err != nil {
+		return BundleStatus{}, err
+	}
+	return f(ctx, client)
+}
+
+// pullBundles asks every node the daemon knows and reaches for a newer
+// bundle than it applied every peer interval, and applies those they
+// offer, so that the nodes a push did not reach catch up. It returns
+// once ctx is done.
+func (d *Daemon) pullBundles(ctx context.Context) {
+	for {
+		t := time.NewTimer(d.config().PeerInterval)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+
+		// Without config roles, the daemon only applies its own bundles.
+		if len(d.config().ConfigRoles) == 0 {
+			continue
+		}
+		for _, node := range d.kvNodes() {
+			d.pullBundle(ctx, node)
+		}
+	}
+}
+
+// pullBundle asks node for a newer bundle, and applies it.
+func (d *Daemon) pullBundle(ctx context.Context, node string) {
+	ctx, cancel := context.WithTimeout(ctx, peerProbeTimeout)
+	defer cancel()
+
+	d.bundles.mu.Lock()
+	seen := d.bundles.state.Seen
+	d.bundles.mu.Unlock()
+
+	var offer BundleOffer
+	_, err := d.callBundleNode(ctx, node, func(ctx context.Context, client *rpc.Client) (_ BundleStatus, err error) {
+		offer, err = rpc.Call[BundleLatest, BundleOffer](ctx, client, "bundles.Latest", seen)
+		return BundleStatus{}, err
+	})
+	if err != nil {
+		log.Default().Debug("daemon: bundles not pulled", "node", node, "err", err)
+		return
+	}
+	if offer.Bundle == nil {
+		return
+	}
+	if _, err := d.applyBundle(offer.Bundle); err != nil {
+		log.Default().Warn("daemon: pulled bundle not applied", "node", node, "version", offer.Bundle.Version, "err", err)
+	}
+}
+
+// bundlesFrom checks the caller of a method of the bundles service may
+// exchange bundles with the daemon.
+func (d *Daemon) bundlesFrom(ctx context.Context) error {
+	leaf, roles := rpcLeaf(ctx), d.config().ConfigRoles
+	switch {
+	case leaf == nil || trust.HasRole(leaf, roles...):
+		return nil
+	case len(roles) == 0:
+		return rpc.Errorf(rpc.CodePermissionDenied, "bundles are disabled for peers")
+	}
+	return rpc.Errorf(rpc.CodePermissionDenied, "bundles require a role of %s", strings.Join(roles, ", "))
+}
+
+func bundlesMethods(d *Daemon, s *rpc.Server) {
+	// A node applies the bundles of its own config roles only, whoever
+	// offers them.
+	rpc.Register(s, "bundles.Offer", nil, func(ctx context.Context, b *confbundle.Bundle) (BundleStatus, error) {
+		if err := d.bundlesFrom(ctx); err != nil {
+			return BundleStatus{}, err
+		}
+		if b == nil {
+			return BundleStatus{}, rpc.Errorf(rpc.CodeInvalidArgument, "no bundle")
+		}
+		if _, err := d.applyBundle(b); rpc.ErrorCode(err) == rpc.CodeInvalidArgument || rpc.ErrorCode(err) == rpc.CodePermissionDenied {
+			return BundleStatus{}, err
+		}
+		return d.BundleStatus(), nil
+	})
+
+	rpc.Register(s, "bundles.Latest", nil, func(ctx context.Context, seen BundleLatest) (BundleOffer, error) {
+		if err := d.bundlesFrom(ctx); err != nil {
+			return BundleOffer{}, err
+		}
+		b := d.bundles.current()
+		if b == nil || !b.Newer(&confbundle.Bundle{Version: seen.Version, Created: seen.Created}) {
+			return BundleOffer{}, nil
+		}
+		return BundleOffer{Bundle: b}, nil
+	})
+
+	rpc.Register(s, "bundles.Status", nil, func(ctx context.Context, _ struct{}) (BundleStatus, error) {
+		if err := d.bundlesFrom(ctx); err != nil {
+			return BundleStatus{}, err
+		}
+		return d.BundleStatus(), nil
+	})
+}
+
+// The bundles service has these endpoints:
+//
+//	GET  /status     the BundleStatus of the daemon, or with all=1, those
+//	                 of every node it knows and reaches too
+//	GET  /history    the BundleInfo of the bundles the daemon applied last,
+//	                 newest first
+//	POST /push       push the BundlePush of the request, responding with
+//	                 BundlePushed
+//	POST /rollback   push the bundle of the BundleRollback of the request
+//	                 again, likewise
+//
+// Peers need a role of the config roles.
+func bundlesHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "bundles", d.config().ConfigRoles) {
+			return
+		}
+		if r.URL.Query().Get("all") != "" {
+			writeJSON(w, d.BundleStatuses(r.Context()))
+			return
+		}
+		writeJSON(w, []BundleStatus{d.BundleStatus()})
+	})
+
+	mux.HandleFunc("GET /history", func(w http.ResponseWriter, r *http.Request) {
+		if d.authorize(w, r, "bundles", d.config().ConfigRoles) {
+			writeJSON(w, d.BundleHistory())
+		}
+	})
+
+	mux.HandleFunc("POST /push", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "bundles", d.config().ConfigRoles) {
+			return
+		}
+
+		var p BundlePush
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*confbundle.MaxSize)).Decode(&p); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		pushed, err := d.PushBundle(r.Context(), p)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		if !p.DryRun {
+			log.Default().Info("daemon: bundle pushed", append(peerAttrs(r), "version", pushed.Version, "nodes", len(pushed.Nodes))...)
+		}
+		writeJSON(w, pushed)
+	})
+
+	mux.HandleFunc("POST /rollback", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "bundles", d.config().ConfigRoles) {
+			return
+		}
+
+		var rb BundleRollback
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&rb); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		pushed, err := d.RollbackBundle(r.Context(), rb.Version)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+
+		log.Default().Info("daemon: bundle rolled back", append(peerAttrs(r), "to", rb.Version, "version", pushed.Version)...)
+		writeJSON(w, pushed)
+	})
+
+	return mux
+}
@@ -0,0 +1,375 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"nih.software/log"
+	"nih.software/nihnet"
+	"nih.software/rpc"
+)
+
+// A Setting is a configuration value of a running daemon, named after
+// the flag of nih serve that sets it.
+type Setting struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+
+	// Live reports whether the setting can be changed while the daemon runs.
+	Live bool `json:"live"`
+}
+
+// A ConfigChange is a change of the value of a setting.
+type ConfigChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// ConfigUpdate is the request of the admin service's config endpoint.
+type ConfigUpdate struct {
+	// Set maps the names of settings to their new values.
+	Set map[string]string `json:"set"`
+
+	// DryRun validates the new values and reports the changes
+	// without applying them.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// A setting describes how to read and write a configuration value.
+// Only live settings have set.
+type setting struct {
+	name string
+	get  func(c *Config) string
+	set  func(c *Config, v string) error
+}
+
+var settings = []setting{
+	{
+		name: "listen",
+		get:  func(c *Config) string { return c.Addr },
+	},
+	{
+		name: "control",
+		get:  func(c *Config) string { return c.Control },
+	},
+	{
+		name: "exec-roles",
+		get:  func(c *Config) string { return strings.Join(c.ExecRoles, ",") },
+		set: func(c *Config, v string) (err error) {
+			c.ExecRoles, err = parseList(v, "role", nil)
+			return err
+		},
+	},
+	{
+		name: "file-roles",
+		get:  func(c *Config) string { return strings.Join(c.FileRoles, ",") },
+		set: func(c *Config, v string) (err error) {
+			c.FileRoles, err = parseList(v, "role", nil)
+			return err
+		},
+	},
+	{
+		name: "kv-roles",
+		get:  func(c *Config) string { return strings.Join(c.KVRoles, ",") },
+		set: func(c *Config, v string) (err error) {
+			c.KVRoles, err = parseList(v, "role", nil)
+			return err
+		},
+	},
+	{
+		name: "job-roles",
+		get:  func(c *Config) string { return strings.Join(c.JobRoles, ",") },
+		set: func(c *Config, v string) (err error) {
+			c.JobRoles, err = parseList(v, "role", nil)
+			return err
+		},
+	},
+	{
+		name: "secret-roles",
+		get:  func(c *Config) string { return strings.Join(c.SecretRoles, ",") },
+		set: func(c *Config, v string) (err error) {
+			c.SecretRoles, err = parseList(v, "role", nil)
+			return err
+		},
+	},
+	{
+		name: "config-roles",
+		get:  func(c *Config) string { return strings.Join(c.ConfigRoles, ",") },
+		set: func(c *Config, v string) (err error) {
+			c.ConfigRoles, err = parseList(v, "role", nil)
+			return err
+		},
+	},
+	{
+		name: "peers",
+		get:  func(c *Config) string { return strings.Join(c.Peers, ",") },
+		set: func(c *Config, v string) (err error) {
+			c.Peers, err = parseList(v, "address", func(s string) error {
+				_, _, err := net.SplitHostPort(s)
+				return err
+			})
+			return err
+		},
+	},
+	{
+		name: "peer-interval",
+		get:  func(c *Config) string { return c.PeerInterval.String() },
+		set: func(c *Config, v string) (err error) {
+			c.PeerInterval, err = parsePositiveDuration(v)
+			return err
+		},
+	},
+	{
+		name: "shutdown-timeout",
+		get:  func(c *Config) string { return c.ShutdownTimeout.String() },
+		set: func(c *Config, v string) (err error) {
+			c.ShutdownTimeout, err = parsePositiveDuration(v)
+			return err
+		},
+	},
+	{
+		name: "max-conns",
+		get:  func(c *Config) string { return strconv.Itoa(c.MaxConns) },
+		set: func(c *Config, v string) (err error) {
+			c.MaxConns, err = parseLimit(v)
+			return err
+		},
+	},
+	{
+		name: "max-peer-conns",
+		get:  func(c *Config) string { return strconv.Itoa(c.MaxPeerConns) },
+		set: func(c *Config, v string) (err error) {
+			c.MaxPeerConns, err = parseLimit(v)
+			return err
+		},
+	},
+	{
+		name: "handshake-rate",
+		get:  func(c *Config) string { return formatRate(c.HandshakeRate) },
+		set: func(c *Config, v string) (err error) {
+			c.HandshakeRate, err = parseRate(v)
+			return err
+		},
+	},
+	{
+		name: "peer-handshake-rate",
+		get:  func(c *Config) string { return formatRate(c.PeerHandshakeRate) },
+		set: func(c *Config, v string) (err error) {
+			c.PeerHandshakeRate, err = parseRate(v)
+			return err
+		},
+	},
+	{
+		name: "max-calls",
+		get:  func(c *Config) string { return strconv.Itoa(c.MaxCalls) },
+		set: func(c *Config, v string) (err error) {
+			c.MaxCalls, err = parseLimit(v)
+			return err
+		},
+	},
+	{
+		name: "max-peer-calls",
+		get:  func(c *Config) string { return strconv.Itoa(c.MaxPeerCalls) },
+		set: func(c *Config, v string) (err error) {
+			c.MaxPeerCalls, err = parseLimit(v)
+			return err
+		},
+	},
+}
+
+// parseList parses a comma-separated list, checking each element with check
+// if not nil. The empty string is the empty list.
+func parseList(v, what string, check func(string) error) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return nil, errors.New("empty " + what)
+		}
+		if check != nil {
+			if err := check(s); err != nil {
+				return nil, err
+			}
+		}
+		list = append(list, s)
+	}
+
+	return list, nil
+}
+
+func parsePositiveDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("must be positive")
+	}
+	return d, nil
+}
+
+// parseLimit parses a limit, of which 0 means none.
+func parseLimit(v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	if n < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return n, nil
+}
+
+// parseRate parses a limit of a rate a second, of which 0 means none.
+func parseRate(v string) (float64, error) {
+	r, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsInf(r, 0) || math.IsNaN(r) {
+		return 0, errors.New("not a number")
+	}
+	if r < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return r, nil
+}
+
+func formatRate(r float64) string {
+	return strconv.FormatFloat(r, 'g', -1, 64)
+}
+
+// setLimits has the listener and RPC server of d enforce the limits of
+// cfg.
+func (d *Daemon) setLimits(cfg *Config) {
+	d.limiter.SetLimits(nihnet.Limits{
+		Conns:             cfg.MaxConns,
+		PeerConns:         cfg.MaxPeerConns,
+		HandshakeRate:     cfg.HandshakeRate,
+		PeerHandshakeRate: cfg.PeerHandshakeRate,
+	})
+	d.rpc.SetLimits(rpc.Limits{Calls: cfg.MaxCalls, PeerCalls: cfg.MaxPeerCalls})
+}
+
+// config returns the current configuration. Its live settings may change
+// at any time with Configure, so code running while the daemon serves
+// reads them from here rather than from d.cfg.
+func (d *Daemon) config() Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.cfg
+}
+
+// Settings returns the current configuration, in name order.
+func (d *Daemon) Settings() []Setting {
+	cfg := d.config()
+
+	var ss []Setting
+	for _, s := range settings {
+		ss = append(ss, Setting{Name: s.name, Value: s.get(&cfg), Live: s.set != nil})
+	}
+
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Name < ss[j].Name
+	})
+
+	return ss
+}
+
+// Configure sets the named settings to new values, in the form of Settings,
+// and returns the changes in name order. It fails without changing anything
+// if a name is unknown, a value is invalid, or a setting is not live.
+// With dryRun, it only returns the changes.
+func (d *Daemon) Configure(values map[string]string, dryRun bool) ([]ConfigChange, error) {
+	changes, peers, err := d.configure(values, dryRun)
+	if err != nil || dryRun || len(changes) == 0 {
+		return changes, err
+	}
+
+	for _, c := range changes {
+		log.Default().Info("daemon: config", "name", c.Name, "old", c.Old, "new", c.New)
+	}
+
+	d.known.setStatic(d.targets(peers))
+
+	// Wake the prober to probe new peers and wait the new interval.
+	select {
+	case d.reconfigured <- struct{}{}:
+	default:
+	}
+
+	return changes, nil
+}
+
+// configure implements Configure under d.mu, returning the new static peers.
+func (d *Daemon) configure(values map[string]string, dryRun bool) ([]ConfigChange, []string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	next := d.cfg
+	changes := []ConfigChange{}
+	for name, v := range values {
+		i := settingIndex(name)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("unknown setting %q", name)
+		}
+
+		s := settings[i]
+		if s.set == nil {
+			return nil, nil, fmt.Errorf("%s cannot be changed while the daemon runs; restart nih serve with -%s", name, name)
+		}
+
+		old := s.get(&next)
+		if err := s.set(&next, v); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		if v := s.get(&next); v != old {
+			changes = append(changes, ConfigChange{Name: name, Old: old, New: v})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	if !dryRun {
+		// Only the live settings: the others are read without d.mu.
+		d.cfg.ExecRoles = next.ExecRoles
+		d.cfg.FileRoles = next.FileRoles
+		d.cfg.KVRoles = next.KVRoles
+		d.cfg.JobRoles = next.JobRoles
+		d.cfg.SecretRoles = next.SecretRoles
+		d.cfg.ConfigRoles = next.ConfigRoles
+		d.cfg.Peers = next.Peers
+		d.cfg.PeerInterval = next.PeerInterval
+		d.cfg.ShutdownTimeout = next.ShutdownTimeout
+		d.cfg.MaxConns = next.MaxConns
+		d.cfg.MaxPeerConns = next.MaxPeerConns
+		d.cfg.HandshakeRate = next.HandshakeRate
+		d.cfg.PeerHandshakeRate = next.PeerHandshakeRate
+		d.cfg.MaxCalls = next.MaxCalls
+		d.cfg.MaxPeerCalls = next.MaxPeerCalls
+		d.setLimits(&d.cfg)
+	}
+
+	return changes, next.Peers, nil
+}
+
+func settingIndex(name string) int {
+	for i, s := range settings {
+		if s.name == name {
+			return i
+		}
+	}
+	return -1
+}
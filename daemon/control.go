@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	stdlog "log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"nih.software/log"
+)
+
+// DefaultControl is the path of the control socket unless configured otherwise.
+const DefaultControl = "run/nih.sock"
+
+// ListenControl creates the control socket at path, replacing a stale one,
+// for ServeListeners. Only the owner of the daemon may connect: the socket
+// is created in a directory that only the owner can enter, and where the
+// system tells, the daemon also closes connections of other users but root.
+// On Windows, it is a unix-domain socket as well.
+func ListenControl(ctx context.Context, path string) (*net.UnixListener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// A socket left behind by a daemon that did not shut down cleanly
+	// refuses connections; one that accepts them belongs to a live daemon.
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, errors.New("daemon: control socket " + path + " is in use")
+	}
+	os.Remove(path)
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln.(*net.UnixListener), nil
+}
+
+// controlListener accepts the connections to the control socket of
+// processes of the user running the daemon, or of root, where the system
+// tells who they are. Elsewhere, as on Windows, only the permissions of the
+// socket keep other users out.
+type controlListener struct {
+	net.Listener
+}
+
+func (l controlListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		uid, ok, err := peerUID(c)
+		switch {
+		case err != nil:
+			log.Default().Warn("daemon: control connection", "err", err)
+		case ok && uid != os.Getuid() && uid != 0:
+			log.Default().Warn("daemon: control connection denied", "uid", uid)
+		default:
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+// maxErrors is the number of recent errors a daemon keeps for its status.
+const maxErrors = 10
+
+// An Error is an error that occurred in a daemon, as reported in its status.
+type Error struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// errorRing keeps the most recent errors.
+type errorRing struct {
+	mu   sync.Mutex
+	errs []Error
+}
+
+func (r *errorRing) add(msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errs = append(r.errs, Error{Time: time.Now(), Message: msg})
+	if len(r.errs) > maxErrors {
+		r.errs = append(r.errs[:0], r.errs[len(r.errs)-maxErrors:]...)
+	}
+}
+
+func (r *errorRing) list() []Error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Error{}, r.errs...)
+}
+
+// errorLog returns the error log of the servers, which records every line
+// as a recent error and logs it at debug level.
+func (d *Daemon) errorLog() *stdlog.Logger {
+	return stdlog.New(errorWriter{d}, "", 0)
+}
+
+type errorWriter struct {
+	d *Daemon
+}
+
+func (w errorWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	w.d.errs.add(msg)
+	log.Default().Debug("daemon: " + msg)
+	return len(p), nil
+}
+
+// connState counts the open connections of the TLS server.
+func (d *Daemon) connState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		d.peers.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		d.peers.Add(-1)
+	}
+}
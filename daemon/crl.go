@@ -0,0 +1,178 @@
+package daemon
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"nih.software/log"
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "crl",
+		Summary: "accept and list certificate revocation lists",
+		Handler: crlHandler,
+	})
+}
+
+// maxCRLSize bounds the size of a posted revocation list.
+const maxCRLSize = 1 << 20
+
+// revocations holds the newest revocation list of every CA that published one,
+// by the key identifier of the CA.
+type revocations struct {
+	mu    sync.Mutex
+	lists map[string]*revocationList
+}
+
+type revocationList struct {
+	*x509.RevocationList
+	issuer  *x509.Certificate
+	serials map[string]bool
+}
+
+// CRL describes a revocation list in effect, as listed by the crl service.
+type CRL struct {
+	Issuer     string    `json:"issuer"`
+	Number     string    `json:"number"`
+	ThisUpdate time.Time `json:"this_update"`
+	NextUpdate time.Time `json:"next_update"`
+	Revoked    int       `json:"revoked"`
+}
+
+// AddCRL puts a revocation list in effect for new connections.
+// The list must be signed by issuer, the first certificate of chain, which
+// must lead to the roots of the current credentials. A list replaces one
+// from the same issuer only if its number is higher.
+func (d *Daemon) AddCRL(crl *x509.RevocationList, chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return errors.New("daemon: revocation list without issuer")
+	}
+	issuer := chain[0]
+
+	if err := trust.VerifyChain(chain, d.Bundle().Roots()); err != nil {
+		return fmt.Errorf("daemon: revocation list issuer: %w", err)
+	}
+
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return fmt.Errorf("daemon: revocation list: %w", err)
+	}
+
+	l := &revocationList{RevocationList: crl, issuer: issuer, serials: make(map[string]bool)}
+	for _, e := range crl.RevokedCertificateEntries {
+		l.serials[e.SerialNumber.String()] = true
+	}
+
+	d.crls.mu.Lock()
+	defer d.crls.mu.Unlock()
+
+	key := string(issuer.SubjectKeyId)
+	if old := d.crls.lists[key]; old != nil && number(old.Number).Cmp(number(crl.Number)) >= 0 {
+		return fmt.Errorf("daemon: revocation list %v of %s is not newer than %v", crl.Number, issuer.Subject, old.Number)
+	}
+
+	if d.crls.lists == nil {
+		d.crls.lists = make(map[string]*revocationList)
+	}
+	d.crls.lists[key] = l
+
+	log.Default().Info("daemon: revocation list in effect",
+		"issuer", issuer.Subject.String(), "number", crl.Number, "revoked", len(l.serials))
+	return nil
+}
+
+func number(n *big.Int) *big.Int {
+	if n == nil {
+		return new(big.Int)
+	}
+	return n
+}
+
+// CRLs returns the revocation lists in effect.
+func (d *Daemon) CRLs() []*CRL {
+	d.crls.mu.Lock()
+	defer d.crls.mu.Unlock()
+
+	var crls []*CRL
+	for _, l := range d.crls.lists {
+		crls = append(crls, &CRL{
+			Issuer:     l.issuer.Subject.String(),
+			Number:     number(l.Number).String(),
+			ThisUpdate: l.ThisUpdate,
+			NextUpdate: l.NextUpdate,
+			Revoked:    len(l.serials),
+		})
+	}
+
+	sort.Slice(crls, func(i, j int) bool {
+		return crls[i].Issuer < crls[j].Issuer
+	})
+
+	return crls
+}
+
+// checkRevoked returns an error if a revocation list in effect
+// lists a certificate of chain.
+func (d *Daemon) checkRevoked(chain []*x509.Certificate) error {
+	d.crls.mu.Lock()
+	defer d.crls.mu.Unlock()
+
+	for i, c := range chain {
+		l := d.crls.lists[string(c.AuthorityKeyId)]
+		if l != nil && l.serials[c.SerialNumber.String()] {
+			return fmt.Errorf("chain[%d]: serial %v revoked by %s", i, c.SerialNumber, l.issuer.Subject)
+		}
+	}
+
+	return nil
+}
+
+func crlHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		crls := d.CRLs()
+		if crls == nil {
+			crls = []*CRL{}
+		}
+		writeJSON(w, crls)
+	})
+
+	// The body is a PEM X509 CRL block followed by the chain of its issuer.
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxCRLSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		crl, err := trustgen.ParseCRLPEM(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		chain, err := trust.ParseCertificatesPEM(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := d.AddCRL(crl, chain); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
@@ -0,0 +1,684 @@
+// Package daemon runs a nih node: a long-running server that accepts
+// mutually authenticated TLS connections from other instances and hosts
+// the registered services on them.
+//
+// Services are HTTP handlers mounted under their name, so the health service
+// answers at /health/. Every request has been authenticated by the TLS
+// handshake; the peer's chain is in the request's TLS connection state, and
+// its identity in the request's context. The api service serves the state
+// of the node as JSON at /api/v1/, for clients other than the CLI.
+//
+// Services may also register RPC methods, served to connections that
+// negotiate rpc.Proto on the same port. The protocols other than HTTP that
+// the daemon speaks are in the registry returned by Protocols, which
+// negotiates their versions with every client.
+package daemon
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nih.software/gossip"
+	"nih.software/health"
+	"nih.software/hlc"
+	"nih.software/jobs"
+	"nih.software/kv"
+	"nih.software/log"
+	"nih.software/nihnet"
+	"nih.software/peers"
+	"nih.software/pubsub"
+	"nih.software/rpc"
+	"nih.software/trust"
+	"nih.software/trust/join"
+)
+
+// DefaultAddr is the address a node listens on unless configured otherwise.
+const DefaultAddr = ":7443"
+
+// A Service is a named part of the daemon's API.
+type Service struct {
+	// Name is the path segment the service is mounted under, e.g. "health".
+	Name string
+
+	// Summary is a one-line description of the service.
+	Summary string
+
+	// Handler returns the handler of the service in d.
+	// Requests reach it with their path relative to the mount point,
+	// so "/health/" arrives as "/". It may be nil for a service with
+	// methods only.
+	Handler func(d *Daemon) http.Handler
+
+	// Methods registers the RPC methods of the service in d with s,
+	// named after the service, such as "health.Check". It may be nil.
+	Methods func(d *Daemon, s *rpc.Server)
+}
+
+var (
+	servicesMu sync.Mutex
+	services   []*Service
+)
+
+// Register adds a service to every daemon started afterwards.
+// It panics if the name is already taken.
+func Register(s *Service) {
+	servicesMu.Lock()
+	defer servicesMu.Unlock()
+
+	if strings.Contains(s.Name, "/") || s.Name == "" {
+		panic("daemon: invalid service name " + s.Name)
+	}
+
+	for _, t := range services {
+		if t.Name == s.Name {
+			panic("daemon: duplicate service " + s.Name)
+		}
+	}
+
+	services = append(services, s)
+}
+
+// Services returns the registered services in name order.
+func Services() []*Service {
+	servicesMu.Lock()
+	defer servicesMu.Unlock()
+
+	ss := append([]*Service(nil), services...)
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Name < ss[j].Name
+	})
+
+	return ss
+}
+
+// Config configures a Daemon. Its live settings, as reported by
+// Daemon.Settings, can be changed while the daemon runs with Daemon.Configure.
+type Config struct {
+	// Addr is the TCP address to listen on. Empty means DefaultAddr.
+	Addr string
+
+	// Control is the path of the control socket, a unix-domain socket
+	// serving the same services to local clients without TLS.
+	// Empty means no control socket.
+	Control string
+
+	// Join serves nodes joining the cluster, usually with a *join.Server.
+	// It receives every request on connections that negotiate join.Proto,
+	// which need no client certificate, and requests for /join/renew of
+	// peers, renewing the certificate they authenticated with. Nil means
+	// the daemon does not accept joining nodes.
+	Join http.Handler
+
+	// ExecRoles are the roles, as returned by trust.Roles, allowed to run
+	// commands with the exec service. Empty means peers cannot run commands;
+	// clients of the control socket always can.
+	ExecRoles []string
+
+	// FileRoles are the roles allowed to read and write files with the
+	// files service, as ExecRoles are for the exec service.
+	FileRoles []string
+
+	// Peers are the addresses of other nodes, which the daemon probes
+	// every PeerInterval and reports with the nodes that connect to it.
+	Peers []string
+
+	// Book is the address book of the node, whose peers the daemon probes
+	// with those of Peers, checking that they present the identities
+	// expected of them. The daemon reads it again for every round of
+	// probes. Nil means no address book.
+	Book *peers.Book
+
+	// Finders find more peers for the daemon to probe, at the start of
+	// every round of probes, such as by multicast DNS. Peers found of the
+	// name of the daemon, or of a peer of the address book, are skipped.
+	// The daemon only reports a peer found as ok once it presents a
+	// certificate of the name found.
+	Finders []peers.Finder
+
+	// PeerInterval is how often the daemon probes each peer, give or take
+	// a fifth, pinging its health service over a connection it keeps to
+	// it, and how often it reads the address book and runs the finders.
+	// Zero means DefaultPeerInterval.
+	PeerInterval time.Duration
+
+	// HealthChanged, if not nil, is called whenever the health of a peer
+	// the daemon probes changes, with the name of the peer, or the address
+	// of one of Peers. It must not block for long.
+	HealthChanged func(health.Change)
+
+	// Gossip, if not nil, has the daemon keep the membership of the
+	// cluster by gossip with the other daemons that gossip, which it
+	// reports with its peers. It joins them through the peers it probes
+	// whenever it knows no other member alive, and leaves them when it
+	// shuts down. The name, address, and transport of the configuration
+	// are the daemon's own: the common name of its certificate, the
+	// address it listens on, and RPC.
+	Gossip *gossip.Config
+
+	// Topics are the rules of the topics of the pubsub service: which
+	// peers may publish and subscribe to which topics, and which nodes may
+	// forward the messages published to them to the daemon. Nil means
+	// peers may do neither; clients of the control socket always can.
+	Topics pubsub.Policy
+
+	// KV, if not nil, has the daemon keep a replica of the key-value store
+	// of the cluster, which the kv service serves, with the nodes it
+	// reaches: it starts the cluster alone if the raft configuration
+	// bootstraps it, and asks the nodes it reaches to add it otherwise,
+	// unless it has joined already. The name, transport, and nodes of the
+	// configuration are the daemon's own: the common name of its
+	// certificate, RPC, and its peers of a name.
+	KV *kv.Config
+
+	// KVRoles are the roles allowed to read and change the store with the
+	// kv service, and to replicate it: other nodes need one of them to
+	// join the cluster and take part in it. Empty means peers can do
+	// neither; clients of the control socket always can.
+	KVRoles []string
+
+	// JobRoles are the roles allowed to submit jobs with the jobs service,
+	// and to run their commands on the daemon: the node a job is submitted
+	// to needs one of them to run it on the others. Empty means peers can
+	// do neither; clients of the control socket always can.
+	JobRoles []string
+
+	// SecretRoles are the roles allowed to put and delete the secrets of
+	// the daemon with the secrets service: the node a secret is put to
+	// needs one of them to put it on the others. Empty means peers can do
+	// neither; clients of the control socket always can, and only they
+	// read the values of secrets.
+	SecretRoles []string
+
+	// ConfigRoles are the roles allowed to push configuration bundles with
+	// the bundles service, and to exchange them: the daemon applies the
+	// bundles signed by itself, or by a node of one of them. Empty means
+	// peers can do neither; clients of the control socket always can.
+	ConfigRoles []string
+
+	// Bundles is the file the daemon keeps the configuration bundles it
+	// applied in, across restarts. Empty means the daemon keeps them in
+	// memory only.
+	Bundles string
+
+	// Secrets is the file the daemon keeps its secrets in, sealed to its
+	// key. Empty means the daemon keeps them in memory only.
+	Secrets string
+
+	// Schedules is the file the daemon keeps its schedules in, with their
+	// last jobs, across restarts. Empty means the daemon keeps them in
+	// memory only.
+	Schedules string
+
+	// Logs keeps the daemon's recent log entries for the admin service's
+	// logs endpoint, usually recording from log.Default through log.Tee.
+	// Nil means the daemon serves no logs.
+	Logs *log.Buffer
+
+	// Ready, if not nil, is called once the daemon accepts connections.
+	Ready func()
+
+	// Credentials loads the credentials of the node.
+	// It is called once by New and again by every Reload.
+	Credentials func() (*trust.Bundle, error)
+
+	// ShutdownTimeout bounds how long Serve waits for requests in flight
+	// after its context is cancelled. Zero means 10 seconds.
+	ShutdownTimeout time.Duration
+
+	// MaxConns and MaxPeerConns bound the connections the daemon keeps
+	// open at once, of all peers and of every address, and HandshakeRate
+	// and PeerHandshakeRate the connections it accepts a second, so that a
+	// misbehaving peer cannot exhaust it. The daemon closes the others
+	// before their handshake. Zero means no limit.
+	MaxConns          int
+	MaxPeerConns      int
+	HandshakeRate     float64
+	PeerHandshakeRate float64
+
+	// MaxCalls and MaxPeerCalls bound the RPC calls the daemon serves at
+	// once, of all peers and of every peer, failing the others with
+	// rpc.CodeResourceExhausted. Zero means no limit.
+	MaxCalls     int
+	MaxPeerCalls int
+}
+
+// A Daemon serves the registered services over mutual TLS.
+type Daemon struct {
+	cfg     Config // live settings are guarded by mu
+	bundle  atomic.Pointer[trust.Bundle]
+	started time.Time
+	peers   atomic.Int64
+	errs    errorRing
+	crls    revocations
+	known   peerTable
+	rpc     *rpc.Server
+	pool    *rpc.Pool
+	limiter *nihnet.Limiter
+	protos  nihnet.Registry
+	gossip  atomic.Pointer[gossip.Node]
+	health  *health.Monitor
+	bus     pubsub.Bus
+	kv      *kv.Replica
+	jobs    *jobs.Manager
+	sched   schedules
+	secrets secretStore
+	bundles bundleStore
+	clock   hlc.Clock
+
+	// reconfigured wakes the prober after Configure.
+	reconfigured chan struct{}
+
+	mu      sync.Mutex
+	addr    net.Addr
+	control string
+}
+
+// New returns a daemon with the credentials loaded by cfg.Credentials.
+func New(cfg Config) (*Daemon, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = DefaultAddr
+	}
+
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 10 * time.Second
+	}
+
+	if cfg.PeerInterval == 0 {
+		cfg.PeerInterval = DefaultPeerInterval
+	}
+
+	d := &Daemon{cfg: cfg, reconfigured: make(chan struct{}, 1), rpc: rpc.NewServer(), limiter: nihnet.NewLimiter(nihnet.Limits{})}
+	d.setLimits(&cfg)
+	d.pool = &rpc.Pool{Bundle: d.Bundle}
+	d.clock.MaxOffset = MaxClockSkew
+	d.health = &health.Monitor{
+		Interval: cfg.PeerInterval,
+		Timeout:  peerProbeTimeout,
+		OnChange: d.healthChanged,
+	}
+
+	for _, s := range Services() {
+		if s.Methods != nil {
+			s.Methods(d, d.rpc)
+		}
+	}
+	d.protos.Register(&nihnet.Protocol{Name: rpc.ProtoName, Version: rpc.Version, Serve: d.serveRPC})
+
+	b, err := cfg.Credentials()
+	if err != nil {
+		return nil, err
+	}
+	d.bundle.Store(b)
+	d.known.setStatic(d.targets(cfg.Peers))
+
+	if cfg.KV != nil {
+		kc := *cfg.KV
+		kc.Name = b.Chain()[0].Subject.CommonName
+		kc.Transport = &kvTransport{d: d}
+		kc.Nodes = d.kvNodes
+		kc.Clock = &d.clock
+		if d.kv, err = kv.New(kc); err != nil {
+			return nil, err
+		}
+	}
+
+	d.jobs, err = jobs.New(jobs.Config{Transport: &jobTransport{d: d}, Nodes: d.jobNodes})
+	if err != nil {
+		return nil, err
+	}
+	d.sched.file = cfg.Schedules
+	if err := d.sched.load(); err != nil {
+		return nil, err
+	}
+	d.secrets.file = cfg.Secrets
+	if err := d.secrets.load(); err != nil {
+		return nil, err
+	}
+	d.writeSecretFiles()
+	d.bundles.file = cfg.Bundles
+	if err := d.bundles.load(); err != nil {
+		return nil, err
+	}
+	d.configureBundle()
+
+	return d, nil
+}
+
+// Clock returns the hybrid logical clock of the daemon, which stamps the
+// messages of gossip and the changes of the key-value store, and rejects
+// the timestamps of peers more than MaxClockSkew ahead.
+func (d *Daemon) Clock() *hlc.Clock {
+	return &d.clock
+}
+
+// RPC returns the server of the RPC methods of the registered services.
+func (d *Daemon) RPC() *rpc.Server {
+	return d.rpc
+}
+
+// Protocols returns the registry of the protocols the daemon serves to
+// clients that negotiate them, which holds the versions of the RPC
+// protocol. Protocols registered after Serve was called are not served.
+func (d *Daemon) Protocols() *nihnet.Registry {
+	return &d.protos
+}
+
+// Bundle returns the current credentials.
+func (d *Daemon) Bundle() *trust.Bundle {
+	return d.bundle.Load()
+}
+
+// Reload loads the credentials again and uses them for new connections.
+// If they fail to load, the daemon keeps the current ones.
+func (d *Daemon) Reload() error {
+	b, err := d.cfg.Credentials()
+	if err != nil {
+		log.Default().Error("daemon: reload credentials", "err", err)
+		d.errs.add("reload credentials: " + err.Error())
+		return err
+	}
+
+	d.bundle.Store(b)
+	log.Default().Info("daemon: reloaded credentials")
+	return nil
+}
+
+// Addr returns the address the daemon listens on, or nil if it is not serving.
+func (d *Daemon) Addr() net.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.addr
+}
+
+// Control returns the path of the control socket, or "" if there is none.
+func (d *Daemon) Control() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.control
+}
+
+// Started returns the time Serve was called.
+func (d *Daemon) Started() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.started
+}
+
+// TLSConfig returns a server configuration that always uses the current credentials
+// and rejects peers listed by the revocation lists in effect.
+// If the daemon accepts joining nodes, clients offering join.Proto
+// hand shake without a client certificate. Clients offering versions of
+// registered protocols negotiate one, as Registry.Negotiate chooses, and
+// fail the handshake if they offer none the daemon supports.
+func (d *Daemon) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			config := d.Bundle().TLSConfig()
+			p, err := d.protos.Negotiate(hello.SupportedProtos)
+			switch {
+			case err != nil:
+				// Agreeing on none of the client's protocols fails the
+				// handshake with an alert the client understands.
+				log.Default().Warn("daemon: incompatible protocol", "remote", hello.Conn.RemoteAddr().String(), "err", err)
+				config.NextProtos = d.protos.NextProtos()
+			case p != nil:
+				config.NextProtos = []string{p.ID()}
+			}
+			if d.cfg.Join != nil && slices.Contains(hello.SupportedProtos, join.Proto) {
+				return &tls.Config{
+					GetCertificate: config.GetCertificate,
+					NextProtos:     []string{join.Proto},
+					MinVersion:     tls.VersionTLS13,
+				}, nil
+			}
+
+			verify := config.VerifyPeerCertificate
+			config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+				if err := verify(rawCerts, chains); err != nil {
+					return err
+				}
+
+				// verify has parsed the chain successfully.
+				var chain []*x509.Certificate
+				for _, raw := range rawCerts {
+					c, _ := x509.ParseCertificate(raw)
+					chain = append(chain, c)
+				}
+
+				if err := d.checkRevoked(chain); err != nil {
+					log.Default().Debug("daemon: peer revoked", "err", err)
+					return &trust.VerificationError{Err: err}
+				}
+
+				return nil
+			}
+
+			return config, nil
+		},
+	}
+}
+
+// Handler returns the handler serving the registered services,
+// and the join handler to connections negotiating join.Proto and to
+// renewals.
+// It records the peers making requests, as reported by Peers, and puts
+// their identity in the context of the requests, for PeerIdentity.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, s := range Services() {
+		if s.Handler == nil {
+			continue
+		}
+		prefix := "/" + s.Name
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, s.Handler(d)))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && d.cfg.Join != nil && r.TLS.NegotiatedProtocol == join.Proto {
+			d.cfg.Join.ServeHTTP(w, r)
+			return
+		}
+
+		if r.TLS != nil {
+			d.known.seen(r.TLS.PeerCertificates[0], r.RemoteAddr)
+			id := nihnet.Identity{Chain: r.TLS.PeerCertificates}
+			r = r.WithContext(context.WithValue(r.Context(), peerIdentityKey{}, id))
+		}
+		if d.cfg.Join != nil && r.URL.Path == "/join/renew" {
+			d.cfg.Join.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe listens on the configured address and calls Serve.
+func (d *Daemon) ListenAndServe(ctx context.Context) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", d.cfg.Addr)
+	if err != nil {
+		return err
+	}
+
+	return d.Serve(ctx, ln)
+}
+
+// Serve accepts connections on ln, and on the control socket if configured,
+// until ctx is cancelled, then waits up to the shutdown timeout for requests
+// in flight. It returns nil after a graceful shutdown.
+func (d *Daemon) Serve(ctx context.Context, ln net.Listener) error {
+	if d.cfg.Control == "" {
+		return d.ServeListeners(ctx, ln, nil)
+	}
+
+	control, err := ListenControl(ctx, d.cfg.Control)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	return d.ServeListeners(ctx, ln, control)
+}
+
+// ServeListeners is Serve with the listener of the control socket,
+// from ListenControl or inherited from another process, or nil for none.
+func (d *Daemon) ServeListeners(ctx context.Context, ln, control net.Listener) error {
+	d.mu.Lock()
+	d.addr = ln.Addr()
+	if control != nil {
+		d.control = d.cfg.Control
+	}
+	d.started = time.Now()
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		d.addr = nil
+		d.control = ""
+		d.mu.Unlock()
+	}()
+
+	newServer := func() *http.Server {
+		return &http.Server{
+			Handler:           d.Handler(),
+			ReadHeaderTimeout: 10 * time.Second,
+			ErrorLog:          d.errorLog(),
+			BaseContext:       func(net.Listener) context.Context { return ctx },
+		}
+	}
+
+	srv := newServer()
+	srv.ConnState = d.connState
+	srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	for _, id := range d.protos.NextProtos() {
+		p := d.protos.Lookup(id)
+		srv.TLSNextProto[id] = func(_ *http.Server, tc *tls.Conn, _ http.Handler) {
+			d.serveProtocol(ctx, p, tc)
+		}
+	}
+	if d.cfg.Join != nil {
+		srv.TLSNextProto[join.Proto] = d.serveJoin
+	}
+	servers := []*http.Server{srv}
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- srv.Serve(tls.NewListener(d.limiter.Listener(ln), d.TLSConfig()))
+	}()
+
+	log.Default().Info("daemon: listening", "addr", ln.Addr().String())
+
+	pctx, stopProbes := context.WithCancel(ctx)
+	defer stopProbes()
+	if d.cfg.Gossip != nil {
+		d.startGossip(pctx, ln.Addr())
+	}
+	go d.probePeers(pctx)
+	if d.kv != nil {
+		go d.kv.Run(pctx)
+	}
+	go d.jobs.Run(pctx)
+	go d.runSchedules(pctx, false)
+	go d.pullBundles(pctx)
+	if d.kv != nil {
+		go d.leadSchedules(pctx)
+	}
+
+	if control != nil {
+		csrv := newServer()
+		servers = append(servers, csrv)
+		go func() {
+			errc <- csrv.Serve(controlListener{control})
+		}()
+
+		log.Default().Info("daemon: listening", "control", d.cfg.Control)
+	}
+
+	if d.cfg.Ready != nil {
+		d.cfg.Ready()
+	}
+
+	var err error
+	pending := len(servers)
+	select {
+	case err = <-errc:
+		pending--
+	case <-ctx.Done():
+	}
+
+	log.Default().Info("daemon: shutting down")
+
+	// The serving context is done; shut down with a fresh one.
+	sctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.config().ShutdownTimeout)
+	defer cancel()
+
+	d.leaveGossip(sctx)
+
+	for _, s := range servers {
+		if serr := s.Shutdown(sctx); serr != nil {
+			s.Close()
+			if err == nil {
+				err = fmt.Errorf("daemon: shutdown: %w", serr)
+			}
+		}
+	}
+
+	for ; pending > 0; pending-- {
+		if serr := <-errc; !errors.Is(serr, http.ErrServerClosed) && err == nil {
+			err = serr
+		}
+	}
+	d.pool.Close()
+
+	return err
+}
+
+// serveProtocol serves p on a connection that negotiated it, recording its
+// peer as Handler does for HTTP requests.
+func (d *Daemon) serveProtocol(ctx context.Context, p *nihnet.Protocol, tc *tls.Conn) {
+	conn, err := nihnet.NewConn(ctx, tc)
+	if err != nil {
+		return
+	}
+
+	d.known.seen(conn.Peer().Leaf(), conn.RemoteAddr().String())
+	p.Serve(ctx, conn)
+}
+
+// serveRPC serves the RPC methods on a connection that negotiated rpc.Proto,
+// until the client closes it or ctx is canceled and the calls in progress
+// have finished.
+func (d *Daemon) serveRPC(ctx context.Context, conn *nihnet.Conn) {
+	if err := d.rpc.ServeConn(ctx, conn); err != nil {
+		log.Default().Debug("daemon: rpc", "addr", conn.RemoteAddr(), "err", err)
+	}
+}
+
+// client returns the client of the connection the daemon keeps to the
+// daemon at addr, dialing it if need be, which must hold the certificate
+// of name unless name is empty. The client is shared; callers must not
+// close it.
+func (d *Daemon) client(ctx context.Context, addr, name string) (*rpc.Client, error) {
+	c, err := d.pool.Client(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if id, _ := c.Peer(); name != "" && id.Name() != name {
+		return nil, fmt.Errorf("daemon: %s is %s, not %s", addr, id.Name(), name)
+	}
+	return c, nil
+}
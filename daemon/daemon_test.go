@@ -0,0 +1,2120 @@
+package daemon_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nih.software/confbundle"
+	"nih.software/daemon"
+	"nih.software/gossip"
+	"nih.software/health"
+	"nih.software/jobs"
+	"nih.software/kv"
+	"nih.software/log"
+	"nih.software/nihnet"
+	"nih.software/peers"
+	"nih.software/pubsub"
+	"nih.software/raft"
+	"nih.software/rpc"
+	"nih.software/trust"
+	"nih.software/trust/join"
+	"nih.software/trust/trustgen"
+)
+
+// credentials returns a generator of fresh leaf bundles under one hierarchy.
+func credentials(t *testing.T) func() (*trust.Bundle, error) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.NewCA(h.Intermediates[0].Cert, h.Intermediates[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func() (*trust.Bundle, error) {
+		crt, key, err := ca.NewLeaf()
+		if err != nil {
+			return nil, err
+		}
+
+		return trust.NewBundle(ca.ChainFor(crt), key, h.Roots())
+	}
+}
+
+func start(t *testing.T, cfg daemon.Config) (*daemon.Daemon, net.Addr, func() error) {
+	d, err := daemon.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.Serve(ctx, ln)
+	}()
+
+	stop := sync.OnceValue(func() error {
+		cancel()
+		return <-errc
+	})
+
+	t.Cleanup(func() { stop() })
+
+	return d, ln.Addr(), stop
+}
+
+func client(b *trust.Bundle) *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: b.TLSConfig()}}
+}
+
+func get(c *http.Client, ln net.Addr, path string, v any) error {
+	resp, err := c.Get("https://" + ln.String() + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func TestServe(t *testing.T) {
+	load := credentials(t)
+	_, addr, stop := start(t, daemon.Config{Credentials: load})
+
+	peer, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var health daemon.Health
+	if err := get(client(peer), addr, "/health/", &health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Status != "ok" {
+		t.Fatalf("health %+v", health)
+	}
+
+	var status daemon.Status
+	if err := get(client(peer), addr, "/admin/status", &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Addr != addr.String() || status.Serial == "" || len(status.Services) < 2 {
+		t.Fatalf("status %+v", status)
+	}
+
+	t.Run("rpc", func(t *testing.T) {
+		c, err := rpc.Dial(context.Background(), peer, addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		health, err := rpc.Call[struct{}, daemon.Health](context.Background(), c, "health.Check", struct{}{})
+		if err != nil || health.Status != "ok" {
+			t.Fatalf("health.Check = %+v, %v", health, err)
+		}
+
+		status, err := rpc.Call[struct{}, daemon.Status](context.Background(), c, "admin.Status", struct{}{})
+		if err != nil || status.Addr != addr.String() || !slices.Contains(status.Methods, "admin.Status") {
+			t.Fatalf("admin.Status = %+v, %v", status, err)
+		}
+		if !slices.Contains(status.Protocols, rpc.Proto) {
+			t.Errorf("protocols %v, want %s", status.Protocols, rpc.Proto)
+		}
+
+		// a client of a version the daemon does not speak fails the handshake
+		d := nihnet.Dialer{Bundle: peer, NextProtos: []string{nihnet.ProtocolID(rpc.ProtoName, rpc.Version+1)}}
+		if conn, err := d.Dial(context.Background(), "tcp", addr.String()); err == nil {
+			conn.Close()
+			t.Error("dial offering a later version succeeded")
+		}
+	})
+
+	t.Run("foreign peer", func(t *testing.T) {
+		stranger, err := credentials(t)()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := get(client(stranger), addr, "/health/", &health); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	if err := stop(); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	named := namedCredentials(t)
+	control := filepath.Join(t.TempDir(), "run", "nih.sock")
+	d, addr, _ := start(t, daemon.Config{Credentials: named("node"), Control: control})
+	for d.Control() == "" {
+		time.Sleep(time.Millisecond)
+	}
+
+	dash, err := named("dashboard")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client(dash)
+
+	var status daemon.Status
+	if err := get(c, addr, "/api/v1/status", &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Addr != addr.String() || status.Serial == "" {
+		t.Errorf("status %+v", status)
+	}
+
+	var ps []daemon.Peer
+	if err := get(c, addr, "/api/v1/peers", &ps); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "dashboard" || ps[0].Source != daemon.PeerInbound {
+		t.Errorf("peers %+v", ps)
+	}
+
+	var cert daemon.CertInfo
+	if err := get(c, addr, "/api/v1/cert", &cert); err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Chain) < 2 || cert.Chain[0].Serial != status.Serial || cert.Chain[0].Subject != "CN=node" ||
+		cert.Chain[0].SHA256 == "" || cert.Chain[0].KeyPin == "" || len(cert.Roots) != 1 || !cert.Roots[0].IsCA {
+		t.Errorf("cert %+v", cert)
+	}
+
+	var who daemon.Whoami
+	if err := get(c, addr, "/api/v1/whoami", &who); err != nil {
+		t.Fatal(err)
+	}
+	if who.Control || len(who.Chain) == 0 || who.Chain[0].Serial != dash.Chain()[0].SerialNumber.String() {
+		t.Errorf("whoami %+v", who)
+	}
+
+	// Errors are JSON too.
+	resp, err := c.Get("https://" + addr.String() + "/api/v1/nothing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&apiErr)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "application/json" || apiErr.Error == "" {
+		t.Errorf("unknown endpoint: %s, %+v", resp.Status, apiErr)
+	}
+
+	// Clients of the control socket have no identity.
+	cc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", control)
+		},
+	}}
+	who = daemon.Whoami{}
+	resp, err = cc.Get("http://nih/api/v1/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&who)
+	resp.Body.Close()
+	if !who.Control || len(who.Chain) != 0 {
+		t.Errorf("whoami over the control socket %+v", who)
+	}
+}
+
+func TestReload(t *testing.T) {
+	load := credentials(t)
+
+	var fail atomic.Bool
+	d, addr, _ := start(t, daemon.Config{Credentials: func() (*trust.Bundle, error) {
+		if fail.Load() {
+			return nil, errors.New("no credentials")
+		}
+		return load()
+	}})
+
+	peer, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial := func() string {
+		var status daemon.Status
+		// A new client, so that each request makes a new connection.
+		if err := get(client(peer), addr, "/admin/status", &status); err != nil {
+			t.Fatal(err)
+		}
+		return status.Serial
+	}
+
+	before := serial()
+	if err := d.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := serial()
+	if after == before {
+		t.Fatal("credentials not reloaded")
+	}
+
+	fail.Store(true)
+	if err := d.Reload(); err == nil {
+		t.Fatal("no error")
+	}
+	if serial() != after {
+		t.Fatal("failed reload replaced credentials")
+	}
+	if errs := d.Status().Errors; len(errs) != 1 {
+		t.Fatalf("errors %+v", errs)
+	}
+}
+
+func TestControl(t *testing.T) {
+	load := credentials(t)
+	var fail atomic.Bool
+	control := filepath.Join(t.TempDir(), "run", "nih.sock")
+	d, addr, stop := start(t, daemon.Config{
+		Credentials: func() (*trust.Bundle, error) {
+			if fail.Load() {
+				return nil, errors.New("no credentials")
+			}
+			return load()
+		},
+		Control: control,
+	})
+	for d.Control() == "" {
+		time.Sleep(time.Millisecond)
+	}
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", control)
+		},
+	}}
+
+	// The same services as over TLS, without credentials.
+	var status daemon.Status
+	if err := get(c, addr, "/admin/status", &status); err == nil {
+		t.Fatal("plain HTTP on the TLS port: no error")
+	}
+
+	status = daemon.Status{}
+	resp, err := c.Get("http://nih/admin/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+
+	if status.Control != control || status.Addr != addr.String() || len(status.Errors) != 0 {
+		t.Fatalf("status %+v", status)
+	}
+
+	// Reloading the credentials is for the control socket only.
+	resp, err = c.Post("http://nih/admin/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status = daemon.Status{}
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || status.Serial == "" {
+		t.Errorf("reload: %s, status %+v", resp.Status, status)
+	}
+
+	b, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client(b).Post("https://"+addr.String()+"/admin/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("reload by a peer: %s", resp.Status)
+	}
+
+	fail.Store(true)
+	resp, err = c.Post("http://nih/admin/reload", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("failed reload: %s", resp.Status)
+	}
+	fail.Store(false)
+
+	fi, err := os.Stat(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("control socket mode %v", fi.Mode())
+	}
+
+	// A second daemon must not take over the socket of a live one.
+	d2, err := daemon.New(daemon.Config{Credentials: load, Control: control})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.Serve(context.Background(), ln); err == nil {
+		t.Fatal("second daemon: no error")
+	}
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(control); !os.IsNotExist(err) {
+		t.Errorf("control socket left behind: %v", err)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{Intermediates: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.NewCA(h.Intermediates[0].Cert, h.Intermediates[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func() (*trust.Bundle, error) {
+		crt, key, err := ca.NewLeaf()
+		if err != nil {
+			return nil, err
+		}
+		return trust.NewBundle(ca.ChainFor(crt), key, h.Roots())
+	}
+
+	tokens, err := join.OpenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, addr, _ := start(t, daemon.Config{
+		Credentials: load,
+		Join:        &join.Server{CA: ca, Roots: h.Roots(), Tokens: tokens},
+	})
+
+	root := h.Roots()[0]
+	newToken := func() string {
+		token, err := tokens.Create("", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return join.Token(token, root)
+	}
+
+	csr, key, err := trustgen.NewCSR()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := newToken()
+	res, err := join.Join(context.Background(), addr.String(), token, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new node is a peer like any other.
+	b, err := trust.NewBundle(res.Chain, key, res.Roots)
+	if err != nil {
+		t.Fatalf("issued credentials: %v", err)
+	}
+
+	var health daemon.Health
+	if err := get(client(b), addr, "/health/", &health); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reused token", func(t *testing.T) {
+		_, err := join.Join(context.Background(), addr.String(), token, csr)
+		if !errors.Is(err, join.ErrTokenRejected) {
+			t.Fatalf("got %v, want %v", err, join.ErrTokenRejected)
+		}
+	})
+
+	t.Run("wrong pin", func(t *testing.T) {
+		other, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := tokens.Create("", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = join.Join(context.Background(), addr.String(), join.Token(token, other.Roots()[0]), csr)
+		var verr *trust.VerificationError
+		if !errors.As(err, &verr) {
+			t.Fatalf("got %v, want a verification error", err)
+		}
+
+		// The token was not sent, so it can still be used.
+		if _, err := join.Join(context.Background(), addr.String(), join.Token(token, root), csr); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("services", func(t *testing.T) {
+		// A join connection reaches nothing but the join server.
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			NextProtos:         []string{join.Proto},
+			InsecureSkipVerify: true,
+		}}}
+
+		resp, err := c.Get("https://" + addr.String() + "/admin/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("status %s", resp.Status)
+		}
+	})
+
+	t.Run("renew", func(t *testing.T) {
+		// the subject of the request does not matter
+		csr, key, err := trustgen.NewCSR(trustgen.WithSubject(pkix.Name{CommonName: "admin"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		renewed, err := join.Renew(context.Background(), b, addr.String(), csr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := renewed.Chain[0].Subject.String(), res.Chain[0].Subject.String(); got != want {
+			t.Errorf("subject %q, want %q", got, want)
+		}
+
+		nb, err := trust.NewBundle(renewed.Chain, key, renewed.Roots)
+		if err != nil {
+			t.Fatalf("renewed credentials: %v", err)
+		}
+		if err := get(client(nb), addr, "/health/", &health); err != nil {
+			t.Fatal(err)
+		}
+
+		// A join connection has no certificate to renew.
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			NextProtos:         []string{join.Proto},
+			InsecureSkipVerify: true,
+		}}}
+		resp, err := c.Post("https://"+addr.String()+"/join/renew", "application/json", strings.NewReader(`{"csr":""}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("join connection: status %s", resp.Status)
+		}
+	})
+
+	t.Run("no join", func(t *testing.T) {
+		_, addr, _ := start(t, daemon.Config{Credentials: load})
+		if _, err := join.Join(context.Background(), addr.String(), newToken(), csr); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func TestCRL(t *testing.T) {
+	db, err := trustgen.OpenDB(filepath.Join(t.TempDir(), "issued.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+		Options:       []trustgen.Option{trustgen.WithDB(db)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.NewCA(h.Intermediates[0].Cert, h.Intermediates[0].Key, trustgen.WithDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	load := func() (*trust.Bundle, error) {
+		crt, key, err := ca.NewLeaf()
+		if err != nil {
+			return nil, err
+		}
+		return trust.NewBundle(ca.ChainFor(crt), key, h.Roots())
+	}
+
+	_, addr, _ := start(t, daemon.Config{Credentials: load})
+
+	peer, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := revoked.TLSConfig().GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Revoke(crt.Leaf.SerialNumber.Int64(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(b *trust.Bundle, ca *trustgen.CA, db *trustgen.DB) int {
+		t.Helper()
+
+		der, err := db.CRL(ca.Cert, ca.Key, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := append(trustgen.PEMEncodeCRL(der), trustgen.PEMEncodeCertificates(ca.Chain...)...)
+
+		resp, err := client(b).Post("https://"+addr.String()+"/crl/", "application/x-pem-file", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	var health daemon.Health
+	if err := get(client(revoked), addr, "/health/", &health); err != nil {
+		t.Fatalf("before revocation: %v", err)
+	}
+
+	if code := post(peer, ca, db); code != http.StatusNoContent {
+		t.Fatalf("post: %d", code)
+	}
+
+	if err := get(client(revoked), addr, "/health/", &health); err == nil {
+		t.Fatal("revoked peer: no error")
+	}
+	if err := get(client(peer), addr, "/health/", &health); err != nil {
+		t.Fatal(err)
+	}
+
+	var crls []daemon.CRL
+	if err := get(client(peer), addr, "/crl/", &crls); err != nil {
+		t.Fatal(err)
+	}
+	if len(crls) != 1 || crls[0].Revoked != 1 {
+		t.Fatalf("crls %+v", crls)
+	}
+
+	t.Run("foreign issuer", func(t *testing.T) {
+		fdb, err := trustgen.OpenDB(filepath.Join(t.TempDir(), "issued.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fca, err := trustgen.NewCA(other.Root.Cert, other.Root.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code := post(peer, fca, fdb); code != http.StatusUnprocessableEntity {
+			t.Fatalf("post: %d", code)
+		}
+	})
+}
+
+func TestExec(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{Intermediates: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.NewCA(h.Intermediates[0].Cert, h.Intermediates[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := func(roles ...string) *trust.Bundle {
+		crt, key, err := ca.NewLeaf(trustgen.WithSubject(pkix.Name{CommonName: "client", OrganizationalUnit: roles}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := trust.NewBundle(ca.ChainFor(crt), key, h.Roots())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	node := func() (*trust.Bundle, error) { return bundle(), nil }
+	_, addr, _ := start(t, daemon.Config{Credentials: node, ExecRoles: []string{"admin"}})
+
+	run := func(b *trust.Bundle, args ...string) (*http.Response, []daemon.ExecFrame) {
+		t.Helper()
+
+		body, _ := json.Marshal(&daemon.ExecRequest{Args: args})
+		resp, err := client(b).Post("https://"+addr.String()+"/exec/", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var frames []daemon.ExecFrame
+		dec := json.NewDecoder(resp.Body)
+		for resp.StatusCode == http.StatusOK {
+			var f daemon.ExecFrame
+			if err := dec.Decode(&f); err != nil {
+				break
+			}
+			frames = append(frames, f)
+		}
+		return resp, frames
+	}
+
+	if resp, _ := run(bundle("ops"), "true"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("without role: %s", resp.Status)
+	}
+
+	if resp, _ := run(bundle("admin"), "nih-no-such-command"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("missing command: %s", resp.Status)
+	}
+
+	resp, frames := run(bundle("ops", "admin"), "sh", "-c", "echo out; echo err >&2; exit 3")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("with role: %s", resp.Status)
+	}
+
+	var stdout, stderr []byte
+	var exit *int
+	for _, f := range frames {
+		stdout = append(stdout, f.Stdout...)
+		stderr = append(stderr, f.Stderr...)
+		if f.Exit != nil {
+			exit = f.Exit
+		}
+	}
+	if string(stdout) != "out\n" || string(stderr) != "err\n" || exit == nil || *exit != 3 {
+		t.Errorf("stdout %q, stderr %q, exit %v", stdout, stderr, exit)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	load := credentials(t)
+	b, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Peers have no role: the files service is disabled for them.
+	control := filepath.Join(t.TempDir(), "nih.sock")
+	d, addr, _ := start(t, daemon.Config{Credentials: load, Control: control})
+	for d.Control() == "" {
+		time.Sleep(time.Millisecond)
+	}
+
+	var fi daemon.FileInfo
+	if err := get(client(b), addr, "/files/stat?path=.", &fi); err == nil || err.Error() != "403 Forbidden" {
+		t.Errorf("peer without role: %v", err)
+	}
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", control)
+		},
+	}}
+
+	do := func(method, query, body string) int {
+		t.Helper()
+
+		req, err := http.NewRequest(method, "http://nih/files/"+query, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	name := filepath.Join(t.TempDir(), "f")
+	q := "?path=" + name
+
+	if code := do("PUT", "content"+q+"&offset=0", "hello, "); code != http.StatusNoContent {
+		t.Fatalf("put: %d", code)
+	}
+	if code := do("PUT", "content"+q+"&offset=3", "world"); code != http.StatusConflict {
+		t.Errorf("put at wrong offset: %d", code)
+	}
+	if code := do("PUT", "content"+q+"&offset=7", "world"); code != http.StatusNoContent {
+		t.Fatalf("put at end: %d", code)
+	}
+
+	if code := do("POST", "commit"+q+"&mode=640&sha256=00", ""); code != http.StatusUnprocessableEntity {
+		t.Errorf("commit with wrong sum: %d", code)
+	}
+	if _, err := os.Stat(name + daemon.PartSuffix); !os.IsNotExist(err) {
+		t.Errorf("partial file kept after mismatch: %v", err)
+	}
+
+	do("PUT", "content"+q+"&offset=0", "hello, world")
+	sum := sha256.Sum256([]byte("hello, world"))
+	if code := do("POST", "commit"+q+"&mode=640&sha256="+hex.EncodeToString(sum[:]), ""); code != http.StatusNoContent {
+		t.Fatalf("commit: %d", code)
+	}
+
+	st, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != 0640 || st.Size() != 12 {
+		t.Errorf("committed file: mode %v, size %d", st.Mode(), st.Size())
+	}
+}
+
+func TestPeers(t *testing.T) {
+	load := credentials(t)
+	b, baddr, stopB := start(t, daemon.Config{Credentials: load})
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := closed.Addr().String()
+	closed.Close()
+
+	var mu sync.Mutex
+	changes := make(map[string][]health.Status)
+	a, _, _ := start(t, daemon.Config{
+		Credentials:  load,
+		Peers:        []string{baddr.String(), down},
+		PeerInterval: 10 * time.Millisecond,
+		HealthChanged: func(ch health.Change) {
+			mu.Lock()
+			defer mu.Unlock()
+			changes[ch.Peer] = append(changes[ch.Peer], ch.To)
+		},
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	var peers []daemon.Peer
+	for {
+		peers = a.Peers()
+		if peers[0].Health != daemon.PeerUnknown && peers[1].Health != daemon.PeerUnknown {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peers not probed: %+v", peers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	byAddr := make(map[string]daemon.Peer)
+	for _, p := range peers {
+		byAddr[p.Addr] = p
+	}
+
+	bserial := b.Status().Serial
+	if p := byAddr[baddr.String()]; p.Health != daemon.PeerOK || p.Source != daemon.PeerStatic || p.Serial != bserial || p.LastSeen.IsZero() {
+		t.Errorf("reachable peer %+v", p)
+	}
+	if p := byAddr[down]; p.Health != daemon.PeerDown || p.Error == "" || !p.LastSeen.IsZero() {
+		t.Errorf("unreachable peer %+v", p)
+	}
+	// The peers share the clock of the host, but for the time the probe
+	// takes.
+	if skew := time.Duration(byAddr[baddr.String()].Skew); skew > time.Second || skew < -time.Second {
+		t.Errorf("skew of the reachable peer %v", skew)
+	}
+	if skew := time.Duration(a.Status().ClockSkew); skew > time.Second || skew < -time.Second {
+		t.Errorf("clock skew of a %v", skew)
+	}
+
+	// b has seen a's probes.
+	aserial := a.Status().Serial
+	peers = b.Peers()
+	if len(peers) != 1 || peers[0].Source != daemon.PeerInbound || peers[0].Serial != aserial || peers[0].Addr != "127.0.0.1" || peers[0].Health != daemon.PeerOK {
+		t.Errorf("inbound peers %+v", peers)
+	}
+
+	// Once b stops, its connection fails, and it is down at once.
+	stopB()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		i := slices.IndexFunc(a.Peers(), func(p daemon.Peer) bool { return p.Addr == baddr.String() })
+		if a.Peers()[i].Health == daemon.PeerDown {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stopped peer not down: %+v", a.Peers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := changes[baddr.String()]; !slices.Equal(got, []health.Status{health.Healthy, health.Down}) {
+		t.Errorf("changes of the stopped peer: %v", got)
+	}
+	if got := changes[down]; !slices.Equal(got, []health.Status{health.Down}) {
+		t.Errorf("changes of the unreachable peer: %v", got)
+	}
+}
+
+func TestBook(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Leaves:  2,
+		Options: []trustgen.Option{trustgen.WithSubject(pkix.Name{CommonName: "node"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func(i int) func() (*trust.Bundle, error) {
+		return func() (*trust.Bundle, error) {
+			return trust.NewBundle(h.Chain(i), h.Leaves[i].Key, h.Roots())
+		}
+	}
+	_, baddr, _ := start(t, daemon.Config{Credentials: load(1)})
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := closed.Addr().String()
+	closed.Close()
+
+	book, err := peers.OpenBook(filepath.Join(t.TempDir(), peers.DefaultFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []peers.Peer{
+		{Name: "node", Addrs: []string{down, baddr.String()}, Pin: peers.Pin(h.Leaves[1].Cert)},
+		{Name: "impostor", Addrs: []string{baddr.String()}},
+	} {
+		if err := book.Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, _, _ := start(t, daemon.Config{
+		Credentials:  load(0),
+		Peers:        []string{baddr.String()},
+		Book:         book,
+		PeerInterval: 10 * time.Millisecond,
+	})
+
+	probed := func(want int) map[string]daemon.Peer {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			byName := make(map[string]daemon.Peer)
+			for _, p := range a.Peers() {
+				if p.Source == daemon.PeerStatic && p.Health != daemon.PeerUnknown {
+					byName[p.Name] = p
+				}
+			}
+			if len(byName) == want {
+				return byName
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("peers not probed: %+v", a.Peers())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The address of Peers is that of a peer of the book, so it is probed
+	// once, as that peer.
+	byName := probed(2)
+	if p := byName["node"]; p.Health != daemon.PeerOK || p.Addr != baddr.String() {
+		t.Errorf("peer of the book %+v", p)
+	}
+	if p := byName["impostor"]; p.Health != daemon.PeerDown || !strings.Contains(p.Error, "unexpected identity") {
+		t.Errorf("peer of another identity %+v", p)
+	}
+
+	// Changes to the book apply to the next round.
+	if err := book.Remove("impostor"); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.Put(peers.Peer{Name: "node", Addrs: []string{baddr.String()}, Pin: peers.Pin(h.Leaves[0].Cert)}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ps := a.Peers()
+		if len(ps) == 1 && ps[0].Health == daemon.PeerDown {
+			if !strings.Contains(ps[0].Error, "pin") {
+				t.Errorf("peer of another key %+v", ps[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("book changes not applied: %+v", ps)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// finderFunc is a peers.Finder of a function.
+type finderFunc func(ctx context.Context) ([]peers.Peer, error)
+
+func (f finderFunc) Find(ctx context.Context) ([]peers.Peer, error) {
+	return f(ctx)
+}
+
+// namedCredentials returns a function returning the credentials of a leaf
+// of a common name, all under one hierarchy.
+func namedCredentials(t *testing.T) func(cn string, roles ...string) func() (*trust.Bundle, error) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{Intermediates: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := trustgen.NewCA(h.Intermediates[0].Cert, h.Intermediates[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(cn string, roles ...string) func() (*trust.Bundle, error) {
+		crt, key, err := ca.NewLeaf(trustgen.WithSubject(pkix.Name{CommonName: cn, OrganizationalUnit: roles}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return func() (*trust.Bundle, error) {
+			return trust.NewBundle(ca.ChainFor(crt), key, h.Roots())
+		}
+	}
+}
+
+func TestFinders(t *testing.T) {
+	named := namedCredentials(t)
+	_, baddr, _ := start(t, daemon.Config{Credentials: named("b")})
+
+	var mu sync.Mutex
+	found := []peers.Peer{
+		{Name: "b", Addrs: []string{baddr.String()}, Source: peers.SourceMDNS},
+		{Name: "a", Addrs: []string{"127.0.0.1:1"}, Source: peers.SourceMDNS},
+		{Name: "impostor", Addrs: []string{baddr.String()}, Source: peers.SourceMDNS},
+		{Name: "bad:name", Addrs: []string{baddr.String()}, Source: peers.SourceMDNS},
+	}
+	a, _, _ := start(t, daemon.Config{
+		Credentials: named("a"),
+		Finders: []peers.Finder{
+			finderFunc(func(ctx context.Context) ([]peers.Peer, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return found, nil
+			}),
+			finderFunc(func(ctx context.Context) ([]peers.Peer, error) {
+				return nil, errors.New("unavailable")
+			}),
+		},
+		PeerInterval: 10 * time.Millisecond,
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	var ps []daemon.Peer
+	for {
+		ps = a.Peers()
+		if len(ps) == 2 && ps[0].Health != daemon.PeerUnknown && ps[1].Health != daemon.PeerUnknown {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("peers found not probed: %+v", ps)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Itself and the invalid name are skipped.
+	if p := ps[0]; p.Name != "b" || p.Source != peers.SourceMDNS || p.Health != daemon.PeerOK || p.Addr != baddr.String() {
+		t.Errorf("peer found %+v", p)
+	}
+	if p := ps[1]; p.Name != "impostor" || p.Health != daemon.PeerDown || !strings.Contains(p.Error, "unexpected identity") {
+		t.Errorf("peer found of another identity %+v", p)
+	}
+
+	// Peers no longer found are forgotten.
+	mu.Lock()
+	found = nil
+	mu.Unlock()
+	deadline = time.Now().Add(5 * time.Second)
+	for len(a.Peers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("peers no longer found: %+v", a.Peers())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	named := namedCredentials(t)
+	fast := func() *gossip.Config {
+		return &gossip.Config{Interval: 20 * time.Millisecond, Timeout: 2 * time.Second, SyncInterval: 100 * time.Millisecond}
+	}
+
+	b, baddr, _ := start(t, daemon.Config{Credentials: named("b"), Gossip: fast()})
+	a, _, _ := start(t, daemon.Config{
+		Credentials:  named("a"),
+		Peers:        []string{baddr.String()},
+		PeerInterval: 10 * time.Millisecond,
+		Gossip:       fast(),
+	})
+	_, _, stopC := start(t, daemon.Config{
+		Credentials:  named("c"),
+		Peers:        []string{baddr.String()},
+		PeerInterval: 10 * time.Millisecond,
+		Gossip:       fast(),
+	})
+
+	member := func(d *daemon.Daemon, name string) (daemon.Peer, bool) {
+		for _, p := range d.Peers() {
+			if p.Name == name {
+				return p, true
+			}
+		}
+		return daemon.Peer{}, false
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s: %+v", what, a.Peers())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a learns of c, which it neither probes nor is probed by, by gossip.
+	waitFor("a to learn of c", func() bool {
+		p, ok := member(a, "c")
+		return ok && p.Source == daemon.PeerGossip && p.Health == daemon.PeerOK
+	})
+	if p, _ := member(a, "c"); !strings.HasPrefix(p.Addr, "127.0.0.1:") {
+		t.Errorf("member c %+v", p)
+	}
+	if p, _ := member(b, "a"); p.Source != daemon.PeerGossip {
+		t.Errorf("member a of b %+v", p)
+	}
+
+	// c leaves as it shuts down.
+	if err := stopC(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("c to leave", func() bool {
+		p, _ := member(a, "c")
+		return p.Health == daemon.PeerLeft
+	})
+
+	// Gossip speaks for its sender only.
+	cb, err := named("c")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := rpc.Dial(context.Background(), cb, baddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = rpc.Call[gossip.Message, gossip.Message](context.Background(), c, "gossip.Ping", gossip.Message{From: gossip.Member{Name: "a", Addr: "127.0.0.1:1", State: gossip.Alive}})
+	if rpc.ErrorCode(err) != rpc.CodePermissionDenied {
+		t.Errorf("gossip for another node: %v", err)
+	}
+}
+
+func TestPubsub(t *testing.T) {
+	named := namedCredentials(t)
+	topics := pubsub.Policy{{Topic: "events.>", Publish: []string{"name:a", "name:pub"}, Subscribe: []string{"*"}}}
+	_, baddr, _ := start(t, daemon.Config{Credentials: named("b"), Topics: topics})
+	a, aaddr, _ := start(t, daemon.Config{
+		Credentials:  named("a"),
+		Peers:        []string{baddr.String()},
+		PeerInterval: 10 * time.Millisecond,
+		Topics:       topics,
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ps := a.Peers(); len(ps) == 0 || ps[0].Health != daemon.PeerOK; ps = a.Peers() {
+		if time.Now().After(deadline) {
+			t.Fatalf("b not probed: %+v", ps)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	dial := func(cn string, addr net.Addr) *rpc.Client {
+		b, err := named(cn)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := rpc.Dial(context.Background(), b, addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A subscriber of b receives what is published to a, as a forwards it.
+	sub := dial("sub", baddr)
+	ss, err := rpc.OpenStream[daemon.SubscribeRequest, pubsub.Message](ctx, sub, "pubsub.Subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	if err := ss.Send(daemon.SubscribeRequest{Topics: []string{"events.>"}}); err != nil {
+		t.Fatal(err)
+	}
+	local, err := a.Subscribe("events.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	// The subscription starts once the request arrives.
+	var sent pubsub.Message
+	got := make(chan pubsub.Message, 1)
+	go func() {
+		m, err := ss.Recv()
+		if err != nil {
+			t.Error(err)
+		}
+		got <- m
+	}()
+	pub := dial("pub", aaddr)
+	for {
+		sent, err = rpc.Call[daemon.PublishRequest, pubsub.Message](ctx, pub, "pubsub.Publish", daemon.PublishRequest{Topic: "events.deploy", Data: []byte("v2")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-got:
+			if m.ID != sent.ID || m.From != "pub" || m.Topic != "events.deploy" || string(m.Data) != "v2" {
+				t.Errorf("b received %+v", m)
+			}
+		case <-time.After(100 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	if m := <-local.C; m.From != "pub" || m.Topic != "events.deploy" {
+		t.Errorf("a received %+v", m)
+	}
+
+	// Topics are granted by the identity of the client.
+	_, err = rpc.Call[daemon.PublishRequest, pubsub.Message](ctx, sub, "pubsub.Publish", daemon.PublishRequest{Topic: "events.deploy"})
+	if rpc.ErrorCode(err) != rpc.CodePermissionDenied {
+		t.Errorf("publish by sub: %v", err)
+	}
+	_, err = rpc.Call[daemon.PublishRequest, pubsub.Message](ctx, pub, "pubsub.Publish", daemon.PublishRequest{Topic: "other"})
+	if rpc.ErrorCode(err) != rpc.CodePermissionDenied {
+		t.Errorf("publish to other: %v", err)
+	}
+	other, err := rpc.OpenStream[daemon.SubscribeRequest, pubsub.Message](ctx, sub, "pubsub.Subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Send(daemon.SubscribeRequest{Topics: []string{">"}})
+	if _, err := other.Recv(); rpc.ErrorCode(err) != rpc.CodePermissionDenied {
+		t.Errorf("subscribe to everything: %v", err)
+	}
+
+	// Only nodes that may publish to a topic forward to it.
+	_, err = rpc.Call[pubsub.Message, struct{}](ctx, pub, "pubsub.Forward", pubsub.Message{ID: "x", Topic: "events.deploy"})
+	if err != nil {
+		t.Errorf("forward by pub: %v", err)
+	}
+	_, err = rpc.Call[pubsub.Message, struct{}](ctx, sub, "pubsub.Forward", pubsub.Message{ID: "y", Topic: "events.deploy"})
+	if rpc.ErrorCode(err) != rpc.CodePermissionDenied {
+		t.Errorf("forward by sub: %v", err)
+	}
+
+	// The same over HTTP.
+	pb, err := named("pub")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client(pb).Post("https://"+aaddr.String()+"/pubsub/publish", "application/json", strings.NewReader(`{"topic": "events.http"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("publish over HTTP: %s", resp.Status)
+	}
+	sb, err := named("sub")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client(sb).Post("https://"+aaddr.String()+"/pubsub/publish", "application/json", strings.NewReader(`{"topic": "events.http"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("publish over HTTP by sub: %s", resp.Status)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	d, err := daemon.New(daemon.Config{Credentials: credentials(t), ExecRoles: []string{"admin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := func(name string) string {
+		for _, s := range d.Settings() {
+			if s.Name == name {
+				return s.Value
+			}
+		}
+		t.Fatalf("no setting %s", name)
+		return ""
+	}
+
+	changes, err := d.Configure(map[string]string{"exec-roles": "admin, ops", "file-roles": ""}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0] != (daemon.ConfigChange{Name: "exec-roles", Old: "admin", New: "admin,ops"}) {
+		t.Fatalf("changes %+v", changes)
+	}
+	if v := value("exec-roles"); v != "admin" {
+		t.Fatalf("dry run changed exec-roles to %q", v)
+	}
+
+	if _, err := d.Configure(map[string]string{"exec-roles": "admin,ops", "peer-interval": "1m"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if v := value("exec-roles"); v != "admin,ops" {
+		t.Errorf("exec-roles %q", v)
+	}
+	if v := value("peer-interval"); v != "1m0s" {
+		t.Errorf("peer-interval %q", v)
+	}
+
+	for _, bad := range []map[string]string{
+		{"peer-interval": "-1s"},
+		{"peers": "no-port"},
+		{"exec-roles": "a,,b"},
+		{"listen": ":1"},
+		{"color": "blue"},
+		{"exec-roles": "x", "shutdown-timeout": "soon"},
+	} {
+		if _, err := d.Configure(bad, false); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+	if v := value("exec-roles"); v != "admin,ops" {
+		t.Errorf("failed change applied: exec-roles %q", v)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	named := namedCredentials(t)
+	d, addr, _ := start(t, daemon.Config{Credentials: named("a"), MaxPeerConns: 1})
+	b, err := named("b")()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := rpc.Dial(context.Background(), b, addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := rpc.Call[struct{}, daemon.Health](context.Background(), c, "health.Check", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second connection from the address is closed before its handshake
+	if c2, err := rpc.Dial(context.Background(), b, addr.String()); err == nil {
+		c2.Close()
+		t.Error("connection beyond max-peer-conns accepted")
+	}
+	if n := d.Status().RefusedConns; n != 1 {
+		t.Errorf("refused connections %d, want 1", n)
+	}
+
+	if _, err := d.Configure(map[string]string{"max-peer-conns": "0", "peer-handshake-rate": "0.5"}, false); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := rpc.Dial(context.Background(), b, addr.String())
+	if err != nil {
+		t.Fatalf("connection once max-peer-conns is 0: %v", err)
+	}
+	c2.Close()
+	if c3, err := rpc.Dial(context.Background(), b, addr.String()); err == nil {
+		c3.Close()
+		t.Error("connection beyond peer-handshake-rate accepted")
+	}
+
+	for _, bad := range []map[string]string{
+		{"max-conns": "-1"},
+		{"max-calls": "many"},
+		{"handshake-rate": "NaN"},
+	} {
+		if _, err := d.Configure(bad, false); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
+
+func TestLogs(t *testing.T) {
+	load := credentials(t)
+	control := filepath.Join(t.TempDir(), "nih.sock")
+	logs := log.NewBuffer(100)
+	l := slog.New(logs.Handler(log.LevelDebug))
+	l.Info("old", "k", "v")
+	l.Warn("older warning")
+
+	d, addr, _ := start(t, daemon.Config{Credentials: load, Control: control, Logs: logs})
+	for d.Control() == "" {
+		time.Sleep(time.Millisecond)
+	}
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", control)
+		},
+	}}
+
+	read := func(dec *json.Decoder) log.Entry {
+		t.Helper()
+		var e log.Entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	resp, err := c.Get("http://nih/admin/logs?level=warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(resp.Body)
+	if e := read(dec); e.Message != "older warning" || e.Level != log.LevelWarn {
+		t.Errorf("entry %+v", e)
+	}
+	if dec.More() {
+		t.Error("info entry at level warn")
+	}
+	resp.Body.Close()
+
+	resp, err = c.Get("http://nih/admin/logs?follow=1&since=" + url.QueryEscape(time.Now().Add(-time.Hour).Format(time.RFC3339)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	dec = json.NewDecoder(resp.Body)
+	if e := read(dec); e.Message != "old" || len(e.Attrs) != 1 || e.Attrs[0] != (log.Attr{Key: "k", Value: "v"}) {
+		t.Errorf("entry %+v", e)
+	}
+	read(dec)
+
+	l.Error("new")
+	if e := read(dec); e.Message != "new" {
+		t.Errorf("followed entry %+v", e)
+	}
+
+	peer, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(client(peer), addr, "/admin/logs", new(any)); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("logs over TLS: %v", err)
+	}
+}
+
+func TestBench(t *testing.T) {
+	load := credentials(t)
+	_, addr, _ := start(t, daemon.Config{Credentials: load})
+
+	peer, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client(peer)
+
+	resp, err := c.Post("https://"+addr.String()+"/bench/discard", "application/octet-stream", strings.NewReader(strings.Repeat("x", 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res daemon.BenchResult
+	json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if res.Bytes != 1000 {
+		t.Errorf("discarded %d bytes, want 1000", res.Bytes)
+	}
+
+	resp, err = c.Get("https://" + addr.String() + "/bench/zero?size=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if len(body) != 5000 || strings.Trim(string(body), "\x00") != "" {
+		t.Errorf("received %d bytes", len(body))
+	}
+
+	resp, err = c.Get("https://" + addr.String() + "/bench/zero?size=" + strconv.Itoa(daemon.MaxBenchSize+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("oversized: %s", resp.Status)
+	}
+}
+
+func TestKV(t *testing.T) {
+	named := namedCredentials(t)
+	roles := []string{"node", "admin"}
+	timing := raft.Config{HeartbeatInterval: 10 * time.Millisecond, ElectionTimeout: 100 * time.Millisecond}
+	bootstrap := timing
+	bootstrap.Bootstrap = true
+	a, aaddr, _ := start(t, daemon.Config{Credentials: named("a", "node"), KV: &kv.Config{Raft: bootstrap}, KVRoles: roles})
+	// b joins the cluster of a, which reaches b at the address b gives.
+	b, baddr, _ := start(t, daemon.Config{
+		Credentials:  named("b", "node"),
+		Peers:        []string{aaddr.String()},
+		PeerInterval: 10 * time.Millisecond,
+		KV:           &kv.Config{Raft: timing},
+		KVRoles:      roles,
+	})
+
+	bundle := func(cn string, roles ...string) *trust.Bundle {
+		b, err := named(cn, roles...)()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	admin := client(bundle("admin", "admin"))
+	apply := func(addr net.Addr, c kv.Change) (kv.Entry, int) {
+		t.Helper()
+		body, _ := json.Marshal(&c)
+		resp, err := admin.Post("https://"+addr.String()+"/kv/apply", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var e kv.Entry
+		if resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&e)
+		}
+		return e, resp.StatusCode
+	}
+
+	// A change made through a follower is made by the leader, once the
+	// follower reaches it.
+	var e kv.Entry
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var status int
+		e, status = apply(baddr, kv.Change{Op: kv.Put, Key: "config/version", Value: []byte("7")})
+		if status == http.StatusOK {
+			break
+		}
+		// b reaches a once it probed it, and joined its cluster.
+		if status != http.StatusServiceUnavailable || time.Now().After(deadline) {
+			t.Fatalf("put through b: status %d", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, ok := b.KV().Get("config/version"); !ok || got.Version != e.Version {
+		t.Errorf("b has %+v, %v", got, ok)
+	}
+	if got, ok := a.KV().Get("config/version"); !ok || string(got.Value) != "7" {
+		t.Errorf("a has %+v, %v", got, ok)
+	}
+
+	old := e.Version - 1
+	if _, status := apply(baddr, kv.Change{Op: kv.Put, Key: "config/version", IfVersion: &old}); status != http.StatusConflict {
+		t.Errorf("put of an old version: status %d", status)
+	}
+	if _, status := apply(aaddr, kv.Change{Op: kv.Put, Key: "a//b"}); status != http.StatusBadRequest {
+		t.Errorf("put of an invalid key: status %d", status)
+	}
+
+	var st raft.Status
+	if err := get(admin, baddr, "/kv/status", &st); err != nil || st.Leader != "a" || len(st.Servers) != 2 {
+		t.Errorf("status of b = %+v, %v", st, err)
+	}
+
+	// Changes made on the leader reach the follower.
+	if _, err := a.KV().Put(context.Background(), "peers/c", []byte("10.0.0.3")); err != nil {
+		t.Fatal(err)
+	}
+	for b.KV().Index() < a.KV().Index() {
+		if time.Now().After(deadline) {
+			t.Fatalf("b at %d, a at %d", b.KV().Index(), a.KV().Index())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var entries []kv.Entry
+	if err := get(admin, baddr, "/kv/keys?prefix=peers/", &entries); err != nil || len(entries) != 1 || entries[0].Key != "peers/c" {
+		t.Errorf("keys of b = %+v, %v", entries, err)
+	}
+	if err := get(admin, baddr, "/kv/keys/peers/c", &e); err != nil || string(e.Value) != "10.0.0.3" {
+		t.Errorf("peers/c of b = %+v, %v", e, err)
+	}
+	if err := get(admin, baddr, "/kv/keys/peers/d", &e); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing key: %v", err)
+	}
+
+	// Peers without a role of the kv roles may neither use the store nor
+	// replicate it, and nodes speak for themselves only.
+	if err := get(client(bundle("other")), aaddr, "/kv/keys", &entries); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("keys for other: %v", err)
+	}
+	for cn, roles := range map[string][]string{"other": nil, "c": {"node"}} {
+		c, err := rpc.Dial(context.Background(), bundle(cn, roles...), baddr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		req := raft.AppendRequest{Term: 100, Leader: "a"}
+		if _, err := rpc.Call[raft.AppendRequest, raft.AppendResponse](context.Background(), c, "kv.AppendEntries", req); rpc.ErrorCode(err) != rpc.CodePermissionDenied {
+			t.Errorf("append entries of a by %s: %v", cn, err)
+		}
+	}
+
+	// A duty runs on the node leading its election, which the others list.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	led := make(chan struct{})
+	go a.Lead(ctx, "crl", func(ctx context.Context) {
+		close(led)
+		<-ctx.Done()
+	})
+	select {
+	case <-led:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a to lead")
+	}
+	var leases []kv.Lease
+	for get(admin, baddr, "/kv/elections", &leases); len(leases) == 0; get(admin, baddr, "/kv/elections", &leases) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the lease of a to reach b")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if leases[0].Election != "crl" || leases[0].Holder != "a" {
+		t.Errorf("elections of b = %+v", leases)
+	}
+
+	// The nodes of singleton schedules campaign to run them.
+	sched, err := a.AddSchedule(daemon.Schedule{Name: "crl", Cron: "@daily", Singleton: true, Job: jobs.Spec{Task: "reload", Nodes: []string{"a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for !slices.ContainsFunc(leases, func(l kv.Lease) bool { return l.Election == daemon.ScheduleElection && l.Holder == "a" }) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for a to lead the schedules: %+v", leases)
+		}
+		time.Sleep(time.Millisecond)
+		get(admin, baddr, "/kv/elections", &leases)
+	}
+	for sched = a.Schedules()[0]; sched.Next.IsZero(); sched = a.Schedules()[0] {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for a to schedule crl")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	body, _ := json.Marshal(&daemon.KVRemoveRequest{Name: "x"})
+	resp, err := admin.Post("https://"+baddr.String()+"/kv/remove", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("remove of a node of no replica: status %d", resp.StatusCode)
+	}
+
+	d, addr, _ := start(t, daemon.Config{Credentials: named("d")})
+	if err := get(admin, addr, "/kv/keys", &entries); err == nil || !strings.Contains(err.Error(), "501") {
+		t.Errorf("keys without a store: %v", err)
+	}
+	if err := d.Lead(ctx, "crl", func(context.Context) {}); err == nil {
+		t.Error("election without a store")
+	}
+	if _, err := d.AddSchedule(daemon.Schedule{Name: "crl", Cron: "@daily", Singleton: true, Job: jobs.Spec{Task: "reload", All: true}}); err == nil {
+		t.Error("singleton schedule without a store")
+	}
+}
+
+func TestJobs(t *testing.T) {
+	named := namedCredentials(t)
+	roles := []string{"jobs"}
+	_, baddr, _ := start(t, daemon.Config{Credentials: named("b"), JobRoles: roles})
+	a, aaddr, _ := start(t, daemon.Config{
+		Credentials:  named("a", "jobs"),
+		Peers:        []string{baddr.String()},
+		PeerInterval: 10 * time.Millisecond,
+		JobRoles:     roles,
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ps := a.Peers(); len(ps) == 0 || ps[0].Health != daemon.PeerOK; ps = a.Peers() {
+		if time.Now().After(deadline) {
+			t.Fatalf("b not probed: %+v", ps)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	alice, err := named("alice", "jobs")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client(alice)
+	submit := func(spec string) jobs.Job {
+		t.Helper()
+		resp, err := c.Post("https://"+aaddr.String()+"/jobs/", "application/json", strings.NewReader(spec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("submit %s: %s", spec, resp.Status)
+		}
+		var j jobs.Job
+		if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+			t.Fatal(err)
+		}
+		if err := get(c, aaddr, "/jobs/"+j.ID+"?wait=true", &j); err != nil {
+			t.Fatal(err)
+		}
+		return j
+	}
+
+	// A command on every node, a through b.
+	j := submit(`{"args": ["sh", "-c", "echo $NIH_JOB"], "env": ["NIH_JOB=hi"], "all": true}`)
+	if j.State != jobs.Succeeded || j.From != "alice" || len(j.Runs) != 2 {
+		t.Fatalf("job %+v", j)
+	}
+	for i, name := range []string{"a", "b"} {
+		if r := j.Runs[i]; r.Node != name || r.Exit == nil || *r.Exit != 0 || string(r.Stdout) != "hi\n" {
+			t.Errorf("run %+v, want on %s", r, name)
+		}
+	}
+
+	// A task, and a command failing on a node and missing on another.
+	if j := submit(`{"task": "reload", "nodes": ["b"]}`); j.State != jobs.Succeeded {
+		t.Errorf("reload on b: %+v", j)
+	}
+	j = submit(`{"args": ["sh", "-c", "exit 3"], "nodes": ["b", "c"]}`)
+	if j.State != jobs.Failed {
+		t.Errorf("job %s, want failed", j.State)
+	}
+	if r := j.Runs[0]; r.Exit == nil || *r.Exit != 3 {
+		t.Errorf("run on b %+v", r)
+	}
+	if r := j.Runs[1]; r.Exit != nil || r.Error != "c unreachable" {
+		t.Errorf("run on c %+v", r)
+	}
+
+	var list []jobs.Job
+	if err := get(c, aaddr, "/jobs/", &list); err != nil || len(list) != 3 || list[0].ID != j.ID {
+		t.Errorf("list = %+v, %v", list, err)
+	}
+	var tasks []daemon.TaskInfo
+	if err := get(c, aaddr, "/jobs/tasks", &tasks); err != nil || !slices.ContainsFunc(tasks, func(t daemon.TaskInfo) bool { return t.Name == "reload" }) {
+		t.Errorf("tasks = %+v, %v", tasks, err)
+	}
+	if err := get(c, aaddr, "/jobs/nope", &j); err == nil || err.Error() != "404 Not Found" {
+		t.Errorf("unknown job: %v", err)
+	}
+
+	// Peers need a role of the job roles to submit jobs, and to run them.
+	bob, err := named("bob")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(client(bob), aaddr, "/jobs/", &list); err == nil || err.Error() != "403 Forbidden" {
+		t.Errorf("list by bob: %v", err)
+	}
+	rc, err := rpc.Dial(context.Background(), bob, baddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	_, err = rpc.Call[jobs.Command, jobs.Result](context.Background(), rc, "jobs.Run", jobs.Command{Args: []string{"true"}})
+	if rpc.ErrorCode(err) != rpc.CodePermissionDenied {
+		t.Errorf("run by bob: %v", err)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	named := namedCredentials(t)
+	file := filepath.Join(t.TempDir(), daemon.DefaultSchedulesFile)
+	cfg := daemon.Config{Credentials: named("a"), Schedules: file, JobRoles: []string{"jobs"}}
+	d, addr, stop := start(t, cfg)
+
+	out := filepath.Join(t.TempDir(), "out")
+	s := daemon.Schedule{
+		Name: "touch",
+		Cron: "@every 1s",
+		Job:  jobs.Spec{Args: []string{"sh", "-c", "echo x >>" + out}, Nodes: []string{"a"}},
+	}
+	if _, err := d.AddSchedule(s); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	st := d.Schedules()[0]
+	for ; st.Last == nil || st.Last.State != jobs.Succeeded; st = d.Schedules()[0] {
+		if time.Now().After(deadline) {
+			t.Fatalf("schedule not run: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if j, ok := d.Jobs().Get(st.Last.Job); !ok || j.From != "schedule touch" {
+		t.Errorf("job of the schedule %+v", j)
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Error(err)
+	}
+
+	// The schedules and their last jobs survive a restart.
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := daemon.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := d.Schedules()
+	if len(list) != 1 || list[0].Cron != "@every 1s" || list[0].Last == nil || list[0].Last.Job == "" {
+		t.Errorf("schedules after a restart = %+v", list)
+	}
+
+	// Over HTTP, with the job roles.
+	alice, err := named("alice", "jobs")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(path, body string) int {
+		t.Helper()
+		resp, err := client(alice).Post("https://"+addr.String()+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	_, addr, _ = start(t, cfg)
+	if code := post("/schedule/", `{"name": "cert", "cron": "0 3 * * *", "jitter": "1m", "job": {"task": "check-cert", "all": true}}`); code != http.StatusOK {
+		t.Errorf("add: status %d", code)
+	}
+	for _, body := range []string{
+		`{"name": "bad", "cron": "0 3 * *", "job": {"task": "check-cert", "all": true}}`,
+		`{"name": "a/b", "cron": "@daily", "job": {"task": "check-cert", "all": true}}`,
+		`{"name": "bad", "cron": "@daily", "job": {"task": "check-cert"}}`,
+	} {
+		if code := post("/schedule/", body); code != http.StatusBadRequest {
+			t.Errorf("add of %s: status %d", body, code)
+		}
+	}
+	if code := post("/schedule/run", `{"name": "cert"}`); code != http.StatusOK {
+		t.Errorf("run: status %d", code)
+	}
+	if code := post("/schedule/remove", `{"name": "touch"}`); code != http.StatusOK {
+		t.Errorf("remove: status %d", code)
+	}
+	if code := post("/schedule/remove", `{"name": "touch"}`); code != http.StatusNotFound {
+		t.Errorf("remove of a schedule removed: status %d", code)
+	}
+	if err := get(client(alice), addr, "/schedule/", &list); err != nil || len(list) != 1 || list[0].Name != "cert" || list[0].Next.IsZero() {
+		t.Errorf("schedules = %+v, %v", list, err)
+	}
+	bob, err := named("bob")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(client(bob), addr, "/schedule/", &list); err == nil || err.Error() != "403 Forbidden" {
+		t.Errorf("schedules for bob: %v", err)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	named := namedCredentials(t)
+	roles := []string{"secrets"}
+	bfile := filepath.Join(t.TempDir(), daemon.DefaultSecretsFile)
+	bcfg := daemon.Config{Credentials: named("b"), SecretRoles: roles, Secrets: bfile}
+	b, baddr, _ := start(t, bcfg)
+	a, aaddr, _ := start(t, daemon.Config{
+		Credentials:  named("a", "secrets"),
+		Peers:        []string{baddr.String()},
+		PeerInterval: 10 * time.Millisecond,
+		SecretRoles:  roles,
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ps := a.Peers(); len(ps) == 0 || ps[0].Health != daemon.PeerOK; ps = a.Peers() {
+		if time.Now().After(deadline) {
+			t.Fatalf("b not probed: %+v", ps)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx := context.Background()
+	out := filepath.Join(t.TempDir(), "token")
+	results, err := a.PutSecret(ctx, daemon.SecretPut{Name: "token", Value: []byte("hunter2"), Nodes: []string{"b", "c"}, File: out, Mode: 0640}, "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Error != "" || results[1].Error != "c unreachable" {
+		t.Errorf("put results %+v", results)
+	}
+	if v, err := b.SecretValue("token"); err != nil || string(v) != "hunter2" {
+		t.Errorf("value on b %q, %v", v, err)
+	}
+	if _, err := a.SecretValue("token"); rpc.ErrorCode(err) != rpc.CodeNotFound {
+		t.Errorf("value on a: %v", err)
+	}
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("file of the secret: %v, %v", fi, err)
+	}
+	if data, _ := os.ReadFile(bfile); len(data) == 0 || bytes.Contains(data, []byte("hunter2")) {
+		t.Errorf("secrets file %s", data)
+	}
+
+	// The secrets survive a restart, and their files are written again.
+	os.Remove(out)
+	restarted, err := daemon.New(bcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := restarted.Secrets(); len(list) != 1 || list[0].From != "control" || list[0].Sealed != nil {
+		t.Errorf("secrets after a restart %+v", list)
+	}
+	if data, err := os.ReadFile(out); err != nil || string(data) != "hunter2" {
+		t.Errorf("file after a restart %q, %v", data, err)
+	}
+
+	// Values are only served over the control socket, even to the roles.
+	alice, err := named("alice", "secrets")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v daemon.SecretValue
+	if err := get(client(alice), baddr, "/secrets/value?name=token", &v); err == nil || err.Error() != "403 Forbidden" {
+		t.Errorf("value over TLS: %v", err)
+	}
+	var list []daemon.Secret
+	if err := get(client(alice), baddr, "/secrets/", &list); err != nil || len(list) != 1 {
+		t.Errorf("list for alice %+v, %v", list, err)
+	}
+	bob, err := named("bob")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client(bob).Post("https://"+aaddr.String()+"/secrets/", "application/json", strings.NewReader(`{"name": "x", "value": "eA==", "all": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("put for bob: %s", resp.Status)
+	}
+
+	results, err = a.DeleteSecret(ctx, daemon.SecretDelete{Name: "token", Nodes: []string{"b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != "" {
+		t.Errorf("delete results %+v", results)
+	}
+	if _, err := os.Stat(out); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file of a deleted secret: %v", err)
+	}
+}
+
+func TestConfigBundles(t *testing.T) {
+	named := namedCredentials(t)
+	roles := []string{"config"}
+	bcfg := daemon.Config{
+		Credentials: named("b"),
+		ConfigRoles: roles,
+		Bundles:     filepath.Join(t.TempDir(), daemon.DefaultBundlesFile),
+	}
+	b, baddr, _ := start(t, bcfg)
+	a, aaddr, _ := start(t, daemon.Config{
+		Credentials:  named("a", "config"),
+		Peers:        []string{baddr.String()},
+		PeerInterval: 10 * time.Millisecond,
+		ConfigRoles:  roles,
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ps := a.Peers(); len(ps) == 0 || ps[0].Health != daemon.PeerOK; ps = a.Peers() {
+		if time.Now().After(deadline) {
+			t.Fatalf("b not probed: %+v", ps)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "app.conf")
+	one := confbundle.Content{
+		Settings: map[string]string{"exec-roles": "ops"},
+		Files:    []confbundle.File{{Path: file, Mode: 0640, Data: []byte("one")}},
+	}
+	pushed, err := a.PushBundle(ctx, daemon.BundlePush{Message: "first", Content: one})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Version != 1 || len(pushed.Nodes) != 2 || pushed.Nodes[1].Node != "b" || pushed.Nodes[1].Version != 1 {
+		t.Errorf("pushed %+v", pushed)
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("file of the bundle: %v, %v", fi, err)
+	}
+	setting := func(d *daemon.Daemon, name string) string {
+		for _, s := range d.Settings() {
+			if s.Name == name {
+				return s.Value
+			}
+		}
+		return ""
+	}
+	if v := setting(b, "exec-roles"); v != "ops" {
+		t.Errorf("exec-roles on b %q", v)
+	}
+
+	// A bundle whose reload fails is rolled back, and not offered.
+	two := confbundle.Content{
+		Settings: map[string]string{"exec-roles": "ops,dev"},
+		Files:    []confbundle.File{{Path: file, Mode: 0600, Data: []byte("two")}},
+		Reload:   []string{"sh", "-c", "echo broken; exit 3"},
+	}
+	pushed, err = a.PushBundle(ctx, daemon.BundlePush{Content: two})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pushed.Nodes) != 1 || pushed.Nodes[0].Version != 1 || pushed.Nodes[0].Failed != 2 || !strings.HasSuffix(pushed.Nodes[0].Error, "broken") {
+		t.Errorf("pushed a failing bundle %+v", pushed)
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "one" {
+		t.Errorf("file after a rollback %q, %v", data, err)
+	}
+	if v := setting(a, "exec-roles"); v != "ops" {
+		t.Errorf("exec-roles after a rollback %q", v)
+	}
+	if s := b.BundleStatus(); s.Version != 1 || s.Failed != 0 {
+		t.Errorf("status of b %+v", s)
+	}
+
+	// Rolling back pushes an old bundle again, as a new version.
+	if _, err := a.RollbackBundle(ctx, 2); rpc.ErrorCode(err) != rpc.CodeNotFound {
+		t.Errorf("rollback to a failed bundle: %v", err)
+	}
+	pushed, err = a.RollbackBundle(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.Version != 3 || pushed.Nodes[1].Version != 3 {
+		t.Errorf("rolled back %+v", pushed)
+	}
+	if h := b.BundleHistory(); len(h) != 2 || h[0].Version != 3 || h[0].Signer != "a" || h[0].Files[0] != file {
+		t.Errorf("history of b %+v", h)
+	}
+
+	// A node the push did not reach pulls the bundle from its peers.
+	c, _, _ := start(t, daemon.Config{
+		Credentials:  named("c", "config"),
+		Peers:        []string{aaddr.String()},
+		PeerInterval: 10 * time.Millisecond,
+		ConfigRoles:  roles,
+	})
+	for s := c.BundleStatus(); s.Version != 3; s = c.BundleStatus() {
+		if time.Now().After(deadline.Add(5 * time.Second)) {
+			t.Fatalf("bundle not pulled: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The settings of the bundle survive a restart.
+	restarted, err := daemon.New(bcfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := setting(restarted, "exec-roles"); v != "ops" {
+		t.Errorf("exec-roles after a restart %q", v)
+	}
+	if s := restarted.BundleStatus(); s.Version != 3 {
+		t.Errorf("status after a restart %+v", s)
+	}
+
+	// Peers need a config role to push.
+	bob, err := named("bob")()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client(bob).Post("https://"+aaddr.String()+"/bundles/push", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("push for bob: %s", resp.Status)
+	}
+}
@@ -0,0 +1,144 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+
+	"nih.software/log"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "exec",
+		Summary: "run commands on the node",
+		Handler: execHandler,
+	})
+}
+
+// ExecRequest is the request of the exec service.
+type ExecRequest struct {
+	// Args are the command and its arguments. The command is looked up in
+	// the daemon's PATH.
+	Args []string `json:"args"`
+
+	// Dir is the working directory. Empty means the daemon's.
+	Dir string `json:"dir,omitempty"`
+
+	// Env holds extra environment variables in "KEY=value" form,
+	// added to the daemon's environment.
+	Env []string `json:"env,omitempty"`
+}
+
+// An ExecFrame is one message of the response of the exec service,
+// a stream of JSON objects. Every frame but the last carries output;
+// the last carries the exit code, or an error if the command could not be waited for.
+type ExecFrame struct {
+	Stdout []byte `json:"stdout,omitempty"`
+	Stderr []byte `json:"stderr,omitempty"`
+	Exit   *int   `json:"exit,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func execHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "exec", d.config().ExecRoles) {
+			return
+		}
+
+		var req ExecRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || len(req.Args) == 0 {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+
+		cmd := exec.CommandContext(r.Context(), req.Args[0], req.Args[1:]...)
+		cmd.Dir = req.Dir
+		cmd.Env = append(os.Environ(), req.Env...)
+
+		out := &frameWriter{w: w}
+		cmd.Stdout = stream{out, false}
+		cmd.Stderr = stream{out, true}
+
+		if err := cmd.Start(); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+
+		log.Default().Info("daemon: exec", append(peerAttrs(r), "args", req.Args, "pid", cmd.Process.Pid)...)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		out.flush()
+
+		err := cmd.Wait()
+
+		var xerr *exec.ExitError
+		frame := &ExecFrame{}
+		switch {
+		case err == nil || errors.As(err, &xerr) && xerr.Exited():
+			code := cmd.ProcessState.ExitCode()
+			frame.Exit = &code
+		default:
+			frame.Error = err.Error()
+		}
+
+		log.Default().Info("daemon: exec done", append(peerAttrs(r), "pid", cmd.Process.Pid, "state", cmd.ProcessState.String())...)
+		out.write(frame)
+	})
+
+	return mux
+}
+
+// A frameWriter writes ExecFrames to a response, flushing each one.
+// The command's output streams write from separate goroutines.
+type frameWriter struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+}
+
+func (fw *frameWriter) write(f *ExecFrame) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if err := json.NewEncoder(fw.w).Encode(f); err != nil {
+		return err
+	}
+	fw.flushLocked()
+	return nil
+}
+
+func (fw *frameWriter) flush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.flushLocked()
+}
+
+func (fw *frameWriter) flushLocked() {
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// stream is the standard output or error of a command run by the exec service.
+type stream struct {
+	fw     *frameWriter
+	stderr bool
+}
+
+func (s stream) Write(p []byte) (int, error) {
+	f := &ExecFrame{Stdout: p}
+	if s.stderr {
+		f = &ExecFrame{Stderr: p}
+	}
+
+	if err := s.fw.write(f); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,322 @@
+package daemon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"nih.software/log"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "files",
+		Summary: "read and write files on the node",
+		Handler: filesHandler,
+	})
+}
+
+// PartSuffix is appended to the name of a file being received, until
+// its transfer is complete and verified. A transfer that was interrupted
+// resumes from the end of the partial file.
+const PartSuffix = ".nihpart"
+
+// FileInfo describes a file or directory, as reported by the files service.
+type FileInfo struct {
+	// Path is the path of the file, as requested. In a walk, it is the
+	// slash-separated path relative to the root of the walk, "." for the root.
+	Path    string      `json:"path"`
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	IsDir   bool        `json:"is_dir"`
+}
+
+func newFileInfo(path string, fi fs.FileInfo) *FileInfo {
+	return &FileInfo{
+		Path:    path,
+		Size:    fi.Size(),
+		Mode:    fi.Mode().Perm(),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+	}
+}
+
+// FileSum is the response of the files service's sum endpoint.
+type FileSum struct {
+	SHA256 string `json:"sha256"`
+}
+
+// The files service has these endpoints, each taking the path of a file
+// on the node in the path query parameter, relative to the daemon's
+// working directory unless absolute:
+//
+//	GET  /stat     the FileInfo of path, or with part=1, of its partial file
+//	GET  /walk     the FileInfo of every file and directory under path
+//	GET  /sum      the FileSum of path
+//	GET  /content  the content of path, with support for Range requests
+//	PUT  /content  write the body at offset in the partial file of path
+//	POST /commit   verify the partial file against sha256, set its mode,
+//	               and rename it to path
+//	POST /mkdir    create the directory path and any parents with mode
+func filesHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+
+	handle := func(pattern string, f func(w http.ResponseWriter, r *http.Request, path string) error) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if !d.authorize(w, r, "files", d.config().FileRoles) {
+				return
+			}
+
+			path := r.URL.Query().Get("path")
+			if path == "" {
+				http.Error(w, "missing path", http.StatusBadRequest)
+				return
+			}
+
+			if err := f(w, r, path); err != nil {
+				fileError(w, err)
+			}
+		})
+	}
+
+	handle("GET /stat", func(w http.ResponseWriter, r *http.Request, path string) error {
+		name := path
+		if r.URL.Query().Get("part") == "1" {
+			name += PartSuffix
+		}
+
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+
+		writeJSON(w, newFileInfo(path, fi))
+		return nil
+	})
+
+	handle("GET /walk", func(w http.ResponseWriter, r *http.Request, path string) error {
+		infos := []*FileInfo{}
+		err := filepath.WalkDir(path, func(name string, e fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			fi, err := e.Info()
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(path, name)
+			if err != nil {
+				return err
+			}
+
+			// Only regular files and directories: a symbolic link could
+			// lead a copy out of the tree.
+			if fi.Mode().IsRegular() || fi.IsDir() {
+				infos = append(infos, newFileInfo(filepath.ToSlash(rel), fi))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		writeJSON(w, infos)
+		return nil
+	})
+
+	handle("GET /sum", func(w http.ResponseWriter, r *http.Request, path string) error {
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+
+		writeJSON(w, &FileSum{SHA256: sum})
+		return nil
+	})
+
+	handle("GET /content", func(w http.ResponseWriter, r *http.Request, path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return errNotRegular
+		}
+
+		log.Default().Info("daemon: files: send", append(peerAttrs(r), "path", path, "size", fi.Size())...)
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+		return nil
+	})
+
+	handle("PUT /content", func(w http.ResponseWriter, r *http.Request, path string) error {
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return nil
+		}
+
+		part := path + PartSuffix
+		flags := os.O_WRONLY | os.O_CREATE
+		if offset == 0 {
+			flags |= os.O_TRUNC
+		}
+
+		f, err := os.OpenFile(part, flags, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() != offset {
+			http.Error(w, "offset "+strconv.FormatInt(offset, 10)+" is not the size of the partial file, "+strconv.FormatInt(fi.Size(), 10), http.StatusConflict)
+			return nil
+		}
+
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		n, err := io.Copy(f, r.Body)
+		if err != nil {
+			// Keep what arrived, for the client to resume from.
+			log.Default().Info("daemon: files: receive interrupted", append(peerAttrs(r), "path", path, "offset", offset+n, "err", err)...)
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+
+	handle("POST /commit", func(w http.ResponseWriter, r *http.Request, path string) error {
+		q := r.URL.Query()
+
+		mode, err := strconv.ParseUint(q.Get("mode"), 8, 32)
+		if err != nil || mode&^0777 != 0 {
+			http.Error(w, "invalid mode", http.StatusBadRequest)
+			return nil
+		}
+
+		part := path + PartSuffix
+		sum, err := fileSHA256(part)
+		if err != nil {
+			return err
+		}
+
+		if sum != q.Get("sha256") {
+			os.Remove(part)
+			log.Default().Warn("daemon: files: checksum mismatch", append(peerAttrs(r), "path", path)...)
+			http.Error(w, "SHA-256 mismatch: received "+sum, http.StatusUnprocessableEntity)
+			return nil
+		}
+
+		if err := os.Chmod(part, fs.FileMode(mode)); err != nil {
+			return err
+		}
+		if err := os.Rename(part, path); err != nil {
+			return err
+		}
+
+		log.Default().Info("daemon: files: received", append(peerAttrs(r), "path", path, "sha256", sum)...)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+
+	handle("POST /mkdir", func(w http.ResponseWriter, r *http.Request, path string) error {
+		mode, err := strconv.ParseUint(r.URL.Query().Get("mode"), 8, 32)
+		if err != nil || mode&^0777 != 0 {
+			http.Error(w, "invalid mode", http.StatusBadRequest)
+			return nil
+		}
+
+		if err := os.MkdirAll(path, fs.FileMode(mode)); err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+
+	return mux
+}
+
+var errNotRegular = errors.New("not a regular file")
+
+// fileError responds with the status matching err, a file system error.
+func fileError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errNotRegular):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFileAtomic writes data to the file name with mode, through a
+// temporary file renamed over it, creating its directory if need be.
+func writeFileAtomic(name string, data []byte, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	// CreateTemp creates the file with mode 0600.
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if mode != 0600 {
+		if err := os.Chmod(tmp.Name(), mode); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), name)
+}
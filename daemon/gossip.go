@@ -0,0 +1,206 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"nih.software/gossip"
+	"nih.software/log"
+	"nih.software/rpc"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "gossip",
+		Summary: "keep the membership of the cluster",
+		Methods: gossipMethods,
+	})
+}
+
+// gossipPingReq is the request of gossip.PingReq.
+type gossipPingReq struct {
+	Target  gossip.Member  `json:"target"`
+	Message gossip.Message `json:"message"`
+}
+
+func gossipMethods(d *Daemon, s *rpc.Server) {
+	rpc.Register(s, "gossip.Ping", nil, func(ctx context.Context, m gossip.Message) (gossip.Message, error) {
+		g, err := d.gossipFrom(ctx, &m)
+		if err != nil {
+			return gossip.Message{}, err
+		}
+		return *g.HandlePing(&m), nil
+	})
+
+	rpc.Register(s, "gossip.PingReq", nil, func(ctx context.Context, req gossipPingReq) (gossip.Message, error) {
+		g, err := d.gossipFrom(ctx, &req.Message)
+		if err != nil {
+			return gossip.Message{}, err
+		}
+		reply, err := g.HandlePingReq(ctx, req.Target, &req.Message)
+		if err != nil {
+			return gossip.Message{}, rpc.Errorf(rpc.CodeUnavailable, "%s: %v", req.Target.Name, err)
+		}
+		return *reply, nil
+	})
+
+	rpc.Register(s, "gossip.Sync", nil, func(ctx context.Context, m gossip.Message) (gossip.Message, error) {
+		g, err := d.gossipFrom(ctx, &m)
+		if err != nil {
+			return gossip.Message{}, err
+		}
+		return *g.HandleSync(&m), nil
+	})
+}
+
+// gossipFrom returns the gossip node of the daemon to handle m with, once
+// it checked that the caller sends m for itself. It fills in the host of
+// the caller's address if the caller left it unspecified.
+func (d *Daemon) gossipFrom(ctx context.Context, m *gossip.Message) (*gossip.Node, error) {
+	g := d.gossip.Load()
+	if g == nil {
+		return nil, rpc.Errorf(rpc.CodeUnimplemented, "gossip is disabled")
+	}
+
+	id, ok := rpc.Peer(ctx)
+	if !ok || id.Name() != m.From.Name {
+		return nil, rpc.Errorf(rpc.CodePermissionDenied, "gossip from %s for %s", id.Name(), m.From.Name)
+	}
+	if addr := rpc.RemoteAddr(ctx); addr != nil {
+		host, _, _ := net.SplitHostPort(addr.String())
+		localize(m, host)
+	}
+	return g, nil
+}
+
+// localize replaces the unspecified host of the address of the sender of m,
+// as it knows itself, with host, the one it was reached at.
+func localize(m *gossip.Message, host string) {
+	fix := func(u *gossip.Member) {
+		u.Addr = localizeAddr(u.Addr, host)
+	}
+
+	fix(&m.From)
+	for i := range m.Updates {
+		if m.Updates[i].Name == m.From.Name {
+			fix(&m.Updates[i])
+		}
+	}
+}
+
+// localizeAddr returns addr with host in place of its host if it is
+// unspecified.
+func localizeAddr(addr, host string) string {
+	h, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return addr
+	}
+	if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+		return net.JoinHostPort(host, port)
+	}
+	return addr
+}
+
+// gossipTransport carries gossip between daemons over RPC, with a
+// connection of the current credentials for every message.
+type gossipTransport struct {
+	d *Daemon
+}
+
+func (t gossipTransport) Ping(ctx context.Context, to gossip.Member, m *gossip.Message) (*gossip.Message, error) {
+	return gossipCall(ctx, t.d, to, to.Name, "gossip.Ping", m)
+}
+
+func (t gossipTransport) PingReq(ctx context.Context, via, target gossip.Member, m *gossip.Message) (*gossip.Message, error) {
+	return gossipCall(ctx, t.d, via, target.Name, "gossip.PingReq", &gossipPingReq{Target: target, Message: *m})
+}
+
+func (t gossipTransport) Sync(ctx context.Context, to gossip.Member, m *gossip.Message) (*gossip.Message, error) {
+	return gossipCall(ctx, t.d, to, to.Name, "gossip.Sync", m)
+}
+
+// gossipCall calls method of the daemon of to, which must hold the
+// certificate of its name if it has one, and returns its answer, which
+// must be from the node from, or from the daemon called if from is empty.
+func gossipCall[Req any](ctx context.Context, d *Daemon, to gossip.Member, from, method string, req *Req) (*gossip.Message, error) {
+	c, err := d.client(ctx, to.Addr, to.Name)
+	if err != nil {
+		return nil, err
+	}
+	id, _ := c.Peer()
+
+	reply, err := rpc.Call[Req, gossip.Message](ctx, c, method, *req)
+	if err != nil {
+		return nil, err
+	}
+	if from == "" {
+		from = id.Name()
+	}
+	if reply.From.Name != from {
+		return nil, fmt.Errorf("daemon: gossip of %s from %s", from, reply.From.Name)
+	}
+	if from == id.Name() {
+		host, _, _ := net.SplitHostPort(to.Addr)
+		localize(&reply, host)
+	}
+	return &reply, nil
+}
+
+// startGossip starts the gossip node of the daemon, reached at addr, which
+// runs until ctx is done.
+func (d *Daemon) startGossip(ctx context.Context, addr net.Addr) {
+	cfg := *d.cfg.Gossip
+	cfg.Name = d.Bundle().Chain()[0].Subject.CommonName
+	cfg.Addr = addr.String()
+	cfg.Transport = gossipTransport{d}
+	cfg.Clock = &d.clock
+	notify := cfg.Notify
+	cfg.Notify = func(m gossip.Member) {
+		log.Default().Info("daemon: member", "name", m.Name, "addr", m.Addr, "state", m.State)
+		if notify != nil {
+			notify(m)
+		}
+	}
+
+	g, err := gossip.New(cfg)
+	if err != nil {
+		log.Default().Warn("daemon: no gossip", "err", err)
+		d.errs.add("gossip: " + err.Error())
+		return
+	}
+	d.gossip.Store(g)
+	go g.Run(ctx)
+}
+
+// joinGossip joins the members of the cluster through the targets, if the
+// daemon gossips but knows no other member alive.
+func (d *Daemon) joinGossip(ctx context.Context, targets []target) {
+	g := d.gossip.Load()
+	if g == nil || g.Alive() > 0 || len(targets) == 0 {
+		return
+	}
+
+	var addrs []string
+	for _, tg := range targets {
+		addrs = append(addrs, tg.addrs[0])
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, peerProbeTimeout)
+	defer cancel()
+	if _, err := g.Join(ctx, addrs...); err != nil {
+		log.Default().Debug("daemon: join gossip", "err", err)
+	}
+}
+
+// leaveGossip has the daemon leave the members of the cluster, if it
+// gossips.
+func (d *Daemon) leaveGossip(ctx context.Context) {
+	g := d.gossip.Swap(nil)
+	if g == nil {
+		return
+	}
+	if err := g.Leave(ctx); err != nil {
+		log.Default().Debug("daemon: leave gossip", "err", err)
+	}
+}
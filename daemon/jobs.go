@@ -0,0 +1,335 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"nih.software/jobs"
+	"nih.software/log"
+	"nih.software/rpc"
+	"nih.software/trust"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "jobs",
+		Summary: "run jobs across the nodes of the cluster",
+		Handler: jobsHandler,
+		Methods: jobsMethods,
+	})
+
+	RegisterTask(&Task{
+		Name:    "reload",
+		Summary: "reload the credentials of the node",
+		Run: func(ctx context.Context, d *Daemon, args []string, stdout, stderr io.Writer) error {
+			if len(args) > 0 {
+				return errors.New("reload takes no arguments")
+			}
+			return d.Reload()
+		},
+	})
+}
+
+// A Task is Go code a job may run on the nodes of the cluster by name,
+// as it runs a command.
+type Task struct {
+	// Name is the name jobs run the task by.
+	Name string
+
+	// Summary is a one-line description of the task.
+	Summary string
+
+	// Run runs the task in d with the arguments of the job, writing its
+	// output to stdout and stderr, until it is done or ctx is. The job
+	// fails on the node if it returns an error.
+	Run func(ctx context.Context, d *Daemon, args []string, stdout, stderr io.Writer) error
+}
+
+var (
+	tasksMu sync.Mutex
+	tasks   = make(map[string]*Task)
+)
+
+// RegisterTask adds a task to every daemon. It panics if the name is
+// already taken.
+func RegisterTask(t *Task) {
+	tasksMu.Lock()
+	defer tasksMu.Unlock()
+
+	if t.Name == "" || strings.ContainsAny(t.Name, " \t\n") {
+		panic("daemon: invalid task name " + t.Name)
+	}
+	if tasks[t.Name] != nil {
+		panic("daemon: duplicate task " + t.Name)
+	}
+	tasks[t.Name] = t
+}
+
+// Tasks returns the registered tasks in name order.
+func Tasks() []*Task {
+	tasksMu.Lock()
+	defer tasksMu.Unlock()
+
+	ts := make([]*Task, 0, len(tasks))
+	for _, t := range tasks {
+		ts = append(ts, t)
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].Name < ts[j].Name
+	})
+	return ts
+}
+
+func lookupTask(name string) *Task {
+	tasksMu.Lock()
+	defer tasksMu.Unlock()
+
+	return tasks[name]
+}
+
+// TaskInfo describes a task in the response of the tasks endpoint of the
+// jobs service.
+type TaskInfo struct {
+	Name    string `json:"name"`
+	Summary string `json:"summary"`
+}
+
+// Jobs returns the manager of the jobs submitted to the daemon.
+func (d *Daemon) Jobs() *jobs.Manager {
+	return d.jobs
+}
+
+// jobNodes returns the names of the nodes the jobs for all nodes run on:
+// the daemon's, and those of the nodes it knows and reaches.
+func (d *Daemon) jobNodes() []string {
+	return append([]string{d.Bundle().Chain()[0].Subject.CommonName}, d.kvNodes()...)
+}
+
+// jobsFrom checks the caller of a method of the jobs service may run the
+// commands of jobs on the daemon.
+func (d *Daemon) jobsFrom(ctx context.Context) error {
+	leaf, roles := rpcLeaf(ctx), d.config().JobRoles
+	switch {
+	case leaf == nil || trust.HasRole(leaf, roles...):
+		return nil
+	case len(roles) == 0:
+		return rpc.Errorf(rpc.CodePermissionDenied, "jobs are disabled for peers")
+	}
+	return rpc.Errorf(rpc.CodePermissionDenied, "jobs require a role of %s", strings.Join(roles, ", "))
+}
+
+func jobsMethods(d *Daemon, s *rpc.Server) {
+	rpc.Register(s, "jobs.Run", nil, func(ctx context.Context, c jobs.Command) (jobs.Result, error) {
+		if err := d.jobsFrom(ctx); err != nil {
+			return jobs.Result{}, err
+		}
+		if c.Task == "" && len(c.Args) == 0 {
+			return jobs.Result{}, rpc.Errorf(rpc.CodeInvalidArgument, "a job needs a command or a task")
+		}
+		from := "control"
+		if id, ok := rpc.Peer(ctx); ok {
+			from = id.Name()
+		}
+		return d.runCommand(ctx, c, from), nil
+	})
+}
+
+// runCommand runs the command of a job on the daemon, for the node named
+// from that coordinates it.
+func (d *Daemon) runCommand(ctx context.Context, c jobs.Command, from string) jobs.Result {
+	var stdout, stderr tailWriter
+	var res jobs.Result
+	attrs := []any{"job", c.Job, "from", from, "attempt", c.Attempt}
+
+	if c.Task != "" {
+		t := lookupTask(c.Task)
+		if t == nil {
+			return jobs.Result{Error: "no task " + c.Task}
+		}
+		log.Default().Info("daemon: job task", append(attrs, "task", c.Task, "args", c.Args)...)
+		code := 0
+		if err := t.Run(ctx, d, c.Args, &stdout, &stderr); err != nil {
+			code, res.Error = 1, err.Error()
+		}
+		res.Exit = &code
+	} else {
+		cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+		cmd.Dir = c.Dir
+		cmd.Env = append(os.Environ(), c.Env...)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Start(); err != nil {
+			return jobs.Result{Error: err.Error()}
+		}
+		log.Default().Info("daemon: job exec", append(attrs, "args", c.Args, "pid", cmd.Process.Pid)...)
+
+		err := cmd.Wait()
+		var xerr *exec.ExitError
+		switch {
+		case err == nil || errors.As(err, &xerr) && xerr.Exited():
+			code := cmd.ProcessState.ExitCode()
+			res.Exit = &code
+		default:
+			res.Error = err.Error()
+		}
+	}
+
+	res.Stdout, res.Stderr = stdout.bytes(), stderr.bytes()
+	log.Default().Info("daemon: job done", append(attrs, "exit", res.Exit, "error", res.Error)...)
+	return res
+}
+
+// A tailWriter keeps the last jobs.MaxOutput bytes written to it.
+type tailWriter struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	if n := len(w.buf) - jobs.MaxOutput; n > 0 {
+		w.buf = append(w.buf[:0], w.buf[n:]...)
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.buf
+}
+
+// jobTransport runs the commands of the jobs of the daemon on itself, and
+// on the other nodes over RPC, over the connections the daemon keeps.
+type jobTransport struct {
+	d *Daemon
+}
+
+func (t *jobTransport) Run(ctx context.Context, node string, c jobs.Command) (jobs.Result, error) {
+	d := t.d
+	self := d.Bundle().Chain()[0].Subject.CommonName
+	if node == self {
+		return d.runCommand(ctx, c, self), nil
+	}
+
+	p, ok := d.node(node)
+	if !ok {
+		return jobs.Result{}, fmt.Errorf("%s unreachable", node)
+	}
+	client, err := d.client(ctx, p.Addr, p.Name)
+	if err != nil {
+		return jobs.Result{}, err
+	}
+	return rpc.Call[jobs.Command, jobs.Result](ctx, client, "jobs.Run", c)
+}
+
+// The jobs service has these endpoints:
+//
+//	GET  /              the jobs submitted to the daemon, newest first,
+//	                    without their output
+//	POST /              submit the jobs.Spec of the request, responding
+//	                    with the job
+//	GET  /ID            the job of ID, once it is done if wait=true
+//	POST /ID/cancel     cancel the job of ID
+//	GET  /tasks         the TaskInfo of every task, by name
+//
+// Peers need a role of the job roles.
+func jobsHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		if d.authorize(w, r, "jobs", d.config().JobRoles) {
+			writeJSON(w, d.jobs.List())
+		}
+	})
+
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "jobs", d.config().JobRoles) {
+			return
+		}
+
+		var spec jobs.Spec
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&spec); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		from := "control"
+		if leaf := httpLeaf(r); leaf != nil {
+			from = leaf.Subject.CommonName
+		}
+		j, err := d.jobs.Submit(spec, from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Default().Info("daemon: job submitted", append(peerAttrs(r), "job", j.ID)...)
+		writeJSON(w, &j)
+	})
+
+	mux.HandleFunc("GET /{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "jobs", d.config().JobRoles) {
+			return
+		}
+
+		id := r.PathValue("id")
+		if r.URL.Query().Get("wait") == "true" {
+			j, err := d.jobs.Wait(r.Context(), id)
+			switch {
+			case errors.Is(err, jobs.ErrNotFound):
+				http.Error(w, "no job "+id, http.StatusNotFound)
+			case err != nil:
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			default:
+				writeJSON(w, &j)
+			}
+			return
+		}
+		j, ok := d.jobs.Get(id)
+		if !ok {
+			http.Error(w, "no job "+id, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, &j)
+	})
+
+	mux.HandleFunc("POST /{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "jobs", d.config().JobRoles) {
+			return
+		}
+
+		id := r.PathValue("id")
+		if err := d.jobs.Cancel(id); err != nil {
+			http.Error(w, "no job "+id, http.StatusNotFound)
+			return
+		}
+
+		log.Default().Info("daemon: job canceled", append(peerAttrs(r), "job", id)...)
+		writeJSON(w, struct{}{})
+	})
+
+	mux.HandleFunc("GET /tasks", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "jobs", d.config().JobRoles) {
+			return
+		}
+
+		infos := []TaskInfo{}
+		for _, t := range Tasks() {
+			infos = append(infos, TaskInfo{Name: t.Name, Summary: t.Summary})
+		}
+		writeJSON(w, infos)
+	})
+
+	return mux
+}
@@ -0,0 +1,63 @@
+package daemon
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serveJoin serves a connection that negotiated join.Proto.
+// http.Server hands such connections to its TLSNextProto functions instead
+// of serving them, so serveJoin serves its one request with HTTP/1.1.
+func (d *Daemon) serveJoin(_ *http.Server, conn *tls.Conn, h http.Handler) {
+	ln := &connListener{conn: alpnConn{conn}, addr: conn.LocalAddr(), done: make(chan struct{})}
+
+	srv := &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          d.errorLog(),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				ln.Close()
+			}
+		},
+	}
+	srv.SetKeepAlivesEnabled(false)
+	srv.Serve(ln)
+}
+
+// An alpnConn hides that its connection is a *tls.Conn from http.Server,
+// which would otherwise look up its protocol in TLSNextProto again.
+// Requests still report the connection state.
+type alpnConn struct {
+	*tls.Conn
+}
+
+// A connListener accepts a single connection, then blocks until closed.
+type connListener struct {
+	conn net.Conn
+	addr net.Addr
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
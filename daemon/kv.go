@@ -0,0 +1,390 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"nih.software/kv"
+	"nih.software/log"
+	"nih.software/raft"
+	"nih.software/rpc"
+	"nih.software/trust"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "kv",
+		Summary: "keep the replicated key-value store of the cluster",
+		Handler: kvHandler,
+		Methods: kvMethods,
+	})
+}
+
+// kvJoinRequest is the request of kv.Join.
+type kvJoinRequest struct {
+	// Addr is the address the node joining listens on.
+	Addr string `json:"addr"`
+}
+
+// KVRemoveRequest is the request of kv.Remove, and of the remove endpoint
+// of the kv service.
+type KVRemoveRequest struct {
+	Name string `json:"name"`
+}
+
+// KV returns the replica of the key-value store of the cluster the daemon
+// keeps, or nil if it keeps none.
+func (d *Daemon) KV() *kv.Replica {
+	return d.kv
+}
+
+// Lead runs duty while the node leads the election named election among
+// the nodes keeping the key-value store, so that one of them at a time
+// runs it, as kv.Replica.Lead does. It fails unless the daemon keeps a
+// replica of the store.
+func (d *Daemon) Lead(ctx context.Context, election string, duty func(ctx context.Context)) error {
+	if d.kv == nil {
+		return errors.New("daemon: elections need the key-value store")
+	}
+	return d.kv.Lead(ctx, election, duty)
+}
+
+// kvFrom returns the replica of the daemon for the caller of a method of
+// the kv service, once it checked the caller may use it.
+func (d *Daemon) kvFrom(ctx context.Context) (*kv.Replica, error) {
+	if d.kv == nil {
+		return nil, rpc.Errorf(rpc.CodeUnimplemented, "the key-value store is disabled")
+	}
+	leaf, roles := rpcLeaf(ctx), d.config().KVRoles
+	switch {
+	case leaf == nil || trust.HasRole(leaf, roles...):
+		return d.kv, nil
+	case len(roles) == 0:
+		return nil, rpc.Errorf(rpc.CodePermissionDenied, "kv is disabled for peers")
+	}
+	return nil, rpc.Errorf(rpc.CodePermissionDenied, "kv requires a role of %s", strings.Join(roles, ", "))
+}
+
+// kvFromNode is kvFrom for a message of the replica of the node named
+// name, which only that node may send.
+func (d *Daemon) kvFromNode(ctx context.Context, name string) (*raft.Node, error) {
+	r, err := d.kvFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := rpc.Peer(ctx); !ok || id.Name() != name {
+		return nil, rpc.Errorf(rpc.CodePermissionDenied, "kv from %s for %s", id.Name(), name)
+	}
+	return r.Raft(), nil
+}
+
+func kvMethods(d *Daemon, s *rpc.Server) {
+	rpc.Register(s, "kv.RequestVote", nil, func(ctx context.Context, req raft.VoteRequest) (raft.VoteResponse, error) {
+		n, err := d.kvFromNode(ctx, req.Candidate)
+		if err != nil {
+			return raft.VoteResponse{}, err
+		}
+		resp, err := n.HandleRequestVote(&req)
+		if err != nil {
+			return raft.VoteResponse{}, err
+		}
+		return *resp, nil
+	})
+
+	rpc.Register(s, "kv.AppendEntries", nil, func(ctx context.Context, req raft.AppendRequest) (raft.AppendResponse, error) {
+		n, err := d.kvFromNode(ctx, req.Leader)
+		if err != nil {
+			return raft.AppendResponse{}, err
+		}
+		resp, err := n.HandleAppendEntries(&req)
+		if err != nil {
+			return raft.AppendResponse{}, err
+		}
+		return *resp, nil
+	})
+
+	rpc.Register(s, "kv.InstallSnapshot", nil, func(ctx context.Context, req raft.SnapshotRequest) (raft.SnapshotResponse, error) {
+		n, err := d.kvFromNode(ctx, req.Leader)
+		if err != nil {
+			return raft.SnapshotResponse{}, err
+		}
+		resp, err := n.HandleInstallSnapshot(&req)
+		if err != nil {
+			return raft.SnapshotResponse{}, err
+		}
+		return *resp, nil
+	})
+
+	rpc.Register(s, "kv.Propose", nil, func(ctx context.Context, c kv.Change) (kv.Entry, error) {
+		r, err := d.kvFrom(ctx)
+		if err != nil {
+			return kv.Entry{}, err
+		}
+		if err := c.Check(); err != nil {
+			return kv.Entry{}, rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+		}
+		e, err := r.HandlePropose(ctx, c)
+		return e, kvError(err)
+	})
+
+	rpc.Register(s, "kv.Join", nil, func(ctx context.Context, req kvJoinRequest) (struct{}, error) {
+		r, err := d.kvFrom(ctx)
+		if err != nil {
+			return struct{}{}, err
+		}
+		id, ok := rpc.Peer(ctx)
+		if !ok || id.Name() == "" {
+			return struct{}{}, rpc.Errorf(rpc.CodePermissionDenied, "kv.Join needs a node")
+		}
+		addr := req.Addr
+		if remote := rpc.RemoteAddr(ctx); remote != nil {
+			host, _, _ := net.SplitHostPort(remote.String())
+			addr = localizeAddr(addr, host)
+		}
+		return struct{}{}, kvError(r.HandleJoin(ctx, raft.Server{ID: id.Name(), Addr: addr}))
+	})
+
+	rpc.Register(s, "kv.Remove", nil, func(ctx context.Context, req KVRemoveRequest) (struct{}, error) {
+		r, err := d.kvFrom(ctx)
+		if err != nil {
+			return struct{}{}, err
+		}
+		return struct{}{}, kvError(r.HandleRemove(ctx, req.Name))
+	})
+}
+
+// kvErrors are the errors of packages kv and raft that cross the network,
+// as errors of their code with their message.
+var kvErrors = map[error]rpc.Code{
+	kv.ErrConflict:           rpc.CodeFailedPrecondition,
+	kv.ErrFull:               rpc.CodeFailedPrecondition,
+	kv.ErrNotLeader:          rpc.CodeFailedPrecondition,
+	kv.ErrNoLeader:           rpc.CodeUnavailable,
+	kv.ErrNoReplica:          rpc.CodeNotFound,
+	raft.ErrLeadershipLost:   rpc.CodeUnavailable,
+	raft.ErrChangeInProgress: rpc.CodeUnavailable,
+	raft.ErrStopped:          rpc.CodeUnavailable,
+}
+
+// kvError returns the error err of a replica as the caller of a method
+// receives it.
+func kvError(err error) error {
+	if code, ok := kvErrors[err]; ok {
+		return rpc.Errorf(code, "%s", err.Error())
+	}
+	return err
+}
+
+// kvTransport carries the messages of the replica of the daemon to those
+// of other nodes over RPC, over the connections the daemon keeps, since
+// the leader sends its followers a heartbeat many times a second.
+type kvTransport struct {
+	d *Daemon
+}
+
+func (t *kvTransport) RequestVote(ctx context.Context, to raft.Server, req *raft.VoteRequest) (*raft.VoteResponse, error) {
+	resp, err := kvCall[raft.VoteRequest, raft.VoteResponse](ctx, t, to, "kv.RequestVote", *req)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (t *kvTransport) AppendEntries(ctx context.Context, to raft.Server, req *raft.AppendRequest) (*raft.AppendResponse, error) {
+	resp, err := kvCall[raft.AppendRequest, raft.AppendResponse](ctx, t, to, "kv.AppendEntries", *req)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (t *kvTransport) InstallSnapshot(ctx context.Context, to raft.Server, req *raft.SnapshotRequest) (*raft.SnapshotResponse, error) {
+	resp, err := kvCall[raft.SnapshotRequest, raft.SnapshotResponse](ctx, t, to, "kv.InstallSnapshot", *req)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (t *kvTransport) Propose(ctx context.Context, leader string, c kv.Change) (kv.Entry, error) {
+	return kvCall[kv.Change, kv.Entry](ctx, t, raft.Server{ID: leader}, "kv.Propose", c)
+}
+
+func (t *kvTransport) Join(ctx context.Context, to string) error {
+	addr := t.d.Addr()
+	if addr == nil {
+		return rpc.Errorf(rpc.CodeUnavailable, "daemon not serving")
+	}
+	_, err := kvCall[kvJoinRequest, struct{}](ctx, t, raft.Server{ID: to}, "kv.Join", kvJoinRequest{Addr: addr.String()})
+	return err
+}
+
+func (t *kvTransport) Remove(ctx context.Context, leader, name string) error {
+	_, err := kvCall[KVRemoveRequest, struct{}](ctx, t, raft.Server{ID: leader}, "kv.Remove", KVRemoveRequest{Name: name})
+	return err
+}
+
+// conn returns the client of the node of to. The node is reached at the
+// address the daemon knows it at, or that of to if it knows it at none,
+// and must hold the certificate of its name.
+func (t *kvTransport) conn(ctx context.Context, to raft.Server) (*rpc.Client, error) {
+	addr := to.Addr
+	if p, ok := t.d.node(to.ID); ok {
+		addr = p.Addr
+	}
+	if addr == "" {
+		return nil, rpc.Errorf(rpc.CodeUnavailable, "%s unreachable", to.ID)
+	}
+	return t.d.client(ctx, addr, to.ID)
+}
+
+// kvCall calls method of the daemon of the node of to. The errors of
+// packages kv and raft the node fails with are returned as such.
+func kvCall[Req, Resp any](ctx context.Context, t *kvTransport, to raft.Server, method string, req Req) (Resp, error) {
+	var resp Resp
+	c, err := t.conn(ctx, to)
+	if err != nil {
+		return resp, err
+	}
+
+	resp, err = rpc.Call[Req, Resp](ctx, c, method, req)
+	if e, ok := err.(*rpc.Error); ok {
+		for known, code := range kvErrors {
+			if e.Code == code && e.Message == known.Error() {
+				return resp, known
+			}
+		}
+	}
+	return resp, err
+}
+
+// node returns the node named name among those the daemon knows and
+// reaches, as nodes returns them.
+func (d *Daemon) node(name string) (Peer, bool) {
+	for _, p := range d.nodes() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Peer{}, false
+}
+
+// kvNodes returns the names of the nodes the daemon knows and reaches.
+func (d *Daemon) kvNodes() []string {
+	var names []string
+	for _, p := range d.nodes() {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// The kv service has these endpoints:
+//
+//	GET  /keys?prefix=P  the entries of the keys starting with P, in order
+//	GET  /keys/KEY       the entry of KEY
+//	POST /apply          make the kv.Change of the request, responding with
+//	                     the entry it made
+//	GET  /status         the raft.Status of the replica of the daemon
+//	GET  /elections      the kv.Lease of every election, by name
+//	POST /remove         remove the replica of the node of the
+//	                     KVRemoveRequest from the cluster
+//
+// Peers need a role of the kv roles.
+func kvHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		if replica := d.kvFor(w, r); replica != nil {
+			writeJSON(w, replica.List(r.URL.Query().Get("prefix")))
+		}
+	})
+
+	mux.HandleFunc("GET /keys/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		replica := d.kvFor(w, r)
+		if replica == nil {
+			return
+		}
+		e, ok := replica.Get(r.PathValue("key"))
+		if !ok {
+			http.Error(w, "no key "+r.PathValue("key"), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, &e)
+	})
+
+	mux.HandleFunc("POST /apply", func(w http.ResponseWriter, r *http.Request) {
+		replica := d.kvFor(w, r)
+		if replica == nil {
+			return
+		}
+
+		var c kv.Change
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*kv.MaxValueSize)).Decode(&c); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		if err := c.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e, err := replica.Apply(r.Context(), c)
+		if err != nil {
+			httpError(w, kvError(err))
+			return
+		}
+
+		log.Default().Info("daemon: kv", append(peerAttrs(r), "op", c.Op, "key", c.Key, "version", e.Version)...)
+		writeJSON(w, &e)
+	})
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		if replica := d.kvFor(w, r); replica != nil {
+			st := replica.Status()
+			writeJSON(w, &st)
+		}
+	})
+
+	mux.HandleFunc("GET /elections", func(w http.ResponseWriter, r *http.Request) {
+		if replica := d.kvFor(w, r); replica != nil {
+			writeJSON(w, replica.Leases())
+		}
+	})
+
+	mux.HandleFunc("POST /remove", func(w http.ResponseWriter, r *http.Request) {
+		replica := d.kvFor(w, r)
+		if replica == nil {
+			return
+		}
+
+		var req KVRemoveRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		if err := replica.Remove(r.Context(), req.Name); err != nil {
+			httpError(w, kvError(err))
+			return
+		}
+
+		log.Default().Info("daemon: kv removed", append(peerAttrs(r), "name", req.Name)...)
+		writeJSON(w, struct{}{})
+	})
+
+	return mux
+}
+
+// kvFor returns the replica of the daemon for the client of r, once it
+// checked the client may use it. If not, it responds with an error.
+func (d *Daemon) kvFor(w http.ResponseWriter, r *http.Request) *kv.Replica {
+	if d.kv == nil {
+		http.Error(w, "the key-value store is disabled", http.StatusNotImplemented)
+		return nil
+	}
+	if !d.authorize(w, r, "kv", d.config().KVRoles) {
+		return nil
+	}
+	return d.kv
+}
@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"nih.software/log"
+)
+
+// serveLogs responds with the entries of the daemon's log buffer as
+// a stream of JSON objects, filtered by these query parameters:
+//
+//	since   only entries at or after this RFC 3339 time
+//	level   only entries at or above this level, such as "warn"
+//	follow  with "1", keep streaming new entries until the client leaves
+func (d *Daemon) serveLogs(w http.ResponseWriter, r *http.Request) {
+	if d.cfg.Logs == nil {
+		http.Error(w, "the daemon keeps no logs", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	level := log.LevelDebug
+	if s := q.Get("level"); s != "" {
+		if err := level.UnmarshalText([]byte(s)); err != nil {
+			http.Error(w, "invalid level: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	match := func(e *log.Entry) bool {
+		return e.Level >= level && !e.Time.Before(since)
+	}
+
+	past := d.cfg.Logs.Entries()
+	var next <-chan log.Entry
+	if q.Get("follow") == "1" {
+		var stop func()
+		past, next, stop = d.cfg.Logs.Follow()
+		defer stop()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	for i := range past {
+		if match(&past[i]) {
+			if err := enc.Encode(&past[i]); err != nil {
+				return
+			}
+		}
+	}
+	flush(w)
+
+	if next == nil {
+		return
+	}
+
+	for {
+		select {
+		case e := <-next:
+			if !match(&e) {
+				continue
+			}
+			if err := enc.Encode(&e); err != nil {
+				return
+			}
+			flush(w)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
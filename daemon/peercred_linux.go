@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerUID returns the user ID of the process at the other end of the
+// unix-domain connection c, and whether the system tells.
+func peerUID(c net.Conn) (int, bool, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, false, nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, false, err
+	}
+
+	var cred *unix.Ucred
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, serr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, false, err
+	}
+	if serr != nil {
+		return 0, false, serr
+	}
+	return int(cred.Uid), true, nil
+}
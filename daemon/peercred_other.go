@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package daemon
+
+import "net"
+
+// peerUID reports false: the system does not tell the user at the other
+// end of a unix-domain connection, which only the permissions of the
+// control socket restrict.
+func peerUID(c net.Conn) (int, bool, error) {
+	return 0, false, nil
+}
@@ -0,0 +1,639 @@
+package daemon
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"nih.software/gossip"
+	"nih.software/health"
+	"nih.software/log"
+	"nih.software/peers"
+	"nih.software/rpc"
+	"nih.software/trust"
+)
+
+// DefaultPeerInterval is how often a daemon probes each of its static
+// peers unless configured otherwise.
+const DefaultPeerInterval = 30 * time.Second
+
+// peerProbeTimeout bounds each probe of a static peer. One that takes
+// longer makes the peer suspect.
+const peerProbeTimeout = 10 * time.Second
+
+// Sources of peers.
+const (
+	// PeerStatic is a peer of Config.Peers or of the address book,
+	// which the daemon probes.
+	PeerStatic = "static"
+
+	// PeerInbound is a peer that connected to the daemon.
+	PeerInbound = "inbound"
+
+	// PeerGossip is a member of the cluster the daemon learned of by
+	// gossip, with Config.Gossip.
+	PeerGossip = "gossip"
+)
+
+// peerFindTimeout bounds each search of a finder of peers.
+const peerFindTimeout = 5 * time.Second
+
+// Health of peers.
+const (
+	// PeerOK is a static peer that answered the last probe, a member
+	// alive, or an inbound peer seen within three probe intervals.
+	PeerOK = "ok"
+
+	// PeerDown is a static peer that could not be reached, presented
+	// another identity than expected, or failed to answer three probes in
+	// a row in time, or a member dead.
+	PeerDown = "down"
+
+	// PeerStale is an inbound peer not seen for three probe intervals.
+	PeerStale = "stale"
+
+	// PeerUnknown is a static peer not probed yet.
+	PeerUnknown = "unknown"
+
+	// PeerSuspect is a static peer that failed to answer its last probes
+	// in time, or a member failing to answer the pings of gossip, either
+	// of which is down unless it answers again soon.
+	PeerSuspect = "suspect"
+
+	// PeerLeft is a member that left the cluster.
+	PeerLeft = "left"
+)
+
+// A Peer is a node known to a daemon, as reported by the admin service's
+// peers endpoint.
+type Peer struct {
+	// Name is the common name of the peer's leaf certificate, if any,
+	// or that expected of a peer of the address book not seen yet.
+	Name string `json:"name,omitempty"`
+
+	// Serial is the serial number of the peer's leaf certificate,
+	// once the peer has been seen.
+	Serial string `json:"serial,omitempty"`
+
+	// Addr is the address a static peer was last probed at, the one a
+	// member is gossiped to be reached at, or the host of the last
+	// connection from an inbound peer.
+	Addr string `json:"addr"`
+
+	// Source is PeerStatic, PeerInbound, PeerGossip, or for a peer found
+	// by one of Config.Finders, the source of the peer, such as
+	// peers.SourceMDNS. A peer probed that also connected to the daemon
+	// is reported once, as probed, and a member that did as a member.
+	Source string `json:"source"`
+
+	// LastSeen is the time of the last successful probe of the peer
+	// or request from it. It is zero if the peer was never seen.
+	LastSeen time.Time `json:"last_seen"`
+
+	Health string `json:"health"`
+
+	// Error is why the last probe of a static peer failed.
+	Error string `json:"error,omitempty"`
+
+	// Skew is how far the clock of a static peer is ahead of the
+	// daemon's, or behind if negative, as of its last probe, give or take
+	// half the round trip of the probe. It is zero if not measured.
+	Skew Duration `json:"skew,omitempty"`
+}
+
+// MaxClockSkew is the greatest skew of the clock of a peer the daemon
+// tolerates: it warns of the peers further ahead or behind, and its clock
+// rejects the timestamps of those further ahead. Certificates are valid
+// from the moment they are issued, so a node whose clock is behind the
+// CA's rejects new certificates until it catches up.
+const MaxClockSkew = 5 * time.Second
+
+// abs returns the absolute value of d.
+func abs(d Duration) Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// A target is a peer to probe: an address of Config.Peers, or a peer of
+// the address book or found, whose addresses are tried in order and which
+// must present the identity expected of it.
+type target struct {
+	// key is the address, or the name of a peer of the address book or
+	// found, which has no colon.
+	key    string
+	addrs  []string
+	expect *peers.Peer
+	source string
+}
+
+// targets returns the peers to probe: those of the address book, read
+// again, those found last, and the addresses of addrs that are not those
+// of another target.
+func (d *Daemon) targets(addrs []string) []target {
+	var ts []target
+	names := make(map[string]bool)
+	booked := make(map[string]bool)
+	add := func(p peers.Peer, source string) {
+		ts = append(ts, target{key: p.Name, addrs: p.Addrs, expect: &p, source: source})
+		names[p.Name] = true
+		for _, addr := range p.Addrs {
+			booked[addr] = true
+		}
+	}
+
+	if d.cfg.Book != nil {
+		entries, err := d.cfg.Book.Peers()
+		if err != nil {
+			log.Default().Warn("daemon: address book", "err", err)
+		}
+		for _, p := range entries {
+			add(p, PeerStatic)
+		}
+	}
+
+	self := d.Bundle().Chain()[0].Subject.CommonName
+	for _, p := range d.known.foundPeers() {
+		if p.Name != self && !names[p.Name] && peers.ValidName(p.Name) && len(p.Addrs) > 0 {
+			add(p, p.Source)
+		}
+	}
+
+	for _, addr := range addrs {
+		if !booked[addr] {
+			ts = append(ts, target{key: addr, addrs: []string{addr}, source: PeerStatic})
+		}
+	}
+	return ts
+}
+
+// peerTable records the peers a daemon knows: the ones it probes by the
+// key of their target, and the inbound ones by identity.
+type peerTable struct {
+	mu      sync.Mutex
+	static  map[string]*Peer
+	inbound map[string]*Peer
+
+	// found are the peers found by the finders last.
+	found []peers.Peer
+}
+
+// setFound records the peers found by the finders.
+func (t *peerTable) setFound(found []peers.Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.found = found
+}
+
+func (t *peerTable) foundPeers() []peers.Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.found
+}
+
+// identity returns the key of the peer holding leaf:
+// its common name, or its serial number if it has none.
+func identity(leaf *x509.Certificate) string {
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName
+	}
+	return "serial:" + leaf.SerialNumber.String()
+}
+
+// seen records a request from the peer holding leaf, connected from addr.
+func (t *peerTable) seen(leaf *x509.Certificate, addr string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.inbound == nil {
+		t.inbound = make(map[string]*Peer)
+	}
+
+	t.inbound[identity(leaf)] = &Peer{
+		Name:     leaf.Subject.CommonName,
+		Serial:   leaf.SerialNumber.String(),
+		Addr:     addr,
+		Source:   PeerInbound,
+		LastSeen: time.Now(),
+	}
+}
+
+// setStatic sets the peers to probe, keeping what is known of those that
+// were probed already.
+func (t *peerTable) setStatic(targets []target) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	static := make(map[string]*Peer, len(targets))
+	for _, tg := range targets {
+		p, ok := t.static[tg.key]
+		if !ok {
+			p = &Peer{Addr: tg.addrs[0], Source: tg.source, Health: PeerUnknown}
+			if tg.expect != nil {
+				p.Name = tg.expect.Name
+			}
+		} else if !slices.Contains(tg.addrs, p.Addr) {
+			p.Addr = tg.addrs[0]
+		}
+		p.Source = tg.source
+		static[tg.key] = p
+	}
+
+	t.static = static
+}
+
+// probed records the result of a probe of the static peer of key at addr,
+// which presented leaf and had a clock skew ahead if err is nil. The health
+// monitor sets its health.
+func (t *peerTable) probed(key, addr string, leaf *x509.Certificate, skew time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.static[key]
+	if !ok {
+		// No longer a static peer.
+		return
+	}
+
+	p.Addr = addr
+	if err != nil {
+		p.Error = err.Error()
+		return
+	}
+
+	p.Name = leaf.Subject.CommonName
+	p.Serial = leaf.SerialNumber.String()
+	p.LastSeen = time.Now()
+	p.Error = ""
+	p.Skew = Duration(skew)
+}
+
+// setHealth sets the health of the static peer of key.
+func (t *peerTable) setHealth(key, health string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.static[key]; ok {
+		p.Health = health
+	}
+}
+
+// list returns the known peers, with the members of the cluster but self
+// not probed, sorted by source, static first and inbound last, then name,
+// then address.
+// Inbound peers are stale if not seen since stale.
+func (t *peerTable) list(stale time.Time, members []gossip.Member, self string) []Peer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	peers := []Peer{}
+	listed := make(map[string]int)
+	for _, p := range t.static {
+		if p.Serial != "" {
+			listed[identityOf(p)] = len(peers)
+		}
+		peers = append(peers, *p)
+	}
+
+	for _, m := range members {
+		if _, ok := listed[m.Name]; ok || m.Name == self {
+			continue
+		}
+		listed[m.Name] = len(peers)
+		peers = append(peers, Peer{Name: m.Name, Addr: m.Addr, Source: PeerGossip, Health: memberHealth(m.State)})
+	}
+
+	for key, p := range t.inbound {
+		if i, ok := listed[key]; ok {
+			if p.LastSeen.After(peers[i].LastSeen) {
+				peers[i].LastSeen = p.LastSeen
+			}
+			continue
+		}
+
+		q := *p
+		q.Health = PeerOK
+		if q.LastSeen.Before(stale) {
+			q.Health = PeerStale
+		}
+		peers = append(peers, q)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		a, b := peers[i], peers[j]
+		if a.Source != b.Source {
+			return sourceRank(a.Source) < sourceRank(b.Source) ||
+				sourceRank(a.Source) == sourceRank(b.Source) && a.Source < b.Source
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Addr < b.Addr
+	})
+
+	return peers
+}
+
+// memberHealth returns the health of a member of state s.
+func memberHealth(s gossip.State) string {
+	switch s {
+	case gossip.Alive:
+		return PeerOK
+	case gossip.Suspect:
+		return PeerSuspect
+	case gossip.Left:
+		return PeerLeft
+	}
+	return PeerDown
+}
+
+func sourceRank(source string) int {
+	switch source {
+	case PeerStatic:
+		return 0
+	case PeerInbound:
+		return 2
+	}
+	return 1
+}
+
+// identityOf returns the identity of a peer that has been seen.
+func identityOf(p *Peer) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return "serial:" + p.Serial
+}
+
+// Peers returns the peers the daemon knows: those of Config.Peers, of the
+// address book, and found by Config.Finders, the members of the cluster
+// if it gossips, and those that have made requests to it since it started.
+func (d *Daemon) Peers() []Peer {
+	var members []gossip.Member
+	var self string
+	if g := d.gossip.Load(); g != nil {
+		members, self = g.Members(), g.Local().Name
+	}
+	return d.known.list(time.Now().Add(-3*d.config().PeerInterval), members, self)
+}
+
+// probePeers has the health monitor ping the static peers every peer
+// interval until ctx is done, looking for them anew every interval and at
+// once when the configuration changes.
+func (d *Daemon) probePeers(ctx context.Context) {
+	go d.health.Run(ctx)
+
+	pingers := make(map[string]*peerPinger)
+	defer func() {
+		for key, p := range pingers {
+			d.health.Forget(key)
+			p.close()
+		}
+	}()
+
+	for {
+		cfg := d.config()
+		if len(d.cfg.Finders) > 0 {
+			d.known.setFound(d.find(ctx))
+		}
+		targets := d.targets(cfg.Peers)
+		d.known.setStatic(targets)
+		d.joinGossip(ctx, targets)
+		d.health.SetInterval(cfg.PeerInterval)
+		d.watchTargets(pingers, targets)
+
+		t := time.NewTimer(cfg.PeerInterval)
+		select {
+		case <-t.C:
+		case <-d.reconfigured:
+			t.Stop()
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// find returns the peers found by the finders of the configuration, which
+// it asks concurrently.
+func (d *Daemon) find(ctx context.Context) []peers.Peer {
+	ctx, cancel := context.WithTimeout(ctx, peerFindTimeout)
+	defer cancel()
+
+	var (
+		mu    sync.Mutex
+		found []peers.Peer
+		wg    sync.WaitGroup
+	)
+	for _, f := range d.cfg.Finders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ps, err := f.Find(ctx)
+			if err != nil {
+				log.Default().Warn("daemon: find peers", "err", err)
+				return
+			}
+			mu.Lock()
+			found = append(found, ps...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	return found
+}
+
+// A peerPinger pings a target with the health service, over a connection
+// it keeps to the first of its addresses that answers with the identity
+// expected of it. It dials again once the connection fails, the
+// credentials change, or the target no longer has the address.
+type peerPinger struct {
+	d *Daemon
+
+	mu     sync.Mutex
+	tg     target
+	c      *rpc.Client
+	addr   string
+	bundle *trust.Bundle
+	closed bool
+}
+
+// setTarget changes the target p pings, from the next ping on.
+func (p *peerPinger) setTarget(tg target) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tg = tg
+}
+
+// Ping calls health.Check, and records the result in the peer table, with
+// the skew of the clock of the peer.
+func (p *peerPinger) Ping(ctx context.Context) error {
+	var skew time.Duration
+	c, tg, addr, leaf, err := p.conn(ctx)
+	if err == nil {
+		start := time.Now()
+		var h Health
+		h, err = rpc.Call[struct{}, Health](ctx, c, "health.Check", struct{}{})
+		if err != nil && rpc.ErrorCode(err) != rpc.CodeDeadlineExceeded {
+			p.drop(c)
+		}
+		if err == nil && !h.Time.IsZero() {
+			// The peer read its clock around the middle of the round trip.
+			skew = h.Time.Sub(start.Add(time.Since(start) / 2))
+			if skew > MaxClockSkew || skew < -MaxClockSkew {
+				log.Default().Warn("daemon: peer clock skew", "peer", tg.key, "skew", skew.Round(time.Millisecond))
+			}
+		}
+	}
+	if err != nil {
+		leaf = nil
+	}
+	p.d.known.probed(tg.key, addr, leaf, skew, err)
+	return err
+}
+
+// conn returns the connection to the target and the address and leaf
+// certificate of its peer, dialing it unless the one kept is fit for use.
+func (p *peerPinger) conn(ctx context.Context) (*rpc.Client, target, string, *x509.Certificate, error) {
+	b := p.d.Bundle()
+
+	p.mu.Lock()
+	tg, c, addr := p.tg, p.c, p.addr
+	if c != nil {
+		select {
+		case <-c.Done():
+			c = nil
+		default:
+			if p.bundle != b || !slices.Contains(tg.addrs, addr) {
+				c = nil
+			}
+		}
+	}
+	if c == nil && p.c != nil {
+		p.c.Close()
+		p.c = nil
+	}
+	p.mu.Unlock()
+
+	if c != nil {
+		// The identity expected may have changed since the dial.
+		id, _ := c.Peer()
+		if tg.expect != nil {
+			if err := tg.expect.Verify(id.Leaf()); err != nil {
+				p.drop(c)
+				return nil, tg, addr, nil, err
+			}
+		}
+		return c, tg, addr, id.Leaf(), nil
+	}
+
+	var leaf *x509.Certificate
+	var err error
+	for _, addr = range tg.addrs {
+		c, err = rpc.Dial(ctx, b, addr)
+		if err == nil {
+			id, _ := c.Peer()
+			leaf = id.Leaf()
+			if tg.expect != nil {
+				err = tg.expect.Verify(leaf)
+			}
+			if err == nil {
+				break
+			}
+			c.Close()
+		}
+		log.Default().Debug("daemon: peer unreachable", "addr", addr, "err", err)
+	}
+	if err != nil {
+		return nil, tg, addr, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return nil, tg, addr, nil, errors.New("daemon: no longer probing " + tg.key)
+	}
+	p.c, p.addr, p.bundle = c, addr, b
+	return c, tg, addr, leaf, nil
+}
+
+// drop closes c, and forgets it if it is the connection kept.
+func (p *peerPinger) drop(c *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.c == c {
+		p.c = nil
+	}
+	c.Close()
+}
+
+// close closes the connection kept, and any dialed from now on.
+func (p *peerPinger) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.c != nil {
+		p.c.Close()
+		p.c = nil
+	}
+}
+
+// watchTargets has the health monitor ping the targets, each with the
+// pinger of its key in pingers, and stop pinging the others.
+func (d *Daemon) watchTargets(pingers map[string]*peerPinger, targets []target) {
+	keep := make(map[string]bool, len(targets))
+	for _, tg := range targets {
+		keep[tg.key] = true
+		if p, ok := pingers[tg.key]; ok {
+			p.setTarget(tg)
+			continue
+		}
+		p := &peerPinger{d: d, tg: tg}
+		pingers[tg.key] = p
+		d.health.Watch(tg.key, p)
+	}
+
+	for key, p := range pingers {
+		if !keep[key] {
+			d.health.Forget(key)
+			p.close()
+			delete(pingers, key)
+		}
+	}
+}
+
+// healthChanged records a change of the health of the static peer of the
+// key ch.Peer, and passes it on to Config.HealthChanged.
+func (d *Daemon) healthChanged(ch health.Change) {
+	h := PeerDown
+	switch ch.To {
+	case health.Healthy:
+		h = PeerOK
+	case health.Suspect:
+		h = PeerSuspect
+	}
+	d.known.setHealth(ch.Peer, h)
+
+	attrs := []any{"peer", ch.Peer, "health", h}
+	if ch.Err != nil {
+		attrs = append(attrs, "err", ch.Err)
+	}
+	log.Default().Info("daemon: peer health", attrs...)
+	if hook := d.config().HealthChanged; hook != nil {
+		hook(ch)
+	}
+}
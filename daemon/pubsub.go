@@ -0,0 +1,264 @@
+package daemon
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"nih.software/log"
+	"nih.software/pubsub"
+	"nih.software/rpc"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "pubsub",
+		Summary: "publish messages to topics and subscribe to them",
+		Handler: pubsubHandler,
+		Methods: pubsubMethods,
+	})
+}
+
+// maxMessageSize bounds the data of a message published.
+const maxMessageSize = 1 << 20
+
+// PublishRequest is the request of the pubsub service's publish endpoint
+// and of pubsub.Publish.
+type PublishRequest struct {
+	Topic string `json:"topic"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// SubscribeRequest is the first request of pubsub.Subscribe.
+type SubscribeRequest struct {
+	Topics []string `json:"topics"`
+}
+
+// Publish publishes data to topic from the daemon, as a client of its
+// control socket does.
+func (d *Daemon) Publish(topic string, data []byte) (pubsub.Message, error) {
+	return d.publish(nil, topic, data)
+}
+
+// Subscribe returns a subscription to the messages of the topics of
+// patterns that reach the daemon, as a client of its control socket has.
+func (d *Daemon) Subscribe(patterns ...string) (*pubsub.Subscription, error) {
+	return d.bus.Subscribe(patterns...)
+}
+
+// allowTopic reports whether the client holding leaf, or the control
+// socket if leaf is nil, may take action on the topics of pattern.
+func (d *Daemon) allowTopic(leaf *x509.Certificate, action pubsub.Action, pattern string) bool {
+	return leaf == nil || d.config().Topics.Allow(leaf, action, pattern)
+}
+
+// publish publishes data to topic from the client holding leaf, nil for
+// the control socket: it delivers it to the subscribers of the daemon, and
+// forwards it to the other nodes the daemon knows.
+func (d *Daemon) publish(leaf *x509.Certificate, topic string, data []byte) (pubsub.Message, error) {
+	if !pubsub.ValidTopic(topic) {
+		return pubsub.Message{}, rpc.Errorf(rpc.CodeInvalidArgument, "invalid topic %q", topic)
+	}
+	if len(data) > maxMessageSize {
+		return pubsub.Message{}, rpc.Errorf(rpc.CodeInvalidArgument, "message of %d bytes, more than %d", len(data), maxMessageSize)
+	}
+	if !d.allowTopic(leaf, pubsub.Publish, topic) {
+		return pubsub.Message{}, rpc.Errorf(rpc.CodePermissionDenied, "publishing to %s is not granted to %s", topic, leaf.Subject.CommonName)
+	}
+
+	from := d.Bundle().Chain()[0].Subject.CommonName
+	if leaf != nil {
+		from = leaf.Subject.CommonName
+	}
+	m := pubsub.Message{ID: pubsub.NewID(), Topic: topic, From: from, Time: time.Now(), Data: data}
+	d.bus.Deliver(m)
+	go d.forward(m)
+	return m, nil
+}
+
+// forward sends m to the other nodes the daemon knows, concurrently.
+// They deliver it to their subscribers, but forward it no further.
+func (d *Daemon) forward(m pubsub.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), peerProbeTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, p := range d.nodes() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := forwardTo(ctx, d, p, m); err != nil {
+				log.Default().Debug("daemon: forward", "topic", m.Topic, "peer", p.Name, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func forwardTo(ctx context.Context, d *Daemon, p Peer, m pubsub.Message) error {
+	c, err := d.client(ctx, p.Addr, p.Name)
+	if err != nil {
+		return err
+	}
+	_, err = rpc.Call[pubsub.Message, struct{}](ctx, c, "pubsub.Forward", m)
+	return err
+}
+
+// nodes returns the other nodes the daemon knows by name and reaches: the
+// static peers and members of the cluster that are ok.
+func (d *Daemon) nodes() []Peer {
+	self := d.Bundle().Chain()[0].Subject.CommonName
+	var nodes []Peer
+	named := make(map[string]bool)
+	for _, p := range d.Peers() {
+		if p.Source == PeerInbound || p.Health != PeerOK || p.Name == "" || p.Name == self || named[p.Name] {
+			continue
+		}
+		named[p.Name] = true
+		nodes = append(nodes, p)
+	}
+	return nodes
+}
+
+// subscribe returns a subscription to the topics of patterns for the
+// client holding leaf, nil for the control socket.
+func (d *Daemon) subscribe(leaf *x509.Certificate, patterns []string) (*pubsub.Subscription, error) {
+	for _, p := range patterns {
+		if !pubsub.ValidPattern(p) {
+			return nil, rpc.Errorf(rpc.CodeInvalidArgument, "invalid topic pattern %q", p)
+		}
+		if !d.allowTopic(leaf, pubsub.Subscribe, p) {
+			return nil, rpc.Errorf(rpc.CodePermissionDenied, "subscribing to %s is not granted to %s", p, leaf.Subject.CommonName)
+		}
+	}
+
+	s, err := d.bus.Subscribe(patterns...)
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	}
+	return s, nil
+}
+
+func pubsubMethods(d *Daemon, s *rpc.Server) {
+	rpc.Register(s, "pubsub.Publish", nil, func(ctx context.Context, req PublishRequest) (pubsub.Message, error) {
+		return d.publish(rpcLeaf(ctx), req.Topic, req.Data)
+	})
+
+	// Forward delivers a message another node forwards, if that node may
+	// publish to its topic itself.
+	rpc.Register(s, "pubsub.Forward", nil, func(ctx context.Context, m pubsub.Message) (struct{}, error) {
+		leaf := rpcLeaf(ctx)
+		switch {
+		case m.ID == "" || !pubsub.ValidTopic(m.Topic):
+			return struct{}{}, rpc.Errorf(rpc.CodeInvalidArgument, "invalid message")
+		case len(m.Data) > maxMessageSize:
+			return struct{}{}, rpc.Errorf(rpc.CodeInvalidArgument, "message of %d bytes, more than %d", len(m.Data), maxMessageSize)
+		case leaf == nil || !d.allowTopic(leaf, pubsub.Publish, m.Topic):
+			return struct{}{}, rpc.Errorf(rpc.CodePermissionDenied, "forwarding to %s is not granted", m.Topic)
+		}
+		d.bus.Deliver(m)
+		return struct{}{}, nil
+	})
+
+	rpc.RegisterStream(s, "pubsub.Subscribe", nil, func(ctx context.Context, ss *rpc.ServerStream[SubscribeRequest, pubsub.Message]) error {
+		req, err := ss.Recv()
+		if err != nil {
+			return err
+		}
+		sub, err := d.subscribe(rpcLeaf(ctx), req.Topics)
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+
+		for {
+			select {
+			case m, ok := <-sub.C:
+				if !ok {
+					return nil
+				}
+				if err := ss.Send(m); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+}
+
+// rpcLeaf returns the leaf certificate of the caller of the method whose
+// context is ctx, if it has one.
+func rpcLeaf(ctx context.Context) *x509.Certificate {
+	if id, ok := rpc.Peer(ctx); ok {
+		return id.Leaf()
+	}
+	return nil
+}
+
+// The pubsub service has these endpoints:
+//
+//	POST /publish    publish the PublishRequest, responding with the message
+//	GET  /subscribe  stream the messages of every topic pattern of the
+//	                 query, as JSON objects, until the client leaves
+func pubsubHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /publish", func(w http.ResponseWriter, r *http.Request) {
+		var req PublishRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*maxMessageSize)).Decode(&req); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+
+		m, err := d.publish(httpLeaf(r), req.Topic, req.Data)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		writeJSON(w, &m)
+	})
+
+	mux.HandleFunc("GET /subscribe", func(w http.ResponseWriter, r *http.Request) {
+		sub, err := d.subscribe(httpLeaf(r), r.URL.Query()["topic"])
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		defer sub.Close()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		flush(w)
+
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case m, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				if err := enc.Encode(&m); err != nil {
+					return
+				}
+				flush(w)
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	return mux
+}
+
+// httpLeaf returns the leaf certificate of the client of r, or nil for a
+// client of the control socket.
+func httpLeaf(r *http.Request) *x509.Certificate {
+	if r.TLS == nil {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
@@ -0,0 +1,524 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nih.software/cron"
+	"nih.software/jobs"
+	"nih.software/log"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "schedule",
+		Summary: "run jobs at the times of cron expressions",
+		Handler: scheduleHandler,
+	})
+
+	RegisterTask(&Task{
+		Name:    "check-cert",
+		Summary: "fail if the certificate of the node expires within a duration, 30 days by default",
+		Run:     checkCertTask,
+	})
+}
+
+// DefaultSchedulesFile is the name of the file of the schedules of a node
+// in its state directory.
+const DefaultSchedulesFile = "schedules.json"
+
+// ScheduleElection is the election the nodes keeping the key-value store
+// hold for the node to run the singleton schedules.
+const ScheduleElection = "schedule"
+
+// A Schedule has the daemon submit a job at the times of a cron
+// expression, as package cron describes them, in the local time of the
+// node.
+type Schedule struct {
+	// Name names the schedule among those of the daemon.
+	Name string `json:"name"`
+
+	Cron string `json:"cron"`
+
+	// Jitter, if not zero, delays every job by a random time up to it,
+	// so that the nodes of the same schedule do not run it at once.
+	Jitter Duration `json:"jitter,omitempty"`
+
+	// Singleton has the job run by the node leading ScheduleElection
+	// only, of the nodes keeping the key-value store that have the
+	// schedule, instead of by every node that has it.
+	Singleton bool `json:"singleton,omitempty"`
+
+	Job jobs.Spec `json:"job"`
+}
+
+// check returns an error if s is not a valid schedule, and its parsed
+// expression otherwise.
+func (s *Schedule) check() (*cron.Schedule, error) {
+	if s.Name == "" || strings.ContainsAny(s.Name, "/ \t\n") {
+		return nil, fmt.Errorf("invalid schedule name %q", s.Name)
+	}
+	if s.Jitter < 0 {
+		return nil, errors.New("negative jitter")
+	}
+	if err := s.Job.Check(); err != nil {
+		return nil, err
+	}
+	return cron.Parse(s.Cron)
+}
+
+// A ScheduleRun is a job a schedule submitted.
+type ScheduleRun struct {
+	Time time.Time `json:"time"`
+
+	// Job is the ID of the job, unless it could not be submitted.
+	Job   string     `json:"job,omitempty"`
+	State jobs.State `json:"state"`
+
+	// Error is why the job could not be submitted.
+	Error string `json:"error,omitempty"`
+}
+
+// ScheduleStatus is a schedule of the daemon in the response of the
+// schedule service.
+type ScheduleStatus struct {
+	Schedule
+
+	// Next is the next time the daemon submits the job of the schedule,
+	// zero if it does not, as for a singleton schedule of a node not
+	// leading ScheduleElection.
+	Next time.Time `json:"next"`
+
+	// Last is the last job the daemon submitted for the schedule, as
+	// kept across restarts.
+	Last *ScheduleRun `json:"last,omitempty"`
+}
+
+// ScheduleRequest is the request of the remove and run endpoints of the
+// schedule service.
+type ScheduleRequest struct {
+	Name string `json:"name"`
+}
+
+// A scheduleEntry is a schedule of the daemon, and its state.
+type scheduleEntry struct {
+	Schedule
+	Last *ScheduleRun `json:"last,omitempty"`
+
+	expr *cron.Schedule
+	next time.Time
+}
+
+// schedules are the schedules of a daemon.
+type schedules struct {
+	// file is the file the schedules are kept in, if any.
+	file string
+
+	mu      sync.Mutex
+	entries map[string]*scheduleEntry
+
+	// changed is closed, and replaced, once the schedules change.
+	changed chan struct{}
+}
+
+// load reads the schedules of s from its file, if any.
+func (s *schedules) load() error {
+	s.entries = make(map[string]*scheduleEntry)
+	s.changed = make(chan struct{})
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*scheduleEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("daemon: schedules %s: %w", s.file, err)
+	}
+	for _, e := range entries {
+		if e.expr, err = e.check(); err != nil {
+			return fmt.Errorf("daemon: schedules %s: %s: %w", s.file, e.Name, err)
+		}
+		// The jobs of the daemon did not survive it.
+		if e.Last != nil && e.Last.State == jobs.Running {
+			e.Last.State = jobs.Canceled
+		}
+		s.entries[e.Name] = e
+	}
+	return nil
+}
+
+// save writes the schedules of s to its file, if any, atomically. The
+// caller must hold s.mu.
+func (s *schedules) save() error {
+	if s.file == "" {
+		return nil
+	}
+	entries := make([]*scheduleEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	data, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.file, data, 0600)
+}
+
+// changedLocked wakes the schedulers of s and saves it. The caller must
+// hold s.mu.
+func (s *schedules) changedLocked() error {
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return s.save()
+}
+
+// Schedules returns the schedules of the daemon, in name order.
+func (d *Daemon) Schedules() []ScheduleStatus {
+	d.sched.mu.Lock()
+	defer d.sched.mu.Unlock()
+
+	list := []ScheduleStatus{}
+	for _, e := range d.sched.entries {
+		list = append(list, e.status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (e *scheduleEntry) status() ScheduleStatus {
+	st := ScheduleStatus{Schedule: e.Schedule, Next: e.next}
+	if e.Last != nil {
+		last := *e.Last
+		st.Last = &last
+	}
+	return st
+}
+
+// AddSchedule adds s to the schedules of the daemon, in place of the one
+// of its name if any, and keeps it across restarts if the daemon keeps
+// its schedules in a file.
+func (d *Daemon) AddSchedule(s Schedule) (ScheduleStatus, error) {
+	expr, err := s.check()
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+	if s.Singleton && d.kv == nil {
+		return ScheduleStatus{}, errors.New("singleton schedules need the key-value store")
+	}
+
+	d.sched.mu.Lock()
+	defer d.sched.mu.Unlock()
+	e := &scheduleEntry{Schedule: s, expr: expr}
+	if old := d.sched.entries[s.Name]; old != nil {
+		e.Last = old.Last
+	}
+	d.sched.entries[s.Name] = e
+	return e.status(), d.sched.changedLocked()
+}
+
+// RemoveSchedule removes the schedule named name from the daemon. It does
+// not cancel the job of the schedule running, if any.
+func (d *Daemon) RemoveSchedule(name string) error {
+	d.sched.mu.Lock()
+	defer d.sched.mu.Unlock()
+	if d.sched.entries[name] == nil {
+		return fmt.Errorf("no schedule %s", name)
+	}
+	delete(d.sched.entries, name)
+	return d.sched.changedLocked()
+}
+
+// runSchedules submits the jobs of the schedules of the daemon, either
+// singleton or not, at their times until ctx is done.
+func (d *Daemon) runSchedules(ctx context.Context, singleton bool) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now := time.Now()
+		var due []Schedule
+		var next time.Time
+
+		d.sched.mu.Lock()
+		for _, e := range d.sched.entries {
+			if e.Singleton != singleton {
+				continue
+			}
+			if e.next.IsZero() {
+				e.next = e.expr.Next(now)
+			} else if !e.next.After(now) {
+				due = append(due, e.Schedule)
+				e.next = e.expr.Next(now)
+			}
+			if !e.next.IsZero() && (next.IsZero() || e.next.Before(next)) {
+				next = e.next
+			}
+		}
+		changed := d.sched.changed
+		d.sched.mu.Unlock()
+
+		for _, s := range due {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.runSchedule(ctx, s)
+			}()
+		}
+
+		if next.IsZero() {
+			timer.Stop()
+		} else {
+			timer.Reset(time.Until(next))
+		}
+		select {
+		case <-timer.C:
+		case <-changed:
+		case <-ctx.Done():
+			// The times are those of this scheduler only.
+			d.sched.mu.Lock()
+			for _, e := range d.sched.entries {
+				if e.Singleton == singleton {
+					e.next = time.Time{}
+				}
+			}
+			d.sched.mu.Unlock()
+			return
+		}
+	}
+}
+
+// leadSchedules campaigns in ScheduleElection while the daemon has
+// singleton schedules, until ctx is done, and runs them while it leads.
+func (d *Daemon) leadSchedules(ctx context.Context) {
+	var stop context.CancelFunc
+	var done chan struct{}
+	for {
+		d.sched.mu.Lock()
+		singletons := false
+		for _, e := range d.sched.entries {
+			singletons = singletons || e.Singleton
+		}
+		changed := d.sched.changed
+		d.sched.mu.Unlock()
+
+		switch {
+		case singletons && stop == nil:
+			var lctx context.Context
+			lctx, stop = context.WithCancel(ctx)
+			done = make(chan struct{})
+			go func() {
+				defer close(done)
+				d.kv.Lead(lctx, ScheduleElection, func(ctx context.Context) {
+					d.runSchedules(ctx, true)
+				})
+			}()
+		case !singletons && stop != nil:
+			stop()
+			<-done
+			stop = nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			if stop != nil {
+				stop()
+				<-done
+			}
+			return
+		}
+	}
+}
+
+// runSchedule submits the job of s once its jitter passed, unless the last
+// job of s still runs, and records it as the last of s, updated once it
+// is done.
+func (d *Daemon) runSchedule(ctx context.Context, s Schedule) {
+	if s.Jitter > 0 {
+		t := time.NewTimer(rand.N(time.Duration(s.Jitter)))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+
+	d.sched.mu.Lock()
+	e := d.sched.entries[s.Name]
+	if e == nil || e.Last != nil && e.Last.State == jobs.Running {
+		d.sched.mu.Unlock()
+		log.Default().Info("daemon: schedule skipped", "schedule", s.Name, "last", e != nil)
+		return
+	}
+	run := &ScheduleRun{Time: time.Now(), State: jobs.Running}
+	e.Last = run
+	j, err := d.jobs.Submit(s.Job, "schedule "+s.Name)
+	if err != nil {
+		run.State, run.Error = jobs.Failed, err.Error()
+	} else {
+		run.Job = j.ID
+	}
+	if err := d.sched.save(); err != nil {
+		log.Default().Warn("daemon: save schedules", "err", err)
+	}
+	d.sched.mu.Unlock()
+
+	if err != nil {
+		log.Default().Warn("daemon: schedule", "schedule", s.Name, "err", err)
+		return
+	}
+	log.Default().Info("daemon: schedule", "schedule", s.Name, "job", j.ID)
+
+	// The job runs on once ctx is done, until it is or the daemon stops.
+	go func() {
+		j, err := d.jobs.Wait(context.WithoutCancel(ctx), j.ID)
+		d.sched.mu.Lock()
+		defer d.sched.mu.Unlock()
+		if err != nil {
+			run.State, run.Error = jobs.Failed, err.Error()
+		} else {
+			run.State = j.State
+		}
+		if err := d.sched.save(); err != nil {
+			log.Default().Warn("daemon: save schedules", "err", err)
+		}
+	}()
+}
+
+// checkCertTask fails if the certificate of the node expires within the
+// duration of its argument, 30 days without one.
+func checkCertTask(ctx context.Context, d *Daemon, args []string, stdout, stderr io.Writer) error {
+	within := 30 * 24 * time.Hour
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if within, err = time.ParseDuration(args[0]); err != nil {
+			return err
+		}
+	default:
+		return errors.New("check-cert takes at most a duration")
+	}
+
+	leaf := d.Bundle().Chain()[0]
+	left := time.Until(leaf.NotAfter)
+	fmt.Fprintf(stdout, "certificate of %s, serial %s, expires %s, in %v\n",
+		leaf.Subject.CommonName, leaf.SerialNumber, leaf.NotAfter.Format(time.RFC3339), left.Round(time.Minute))
+	if left < within {
+		return fmt.Errorf("certificate expires within %v", within)
+	}
+	return nil
+}
+
+// The schedule service has these endpoints:
+//
+//	GET  /        the ScheduleStatus of every schedule, by name
+//	POST /        add the Schedule of the request, or replace that of its
+//	              name, responding with its ScheduleStatus
+//	POST /remove  remove the schedule of the ScheduleRequest
+//	POST /run     submit the job of the schedule of the ScheduleRequest
+//	              at once, responding with the job
+//
+// Peers need a role of the job roles.
+func scheduleHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		if d.authorize(w, r, "schedule", d.config().JobRoles) {
+			writeJSON(w, d.Schedules())
+		}
+	})
+
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "schedule", d.config().JobRoles) {
+			return
+		}
+
+		var s Schedule
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&s); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		st, err := d.AddSchedule(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Default().Info("daemon: schedule added", append(peerAttrs(r), "schedule", s.Name, "cron", s.Cron)...)
+		writeJSON(w, &st)
+	})
+
+	mux.HandleFunc("POST /remove", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "schedule", d.config().JobRoles) {
+			return
+		}
+
+		var req ScheduleRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		if err := d.RemoveSchedule(req.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		log.Default().Info("daemon: schedule removed", append(peerAttrs(r), "schedule", req.Name)...)
+		writeJSON(w, struct{}{})
+	})
+
+	mux.HandleFunc("POST /run", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "schedule", d.config().JobRoles) {
+			return
+		}
+
+		var req ScheduleRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		d.sched.mu.Lock()
+		e := d.sched.entries[req.Name]
+		d.sched.mu.Unlock()
+		if e == nil {
+			http.Error(w, "no schedule "+req.Name, http.StatusNotFound)
+			return
+		}
+		j, err := d.jobs.Submit(e.Job, "schedule "+req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Default().Info("daemon: schedule run", append(peerAttrs(r), "schedule", req.Name, "job", j.ID)...)
+		writeJSON(w, &j)
+	})
+
+	return mux
+}
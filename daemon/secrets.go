@@ -0,0 +1,504 @@
+package daemon
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nih.software/log"
+	"nih.software/rpc"
+	"nih.software/secrets"
+	"nih.software/trust"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "secrets",
+		Summary: "keep secrets sealed to the keys of nodes",
+		Handler: secretsHandler,
+		Methods: secretsMethods,
+	})
+}
+
+// DefaultSecretsFile is the name of the file of the secrets of a node in
+// its state directory.
+const DefaultSecretsFile = "secrets.json"
+
+// MaxSecretSize is the size limit of the value of a secret.
+const MaxSecretSize = 64 << 10
+
+// A Secret is a secret a daemon keeps, sealed to the key of its
+// certificate, so that it is encrypted at rest, and only that daemon may
+// open it.
+type Secret struct {
+	Name string `json:"name"`
+
+	// Updated is when the secret was put. A daemon keeps the secret put
+	// last of those of a name.
+	Updated time.Time `json:"updated"`
+
+	// From is the name of the certificate of whoever put the secret, or
+	// "control" for a client of the control socket.
+	From string `json:"from"`
+
+	// File, if not empty, is the file the daemon writes the value of the
+	// secret to, with Mode, whenever it starts or the secret changes, and
+	// removes once it is deleted: relative to the daemon's working
+	// directory unless absolute.
+	File string      `json:"file,omitempty"`
+	Mode fs.FileMode `json:"mode,omitempty"`
+
+	// Sealed is the sealed value, omitted from the list of the secrets
+	// service.
+	Sealed *secrets.Sealed `json:"sealed,omitempty"`
+}
+
+// SecretPut is the request of the put endpoint of the secrets service.
+type SecretPut struct {
+	Name  string `json:"name"`
+	Value []byte `json:"value"`
+
+	// Nodes are the names of the nodes to seal the secret to, or with
+	// All, every node the daemon knows and reaches, its own included.
+	Nodes []string `json:"nodes,omitempty"`
+	All   bool     `json:"all,omitempty"`
+
+	File string      `json:"file,omitempty"`
+	Mode fs.FileMode `json:"mode,omitempty"`
+}
+
+// SecretDelete is the request of the delete endpoint of the secrets
+// service, to the nodes of Nodes or All as for SecretPut.
+type SecretDelete struct {
+	Name  string   `json:"name"`
+	Nodes []string `json:"nodes,omitempty"`
+	All   bool     `json:"all,omitempty"`
+}
+
+// SecretRequest is the request of the secrets.Delete method.
+type SecretRequest struct {
+	Name string `json:"name"`
+}
+
+// SecretResult is the outcome of a put or delete on a node.
+type SecretResult struct {
+	Node  string `json:"node"`
+	Error string `json:"error,omitempty"`
+}
+
+// SecretValue is the response of the value endpoint of the secrets
+// service.
+type SecretValue struct {
+	Name  string `json:"name"`
+	Value []byte `json:"value"`
+}
+
+// checkSecretName returns an error if name is not a valid name of a
+// secret.
+func checkSecretName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/= \t\n") {
+		return fmt.Errorf("invalid secret name %q", name)
+	}
+	return nil
+}
+
+// secretStore are the secrets of a daemon.
+type secretStore struct {
+	// file is the file the secrets are kept in, if any.
+	file string
+
+	mu      sync.Mutex
+	entries map[string]*Secret
+}
+
+// load reads the secrets of s from its file, if any.
+func (s *secretStore) load() error {
+	s.entries = make(map[string]*Secret)
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*Secret
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("daemon: secrets %s: %w", s.file, err)
+	}
+	for _, e := range entries {
+		s.entries[e.Name] = e
+	}
+	return nil
+}
+
+// save writes the secrets of s to its file, if any. The caller must hold
+// s.mu.
+func (s *secretStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+	entries := make([]*Secret, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	data, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.file, data, 0600)
+}
+
+// Secrets returns the secrets of the daemon, without their sealed values,
+// in name order.
+func (d *Daemon) Secrets() []Secret {
+	d.secrets.mu.Lock()
+	defer d.secrets.mu.Unlock()
+
+	list := []Secret{}
+	for _, e := range d.secrets.entries {
+		s := *e
+		s.Sealed = nil
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// SecretValue opens the secret of name with the key of the daemon.
+func (d *Daemon) SecretValue(name string) ([]byte, error) {
+	d.secrets.mu.Lock()
+	e := d.secrets.entries[name]
+	d.secrets.mu.Unlock()
+	if e == nil {
+		return nil, rpc.Errorf(rpc.CodeNotFound, "no secret %s", name)
+	}
+	return e.Sealed.Open(d.Bundle().Signer())
+}
+
+// storeSecret keeps s, unless the daemon has a secret of its name put
+// later, and writes it to its file, if any. s must be sealed to the key
+// of the daemon.
+func (d *Daemon) storeSecret(s Secret) error {
+	if err := checkSecretName(s.Name); err != nil {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	}
+	if s.Sealed == nil {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "secret %s is not sealed", s.Name)
+	}
+	// Open it once, so that a secret the daemon cannot open is refused
+	// rather than kept.
+	value, err := s.Sealed.Open(d.Bundle().Signer())
+	if err != nil {
+		return rpc.Errorf(rpc.CodeInvalidArgument, "secret %s: %v", s.Name, err)
+	}
+
+	d.secrets.mu.Lock()
+	defer d.secrets.mu.Unlock()
+	if e := d.secrets.entries[s.Name]; e != nil && e.Updated.After(s.Updated) {
+		return nil
+	}
+	if e := d.secrets.entries[s.Name]; e != nil && e.File != "" && e.File != s.File {
+		os.Remove(e.File)
+	}
+	d.secrets.entries[s.Name] = &s
+	if err := d.secrets.save(); err != nil {
+		return err
+	}
+	return writeSecretFile(&s, value)
+}
+
+// writeSecretFile writes value, that of s, to the file of s, if any.
+func writeSecretFile(s *Secret, value []byte) error {
+	if s.File == "" {
+		return nil
+	}
+	mode := s.Mode.Perm()
+	if mode == 0 {
+		mode = 0600
+	}
+	if err := writeFileAtomic(s.File, value, mode); err != nil {
+		return fmt.Errorf("secret %s: %w", s.Name, err)
+	}
+	return nil
+}
+
+// writeSecretFiles writes the secrets of the daemon to their files, as
+// when it starts, logging those it cannot.
+func (d *Daemon) writeSecretFiles() {
+	d.secrets.mu.Lock()
+	defer d.secrets.mu.Unlock()
+
+	for _, s := range d.secrets.entries {
+		if s.File == "" {
+			continue
+		}
+		value, err := s.Sealed.Open(d.Bundle().Signer())
+		if err == nil {
+			err = writeSecretFile(s, value)
+		}
+		if err != nil {
+			log.Default().Warn("daemon: secret not written", "secret", s.Name, "file", s.File, "err", err)
+		}
+	}
+}
+
+// removeSecret removes the secret of name, and its file, if any.
+func (d *Daemon) removeSecret(name string) error {
+	d.secrets.mu.Lock()
+	defer d.secrets.mu.Unlock()
+
+	e := d.secrets.entries[name]
+	if e == nil {
+		return rpc.Errorf(rpc.CodeNotFound, "no secret %s", name)
+	}
+	if e.File != "" {
+		if err := os.Remove(e.File); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	delete(d.secrets.entries, name)
+	return d.secrets.save()
+}
+
+// secretNodes returns the names of the nodes of a put or delete.
+func (d *Daemon) secretNodes(nodes []string, all bool) ([]string, error) {
+	switch {
+	case all && len(nodes) > 0:
+		return nil, errors.New("both nodes and all")
+	case all:
+		return d.jobNodes(), nil
+	case len(nodes) == 0:
+		return nil, errors.New("no nodes")
+	}
+	return nodes, nil
+}
+
+// PutSecret seals the value of p to the key of every node of p, and sends
+// it to them over RPC, from whoever from names.
+func (d *Daemon) PutSecret(ctx context.Context, p SecretPut, from string) ([]SecretResult, error) {
+	if err := checkSecretName(p.Name); err != nil {
+		return nil, err
+	}
+	if len(p.Value) > MaxSecretSize {
+		return nil, fmt.Errorf("secret %s exceeds %d bytes", p.Name, MaxSecretSize)
+	}
+	if p.Mode&^fs.ModePerm != 0 {
+		return nil, fmt.Errorf("invalid mode %o", p.Mode)
+	}
+	nodes, err := d.secretNodes(p.Nodes, p.All)
+	if err != nil {
+		return nil, err
+	}
+
+	s := Secret{Name: p.Name, Updated: time.Now(), From: from, File: p.File, Mode: p.Mode}
+	return d.eachSecretNode(ctx, nodes, func(ctx context.Context, leaf *x509.Certificate, client *rpc.Client) error {
+		sealed, err := secrets.Seal(p.Value, leaf.PublicKey)
+		if err != nil {
+			return err
+		}
+		s := s
+		s.Sealed = sealed
+		if client == nil {
+			return d.storeSecret(s)
+		}
+		_, err = rpc.Call[Secret, struct{}](ctx, client, "secrets.Store", s)
+		return err
+	}), nil
+}
+
+// DeleteSecret deletes the secret of d from every node of d.
+func (d *Daemon) DeleteSecret(ctx context.Context, del SecretDelete) ([]SecretResult, error) {
+	if err := checkSecretName(del.Name); err != nil {
+		return nil, err
+	}
+	nodes, err := d.secretNodes(del.Nodes, del.All)
+	if err != nil {
+		return nil, err
+	}
+	return d.eachSecretNode(ctx, nodes, func(ctx context.Context, _ *x509.Certificate, client *rpc.Client) error {
+		if client == nil {
+			return d.removeSecret(del.Name)
+		}
+		_, err := rpc.Call[SecretRequest, struct{}](ctx, client, "secrets.Delete", SecretRequest{Name: del.Name})
+		return err
+	}), nil
+}
+
+// eachSecretNode calls f for every node of nodes at once, with the
+// certificate of the node, and a client connected to it, or nil for the
+// daemon itself.
+func (d *Daemon) eachSecretNode(ctx context.Context, nodes []string, f func(ctx context.Context, leaf *x509.Certificate, client *rpc.Client) error) []SecretResult {
+	self := d.Bundle().Chain()[0].Subject.CommonName
+	results := make([]SecretResult, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		results[i].Node = node
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if node == self {
+				err = f(ctx, d.Bundle().Chain()[0], nil)
+			} else {
+				err = d.callSecretNode(ctx, node, f)
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// callSecretNode calls f with the client of node, and its certificate,
+// which it presented in the handshake.
+func (d *Daemon) callSecretNode(ctx context.Context, node string, f func(ctx context.Context, leaf *x509.Certificate, client *rpc.Client) error) error {
+	p, ok := d.node(node)
+	if !ok {
+		return fmt.Errorf("%s unreachable", node)
+	}
+	client, err := d.client(ctx, p.Addr, p.Name)
+	if err != nil {
+		return err
+	}
+	id, _ := client.Peer()
+	return f(ctx, id.Leaf(), client)
+}
+
+// secretsFrom checks the caller of a method of the secrets service may
+// change the secrets of the daemon.
+func (d *Daemon) secretsFrom(ctx context.Context) error {
+	leaf, roles := rpcLeaf(ctx), d.config().SecretRoles
+	switch {
+	case leaf == nil || trust.HasRole(leaf, roles...):
+		return nil
+	case len(roles) == 0:
+		return rpc.Errorf(rpc.CodePermissionDenied, "secrets are disabled for peers")
+	}
+	return rpc.Errorf(rpc.CodePermissionDenied, "secrets require a role of %s", strings.Join(roles, ", "))
+}
+
+func secretsMethods(d *Daemon, s *rpc.Server) {
+	rpc.Register(s, "secrets.Store", nil, func(ctx context.Context, sec Secret) (struct{}, error) {
+		if err := d.secretsFrom(ctx); err != nil {
+			return struct{}{}, err
+		}
+		if err := d.storeSecret(sec); err != nil {
+			return struct{}{}, err
+		}
+		log.Default().Info("daemon: secret stored", "peer", rpcLeaf(ctx).Subject.String(), "secret", sec.Name, "from", sec.From)
+		return struct{}{}, nil
+	})
+
+	rpc.Register(s, "secrets.Delete", nil, func(ctx context.Context, req SecretRequest) (struct{}, error) {
+		if err := d.secretsFrom(ctx); err != nil {
+			return struct{}{}, err
+		}
+		if err := d.removeSecret(req.Name); err != nil {
+			return struct{}{}, err
+		}
+		log.Default().Info("daemon: secret deleted", "peer", rpcLeaf(ctx).Subject.String(), "secret", req.Name)
+		return struct{}{}, nil
+	})
+}
+
+// The secrets service has these endpoints:
+//
+//	GET  /        the secrets of the daemon, without their values
+//	POST /        put the SecretPut of the request on its nodes,
+//	              responding with a SecretResult for every node
+//	POST /delete  delete the secret of the SecretDelete of the request
+//	              from its nodes, likewise
+//	GET  /value   the SecretValue of the secret of the name query
+//	              parameter, to clients of the control socket only
+//
+// Peers need a role of the secret roles for the others.
+func secretsHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		if d.authorize(w, r, "secrets", d.config().SecretRoles) {
+			writeJSON(w, d.Secrets())
+		}
+	})
+
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "secrets", d.config().SecretRoles) {
+			return
+		}
+
+		var p SecretPut
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*MaxSecretSize+1<<10)).Decode(&p); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		from := "control"
+		if leaf := httpLeaf(r); leaf != nil {
+			from = leaf.Subject.CommonName
+		}
+		results, err := d.PutSecret(r.Context(), p, from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Default().Info("daemon: secret put", append(peerAttrs(r), "secret", p.Name, "nodes", len(results))...)
+		writeJSON(w, results)
+	})
+
+	mux.HandleFunc("POST /delete", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "secrets", d.config().SecretRoles) {
+			return
+		}
+
+		var del SecretDelete
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&del); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		results, err := d.DeleteSecret(r.Context(), del)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		log.Default().Info("daemon: secret deleted", append(peerAttrs(r), "secret", del.Name, "nodes", len(results))...)
+		writeJSON(w, results)
+	})
+
+	mux.HandleFunc("GET /value", func(w http.ResponseWriter, r *http.Request) {
+		// The values never leave the node.
+		if r.TLS != nil {
+			http.Error(w, "secret values are only served over the control socket", http.StatusForbidden)
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		value, err := d.SecretValue(name)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		writeJSON(w, &SecretValue{Name: name, Value: value})
+	})
+
+	return mux
+}
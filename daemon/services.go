@@ -0,0 +1,277 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"nih.software/log"
+	"nih.software/rpc"
+	"nih.software/trust"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "health",
+		Summary: "report whether the node is serving",
+		Handler: healthHandler,
+		Methods: healthMethods,
+	})
+
+	Register(&Service{
+		Name:    "admin",
+		Summary: "report the state of the node",
+		Handler: adminHandler,
+		Methods: adminMethods,
+	})
+}
+
+// Health is the response of the health service.
+type Health struct {
+	Status string `json:"status"`
+
+	// Time is the time of the clock of the node as it answered, which
+	// peers measure the skew of their clocks against.
+	Time time.Time `json:"time"`
+}
+
+func healthHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, &Health{Status: "ok", Time: time.Now()})
+	})
+
+	return mux
+}
+
+func healthMethods(d *Daemon, s *rpc.Server) {
+	rpc.Register(s, "health.Check", nil, func(ctx context.Context, _ struct{}) (Health, error) {
+		// Peers ping over connections they keep, so every ping counts as
+		// their being seen, not only the connection.
+		if id, ok := rpc.Peer(ctx); ok {
+			d.known.seen(id.Leaf(), rpc.RemoteAddr(ctx).String())
+		}
+		return Health{Status: "ok", Time: time.Now()}, nil
+	})
+}
+
+// Status is the response of the admin service's status endpoint.
+type Status struct {
+	Addr     string    `json:"addr"`
+	Control  string    `json:"control,omitempty"`
+	Started  time.Time `json:"started"`
+	Uptime   Duration  `json:"uptime"`
+	Serial   string    `json:"serial"`
+	NotAfter time.Time `json:"not_after"`
+	Peers    int64     `json:"peers"`
+	Services []string  `json:"services"`
+	Methods  []string  `json:"methods"`
+
+	// Protocols are the IDs of the protocols the daemon negotiates by
+	// ALPN, in order of preference.
+	Protocols []string `json:"protocols"`
+
+	// ClockSkew is the skew of the clock of the peer furthest from the
+	// daemon's, ahead if positive or behind, among those probed.
+	ClockSkew Duration `json:"clock_skew"`
+
+	// RefusedConns and RefusedCalls are how many connections and RPC calls
+	// the daemon refused for its limits.
+	RefusedConns int64 `json:"refused_conns"`
+	RefusedCalls int64 `json:"refused_calls"`
+
+	Errors []Error `json:"errors"`
+}
+
+// Duration is a time.Duration encoded in JSON as a string such as "1h2m3s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	*d = Duration(v)
+	return err
+}
+
+// Status returns the state of the daemon.
+func (d *Daemon) Status() *Status {
+	s := &Status{
+		Started: d.Started(),
+		Uptime:  Duration(time.Since(d.Started()).Round(time.Second)),
+		Control: d.Control(),
+		Peers:   d.peers.Load(),
+		Errors:  d.errs.list(),
+
+		RefusedConns: d.limiter.Refused(),
+		RefusedCalls: d.rpc.Refused(),
+	}
+
+	if addr := d.Addr(); addr != nil {
+		s.Addr = addr.String()
+	}
+
+	if crt, err := d.Bundle().TLSConfig().GetCertificate(nil); err == nil {
+		s.Serial = crt.Leaf.SerialNumber.String()
+		s.NotAfter = crt.Leaf.NotAfter
+	}
+
+	for _, p := range d.Peers() {
+		if abs(p.Skew) > abs(s.ClockSkew) {
+			s.ClockSkew = p.Skew
+		}
+	}
+
+	for _, svc := range Services() {
+		s.Services = append(s.Services, svc.Name)
+	}
+	s.Methods = d.rpc.Methods()
+	s.Protocols = d.protos.NextProtos()
+
+	return s
+}
+
+func adminMethods(d *Daemon, s *rpc.Server) {
+	rpc.Register(s, "admin.Status", nil, func(context.Context, struct{}) (Status, error) {
+		return *d.Status(), nil
+	})
+
+	rpc.Register(s, "admin.Peers", nil, func(context.Context, struct{}) ([]Peer, error) {
+		return d.Peers(), nil
+	})
+}
+
+func adminHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Status())
+	})
+
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "config", nil) {
+			return
+		}
+
+		writeJSON(w, d.Settings())
+	})
+
+	mux.HandleFunc("POST /config", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "config", nil) {
+			return
+		}
+
+		var u ConfigUpdate
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&u); err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+
+		changes, err := d.Configure(u.Set, u.DryRun)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, changes)
+	})
+
+	mux.HandleFunc("POST /reload", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "reload", nil) {
+			return
+		}
+
+		log.Default().Info("daemon: reload requested", peerAttrs(r)...)
+		if err := d.Reload(); err != nil {
+			http.Error(w, "reload credentials: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, d.Status())
+	})
+
+	mux.HandleFunc("GET /logs", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "logs", nil) {
+			return
+		}
+		d.serveLogs(w, r)
+	})
+
+	mux.HandleFunc("GET /peers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, d.Peers())
+	})
+
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// httpError responds with the message of err, and the status of its code.
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch rpc.ErrorCode(err) {
+	case rpc.CodeInvalidArgument:
+		status = http.StatusBadRequest
+	case rpc.CodeNotFound:
+		status = http.StatusNotFound
+	case rpc.CodePermissionDenied:
+		status = http.StatusForbidden
+	case rpc.CodeFailedPrecondition:
+		status = http.StatusConflict
+	case rpc.CodeUnimplemented:
+		status = http.StatusNotImplemented
+	case rpc.CodeUnavailable:
+		status = http.StatusServiceUnavailable
+	case rpc.CodeResourceExhausted:
+		status = http.StatusTooManyRequests
+	}
+	msg := err.Error()
+	if e, ok := err.(*rpc.Error); ok {
+		msg = e.Message
+	}
+	http.Error(w, msg, status)
+}
+
+// authorize reports whether the client of r may use the service,
+// which requires one of roles. If not, it responds with 403 Forbidden.
+// Clients of the control socket hold the daemon's privileges already.
+func (d *Daemon) authorize(w http.ResponseWriter, r *http.Request, service string, roles []string) bool {
+	if r.TLS == nil {
+		return true
+	}
+
+	leaf := r.TLS.PeerCertificates[0]
+	if len(roles) > 0 && trust.HasRole(leaf, roles...) {
+		return true
+	}
+
+	log.Default().Warn("daemon: "+service+" denied", "subject", leaf.Subject.String(), "serial", leaf.SerialNumber)
+
+	msg := service + " requires a role of " + strings.Join(roles, ", ")
+	if len(roles) == 0 {
+		msg = service + " is disabled for peers"
+	}
+	http.Error(w, msg, http.StatusForbidden)
+	return false
+}
+
+// peerAttrs returns log attributes identifying the client of r.
+func peerAttrs(r *http.Request) []any {
+	if r.TLS == nil {
+		return []any{"peer", "control"}
+	}
+
+	leaf := r.TLS.PeerCertificates[0]
+	return []any{"peer", leaf.Subject.String(), "serial", leaf.SerialNumber}
+}
@@ -0,0 +1,131 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"nih.software/filesync"
+	"nih.software/log"
+)
+
+func init() {
+	Register(&Service{
+		Name:    "sync",
+		Summary: "make directories of the node match those of peers",
+		Handler: syncHandler,
+	})
+}
+
+// SyncRequest is the request of the manifest of a directory of the node,
+// as the destination of a sync.
+type SyncRequest struct {
+	// Path is the directory, relative to the daemon's working directory
+	// unless absolute.
+	Path  string         `json:"path"`
+	Rules filesync.Rules `json:"rules"`
+}
+
+// The sync service has these endpoints, allowed to the roles of
+// FileRoles, as the files service:
+//
+//	POST /manifest  the filesync.Manifest of the directory of a
+//	                SyncRequest, with the SHA-256 of the blocks of its files
+//	POST /apply     apply the stream of JSON filesync.Frame of the body to
+//	                the directory of the path query parameter
+//
+// Applies are run one at a time, as two to the same directory would
+// receive their files into the same partial files.
+func syncHandler(d *Daemon) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /manifest", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "sync", d.config().FileRoles) {
+			return
+		}
+
+		var req SyncRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		if err := req.Rules.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m, err := filesync.Scan(req.Path, req.Rules, true)
+		if err != nil {
+			fileError(w, err)
+			return
+		}
+		writeJSON(w, m)
+	})
+
+	var mu sync.Mutex
+	mux.HandleFunc("POST /apply", func(w http.ResponseWriter, r *http.Request) {
+		if !d.authorize(w, r, "sync", d.config().FileRoles) {
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			http.Error(w, "missing path", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		n, err := syncApply(path, r.Body)
+		switch {
+		case errors.Is(err, filesync.ErrInvalidFrame):
+			log.Default().Warn("daemon: sync: invalid frame", append(peerAttrs(r), "path", path, "err", err)...)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Default().Info("daemon: sync: interrupted", append(peerAttrs(r), "path", path, "frames", n, "err", err)...)
+			fileError(w, err)
+			return
+		}
+
+		log.Default().Info("daemon: sync: applied", append(peerAttrs(r), "path", path, "frames", n)...)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+// syncApply applies the frames of body to the directory path, and returns
+// the number of frames applied.
+func syncApply(path string, body io.Reader) (int, error) {
+	rcv, err := filesync.NewReceiver(path)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	dec := json.NewDecoder(body)
+	for {
+		var f filesync.Frame
+		if err = dec.Decode(&f); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		if err = rcv.Apply(&f); err != nil {
+			break
+		}
+		n++
+	}
+
+	// The state is saved even if the sync failed, for the files it
+	// received.
+	if cerr := rcv.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
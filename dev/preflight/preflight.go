@@ -0,0 +1,459 @@
+// Package preflight runs the steps that prepare a development environment,
+// as "nih dev preflight" does.
+//
+// A step has a test, which passes if the environment is prepared, and
+// usually an action, which prepares it. Steps need other steps by their
+// IDs; a Runner takes independent steps concurrently, and every step after
+// the steps it needs, and reports the outcome of each.
+//
+// Programs embedding nih add steps to "nih dev preflight" with RegisterStep,
+// usually in an init function:
+//
+//	func init() {
+//		preflight.RegisterStep(preflight.Step{
+//			ID:    "schema",
+//			Name:  "migrate the development database",
+//			Needs: []string{"dirs"},
+//			Test:  schemaCurrent,
+//			Do:    migrate,
+//		})
+//	}
+package preflight
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"nih.software/cli/ui"
+	"nih.software/log"
+)
+
+// A Step is a step of preflight.
+type Step struct {
+	// ID names the step for selecting it and for Needs, e.g. "creds".
+	ID string
+
+	// Name describes the step in its results, e.g. "generate creds".
+	Name string
+
+	// Needs are the IDs of the steps that must succeed before this one.
+	Needs []string
+
+	// Test reports whether the environment is prepared, by failing if it
+	// is not. Its error tells the user what is wrong.
+	Test func() error
+
+	// Do makes the test pass. It is nil for a step that only checks,
+	// whose failure the user has to fix.
+	Do func() error
+
+	// Confirm returns a question for the user, asked before any step is
+	// taken, if Do is about to make changes that may lose data, such as
+	// replacing files that fail the test but may still be needed. It
+	// returns "" if Do may run without asking. It may be nil.
+	Confirm func() string
+
+	// Force takes the step even if its test passes.
+	Force bool
+
+	// Plan describes the changes Do would make, for a dry run.
+	// It may be nil.
+	Plan func() []string
+
+	// Report describes what the step prepared, such as the identity of
+	// generated credentials, in lines printed after its result if it
+	// succeeds. It may be nil.
+	Report func() []string
+}
+
+var (
+	stepsMu sync.Mutex
+	steps   []Step
+)
+
+// RegisterStep adds s to the steps of every run of "nih dev preflight"
+// started afterwards, after its built-in steps, whose IDs s may need.
+// It panics if the ID is empty or already registered, or if s has no test.
+func RegisterStep(s Step) {
+	stepsMu.Lock()
+	defer stepsMu.Unlock()
+
+	if s.ID == "" || strings.ContainsAny(s.ID, ", ") {
+		panic("preflight: invalid step ID " + s.ID)
+	}
+	if s.Test == nil {
+		panic("preflight: step " + s.ID + " has no test")
+	}
+
+	for _, t := range steps {
+		if t.ID == s.ID {
+			panic("preflight: duplicate step " + s.ID)
+		}
+	}
+
+	steps = append(steps, s)
+}
+
+// Registered returns the registered steps in the order of registration.
+func Registered() []Step {
+	stepsMu.Lock()
+	defer stepsMu.Unlock()
+
+	return slices.Clone(steps)
+}
+
+// A Result is the outcome of a step, as a Runner prints it in JSON.
+type Result struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+
+	// Action is "skipped" if the test of the step passed, "ran" otherwise,
+	// "checked" for a step that only checks, "blocked" if a step it needs
+	// failed, and "declined" if the user did not confirm it. In a dry run,
+	// a step that would run is "would run", and in a check, steps that are
+	// not "checked" are "passed" or "failed".
+	Action string `json:"action"`
+
+	// Reason is why the step ran: the error of its test, or "forced".
+	Reason string `json:"reason,omitempty"`
+
+	// Changes are those the step would make, in a dry run.
+	Changes []string `json:"changes,omitempty"`
+
+	// Report describes what the step prepared, if it succeeded.
+	Report []string `json:"report,omitempty"`
+
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// A Summary counts the outcomes of a run. In JSON, it is printed last, as an
+// object with a summary field.
+type Summary struct {
+	Steps    int           `json:"steps"`
+	Passed   int           `json:"passed"`
+	Failed   int           `json:"failed"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Select returns the steps named by only and the steps they need, or all
+// steps if only is empty, except those named by skip. A skipped step is
+// assumed to be taken care of by the steps that need it. It fails if a name
+// is not the ID of one of steps.
+func Select(steps []Step, only, skip []string) ([]Step, error) {
+	index := make(map[string]int)
+	var ids []string
+	for i, s := range steps {
+		index[s.ID] = i
+		ids = append(ids, s.ID)
+	}
+
+	for _, id := range append(only, skip...) {
+		if _, ok := index[id]; !ok {
+			return nil, fmt.Errorf("unknown step %q; the steps are %s", id, strings.Join(ids, ", "))
+		}
+	}
+
+	want := make(map[string]bool)
+	var add func(id string)
+	add = func(id string) {
+		if want[id] {
+			return
+		}
+		want[id] = true
+		for _, need := range steps[index[id]].Needs {
+			if _, ok := index[need]; ok {
+				add(need)
+			}
+		}
+	}
+	for _, id := range only {
+		add(id)
+	}
+
+	var selected []Step
+	for _, s := range steps {
+		if (len(only) == 0 || want[s.ID]) && !slices.Contains(skip, s.ID) {
+			selected = append(selected, s)
+		}
+	}
+	return selected, nil
+}
+
+// Order returns steps sorted so that every step follows the steps it needs,
+// and otherwise in the order given, so that runs are deterministic. Needs
+// that are not among steps are ignored. It fails if steps need each other.
+func Order(steps []Step) ([]Step, error) {
+	index := make(map[string]int)
+	for i, s := range steps {
+		index[s.ID] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(steps))
+
+	var sorted []Step
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("step %s needs itself through the steps it needs", steps[i].ID)
+		case visited:
+			return nil
+		}
+
+		state[i] = visiting
+		for _, id := range steps[i].Needs {
+			if j, ok := index[id]; ok {
+				if err := visit(j); err != nil {
+					return err
+				}
+			}
+		}
+		state[i] = visited
+		sorted = append(sorted, steps[i])
+		return nil
+	}
+
+	for i := range steps {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// A Runner takes steps and reports their outcomes.
+type Runner struct {
+	// Force takes every step even if its test passes.
+	Force bool
+
+	// Check runs only the tests, and runs every test, even those of steps
+	// whose needs failed, to report every problem at once.
+	Check bool
+
+	// DryRun runs only the tests, and reports the changes the steps whose
+	// tests fail would make.
+	DryRun bool
+
+	// JSON, if not nil, receives every result and then the summary as
+	// JSON objects, one per line, instead of the text printed by the
+	// default UI.
+	JSON io.Writer
+}
+
+// Run takes steps, in an order that Order returned, and returns the summary
+// of their outcomes. Every step starts as soon as the steps it needs have
+// finished, so that independent steps run concurrently, and is blocked
+// rather than taken if one of them failed. Results are printed in the
+// order of steps, followed by the summary. The start and outcome of every
+// step are logged at debug level, as the "preflight" component, so that
+// -log-level preflight=debug traces a run as it happens.
+func (rn *Runner) Run(steps []Step) Summary {
+	start := time.Now()
+
+	index := make(map[string]int)
+	for i, s := range steps {
+		index[s.ID] = i
+	}
+
+	// Ask every question first, so that prompts do not interleave with
+	// the results.
+	declined := make([]error, len(steps))
+	if !rn.Check && !rn.DryRun {
+		for i, s := range steps {
+			if s.Confirm == nil {
+				continue
+			}
+			if q := s.Confirm(); q != "" {
+				ok, err := ui.Confirm(q)
+				if err == nil && !ok {
+					err = errors.New("declined")
+				}
+				declined[i] = err
+			}
+		}
+	}
+
+	results := make([]Result, len(steps))
+	errs := make([]error, len(steps))
+	done := make([]chan struct{}, len(steps))
+	for i := range steps {
+		done[i] = make(chan struct{})
+	}
+
+	for i, s := range steps {
+		go func() {
+			defer close(done[i])
+
+			blocked := ""
+			for _, id := range s.Needs {
+				if j, ok := index[id]; ok {
+					<-done[j]
+					if errs[j] != nil && blocked == "" {
+						blocked = id
+					}
+				}
+			}
+
+			t := time.Now()
+			r := Result{ID: s.ID, Name: s.Name, Action: "skipped"}
+
+			var err error
+			if blocked != "" && !rn.Check {
+				r.Action = "blocked"
+				err = fmt.Errorf("needs %s, which failed", blocked)
+			} else if declined[i] != nil {
+				r.Action = "declined"
+				err = declined[i]
+			} else {
+				log.Default().Debug("preflight: start", "step", s.ID)
+				err = rn.take(s, &r)
+			}
+
+			if err != nil {
+				r.Error = err.Error()
+			} else if s.Report != nil && r.Action != "would run" {
+				r.Report = s.Report()
+			}
+			r.Duration = time.Since(t)
+			results[i], errs[i] = r, err
+			log.Default().Debug("preflight: "+r.Action, "step", s.ID, "reason", r.Reason, "duration", r.Duration, "err", err)
+		}()
+	}
+
+	var enc *json.Encoder
+	if rn.JSON != nil {
+		enc = json.NewEncoder(rn.JSON)
+	}
+	sum := Summary{Steps: len(steps)}
+
+	for i, s := range steps {
+		var sp *ui.Spinner
+		if enc == nil {
+			sp = ui.NewSpinner(s.Name)
+		}
+		<-done[i]
+		if sp != nil {
+			sp.Stop()
+		}
+
+		r, err := results[i], errs[i]
+		if err != nil {
+			sum.Failed++
+		} else {
+			sum.Passed++
+		}
+
+		if enc != nil {
+			enc.Encode(r)
+		} else if r.Action == "would run" {
+			u := ui.Default()
+			u.Info("%s: %s", s.Name, u.Yellow("would run: "+r.Reason))
+			for _, c := range r.Changes {
+				u.Info("  %s", c)
+			}
+		} else if err != nil || r.Action == "ran" || rn.Check {
+			ui.Status(s.Name, err)
+		} else if len(r.Report) > 0 {
+			ui.Info("%s:", s.Name)
+		}
+		if enc == nil {
+			for _, line := range r.Report {
+				ui.Info("  %s", line)
+			}
+		}
+	}
+
+	sum.Duration = time.Since(start)
+	log.Default().Debug("preflight: done", "steps", sum.Steps, "passed", sum.Passed, "failed", sum.Failed, "duration", sum.Duration)
+	if enc != nil {
+		enc.Encode(struct {
+			Summary Summary `json:"summary"`
+		}{sum})
+	} else {
+		sum.write(results)
+	}
+
+	return sum
+}
+
+// write prints the duration of every step, and then the counts.
+func (sum Summary) write(results []Result) {
+	u := ui.Default()
+	round := func(d time.Duration) time.Duration {
+		return d.Round(100 * time.Microsecond)
+	}
+
+	width := 8
+	for _, r := range results {
+		width = max(width, len(r.ID))
+	}
+
+	u.Info("")
+	for _, r := range results {
+		u.Info("  %-*s %-9s %8v", width, r.ID, r.Action, round(r.Duration))
+	}
+
+	counts := fmt.Sprintf("%d passed, %d failed", sum.Passed, sum.Failed)
+	if sum.Failed > 0 {
+		counts = u.Red(counts)
+	} else {
+		counts = u.Green(counts)
+	}
+	u.Info("%d steps in %v: %s", sum.Steps, round(sum.Duration), counts)
+}
+
+// take takes s if its test fails or it is forced, recording what it did in r.
+func (rn *Runner) take(s Step, r *Result) error {
+	err := s.Test()
+	if s.Do == nil {
+		r.Action = "checked"
+		return err
+	}
+
+	if rn.Check {
+		r.Action = "passed"
+		if err != nil {
+			r.Action = "failed"
+		}
+		return err
+	}
+
+	switch {
+	case err != nil:
+		r.Reason = err.Error()
+	case rn.Force || s.Force:
+		r.Reason = "forced"
+	default:
+		return nil
+	}
+
+	if rn.DryRun {
+		r.Action = "would run"
+		if s.Plan != nil {
+			r.Changes = s.Plan()
+		}
+		return nil
+	}
+	r.Action = "ran"
+
+	err = s.Do()
+
+	// retest
+	if err == nil {
+		err = s.Test()
+	}
+
+	return err
+}
@@ -0,0 +1,207 @@
+package preflight_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"nih.software/cli/ui"
+	"nih.software/dev/preflight"
+)
+
+func ids(steps []preflight.Step) []string {
+	var ids []string
+	for _, s := range steps {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func pass() error { return nil }
+
+func TestSelectOrder(t *testing.T) {
+	steps := []preflight.Step{
+		{ID: "creds", Needs: []string{"dirs", "clock"}},
+		{ID: "go"},
+		{ID: "dirs"},
+		{ID: "clock"},
+	}
+
+	sorted, err := preflight.Order(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(sorted), []string{"dirs", "clock", "creds", "go"}; !slices.Equal(got, want) {
+		t.Errorf("Order = %v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		only, skip []string
+		want       []string
+	}{
+		{nil, nil, []string{"creds", "go", "dirs", "clock"}},
+		{[]string{"creds"}, nil, []string{"creds", "dirs", "clock"}},
+		{[]string{"creds"}, []string{"clock"}, []string{"creds", "dirs"}},
+		{nil, []string{"go"}, []string{"creds", "dirs", "clock"}},
+	} {
+		selected, err := preflight.Select(steps, tt.only, tt.skip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(selected); !slices.Equal(got, tt.want) {
+			t.Errorf("Select(%v, %v) = %v, want %v", tt.only, tt.skip, got, tt.want)
+		}
+	}
+
+	if _, err := preflight.Select(steps, []string{"bogus"}, nil); err == nil {
+		t.Error("Select(bogus) succeeded")
+	}
+
+	cycle := []preflight.Step{{ID: "a", Needs: []string{"b"}}, {ID: "b", Needs: []string{"a"}}}
+	if _, err := preflight.Order(cycle); err == nil {
+		t.Error("Order of a cycle succeeded")
+	}
+}
+
+func TestRunner(t *testing.T) {
+	prepared := false
+	steps := []preflight.Step{
+		{
+			ID: "prepare",
+			Test: func() error {
+				if !prepared {
+					return errors.New("not prepared")
+				}
+				return nil
+			},
+			Do:   func() error { prepared = true; return nil },
+			Plan: func() []string { return []string{"prepare"} },
+		},
+		{ID: "broken", Test: func() error { return errors.New("broken") }},
+		{ID: "after", Needs: []string{"broken"}, Test: pass, Do: pass},
+	}
+
+	run := func(rn preflight.Runner) (map[string]preflight.Result, preflight.Summary) {
+		t.Helper()
+
+		var b bytes.Buffer
+		rn.JSON = &b
+		sum := rn.Run(steps)
+
+		results := make(map[string]preflight.Result)
+		dec := json.NewDecoder(&b)
+		for range steps {
+			var r preflight.Result
+			if err := dec.Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+			results[r.ID] = r
+		}
+
+		var last struct{ Summary preflight.Summary }
+		if err := dec.Decode(&last); err != nil {
+			t.Fatal(err)
+		}
+		if last.Summary != sum {
+			t.Errorf("printed summary %+v, returned %+v", last.Summary, sum)
+		}
+		return results, sum
+	}
+
+	results, sum := run(preflight.Runner{DryRun: true})
+	if r := results["prepare"]; r.Action != "would run" || r.Reason != "not prepared" || !slices.Equal(r.Changes, []string{"prepare"}) || prepared {
+		t.Errorf("dry run: %+v", r)
+	}
+	if r := results["after"]; r.Action != "blocked" || !strings.Contains(r.Error, "broken") {
+		t.Errorf("dry run: %+v", r)
+	}
+	if sum.Steps != 3 || sum.Passed != 1 || sum.Failed != 2 {
+		t.Errorf("dry run: %+v", sum)
+	}
+
+	results, _ = run(preflight.Runner{Check: true})
+	if r := results["prepare"]; r.Action != "failed" {
+		t.Errorf("check: %+v", r)
+	}
+	if r := results["after"]; r.Action != "passed" {
+		t.Errorf("check: %+v", r)
+	}
+
+	results, _ = run(preflight.Runner{})
+	if r := results["prepare"]; r.Action != "ran" || r.Error != "" || !prepared {
+		t.Errorf("run: %+v", r)
+	}
+
+	results, _ = run(preflight.Runner{Force: true})
+	if r := results["prepare"]; r.Action != "ran" || r.Reason != "forced" {
+		t.Errorf("forced: %+v", r)
+	}
+}
+
+func TestRegisterStep(t *testing.T) {
+	preflight.RegisterStep(preflight.Step{ID: "registered", Test: pass})
+	if got := ids(preflight.Registered()); !slices.Equal(got, []string{"registered"}) {
+		t.Errorf("Registered = %v", got)
+	}
+
+	for _, s := range []preflight.Step{
+		{ID: "registered", Test: pass},
+		{ID: "", Test: pass},
+		{ID: "no-test"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterStep(%q) did not panic", s.ID)
+				}
+			}()
+			preflight.RegisterStep(s)
+		}()
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	old := ui.Default()
+	defer ui.SetDefault(old)
+
+	took := false
+	steps := []preflight.Step{{
+		ID:      "replace",
+		Test:    func() error { return errors.New("invalid") },
+		Do:      func() error { took = true; return nil },
+		Confirm: func() string { return "Replace?" },
+	}}
+
+	for _, tt := range []struct {
+		answer string
+		yes    bool
+		want   string
+	}{
+		{"n\n", false, "declined"},
+		{"", false, "declined"},
+		{"", true, "ran"},
+		{"y\n", false, "ran"},
+	} {
+		var prompts bytes.Buffer
+		ui.SetDefault(ui.New(io.Discard, &prompts, ui.Options{Input: strings.NewReader(tt.answer), AssumeYes: tt.yes}))
+		took = false
+
+		var b bytes.Buffer
+		(&preflight.Runner{JSON: &b}).Run(steps)
+
+		var r preflight.Result
+		if err := json.NewDecoder(&b).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Action != tt.want || took != (tt.want == "ran") {
+			t.Errorf("answer %q, -yes %v: %+v, took %v", tt.answer, tt.yes, r, took)
+		}
+		if asked := strings.Contains(prompts.String(), "Replace?"); asked == tt.yes {
+			t.Errorf("answer %q, -yes %v: prompts %q", tt.answer, tt.yes, prompts.String())
+		}
+	}
+}
@@ -0,0 +1,681 @@
+// Package filesync makes a directory tree, the destination, match
+// another, the source, by the content of its files, sending only what the
+// destination lacks.
+//
+// Both trees are scanned into a Manifest, which holds the SHA-256 of
+// every file, and for the destination, of every block of BlockSize bytes
+// of its files. Plan compares the manifests, and Send writes the changes
+// as a stream of frames, in which a block of a file the destination has in
+// the version it replaces is copied rather than sent. A Receiver applies
+// the frames to the destination, receiving every file into a partial file
+// renamed over the file once its SHA-256 is verified.
+//
+// The destination records the SHA-256 of the files as synced, in the file
+// StateFile at its root, so that a file changed there since, by hand or
+// otherwise, is a conflict, which a Policy settles. Rules exclude files
+// from both trees, which a sync neither changes nor deletes.
+package filesync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// BlockSize is the size of the blocks of files a sync copies from the
+// version of a file the destination has.
+const BlockSize = 64 << 10
+
+// Names of the files of a sync in the destination, which scans skip.
+const (
+	// StateFile, at the root of the destination, records the SHA-256 of
+	// the files as synced.
+	StateFile = ".nihsync"
+
+	// PartSuffix is appended to the name of a file being received.
+	PartSuffix = ".nihpart"
+
+	// ConflictSuffix is appended to the name of a file the Backup policy
+	// kept.
+	ConflictSuffix = ".nihconflict"
+)
+
+// Rules select the files of a tree to sync by patterns of path.Match,
+// matched against the slash-separated path of a file relative to the root
+// of the tree, or against its base name for a pattern without a slash.
+type Rules struct {
+	// Include, if not empty, restricts the files synced to those matching
+	// one of its patterns. Directories are synced as they hold them.
+	Include []string `json:"include,omitempty"`
+
+	// Exclude skips the files and directories matching one of its
+	// patterns, and everything under such directories.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Check returns an error if a pattern of r is malformed.
+func (r *Rules) Check() error {
+	for _, p := range slices.Concat(r.Include, r.Exclude) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("filesync: invalid pattern %q", p)
+		}
+	}
+	return nil
+}
+
+// match reports whether p, or its base name for a pattern without a
+// slash, matches one of patterns.
+func match(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		name := p
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// An Entry is a file or directory of a manifest.
+type Entry struct {
+	// Path is the slash-separated path of the file relative to the root
+	// of its tree.
+	Path  string      `json:"path"`
+	IsDir bool        `json:"is_dir,omitempty"`
+	Mode  fs.FileMode `json:"mode"`
+	Size  int64       `json:"size,omitempty"`
+
+	// SHA256 is the SHA-256 of the content of the file, in hex.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Blocks are the SHA-256 of every block of the file, in hex, in the
+	// manifest of a destination.
+	Blocks []string `json:"blocks,omitempty"`
+}
+
+// A Manifest describes a tree.
+type Manifest struct {
+	// Entries are the files and directories of the tree, the root
+	// excluded, in path order.
+	Entries []Entry `json:"entries"`
+
+	// Synced records the SHA-256 of the files of a destination as the
+	// last sync left them, by path.
+	Synced map[string]string `json:"synced,omitempty"`
+}
+
+// lookup returns the entry of p in m, if any.
+func (m *Manifest) lookup(p string) (*Entry, bool) {
+	i, ok := slices.BinarySearchFunc(m.Entries, p, func(e Entry, p string) int {
+		return strings.Compare(e.Path, p)
+	})
+	if !ok {
+		return nil, false
+	}
+	return &m.Entries[i], true
+}
+
+// Scan returns the manifest of the tree at root, a directory, of the
+// regular files and directories the rules select; with blocks, its entries
+// have the SHA-256 of their blocks, and Synced is read from the state
+// file of root. The files of syncs are skipped, as are symbolic links,
+// which could lead a sync out of the tree. A root that does not exist has
+// an empty manifest.
+func Scan(root string, rules Rules, blocks bool) (*Manifest, error) {
+	m := &Manifest{Entries: []Entry{}}
+	if _, err := os.Stat(root); errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+
+	err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case rel == StateFile || strings.HasSuffix(rel, PartSuffix) || strings.HasSuffix(rel, ConflictSuffix):
+			return nil
+		case match(rules.Exclude, rel):
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			m.Entries = append(m.Entries, Entry{Path: rel, IsDir: true, Mode: fi.Mode().Perm()})
+		case fi.Mode().IsRegular() && (len(rules.Include) == 0 || match(rules.Include, rel)):
+			e := Entry{Path: rel, Mode: fi.Mode().Perm(), Size: fi.Size()}
+			if e.SHA256, e.Blocks, err = hashFile(name, blocks); err != nil {
+				return err
+			}
+			m.Entries = append(m.Entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rules.Include) > 0 {
+		m.Entries = pruneDirs(m.Entries)
+	}
+	// A walk is in the order of the names in every directory, which is not
+	// that of paths: "a-b" comes before "a/b".
+	slices.SortFunc(m.Entries, func(a, b Entry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	if blocks {
+		if m.Synced, err = readState(root); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// pruneDirs removes the directories of entries that hold no file.
+func pruneDirs(entries []Entry) []Entry {
+	full := make(map[string]bool)
+	for _, e := range entries {
+		if !e.IsDir {
+			for d := path.Dir(e.Path); d != "."; d = path.Dir(d) {
+				full[d] = true
+			}
+		}
+	}
+	return slices.DeleteFunc(entries, func(e Entry) bool {
+		return e.IsDir && !full[e.Path]
+	})
+}
+
+// hashFile returns the SHA-256 of the file name, and with blocks, those of
+// its blocks.
+func hashFile(name string, blocks bool) (string, []string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if !blocks {
+		if _, err := io.Copy(h, f); err != nil {
+			return "", nil, err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil, nil
+	}
+
+	var sums []string
+	buf := make([]byte, BlockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			sum := sha256.Sum256(buf[:n])
+			sums = append(sums, hex.EncodeToString(sum[:]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hex.EncodeToString(h.Sum(nil)), sums, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// readState returns the SHA-256 of the files of the destination at root
+// as synced.
+func readState(root string) (map[string]string, error) {
+	data, err := os.ReadFile(filepath.Join(root, StateFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var synced map[string]string
+	if err := json.Unmarshal(data, &synced); err != nil {
+		return nil, fmt.Errorf("filesync: %s: %w", filepath.Join(root, StateFile), err)
+	}
+	if synced == nil {
+		synced = map[string]string{}
+	}
+	return synced, nil
+}
+
+// An Op is an operation of a change, or of a frame.
+type Op string
+
+const (
+	Mkdir  Op = "mkdir"
+	Write  Op = "write"
+	Chmod  Op = "chmod"
+	Delete Op = "delete"
+
+	// Record records the SHA-256 of a file the destination has as synced.
+	Record Op = "record"
+
+	// Data and Copy write the next bytes of the file being received: the
+	// data of the frame, or bytes of the version of the file the
+	// destination has. Commit renames it over the file once received.
+	Data   Op = "data"
+	Copy   Op = "copy"
+	Commit Op = "commit"
+)
+
+// A Conflict is why a change would lose a change of the destination.
+type Conflict string
+
+const (
+	// Changed is the conflict of a file of the destination that is not as
+	// the last sync left it.
+	Changed Conflict = "changed"
+
+	// Kind is the conflict of a file of the destination where the source
+	// has a directory, or the other way round, which no policy settles.
+	Kind Conflict = "kind"
+)
+
+// A Change is a change of the destination to match the source.
+type Change struct {
+	Op       Op       `json:"op"`
+	Path     string   `json:"path"`
+	Conflict Conflict `json:"conflict,omitempty"`
+}
+
+// Plan returns the changes making dst, the manifest of a destination,
+// match src: directories created before their files, and with del, the
+// files and directories src does not have deleted, after their contents.
+func Plan(src, dst *Manifest, del bool) []Change {
+	var changes []Change
+	changed := func(d *Entry) Conflict {
+		if !d.IsDir && dst.Synced[d.Path] != d.SHA256 {
+			return Changed
+		}
+		return ""
+	}
+
+	for _, s := range src.Entries {
+		d, ok := dst.lookup(s.Path)
+		switch {
+		case !ok && s.IsDir:
+			changes = append(changes, Change{Op: Mkdir, Path: s.Path})
+		case !ok:
+			changes = append(changes, Change{Op: Write, Path: s.Path})
+		case s.IsDir != d.IsDir:
+			changes = append(changes, Change{Op: Write, Path: s.Path, Conflict: Kind})
+		case !s.IsDir && s.SHA256 != d.SHA256:
+			changes = append(changes, Change{Op: Write, Path: s.Path, Conflict: changed(d)})
+		case s.Mode != d.Mode:
+			changes = append(changes, Change{Op: Chmod, Path: s.Path})
+		case !s.IsDir && dst.Synced[s.Path] != s.SHA256:
+			changes = append(changes, Change{Op: Record, Path: s.Path})
+		}
+	}
+
+	if del {
+		for _, d := range slices.Backward(dst.Entries) {
+			if _, ok := src.lookup(d.Path); !ok {
+				changes = append(changes, Change{Op: Delete, Path: d.Path, Conflict: changed(&d)})
+			}
+		}
+	}
+	return changes
+}
+
+// A Policy settles the conflicts of changes that would lose a change of
+// the destination.
+type Policy string
+
+const (
+	// Skip skips the change, keeping the file of the destination.
+	Skip Policy = "skip"
+
+	// Overwrite makes the change, losing the file of the destination.
+	Overwrite Policy = "overwrite"
+
+	// Backup renames the file of the destination to its name with
+	// ConflictSuffix, then makes the change.
+	Backup Policy = "backup"
+)
+
+// ParsePolicy returns the policy named s.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case Skip, Overwrite, Backup:
+		return p, nil
+	}
+	return "", fmt.Errorf("filesync: unknown conflict policy %q, want skip, overwrite, or backup", s)
+}
+
+// A Frame is a message of the stream of a sync to its destination.
+type Frame struct {
+	Op   Op     `json:"op"`
+	Path string `json:"path,omitempty"`
+
+	// Mode is the mode of a directory made, or a file committed or
+	// changed.
+	Mode fs.FileMode `json:"mode,omitempty"`
+
+	// Data are the bytes of a Data frame.
+	Data []byte `json:"data,omitempty"`
+
+	// Offset and Length are the bytes a Copy frame copies from the
+	// version of the file the destination has.
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+
+	// SHA256 is the SHA-256 of the file of a Commit or Record frame.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Backup has a Commit or Delete frame keep the file of the
+	// destination under its name with ConflictSuffix.
+	Backup bool `json:"backup,omitempty"`
+}
+
+// Stats count the work of a sync.
+type Stats struct {
+	Dirs    int `json:"dirs"`
+	Files   int `json:"files"`
+	Deleted int `json:"deleted"`
+
+	// Sent is the number of bytes of files sent, and Reused, of those
+	// copied from the versions the destination had.
+	Sent   int64 `json:"sent"`
+	Reused int64 `json:"reused"`
+
+	// Conflicts are the paths of the changes skipped for their conflicts.
+	Conflicts []string `json:"conflicts,omitempty"`
+}
+
+// Send sends the frames of changes, between the tree at root, the source
+// of src, and the destination of dst, to emit, settling their conflicts
+// by policy, and returns its stats.
+func Send(root string, src, dst *Manifest, changes []Change, policy Policy, emit func(*Frame) error) (*Stats, error) {
+	st := &Stats{}
+	for _, c := range changes {
+		if c.Conflict == Kind || c.Conflict == Changed && policy == Skip {
+			st.Conflicts = append(st.Conflicts, c.Path)
+			continue
+		}
+		backup := c.Conflict == Changed && policy == Backup
+
+		s, _ := src.lookup(c.Path)
+		var err error
+		switch c.Op {
+		case Mkdir:
+			st.Dirs++
+			err = emit(&Frame{Op: Mkdir, Path: c.Path, Mode: s.Mode})
+		case Chmod:
+			err = emit(&Frame{Op: Chmod, Path: c.Path, Mode: s.Mode})
+		case Record:
+			err = emit(&Frame{Op: Record, Path: c.Path, SHA256: s.SHA256})
+		case Delete:
+			st.Deleted++
+			err = emit(&Frame{Op: Delete, Path: c.Path, Backup: backup})
+		case Write:
+			st.Files++
+			d, _ := dst.lookup(c.Path)
+			err = sendFile(filepath.Join(root, filepath.FromSlash(c.Path)), s, d, st, emit)
+			if err == nil {
+				err = emit(&Frame{Op: Commit, Path: c.Path, Mode: s.Mode, SHA256: s.SHA256, Backup: backup})
+			}
+		}
+		if err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+// sendFile sends the data of the file name of the entry s, copying the
+// blocks of the version old of the destination, if not nil, it has.
+func sendFile(name string, s, old *Entry, st *Stats, emit func(*Frame) error) error {
+	have := make(map[string]int64)
+	if old != nil {
+		for i, sum := range old.Blocks {
+			if _, ok := have[sum]; !ok {
+				have[sum] = int64(i) * BlockSize
+			}
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, BlockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			if offset, ok := have[hex.EncodeToString(sum[:])]; ok {
+				st.Reused += int64(n)
+				if err := emit(&Frame{Op: Copy, Path: s.Path, Offset: offset, Length: int64(n)}); err != nil {
+					return err
+				}
+			} else {
+				st.Sent += int64(n)
+				if err := emit(&Frame{Op: Data, Path: s.Path, Data: buf[:n]}); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ErrInvalidFrame is the error of a frame a Receiver cannot apply, such as
+// one of a path out of its tree, or the commit of a file whose SHA-256 is
+// not that received.
+var ErrInvalidFrame = errors.New("filesync: invalid frame")
+
+// A Receiver applies the frames of a sync to its destination.
+type Receiver struct {
+	root   string
+	synced map[string]string
+
+	// part is the partial file of the file being received, of path.
+	part *os.File
+	path string
+}
+
+// NewReceiver returns a receiver of the frames of a sync to the tree at
+// root, created if need be.
+func NewReceiver(root string) (*Receiver, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	synced, err := readState(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Receiver{root: root, synced: synced}, nil
+}
+
+// name returns the name of the file of p, a path of a frame, under the
+// root of r.
+func (r *Receiver) name(p string) (string, error) {
+	if p == "" || p != path.Clean(p) || !filepath.IsLocal(filepath.FromSlash(p)) || path.Base(p) == StateFile {
+		return "", fmt.Errorf("%w: invalid path %q", ErrInvalidFrame, p)
+	}
+	return filepath.Join(r.root, filepath.FromSlash(p)), nil
+}
+
+// Apply applies f to the destination.
+func (r *Receiver) Apply(f *Frame) error {
+	name, err := r.name(f.Path)
+	if err != nil {
+		return err
+	}
+	if r.part != nil && (f.Path != r.path || f.Op != Data && f.Op != Copy && f.Op != Commit) {
+		return fmt.Errorf("%w: %s before %s was committed", ErrInvalidFrame, f.Op, r.path)
+	}
+
+	switch f.Op {
+	case Mkdir:
+		return os.MkdirAll(name, f.Mode.Perm())
+	case Chmod:
+		return os.Chmod(name, f.Mode.Perm())
+	case Record:
+		r.synced[f.Path] = f.SHA256
+		return nil
+	case Delete:
+		return r.delete(name, f)
+	case Data, Copy:
+		if r.part == nil {
+			if r.part, err = os.OpenFile(name+PartSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+				return err
+			}
+			r.path = f.Path
+		}
+		if f.Op == Data {
+			_, err = r.part.Write(f.Data)
+			return err
+		}
+		return r.copy(name, f)
+	case Commit:
+		return r.commit(name, f)
+	}
+	return fmt.Errorf("%w: unknown op %q", ErrInvalidFrame, f.Op)
+}
+
+// copy copies the bytes of f from the file name to the partial file.
+func (r *Receiver) copy(name string, f *Frame) error {
+	old, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	if f.Length < 0 || f.Length > BlockSize {
+		return fmt.Errorf("%w: copy of %d bytes", ErrInvalidFrame, f.Length)
+	}
+	_, err = io.Copy(r.part, io.NewSectionReader(old, f.Offset, f.Length))
+	return err
+}
+
+// commit verifies the partial file against f, and renames it over the
+// file name.
+func (r *Receiver) commit(name string, f *Frame) error {
+	part := name + PartSuffix
+	if r.part == nil {
+		// An empty file.
+		var err error
+		if r.part, err = os.Create(part); err != nil {
+			return err
+		}
+	}
+	err := r.part.Close()
+	r.part = nil
+	if err != nil {
+		return err
+	}
+
+	sum, _, err := hashFile(part, false)
+	if err != nil {
+		return err
+	}
+	if sum != f.SHA256 {
+		os.Remove(part)
+		return fmt.Errorf("%w: %s: SHA-256 mismatch: received %s", ErrInvalidFrame, f.Path, sum)
+	}
+	if err := os.Chmod(part, f.Mode.Perm()); err != nil {
+		return err
+	}
+	if f.Backup {
+		if err := os.Rename(name, name+ConflictSuffix); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(part, name); err != nil {
+		return err
+	}
+	r.synced[f.Path] = f.SHA256
+	return nil
+}
+
+// delete deletes the file or directory name of f. A directory is only
+// deleted once empty, as it may hold files the sync skipped.
+func (r *Receiver) delete(name string, f *Frame) error {
+	fi, err := os.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	delete(r.synced, f.Path)
+
+	if fi.IsDir() {
+		if entries, err := os.ReadDir(name); err != nil || len(entries) > 0 {
+			return err
+		}
+		return os.Remove(name)
+	}
+	if f.Backup {
+		return os.Rename(name, name+ConflictSuffix)
+	}
+	return os.Remove(name)
+}
+
+// Close ends the sync, removing the partial file of a file not committed,
+// and records the files of the destination as synced.
+func (r *Receiver) Close() error {
+	if r.part != nil {
+		r.part.Close()
+		os.Remove(r.part.Name())
+		r.part = nil
+	}
+
+	// The paths of the files that are no more, as those removed by hand.
+	for p := range r.synced {
+		if fi, err := os.Stat(filepath.Join(r.root, filepath.FromSlash(p))); err != nil || fi.IsDir() {
+			delete(r.synced, p)
+		}
+	}
+	data, err := json.MarshalIndent(r.synced, "", "\t")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(r.root, StateFile)
+	tmp, err := os.CreateTemp(r.root, StateFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,173 @@
+package filesync_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"nih.software/filesync"
+)
+
+func write(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sync syncs src to dst as over a connection, through frames encoded
+// apart from their buffers.
+func sync(t *testing.T, src, dst string, rules filesync.Rules, policy filesync.Policy, del bool) *filesync.Stats {
+	t.Helper()
+	sm, err := filesync.Scan(src, rules, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm, err := filesync.Scan(dst, rules, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rcv, err := filesync.NewReceiver(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := filesync.Send(src, sm, dm, filesync.Plan(sm, dm, del), policy, func(f *filesync.Frame) error {
+		g := *f
+		g.Data = bytes.Clone(f.Data)
+		return rcv.Apply(&g)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rcv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func read(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSync(t *testing.T) {
+	src, dst := filepath.Join(t.TempDir(), "src"), filepath.Join(t.TempDir(), "dst")
+	big := bytes.Repeat([]byte("0123456789abcdef"), 4*filesync.BlockSize/16+100)
+	write(t, filepath.Join(src, "a.txt"), []byte("a\n"))
+	write(t, filepath.Join(src, "sub/big.bin"), big)
+	write(t, filepath.Join(src, "sub/empty"), nil)
+	write(t, filepath.Join(src, "app.log"), []byte("log\n"))
+
+	rules := filesync.Rules{Exclude: []string{"*.log"}}
+	st := sync(t, src, dst, rules, filesync.Skip, false)
+	if st.Files != 3 || st.Dirs != 1 || st.Sent != int64(len(big))+2 || st.Reused != 0 {
+		t.Errorf("first sync: %+v", st)
+	}
+	if read(t, filepath.Join(dst, "sub/big.bin")) != string(big) || read(t, filepath.Join(dst, "sub/empty")) != "" {
+		t.Error("first sync: files differ")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "app.log")); err == nil {
+		t.Error("excluded file synced")
+	}
+
+	// Nothing to do.
+	if st := sync(t, src, dst, rules, filesync.Skip, false); st.Files != 0 || st.Sent != 0 {
+		t.Errorf("second sync: %+v", st)
+	}
+
+	// A changed block is sent, the others copied.
+	big[filesync.BlockSize+1] = 'x'
+	write(t, filepath.Join(src, "sub/big.bin"), big)
+	st = sync(t, src, dst, rules, filesync.Skip, false)
+	if st.Files != 1 || st.Sent != filesync.BlockSize || st.Reused != int64(len(big))-filesync.BlockSize {
+		t.Errorf("delta sync: %+v", st)
+	}
+	if read(t, filepath.Join(dst, "sub/big.bin")) != string(big) {
+		t.Error("delta sync: file differs")
+	}
+
+	// A file changed in the destination is a conflict.
+	write(t, filepath.Join(dst, "a.txt"), []byte("mine\n"))
+	write(t, filepath.Join(src, "a.txt"), []byte("theirs\n"))
+	st = sync(t, src, dst, rules, filesync.Skip, false)
+	if !slices.Equal(st.Conflicts, []string{"a.txt"}) || read(t, filepath.Join(dst, "a.txt")) != "mine\n" {
+		t.Errorf("skip: %+v", st)
+	}
+	st = sync(t, src, dst, rules, filesync.Backup, false)
+	if len(st.Conflicts) != 0 || read(t, filepath.Join(dst, "a.txt")) != "theirs\n" ||
+		read(t, filepath.Join(dst, "a.txt"+filesync.ConflictSuffix)) != "mine\n" {
+		t.Errorf("backup: %+v", st)
+	}
+
+	// A file as synced is no conflict: the source changes it again.
+	write(t, filepath.Join(src, "a.txt"), []byte("again\n"))
+	if st := sync(t, src, dst, rules, filesync.Skip, false); len(st.Conflicts) != 0 || read(t, filepath.Join(dst, "a.txt")) != "again\n" {
+		t.Errorf("resync: %+v", st)
+	}
+
+	// Deletes leave the excluded files, and the directories holding them.
+	write(t, filepath.Join(dst, "sub/keep.log"), []byte("keep\n"))
+	write(t, filepath.Join(dst, "extra/x"), []byte("x\n"))
+	if err := os.RemoveAll(filepath.Join(src, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	st = sync(t, src, dst, rules, filesync.Overwrite, true)
+	if st.Deleted != 5 || len(st.Conflicts) != 0 {
+		t.Errorf("delete: %+v", st)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "extra")); err == nil {
+		t.Error("delete: extra not deleted")
+	}
+	if read(t, filepath.Join(dst, "sub/keep.log")) != "keep\n" {
+		t.Error("delete: excluded file deleted")
+	}
+}
+
+func TestSyncInclude(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	write(t, filepath.Join(src, "conf/app.yaml"), []byte("a: 1\n"))
+	write(t, filepath.Join(src, "conf/notes.txt"), []byte("notes\n"))
+	write(t, filepath.Join(src, "docs/readme.txt"), []byte("readme\n"))
+
+	st := sync(t, src, dst, filesync.Rules{Include: []string{"*.yaml"}}, filesync.Skip, false)
+	if st.Files != 1 || st.Dirs != 1 {
+		t.Errorf("stats: %+v", st)
+	}
+	for _, name := range []string{"conf/notes.txt", "docs"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err == nil {
+			t.Errorf("%s synced", name)
+		}
+	}
+}
+
+func TestReceiverPaths(t *testing.T) {
+	rcv, err := filesync.NewReceiver(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rcv.Close()
+
+	for _, p := range []string{"", "../x", "/etc/passwd", "a/../../x", "a//b", filesync.StateFile} {
+		if err := rcv.Apply(&filesync.Frame{Op: filesync.Mkdir, Path: p, Mode: 0755}); err == nil {
+			t.Errorf("%q: applied", p)
+		}
+	}
+
+	if err := rcv.Apply(&filesync.Frame{Op: filesync.Data, Path: "f", Data: []byte("x")}); err != nil {
+		t.Fatal(err)
+	}
+	err = rcv.Apply(&filesync.Frame{Op: filesync.Commit, Path: "f", Mode: 0644, SHA256: "00"})
+	if err == nil {
+		t.Error("commit with wrong SHA-256 applied")
+	}
+}
@@ -4,4 +4,4 @@ go 1.23.0
 
 require golang.org/x/term v0.24.0
 
-require golang.org/x/sys v0.25.0 // indirect
+require golang.org/x/sys v0.25.0
@@ -0,0 +1,643 @@
+// Package gossip keeps the membership of a cluster of nodes by gossip, in
+// the manner of SWIM (Das, Gupta, and Motivala, 2002), so that every node
+// learns of the nodes that join, leave, and fail without a central
+// registry.
+//
+// Every Interval, a Node pings one of the members, going round all of
+// them in a random order. If the member does not answer within Timeout,
+// the node asks IndirectChecks other members to ping it in its stead, so
+// that a link failing between two nodes does not fail a member the others
+// reach. A member none of them reaches is suspect, and dead once it has
+// been suspect for SuspectTimeout, unless it refutes the suspicion in the
+// meantime: a node that learns it is suspected announces itself alive
+// again with a higher incarnation number, which overrides the suspicion.
+//
+// The changes of members ride along the pings and their answers, each a
+// few times the logarithm of the size of the cluster, which spreads them
+// to every node in a number of rounds growing with that logarithm. A node
+// joining exchanges the whole membership with a node it knows, as every
+// node does with a random member every SyncInterval, to mend what gossip
+// missed.
+//
+// Every message carries the timestamp of the hybrid logical clock of its
+// sender, which the receiver updates its own with, so that the events the
+// nodes stamp with their clocks are in an order consistent with gossip.
+//
+// Nodes exchange their messages over a Transport, such as the RPC methods
+// of package daemon, which also checks that a node speaks for itself only.
+package gossip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"nih.software/hlc"
+	"nih.software/log"
+)
+
+// Defaults of a Config.
+const (
+	DefaultInterval       = time.Second
+	DefaultTimeout        = 500 * time.Millisecond
+	DefaultIndirectChecks = 3
+	DefaultSuspectTimeout = 5 * time.Second
+	DefaultSyncInterval   = 30 * time.Second
+	DefaultForgetAfter    = time.Hour
+)
+
+// retransmitMult is how many times a change rides along messages, times
+// the number of bits of the size of the cluster.
+const retransmitMult = 3
+
+// maxUpdates bounds the changes a message carries along.
+const maxUpdates = 32
+
+// A State is the state of a member.
+type State string
+
+// States of members, each overriding the ones before it at the same
+// incarnation.
+const (
+	// Alive is a member that answers, directly or through others.
+	Alive State = "alive"
+
+	// Suspect is a member that failed to answer, which is dead unless it
+	// refutes the suspicion within the suspect timeout.
+	Suspect State = "suspect"
+
+	// Dead is a member that stayed suspect for the suspect timeout.
+	Dead State = "dead"
+
+	// Left is a member that left the cluster.
+	Left State = "left"
+)
+
+func (s State) valid() bool {
+	return s == Alive || s == Suspect || s == Dead || s == Left
+}
+
+func (s State) rank() int {
+	switch s {
+	case Alive:
+		return 0
+	case Suspect:
+		return 1
+	case Dead:
+		return 2
+	}
+	return 3
+}
+
+// A Member is a node of the cluster, as a node knows it.
+type Member struct {
+	// Name is the name of the node, unique in the cluster, such as the
+	// common name of its certificate.
+	Name string `json:"name"`
+
+	// Addr is the address the node is reached at.
+	Addr string `json:"addr"`
+
+	State State `json:"state"`
+
+	// Incarnation orders the states of the node: only the node itself
+	// increments it, to refute that it is suspect or dead.
+	Incarnation uint64 `json:"incarnation"`
+
+	// Since is when the node keeping the member learned of its state.
+	// It is not gossiped.
+	Since time.Time `json:"since" wire:"-"`
+}
+
+// supersedes reports whether m is news to a node that knows old.
+func (m Member) supersedes(old Member) bool {
+	if m.Incarnation != old.Incarnation {
+		return m.Incarnation > old.Incarnation
+	}
+	return m.State.rank() > old.State.rank()
+}
+
+// A Message is what nodes send each other: a ping, its answer, or the
+// whole membership of a node as they join and sync.
+type Message struct {
+	// From is the node sending the message, as it knows itself.
+	From Member `json:"from"`
+
+	// Updates are the changes of members the message carries along, or
+	// the whole membership.
+	Updates []Member `json:"updates,omitempty"`
+
+	// Time is the time of the clock of the sender as it sent the message.
+	Time hlc.Timestamp `json:"time"`
+}
+
+// A Transport carries messages between nodes. Its methods deliver a
+// message to the node of to, as it is known, and return the answer of
+// that node. If to has a name, the transport fails unless the node
+// answering is that of the name.
+type Transport interface {
+	// Ping delivers m to the Node.HandlePing of to.
+	Ping(ctx context.Context, to Member, m *Message) (*Message, error)
+
+	// PingReq delivers m to the Node.HandlePingReq of via, asking it to
+	// ping target.
+	PingReq(ctx context.Context, via, target Member, m *Message) (*Message, error)
+
+	// Sync delivers m to the Node.HandleSync of to.
+	Sync(ctx context.Context, to Member, m *Message) (*Message, error)
+}
+
+// Config configures a Node. Name, Addr, and Transport are required; the
+// durations and counts are their default if zero.
+type Config struct {
+	// Name is the name of the node.
+	Name string
+
+	// Addr is the address the other nodes reach the node at.
+	Addr string
+
+	Transport Transport
+
+	// Interval is the time between pings of members.
+	Interval time.Duration
+
+	// Timeout bounds the wait for the answer of a ping.
+	Timeout time.Duration
+
+	// IndirectChecks is the number of members asked to ping a member
+	// that failed to answer.
+	IndirectChecks int
+
+	// SuspectTimeout is the time a member stays suspect before it is
+	// dead.
+	SuspectTimeout time.Duration
+
+	// SyncInterval is the time between exchanges of the whole membership
+	// with a random member.
+	SyncInterval time.Duration
+
+	// ForgetAfter is the time dead members, and those that left, are
+	// kept before they are forgotten.
+	ForgetAfter time.Duration
+
+	// Notify, if not nil, is called with every member of a new state,
+	// once the node has learned of it.
+	Notify func(Member)
+
+	// Clock, if not nil, is the clock of the node, which stamps its
+	// messages and is updated with those of others, instead of a clock
+	// of its own.
+	Clock *hlc.Clock
+}
+
+// A broadcast is a change of a member to carry along messages.
+type broadcast struct {
+	m    Member
+	sent int
+}
+
+// A Node is a member of a cluster, keeping its membership.
+type Node struct {
+	cfg Config
+
+	mu      sync.Mutex
+	self    Member
+	members map[string]*Member // but self
+	queue   map[string]*broadcast
+	leaving bool
+
+	// order is the order members are pinged in, up to next.
+	order []string
+	next  int
+}
+
+// New returns a node of cfg, alone in its cluster until it joins others
+// or others join it.
+func New(cfg Config) (*Node, error) {
+	if cfg.Name == "" || cfg.Addr == "" || cfg.Transport == nil {
+		return nil, errors.New("gossip: a node needs a name, an address, and a transport")
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.IndirectChecks == 0 {
+		cfg.IndirectChecks = DefaultIndirectChecks
+	}
+	if cfg.SuspectTimeout == 0 {
+		cfg.SuspectTimeout = DefaultSuspectTimeout
+	}
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = DefaultSyncInterval
+	}
+	if cfg.ForgetAfter == 0 {
+		cfg.ForgetAfter = DefaultForgetAfter
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = &hlc.Clock{}
+	}
+
+	return &Node{
+		cfg:     cfg,
+		self:    Member{Name: cfg.Name, Addr: cfg.Addr, State: Alive, Since: time.Now()},
+		members: make(map[string]*Member),
+		queue:   make(map[string]*broadcast),
+	}, nil
+}
+
+// Local returns the node as a member.
+func (n *Node) Local() Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.self
+}
+
+// Members returns the members the node knows, itself included, in name
+// order.
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ms := []Member{n.self}
+	for _, m := range n.members {
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+	return ms
+}
+
+// Alive returns the number of members alive or suspect, itself left out.
+func (n *Node) Alive() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	count := 0
+	for _, m := range n.members {
+		if m.State == Alive || m.State == Suspect {
+			count++
+		}
+	}
+	return count
+}
+
+// Run pings members, declares those that fail dead, and syncs with a random
+// member every SyncInterval, until ctx is done or the node leaves.
+func (n *Node) Run(ctx context.Context) {
+	probe := time.NewTicker(n.cfg.Interval)
+	defer probe.Stop()
+	resync := time.NewTicker(n.cfg.SyncInterval)
+	defer resync.Stop()
+
+	for {
+		select {
+		case <-probe.C:
+			n.probe(ctx)
+			n.expire()
+		case <-resync.C:
+			n.sync(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Join exchanges the whole membership with the nodes at addrs, and returns
+// the number of them that answered. It fails if none did.
+func (n *Node) Join(ctx context.Context, addrs ...string) (int, error) {
+	var joined int
+	var err error
+	for _, addr := range addrs {
+		var reply *Message
+		reply, err = n.cfg.Transport.Sync(ctx, Member{Addr: addr}, n.full())
+		if err != nil {
+			log.Default().Debug("gossip: join", "addr", addr, "err", err)
+			continue
+		}
+		n.receive(reply)
+		joined++
+	}
+	if joined == 0 && err != nil {
+		return 0, fmt.Errorf("gossip: join: %w", err)
+	}
+	return joined, nil
+}
+
+// Leave announces that the node leaves the cluster to some of its members,
+// and stops it pinging members. It fails if it reached none of them.
+func (n *Node) Leave(ctx context.Context) error {
+	n.mu.Lock()
+	n.leaving = true
+	n.self.State = Left
+	n.self.Since = time.Now()
+	n.enqueue(n.self)
+	targets := n.random(max(n.cfg.IndirectChecks, 1), "")
+	n.mu.Unlock()
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	errc := make(chan error, len(targets))
+	for _, m := range targets {
+		go func() {
+			_, err := n.cfg.Transport.Ping(ctx, m, n.message())
+			errc <- err
+		}()
+	}
+	var err error
+	reached := false
+	for range targets {
+		if e := <-errc; e == nil {
+			reached = true
+		} else {
+			err = e
+		}
+	}
+	if !reached {
+		return fmt.Errorf("gossip: leave: %w", err)
+	}
+	return nil
+}
+
+// HandlePing handles a ping from another node, and returns the answer.
+func (n *Node) HandlePing(m *Message) *Message {
+	n.receive(m)
+	return n.message()
+}
+
+// HandlePingReq handles the request of another node to ping target, and
+// returns the answer of target.
+func (n *Node) HandlePingReq(ctx context.Context, target Member, m *Message) (*Message, error) {
+	n.receive(m)
+
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.Timeout)
+	defer cancel()
+	reply, err := n.cfg.Transport.Ping(ctx, target, n.message())
+	if err != nil {
+		return nil, err
+	}
+	n.receive(reply)
+	return reply, nil
+}
+
+// HandleSync handles the whole membership of another node, and returns
+// its own.
+func (n *Node) HandleSync(m *Message) *Message {
+	n.receive(m)
+	return n.full()
+}
+
+// probe pings the next member, through others if it fails to answer, and
+// suspects it if none of them reaches it.
+func (n *Node) probe(ctx context.Context) {
+	n.mu.Lock()
+	if n.leaving {
+		n.mu.Unlock()
+		return
+	}
+	target, ok := n.nextTarget()
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, n.cfg.Timeout)
+	reply, err := n.cfg.Transport.Ping(pctx, target, n.message())
+	cancel()
+	if err == nil {
+		n.receive(reply)
+		return
+	}
+	log.Default().Debug("gossip: ping failed", "member", target.Name, "err", err)
+
+	n.mu.Lock()
+	vias := n.random(n.cfg.IndirectChecks, target.Name)
+	n.mu.Unlock()
+
+	// The members asked wait up to Timeout for target themselves.
+	ictx, cancel := context.WithTimeout(ctx, 2*n.cfg.Timeout)
+	defer cancel()
+	acks := make(chan bool, len(vias))
+	for _, via := range vias {
+		go func() {
+			reply, err := n.cfg.Transport.PingReq(ictx, via, target, n.message())
+			if err != nil {
+				log.Default().Debug("gossip: indirect ping failed", "member", target.Name, "via", via.Name, "err", err)
+				acks <- false
+				return
+			}
+			n.receive(reply)
+			acks <- true
+		}()
+	}
+	for range vias {
+		if <-acks {
+			return
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	n.mu.Lock()
+	var changed []Member
+	if m, ok := n.members[target.Name]; ok && m.State == Alive {
+		changed = n.apply(Member{Name: m.Name, Addr: m.Addr, State: Suspect, Incarnation: m.Incarnation})
+	}
+	n.mu.Unlock()
+	n.notify(changed)
+}
+
+// expire declares dead the members that stayed suspect for the suspect
+// timeout, and forgets those dead or gone for ForgetAfter.
+func (n *Node) expire() {
+	n.mu.Lock()
+	now := time.Now()
+	var changed []Member
+	for name, m := range n.members {
+		switch {
+		case m.State == Suspect && now.Sub(m.Since) >= n.cfg.SuspectTimeout:
+			changed = append(changed, n.apply(Member{Name: m.Name, Addr: m.Addr, State: Dead, Incarnation: m.Incarnation})...)
+		case (m.State == Dead || m.State == Left) && now.Sub(m.Since) >= n.cfg.ForgetAfter:
+			delete(n.members, name)
+			delete(n.queue, name)
+		}
+	}
+	n.mu.Unlock()
+	n.notify(changed)
+}
+
+// sync exchanges the whole membership with a random member, dead ones
+// included, so that nodes find each other again after a partition heals.
+func (n *Node) sync(ctx context.Context) {
+	n.mu.Lock()
+	var candidates []Member
+	for _, m := range n.members {
+		if m.State != Left {
+			candidates = append(candidates, *m)
+		}
+	}
+	leaving := n.leaving
+	n.mu.Unlock()
+	if leaving || len(candidates) == 0 {
+		return
+	}
+
+	to := candidates[rand.IntN(len(candidates))]
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.Interval)
+	defer cancel()
+	reply, err := n.cfg.Transport.Sync(ctx, to, n.full())
+	if err != nil {
+		log.Default().Debug("gossip: sync failed", "member", to.Name, "err", err)
+		return
+	}
+	n.receive(reply)
+}
+
+// receive learns of the sender of m and of the changes it carries.
+func (n *Node) receive(m *Message) {
+	if _, err := n.cfg.Clock.Update(m.Time); err != nil {
+		log.Default().Warn("gossip: clock", "member", m.From.Name, "err", err)
+	}
+
+	n.mu.Lock()
+	var changed []Member
+	if m.From.Name != "" {
+		changed = n.apply(m.From)
+	}
+	for _, u := range m.Updates {
+		changed = append(changed, n.apply(u)...)
+	}
+	n.mu.Unlock()
+	n.notify(changed)
+}
+
+// apply learns of u if it is news, and returns it if the state of a
+// member changed. If u suspects the node itself, it refutes it.
+func (n *Node) apply(u Member) []Member {
+	if u.Name == "" || !u.State.valid() {
+		return nil
+	}
+
+	if u.Name == n.self.Name {
+		if !n.leaving && (u.Incarnation > n.self.Incarnation || u.Incarnation == n.self.Incarnation && u.State != Alive) {
+			n.self.Incarnation = u.Incarnation + 1
+			n.self.Since = time.Now()
+			n.enqueue(n.self)
+			log.Default().Debug("gossip: refuted", "state", u.State, "incarnation", n.self.Incarnation)
+		}
+		return nil
+	}
+
+	old, ok := n.members[u.Name]
+	switch {
+	case !ok && u.State != Alive:
+		// Not news of a member never known alive.
+		return nil
+	case ok && !u.supersedes(*old):
+		return nil
+	}
+
+	u.Since = time.Now()
+	n.members[u.Name] = &u
+	n.enqueue(u)
+	if ok && old.State == u.State {
+		return nil
+	}
+	return []Member{u}
+}
+
+// notify calls Config.Notify with the members changed, without n.mu held.
+func (n *Node) notify(changed []Member) {
+	for _, m := range changed {
+		log.Default().Debug("gossip: member", "name", m.Name, "addr", m.Addr, "state", m.State)
+		if n.cfg.Notify != nil {
+			n.cfg.Notify(m)
+		}
+	}
+}
+
+// enqueue has the change m carried along messages.
+func (n *Node) enqueue(m Member) {
+	n.queue[m.Name] = &broadcast{m: m}
+}
+
+// message returns a message from the node, carrying along the changes sent
+// the fewest times.
+func (n *Node) message() *Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	bs := make([]*broadcast, 0, len(n.queue))
+	for _, b := range n.queue {
+		bs = append(bs, b)
+	}
+	sort.Slice(bs, func(i, j int) bool {
+		if bs[i].sent != bs[j].sent {
+			return bs[i].sent < bs[j].sent
+		}
+		return bs[i].m.Name < bs[j].m.Name
+	})
+
+	limit := retransmitMult * bits.Len(uint(len(n.members)+1))
+	m := &Message{From: n.self, Time: n.cfg.Clock.Now()}
+	for _, b := range bs[:min(len(bs), maxUpdates)] {
+		m.Updates = append(m.Updates, b.m)
+		if b.sent++; b.sent >= limit {
+			delete(n.queue, b.m.Name)
+		}
+	}
+	return m
+}
+
+// full returns a message from the node carrying its whole membership.
+func (n *Node) full() *Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	m := &Message{From: n.self, Time: n.cfg.Clock.Now()}
+	for _, u := range n.members {
+		m.Updates = append(m.Updates, *u)
+	}
+	return m
+}
+
+// nextTarget returns the next member to ping, alive or suspect, going
+// round them in an order shuffled every time.
+func (n *Node) nextTarget() (Member, bool) {
+	for range 2 {
+		for ; n.next < len(n.order); n.next++ {
+			if m, ok := n.members[n.order[n.next]]; ok && (m.State == Alive || m.State == Suspect) {
+				n.next++
+				return *m, true
+			}
+		}
+
+		n.order = n.order[:0]
+		for name := range n.members {
+			n.order = append(n.order, name)
+		}
+		rand.Shuffle(len(n.order), func(i, j int) { n.order[i], n.order[j] = n.order[j], n.order[i] })
+		n.next = 0
+	}
+	return Member{}, false
+}
+
+// random returns up to k random members alive, but the one named except.
+func (n *Node) random(k int, except string) []Member {
+	var ms []Member
+	for _, m := range n.members {
+		if m.State == Alive && m.Name != except {
+			ms = append(ms, *m)
+		}
+	}
+	rand.Shuffle(len(ms), func(i, j int) { ms[i], ms[j] = ms[j], ms[i] })
+	return ms[:min(k, len(ms))]
+}
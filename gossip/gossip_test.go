@@ -0,0 +1,292 @@
+package gossip_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"nih.software/gossip"
+	"nih.software/hlc"
+)
+
+// network delivers messages between the nodes of a test in memory, but
+// not to nodes down or over links cut.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*gossip.Node
+	down  map[string]bool
+	cut   map[[2]string]bool
+}
+
+func newNetwork() *network {
+	return &network{
+		nodes: make(map[string]*gossip.Node),
+		down:  make(map[string]bool),
+		cut:   make(map[[2]string]bool),
+	}
+}
+
+// transport is the transport of the node at from.
+type transport struct {
+	net  *network
+	from string
+}
+
+func (t transport) node(to gossip.Member) (*gossip.Node, error) {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+
+	n := t.net.nodes[to.Addr]
+	if n == nil || t.net.down[to.Addr] || t.net.cut[[2]string{t.from, to.Addr}] || t.net.cut[[2]string{to.Addr, t.from}] {
+		return nil, errors.New("unreachable")
+	}
+	if to.Name != "" && n.Local().Name != to.Name {
+		return nil, fmt.Errorf("%s is not %s", to.Addr, to.Name)
+	}
+	return n, nil
+}
+
+func (t transport) Ping(ctx context.Context, to gossip.Member, m *gossip.Message) (*gossip.Message, error) {
+	n, err := t.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandlePing(m), nil
+}
+
+func (t transport) PingReq(ctx context.Context, via, target gossip.Member, m *gossip.Message) (*gossip.Message, error) {
+	n, err := t.node(via)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandlePingReq(ctx, target, m)
+}
+
+func (t transport) Sync(ctx context.Context, to gossip.Member, m *gossip.Message) (*gossip.Message, error) {
+	n, err := t.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleSync(m), nil
+}
+
+// events records the members notified to a node.
+type events struct {
+	mu sync.Mutex
+	ms []gossip.Member
+}
+
+func (e *events) add(m gossip.Member) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.ms = append(e.ms, m)
+}
+
+func (e *events) states(name string) []gossip.State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var states []gossip.State
+	for _, m := range e.ms {
+		if m.Name == name {
+			states = append(states, m.State)
+		}
+	}
+	return states
+}
+
+// start starts the node name on the network, running until the test ends
+// or the returned function is called.
+func (nw *network) start(t *testing.T, name string, ev *events) (*gossip.Node, func()) {
+	addr := name + ":7443"
+	cfg := gossip.Config{
+		Name:           name,
+		Addr:           addr,
+		Transport:      transport{net: nw, from: addr},
+		Interval:       5 * time.Millisecond,
+		Timeout:        20 * time.Millisecond,
+		SuspectTimeout: 100 * time.Millisecond,
+		SyncInterval:   50 * time.Millisecond,
+	}
+	if ev != nil {
+		cfg.Notify = ev.add
+	}
+	n, err := gossip.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nw.mu.Lock()
+	nw.nodes[addr] = n
+	delete(nw.down, addr)
+	nw.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.Run(ctx)
+	}()
+	stop := sync.OnceFunc(func() {
+		cancel()
+		<-done
+	})
+	t.Cleanup(stop)
+	return n, stop
+}
+
+func (nw *network) setDown(addr string, down bool) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.down[addr] = down
+}
+
+// state returns the state of the member name as n knows it, or "" if n
+// does not know it.
+func state(n *gossip.Node, name string) gossip.State {
+	for _, m := range n.Members() {
+		if m.Name == name {
+			return m.State
+		}
+	}
+	return ""
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	nw := newNetwork()
+	var ev events
+	a, _ := nw.start(t, "a", &ev)
+	b, _ := nw.start(t, "b", nil)
+	c, stopC := nw.start(t, "c", nil)
+
+	if _, err := b.Join(context.Background(), "a:7443"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Join(context.Background(), "nowhere:7443", "b:7443"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Join(context.Background(), "nowhere:7443"); err == nil {
+		t.Error("Join of nowhere succeeded")
+	}
+
+	// Every node learns of the others, c of a through b and a of c by gossip.
+	for _, n := range []*gossip.Node{a, b, c} {
+		waitFor(t, n.Local().Name+" to know all", func() bool {
+			return len(n.Members()) == 3 && n.Alive() == 2
+		})
+	}
+
+	// A node that fails is suspected, then found dead.
+	stopC()
+	nw.setDown("c:7443", true)
+	waitFor(t, "c to be dead", func() bool {
+		return state(a, "c") == gossip.Dead && state(b, "c") == gossip.Dead
+	})
+	if got := ev.states("c"); len(got) < 2 || got[0] != gossip.Alive || got[len(got)-1] != gossip.Dead {
+		t.Errorf("states of c notified: %v", got)
+	}
+
+	// Once restarted, it refutes its death with a higher incarnation.
+	c, _ = nw.start(t, "c", nil)
+	if _, err := c.Join(context.Background(), "a:7443"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "c to be alive again", func() bool {
+		return state(a, "c") == gossip.Alive && state(b, "c") == gossip.Alive
+	})
+	if inc := c.Local().Incarnation; inc == 0 {
+		t.Errorf("incarnation of c restarted = %d", inc)
+	}
+}
+
+func TestIndirect(t *testing.T) {
+	nw := newNetwork()
+	var ev events
+	a, _ := nw.start(t, "a", &ev)
+	b, _ := nw.start(t, "b", nil)
+	c, _ := nw.start(t, "c", nil)
+	b.Join(context.Background(), "a:7443")
+	c.Join(context.Background(), "a:7443")
+	for _, n := range []*gossip.Node{a, b, c} {
+		waitFor(t, n.Local().Name+" to know all", func() bool { return n.Alive() == 2 })
+	}
+
+	// Over a link cut between a and c, they reach each other through b.
+	nw.mu.Lock()
+	nw.cut[[2]string{"a:7443", "c:7443"}] = true
+	nw.mu.Unlock()
+	time.Sleep(300 * time.Millisecond)
+	if s := state(a, "c"); s != gossip.Alive {
+		t.Errorf("c is %s to a", s)
+	}
+	if s := state(c, "a"); s != gossip.Alive {
+		t.Errorf("a is %s to c", s)
+	}
+	if got := ev.states("c"); len(got) != 1 {
+		t.Errorf("states of c notified: %v", got)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	nw := newNetwork()
+	a, _ := nw.start(t, "a", nil)
+	b, stopB := nw.start(t, "b", nil)
+	if err := b.Leave(context.Background()); err != nil {
+		t.Errorf("Leave alone: %v", err)
+	}
+
+	b, stopB = nw.start(t, "b", nil)
+	b.Join(context.Background(), "a:7443")
+	waitFor(t, "a to know b", func() bool { return a.Alive() == 1 })
+
+	if err := b.Leave(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stopB()
+	if s := state(a, "b"); s != gossip.Left {
+		t.Errorf("b is %s after leaving", s)
+	}
+	if s := b.Local().State; s != gossip.Left {
+		t.Errorf("b is %s to itself after leaving", s)
+	}
+
+	// A node told it is suspect refutes it, but not once it left.
+	if inc := a.Local().Incarnation; inc != 0 {
+		t.Fatalf("incarnation of a = %d", inc)
+	}
+	a.HandlePing(&gossip.Message{Updates: []gossip.Member{{Name: "a", Addr: "a:7443", State: gossip.Suspect}}})
+	if m := a.Local(); m.Incarnation != 1 || m.State != gossip.Alive {
+		t.Errorf("a suspected is %+v", m)
+	}
+	b.HandlePing(&gossip.Message{Updates: []gossip.Member{{Name: "b", Addr: "b:7443", State: gossip.Suspect, Incarnation: 5}}})
+	if m := b.Local(); m.State != gossip.Left {
+		t.Errorf("b suspected after leaving is %+v", m)
+	}
+
+	// The answer of a node is stamped after the message it answers, even
+	// one from a clock ahead of its own.
+	ahead := hlc.Timestamp{Wall: time.Now().Add(time.Hour).UnixNano()}
+	if reply := a.HandlePing(&gossip.Message{Time: ahead}); !ahead.Before(reply.Time) {
+		t.Errorf("answer stamped %v, after a message stamped %v", reply.Time, ahead)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := gossip.New(gossip.Config{Name: "a", Addr: "a:7443"}); err == nil {
+		t.Error("New without a transport succeeded")
+	}
+}
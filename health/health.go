@@ -0,0 +1,305 @@
+// Package health checks the health of peers by pinging them over the
+// connections to them, at intervals jittered so that the pings of many
+// nodes do not fall in step.
+//
+// A ping is a request the application of the peer answers, unlike a TCP
+// keepalive, which the kernel of the peer answers even while the process
+// is wedged. A peer is healthy while it answers. One that fails to answer
+// in time may be slow rather than gone, so it is suspect until it failed
+// DownAfter pings in a row; one whose connection fails outright is down at
+// once. A Monitor calls its OnChange hook on every transition, so that its
+// user can react to peers going down and coming back.
+package health
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"nih.software/log"
+)
+
+// Defaults of a Monitor.
+const (
+	DefaultInterval  = 30 * time.Second
+	DefaultJitter    = 0.2
+	DefaultTimeout   = 10 * time.Second
+	DefaultDownAfter = 3
+)
+
+// A Status is the health of a peer.
+type Status string
+
+const (
+	// Unknown is a peer not pinged yet.
+	Unknown Status = "unknown"
+
+	// Healthy is a peer that answered its last ping.
+	Healthy Status = "healthy"
+
+	// Suspect is a peer that failed to answer its last pings in time, but
+	// fewer than DownAfter of them.
+	Suspect Status = "suspect"
+
+	// Down is a peer whose connection failed, or that failed to answer
+	// DownAfter pings in a row in time.
+	Down Status = "down"
+)
+
+// A Pinger pings a peer, over a connection it keeps to it.
+type Pinger interface {
+	// Ping returns once the peer answered, or fails. Errors that are
+	// timeouts, such as context.DeadlineExceeded, mean that the peer may
+	// only be slow.
+	Ping(ctx context.Context) error
+}
+
+// PingerFunc is a Pinger of a function.
+type PingerFunc func(ctx context.Context) error
+
+func (f PingerFunc) Ping(ctx context.Context) error {
+	return f(ctx)
+}
+
+// A Change is a transition of the health of a peer.
+type Change struct {
+	Peer     string
+	From, To Status
+
+	// Err is the error of the ping that made the peer suspect or down.
+	Err error
+}
+
+// PeerStatus is the health of a peer as a Monitor knows it.
+type PeerStatus struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+
+	// RTT is the round-trip time of the last ping the peer answered.
+	RTT time.Duration `json:"rtt_ns,omitempty"`
+
+	// LastOK is when the peer last answered a ping.
+	LastOK time.Time `json:"last_ok"`
+
+	// Failures is the number of pings the peer failed since it last
+	// answered one.
+	Failures int `json:"failures,omitempty"`
+
+	// Error is why the last ping failed.
+	Error string `json:"error,omitempty"`
+}
+
+type peer struct {
+	pinger Pinger
+	status PeerStatus
+	next   time.Time
+	busy   bool
+}
+
+// A Monitor pings the peers it watches, each every Interval, give or take
+// Jitter. The zero value is a monitor of the defaults.
+type Monitor struct {
+	// Interval is the time between pings of a peer.
+	Interval time.Duration
+
+	// Jitter is the fraction of Interval the time between pings varies
+	// by, either way, at random.
+	Jitter float64
+
+	// Timeout bounds every ping.
+	Timeout time.Duration
+
+	// DownAfter is the number of pings in a row a peer fails to answer in
+	// time before it is down.
+	DownAfter int
+
+	// OnChange, if not nil, is called with every transition, in the order
+	// they happen for each peer.
+	OnChange func(Change)
+
+	mu    sync.Mutex
+	peers map[string]*peer
+	wake  chan struct{}
+}
+
+// Watch has m ping the peer name with p, at once and then every interval,
+// replacing the pinger of a peer of the name watched already.
+func (m *Monitor) Watch(name string, p Pinger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.peers == nil {
+		m.peers = make(map[string]*peer)
+	}
+	m.peers[name] = &peer{pinger: p, status: PeerStatus{Name: name, Status: Unknown}}
+	m.signal()
+}
+
+// Forget stops m pinging the peer name.
+func (m *Monitor) Forget(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.peers, name)
+}
+
+// SetInterval changes the interval of the pings to come.
+func (m *Monitor) SetInterval(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Interval = d
+}
+
+// Status returns the health of the peer name, and whether m watches it.
+func (m *Monitor) Status(name string) (PeerStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.peers[name]
+	if !ok {
+		return PeerStatus{}, false
+	}
+	return p.status, true
+}
+
+// Peers returns the health of the peers m watches, in name order.
+func (m *Monitor) Peers() []PeerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ps := make([]PeerStatus, 0, len(m.peers))
+	for _, p := range m.peers {
+		ps = append(ps, p.status)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+	return ps
+}
+
+// Run pings the peers as they are due until ctx is done.
+func (m *Monitor) Run(ctx context.Context) {
+	m.mu.Lock()
+	m.signal()
+	m.mu.Unlock()
+
+	for {
+		m.mu.Lock()
+		now := time.Now()
+		wait := time.Hour
+		for name, p := range m.peers {
+			if p.busy {
+				continue
+			}
+			if d := p.next.Sub(now); d > 0 {
+				wait = min(wait, d)
+				continue
+			}
+			p.busy = true
+			go m.ping(ctx, name, p)
+		}
+		wake := m.wake
+		m.mu.Unlock()
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-wake:
+			t.Stop()
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// signal wakes Run to look for peers due. m.mu must be held.
+func (m *Monitor) signal() {
+	if m.wake == nil {
+		m.wake = make(chan struct{}, 1)
+	}
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ping pings the peer p of name and records the result.
+func (m *Monitor) ping(ctx context.Context, name string, p *peer) {
+	m.mu.Lock()
+	timeout := orDefault(m.Timeout, DefaultTimeout)
+	m.mu.Unlock()
+
+	pctx, cancel := context.WithTimeout(ctx, timeout)
+	start := time.Now()
+	err := p.pinger.Ping(pctx)
+	rtt := time.Since(start)
+	cancel()
+	if ctx.Err() != nil {
+		return
+	}
+
+	m.mu.Lock()
+	if m.peers[name] != p {
+		// Forgotten or replaced meanwhile.
+		m.mu.Unlock()
+		return
+	}
+
+	s := &p.status
+	from := s.Status
+	if err == nil {
+		s.Status, s.RTT, s.LastOK, s.Failures, s.Error = Healthy, rtt, time.Now(), 0, ""
+	} else {
+		s.Failures++
+		s.Error = err.Error()
+		switch {
+		case !timedOut(err) || s.Failures >= orDefault(m.DownAfter, DefaultDownAfter):
+			s.Status = Down
+		case from != Down:
+			s.Status = Suspect
+		}
+	}
+	to := s.Status
+
+	interval := float64(orDefault(m.Interval, DefaultInterval))
+	jitter := m.Jitter
+	if jitter == 0 {
+		jitter = DefaultJitter
+	}
+	p.next = time.Now().Add(time.Duration(interval * (1 + jitter*(2*rand.Float64()-1))))
+	onChange := m.OnChange
+	m.mu.Unlock()
+
+	if from != to {
+		log.Default().Debug("health: peer", "name", name, "from", from, "to", to, "err", err)
+		if onChange != nil {
+			onChange(Change{Peer: name, From: from, To: to, Err: err})
+		}
+	}
+
+	// The next ping waits for the hook, so that it sees the transitions
+	// of a peer in order.
+	m.mu.Lock()
+	p.busy = false
+	m.signal()
+	m.mu.Unlock()
+}
+
+// orDefault returns v, or def if v is zero.
+func orDefault[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
+
+// timedOut reports whether err is that of a ping that ran out of time.
+func timedOut(err error) bool {
+	var nerr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.As(err, &nerr) && nerr.Timeout()
+}
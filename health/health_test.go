@@ -0,0 +1,204 @@
+package health_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"nih.software/health"
+)
+
+// pinger answers pings as told by its err, or hangs while hang is set.
+type pinger struct {
+	mu    sync.Mutex
+	err   error
+	hang  bool
+	count int
+}
+
+func (p *pinger) set(err error, hang bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err, p.hang = err, hang
+}
+
+func (p *pinger) pings() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
+
+func (p *pinger) Ping(ctx context.Context) error {
+	p.mu.Lock()
+	p.count++
+	err, hang := p.err, p.hang
+	p.mu.Unlock()
+
+	if hang {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return err
+}
+
+// changes records the transitions a monitor calls its hook with.
+type changes struct {
+	mu sync.Mutex
+	cs []health.Change
+}
+
+func (c *changes) add(ch health.Change) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cs = append(c.cs, ch)
+}
+
+func (c *changes) to(name string) []health.Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var ss []health.Status
+	for _, ch := range c.cs {
+		if ch.Peer == name {
+			ss = append(ss, ch.To)
+		}
+	}
+	return ss
+}
+
+func start(t *testing.T, m *health.Monitor) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func status(m *health.Monitor, name string) health.Status {
+	s, _ := m.Status(name)
+	return s.Status
+}
+
+func TestMonitor(t *testing.T) {
+	var ch changes
+	m := &health.Monitor{
+		Interval:  5 * time.Millisecond,
+		Timeout:   10 * time.Millisecond,
+		DownAfter: 3,
+		OnChange:  ch.add,
+	}
+	var slow, gone pinger
+	m.Watch("slow", &slow)
+	m.Watch("gone", &gone)
+	if s := status(m, "slow"); s != health.Unknown {
+		t.Errorf("slow before Run is %s", s)
+	}
+	start(t, m)
+
+	waitFor(t, "both healthy", func() bool {
+		return status(m, "slow") == health.Healthy && status(m, "gone") == health.Healthy
+	})
+	if s, _ := m.Status("slow"); s.LastOK.IsZero() || s.Failures != 0 {
+		t.Errorf("slow healthy is %+v", s)
+	}
+
+	// A peer that stops answering in time is suspect, then down.
+	slow.set(nil, true)
+	waitFor(t, "slow down", func() bool { return status(m, "slow") == health.Down })
+	if s, _ := m.Status("slow"); s.Failures != 3 || s.Error == "" {
+		t.Errorf("slow down is %+v", s)
+	}
+
+	// One whose connection fails is down at once.
+	gone.set(errors.New("connection refused"), false)
+	waitFor(t, "gone down", func() bool { return status(m, "gone") == health.Down })
+
+	// Both come back.
+	slow.set(nil, false)
+	gone.set(nil, false)
+	waitFor(t, "both healthy again", func() bool {
+		return status(m, "slow") == health.Healthy && status(m, "gone") == health.Healthy
+	})
+
+	want := []health.Status{health.Healthy, health.Suspect, health.Down, health.Healthy}
+	if got := ch.to("slow"); !slices.Equal(got, want) {
+		t.Errorf("transitions of slow = %v, want %v", got, want)
+	}
+	want = []health.Status{health.Healthy, health.Down, health.Healthy}
+	if got := ch.to("gone"); !slices.Equal(got, want) {
+		t.Errorf("transitions of gone = %v, want %v", got, want)
+	}
+
+	if ps := m.Peers(); len(ps) != 2 || ps[0].Name != "gone" || ps[1].Name != "slow" {
+		t.Errorf("Peers = %+v", ps)
+	}
+
+	// A peer forgotten is pinged no more.
+	m.Forget("gone")
+	if _, ok := m.Status("gone"); ok {
+		t.Error("gone is watched after Forget")
+	}
+	n := gone.pings()
+	time.Sleep(50 * time.Millisecond)
+	if got := gone.pings(); got > n+1 {
+		t.Errorf("gone pinged %d times after Forget", got-n)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	var mu sync.Mutex
+	var at []time.Time
+	m := &health.Monitor{Interval: 20 * time.Millisecond, Jitter: 0.5}
+	m.Watch("a", health.PingerFunc(func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		at = append(at, time.Now())
+		return nil
+	}))
+	start(t, m)
+
+	waitFor(t, "pings", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(at) >= 20
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	var lo, hi time.Duration
+	for i := 1; i < len(at); i++ {
+		d := at[i].Sub(at[i-1])
+		if i == 1 || d < lo {
+			lo = d
+		}
+		if d > hi {
+			hi = d
+		}
+	}
+	// 20ms, give or take half, with room for a slow scheduler above.
+	if lo < 10*time.Millisecond || hi > 200*time.Millisecond {
+		t.Errorf("intervals between %v and %v", lo, hi)
+	}
+	if hi-lo < time.Millisecond {
+		t.Errorf("intervals between %v and %v do not vary", lo, hi)
+	}
+}
@@ -0,0 +1,153 @@
+// Package hlc implements hybrid logical clocks (Kulkarni, Demirbas, et
+// al., 2014), which stamp the events of the nodes of a cluster in an order
+// consistent with causality, as close to physical time as the clocks of
+// the nodes allow.
+//
+// A timestamp is the greatest physical time a node has seen, from its own
+// clock or from the timestamps of the messages it received, and a logical
+// count that orders the events of the same physical time. A node stamps a
+// message it sends with Clock.Now and updates its clock with the timestamp
+// of a message it receives, so that every event it stamps after is later
+// than those the message followed, even if its own clock is behind.
+//
+// A clock running far ahead would drag every node along. A clock rejects
+// the timestamps of nodes further ahead of it than its maximum offset,
+// which reveals the skew of their clocks rather than absorbing it.
+package hlc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Timestamp is a time of a hybrid logical clock. The zero value is
+// before any other.
+type Timestamp struct {
+	// Wall is the physical part of the timestamp, in nanoseconds since
+	// the Unix epoch.
+	Wall int64 `json:"wall"`
+
+	// Logical orders the timestamps of the same physical time.
+	Logical uint32 `json:"logical,omitempty"`
+}
+
+// Compare returns -1 if t is before u, 1 if it is after, and 0 if they are
+// equal.
+func (t Timestamp) Compare(u Timestamp) int {
+	switch {
+	case t.Wall < u.Wall:
+		return -1
+	case t.Wall > u.Wall:
+		return 1
+	case t.Logical < u.Logical:
+		return -1
+	case t.Logical > u.Logical:
+		return 1
+	}
+	return 0
+}
+
+// Before reports whether t is before u.
+func (t Timestamp) Before(u Timestamp) bool {
+	return t.Compare(u) < 0
+}
+
+// IsZero reports whether t is the zero timestamp.
+func (t Timestamp) IsZero() bool {
+	return t == Timestamp{}
+}
+
+// Time returns the physical part of t.
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.Wall)
+}
+
+// String returns t as its physical time in RFC 3339 format, in UTC, and
+// its logical count, such as 2024-05-01T12:00:00.123456789Z+2.
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%s+%d", t.Time().UTC().Format(time.RFC3339Nano), t.Logical)
+}
+
+// An OffsetError is the error of a timestamp too far ahead of the clock
+// updated with it.
+type OffsetError struct {
+	// Offset is how far the timestamp is ahead of the physical clock.
+	Offset time.Duration
+
+	MaxOffset time.Duration
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("hlc: timestamp %v ahead of the clock, more than %v", e.Offset.Round(time.Millisecond), e.MaxOffset)
+}
+
+// A Clock is a hybrid logical clock. Its methods may be called
+// concurrently. The zero value reads the system clock and accepts the
+// timestamps of any offset.
+type Clock struct {
+	// Physical, if not nil, is the physical clock, instead of time.Now.
+	Physical func() time.Time
+
+	// MaxOffset, if not zero, is the greatest offset of the timestamps
+	// Update accepts ahead of the physical clock.
+	MaxOffset time.Duration
+
+	mu   sync.Mutex
+	last Timestamp
+}
+
+// physical returns the time of the physical clock of c.
+func (c *Clock) physical() int64 {
+	if c.Physical != nil {
+		return c.Physical().UnixNano()
+	}
+	return time.Now().UnixNano()
+}
+
+// Now returns a timestamp after every other timestamp of c, to stamp an
+// event such as a message sent.
+func (c *Clock) Now() Timestamp {
+	pt := c.physical()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt > c.last.Wall {
+		c.last = Timestamp{Wall: pt}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update advances c past remote, the timestamp of a message received, and
+// returns a timestamp after both, to stamp its receipt. It fails with an
+// *OffsetError, leaving c as it is, if remote is ahead of the physical
+// clock by more than the maximum offset.
+func (c *Clock) Update(remote Timestamp) (Timestamp, error) {
+	pt := c.physical()
+	if c.MaxOffset > 0 && time.Duration(remote.Wall-pt) > c.MaxOffset {
+		return Timestamp{}, &OffsetError{Offset: time.Duration(remote.Wall - pt), MaxOffset: c.MaxOffset}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case pt > c.last.Wall && pt > remote.Wall:
+		c.last = Timestamp{Wall: pt}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		c.last.Logical = max(c.last.Logical, remote.Logical) + 1
+	}
+	return c.last, nil
+}
+
+// Last returns the last timestamp of c, without advancing it.
+func (c *Clock) Last() Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
@@ -0,0 +1,97 @@
+package hlc_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"nih.software/hlc"
+)
+
+func TestClock(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := &hlc.Clock{
+		Physical:  func() time.Time { return now },
+		MaxOffset: time.Second,
+	}
+
+	a := c.Now()
+	if a != (hlc.Timestamp{Wall: now.UnixNano()}) {
+		t.Errorf("Now = %v", a)
+	}
+	// The clock counts the events of the same physical time.
+	b := c.Now()
+	if !a.Before(b) || b.Logical != 1 {
+		t.Errorf("Now = %v after %v", b, a)
+	}
+
+	// A timestamp ahead, but within the maximum offset, drags the clock
+	// along, even once its physical clock moves on.
+	ahead := hlc.Timestamp{Wall: now.Add(500 * time.Millisecond).UnixNano(), Logical: 3}
+	u, err := c.Update(ahead)
+	if err != nil || u != (hlc.Timestamp{Wall: ahead.Wall, Logical: 4}) {
+		t.Errorf("Update(%v) = %v, %v", ahead, u, err)
+	}
+	now = now.Add(100 * time.Millisecond)
+	if got := c.Now(); got != (hlc.Timestamp{Wall: ahead.Wall, Logical: 5}) {
+		t.Errorf("Now = %v after an update ahead", got)
+	}
+
+	// A timestamp behind moves the clock past its own last.
+	if got, err := c.Update(a); err != nil || got != (hlc.Timestamp{Wall: ahead.Wall, Logical: 6}) {
+		t.Errorf("Update(%v) = %v, %v", a, got, err)
+	}
+	now = now.Add(time.Second)
+	if got := c.Now(); got != (hlc.Timestamp{Wall: now.UnixNano()}) {
+		t.Errorf("Now = %v once the physical clock caught up", got)
+	}
+
+	// A timestamp too far ahead is rejected, and leaves the clock as it is.
+	last := c.Last()
+	far := hlc.Timestamp{Wall: now.Add(2 * time.Second).UnixNano()}
+	_, err = c.Update(far)
+	var oerr *hlc.OffsetError
+	if !errors.As(err, &oerr) || oerr.Offset != 2*time.Second {
+		t.Errorf("Update of a timestamp 2s ahead: %v", err)
+	}
+	if c.Last() != last {
+		t.Errorf("clock at %v after a rejected update, was %v", c.Last(), last)
+	}
+
+	if s := (hlc.Timestamp{Wall: time.Unix(1, 5).UnixNano(), Logical: 2}).String(); s != "1970-01-01T00:00:01.000000005Z+2" {
+		t.Errorf("String = %q", s)
+	}
+	if !(hlc.Timestamp{}).IsZero() || a.IsZero() {
+		t.Error("IsZero")
+	}
+}
+
+func TestClockConcurrent(t *testing.T) {
+	var c hlc.Clock
+	var wg sync.WaitGroup
+	stamps := make([][]hlc.Timestamp, 4)
+	for i := range stamps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				stamps[i] = append(stamps[i], c.Now())
+			}
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[hlc.Timestamp]bool)
+	for _, ts := range stamps {
+		for j, s := range ts {
+			if seen[s] {
+				t.Fatalf("timestamp %v twice", s)
+			}
+			seen[s] = true
+			if j > 0 && !ts[j-1].Before(s) {
+				t.Fatalf("%v after %v", s, ts[j-1])
+			}
+		}
+	}
+}
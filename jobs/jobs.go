@@ -0,0 +1,487 @@
+// Package jobs runs jobs across the nodes of a cluster: a command, or a
+// task of Go code a node registered by name, on one node, some, or all of
+// them, trying it again on the nodes it fails on.
+//
+// A Manager runs the jobs submitted to it from the node it runs on, which
+// coordinates them: it has the command of a job run on each of its nodes
+// over a Transport, at most Spec.Parallel at a time, and keeps the state,
+// exit code, and the end of the output of every run. A job is done once
+// its command succeeded, or failed every attempt, on every node. The
+// manager keeps the last MaxJobs jobs in memory only, so that the state of
+// the jobs of a node is lost if it restarts.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"nih.software/log"
+)
+
+// Defaults of a Spec.
+const (
+	DefaultTimeout    = 10 * time.Minute
+	DefaultRetryDelay = time.Second
+)
+
+// Limits of jobs.
+const (
+	// MaxOutput bounds the output of a run kept, of each stream: the last
+	// MaxOutput bytes of it.
+	MaxOutput = 64 << 10
+
+	// MaxJobs bounds the jobs a Manager keeps: it forgets the oldest done
+	// beyond it.
+	MaxJobs = 100
+
+	// MaxRetries bounds the retries of a job on each node.
+	MaxRetries = 100
+)
+
+// ErrNotFound is the error of a job the manager does not know.
+var ErrNotFound = errors.New("jobs: no such job")
+
+// A State is the state of a job, or of its run on a node.
+type State string
+
+const (
+	Pending   State = "pending"
+	Running   State = "running"
+	Succeeded State = "succeeded"
+	Failed    State = "failed"
+	Canceled  State = "canceled"
+)
+
+// Done reports whether s is the state of a job or run that is over.
+func (s State) Done() bool {
+	return s == Succeeded || s == Failed || s == Canceled
+}
+
+// A Spec describes a job: what it runs, on which nodes, and how.
+type Spec struct {
+	// Task is the name of the task the job runs, with Args as its
+	// arguments. If empty, the job runs the command of Args.
+	Task string `json:"task,omitempty"`
+
+	// Args are the arguments of the task, or the command the job runs and
+	// its arguments, looked up in the PATH of the nodes.
+	Args []string `json:"args,omitempty"`
+
+	// Dir is the working directory of the command, that of the nodes if
+	// empty.
+	Dir string `json:"dir,omitempty"`
+
+	// Env holds environment variables in "KEY=value" form, added to that
+	// of the nodes for the command.
+	Env []string `json:"env,omitempty"`
+
+	// Nodes are the names of the nodes the job runs on, unless All is
+	// set.
+	Nodes []string `json:"nodes,omitempty"`
+
+	// All has the job run on every node of the cluster the manager knows
+	// as it is submitted, its own included.
+	All bool `json:"all,omitempty"`
+
+	// Parallel bounds the nodes the job runs on at a time, if not zero.
+	Parallel int `json:"parallel,omitempty"`
+
+	// Retries is the number of times the job is tried again on a node it
+	// fails on.
+	Retries int `json:"retries,omitempty"`
+
+	// RetryDelay is the time before the first retry on a node, doubled
+	// for every retry after it. Zero means DefaultRetryDelay.
+	RetryDelay time.Duration `json:"retry_delay,omitempty"`
+
+	// Timeout bounds every attempt of the job on a node. Zero means
+	// DefaultTimeout.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// Check returns an error if s is not a valid spec.
+func (s *Spec) Check() error {
+	switch {
+	case s.Task == "" && len(s.Args) == 0:
+		return errors.New("jobs: a job needs a command or a task")
+	case s.All && len(s.Nodes) > 0:
+		return errors.New("jobs: a job runs on its nodes or on all of them, not both")
+	case !s.All && len(s.Nodes) == 0:
+		return errors.New("jobs: a job needs nodes")
+	case s.Parallel < 0 || s.Retries < 0 || s.RetryDelay < 0 || s.Timeout < 0:
+		return errors.New("jobs: negative parallelism, retries, retry delay, or timeout")
+	case s.Retries > MaxRetries:
+		return fmt.Errorf("jobs: %d retries, more than %d", s.Retries, MaxRetries)
+	}
+	for i, name := range s.Nodes {
+		if name == "" || slices.Contains(s.Nodes[:i], name) {
+			return fmt.Errorf("jobs: invalid or repeated node %q", name)
+		}
+	}
+	return nil
+}
+
+// A Command is the command of a job a node runs: the part of its spec
+// that travels to the node.
+type Command struct {
+	// Job is the ID of the job.
+	Job string `json:"job"`
+
+	// Attempt counts the attempts of the job on the node, from 1.
+	Attempt int `json:"attempt"`
+
+	Task string   `json:"task,omitempty"`
+	Args []string `json:"args,omitempty"`
+	Dir  string   `json:"dir,omitempty"`
+	Env  []string `json:"env,omitempty"`
+}
+
+// A Result is the result of a command a node ran.
+type Result struct {
+	// Exit is the exit code of the command, or 1 for a task that failed,
+	// unless it could not run.
+	Exit *int `json:"exit,omitempty"`
+
+	// Error is why the command could not run or be waited for, or why
+	// the task failed.
+	Error string `json:"error,omitempty"`
+
+	// Stdout and Stderr are the last MaxOutput bytes of the output of
+	// the command.
+	Stdout []byte `json:"stdout,omitempty"`
+	Stderr []byte `json:"stderr,omitempty"`
+}
+
+// ok reports whether the command of r succeeded.
+func (r *Result) ok() bool {
+	return r.Exit != nil && *r.Exit == 0 && r.Error == ""
+}
+
+// A Transport runs the commands of jobs on nodes.
+type Transport interface {
+	// Run runs c on the node named node until it is done or ctx is, and
+	// returns its result. It fails if the node did not run the command,
+	// or did not answer.
+	Run(ctx context.Context, node string, c Command) (Result, error)
+}
+
+// A Run is the run of a job on a node.
+type Run struct {
+	Node     string `json:"node"`
+	State    State  `json:"state"`
+	Attempts int    `json:"attempts"`
+
+	// Exit is the exit code of the last attempt, if the node ran it.
+	Exit *int `json:"exit,omitempty"`
+
+	// Error is why the last attempt failed, but for its exit code.
+	Error string `json:"error,omitempty"`
+
+	// Stdout and Stderr are the end of the output of the last attempt.
+	Stdout []byte `json:"stdout,omitempty"`
+	Stderr []byte `json:"stderr,omitempty"`
+
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// A Job is a job submitted to a manager, with its runs on every node.
+type Job struct {
+	ID   string `json:"id"`
+	Spec Spec   `json:"spec"`
+
+	// From is who submitted the job.
+	From string `json:"from,omitempty"`
+
+	State    State     `json:"state"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+	Runs     []Run     `json:"runs"`
+}
+
+// Config configures a Manager. Transport is required.
+type Config struct {
+	Transport Transport
+
+	// Nodes returns the names of the nodes of the cluster the jobs for
+	// all nodes run on, that of the manager included.
+	Nodes func() []string
+}
+
+// A job is a job of a manager.
+type job struct {
+	Job
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// A Manager runs jobs, and keeps their state.
+type Manager struct {
+	cfg    Config
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu    sync.Mutex
+	jobs  map[string]*job
+	order []string // the IDs of jobs, oldest first
+}
+
+// New returns a manager of cfg, which runs the jobs submitted to it until
+// it stops running.
+func New(cfg Config) (*Manager, error) {
+	if cfg.Transport == nil {
+		return nil, errors.New("jobs: a manager needs a transport")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{cfg: cfg, ctx: ctx, cancel: cancel, jobs: make(map[string]*job)}, nil
+}
+
+// Run waits until ctx is done, then cancels the jobs running and waits for
+// them to stop. Jobs submitted after are canceled at once.
+func (m *Manager) Run(ctx context.Context) {
+	<-ctx.Done()
+	m.cancel()
+	m.wg.Wait()
+}
+
+// Submit starts the job of spec, submitted by from, and returns it.
+func (m *Manager) Submit(spec Spec, from string) (Job, error) {
+	if err := spec.Check(); err != nil {
+		return Job{}, err
+	}
+	nodes := spec.Nodes
+	if spec.All {
+		if m.cfg.Nodes != nil {
+			nodes = m.cfg.Nodes()
+		}
+		if len(nodes) == 0 {
+			return Job{}, errors.New("jobs: no nodes")
+		}
+	}
+	if spec.Timeout == 0 {
+		spec.Timeout = DefaultTimeout
+	}
+	if spec.RetryDelay == 0 {
+		spec.RetryDelay = DefaultRetryDelay
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	j := &job{
+		Job:  Job{ID: hex.EncodeToString(b), Spec: spec, From: from, State: Running, Created: time.Now()},
+		done: make(chan struct{}),
+	}
+	for _, node := range nodes {
+		j.Runs = append(j.Runs, Run{Node: node, State: Pending})
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	j.cancel = cancel
+
+	m.mu.Lock()
+	m.jobs[j.ID] = j
+	m.order = append(m.order, j.ID)
+	m.forget()
+	snapshot := j.copy()
+	m.mu.Unlock()
+
+	log.Default().Info("jobs: submitted", "job", j.ID, "from", from, "task", spec.Task, "args", spec.Args, "nodes", nodes)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		m.run(ctx, j)
+	}()
+	return snapshot, nil
+}
+
+// forget forgets the oldest jobs done beyond MaxJobs, under m.mu.
+func (m *Manager) forget() {
+	for i := 0; len(m.order) > MaxJobs && i < len(m.order); {
+		if j := m.jobs[m.order[i]]; j.State.Done() {
+			delete(m.jobs, j.ID)
+			m.order = slices.Delete(m.order, i, i+1)
+			continue
+		}
+		i++
+	}
+}
+
+// run runs j on its nodes, at most Spec.Parallel at a time.
+func (m *Manager) run(ctx context.Context, j *job) {
+	parallel := j.Spec.Parallel
+	if parallel == 0 {
+		parallel = len(j.Runs)
+	}
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range j.Runs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			m.update(j, i, func(r *Run) { r.State = Canceled })
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			m.runOn(ctx, j, i)
+		}()
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	j.State = Succeeded
+	for _, r := range j.Runs {
+		if r.State == Canceled {
+			j.State = Canceled
+		} else if r.State == Failed && j.State != Canceled {
+			j.State = Failed
+		}
+	}
+	j.Finished = time.Now()
+	m.forget()
+	m.mu.Unlock()
+	close(j.done)
+	log.Default().Info("jobs: done", "job", j.ID, "state", j.State)
+}
+
+// runOn runs j on the node of its run i, trying again as its spec allows.
+func (m *Manager) runOn(ctx context.Context, j *job, i int) {
+	node := j.Runs[i].Node
+	c := Command{Job: j.ID, Task: j.Spec.Task, Args: j.Spec.Args, Dir: j.Spec.Dir, Env: j.Spec.Env}
+	delay := j.Spec.RetryDelay
+	for c.Attempt = 1; ; c.Attempt++ {
+		m.update(j, i, func(r *Run) {
+			r.State = Running
+			r.Attempts = c.Attempt
+			if r.Started.IsZero() {
+				r.Started = time.Now()
+			}
+		})
+
+		actx, cancel := context.WithTimeout(ctx, j.Spec.Timeout)
+		res, err := m.cfg.Transport.Run(actx, node, c)
+		cancel()
+
+		state := Succeeded
+		switch {
+		case ctx.Err() != nil:
+			state = Canceled
+		case err != nil || !res.ok():
+			state = Failed
+		}
+		m.update(j, i, func(r *Run) {
+			if err != nil {
+				r.Exit, r.Error, r.Stdout, r.Stderr = nil, err.Error(), nil, nil
+			} else {
+				r.Exit, r.Error, r.Stdout, r.Stderr = res.Exit, res.Error, res.Stdout, res.Stderr
+			}
+			if state != Failed || c.Attempt > j.Spec.Retries {
+				r.State = state
+				r.Finished = time.Now()
+			}
+		})
+		if state != Failed || c.Attempt > j.Spec.Retries {
+			return
+		}
+		log.Default().Debug("jobs: retry", "job", j.ID, "node", node, "attempt", c.Attempt, "err", err, "error", res.Error)
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			m.update(j, i, func(r *Run) {
+				r.State = Canceled
+				r.Finished = time.Now()
+			})
+			return
+		}
+		delay *= 2
+	}
+}
+
+// update calls f with the run i of j under m.mu.
+func (m *Manager) update(j *job, i int, f func(*Run)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(&j.Runs[i])
+}
+
+// copy returns a copy of j, under the lock of its manager.
+func (j *job) copy() Job {
+	c := j.Job
+	c.Runs = slices.Clone(j.Runs)
+	return c
+}
+
+// Get returns the job of id, and whether the manager knows it.
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.copy(), true
+}
+
+// List returns the jobs the manager knows, newest first, without the
+// output of their runs.
+func (m *Manager) List() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := []Job{}
+	for _, id := range slices.Backward(m.order) {
+		j := m.jobs[id].copy()
+		for i := range j.Runs {
+			j.Runs[i].Stdout, j.Runs[i].Stderr = nil, nil
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+// Wait waits for the job of id to be done, and returns it, unless ctx is
+// done first.
+func (m *Manager) Wait(ctx context.Context, id string) (Job, error) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return j.copy(), nil
+}
+
+// Cancel cancels the job of id, unless it is done: the attempts running
+// are canceled, and the runs pending are not started.
+func (m *Manager) Cancel(id string) error {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	j.cancel()
+	return nil
+}
@@ -0,0 +1,219 @@
+package jobs_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nih.software/jobs"
+)
+
+// A transport runs commands by a function of the node.
+type transport func(ctx context.Context, node string, c jobs.Command) (jobs.Result, error)
+
+func (f transport) Run(ctx context.Context, node string, c jobs.Command) (jobs.Result, error) {
+	return f(ctx, node, c)
+}
+
+func exit(code int) *int { return &code }
+
+func newManager(t *testing.T, cfg jobs.Config) *jobs.Manager {
+	t.Helper()
+	m, err := jobs.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return m
+}
+
+func wait(t *testing.T, m *jobs.Manager, id string) jobs.Job {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	j, err := m.Wait(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestJobs(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	m := newManager(t, jobs.Config{
+		Transport: transport(func(ctx context.Context, node string, c jobs.Command) (jobs.Result, error) {
+			mu.Lock()
+			attempts[node]++
+			mu.Unlock()
+			switch node {
+			case "down":
+				return jobs.Result{}, errors.New("unreachable")
+			case "flaky":
+				if c.Attempt < 3 {
+					return jobs.Result{Exit: exit(1), Stderr: []byte("not yet\n")}, nil
+				}
+			}
+			return jobs.Result{Exit: exit(0), Stdout: []byte(node + " " + c.Args[0] + "\n")}, nil
+		}),
+		Nodes: func() []string { return []string{"a", "b", "flaky"} },
+	})
+
+	// A job on every node, trying again on the one that fails at first.
+	j, err := m.Submit(jobs.Spec{Args: []string{"uptime"}, All: true, Retries: 2, RetryDelay: time.Millisecond}, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.State != jobs.Running || len(j.Runs) != 3 || j.From != "alice" {
+		t.Errorf("submitted %+v", j)
+	}
+	j = wait(t, m, j.ID)
+	if j.State != jobs.Succeeded || j.Finished.IsZero() {
+		t.Errorf("job %s, finished at %v", j.State, j.Finished)
+	}
+	for _, r := range j.Runs {
+		if r.State != jobs.Succeeded || r.Exit == nil || *r.Exit != 0 || string(r.Stdout) != r.Node+" uptime\n" {
+			t.Errorf("run %+v", r)
+		}
+	}
+	if r := j.Runs[2]; r.Node != "flaky" || r.Attempts != 3 || len(r.Stderr) != 0 {
+		t.Errorf("flaky run %+v, want 3 attempts", r)
+	}
+
+	// A job that fails on a node, past its retries.
+	j, err = m.Submit(jobs.Spec{Task: "reload", Args: []string{"-now"}, Nodes: []string{"a", "down"}, Retries: 1, RetryDelay: time.Millisecond}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j = wait(t, m, j.ID)
+	if j.State != jobs.Failed {
+		t.Errorf("job %s, want failed", j.State)
+	}
+	if r := j.Runs[1]; r.State != jobs.Failed || r.Attempts != 2 || r.Exit != nil || r.Error != "unreachable" {
+		t.Errorf("run on a node down %+v", r)
+	}
+	if attempts["down"] != 2 {
+		t.Errorf("%d attempts on a node down, want 2", attempts["down"])
+	}
+
+	list := m.List()
+	if len(list) != 2 || list[0].ID != j.ID || list[1].Runs[0].Stdout != nil {
+		t.Errorf("List = %+v", list)
+	}
+	if _, ok := m.Get(j.ID); !ok {
+		t.Errorf("Get(%s) failed", j.ID)
+	}
+	if _, ok := m.Get("nope"); ok {
+		t.Error("Get of an unknown job succeeded")
+	}
+	if err := m.Cancel("nope"); err != jobs.ErrNotFound {
+		t.Errorf("Cancel of an unknown job: %v", err)
+	}
+
+	for _, spec := range []jobs.Spec{
+		{Nodes: []string{"a"}},
+		{Args: []string{"true"}},
+		{Args: []string{"true"}, All: true, Nodes: []string{"a"}},
+		{Args: []string{"true"}, Nodes: []string{"a", "a"}},
+		{Args: []string{"true"}, Nodes: []string{"a"}, Retries: -1},
+		{Args: []string{"true"}, Nodes: []string{"a"}, Retries: jobs.MaxRetries + 1},
+	} {
+		if _, err := m.Submit(spec, ""); err == nil {
+			t.Errorf("Submit(%+v) succeeded", spec)
+		}
+	}
+}
+
+func TestJobsParallel(t *testing.T) {
+	var running, most atomic.Int32
+	m := newManager(t, jobs.Config{
+		Transport: transport(func(ctx context.Context, node string, c jobs.Command) (jobs.Result, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := most.Load()
+				if n <= m || most.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			return jobs.Result{Exit: exit(0)}, nil
+		}),
+	})
+
+	j, err := m.Submit(jobs.Spec{Args: []string{"true"}, Nodes: []string{"a", "b", "c", "d", "e"}, Parallel: 2}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j = wait(t, m, j.ID); j.State != jobs.Succeeded {
+		t.Errorf("job %s", j.State)
+	}
+	if n := most.Load(); n != 2 {
+		t.Errorf("%d runs at a time, want 2", n)
+	}
+}
+
+func TestJobsCancel(t *testing.T) {
+	started := make(chan string, 3)
+	m := newManager(t, jobs.Config{
+		Transport: transport(func(ctx context.Context, node string, c jobs.Command) (jobs.Result, error) {
+			started <- node
+			<-ctx.Done()
+			return jobs.Result{}, ctx.Err()
+		}),
+	})
+
+	j, err := m.Submit(jobs.Spec{Args: []string{"sleep", "1h"}, Nodes: []string{"a", "b", "c"}, Parallel: 1}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node := <-started; node != "a" {
+		t.Errorf("started on %s first", node)
+	}
+	if err := m.Cancel(j.ID); err != nil {
+		t.Fatal(err)
+	}
+	j = wait(t, m, j.ID)
+	if j.State != jobs.Canceled {
+		t.Errorf("job %s, want canceled", j.State)
+	}
+	var states []jobs.State
+	for _, r := range j.Runs {
+		states = append(states, r.State)
+	}
+	if !slices.Equal(states, []jobs.State{jobs.Canceled, jobs.Canceled, jobs.Canceled}) {
+		t.Errorf("runs %v", states)
+	}
+	if len(started) != 0 {
+		t.Errorf("runs pending started after the job was canceled")
+	}
+}
+
+func TestJobsTimeout(t *testing.T) {
+	m := newManager(t, jobs.Config{
+		Transport: transport(func(ctx context.Context, node string, c jobs.Command) (jobs.Result, error) {
+			<-ctx.Done()
+			return jobs.Result{}, ctx.Err()
+		}),
+	})
+	j, err := m.Submit(jobs.Spec{Args: []string{"sleep", "1h"}, Nodes: []string{"a"}, Timeout: 10 * time.Millisecond}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j = wait(t, m, j.ID); j.State != jobs.Failed || j.Runs[0].Error != context.DeadlineExceeded.Error() {
+		t.Errorf("job %s, run %+v", j.State, j.Runs[0])
+	}
+}
@@ -0,0 +1,208 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"nih.software/log"
+)
+
+// ElectionPrefix is the prefix of the keys of the leases of elections.
+const ElectionPrefix = "elections/"
+
+// DefaultLeaseTTL is the time a node leads an election without renewing
+// its lease, unless configured otherwise.
+const DefaultLeaseTTL = 10 * time.Second
+
+// A Lease is the lease of the node leading an election, held by it as long
+// as it renews it.
+//
+// The node winning an election puts its lease under the key of the
+// election, conditioned on the version the key had, and renews it a few
+// times a lease TTL in the same way. It leads until the TTL passes since
+// it last asked to renew it, or its renewal conflicts with another node's
+// change. The other nodes campaigning take the lease over once they saw
+// its key keep the same version for a quarter more than its TTL, by the
+// clock of each, so that no two nodes lead at once unless their clocks run
+// at rates a quarter apart, or a duty is slow to stop.
+type Lease struct {
+	// Election is the name of the election.
+	Election string `json:"election"`
+
+	// Holder is the name of the node leading the election.
+	Holder string `json:"holder"`
+
+	TTL time.Duration `json:"ttl"`
+
+	// Version is the version of the key of the election, that of the last
+	// renewal of the lease.
+	Version uint64 `json:"version"`
+}
+
+// leaseValue is the value of the key of a lease.
+type leaseValue struct {
+	Holder string        `json:"holder"`
+	TTL    time.Duration `json:"ttl"`
+}
+
+// Leases returns the leases of the elections in the replica, by the name
+// of their election.
+func (r *Replica) Leases() []Lease {
+	leases := []Lease{}
+	for _, e := range r.List(ElectionPrefix) {
+		var v leaseValue
+		if err := json.Unmarshal(e.Value, &v); err != nil {
+			continue
+		}
+		leases = append(leases, Lease{
+			Election: strings.TrimPrefix(e.Key, ElectionPrefix),
+			Holder:   v.Holder,
+			TTL:      v.TTL,
+			Version:  e.Version,
+		})
+	}
+	return leases
+}
+
+// Lead campaigns in the election named election until ctx is done, and
+// runs duty while the node of r leads it, so that duties such as
+// publishing revocation lists run on one node of the cluster at a time.
+// The context of duty is canceled once the node stops leading, and duty
+// must return then; if it returns sooner, the node resigns. A node losing
+// the lease campaigns again, and one resigning or done hands it over to
+// the next at once.
+//
+// A node must not campaign twice in an election at once. Lead fails at once
+// if election is not a valid segment of a key, and returns nil once ctx is
+// done.
+func (r *Replica) Lead(ctx context.Context, election string, duty func(ctx context.Context)) error {
+	key := ElectionPrefix + election
+	if strings.Contains(election, "/") || !ValidKey(key) {
+		return fmt.Errorf("kv: invalid election %q", election)
+	}
+	ttl := r.cfg.LeaseTTL
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	value, err := json.Marshal(&leaseValue{Holder: r.cfg.Name, TTL: ttl})
+	if err != nil {
+		return err
+	}
+
+	// seen is the version of the lease of another node last seen, at
+	// seenAt, and expiry the time it expires after that.
+	var (
+		seen   uint64
+		seenAt time.Time
+		expiry time.Duration
+	)
+	for {
+		e, ok := r.Get(key)
+		var v leaseValue
+		if ok && json.Unmarshal(e.Value, &v) != nil {
+			v = leaseValue{}
+		}
+
+		take := false
+		switch {
+		case !ok:
+			take = true
+		case v.Holder == r.cfg.Name:
+			// The lease of the node from before it restarted.
+			take = true
+		case e.Version != seen:
+			seen, seenAt = e.Version, time.Now()
+			expiry = v.TTL + v.TTL/4
+			if v.TTL <= 0 {
+				expiry = ttl + ttl/4
+			}
+		case time.Since(seenAt) >= expiry:
+			take = true
+			log.Default().Info("kv: lease expired", "election", election, "holder", v.Holder)
+		}
+
+		if take {
+			start := time.Now()
+			won, err := r.Apply(ctx, Change{Op: Put, Key: key, Value: value, IfVersion: &e.Version})
+			if err == nil {
+				r.lead(ctx, election, won, start, ttl, duty)
+			} else if ctx.Err() == nil {
+				log.Default().Debug("kv: campaign", "election", election, "err", err)
+			}
+		}
+
+		t := time.NewTimer(time.Duration(float64(ttl/4) * (0.8 + 0.4*rand.Float64())))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil
+		}
+	}
+}
+
+// lead runs duty while the node holds the lease of election it put as e,
+// having asked to at start, renews the lease meanwhile, and resigns it
+// after unless it lost it.
+func (r *Replica) lead(ctx context.Context, election string, e Entry, start time.Time, ttl time.Duration, duty func(ctx context.Context)) {
+	log.Default().Info("kv: leading", "election", election, "version", e.Version)
+
+	dctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		duty(dctx)
+	}()
+
+	deadline := start.Add(ttl)
+	held := true
+	t := time.NewTimer(ttl / 3)
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		case <-ctx.Done():
+			break loop
+		case <-t.C:
+		}
+
+		start := time.Now()
+		rctx, rcancel := context.WithDeadline(ctx, deadline)
+		renewed, err := r.Apply(rctx, Change{Op: Put, Key: e.Key, Value: e.Value, IfVersion: &e.Version})
+		rcancel()
+		switch {
+		case err == nil:
+			e, deadline = renewed, start.Add(ttl)
+			t.Reset(ttl / 3)
+		case err == ErrConflict:
+			log.Default().Warn("kv: lease taken over", "election", election)
+			held = false
+			break loop
+		case !time.Now().Before(deadline):
+			log.Default().Warn("kv: lease expired", "election", election, "err", err)
+			held = false
+			break loop
+		default:
+			t.Reset(ttl / 10)
+		}
+	}
+	t.Stop()
+	cancel()
+	<-done
+
+	if held {
+		// Resign, so that another node takes over at once.
+		rctx, rcancel := context.WithTimeout(context.WithoutCancel(ctx), ttl)
+		_, err := r.Apply(rctx, Change{Op: Delete, Key: e.Key, IfVersion: &e.Version})
+		rcancel()
+		if err != nil {
+			log.Default().Debug("kv: resign", "election", election, "err", err)
+		}
+	}
+	log.Default().Info("kv: stopped leading", "election", election)
+}
@@ -0,0 +1,299 @@
+// Package kv keeps a small key-value store replicated across the nodes of
+// a cluster, for the metadata of the cluster itself, such as its registry
+// of peers, its revocations, and the versions of its configuration.
+//
+// The replicas of the store are the servers of a raft cluster, which
+// elects one of them leader. The leader orders every change of the store
+// and applies it once a majority of the replicas has it, as the others do
+// as they learn it is committed: a change made survives the failure of any
+// minority of the nodes. Followers forward the changes made through them to
+// the leader. Reads are answered by the replica of the node read from,
+// which may lag behind the leader's by the time replication takes, but
+// holds a change made through the node once the change returns.
+//
+// Every change has an index, greater than that of the change before it,
+// which is the version of the key it sets. A change may be conditioned on
+// the version of its key, so that clients reading a key and writing it
+// back lose no change made in the meantime.
+//
+// A node joins the cluster by asking its nodes to add it, which the leader
+// does, and leaves it as the leader removes it. Replicas exchange their
+// messages over a Transport, such as the RPC methods of package daemon.
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"nih.software/hlc"
+)
+
+// Limits of the store, which keep a snapshot of it small enough to send
+// in one message.
+const (
+	MaxKeySize   = 256
+	MaxValueSize = 1 << 20
+	MaxSize      = 8 << 20
+)
+
+var (
+	// ErrConflict is the error of a change whose key did not have the
+	// version the change was conditioned on.
+	ErrConflict = errors.New("kv: version conflict")
+
+	// ErrFull is the error of a change that would make the store larger
+	// than MaxSize.
+	ErrFull = errors.New("kv: store full")
+
+	// ErrNotLeader is the error of asking a follower for what only the
+	// leader does.
+	ErrNotLeader = errors.New("kv: not the leader")
+
+	// ErrNoLeader is the error of a change made through a replica that
+	// knows of no leader, as while the replicas elect one.
+	ErrNoLeader = errors.New("kv: no leader")
+
+	// ErrNoReplica is the error of removing a node of no replica in the
+	// cluster.
+	ErrNoReplica = errors.New("kv: no replica of the node")
+)
+
+// An Op is what a change does to its key.
+type Op string
+
+const (
+	Put    Op = "put"
+	Delete Op = "delete"
+)
+
+// A Change is a change of the store.
+type Change struct {
+	// Index orders the changes of the store. It is the index of the
+	// change in the raft log, which the leader sets.
+	Index uint64 `json:"index"`
+
+	Op    Op     `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+
+	// IfVersion, if not nil, conditions the change on the version of its
+	// key, 0 for a key absent: the change fails with ErrConflict unless
+	// the key has that version.
+	IfVersion *uint64 `json:"if_version,omitempty"`
+
+	// Time is the time of the change by the clock of the leader, later
+	// than the events of the node it was made through.
+	Time hlc.Timestamp `json:"time"`
+}
+
+// An Entry is a key of the store with its value.
+type Entry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+
+	// Version is the index of the change that set the value.
+	Version uint64 `json:"version"`
+
+	// Time is the time of the change that set the value.
+	Time hlc.Timestamp `json:"time"`
+}
+
+// A Snapshot is the whole of a store at an index.
+type Snapshot struct {
+	Index   uint64  `json:"index"`
+	Entries []Entry `json:"entries"`
+}
+
+// ValidKey reports whether key may be a key of the store: segments of
+// printable characters other than spaces, separated by slashes, such as
+// peers/node1, of at most MaxKeySize bytes. Segments may not be "." or
+// "..".
+func ValidKey(key string) bool {
+	if len(key) > MaxKeySize || !utf8.ValidString(key) {
+		return false
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+		if strings.IndexFunc(seg, func(r rune) bool { return !unicode.IsPrint(r) || unicode.IsSpace(r) }) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Check returns an error if c is not a valid change, but for its index.
+func (c *Change) Check() error {
+	if !ValidKey(c.Key) {
+		return fmt.Errorf("kv: invalid key %q", c.Key)
+	}
+	switch c.Op {
+	case Put:
+		if len(c.Value) > MaxValueSize {
+			return fmt.Errorf("kv: value of %d bytes, more than %d", len(c.Value), MaxValueSize)
+		}
+	case Delete:
+		if c.Value != nil {
+			return errors.New("kv: value of a delete")
+		}
+	default:
+		return fmt.Errorf("kv: invalid op %q", c.Op)
+	}
+	return nil
+}
+
+// A Store is a replica of the store: its entries at an index. The zero
+// value is an empty store.
+type Store struct {
+	mu      sync.Mutex
+	index   uint64
+	size    int
+	entries map[string]Entry
+
+	// changed is closed and replaced by every change.
+	changed chan struct{}
+}
+
+// Index returns the index of the last change applied.
+func (s *Store) Index() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index
+}
+
+// Get returns the entry of key, and whether there is one.
+func (s *Store) Get(key string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	return e, ok
+}
+
+// List returns the entries whose keys start with prefix, in key order.
+func (s *Store) List(prefix string) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []Entry{}
+	for k, e := range s.entries {
+		if strings.HasPrefix(k, prefix) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// Apply applies c, which must have an index greater than that of the
+// store, and returns the entry it made, without a value for a delete.
+//
+// A change that fails its condition, or would make the store full, fails
+// with ErrConflict or ErrFull, and one that is not valid with the error of
+// Check. They change nothing, but take their index all the same, so that
+// every replica applying the same changes fails the same ones.
+func (s *Store) Apply(c Change) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c.Index <= s.index {
+		return Entry{}, fmt.Errorf("kv: change %d applied at index %d", c.Index, s.index)
+	}
+	s.index = c.Index
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+
+	if err := c.Check(); err != nil {
+		return Entry{}, err
+	}
+	old, ok := s.entries[c.Key]
+	if c.IfVersion != nil && *c.IfVersion != old.Version {
+		return Entry{}, ErrConflict
+	}
+	if s.entries == nil {
+		s.entries = make(map[string]Entry)
+	}
+
+	e := Entry{Key: c.Key, Version: c.Index, Time: c.Time}
+	switch c.Op {
+	case Put:
+		size := s.size + len(c.Key) + len(c.Value)
+		if ok {
+			size -= len(old.Key) + len(old.Value)
+		}
+		if size > MaxSize {
+			return Entry{}, ErrFull
+		}
+		e.Value = c.Value
+		s.entries[c.Key] = e
+		s.size = size
+	case Delete:
+		if ok {
+			delete(s.entries, c.Key)
+			s.size -= len(old.Key) + len(old.Value)
+		}
+	}
+	return e, nil
+}
+
+// Wait waits until the store has a change after index after, or ctx is
+// done.
+func (s *Store) Wait(ctx context.Context, after uint64) error {
+	for {
+		s.mu.Lock()
+		if s.index > after {
+			s.mu.Unlock()
+			return nil
+		}
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Snapshot returns the entries of the store, in key order, at its index.
+func (s *Store) Snapshot() *Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := &Snapshot{Index: s.index, Entries: []Entry{}}
+	for _, e := range s.entries {
+		snap.Entries = append(snap.Entries, e)
+	}
+	sort.Slice(snap.Entries, func(i, j int) bool { return snap.Entries[i].Key < snap.Entries[j].Key })
+	return snap
+}
+
+// Restore replaces the store with snap.
+func (s *Store) Restore(snap *Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index = snap.Index
+	s.size = 0
+	s.entries = make(map[string]Entry, len(snap.Entries))
+	for _, e := range snap.Entries {
+		s.entries[e.Key] = e
+		s.size += len(e.Key) + len(e.Value)
+	}
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
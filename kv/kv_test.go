@@ -0,0 +1,441 @@
+package kv_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nih.software/kv"
+	"nih.software/raft"
+)
+
+func TestStore(t *testing.T) {
+	var s kv.Store
+	var all []kv.Change
+	apply := func(c kv.Change) (kv.Entry, error) {
+		t.Helper()
+		c.Index = s.Index() + 1
+		all = append(all, c)
+		return s.Apply(c)
+	}
+	version := func(v uint64) *uint64 { return &v }
+
+	if e, err := apply(kv.Change{Op: kv.Put, Key: "peers/a", Value: []byte("1")}); err != nil || e.Version != 1 {
+		t.Fatalf("put = %+v, %v", e, err)
+	}
+	if _, err := apply(kv.Change{Op: kv.Put, Key: "peers/a", Value: []byte("2"), IfVersion: version(0)}); err != kv.ErrConflict {
+		t.Errorf("put of a key present if absent: %v", err)
+	}
+	if _, err := apply(kv.Change{Op: kv.Put, Key: "peers/b", Value: []byte("3"), IfVersion: version(0)}); err != nil {
+		t.Errorf("put of a key absent if absent: %v", err)
+	}
+	if _, err := apply(kv.Change{Op: kv.Put, Key: "peers/a", Value: []byte("4"), IfVersion: version(1)}); err != nil {
+		t.Errorf("put of the version read: %v", err)
+	}
+	if _, err := apply(kv.Change{Op: kv.Put, Key: "other", Value: []byte("5")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apply(kv.Change{Op: kv.Delete, Key: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apply(kv.Change{Op: kv.Put, Key: "a//b"}); err == nil {
+		t.Error("put of an invalid key succeeded")
+	}
+	if _, err := s.Apply(kv.Change{Index: 2, Op: kv.Put, Key: "x"}); err == nil {
+		t.Error("apply of a change out of order succeeded")
+	}
+	// Indexes may skip some, as raft entries other than changes do.
+	c := kv.Change{Index: s.Index() + 3, Op: kv.Put, Key: "other", Value: []byte("6")}
+	all = append(all, c)
+	if e, err := s.Apply(c); err != nil || e.Version != 10 {
+		t.Errorf("apply after a gap = %+v, %v", e, err)
+	}
+
+	if s.Index() != 10 {
+		t.Errorf("index %d, want 10", s.Index())
+	}
+	if e, ok := s.Get("peers/a"); !ok || string(e.Value) != "4" || e.Version != 4 {
+		t.Errorf("Get = %+v, %v", e, ok)
+	}
+	if e, ok := s.Get("other"); !ok || e.Version != 10 {
+		t.Errorf("key put again = %+v, %v", e, ok)
+	}
+	if l := s.List("peers/"); len(l) != 2 || l[0].Key != "peers/a" || l[1].Key != "peers/b" {
+		t.Errorf("List = %+v", l)
+	}
+
+	// Changes that fail take their index all the same.
+	var r kv.Store
+	r.Restore(&kv.Snapshot{})
+	for _, c := range all {
+		r.Apply(c)
+	}
+	if !equal(r.Snapshot(), s.Snapshot()) {
+		t.Errorf("replayed %+v, want %+v", r.Snapshot(), s.Snapshot())
+	}
+
+	// The store holds up to MaxSize.
+	big := make([]byte, kv.MaxValueSize)
+	var err error
+	for i := 0; err == nil && i < 10; i++ {
+		_, err = apply(kv.Change{Op: kv.Put, Key: fmt.Sprint("big/", i), Value: big})
+	}
+	if err != kv.ErrFull {
+		t.Errorf("put beyond MaxSize: %v", err)
+	}
+	if _, err := apply(kv.Change{Op: kv.Put, Key: "big/0", Value: big}); err != nil {
+		t.Errorf("put replacing a value when full: %v", err)
+	}
+
+	for key, want := range map[string]bool{
+		"peers/node-1": true, "a": true, "": false, "/a": false, "a/": false, "a/../b": false, "a b": false, "a\x00": false,
+	} {
+		if got := kv.ValidKey(key); got != want {
+			t.Errorf("ValidKey(%q) = %v", key, got)
+		}
+	}
+}
+
+func equal(a, b *kv.Snapshot) bool {
+	if a.Index != b.Index || len(a.Entries) != len(b.Entries) {
+		return false
+	}
+	for i := range a.Entries {
+		if a.Entries[i].Key != b.Entries[i].Key || a.Entries[i].Version != b.Entries[i].Version || !bytes.Equal(a.Entries[i].Value, b.Entries[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// network carries the messages of the replicas of a test in memory, but
+// not from or to replicas down.
+type network struct {
+	mu       sync.Mutex
+	replicas map[string]*kv.Replica
+	down     map[string]bool
+}
+
+// transport is the transport of the replica of from.
+type transport struct {
+	net  *network
+	from string
+}
+
+func (t transport) replica(name string) (*kv.Replica, error) {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+
+	r := t.net.replicas[name]
+	if r == nil || t.net.down[name] || t.net.down[t.from] {
+		return nil, errors.New("unreachable")
+	}
+	return r, nil
+}
+
+func (t transport) RequestVote(ctx context.Context, to raft.Server, req *raft.VoteRequest) (*raft.VoteResponse, error) {
+	r, err := t.replica(to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return r.Raft().HandleRequestVote(req)
+}
+
+func (t transport) AppendEntries(ctx context.Context, to raft.Server, req *raft.AppendRequest) (*raft.AppendResponse, error) {
+	r, err := t.replica(to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return r.Raft().HandleAppendEntries(req)
+}
+
+func (t transport) InstallSnapshot(ctx context.Context, to raft.Server, req *raft.SnapshotRequest) (*raft.SnapshotResponse, error) {
+	r, err := t.replica(to.ID)
+	if err != nil {
+		return nil, err
+	}
+	return r.Raft().HandleInstallSnapshot(req)
+}
+
+func (t transport) Propose(ctx context.Context, leader string, c kv.Change) (kv.Entry, error) {
+	r, err := t.replica(leader)
+	if err != nil {
+		return kv.Entry{}, err
+	}
+	return r.HandlePropose(ctx, c)
+}
+
+func (t transport) Join(ctx context.Context, to string) error {
+	r, err := t.replica(to)
+	if err != nil {
+		return err
+	}
+	return r.HandleJoin(ctx, raft.Server{ID: t.from})
+}
+
+func (t transport) Remove(ctx context.Context, leader, name string) error {
+	r, err := t.replica(leader)
+	if err != nil {
+		return err
+	}
+	return r.HandleRemove(ctx, name)
+}
+
+func TestReplica(t *testing.T) {
+	dir := t.TempDir()
+	net := &network{replicas: make(map[string]*kv.Replica), down: make(map[string]bool)}
+	names := []string{"a", "b", "c"}
+
+	start := func(name string, bootstrap bool) (*kv.Replica, func()) {
+		t.Helper()
+		r, err := kv.New(kv.Config{
+			Name:      name,
+			Transport: transport{net, name},
+			Nodes:     func() []string { return names },
+			Raft: raft.Config{
+				Dir:               filepath.Join(dir, name),
+				Bootstrap:         bootstrap,
+				HeartbeatInterval: 10 * time.Millisecond,
+				ElectionTimeout:   100 * time.Millisecond,
+				SnapshotThreshold: 64,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.mu.Lock()
+		net.replicas[name] = r
+		net.mu.Unlock()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.Run(ctx)
+		}()
+		stop := sync.OnceFunc(func() {
+			cancel()
+			<-done
+		})
+		t.Cleanup(stop)
+		return r, stop
+	}
+	wait := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	// put puts through r, retrying while the replicas elect a leader.
+	put := func(r *kv.Replica, key, value string) kv.Entry {
+		t.Helper()
+		var e kv.Entry
+		wait("a leader to put through", func() bool {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			var err error
+			e, err = r.Put(ctx, key, []byte(value))
+			return err == nil
+		})
+		return e
+	}
+
+	a, stopA := start("a", true)
+	b, stopB := start("b", false)
+	c, stopC := start("c", false)
+	wait("the replicas to join", func() bool {
+		return len(b.Status().Servers) == 3 && len(c.Status().Servers) == 3
+	})
+	if !a.IsLeader() || b.Leader() != "a" {
+		t.Fatalf("a leads %v, b follows %q", a.IsLeader(), b.Leader())
+	}
+
+	ctx := context.Background()
+	first, err := a.Put(ctx, "config/version", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A change made through a follower is in its replica once made, and
+	// stamped after the changes before it.
+	e, err := b.Put(ctx, "revocations/12", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Time.IsZero() || !first.Time.Before(e.Time) {
+		t.Errorf("change stamped %v after one stamped %v", e.Time, first.Time)
+	}
+	if got, ok := b.Get("revocations/12"); !ok || got.Version != e.Version {
+		t.Errorf("follower has %+v, %v after its put", got, ok)
+	}
+	v := e.Version - 1
+	if _, err := b.Apply(ctx, kv.Change{Op: kv.Put, Key: "revocations/12", IfVersion: &v}); err != kv.ErrConflict {
+		t.Errorf("put of an old version through a follower: %v", err)
+	}
+	if _, err := b.HandlePropose(ctx, kv.Change{Op: kv.Put, Key: "x"}); err != kv.ErrNotLeader {
+		t.Errorf("follower handled a proposal: %v", err)
+	}
+
+	// The others elect another leader once the leader fails, and the
+	// changes made meanwhile reach it once it is back, by snapshot if
+	// the leader compacted them.
+	net.mu.Lock()
+	net.down["a"] = true
+	net.mu.Unlock()
+	for i := range 100 {
+		put(c, fmt.Sprint("peers/", i%10), fmt.Sprint(i))
+	}
+	if b.Leader() == "a" || !b.IsLeader() && !c.IsLeader() {
+		t.Errorf("b follows %q after a failed", b.Leader())
+	}
+	net.mu.Lock()
+	net.down["a"] = false
+	net.mu.Unlock()
+	wait("a to catch up", func() bool { return a.Index() == c.Index() && b.Index() == c.Index() })
+	for _, r := range []*kv.Replica{a, b, c} {
+		if got := r.List(""); len(got) != 12 || string(got[10].Value) != "99" {
+			t.Errorf("replica has %+v", got)
+		}
+	}
+
+	// A replica removed leaves the cluster.
+	if err := a.Remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	wait("a to leave", func() bool { return len(b.Status().Servers) == 2 })
+	stopA()
+	e = put(b, "peers/0", "removed")
+
+	// Replicas read their state back from their directory.
+	stopB()
+	stopC()
+	b, _ = start("b", false)
+	c, _ = start("c", false)
+	wait("the replicas to read back", func() bool {
+		got, ok := c.Get("peers/0")
+		return b.Index() >= e.Version && ok && string(got.Value) == "removed"
+	})
+	if got := b.List("peers/"); len(got) != 10 {
+		t.Errorf("read back %d peers", len(got))
+	}
+}
+
+func TestElection(t *testing.T) {
+	net := &network{replicas: make(map[string]*kv.Replica), down: make(map[string]bool)}
+	names := []string{"a", "b", "c"}
+
+	// running counts the duties running, and leaders receives the name of
+	// the node of every duty started.
+	var running atomic.Int32
+	var overlap atomic.Bool
+	leaders := make(chan string, 10)
+	campaigns := make(map[string]context.CancelFunc)
+	replicas := make(map[string]*kv.Replica)
+	for i, name := range names {
+		r, err := kv.New(kv.Config{
+			Name:      name,
+			Transport: transport{net, name},
+			Nodes:     func() []string { return names },
+			LeaseTTL:  200 * time.Millisecond,
+			Raft: raft.Config{
+				Bootstrap:         i == 0,
+				HeartbeatInterval: 10 * time.Millisecond,
+				ElectionTimeout:   100 * time.Millisecond,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.mu.Lock()
+		net.replicas[name] = r
+		net.mu.Unlock()
+		replicas[name] = r
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r.Run(ctx)
+		}()
+		lctx, lcancel := context.WithCancel(ctx)
+		campaigns[name] = lcancel
+		go func() {
+			defer wg.Done()
+			r.Lead(lctx, "crl", func(ctx context.Context) {
+				if running.Add(1) > 1 {
+					overlap.Store(true)
+				}
+				leaders <- name
+				<-ctx.Done()
+				running.Add(-1)
+			})
+		}()
+		t.Cleanup(func() {
+			cancel()
+			wg.Wait()
+		})
+	}
+
+	if err := replicas["a"].Lead(context.Background(), "a/b", func(context.Context) {}); err == nil {
+		t.Error("campaign in an election of an invalid name")
+	}
+
+	// next waits for a leader other than not.
+	next := func(not string) string {
+		t.Helper()
+		for {
+			select {
+			case l := <-leaders:
+				if l != not {
+					return l
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for a leader")
+			}
+		}
+	}
+
+	l := next("")
+	wait := func(what string, cond func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	wait("the lease in every replica", func() bool {
+		for _, r := range replicas {
+			if leases := r.Leases(); len(leases) != 1 || leases[0].Election != "crl" || leases[0].Holder != l {
+				return false
+			}
+		}
+		return true
+	})
+
+	// A leader done resigns, and another takes over.
+	campaigns[l]()
+	l = next(l)
+
+	// A leader cut off from the others loses its lease once it expires,
+	// and another takes over.
+	net.mu.Lock()
+	net.down[l] = true
+	net.mu.Unlock()
+	cut := l
+	l = next(cut)
+	if got := replicas[l].Leases(); len(got) != 1 || got[0].Holder != l {
+		t.Errorf("leases %+v led by %s", got, l)
+	}
+	if overlap.Load() {
+		t.Error("duties ran at once")
+	}
+}
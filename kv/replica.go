@@ -0,0 +1,323 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"nih.software/hlc"
+	"nih.software/log"
+	"nih.software/raft"
+)
+
+// DefaultDir is the name of the directory of a replica in the state
+// directory of a node.
+const DefaultDir = "kv"
+
+// retryInterval is the time a replica of no cluster waits, give or take a
+// fifth, before it asks the nodes to add it again.
+const retryInterval = time.Second
+
+// A Transport carries the messages of replicas. Its methods, and those of
+// raft.Transport, deliver them to the replica of a node by name, the ID of
+// its raft server, and fail unless it is that node that answers.
+type Transport interface {
+	raft.Transport
+
+	// Propose delivers c to the Replica.HandlePropose of leader. It fails
+	// with ErrConflict, ErrFull, ErrNotLeader, or ErrNoLeader if the
+	// leader does.
+	Propose(ctx context.Context, leader string, c Change) (Entry, error)
+
+	// Join delivers the request of the replica to be added to the cluster
+	// to the Replica.HandleJoin of to, which knows the address of the
+	// replica if the transport needs one.
+	Join(ctx context.Context, to string) error
+
+	// Remove delivers the removal of the node named name to the
+	// Replica.HandleRemove of leader.
+	Remove(ctx context.Context, leader, name string) error
+}
+
+// Config configures a Replica. Name and Transport are required.
+type Config struct {
+	// Name is the name of the node.
+	Name string
+
+	Transport Transport
+
+	// Nodes, if not nil, returns the names of the other nodes, which a
+	// replica of no cluster asks to add it, until the leader does.
+	Nodes func() []string
+
+	// Clock, if not nil, is the clock of the node, which stamps the
+	// changes the replica leads and is updated with those of others,
+	// instead of a clock of its own.
+	Clock *hlc.Clock
+
+	// LeaseTTL is the TTL of the leases of the elections the node leads,
+	// DefaultLeaseTTL if 0.
+	LeaseTTL time.Duration
+
+	// Raft configures the raft server of the replica, but for its ID,
+	// transport, and state machine, which are the name, transport, and
+	// store of the replica. A replica keeps its state in memory only
+	// unless its directory is set.
+	Raft raft.Config
+}
+
+// A Replica is the replica of the store of a node, a raft server of the
+// cluster replicating it.
+type Replica struct {
+	cfg   Config
+	clock *hlc.Clock
+	store Store
+	node  *raft.Node
+}
+
+// A result is the result of a change applied by the store.
+type result struct {
+	e   Entry
+	err error
+}
+
+// machine is a replica as the state machine of raft.
+type machine Replica
+
+func (m *machine) Apply(index uint64, data []byte) any {
+	var c Change
+	if err := json.Unmarshal(data, &c); err != nil {
+		return result{err: err}
+	}
+	c.Index = index
+	if _, err := m.clock.Update(c.Time); err != nil {
+		log.Default().Debug("kv: clock", "index", index, "err", err)
+	}
+	e, err := m.store.Apply(c)
+	return result{e, err}
+}
+
+func (m *machine) Snapshot() ([]byte, error) {
+	return json.Marshal(m.store.Snapshot())
+}
+
+func (m *machine) Restore(data []byte) error {
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	m.store.Restore(&snap)
+	return nil
+}
+
+// New returns the replica of cfg, read from its directory if it has one.
+func New(cfg Config) (*Replica, error) {
+	if cfg.Name == "" || cfg.Transport == nil {
+		return nil, errors.New("kv: a replica needs a name and a transport")
+	}
+
+	r := &Replica{cfg: cfg, clock: cfg.Clock}
+	if r.clock == nil {
+		r.clock = &hlc.Clock{}
+	}
+	rc := cfg.Raft
+	rc.ID = cfg.Name
+	rc.Transport = cfg.Transport
+	rc.StateMachine = (*machine)(r)
+	node, err := raft.New(rc)
+	if err != nil {
+		return nil, err
+	}
+	r.node = node
+	return r, nil
+}
+
+// Raft returns the raft server of the replica, whose requests the
+// transport delivers to it.
+func (r *Replica) Raft() *raft.Node {
+	return r.node
+}
+
+// Status returns the state of the raft server of the replica.
+func (r *Replica) Status() raft.Status {
+	return r.node.Status()
+}
+
+// Leader returns the name of the node leading the store, or "" if the
+// replica knows of none.
+func (r *Replica) Leader() string {
+	return r.node.Leader()
+}
+
+// IsLeader reports whether the node of r leads the store.
+func (r *Replica) IsLeader() bool {
+	return r.node.IsLeader()
+}
+
+// Index returns the index of the last change of the replica.
+func (r *Replica) Index() uint64 {
+	return r.store.Index()
+}
+
+// Get returns the entry of key in the replica, and whether there is one.
+func (r *Replica) Get(key string) (Entry, bool) {
+	return r.store.Get(key)
+}
+
+// List returns the entries of the replica whose keys start with prefix, in
+// key order.
+func (r *Replica) List(prefix string) []Entry {
+	return r.store.List(prefix)
+}
+
+// Put sets key to value.
+func (r *Replica) Put(ctx context.Context, key string, value []byte) (Entry, error) {
+	if value == nil {
+		value = []byte{}
+	}
+	return r.Apply(ctx, Change{Op: Put, Key: key, Value: value})
+}
+
+// Delete deletes key, if the store has it.
+func (r *Replica) Delete(ctx context.Context, key string) (Entry, error) {
+	return r.Apply(ctx, Change{Op: Delete, Key: key})
+}
+
+// Apply makes the change c, whose index and time it sets, through the leader,
+// and returns the entry it made once the replica has it, as Store.Apply
+// does. It fails with ErrNoLeader if the replica knows of no leader, or
+// of one that stepped down. If ctx is done first, the change may have been
+// made all the same.
+func (r *Replica) Apply(ctx context.Context, c Change) (Entry, error) {
+	c.Index, c.Time = 0, r.clock.Now()
+	if err := c.Check(); err != nil {
+		return Entry{}, err
+	}
+	if r.IsLeader() {
+		return r.HandlePropose(ctx, c)
+	}
+
+	leader := r.Leader()
+	if leader == "" {
+		return Entry{}, ErrNoLeader
+	}
+	e, err := r.cfg.Transport.Propose(ctx, leader, c)
+	if err == ErrNotLeader {
+		// The leader the replica knows of stepped down.
+		return Entry{}, ErrNoLeader
+	} else if err != nil {
+		return Entry{}, err
+	}
+	if err := r.store.Wait(ctx, e.Version-1); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+// HandlePropose makes the change c a follower proposes, if r leads the
+// store, once a majority of the replicas has it. The change is stamped by
+// the clock of r, once updated with the time of c.
+func (r *Replica) HandlePropose(ctx context.Context, c Change) (Entry, error) {
+	if err := c.Check(); err != nil {
+		return Entry{}, err
+	}
+	if _, err := r.clock.Update(c.Time); err != nil {
+		log.Default().Debug("kv: clock", "key", c.Key, "err", err)
+	}
+	c.Time = r.clock.Now()
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	res, err := r.node.Propose(ctx, data)
+	if err == raft.ErrNotLeader {
+		return Entry{}, ErrNotLeader
+	} else if err != nil {
+		return Entry{}, err
+	}
+	return res.(result).e, res.(result).err
+}
+
+// HandleJoin adds the raft server s, the replica of another node, to the
+// cluster, if r leads the store.
+func (r *Replica) HandleJoin(ctx context.Context, s raft.Server) error {
+	err := r.node.AddVoter(ctx, s)
+	if err == raft.ErrNotLeader {
+		return ErrNotLeader
+	} else if err == nil {
+		log.Default().Info("kv: added", "name", s.ID, "addr", s.Addr)
+	}
+	return err
+}
+
+// Remove removes the replica of the node named name from the cluster,
+// through the leader. A node removed must start with a replica of no
+// state to join again.
+func (r *Replica) Remove(ctx context.Context, name string) error {
+	if r.IsLeader() {
+		return r.HandleRemove(ctx, name)
+	}
+	leader := r.Leader()
+	if leader == "" {
+		return ErrNoLeader
+	}
+	return r.cfg.Transport.Remove(ctx, leader, name)
+}
+
+// HandleRemove removes the replica of the node named name from the
+// cluster, if r leads the store.
+func (r *Replica) HandleRemove(ctx context.Context, name string) error {
+	for _, s := range r.node.Servers() {
+		if s.ID == name {
+			err := r.node.RemoveServer(ctx, name)
+			if err == raft.ErrNotLeader {
+				return ErrNotLeader
+			} else if err == nil {
+				log.Default().Info("kv: removed", "name", name)
+			}
+			return err
+		}
+	}
+	if !r.IsLeader() {
+		return ErrNotLeader
+	}
+	return ErrNoReplica
+}
+
+// Run runs the raft server of the replica until ctx is done. A replica of
+// no cluster asks the nodes to add it meanwhile, until the leader does.
+func (r *Replica) Run(ctx context.Context) {
+	if len(r.node.Servers()) == 0 && r.cfg.Nodes != nil {
+		go r.join(ctx)
+	}
+	r.node.Run(ctx)
+}
+
+// join asks the nodes to add the replica to the cluster, until one of
+// them does or ctx is done.
+func (r *Replica) join(ctx context.Context) {
+	for {
+		for _, name := range r.cfg.Nodes() {
+			err := r.cfg.Transport.Join(ctx, name)
+			if err == nil {
+				log.Default().Info("kv: joined", "through", name)
+				return
+			}
+			log.Default().Debug("kv: join", "through", name, "err", err)
+		}
+
+		t := time.NewTimer(time.Duration(float64(retryInterval) * (0.8 + 0.4*rand.Float64())))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+		if len(r.node.Servers()) > 0 {
+			return
+		}
+	}
+}
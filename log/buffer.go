@@ -0,0 +1,211 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// An Entry is a log record kept by a Buffer.
+type Entry struct {
+	Time    time.Time  `json:"time"`
+	Level   slog.Level `json:"level"`
+	Message string     `json:"msg"`
+	Attrs   []Attr     `json:"attrs,omitempty"`
+}
+
+// An Attr is a key/value pair of an Entry. Keys of attributes in groups
+// are qualified with the group names, as in "group.key".
+type Attr struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// followBuffer is the number of entries a follower may fall behind by
+// before it misses some.
+const followBuffer = 256
+
+// A Buffer keeps the most recent log entries, for a daemon to serve them,
+// and passes new ones on to followers. Its Handler records into it.
+type Buffer struct {
+	mu        sync.Mutex
+	entries   []Entry // a ring of up to size entries
+	next      int     // index of the oldest entry once the ring is full
+	size      int
+	followers map[chan Entry]struct{}
+}
+
+// NewBuffer returns a buffer keeping the last size entries.
+func NewBuffer(size int) *Buffer {
+	return &Buffer{size: size, followers: make(map[chan Entry]struct{})}
+}
+
+func (b *Buffer) add(e Entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.entries) < b.size {
+		b.entries = append(b.entries, e)
+	} else {
+		b.entries[b.next] = e
+		b.next = (b.next + 1) % b.size
+	}
+
+	for c := range b.followers {
+		// Logging never waits for a follower; a slow one misses entries.
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// Entries returns the kept entries, oldest first.
+func (b *Buffer) Entries() []Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.entriesLocked()
+}
+
+func (b *Buffer) entriesLocked() []Entry {
+	return append(append([]Entry{}, b.entries[b.next:]...), b.entries[:b.next]...)
+}
+
+// Follow returns the kept entries, oldest first, and a channel receiving
+// every entry added afterwards until stop is called. A follower that falls
+// behind by more than a few hundred entries misses the entries in between.
+func (b *Buffer) Follow() (past []Entry, next <-chan Entry, stop func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := make(chan Entry, followBuffer)
+	b.followers[c] = struct{}{}
+
+	stop = sync.OnceFunc(func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.followers, c)
+	})
+
+	return b.entriesLocked(), c, stop
+}
+
+// Handler returns a handler recording the records at or above level in b.
+func (b *Buffer) Handler(level slog.Leveler) slog.Handler {
+	return &bufferHandler{b: b, level: level}
+}
+
+type bufferHandler struct {
+	b      *Buffer
+	level  slog.Leveler
+	attrs  []Attr
+	prefix string // the open groups, each followed by "."
+}
+
+func (h *bufferHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *bufferHandler) Handle(_ context.Context, r slog.Record) error {
+	e := Entry{
+		Time:    r.Time,
+		Level:   r.Level,
+		Message: r.Message,
+		Attrs:   append([]Attr{}, h.attrs...),
+	}
+
+	r.Attrs(func(a slog.Attr) bool {
+		e.Attrs = appendAttr(e.Attrs, h.prefix, a)
+		return true
+	})
+
+	h.b.add(e)
+	return nil
+}
+
+func (h *bufferHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]Attr{}, h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = appendAttr(h2.attrs, h.prefix, a)
+	}
+	return &h2
+}
+
+func (h *bufferHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// appendAttr appends a, flattening groups, as slog's text handler does.
+func appendAttr(attrs []Attr, prefix string, a slog.Attr) []Attr {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			attrs = appendAttr(attrs, prefix, ga)
+		}
+		return attrs
+	}
+
+	if a.Equal(slog.Attr{}) {
+		return attrs
+	}
+
+	return append(attrs, Attr{Key: prefix + a.Key, Value: v.String()})
+}
+
+// Tee returns a logger passing every record to each of handlers
+// enabled for its level, such as a handler writing to standard error
+// and that of a Buffer.
+func Tee(handlers ...slog.Handler) *slog.Logger {
+	return slog.New(teeHandler(handlers))
+}
+
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	t2 := make(teeHandler, len(t))
+	for i, h := range t {
+		t2[i] = h.WithAttrs(attrs)
+	}
+	return t2
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	t2 := make(teeHandler, len(t))
+	for i, h := range t {
+		t2[i] = h.WithGroup(name)
+	}
+	return t2
+}
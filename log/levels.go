@@ -0,0 +1,119 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Component returns the component of a log message: the word it starts
+// with, before a colon, as "raft" of "raft: elected", or "" for none.
+func Component(msg string) string {
+	c, _, ok := strings.Cut(msg, ": ")
+	if !ok || c == "" || strings.ContainsAny(c, " \t") {
+		return ""
+	}
+	return c
+}
+
+// Levels are the minimum levels of logs, with overrides for the messages
+// of some components, as Component names them, so that one subsystem
+// logs at debug while the others keep quiet. Their text form, as flags
+// take it, is the default level, then component=level pairs, separated
+// by commas:
+//
+//	warn,raft=debug,daemon=info
+//
+// Levels is a slog.Leveler of the lowest of its levels; New filters the
+// records of each component by its own.
+type Levels struct {
+	Default    slog.Level
+	Components map[string]slog.Level
+}
+
+// Level implements slog.Leveler, returning the lowest level of l.
+func (l Levels) Level() slog.Level {
+	lowest := l.Default
+	for _, lv := range l.Components {
+		lowest = min(lowest, lv)
+	}
+	return lowest
+}
+
+// For returns the minimum level of the messages of component.
+func (l Levels) For(component string) slog.Level {
+	if lv, ok := l.Components[component]; ok {
+		return lv
+	}
+	return l.Default
+}
+
+func (l Levels) String() string {
+	parts := []string{l.Default.String()}
+	for c, lv := range l.Components {
+		parts = append(parts, c+"="+lv.String())
+	}
+	sort.Strings(parts[1:])
+	return strings.ToLower(strings.Join(parts, ","))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (l Levels) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. A component=level
+// pair may come first, leaving the default level as it was.
+func (l *Levels) UnmarshalText(text []byte) error {
+	next := Levels{Default: l.Default}
+	for _, s := range strings.Split(string(text), ",") {
+		c, v, ok := strings.Cut(strings.TrimSpace(s), "=")
+		if !ok {
+			v, c = c, ""
+		}
+		var lv slog.Level
+		if err := lv.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("log level %q: %w", s, err)
+		}
+		switch {
+		case !ok:
+			next.Default = lv
+		case c == "" || strings.ContainsAny(c, " \t"):
+			return fmt.Errorf("invalid component in %q", s)
+		default:
+			if next.Components == nil {
+				next.Components = make(map[string]slog.Level)
+			}
+			next.Components[c] = lv
+		}
+	}
+	*l = next
+	return nil
+}
+
+// levelsHandler drops the records below the level of their component.
+type levelsHandler struct {
+	h      slog.Handler
+	levels Levels
+}
+
+func (h *levelsHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.levels.Level() && h.h.Enabled(ctx, level)
+}
+
+func (h *levelsHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < h.levels.For(Component(r.Message)) {
+		return nil
+	}
+	return h.h.Handle(ctx, r)
+}
+
+func (h *levelsHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelsHandler{h.h.WithAttrs(attrs), h.levels}
+}
+
+func (h *levelsHandler) WithGroup(name string) slog.Handler {
+	return &levelsHandler{h.h.WithGroup(name), h.levels}
+}
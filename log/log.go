@@ -0,0 +1,89 @@
+// Package log provides the structured logger shared by nih commands and subsystems.
+//
+// Logs are diagnostics for operators and go to standard error;
+// they are separate from the messages of package cli/ui and the results of package cli/output.
+// A daemon also records them in a Buffer, through Tee, to serve them to "nih logs".
+// Messages start with the component logging them, which Levels may log at
+// a level of its own.
+// The logger is a log/slog Logger, so callers log with key/value pairs:
+//
+//	log.Default().Debug("trust: verify peer", "serial", crt.SerialNumber, "err", err)
+package log
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// Levels, re-exported from log/slog for flag defaults.
+const (
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+)
+
+// Format selects how log records are encoded.
+type Format int
+
+const (
+	Text Format = iota // logfmt-style key=value pairs
+	JSON               // one JSON object per line
+)
+
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	default:
+		return "text"
+	}
+}
+
+// Set implements flag.Value.
+func (f *Format) Set(s string) error {
+	switch s {
+	case "text":
+		*f = Text
+	case "json":
+		*f = JSON
+	default:
+		return fmt.Errorf("unknown log format %q", s)
+	}
+	return nil
+}
+
+// New returns a logger writing records at or above level to w in the given format.
+// With Levels, each record must be at or above the level of its component.
+func New(w io.Writer, level slog.Leveler, f Format) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if f == JSON {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	if l, ok := level.(Levels); ok && len(l.Components) > 0 {
+		h = &levelsHandler{h, l}
+	}
+	return slog.New(h)
+}
+
+var std atomic.Pointer[slog.Logger]
+
+func init() {
+	std.Store(New(os.Stderr, LevelWarn, Text))
+}
+
+// Default returns the shared logger.
+// Until SetDefault is called, it writes warnings and errors to standard error as text.
+func Default() *slog.Logger {
+	return std.Load()
+}
+
+// SetDefault replaces the shared logger.
+// It is safe to call concurrently with Default.
+func SetDefault(l *slog.Logger) {
+	std.Store(l)
+}
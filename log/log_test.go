@@ -0,0 +1,169 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	for _, s := range []string{"text", "json"} {
+		var f Format
+		if err := f.Set(s); err != nil {
+			t.Fatal(err)
+		}
+		if f.String() != s {
+			t.Errorf("Set(%q).String() = %q", s, f)
+		}
+	}
+
+	var f Format
+	if err := f.Set("xml"); err == nil {
+		t.Error("Set(xml) succeeded")
+	}
+}
+
+func TestNew(t *testing.T) {
+	var b bytes.Buffer
+	l := New(&b, LevelInfo, JSON)
+	l.Debug("hidden")
+	l.Info("shown", "serial", 42)
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1:\n%s", len(lines), b.String())
+	}
+
+	var rec struct {
+		Level  string
+		Msg    string
+		Serial int
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Level != "INFO" || rec.Msg != "shown" || rec.Serial != 42 {
+		t.Errorf("got %+v", rec)
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	old := Default()
+	defer SetDefault(old)
+
+	var b bytes.Buffer
+	SetDefault(New(&b, LevelDebug, Text))
+	Default().Debug("hello", "k", "v")
+
+	if got := b.String(); !strings.Contains(got, "level=DEBUG msg=hello k=v") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	b := NewBuffer(2)
+	l := slog.New(b.Handler(LevelInfo)).With("node", "a").WithGroup("req")
+	l.Debug("hidden")
+	l.Info("one", "n", 1)
+
+	past, next, stop := b.Follow()
+	l.Warn("two", slog.Group("peer", "cn", "b"))
+	l.Error("three")
+
+	if len(past) != 1 || past[0].Message != "one" {
+		t.Fatalf("past %+v", past)
+	}
+	want := []Attr{{"node", "a"}, {"req.n", "1"}}
+	if !slices.Equal(past[0].Attrs, want) {
+		t.Errorf("attrs %+v, want %+v", past[0].Attrs, want)
+	}
+
+	if e := <-next; e.Message != "two" || e.Level != LevelWarn || !slices.Equal(e.Attrs, []Attr{{"node", "a"}, {"req.peer.cn", "b"}}) {
+		t.Errorf("followed %+v", e)
+	}
+	if e := <-next; e.Message != "three" {
+		t.Errorf("followed %+v", e)
+	}
+	stop()
+
+	// The ring keeps the last two.
+	var msgs []string
+	for _, e := range b.Entries() {
+		msgs = append(msgs, e.Message)
+	}
+	if !slices.Equal(msgs, []string{"two", "three"}) {
+		t.Errorf("entries %q", msgs)
+	}
+}
+
+func TestTee(t *testing.T) {
+	var text bytes.Buffer
+	b := NewBuffer(10)
+	l := Tee(New(&text, LevelWarn, Text).Handler(), b.Handler(LevelDebug))
+	l.Debug("quiet")
+	l.Warn("loud")
+
+	if got := text.String(); strings.Contains(got, "quiet") || !strings.Contains(got, "msg=loud") {
+		t.Errorf("text %q", got)
+	}
+	if got := b.Entries(); len(got) != 2 {
+		t.Errorf("buffer has %d entries, want 2", len(got))
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var l Levels
+	if err := l.UnmarshalText([]byte("info, raft=debug,daemon=ERROR")); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.String(); got != "info,daemon=error,raft=debug" {
+		t.Errorf("String() = %q", got)
+	}
+	if l.Level() != LevelDebug || l.For("daemon") != LevelError || l.For("kv") != LevelInfo {
+		t.Errorf("levels %+v", l)
+	}
+	for _, s := range []string{"loud", "=debug", "raft=loud", "a b=info"} {
+		if err := new(Levels).UnmarshalText([]byte(s)); err == nil {
+			t.Errorf("UnmarshalText(%q) succeeded", s)
+		}
+	}
+
+	var b bytes.Buffer
+	logger := New(&b, l, Text).With("node", "a")
+	logger.Debug("raft: shown")
+	logger.Debug("kv: hidden")
+	logger.Warn("daemon: hidden")
+	logger.Info("no component")
+	if got := b.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "raft: shown") || !strings.Contains(got, "no component") {
+		t.Errorf("logged %q", got)
+	}
+
+	if c := Component("daemon: files: send"); c != "daemon" {
+		t.Errorf("Component = %q", c)
+	}
+	if c := Component("no component: here"); c != "" {
+		t.Errorf("Component = %q", c)
+	}
+}
+
+func TestSample(t *testing.T) {
+	b := NewBuffer(100)
+	l := slog.New(Sample(b.Handler(LevelDebug), 2, 3, time.Hour))
+	for range 10 {
+		l.Info("flood")
+	}
+	l.Info("other")
+
+	var msgs []string
+	for _, e := range b.Entries() {
+		msgs = append(msgs, e.Message)
+	}
+	// The first two, then the 5th and 8th.
+	if want := []string{"flood", "flood", "flood", "flood", "other"}; !slices.Equal(msgs, want) {
+		t.Errorf("entries %q, want %q", msgs, want)
+	}
+}
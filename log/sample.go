@@ -0,0 +1,70 @@
+package log
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Sample returns a handler passing the records of h, but of those of the
+// same level and message within every tick, only the first first, then
+// every thereafter-th, so that a flood of one message, such as a peer
+// failing every handshake, does not drown the others. Zero thereafter
+// drops every record after the first ones.
+func Sample(h slog.Handler, first, thereafter int, tick time.Duration) slog.Handler {
+	return &sampleHandler{h: h, s: &sampler{first: first, thereafter: thereafter, tick: tick}}
+}
+
+// A sampler counts the records of every level and message of a tick.
+type sampler struct {
+	first, thereafter int
+	tick              time.Duration
+
+	mu     sync.Mutex
+	start  time.Time
+	counts map[sampleKey]int
+}
+
+type sampleKey struct {
+	level slog.Level
+	msg   string
+}
+
+// keep reports whether to pass the record of level and msg at t.
+func (s *sampler) keep(t time.Time, level slog.Level, msg string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts == nil || t.Sub(s.start) >= s.tick {
+		s.start, s.counts = t, make(map[sampleKey]int)
+	}
+	k := sampleKey{level, msg}
+	s.counts[k]++
+	n := s.counts[k]
+	return n <= s.first || s.thereafter > 0 && (n-s.first)%s.thereafter == 0
+}
+
+type sampleHandler struct {
+	h slog.Handler
+	s *sampler
+}
+
+func (h *sampleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+func (h *sampleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !h.s.keep(r.Time, r.Level, r.Message) {
+		return nil
+	}
+	return h.h.Handle(ctx, r)
+}
+
+func (h *sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampleHandler{h.h.WithAttrs(attrs), h.s}
+}
+
+func (h *sampleHandler) WithGroup(name string) slog.Handler {
+	return &sampleHandler{h.h.WithGroup(name), h.s}
+}
@@ -0,0 +1,195 @@
+package nihnet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"nih.software/log"
+)
+
+// Limits bound the connections an instance accepts, so that a
+// misbehaving peer cannot exhaust it. Zero fields mean no limit. The
+// limits of a peer apply to its address, as its identity is only known
+// once the handshake completed.
+type Limits struct {
+	// Conns and PeerConns bound the connections open at once, of all
+	// peers and of every address.
+	Conns     int
+	PeerConns int
+
+	// HandshakeRate and PeerHandshakeRate bound the connections accepted
+	// a second, each of which costs a handshake, of all peers and of
+	// every address, allowing bursts of a second's worth.
+	HandshakeRate     float64
+	PeerHandshakeRate float64
+}
+
+// peerPrune is how often a Limiter forgets the addresses without
+// connections.
+const peerPrune = time.Minute
+
+// A Limiter enforces Limits on the connections of listeners, which it
+// refuses by closing them before the handshake. Its limits may change
+// while it enforces them.
+type Limiter struct {
+	mu      sync.Mutex
+	limits  Limits
+	conns   int
+	rate    bucket
+	peers   map[string]*peerLimit
+	pruned  time.Time
+	refused int64
+}
+
+// peerLimit is the state of the connections of an address.
+type peerLimit struct {
+	conns int
+	rate  bucket
+}
+
+// A bucket is a token bucket, of a second's worth of tokens.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token from b, filled at rate a second, and reports whether
+// it had one.
+func (b *bucket) take(now time.Time, rate float64) bool {
+	burst := max(rate, 1)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// NewLimiter returns a limiter enforcing limits.
+func NewLimiter(limits Limits) *Limiter {
+	return &Limiter{limits: limits, peers: make(map[string]*peerLimit)}
+}
+
+// SetLimits changes the limits of l, for the connections accepted next.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// Refused returns how many connections l refused.
+func (l *Limiter) Refused() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.refused
+}
+
+// admit admits a connection from addr, returning the function releasing
+// it once closed, or why it is refused.
+func (l *Limiter) admit(addr net.Addr) (func(), error) {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.pruned) >= peerPrune {
+		l.prune(now)
+	}
+	// Addresses are only kept once admitted, so that refused connections
+	// from ever new addresses do not grow l.peers.
+	p := l.peers[host]
+	if p == nil {
+		p = &peerLimit{}
+	}
+
+	lim := l.limits
+	var err error
+	switch {
+	case lim.Conns > 0 && l.conns >= lim.Conns:
+		err = fmt.Errorf("limit of %d connections reached", lim.Conns)
+	case lim.PeerConns > 0 && p.conns >= lim.PeerConns:
+		err = fmt.Errorf("limit of %d connections from %s reached", lim.PeerConns, host)
+	case lim.HandshakeRate > 0 && !l.rate.take(now, lim.HandshakeRate):
+		err = fmt.Errorf("limit of %g connections a second reached", lim.HandshakeRate)
+	case lim.PeerHandshakeRate > 0 && !p.rate.take(now, lim.PeerHandshakeRate):
+		err = fmt.Errorf("limit of %g connections a second from %s reached", lim.PeerHandshakeRate, host)
+	}
+	if err != nil {
+		l.refused++
+		return nil, err
+	}
+
+	l.peers[host] = p
+	l.conns++
+	p.conns++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.conns--
+			p.conns--
+		})
+	}, nil
+}
+
+// prune forgets the addresses without connections, whose buckets are
+// full again. The caller must hold l.mu.
+func (l *Limiter) prune(now time.Time) {
+	l.pruned = now
+	for host, p := range l.peers {
+		if p.conns == 0 && now.Sub(p.rate.last) >= time.Second {
+			delete(l.peers, host)
+		}
+	}
+}
+
+// Listener returns a listener accepting the connections of inner that l
+// admits, and closing the others, each of which it logs with the reason.
+// Closing the listener closes inner.
+func (l *Limiter) Listener(inner net.Listener) net.Listener {
+	return &limitListener{Listener: inner, l: l}
+}
+
+type limitListener struct {
+	net.Listener
+	l *Limiter
+}
+
+func (ll *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, err := ll.l.admit(c.RemoteAddr())
+		if err != nil {
+			log.Default().Warn("nihnet: connection refused", "addr", c.RemoteAddr().String(), "reason", err)
+			c.Close()
+			continue
+		}
+		return &limitConn{Conn: c, release: release}, nil
+	}
+}
+
+// A limitConn releases its admission once closed.
+type limitConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
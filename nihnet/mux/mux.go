@@ -0,0 +1,475 @@
+// Package mux multiplexes streams over a single connection, so that the
+// RPCs, log streams, and file transfers between two instances share one
+// mutually authenticated connection rather than hand shaking for each.
+//
+// Either end of a Session opens streams, which the other end accepts. A
+// stream is a reliable, ordered, bidirectional byte stream, like a TCP
+// connection, with flow control of its own, so that a stream whose reader
+// falls behind does not hold up the others.
+//
+// The framing follows yamux: every frame has a 12-byte header of a version,
+// a type, flags, a stream ID, and a length, and data frames are followed by
+// that many bytes of data.
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"nih.software/log"
+)
+
+var (
+	// ErrSessionClosed is returned by the operations of a session, and of
+	// its streams, after either end closed it.
+	ErrSessionClosed = errors.New("mux: session closed")
+
+	// ErrStreamClosed is returned by the operations of a stream after it
+	// was closed, and by Write after CloseWrite.
+	ErrStreamClosed = errors.New("mux: stream closed")
+
+	// ErrStreamReset is returned by the operations of a stream the peer
+	// closed without reading to the end, or refused.
+	ErrStreamReset = errors.New("mux: stream reset by peer")
+
+	// ErrGoAway is returned by Open after the peer stopped accepting
+	// streams.
+	ErrGoAway = errors.New("mux: peer accepts no more streams")
+)
+
+const (
+	version = 0
+
+	typeData         = 0
+	typeWindowUpdate = 1
+	typePing         = 2
+	typeGoAway       = 3
+
+	flagSYN = 1 << 0
+	flagACK = 1 << 1
+	flagFIN = 1 << 2
+	flagRST = 1 << 3
+
+	headerSize = 12
+
+	// window is the receive window of every stream: how much data the
+	// peer may send before the stream is read.
+	window = 256 << 10
+
+	// maxFrame bounds the data of a frame, so that streams take turns.
+	maxFrame = 64 << 10
+)
+
+type header [headerSize]byte
+
+func newHeader(typ uint8, flags uint16, id, length uint32) header {
+	var h header
+	h[0] = version
+	h[1] = typ
+	binary.BigEndian.PutUint16(h[2:], flags)
+	binary.BigEndian.PutUint32(h[4:], id)
+	binary.BigEndian.PutUint32(h[8:], length)
+	return h
+}
+
+func (h header) typ() uint8     { return h[1] }
+func (h header) flags() uint16  { return binary.BigEndian.Uint16(h[2:]) }
+func (h header) id() uint32     { return binary.BigEndian.Uint32(h[4:]) }
+func (h header) length() uint32 { return binary.BigEndian.Uint32(h[8:]) }
+func (h header) String() string {
+	return fmt.Sprintf("type %d flags %#x stream %d length %d", h.typ(), h.flags(), h.id(), h.length())
+}
+
+// A Config configures a session. The zero value is the default.
+type Config struct {
+	// AcceptBacklog bounds the streams opened by the peer that wait for
+	// Accept; the peer's further streams are reset. Zero means 256.
+	AcceptBacklog int
+}
+
+// A frame is queued for the send loop. If done is not nil, the result of
+// writing it is sent there, and the body must not change until then.
+type frame struct {
+	hdr  header
+	body []byte
+	done chan error
+}
+
+// A Session multiplexes streams over a connection.
+// It is a net.Listener accepting the streams the peer opens.
+type Session struct {
+	conn net.Conn
+
+	accept chan *Stream
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	nextID   uint32
+	goneAway bool
+	pings    map[uint32]chan struct{}
+	nextPing uint32
+	queue    []frame
+	err      error
+
+	// queued is signaled when a frame is queued.
+	queued chan struct{}
+
+	// done is closed when the session ends, with the cause in err.
+	done chan struct{}
+}
+
+// Client returns a session over conn for the end that dialed it.
+func Client(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server returns a session over conn for the end that accepted it.
+func Server(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+// newSession starts a session whose streams have IDs from firstID up, in
+// steps of two, so that the IDs of the ends never collide.
+func newSession(conn net.Conn, config *Config, firstID uint32) *Session {
+	if config == nil {
+		config = new(Config)
+	}
+	backlog := config.AcceptBacklog
+	if backlog == 0 {
+		backlog = 256
+	}
+
+	s := &Session{
+		conn:    conn,
+		accept:  make(chan *Stream, backlog),
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		pings:   make(map[uint32]chan struct{}),
+		queued:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.sendLoop()
+	return s
+}
+
+// Conn returns the connection of s, such as a *nihnet.Conn that knows the
+// identity of the peer.
+func (s *Session) Conn() net.Conn {
+	return s.conn
+}
+
+// Open opens a stream, which the peer accepts. It does not wait for the peer.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if s.goneAway {
+		s.mu.Unlock()
+		return nil, ErrGoAway
+	}
+
+	st := newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.send(newHeader(typeWindowUpdate, flagSYN, st.id, 0), nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for and returns the next stream the peer opened.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Accept waits for and returns the next stream the peer opened, which is a
+// *Stream.
+func (s *Session) Accept() (net.Conn, error) {
+	st, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Addr returns the local address of the connection of s.
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// Ping sends a ping to the peer and returns the round-trip time of its reply.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	s.mu.Lock()
+	id := s.nextPing
+	s.nextPing++
+	pong := make(chan struct{})
+	s.pings[id] = pong
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pings, id)
+		s.mu.Unlock()
+	}()
+
+	start := time.Now()
+	s.queue1(frame{hdr: newHeader(typePing, flagSYN, 0, id)})
+
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-s.done:
+		return 0, s.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// GoAway tells the peer that s accepts no more streams, such as before
+// shutting down. Streams already open are not affected.
+func (s *Session) GoAway() error {
+	return s.send(newHeader(typeGoAway, 0, 0, 0), nil)
+}
+
+// GoneAway reports whether the peer stopped accepting streams, after
+// which Open fails with ErrGoAway.
+func (s *Session) GoneAway() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.goneAway
+}
+
+// Close closes the session, its streams, and its connection.
+func (s *Session) Close() error {
+	s.close(ErrSessionClosed)
+	return nil
+}
+
+// Done returns a channel that is closed when the session ends.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, or nil if it has not.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// close ends the session with err, unless it already ended.
+func (s *Session) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = nil
+	s.mu.Unlock()
+
+	close(s.done)
+	s.conn.Close()
+	for _, st := range streams {
+		st.abort()
+		st.notify()
+	}
+
+	if err != ErrSessionClosed {
+		log.Default().Debug("mux: session failed", "addr", s.conn.RemoteAddr(), "err", err)
+	}
+}
+
+// queue1 queues f for the send loop.
+func (s *Session) queue1(f frame) {
+	s.mu.Lock()
+	s.queue = append(s.queue, f)
+	s.mu.Unlock()
+
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
+}
+
+// send queues a frame and waits until it is written.
+func (s *Session) send(hdr header, body []byte) error {
+	done := make(chan error, 1)
+	s.queue1(frame{hdr: hdr, body: body, done: done})
+
+	select {
+	case err := <-done:
+		return err
+	case <-s.done:
+		return s.err
+	}
+}
+
+// sendLoop writes the queued frames in order. The receive loop only ever
+// queues frames, so that it never waits for the connection, which would
+// deadlock if the peer's receive loop did as well.
+func (s *Session) sendLoop() {
+	var buf []byte
+	for {
+		select {
+		case <-s.queued:
+		case <-s.done:
+			return
+		}
+
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, f := range queue {
+			buf = append(append(buf[:0], f.hdr[:]...), f.body...)
+			_, err := s.conn.Write(buf)
+			if f.done != nil {
+				f.done <- err
+			}
+			if err != nil {
+				s.close(fmt.Errorf("mux: %w", err))
+				return
+			}
+		}
+	}
+}
+
+// recvLoop reads frames and dispatches them until the connection fails.
+func (s *Session) recvLoop() {
+	var hdr header
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				err = ErrSessionClosed
+			} else {
+				err = fmt.Errorf("mux: %w", err)
+			}
+			s.close(err)
+			return
+		}
+
+		if err := s.handle(hdr); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+// handle handles a frame whose header is hdr, reading its data.
+func (s *Session) handle(hdr header) error {
+	if hdr[0] != version {
+		return fmt.Errorf("mux: unsupported version %d", hdr[0])
+	}
+
+	switch hdr.typ() {
+	case typePing:
+		if hdr.flags()&flagSYN != 0 {
+			s.queue1(frame{hdr: newHeader(typePing, flagACK, 0, hdr.length())})
+			return nil
+		}
+		s.mu.Lock()
+		if pong, ok := s.pings[hdr.length()]; ok {
+			close(pong)
+			delete(s.pings, hdr.length())
+		}
+		s.mu.Unlock()
+		return nil
+
+	case typeGoAway:
+		s.mu.Lock()
+		s.goneAway = true
+		s.mu.Unlock()
+		return nil
+
+	case typeData, typeWindowUpdate:
+		return s.handleStream(hdr)
+
+	default:
+		return fmt.Errorf("mux: unknown frame: %v", hdr)
+	}
+}
+
+// handleStream handles a data or window update frame.
+func (s *Session) handleStream(hdr header) error {
+	id, flags := hdr.id(), hdr.flags()
+
+	var data []byte
+	if hdr.typ() == typeData {
+		if hdr.length() > window {
+			return fmt.Errorf("mux: frame exceeds the window: %v", hdr)
+		}
+		data = make([]byte, hdr.length())
+		if _, err := io.ReadFull(s.conn, data); err != nil {
+			return fmt.Errorf("mux: %w", err)
+		}
+	}
+
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	st := s.streams[id]
+	if flags&flagSYN != 0 {
+		if st != nil || id == 0 || id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return fmt.Errorf("mux: peer opened invalid stream %d", id)
+		}
+
+		st = newStream(s, id)
+		select {
+		case s.accept <- st:
+			s.streams[id] = st
+		default:
+			s.mu.Unlock()
+			log.Default().Debug("mux: backlog full, refused stream", "addr", s.conn.RemoteAddr(), "stream", id)
+			s.queue1(frame{hdr: newHeader(typeWindowUpdate, flagRST, id, 0)})
+			return nil
+		}
+	}
+	s.mu.Unlock()
+
+	if st == nil {
+		// a stream closed on this end; the peer learns of it by its RST
+		// or FIN
+		return nil
+	}
+
+	if hdr.typ() == typeWindowUpdate {
+		return st.recvWindowUpdate(hdr.length(), flags)
+	}
+	return st.recvData(data, flags)
+}
+
+// remove forgets the stream with id, once both ends are done with it.
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
@@ -0,0 +1,197 @@
+package mux_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"nih.software/nihnet/mux"
+)
+
+func pair(t *testing.T, config *mux.Config) (client, server *mux.Session) {
+	t.Helper()
+
+	a, b := net.Pipe()
+	client, server = mux.Client(a, config), mux.Server(b, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreams(t *testing.T) {
+	client, server := pair(t, nil)
+
+	// the server echoes every stream
+	go func() {
+		for {
+			st, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer st.Close()
+				io.Copy(st, st)
+				st.CloseWrite()
+			}()
+		}
+	}()
+
+	// more data than a window on each of several concurrent streams
+	const streams = 8
+	var wg sync.WaitGroup
+	for range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data := make([]byte, 1<<20)
+			rand.Read(data)
+
+			st, err := client.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+
+			go func() {
+				st.Write(data)
+				st.CloseWrite()
+			}()
+
+			got, err := io.ReadAll(st)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("stream %d: echoed %d bytes, not the %d written", st.ID(), len(got), len(data))
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.NumStreams() != 0 || server.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d client and %d server streams left open", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if rtt, err := client.Ping(context.Background()); err != nil || rtt <= 0 {
+		t.Errorf("Ping = %v, %v", rtt, err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server := pair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server closes without reading to the end, so the client's writes
+	// fail once it learns of it
+	if _, err := st.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	peer.Close()
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := st.Write([]byte("more")); errors.Is(err, mux.ErrStreamReset) {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("Write after reset: %v", err)
+		}
+	}
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, mux.ErrStreamReset) {
+		t.Errorf("Read after reset: %v", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	client, server := pair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.AcceptStream(); err != nil {
+		t.Fatal(err)
+	}
+
+	st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read past the deadline: %v", err)
+	}
+
+	// the server never reads, so a write beyond the window waits
+	st.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := st.Write(make([]byte, 1<<20)); !errors.Is(err, os.ErrDeadlineExceeded) || n != 256<<10 {
+		t.Errorf("Write beyond the window = %d, %v", n, err)
+	}
+}
+
+func TestBacklog(t *testing.T) {
+	client, _ := pair(t, &mux.Config{AcceptBacklog: 1})
+
+	if _, err := client.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server accepts none, so the second stream is refused
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, mux.ErrStreamReset) {
+		t.Errorf("Read of a refused stream: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	client, server := pair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.GoAway()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := client.Open(); errors.Is(err, mux.ErrGoAway) {
+			break
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("Open after GoAway: %v", err)
+		}
+	}
+
+	server.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client session still open")
+	}
+
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, mux.ErrSessionClosed) {
+		t.Errorf("Read after close: %v", err)
+	}
+	if _, err := client.AcceptStream(); !errors.Is(err, mux.ErrSessionClosed) {
+		t.Errorf("Accept after close: %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package mux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Stream is a stream of a session. It is a net.Conn, whose addresses are
+// those of the connection of the session.
+type Stream struct {
+	id uint32
+	s  *Session
+
+	mu sync.Mutex
+
+	// buf holds the data received but not yet read, and consumed counts
+	// the data read since the peer was last granted more window.
+	buf      []byte
+	consumed uint32
+
+	// sendWindow is how much more data the peer is ready to receive.
+	sendWindow uint32
+
+	finRecv bool
+	finSent bool
+	reset   bool
+	closed  bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// readable and writable are signaled when Read or Write may proceed.
+	readable chan struct{}
+	writable chan struct{}
+
+	// aborted is closed when the peer resets the stream or the session
+	// ends.
+	aborted   chan struct{}
+	abortOnce sync.Once
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		s:          s,
+		sendWindow: window,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		aborted:    make(chan struct{}),
+	}
+}
+
+// ID returns the ID of st, which is unique among the streams of its session.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Session returns the session of st.
+func (st *Stream) Session() *Session {
+	return st.s
+}
+
+// Aborted returns a channel that is closed when the peer resets st, or the
+// session ends, but not when the stream is closed normally. A server may
+// use it to learn that a client gave up on a request it has read.
+func (st *Stream) Aborted() <-chan struct{} {
+	return st.aborted
+}
+
+func (st *Stream) abort() {
+	st.abortOnce.Do(func() { close(st.aborted) })
+}
+
+// Read reads data the peer wrote to st. It returns io.EOF after the peer
+// called CloseWrite or Close and all its data was read.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+
+		if len(st.buf) > 0 {
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			st.consumed += uint32(n)
+
+			var grant uint32
+			if st.consumed >= window/2 && !st.finRecv && !st.reset {
+				grant, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+
+			if grant > 0 {
+				st.s.queue1(frame{hdr: newHeader(typeWindowUpdate, 0, st.id, grant)})
+			}
+			return n, nil
+		}
+
+		switch {
+		case st.finRecv:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.s.Err(); err != nil {
+			return 0, err
+		}
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to st, waiting while the peer has not read enough of
+// the data written before.
+func (st *Stream) Write(b []byte) (int, error) {
+	n := 0
+	for {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.finSent:
+			st.mu.Unlock()
+			return n, ErrStreamClosed
+		case st.reset:
+			st.mu.Unlock()
+			return n, ErrStreamReset
+		}
+		if n == len(b) {
+			st.mu.Unlock()
+			return n, nil
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+
+			if err := st.s.Err(); err != nil {
+				return n, err
+			}
+			if err := st.wait(st.writable, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		k := min(uint32(len(b)-n), st.sendWindow, maxFrame)
+		st.sendWindow -= k
+		st.mu.Unlock()
+
+		if err := st.s.send(newHeader(typeData, 0, st.id, k), b[n:n+int(k)]); err != nil {
+			return n, err
+		}
+		n += int(k)
+	}
+}
+
+// CloseWrite tells the peer that st will write no more data, so that its
+// reads return io.EOF, while st can still read.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.closed || st.finSent {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+
+	if done {
+		st.s.remove(st.id)
+	}
+	return st.s.send(newHeader(typeWindowUpdate, flagFIN, st.id, 0), nil)
+}
+
+// Close closes st. If the peer has not finished writing, its writes fail
+// with ErrStreamReset; otherwise, it reads io.EOF once it read all the data
+// written to st.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf = nil
+
+	var flags uint16
+	switch {
+	case st.reset:
+	case !st.finRecv:
+		flags = flagRST
+	case !st.finSent:
+		flags = flagFIN
+	}
+	st.finSent = true
+	st.mu.Unlock()
+
+	st.s.remove(st.id)
+	st.notify()
+	if flags != 0 {
+		st.s.queue1(frame{hdr: newHeader(typeWindowUpdate, flags, st.id, 0)})
+	}
+	return nil
+}
+
+// recvData adds data received from the peer.
+func (st *Stream) recvData(data []byte, flags uint16) error {
+	st.mu.Lock()
+	if uint32(len(st.buf))+st.consumed+uint32(len(data)) > window {
+		st.mu.Unlock()
+		return fmt.Errorf("mux: peer exceeded the window of stream %d", st.id)
+	}
+	if !st.closed {
+		st.buf = append(st.buf, data...)
+	}
+	st.mu.Unlock()
+
+	st.recvFlags(flags)
+	return nil
+}
+
+// recvWindowUpdate grants st more window, or carries flags alone.
+func (st *Stream) recvWindowUpdate(n uint32, flags uint16) error {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+
+	st.recvFlags(flags)
+	return nil
+}
+
+// recvFlags records that the peer finished writing or reset st.
+func (st *Stream) recvFlags(flags uint16) {
+	st.mu.Lock()
+	done := false
+	if flags&flagFIN != 0 {
+		st.finRecv = true
+		done = st.finSent
+	}
+	if flags&flagRST != 0 {
+		st.reset = true
+		done = true
+	}
+	st.mu.Unlock()
+
+	if flags&flagRST != 0 {
+		st.abort()
+	}
+
+	if done {
+		st.s.remove(st.id)
+	}
+	st.notify()
+}
+
+// notify wakes Read and Write to check the state of st again.
+func (st *Stream) notify() {
+	for _, ch := range []chan struct{}{st.readable, st.writable} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// wait waits until ch is signaled or the session ends, or fails when the
+// deadline passes.
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-ch:
+	case <-st.s.done:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// SetDeadline sets the read and write deadlines of st.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+// SetReadDeadline sets the time after which Read fails with
+// os.ErrDeadlineExceeded, or none if t is zero.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+// SetWriteDeadline sets the time after which Write fails with
+// os.ErrDeadlineExceeded while it waits for the peer to read, or none if t
+// is zero.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify()
+	return nil
+}
+
+// LocalAddr returns the local address of the connection of the session.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the connection of the session.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.s.conn.RemoteAddr()
+}
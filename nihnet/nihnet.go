@@ -0,0 +1,363 @@
+// Package nihnet connects instances to each other over TLS with the
+// credentials of a trust.Bundle.
+//
+// Unlike those of tls.Listen and trust.Bundle.Listen, the connections of a
+// Listener have completed their handshake by the time they are accepted,
+// so a Conn always knows the verified identity of its peer, the protocol
+// negotiated by ALPN, and how long it took to establish. Peers that fail
+// verification or the handshake never reach Accept.
+//
+// Package nihnet/mux multiplexes streams over a Conn, so that two instances
+// need a single connection between them.
+package nihnet
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nih.software/log"
+	"nih.software/trace"
+	"nih.software/trust"
+)
+
+// DefaultHandshakeTimeout bounds the handshake of an accepted connection
+// if the ListenConfig does not.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// An Identity is the verified identity of a peer.
+type Identity struct {
+	// Chain is the certificate chain the peer presented, leaf first.
+	Chain []*x509.Certificate
+}
+
+// Leaf returns the certificate of the peer itself.
+func (id Identity) Leaf() *x509.Certificate {
+	return id.Chain[0]
+}
+
+// Name returns the common name of the peer, such as node1.
+func (id Identity) Name() string {
+	return id.Leaf().Subject.CommonName
+}
+
+// Roles returns the roles the certificate of the peer grants, as
+// trust.Roles does.
+func (id Identity) Roles() []string {
+	return trust.Roles(id.Leaf())
+}
+
+func (id Identity) String() string {
+	leaf := id.Leaf()
+	return fmt.Sprintf("%s (serial %s)", leaf.Subject, leaf.SerialNumber)
+}
+
+// Stats describe a connection.
+type Stats struct {
+	// Connect is how long it took to establish the underlying connection,
+	// for a dialed connection.
+	Connect time.Duration `json:"connect_ns,omitempty"`
+
+	// Handshake is how long the TLS handshake took.
+	Handshake time.Duration `json:"handshake_ns"`
+
+	// Established is when the handshake completed.
+	Established time.Time `json:"established"`
+
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	Resumed     bool   `json:"resumed"`
+
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+}
+
+// A Conn is a TLS connection whose handshake has completed.
+type Conn struct {
+	*tls.Conn
+
+	peer  Identity
+	proto string
+	stats Stats
+
+	read, written atomic.Int64
+}
+
+func newConn(tc *tls.Conn, connect, handshake time.Duration) *Conn {
+	state := tc.ConnectionState()
+	return &Conn{
+		Conn:  tc,
+		peer:  Identity{Chain: state.PeerCertificates},
+		proto: state.NegotiatedProtocol,
+		stats: Stats{
+			Connect:     connect,
+			Handshake:   handshake,
+			Established: time.Now(),
+			Version:     tls.VersionName(state.Version),
+			CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+			Resumed:     state.DidResume,
+		},
+	}
+}
+
+// NewConn returns a Conn for tc, a connection configured with the
+// credentials of a bundle but accepted by other means, such as one an
+// http.Server hands to its TLSNextProto functions. It completes the
+// handshake of tc unless it already has.
+func NewConn(ctx context.Context, tc *tls.Conn) (*Conn, error) {
+	return handshake(ctx, tc, nil, 0)
+}
+
+// Peer returns the verified identity of the other end of c.
+func (c *Conn) Peer() Identity {
+	return c.peer
+}
+
+// Protocol returns the protocol negotiated by ALPN, or "" if the ends of c
+// did not offer any.
+func (c *Conn) Protocol() string {
+	return c.proto
+}
+
+// Stats returns the statistics of c so far.
+func (c *Conn) Stats() Stats {
+	s := c.stats
+	s.BytesRead = c.read.Load()
+	s.BytesWritten = c.written.Load()
+	return s
+}
+
+// Read reads data from c, counting it in its stats.
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// Write writes data to c, counting it in its stats.
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// handshake completes the handshake of tc, closing it if that fails.
+// If protos is not empty, the peer must have agreed on one of them.
+func handshake(ctx context.Context, tc *tls.Conn, protos []string, connect time.Duration) (*Conn, error) {
+	start := time.Now()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		tc.Close()
+		return nil, err
+	}
+
+	c := newConn(tc, connect, time.Since(start))
+	if len(protos) > 0 && c.proto == "" {
+		tc.Close()
+		return nil, fmt.Errorf("nihnet: peer %s agreed on none of the protocols %v", c.peer, protos)
+	}
+	return c, nil
+}
+
+// A Dialer connects to instances with the credentials of a bundle.
+type Dialer struct {
+	Bundle *trust.Bundle
+
+	// NextProtos are the protocols to offer by ALPN, in order of
+	// preference. If set, the peer must agree on one of them.
+	NextProtos []string
+}
+
+// Dial connects to the address on the named network and completes the
+// handshake. The context bounds both the connection and the handshake.
+func (d *Dialer) Dial(ctx context.Context, network, addr string) (_ *Conn, err error) {
+	_, span := trace.Start(ctx, "nihnet.Dial", trace.Client, "net.peer.addr", addr)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	config := d.Bundle.TLSConfig()
+	config.NextProtos = slices.Clone(d.NextProtos)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = host
+	}
+
+	start := time.Now()
+	var nd net.Dialer
+	raw, err := nd.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := handshake(ctx, tls.Client(raw, config), d.NextProtos, time.Since(start))
+	if err == nil {
+		span.SetAttr("net.peer.name", c.peer.Name())
+		span.SetAttr("nihnet.proto", c.proto)
+	}
+	return c, err
+}
+
+// Dial connects to the address on the named network with the credentials
+// of b, as a Dialer without protocols does.
+func Dial(ctx context.Context, b *trust.Bundle, network, addr string) (*Conn, error) {
+	d := Dialer{Bundle: b}
+	return d.Dial(ctx, network, addr)
+}
+
+// A ListenConfig configures the listeners of instances.
+type ListenConfig struct {
+	Bundle *trust.Bundle
+
+	// NextProtos are the protocols to agree on by ALPN, in order of
+	// preference. If set, connections must agree on one of them.
+	NextProtos []string
+
+	// HandshakeTimeout bounds the handshake of every accepted connection;
+	// zero means DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	// Limiter, if not nil, refuses the connections beyond its limits
+	// before their handshake.
+	Limiter *Limiter
+}
+
+// Listen announces on the local network address.
+func (lc *ListenConfig) Listen(ctx context.Context, network, addr string) (*Listener, error) {
+	var nlc net.ListenConfig
+	ln, err := nlc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return lc.NewListener(ln), nil
+}
+
+// NewListener returns a listener that hands shake on the connections
+// accepted by inner, such as a listener inherited from a parent process.
+// Closing the listener closes inner.
+func (lc *ListenConfig) NewListener(inner net.Listener) *Listener {
+	config := lc.Bundle.TLSConfig()
+	config.NextProtos = slices.Clone(lc.NextProtos)
+
+	timeout := lc.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	if lc.Limiter != nil {
+		inner = lc.Limiter.Listener(inner)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Listener{
+		inner:   inner,
+		config:  config,
+		timeout: timeout,
+		ctx:     ctx,
+		cancel:  cancel,
+		conns:   make(chan *Conn),
+		stopped: make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+// Listen announces on the local network address with the credentials of b,
+// as a ListenConfig without protocols does.
+func Listen(b *trust.Bundle, network, addr string) (*Listener, error) {
+	lc := ListenConfig{Bundle: b}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+// A Listener accepts connections whose handshake has completed.
+// Handshakes run concurrently, so that a slow or silent peer does not hold
+// up the others.
+type Listener struct {
+	inner   net.Listener
+	config  *tls.Config
+	timeout time.Duration
+
+	// ctx is canceled by Close, aborting handshakes in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	conns chan *Conn
+
+	// stopped is closed when inner fails to accept, with the error in err.
+	stopped chan struct{}
+	err     error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// serve accepts connections from the inner listener and hands shake on
+// each of them until it fails.
+func (l *Listener) serve() {
+	defer close(l.stopped)
+
+	for {
+		raw, err := l.inner.Accept()
+		if err != nil {
+			l.err = err
+			return
+		}
+
+		go func() {
+			ctx, cancel := context.WithTimeout(l.ctx, l.timeout)
+			defer cancel()
+
+			c, err := handshake(ctx, tls.Server(raw, l.config), l.config.NextProtos, 0)
+			if err != nil {
+				log.Default().Debug("nihnet: handshake failed", "addr", raw.RemoteAddr(), "err", err)
+				return
+			}
+
+			select {
+			case l.conns <- c:
+			case <-l.ctx.Done():
+				c.Close()
+			}
+		}()
+	}
+}
+
+// AcceptConn waits for and returns the next connection whose handshake has
+// completed.
+func (l *Listener) AcceptConn() (*Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.stopped:
+		return nil, l.err
+	}
+}
+
+// Accept waits for and returns the next connection whose handshake has
+// completed, which is a *Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.AcceptConn()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops listening and aborts the handshakes in progress.
+// Connections already accepted are not closed.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		l.cancel()
+		l.closeErr = l.inner.Close()
+	})
+	return l.closeErr
+}
+
+// Addr returns the network address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return l.inner.Addr()
+}
@@ -0,0 +1,311 @@
+package nihnet_test
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"nih.software/nihnet"
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+// bundles returns the credentials of two nodes of the same hierarchy.
+func bundles(t *testing.T) (server, client *trust.Bundle) {
+	t.Helper()
+
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+		Leaves:        2,
+		Options: []trustgen.Option{
+			trustgen.WithSubject(pkix.Name{CommonName: "node", OrganizationalUnit: []string{"admin"}}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := func(i int) *trust.Bundle {
+		b, err := trust.NewBundle(h.Chain(i), h.Leaves[i].Key, h.Roots())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	return bundle(0), bundle(1)
+}
+
+func TestDialListen(t *testing.T) {
+	server, client := bundles(t)
+
+	lc := nihnet.ListenConfig{Bundle: server, NextProtos: []string{"nih/1"}, HandshakeTimeout: time.Second}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan *nihnet.Conn)
+	go func() {
+		for {
+			c, err := ln.AcceptConn()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	// A peer that never hands shake does not hold up the others.
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// Nor does one that fails verification.
+	other, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{Leaves: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := trust.NewBundle(other.Chain(0), other.Leaves[0].Key, other.Roots())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verr *trust.VerificationError
+	if _, err := nihnet.Dial(context.Background(), stranger, "tcp", ln.Addr().String()); !errors.As(err, &verr) {
+		t.Errorf("stranger: got %v, want a VerificationError", err)
+	}
+
+	// Nor one that offers none of the protocols.
+	d := nihnet.Dialer{Bundle: client, NextProtos: []string{"nih/0"}}
+	if _, err := d.Dial(context.Background(), "tcp", ln.Addr().String()); err == nil {
+		t.Error("dial with an unknown protocol succeeded")
+	}
+
+	d.NextProtos = []string{"nih/2", "nih/1"}
+	conn, err := d.Dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var sc *nihnet.Conn
+	select {
+	case sc = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection accepted")
+	}
+	defer sc.Close()
+
+	for _, tt := range []struct {
+		end  string
+		c    *nihnet.Conn
+		peer *x509.Certificate
+	}{
+		{"client", conn, server.Chain()[0]},
+		{"server", sc, client.Chain()[0]},
+	} {
+		id := tt.c.Peer()
+		if !id.Leaf().Equal(tt.peer) || len(id.Chain) != 2 {
+			t.Errorf("%s: peer %v, want %v", tt.end, id, tt.peer.SerialNumber)
+		}
+		if id.Name() != "node" || !slices.Equal(id.Roles(), []string{"admin"}) {
+			t.Errorf("%s: peer name %q, roles %v", tt.end, id.Name(), id.Roles())
+		}
+		if p := tt.c.Protocol(); p != "nih/1" {
+			t.Errorf("%s: protocol %q, want nih/1", tt.end, p)
+		}
+		if s := tt.c.Stats(); s.Version != "TLS 1.3" || s.Handshake <= 0 || s.Established.IsZero() {
+			t.Errorf("%s: stats %+v", tt.end, s)
+		}
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.CloseWrite()
+
+	data, err := io.ReadAll(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("read %q", data)
+	}
+
+	if s := conn.Stats(); s.BytesWritten != 5 || s.Connect <= 0 {
+		t.Errorf("client stats %+v", s)
+	}
+	if s := sc.Stats(); s.BytesRead != 5 {
+		t.Errorf("server stats %+v", s)
+	}
+
+	ln.Close()
+	if _, ok := <-accepted; ok {
+		t.Error("accepted a connection after Close")
+	}
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close: %v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var r nihnet.Registry
+	for _, p := range []*nihnet.Protocol{
+		{Name: "nih", Version: 1},
+		{Name: "nih", Version: 2},
+		{Name: "files", Version: 1},
+		{Name: "nih", Version: 4},
+	} {
+		r.Register(p)
+	}
+
+	if got, want := r.NextProtos(), []string{"nih/4", "nih/2", "nih/1", "files/1"}; !slices.Equal(got, want) {
+		t.Errorf("NextProtos = %v, want %v", got, want)
+	}
+	if got := r.Versions("nih"); !slices.Equal(got, []int{1, 2, 4}) {
+		t.Errorf("Versions = %v", got)
+	}
+
+	for _, tt := range []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{"nih/1"}, "nih/1"},
+		{[]string{"nih/1", "nih/2", "nih/3"}, "nih/2"},
+		{[]string{"nih/5", "nih/4"}, "nih/4"},
+		{[]string{"files/1", "nih/1"}, "nih/1"},
+		{[]string{"files/1", "http/1.1"}, "files/1"},
+		{[]string{"http/1.1", "h2", "nih/01", "nih/x"}, ""},
+		{nil, ""},
+	} {
+		p, err := r.Negotiate(tt.offered)
+		if err != nil {
+			t.Errorf("Negotiate(%v): %v", tt.offered, err)
+			continue
+		}
+		if got := ""; p != nil {
+			got = p.ID()
+			if got != tt.want {
+				t.Errorf("Negotiate(%v) = %s, want %s", tt.offered, got, tt.want)
+			}
+		} else if tt.want != "" {
+			t.Errorf("Negotiate(%v) = nil, want %s", tt.offered, tt.want)
+		}
+	}
+
+	var verr *nihnet.VersionError
+	if _, err := r.Negotiate([]string{"nih/3", "nih/5"}); !errors.As(err, &verr) ||
+		!slices.Equal(verr.Offered, []int{3, 5}) || !slices.Equal(verr.Supported, []int{1, 2, 4}) {
+		t.Errorf("Negotiate of unsupported versions: %v", err)
+	}
+
+	// Peers of different versions agree on the highest they share.
+	server, client := bundles(t)
+	lc := nihnet.ListenConfig{Bundle: server, NextProtos: r.NextProtos()}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.AcceptConn()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	for _, offered := range [][]string{{"nih/2", "nih/1"}, {"nih/3", "nih/2"}, {"nih/1"}} {
+		d := nihnet.Dialer{Bundle: client, NextProtos: offered}
+		c, err := d.Dial(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if want, _ := r.Negotiate(offered); c.Protocol() != want.ID() {
+			t.Errorf("offering %v: agreed on %s, want %s", offered, c.Protocol(), want.ID())
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := nihnet.NewLimiter(nihnet.Limits{PeerConns: 1})
+	ln := l.Listener(inner)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	// dial returns whether the listener accepted a connection, which it
+	// closes unless keep.
+	dial := func(keep bool) (net.Conn, bool) {
+		t.Helper()
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		select {
+		case sc := <-accepted:
+			if !keep {
+				sc.Close()
+			}
+			return sc, true
+		case <-time.After(time.Second):
+		}
+		// a refused connection is closed before its handshake
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read of a refused connection: %v", err)
+		}
+		return nil, false
+	}
+
+	first, ok := dial(true)
+	if !ok {
+		t.Fatal("first connection refused")
+	}
+	if _, ok := dial(false); ok {
+		t.Error("connection beyond PeerConns accepted")
+	}
+	first.Close()
+	if _, ok := dial(false); !ok {
+		t.Error("connection refused once the first closed")
+	}
+
+	l.SetLimits(nihnet.Limits{PeerHandshakeRate: 1})
+	if _, ok := dial(false); !ok {
+		t.Error("first connection of the second refused")
+	}
+	if _, ok := dial(false); ok {
+		t.Error("connection beyond the handshake rate accepted")
+	}
+
+	if n := l.Refused(); n != 2 {
+		t.Errorf("Refused = %d, want 2", n)
+	}
+}
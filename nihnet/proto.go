@@ -0,0 +1,180 @@
+package nihnet
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ProtocolID returns the ALPN protocol ID of version v of the protocol
+// name, such as "nih/1".
+func ProtocolID(name string, v int) string {
+	return name + "/" + strconv.Itoa(v)
+}
+
+// ParseProtocolID returns the name and version of the protocol of an ID
+// returned by ProtocolID. It reports false for other IDs, such as
+// "http/1.1".
+func ParseProtocolID(id string) (name string, v int, ok bool) {
+	name, version, ok := strings.Cut(id, "/")
+	if !ok || name == "" {
+		return "", 0, false
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil || v < 1 || strconv.Itoa(v) != version {
+		return "", 0, false
+	}
+	return name, v, true
+}
+
+// A Protocol is a version of a protocol, spoken on connections that
+// negotiate its ID by ALPN.
+type Protocol struct {
+	Name    string
+	Version int
+
+	// Serve serves a connection that negotiated the protocol, until the
+	// peer closes it or ctx is canceled.
+	Serve func(ctx context.Context, conn *Conn)
+}
+
+// ID returns the ALPN protocol ID of p.
+func (p *Protocol) ID() string {
+	return ProtocolID(p.Name, p.Version)
+}
+
+// A Registry maps the versions of protocols to the handlers serving them.
+//
+// Instances agree on the highest version of a protocol both support, so
+// that a new version can be rolled out one instance at a time: upgraded
+// instances speak it to each other and the previous version to the rest.
+// For that, an instance keeps serving a version for at least one release
+// after it registers its successor. Peers that speak a protocol only in
+// versions the registry does not have are refused with a *VersionError.
+type Registry struct {
+	mu     sync.Mutex
+	protos map[string]*Protocol
+	names  []string // in order of registration
+}
+
+// Register adds p to r. It panics if p is not valid or its version is
+// already registered.
+func (r *Registry) Register(p *Protocol) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := p.ID()
+	if name, v, ok := ParseProtocolID(id); !ok || name != p.Name || v != p.Version {
+		panic("nihnet: invalid protocol " + id)
+	}
+	if _, ok := r.protos[id]; ok {
+		panic("nihnet: duplicate protocol " + id)
+	}
+
+	if r.protos == nil {
+		r.protos = make(map[string]*Protocol)
+	}
+	r.protos[id] = p
+	if !slices.Contains(r.names, p.Name) {
+		r.names = append(r.names, p.Name)
+	}
+}
+
+// Lookup returns the protocol of the ID, or nil if it is not registered.
+func (r *Registry) Lookup(id string) *Protocol {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.protos[id]
+}
+
+// Versions returns the registered versions of the protocol name in
+// ascending order.
+func (r *Registry) Versions(name string) []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.versions(name)
+}
+
+func (r *Registry) versions(name string) []int {
+	var vs []int
+	for _, p := range r.protos {
+		if p.Name == name {
+			vs = append(vs, p.Version)
+		}
+	}
+	slices.Sort(vs)
+	return vs
+}
+
+// NextProtos returns the IDs of the registered protocols in order of
+// preference, for tls.Config.NextProtos: the protocols in the order they
+// were registered, each from its highest version down.
+func (r *Registry) NextProtos() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ids []string
+	for _, name := range r.names {
+		vs := r.versions(name)
+		for i := len(vs) - 1; i >= 0; i-- {
+			ids = append(ids, ProtocolID(name, vs[i]))
+		}
+	}
+	return ids
+}
+
+// Negotiate returns the protocol to agree on with a peer offering the IDs
+// offered: the highest version the peer offers of the first registered
+// protocol it offers any version of. It returns nil if the peer offers no
+// registered protocol, and a *VersionError if the versions it offers of
+// one are all unregistered.
+func (r *Registry) Negotiate(offered []string) (*Protocol, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	theirs := make(map[string][]int)
+	for _, id := range offered {
+		if name, v, ok := ParseProtocolID(id); ok {
+			theirs[name] = append(theirs[name], v)
+		}
+	}
+
+	for _, name := range r.names {
+		vs := theirs[name]
+		if len(vs) == 0 {
+			continue
+		}
+
+		slices.Sort(vs)
+		for i := len(vs) - 1; i >= 0; i-- {
+			if p := r.protos[ProtocolID(name, vs[i])]; p != nil {
+				return p, nil
+			}
+		}
+		return nil, &VersionError{Name: name, Offered: vs, Supported: r.versions(name)}
+	}
+	return nil, nil
+}
+
+// A VersionError reports that a peer speaks a protocol only in versions
+// the registry does not have.
+type VersionError struct {
+	Name      string
+	Offered   []int
+	Supported []int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("nihnet: peer speaks %s versions %s, not %s", e.Name, joinInts(e.Offered), joinInts(e.Supported))
+}
+
+func joinInts(vs []int) string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ", ")
+}
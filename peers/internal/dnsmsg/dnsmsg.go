@@ -0,0 +1,467 @@
+// Package dnsmsg encodes and decodes DNS messages, as described in RFC 1035,
+// with the records that service discovery uses: A, AAAA, PTR, SRV, and TXT
+// (RFC 2782 and RFC 6763).
+//
+// Names are written in presentation form, such as "_nih._tcp.local.", with
+// a dot or backslash within a label escaped by a backslash.
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Types of records.
+const (
+	TypeA    uint16 = 1
+	TypePTR  uint16 = 12
+	TypeTXT  uint16 = 16
+	TypeAAAA uint16 = 28
+	TypeSRV  uint16 = 33
+	TypeANY  uint16 = 255
+)
+
+// ClassINET is the Internet class.
+const ClassINET uint16 = 1
+
+// RCodes of responses.
+const (
+	RCodeSuccess  = 0
+	RCodeServFail = 2
+	RCodeNameErr  = 3
+)
+
+// MaxSize is the largest message Unpack accepts and Pack produces.
+const MaxSize = 9000
+
+var errTruncated = errors.New("dnsmsg: message truncated")
+
+// A Message is a DNS message.
+type Message struct {
+	ID                 uint16
+	Response           bool
+	Opcode             int
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	RCode              int
+
+	Questions   []Question
+	Answers     []Record
+	Authorities []Record
+	Additionals []Record
+}
+
+// A Question asks for the records of a name, type, and class. In multicast
+// DNS, the top bit of Class asks for a unicast response.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// A Record is a resource record. Which of its data fields are set depends
+// on its type; Data holds the data of other types.
+type Record struct {
+	Name string
+	Type uint16
+	// Class is the class of the record. In multicast DNS, its top bit
+	// tells that the record replaces those of the same name and type.
+	Class uint16
+	TTL   uint32
+
+	// IP is the address of an A or AAAA record.
+	IP netip.Addr
+
+	// Target is the name of a PTR record, or the host of an SRV record.
+	Target string
+
+	// Priority, Weight, and Port are the fields of an SRV record.
+	Priority, Weight, Port uint16
+
+	// Text are the strings of a TXT record.
+	Text []string
+
+	Data []byte
+}
+
+// Pack returns the encoding of m. Names are not compressed.
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b, m.ID)
+
+	var flags uint16
+	if m.Response {
+		flags |= 1 << 15
+	}
+	flags |= uint16(m.Opcode&0xf) << 11
+	if m.Authoritative {
+		flags |= 1 << 10
+	}
+	if m.Truncated {
+		flags |= 1 << 9
+	}
+	if m.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if m.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	flags |= uint16(m.RCode & 0xf)
+	binary.BigEndian.PutUint16(b[2:], flags)
+
+	for i, n := range []int{len(m.Questions), len(m.Answers), len(m.Authorities), len(m.Additionals)} {
+		if n > 0xffff {
+			return nil, errors.New("dnsmsg: too many records")
+		}
+		binary.BigEndian.PutUint16(b[4+2*i:], uint16(n))
+	}
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+	for _, rs := range [][]Record{m.Answers, m.Authorities, m.Additionals} {
+		for i := range rs {
+			if b, err = rs[i].append(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(b) > MaxSize {
+		return nil, fmt.Errorf("dnsmsg: message of %d bytes too large", len(b))
+	}
+	return b, nil
+}
+
+func (r *Record) append(b []byte) ([]byte, error) {
+	b, err := appendName(b, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, r.Type)
+	b = binary.BigEndian.AppendUint16(b, r.Class)
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+
+	// the length of the data, set below
+	b = append(b, 0, 0)
+	start := len(b)
+
+	switch r.Type {
+	case TypeA:
+		if !r.IP.Is4() {
+			return nil, fmt.Errorf("dnsmsg: A record of %s with address %v", r.Name, r.IP)
+		}
+		ip := r.IP.As4()
+		b = append(b, ip[:]...)
+	case TypeAAAA:
+		if !r.IP.Is6() {
+			return nil, fmt.Errorf("dnsmsg: AAAA record of %s with address %v", r.Name, r.IP)
+		}
+		ip := r.IP.As16()
+		b = append(b, ip[:]...)
+	case TypePTR:
+		if b, err = appendName(b, r.Target); err != nil {
+			return nil, err
+		}
+	case TypeSRV:
+		b = binary.BigEndian.AppendUint16(b, r.Priority)
+		b = binary.BigEndian.AppendUint16(b, r.Weight)
+		b = binary.BigEndian.AppendUint16(b, r.Port)
+		if b, err = appendName(b, r.Target); err != nil {
+			return nil, err
+		}
+	case TypeTXT:
+		for _, s := range r.Text {
+			if len(s) > 255 {
+				return nil, fmt.Errorf("dnsmsg: TXT string of %d bytes too long", len(s))
+			}
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+		if len(r.Text) == 0 {
+			// a TXT record holds at least one string
+			b = append(b, 0)
+		}
+	default:
+		b = append(b, r.Data...)
+	}
+
+	n := len(b) - start
+	if n > 0xffff {
+		return nil, errors.New("dnsmsg: record data too long")
+	}
+	binary.BigEndian.PutUint16(b[start-2:], uint16(n))
+	return b, nil
+}
+
+// appendName appends the uncompressed encoding of name.
+func appendName(b []byte, name string) ([]byte, error) {
+	labels, err := Labels(name)
+	if err != nil {
+		return nil, err
+	}
+	n := 1
+	for _, l := range labels {
+		n += 1 + len(l)
+	}
+	if n > 255 {
+		return nil, fmt.Errorf("dnsmsg: name %q too long", name)
+	}
+	for _, l := range labels {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0), nil
+}
+
+// Labels returns the unescaped labels of a name in presentation form.
+func Labels(name string) ([]string, error) {
+	if name == "." {
+		return nil, nil
+	}
+	if !strings.HasSuffix(name, ".") {
+		return nil, fmt.Errorf("dnsmsg: name %q not fully qualified", name)
+	}
+
+	var labels []string
+	var l []byte
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '\\':
+			i++
+			if i == len(name) {
+				return nil, fmt.Errorf("dnsmsg: name %q ends with an escape", name)
+			}
+			l = append(l, name[i])
+		case '.':
+			if len(l) == 0 || len(l) > 63 {
+				return nil, fmt.Errorf("dnsmsg: name %q has a label of %d bytes", name, len(l))
+			}
+			labels = append(labels, string(l))
+			l = l[:0]
+		default:
+			l = append(l, c)
+		}
+	}
+	if len(l) > 0 {
+		return nil, fmt.Errorf("dnsmsg: name %q not fully qualified", name)
+	}
+	return labels, nil
+}
+
+// Join returns the name of labels in presentation form, escaping them.
+func Join(labels ...string) string {
+	if len(labels) == 0 {
+		return "."
+	}
+	var s strings.Builder
+	for _, l := range labels {
+		for i := 0; i < len(l); i++ {
+			if l[i] == '.' || l[i] == '\\' {
+				s.WriteByte('\\')
+			}
+			s.WriteByte(l[i])
+		}
+		s.WriteByte('.')
+	}
+	return s.String()
+}
+
+// Unpack decodes a message.
+func Unpack(data []byte) (*Message, error) {
+	if len(data) > MaxSize {
+		return nil, fmt.Errorf("dnsmsg: message of %d bytes too large", len(data))
+	}
+	if len(data) < 12 {
+		return nil, errTruncated
+	}
+
+	flags := binary.BigEndian.Uint16(data[2:])
+	m := &Message{
+		ID:                 binary.BigEndian.Uint16(data),
+		Response:           flags&(1<<15) != 0,
+		Opcode:             int(flags>>11) & 0xf,
+		Authoritative:      flags&(1<<10) != 0,
+		Truncated:          flags&(1<<9) != 0,
+		RecursionDesired:   flags&(1<<8) != 0,
+		RecursionAvailable: flags&(1<<7) != 0,
+		RCode:              int(flags & 0xf),
+	}
+
+	d := decoder{msg: data, off: 12}
+	qd := int(binary.BigEndian.Uint16(data[4:]))
+	for range qd {
+		var q Question
+		var err error
+		if q.Name, err = d.name(); err != nil {
+			return nil, err
+		}
+		if q.Type, err = d.uint16(); err != nil {
+			return nil, err
+		}
+		if q.Class, err = d.uint16(); err != nil {
+			return nil, err
+		}
+		m.Questions = append(m.Questions, q)
+	}
+
+	for i, rs := range []*[]Record{&m.Answers, &m.Authorities, &m.Additionals} {
+		n := int(binary.BigEndian.Uint16(data[6+2*i:]))
+		for range n {
+			r, err := d.record()
+			if err != nil {
+				return nil, err
+			}
+			*rs = append(*rs, r)
+		}
+	}
+	return m, nil
+}
+
+type decoder struct {
+	msg []byte
+	off int
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	if d.off+2 > len(d.msg) {
+		return 0, errTruncated
+	}
+	v := binary.BigEndian.Uint16(d.msg[d.off:])
+	d.off += 2
+	return v, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if d.off+4 > len(d.msg) {
+		return 0, errTruncated
+	}
+	v := binary.BigEndian.Uint32(d.msg[d.off:])
+	d.off += 4
+	return v, nil
+}
+
+// name decodes a name at the offset, following compression pointers, each
+// of which must point before the one followed last so that they end.
+func (d *decoder) name() (string, error) {
+	var labels []string
+	off, end, n := d.off, -1, 1
+	limit := off
+	for {
+		if off >= len(d.msg) {
+			return "", errTruncated
+		}
+		c := int(d.msg[off])
+		switch c & 0xc0 {
+		case 0x00:
+			if c == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+				d.off = end
+				return Join(labels...), nil
+			}
+			if off+1+c > len(d.msg) {
+				return "", errTruncated
+			}
+			if n += 1 + c; n > 255 {
+				return "", errors.New("dnsmsg: name too long")
+			}
+			labels = append(labels, string(d.msg[off+1:off+1+c]))
+			off += 1 + c
+		case 0xc0:
+			if off+2 > len(d.msg) {
+				return "", errTruncated
+			}
+			ptr := int(binary.BigEndian.Uint16(d.msg[off:]) & 0x3fff)
+			if ptr >= limit {
+				return "", errors.New("dnsmsg: compression pointer out of range")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off, limit = ptr, ptr
+		default:
+			return "", fmt.Errorf("dnsmsg: invalid label type %#x", c&0xc0)
+		}
+	}
+}
+
+func (d *decoder) record() (Record, error) {
+	var r Record
+	var err error
+	if r.Name, err = d.name(); err != nil {
+		return r, err
+	}
+	if r.Type, err = d.uint16(); err != nil {
+		return r, err
+	}
+	if r.Class, err = d.uint16(); err != nil {
+		return r, err
+	}
+	if r.TTL, err = d.uint32(); err != nil {
+		return r, err
+	}
+	length, err := d.uint16()
+	if err != nil {
+		return r, err
+	}
+	end := d.off + int(length)
+	if end > len(d.msg) {
+		return r, errTruncated
+	}
+	data := d.msg[d.off:end]
+
+	switch r.Type {
+	case TypeA, TypeAAAA:
+		ip, ok := netip.AddrFromSlice(data)
+		if !ok || (r.Type == TypeA) != ip.Is4() {
+			return r, fmt.Errorf("dnsmsg: address record of %d bytes", len(data))
+		}
+		r.IP = ip
+	case TypePTR:
+		if r.Target, err = d.name(); err != nil {
+			return r, err
+		}
+	case TypeSRV:
+		if r.Priority, err = d.uint16(); err != nil {
+			return r, err
+		}
+		if r.Weight, err = d.uint16(); err != nil {
+			return r, err
+		}
+		if r.Port, err = d.uint16(); err != nil {
+			return r, err
+		}
+		if r.Target, err = d.name(); err != nil {
+			return r, err
+		}
+	case TypeTXT:
+		for rest := data; len(rest) > 0; {
+			n := int(rest[0])
+			if 1+n > len(rest) {
+				return r, errTruncated
+			}
+			r.Text = append(r.Text, string(rest[1:1+n]))
+			rest = rest[1+n:]
+		}
+	default:
+		r.Data = append([]byte(nil), data...)
+	}
+
+	if (r.Type == TypePTR || r.Type == TypeSRV) && d.off != end {
+		return r, fmt.Errorf("dnsmsg: data of a record of %s not of its length", r.Name)
+	}
+	d.off = end
+	return r, nil
+}
@@ -0,0 +1,132 @@
+package dnsmsg_test
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"reflect"
+	"slices"
+	"testing"
+
+	"nih.software/peers/internal/dnsmsg"
+)
+
+func TestRoundTrip(t *testing.T) {
+	m := &dnsmsg.Message{
+		ID:            0xbeef,
+		Response:      true,
+		Authoritative: true,
+		RCode:         dnsmsg.RCodeNameErr,
+		Questions:     []dnsmsg.Question{{Name: "_nih._tcp.local.", Type: dnsmsg.TypePTR, Class: dnsmsg.ClassINET | 1<<15}},
+		Answers: []dnsmsg.Record{
+			{Name: "_nih._tcp.local.", Type: dnsmsg.TypePTR, Class: dnsmsg.ClassINET, TTL: 120, Target: `node\.1._nih._tcp.local.`},
+		},
+		Additionals: []dnsmsg.Record{
+			{Name: `node\.1._nih._tcp.local.`, Type: dnsmsg.TypeSRV, Class: dnsmsg.ClassINET, TTL: 120, Priority: 1, Weight: 2, Port: 7443, Target: "host.local."},
+			{Name: `node\.1._nih._tcp.local.`, Type: dnsmsg.TypeTXT, Class: dnsmsg.ClassINET, Text: []string{"name=node.1", ""}},
+			{Name: "host.local.", Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET, IP: netip.MustParseAddr("192.0.2.1")},
+			{Name: "host.local.", Type: dnsmsg.TypeAAAA, Class: dnsmsg.ClassINET, IP: netip.MustParseAddr("2001:db8::1")},
+			{Name: ".", Type: 41, Class: 1232, Data: []byte{1, 2, 3}},
+		},
+	}
+
+	data, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := dnsmsg.Unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("Unpack(Pack(m)) = %+v\nwant %+v", got, m)
+	}
+
+	for _, r := range []dnsmsg.Record{
+		{Name: "a.", Type: dnsmsg.TypeA, IP: netip.MustParseAddr("2001:db8::1")},
+		{Name: "a", Type: dnsmsg.TypePTR, Target: "b."},
+		{Name: "a..", Type: dnsmsg.TypePTR, Target: "b."},
+		{Name: `a\.`, Type: dnsmsg.TypePTR, Target: "b."},
+	} {
+		m := &dnsmsg.Message{Answers: []dnsmsg.Record{r}}
+		if _, err := m.Pack(); err == nil {
+			t.Errorf("Pack of %+v succeeded", r)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	name := dnsmsg.Join("a.b", `c\`, "d")
+	if name != `a\.b.c\\.d.` {
+		t.Errorf("Join = %s", name)
+	}
+	if labels, err := dnsmsg.Labels(name); err != nil || !slices.Equal(labels, []string{"a.b", `c\`, "d"}) {
+		t.Errorf("Labels = %q, %v", labels, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	// a response with one PTR answer, of the name of the question and a
+	// target in part compressed
+	data, _ := hex.DecodeString("000084000001000100000000" +
+		"03666f6f" + "056c6f63616c00" + "000c0001" +
+		"c00c" + "000c0001" + "00000078" + "0006" + "03626172c010")
+	m, err := dnsmsg.Unpack(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := m.Questions[0]; q.Name != "foo.local." {
+		t.Errorf("question %+v", q)
+	}
+	if r := m.Answers[0]; r.Name != "foo.local." || r.Target != "bar.local." || r.TTL != 120 {
+		t.Errorf("answer %+v", r)
+	}
+
+	for _, bad := range []string{
+		// a pointer to itself
+		"000000000001000000000000" + "c00c" + "000c0001",
+		// a pointer forward
+		"000000000001000000000000" + "c00e" + "00" + "000c0001",
+		// a label past the end
+		"000000000001000000000000" + "05666f6f",
+		// a PTR record whose name overruns its data
+		"000000000000000100000000" + "00" + "000c0001" + "00000000" + "0001" + "03626172" + "00",
+	} {
+		data, _ := hex.DecodeString(bad)
+		if _, err := dnsmsg.Unpack(data); err == nil {
+			t.Errorf("Unpack(%s) succeeded", bad)
+		}
+	}
+}
+
+func FuzzUnpack(f *testing.F) {
+	m := &dnsmsg.Message{
+		Questions: []dnsmsg.Question{{Name: "_nih._tcp.local.", Type: dnsmsg.TypePTR, Class: dnsmsg.ClassINET}},
+		Answers:   []dnsmsg.Record{{Name: "x.local.", Type: dnsmsg.TypeSRV, Port: 1, Target: "y.local."}},
+	}
+	data, err := m.Pack()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := dnsmsg.Unpack(data)
+		if err != nil {
+			return
+		}
+		// What Unpack accepts, Pack encodes, and the encoding decodes the
+		// same, unless a name Unpack accepts is too long to pack once
+		// uncompressed.
+		again, err := m.Pack()
+		if err != nil {
+			return
+		}
+		m2, err := dnsmsg.Unpack(again)
+		if err != nil {
+			t.Fatalf("Unpack of a packed message: %v", err)
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Fatalf("Unpack(Pack(m)) = %+v, want %+v", m2, m)
+		}
+	})
+}
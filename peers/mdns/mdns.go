@@ -0,0 +1,472 @@
+// Package mdns finds nodes on the local network by multicast DNS (RFC 6762)
+// and DNS-based service discovery (RFC 6763).
+//
+// A Responder announces a node as an instance of Service, and a Browser, a
+// peers.Finder, asks the network for the instances. The TXT record of an
+// instance holds the common name of the certificate of its node, as
+// name=CN, which the instance name may only approximate.
+//
+// Anyone on the network may answer, so the peers a Browser finds are only
+// claims: a peer is to be trusted once it presents a certificate of its
+// name, as peers.Peer.Verify checks.
+package mdns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"nih.software/log"
+	"nih.software/peers"
+	"nih.software/peers/internal/dnsmsg"
+)
+
+const (
+	// Service is the DNS-SD service of nih nodes.
+	Service = "_nih._tcp"
+
+	// DefaultAddr is the IPv4 group and port of multicast DNS.
+	DefaultAddr = "224.0.0.251:5353"
+
+	// DefaultWait is how long a Browser waits for answers by default.
+	DefaultWait = time.Second
+)
+
+const (
+	// ttl is the time to live of the records of a Responder.
+	ttl = 120
+
+	// unicastTTL is the time to live of the records of a response to a
+	// legacy unicast query, which RFC 6762 limits to 10 seconds.
+	unicastTTL = 10
+
+	// mdnsPort is the port of multicast DNS, from which queries of full
+	// multicast DNS queriers come. Other ports are those of legacy
+	// unicast queriers, which expect answers as from a DNS server.
+	mdnsPort = 5353
+
+	// cacheFlush is the bit of the class of a record telling that it
+	// replaces the records of the same name and type.
+	cacheFlush = 1 << 15
+
+	// unicastResponse is the bit of the class of a question asking for
+	// a unicast response.
+	unicastResponse = 1 << 15
+
+	classANY = 255
+)
+
+var (
+	serviceName  = Service + ".local."
+	servicesName = "_services._dns-sd._udp.local."
+)
+
+// label returns the DNS label of a node named name: its name with
+// characters other than letters, digits, and hyphens replaced by hyphens,
+// and at most 63 bytes long.
+func label(name string) string {
+	l := []byte(name)
+	for i, c := range l {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			l[i] = '-'
+		}
+	}
+	if len(l) > 63 {
+		l = l[:63]
+	}
+	return string(l)
+}
+
+// A Responder answers multicast DNS queries for the instance of a node.
+type Responder struct {
+	// Name is the common name of the certificate of the node.
+	Name string
+
+	// Port is the port the node serves on.
+	Port int
+
+	// IPs are the addresses of the node. If nil, they are those of the
+	// network interfaces that are up and multicast, but for loopback and
+	// link-local addresses, looked up for every response.
+	IPs []netip.Addr
+
+	// Addr is the UDP address to listen on: if empty, DefaultAddr, whose
+	// group the Responder joins on every multicast interface. On another
+	// address, it only answers the queries sent to that address.
+	Addr string
+}
+
+// Serve answers queries until ctx is done, then returns nil.
+func (r *Responder) Serve(ctx context.Context) error {
+	if r.Name == "" || r.Port <= 0 || r.Port > 0xffff {
+		return fmt.Errorf("mdns: invalid instance %q on port %d", r.Name, r.Port)
+	}
+
+	addr := r.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	uaddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("mdns: %w", err)
+	}
+
+	var conn *net.UDPConn
+	if uaddr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp4", nil, uaddr)
+	} else {
+		conn, err = net.ListenUDP("udp4", uaddr)
+	}
+	if err != nil {
+		return fmt.Errorf("mdns: %w", err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	log.Default().Debug("mdns: responding", "instance", r.instance(), "addr", conn.LocalAddr())
+
+	buf := make([]byte, dnsmsg.MaxSize)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("mdns: %w", err)
+		}
+
+		q, err := dnsmsg.Unpack(buf[:n])
+		if err != nil || q.Response || q.Opcode != 0 {
+			continue
+		}
+
+		resp, to := r.respond(q, from, uaddr.AddrPort())
+		if resp == nil {
+			continue
+		}
+		data, err := resp.Pack()
+		if err != nil {
+			log.Default().Warn("mdns: response", "err", err)
+			continue
+		}
+		if _, err := conn.WriteToUDPAddrPort(data, to); err != nil {
+			log.Default().Debug("mdns: response", "to", to, "err", err)
+		}
+	}
+}
+
+func (r *Responder) instance() string {
+	return dnsmsg.Join(label(r.Name), "_nih", "_tcp", "local")
+}
+
+func (r *Responder) host() string {
+	return dnsmsg.Join(label(r.Name), "local")
+}
+
+// respond returns the response to the query q from the address from, and
+// where to send it, or nil if r has no answer. group is the address of the
+// multicast group.
+func (r *Responder) respond(q *dnsmsg.Message, from, group netip.AddrPort) (*dnsmsg.Message, netip.AddrPort) {
+	instance, host := r.instance(), r.host()
+
+	var answers, extra []dnsmsg.Record
+	unicast := from.Port() != mdnsPort
+	for _, qq := range q.Questions {
+		if class := qq.Class &^ unicastResponse; class != dnsmsg.ClassINET && class != classANY {
+			continue
+		}
+		if qq.Class&unicastResponse != 0 {
+			unicast = true
+		}
+
+		want := func(t uint16) bool {
+			return qq.Type == t || qq.Type == dnsmsg.TypeANY
+		}
+		switch {
+		case strings.EqualFold(qq.Name, servicesName) && want(dnsmsg.TypePTR):
+			answers = append(answers, dnsmsg.Record{Name: servicesName, Type: dnsmsg.TypePTR, Target: serviceName})
+		case strings.EqualFold(qq.Name, serviceName) && want(dnsmsg.TypePTR):
+			answers = append(answers, dnsmsg.Record{Name: serviceName, Type: dnsmsg.TypePTR, Target: instance})
+			extra = append(extra, r.srv(), r.txt())
+			extra = append(extra, r.addresses()...)
+		case strings.EqualFold(qq.Name, instance):
+			if want(dnsmsg.TypeSRV) {
+				answers = append(answers, r.srv())
+				extra = append(extra, r.addresses()...)
+			}
+			if want(dnsmsg.TypeTXT) {
+				answers = append(answers, r.txt())
+			}
+		case strings.EqualFold(qq.Name, host):
+			for _, a := range r.addresses() {
+				if want(a.Type) {
+					answers = append(answers, a)
+				}
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return nil, netip.AddrPort{}
+	}
+
+	resp := &dnsmsg.Message{Response: true, Authoritative: true}
+	legacy := from.Port() != mdnsPort
+	if legacy {
+		// As a DNS server would answer it.
+		resp.ID = q.ID
+		resp.Questions = q.Questions
+	}
+	for _, rs := range [][]dnsmsg.Record{answers, extra} {
+		for i := range rs {
+			rs[i].Class = dnsmsg.ClassINET
+			rs[i].TTL = ttl
+			if legacy {
+				rs[i].TTL = unicastTTL
+			} else if rs[i].Type != dnsmsg.TypePTR {
+				rs[i].Class |= cacheFlush
+			}
+		}
+	}
+	resp.Answers, resp.Additionals = answers, extra
+
+	if unicast {
+		return resp, from
+	}
+	return resp, group
+}
+
+func (r *Responder) srv() dnsmsg.Record {
+	return dnsmsg.Record{Name: r.instance(), Type: dnsmsg.TypeSRV, Port: uint16(r.Port), Target: r.host()}
+}
+
+func (r *Responder) txt() dnsmsg.Record {
+	return dnsmsg.Record{Name: r.instance(), Type: dnsmsg.TypeTXT, Text: []string{"name=" + r.Name}}
+}
+
+// addresses returns the A and AAAA records of the host of r.
+func (r *Responder) addresses() []dnsmsg.Record {
+	ips := r.IPs
+	if ips == nil {
+		ips = interfaceIPs()
+	}
+
+	var rs []dnsmsg.Record
+	for _, ip := range ips {
+		t := dnsmsg.TypeA
+		if !ip.Is4() {
+			t = dnsmsg.TypeAAAA
+		}
+		rs = append(rs, dnsmsg.Record{Name: r.host(), Type: t, IP: ip})
+	}
+	return rs
+}
+
+// interfaceIPs returns the addresses of the up, multicast, non-loopback
+// interfaces, but for link-local ones, which need a zone to be reached.
+func interfaceIPs() []netip.Addr {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		log.Default().Warn("mdns: interfaces", "err", err)
+		return nil
+	}
+
+	var ips []netip.Addr
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, ok := netip.AddrFromSlice(ipnet.IP)
+			if !ok || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			ips = append(ips, ip.Unmap())
+		}
+	}
+	return ips
+}
+
+// A Browser finds the nodes on the local network that a Responder
+// announces. It is a peers.Finder.
+type Browser struct {
+	// Addr is the UDP address to send queries to, DefaultAddr if empty.
+	Addr string
+
+	// Wait is how long to wait for answers, DefaultWait if zero.
+	Wait time.Duration
+}
+
+// Find queries the network for the instances of Service and returns their
+// nodes, with Source peers.SourceMDNS, by name.
+func (b *Browser) Find(ctx context.Context) ([]peers.Peer, error) {
+	addr := b.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	to, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+
+	// From a port other than 5353, as a legacy unicast querier, so that
+	// responders answer to the port, whoever else holds 5353.
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+	defer conn.Close()
+
+	var id [2]byte
+	rand.Read(id[:])
+	q := &dnsmsg.Message{
+		ID:        binary.BigEndian.Uint16(id[:]),
+		Questions: []dnsmsg.Question{{Name: serviceName, Type: dnsmsg.TypePTR, Class: dnsmsg.ClassINET}},
+	}
+	data, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(data, to); err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+
+	wait := b.Wait
+	if wait == 0 {
+		wait = DefaultWait
+	}
+	deadline := time.Now().Add(wait)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	var found answers
+	buf := make([]byte, dnsmsg.MaxSize)
+	for {
+		n, err := conn.Read(buf)
+		if isTimeout(err) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("mdns: %w", err)
+		}
+
+		m, err := dnsmsg.Unpack(buf[:n])
+		if err != nil || !m.Response || m.ID != q.ID {
+			continue
+		}
+		found.add(m)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return found.peers(), nil
+}
+
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// answers collects the records of the responses to a Browser.
+type answers struct {
+	instances []string
+	srv       map[string]dnsmsg.Record
+	names     map[string]string
+	ips       map[string][]netip.Addr
+}
+
+func (a *answers) add(m *dnsmsg.Message) {
+	if a.srv == nil {
+		a.srv = make(map[string]dnsmsg.Record)
+		a.names = make(map[string]string)
+		a.ips = make(map[string][]netip.Addr)
+	}
+
+	for _, r := range append(m.Answers, m.Additionals...) {
+		key := strings.ToLower(r.Name)
+		switch r.Type {
+		case dnsmsg.TypePTR:
+			if strings.EqualFold(r.Name, serviceName) && !slices.Contains(a.instances, strings.ToLower(r.Target)) {
+				a.instances = append(a.instances, strings.ToLower(r.Target))
+			}
+		case dnsmsg.TypeSRV:
+			a.srv[key] = r
+		case dnsmsg.TypeTXT:
+			for _, s := range r.Text {
+				if name, ok := strings.CutPrefix(s, "name="); ok {
+					a.names[key] = name
+				}
+			}
+		case dnsmsg.TypeA, dnsmsg.TypeAAAA:
+			if !slices.Contains(a.ips[key], r.IP) {
+				a.ips[key] = append(a.ips[key], r.IP)
+			}
+		}
+	}
+}
+
+// peers returns the nodes of the instances answered with their address,
+// merging instances of the same name.
+func (a *answers) peers() []peers.Peer {
+	byName := make(map[string]*peers.Peer)
+	for _, instance := range a.instances {
+		srv, ok := a.srv[instance]
+		if !ok {
+			continue
+		}
+		name, ok := a.names[instance]
+		if !ok {
+			labels, err := dnsmsg.Labels(instance)
+			if err != nil || len(labels) == 0 {
+				continue
+			}
+			name = labels[0]
+		}
+		if !peers.ValidName(name) {
+			continue
+		}
+
+		p := byName[name]
+		if p == nil {
+			p = &peers.Peer{Name: name, Source: peers.SourceMDNS}
+			byName[name] = p
+		}
+		for _, ip := range a.ips[strings.ToLower(srv.Target)] {
+			addr := netip.AddrPortFrom(ip, srv.Port).String()
+			if !slices.Contains(p.Addrs, addr) {
+				p.Addrs = append(p.Addrs, addr)
+			}
+		}
+	}
+
+	var ps []peers.Peer
+	for _, p := range byName {
+		if len(p.Addrs) > 0 {
+			ps = append(ps, *p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+	return ps
+}
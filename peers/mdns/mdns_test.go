@@ -0,0 +1,80 @@
+package mdns_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"nih.software/peers"
+	"nih.software/peers/mdns"
+)
+
+// freeAddr returns a loopback UDP address that was free a moment ago.
+func freeAddr(t *testing.T) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestBrowse(t *testing.T) {
+	addr := freeAddr(t)
+	r := &mdns.Responder{
+		Name: "node.1",
+		Port: 7443,
+		IPs:  []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")},
+		Addr: addr,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- r.Serve(ctx) }()
+
+	b := &mdns.Browser{Addr: addr, Wait: 100 * time.Millisecond}
+	want := []peers.Peer{{Name: "node.1", Addrs: []string{"127.0.0.1:7443", "[::1]:7443"}, Source: peers.SourceMDNS}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		found, err := b.Find(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) > 0 {
+			if !reflect.DeepEqual(found, want) {
+				t.Errorf("Find = %+v, want %+v", found, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("responder not found")
+		}
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+
+	// Without a responder, Find waits and finds nothing.
+	start := time.Now()
+	if found, err := b.Find(context.Background()); err != nil || len(found) != 0 {
+		t.Errorf("Find without a responder = %+v, %v", found, err)
+	}
+	if elapsed := time.Since(start); elapsed < b.Wait {
+		t.Errorf("Find returned after %v, before %v", elapsed, b.Wait)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.Find(ctx); err == nil {
+		t.Error("Find with a canceled context succeeded")
+	}
+
+	if err := (&mdns.Responder{Name: "node", Addr: addr}).Serve(context.Background()); err == nil {
+		t.Error("Serve without a port succeeded")
+	}
+}
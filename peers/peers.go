@@ -0,0 +1,310 @@
+// Package peers keeps the address book of a node: the other nodes it knows
+// by name, the addresses to reach them at, and the identity each of them is
+// expected to present.
+//
+// The address book is a JSON file, DefaultFile in the state directory of the
+// node, shared by the daemon, which probes its peers, and the commands of
+// nih, which resolve the names of nodes with it. Every operation reads the
+// file again, so that changes made by one process apply to the others.
+package peers
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFile is the name of the address book in the state directory.
+const DefaultFile = "peers.json"
+
+// Sources of peers.
+const (
+	// SourceStatic is a peer added by hand, as with nih nodes add.
+	SourceStatic = "static"
+
+	// SourceMDNS is a peer found by multicast DNS, as with package mdns.
+	SourceMDNS = "mdns"
+
+	// SourceDNS is a peer found by the SRV records of a name, as with
+	// package srv.
+	SourceDNS = "dns"
+)
+
+// ErrNotFound is returned for a name the address book does not have.
+var ErrNotFound = errors.New("peers: no such peer")
+
+// ErrIdentity is returned by Peer.Verify for a certificate other than the
+// one expected of the peer.
+var ErrIdentity = errors.New("peers: unexpected identity")
+
+// A Peer is an entry of the address book.
+type Peer struct {
+	// Name is the common name the certificate of the peer must hold.
+	Name string `json:"name"`
+
+	// Addrs are the addresses of the peer, as host:port, in the order to
+	// try them.
+	Addrs []string `json:"addrs"`
+
+	// Pin, if not empty, is the pin of the public key the certificate of
+	// the peer must hold, as returned by Pin. Unlike a pin of the
+	// certificate, it holds across renewals of the certificate for the
+	// same key.
+	Pin string `json:"pin,omitempty"`
+
+	// Source tells how the peer was added, such as SourceStatic.
+	Source string `json:"source"`
+
+	// Updated is when the entry was last added or changed.
+	Updated time.Time `json:"updated"`
+}
+
+// A Finder finds peers, such as on the local network or in DNS.
+//
+// The peers a Finder returns are claims of whoever answered it: they are
+// only to be trusted once they present a certificate their Verify accepts.
+type Finder interface {
+	// Find returns the peers found now, with their Source set.
+	Find(ctx context.Context) ([]Peer, error)
+}
+
+// Pin returns the pin of the public key of cert: the unpadded base64url
+// encoding of the SHA-256 hash of its DER encoding.
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Verify checks that leaf is a certificate expected of p: that it holds the
+// name of p, and the key of its pin if it has one. It fails with an error
+// wrapping ErrIdentity otherwise.
+func (p *Peer) Verify(leaf *x509.Certificate) error {
+	if cn := leaf.Subject.CommonName; cn != p.Name {
+		return fmt.Errorf("%w: %s presented the certificate of %q", ErrIdentity, p.Name, cn)
+	}
+	if p.Pin != "" && Pin(leaf) != p.Pin {
+		return fmt.Errorf("%w: %s presented a key of pin %s, not %s", ErrIdentity, p.Name, Pin(leaf), p.Pin)
+	}
+	return nil
+}
+
+// VerifyConnection calls Verify with the leaf certificate of cs. It can be
+// used as tls.Config.VerifyConnection for connections to p.
+func (p *Peer) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: %s presented no certificate", ErrIdentity, p.Name)
+	}
+	return p.Verify(cs.PeerCertificates[0])
+}
+
+// ValidName reports whether name can be the name of a peer: a common name
+// that is not empty and has no comma, colon, slash, or white space, so that
+// it cannot be mistaken for an address.
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, ",:/ \t\n")
+}
+
+// check validates p before it is added to a book.
+func (p *Peer) check() error {
+	if !ValidName(p.Name) {
+		return fmt.Errorf("invalid name %q", p.Name)
+	}
+	if len(p.Addrs) == 0 {
+		return fmt.Errorf("%s has no address", p.Name)
+	}
+	for _, addr := range p.Addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("%s: %v", p.Name, err)
+		}
+	}
+	if p.Pin != "" {
+		if sum, err := base64.RawURLEncoding.DecodeString(p.Pin); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("%s: invalid pin %q", p.Name, p.Pin)
+		}
+	}
+	return nil
+}
+
+// A Book is an address book in a file.
+type Book struct {
+	name string
+	mu   sync.Mutex
+}
+
+type bookData struct {
+	Peers []*Peer `json:"peers"`
+}
+
+// OpenBook opens the address book in the named file, which is created on
+// first write if it does not exist.
+func OpenBook(name string) (*Book, error) {
+	b := &Book{name: name}
+	if _, err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Name returns the name of the file of b.
+func (b *Book) Name() string {
+	return b.name
+}
+
+// Peers returns the peers of b in name order.
+func (b *Book) Peers() ([]Peer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]Peer, len(data.Peers))
+	for i, p := range data.Peers {
+		peers[i] = *p
+	}
+	return peers, nil
+}
+
+// Lookup returns the peer named name, or ErrNotFound.
+func (b *Book) Lookup(name string) (*Peer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, err := b.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range data.Peers {
+		if p.Name == name {
+			q := *p
+			return &q, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Put adds p to b, replacing the peer of the same name, if any.
+// Updated is set to the current time, and an empty Source to SourceStatic.
+func (b *Book) Put(p Peer) error {
+	if err := p.check(); err != nil {
+		return fmt.Errorf("peers: %w", err)
+	}
+	p.Updated = time.Now().UTC()
+	if p.Source == "" {
+		p.Source = SourceStatic
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i, q := range data.Peers {
+		if q.Name == p.Name {
+			data.Peers[i] = &p
+			replaced = true
+		}
+	}
+	if !replaced {
+		data.Peers = append(data.Peers, &p)
+	}
+
+	return b.save(data)
+}
+
+// Remove removes the peer named name from b, or fails with ErrNotFound.
+func (b *Book) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	data, err := b.load()
+	if err != nil {
+		return err
+	}
+
+	for i, p := range data.Peers {
+		if p.Name == name {
+			data.Peers = append(data.Peers[:i], data.Peers[i+1:]...)
+			return b.save(data)
+		}
+	}
+	return ErrNotFound
+}
+
+// load reads the book. The caller must hold b.mu, except in OpenBook.
+func (b *Book) load() (*bookData, error) {
+	var data bookData
+
+	contents, err := os.ReadFile(b.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &data); err != nil {
+		return nil, fmt.Errorf("peers: open %s: %w", b.name, err)
+	}
+	for _, p := range data.Peers {
+		if err := p.check(); err != nil {
+			return nil, fmt.Errorf("peers: open %s: %w", b.name, err)
+		}
+	}
+
+	sort.Slice(data.Peers, func(i, j int) bool {
+		return data.Peers[i].Name < data.Peers[j].Name
+	})
+	return &data, nil
+}
+
+// save writes the book atomically and readable only by its owner.
+// The caller must hold b.mu.
+func (b *Book) save(data *bookData) error {
+	contents, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.name), 0700); err != nil {
+		return err
+	}
+
+	// CreateTemp creates the file with mode 0600.
+	tmp, err := os.CreateTemp(filepath.Dir(b.name), filepath.Base(b.name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), b.name)
+}
@@ -0,0 +1,121 @@
+package peers_test
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"nih.software/peers"
+	"nih.software/trust/trustgen"
+)
+
+func TestBook(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "state", peers.DefaultFile)
+	book, err := peers.OpenBook(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps, err := book.Peers(); err != nil || len(ps) != 0 {
+		t.Fatalf("new book: %v, %v", ps, err)
+	}
+
+	for _, p := range []peers.Peer{
+		{Name: "node2", Addrs: []string{"10.0.0.2:7443"}},
+		{Name: "node1", Addrs: []string{"10.0.0.1:7443", "[fd00::1]:7443"}},
+		{Name: "node2", Addrs: []string{"10.0.0.3:7443"}, Source: "dns"},
+	} {
+		if err := book.Put(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("book file: %v, %v", fi, err)
+	}
+
+	// Another process sees the changes.
+	other, err := peers.OpenBook(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := other.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 2 || ps[0].Name != "node1" || ps[1].Name != "node2" {
+		t.Fatalf("peers %+v", ps)
+	}
+	if p := ps[0]; len(p.Addrs) != 2 || p.Source != peers.SourceStatic || p.Updated.IsZero() {
+		t.Errorf("node1 = %+v", p)
+	}
+	if p := ps[1]; !slices.Equal(p.Addrs, []string{"10.0.0.3:7443"}) || p.Source != "dns" {
+		t.Errorf("replaced node2 = %+v", p)
+	}
+
+	if p, err := other.Lookup("node1"); err != nil || p.Addrs[0] != "10.0.0.1:7443" {
+		t.Errorf("Lookup = %+v, %v", p, err)
+	}
+	if err := book.Remove("node1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Lookup("node1"); !errors.Is(err, peers.ErrNotFound) {
+		t.Errorf("Lookup of a removed peer: %v", err)
+	}
+	if err := book.Remove("node1"); !errors.Is(err, peers.ErrNotFound) {
+		t.Errorf("Remove of a removed peer: %v", err)
+	}
+
+	for _, p := range []peers.Peer{
+		{Name: "", Addrs: []string{"host:1"}},
+		{Name: "a:b", Addrs: []string{"host:1"}},
+		{Name: "node"},
+		{Name: "node", Addrs: []string{"host"}},
+		{Name: "node", Addrs: []string{"host:1"}, Pin: "short"},
+	} {
+		if err := book.Put(p); err == nil {
+			t.Errorf("Put(%+v) succeeded", p)
+		}
+	}
+
+	if err := os.WriteFile(name, []byte(`{"peers":[{"name":"x","addrs":["nope"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peers.OpenBook(name); err == nil {
+		t.Error("OpenBook of an invalid book succeeded")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Leaves:  2,
+		Options: []trustgen.Option{trustgen.WithSubject(pkix.Name{CommonName: "node1"})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, sibling := h.Leaves[0].Cert, h.Leaves[1].Cert
+
+	pin := peers.Pin(leaf)
+	if pin == peers.Pin(sibling) || len(pin) != 43 {
+		t.Fatalf("Pin = %q", pin)
+	}
+
+	for _, tt := range []struct {
+		p    peers.Peer
+		ok   bool
+		desc string
+	}{
+		{peers.Peer{Name: "node1"}, true, "name"},
+		{peers.Peer{Name: "node1", Pin: pin}, true, "name and pin"},
+		{peers.Peer{Name: "node2"}, false, "other name"},
+		{peers.Peer{Name: "node1", Pin: peers.Pin(sibling)}, false, "other key"},
+	} {
+		err := tt.p.Verify(leaf)
+		if tt.ok && err != nil || !tt.ok && !errors.Is(err, peers.ErrIdentity) {
+			t.Errorf("%s: Verify = %v", tt.desc, err)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package srv finds nodes by the DNS SRV records of a name (RFC 2782), such
+// as _nih._tcp.example.com, as service discovery systems publish them.
+//
+// Every target of the records is a node, named after the first label of
+// the target, which must be the common name of its certificate: the
+// target node1.example.com. is the node node1. The addresses of a node are
+// those of its target, at the port of the record, in order of priority
+// and weight.
+//
+// A Finder keeps the nodes it found for as long as the records live, so
+// that finding them again every round of probes only asks the server once
+// their time to live is over.
+package srv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nih.software/log"
+	"nih.software/peers"
+	"nih.software/peers/internal/dnsmsg"
+)
+
+// Bounds of the time nodes found are kept, whatever the time to live of
+// their records.
+const (
+	DefaultMinTTL = 5 * time.Second
+	DefaultMaxTTL = time.Hour
+)
+
+// maxStale is how long a Finder keeps returning the nodes it found once
+// their time to live is over, while the server fails to answer.
+const maxStale = 10 * time.Minute
+
+// attemptTimeout bounds each query to the server.
+const attemptTimeout = 2 * time.Second
+
+// resolvConf is the resolver configuration of the system.
+const resolvConf = "/etc/resolv.conf"
+
+// A Finder finds the nodes of the SRV records of a name. It is a
+// peers.Finder whose peers have Source peers.SourceDNS.
+type Finder struct {
+	// Name is the name of the SRV records, such as _nih._tcp.example.com.
+	Name string
+
+	// Server is the address of the DNS server to ask, as host:port.
+	// If empty, it is the first nameserver of /etc/resolv.conf.
+	Server string
+
+	// MinTTL and MaxTTL bound the time nodes found are kept:
+	// DefaultMinTTL and DefaultMaxTTL if zero.
+	MinTTL, MaxTTL time.Duration
+
+	mu      sync.Mutex
+	found   []peers.Peer
+	expires time.Time
+}
+
+// Find returns the nodes of the SRV records of f.Name, asking the server
+// only if those found last have expired. If the server fails, Find keeps
+// returning them for up to ten minutes after they expired.
+func (f *Finder) Find(ctx context.Context) ([]peers.Peer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(f.expires) {
+		return f.found, nil
+	}
+
+	found, ttl, err := f.lookup(ctx)
+	if err != nil {
+		if !f.expires.IsZero() && now.Before(f.expires.Add(maxStale)) {
+			log.Default().Warn("srv: keeping the nodes found last", "name", f.Name, "err", err)
+			return f.found, nil
+		}
+		return nil, err
+	}
+
+	minTTL, maxTTL := f.MinTTL, f.MaxTTL
+	if minTTL == 0 {
+		minTTL = DefaultMinTTL
+	}
+	if maxTTL == 0 {
+		maxTTL = DefaultMaxTTL
+	}
+	f.found, f.expires = found, now.Add(min(max(ttl, minTTL), maxTTL))
+	log.Default().Debug("srv: found", "name", f.Name, "nodes", len(found), "expires", f.expires)
+	return found, nil
+}
+
+// lookup asks the server for the nodes of f.Name and returns them with the
+// time to live of the records they are of.
+func (f *Finder) lookup(ctx context.Context) ([]peers.Peer, time.Duration, error) {
+	name := f.Name
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	server := f.Server
+	if server == "" {
+		var err error
+		if server, err = systemServer(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	resp, err := exchange(ctx, server, name, dnsmsg.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.RCode == dnsmsg.RCodeNameErr {
+		return nil, 0, nil
+	}
+
+	var srvs []dnsmsg.Record
+	ttl := time.Duration(-1)
+	expire := func(r dnsmsg.Record) {
+		if d := time.Duration(r.TTL) * time.Second; ttl < 0 || d < ttl {
+			ttl = d
+		}
+	}
+	for _, r := range resp.Answers {
+		if r.Type == dnsmsg.TypeSRV && strings.EqualFold(r.Name, name) {
+			srvs = append(srvs, r)
+			expire(r)
+		}
+	}
+	if len(srvs) == 0 {
+		return nil, 0, nil
+	}
+
+	// Addresses of the targets the server added, or asked for.
+	ips := make(map[string][]netip.Addr)
+	for _, r := range resp.Additionals {
+		if r.Type == dnsmsg.TypeA || r.Type == dnsmsg.TypeAAAA {
+			key := strings.ToLower(r.Name)
+			ips[key] = append(ips[key], r.IP)
+			expire(r)
+		}
+	}
+	for _, r := range srvs {
+		key := strings.ToLower(r.Target)
+		if _, ok := ips[key]; ok || r.Target == "." {
+			continue
+		}
+		ips[key] = []netip.Addr{}
+		for _, t := range []uint16{dnsmsg.TypeA, dnsmsg.TypeAAAA} {
+			resp, err := exchange(ctx, server, r.Target, t)
+			if err != nil {
+				return nil, 0, err
+			}
+			for _, a := range resp.Answers {
+				if a.Type == t {
+					ips[key] = append(ips[key], a.IP)
+					expire(a)
+				}
+			}
+		}
+	}
+
+	// By priority, then by weight, heaviest first.
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+
+	var found []peers.Peer
+	for _, r := range srvs {
+		labels, err := dnsmsg.Labels(r.Target)
+		if err != nil || len(labels) == 0 || !peers.ValidName(labels[0]) {
+			continue
+		}
+		i := slices.IndexFunc(found, func(p peers.Peer) bool { return p.Name == labels[0] })
+		if i < 0 {
+			found = append(found, peers.Peer{Name: labels[0], Source: peers.SourceDNS})
+			i = len(found) - 1
+		}
+		for _, ip := range ips[strings.ToLower(r.Target)] {
+			addr := netip.AddrPortFrom(ip, r.Port).String()
+			if !slices.Contains(found[i].Addrs, addr) {
+				found[i].Addrs = append(found[i].Addrs, addr)
+			}
+		}
+	}
+
+	found = slices.DeleteFunc(found, func(p peers.Peer) bool { return len(p.Addrs) == 0 })
+	sort.Slice(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	return found, ttl, nil
+}
+
+// systemServer returns the address of the first nameserver of the system.
+func systemServer() (string, error) {
+	data, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return "", fmt.Errorf("srv: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", fmt.Errorf("srv: no nameserver in %s", resolvConf)
+}
+
+// exchange asks server for the records of name and type t, over UDP, and
+// again over TCP if the answer is truncated. It retries once on timeout.
+func exchange(ctx context.Context, server, name string, t uint16) (*dnsmsg.Message, error) {
+	var id [2]byte
+	rand.Read(id[:])
+	q := &dnsmsg.Message{
+		ID:               binary.BigEndian.Uint16(id[:]),
+		RecursionDesired: true,
+		Questions:        []dnsmsg.Question{{Name: name, Type: t, Class: dnsmsg.ClassINET}},
+	}
+	data, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *dnsmsg.Message
+	for attempt := 0; ; attempt++ {
+		resp, err = exchangeOver(ctx, "udp", server, q, data)
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() && attempt == 0 && ctx.Err() == nil {
+			continue
+		}
+		break
+	}
+	if err == nil && resp.Truncated {
+		resp, err = exchangeOver(ctx, "tcp", server, q, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("srv: %s: %w", name, err)
+	}
+
+	if resp.RCode != dnsmsg.RCodeSuccess && resp.RCode != dnsmsg.RCodeNameErr {
+		return nil, fmt.Errorf("srv: %s: server failed with rcode %d", name, resp.RCode)
+	}
+	return resp, nil
+}
+
+// exchangeOver sends q, encoded as data, to server over network, and
+// returns the response to it.
+func exchangeOver(ctx context.Context, network, server string, q *dnsmsg.Message, data []byte) (*dnsmsg.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, attemptTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "tcp" {
+		// prefixed by its length
+		data = append(binary.BigEndian.AppendUint16(nil, uint16(len(data))), data...)
+	}
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, dnsmsg.MaxSize)
+	for {
+		var n int
+		if network == "tcp" {
+			var size [2]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return nil, err
+			}
+			n = int(binary.BigEndian.Uint16(size[:]))
+			if n > len(buf) {
+				return nil, fmt.Errorf("response of %d bytes too large", n)
+			}
+			if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+				return nil, err
+			}
+		} else if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+
+		resp, err := dnsmsg.Unpack(buf[:n])
+		if err != nil {
+			if network == "tcp" {
+				return nil, err
+			}
+			continue
+		}
+		if !resp.Response || resp.ID != q.ID || len(resp.Questions) != 1 || !strings.EqualFold(resp.Questions[0].Name, q.Questions[0].Name) || resp.Questions[0].Type != q.Questions[0].Type {
+			// Not the response to q: a stray or spoofed datagram.
+			if network == "tcp" {
+				return nil, errors.New("mismatched response")
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
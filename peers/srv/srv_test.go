@@ -0,0 +1,235 @@
+package srv_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nih.software/peers"
+	"nih.software/peers/internal/dnsmsg"
+	"nih.software/peers/srv"
+)
+
+const name = "_nih._tcp.example.com."
+
+// server is a DNS server over UDP and TCP on the same loopback port,
+// answering from records.
+type server struct {
+	addr    string
+	queries atomic.Int32
+
+	mu       sync.Mutex
+	records  []dnsmsg.Record
+	truncate bool // answer over UDP with only the truncated bit
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func newServer(t *testing.T, records ...dnsmsg.Record) *server {
+	s := &server{records: records}
+	for range 10 {
+		udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.Listen("tcp4", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			continue
+		}
+		s.udp, s.tcp, s.addr = udp, tcp, udp.LocalAddr().String()
+		break
+	}
+	if s.addr == "" {
+		t.Fatal("no port free over both UDP and TCP")
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(s.close)
+	return s
+}
+
+func (s *server) close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+// answer returns the response to the query data, over TCP or not.
+func (s *server) answer(data []byte, tcp bool) []byte {
+	q, err := dnsmsg.Unpack(data)
+	if err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	s.queries.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &dnsmsg.Message{ID: q.ID, Response: true, Questions: q.Questions}
+	if s.truncate && !tcp {
+		resp.Truncated = true
+	} else {
+		qq := q.Questions[0]
+		for _, r := range s.records {
+			if r.Name == qq.Name && r.Type == qq.Type {
+				resp.Answers = append(resp.Answers, r)
+			}
+		}
+		// Addresses of the SRV targets named "add.*" go along.
+		for _, a := range resp.Answers {
+			if a.Type != dnsmsg.TypeSRV {
+				continue
+			}
+			for _, r := range s.records {
+				if r.Name == a.Target && strings.HasPrefix(r.Name, "add.") && (r.Type == dnsmsg.TypeA || r.Type == dnsmsg.TypeAAAA) {
+					resp.Additionals = append(resp.Additionals, r)
+				}
+			}
+		}
+		if len(resp.Answers) == 0 && qq.Name != name && qq.Type == dnsmsg.TypeSRV {
+			resp.RCode = dnsmsg.RCodeNameErr
+		}
+	}
+	out, _ := resp.Pack()
+	return out
+}
+
+func (s *server) serveUDP() {
+	buf := make([]byte, dnsmsg.MaxSize)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if out := s.answer(buf[:n], false); out != nil {
+			s.udp.WriteTo(out, from)
+		}
+	}
+}
+
+func (s *server) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var size [2]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint16(size[:]))
+			if _, err := io.ReadFull(conn, data); err != nil {
+				return
+			}
+			out := s.answer(data, true)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...))
+		}()
+	}
+}
+
+func records() []dnsmsg.Record {
+	in := dnsmsg.ClassINET
+	return []dnsmsg.Record{
+		{Name: name, Type: dnsmsg.TypeSRV, Class: in, TTL: 60, Priority: 10, Weight: 1, Port: 7443, Target: "node1.example.com."},
+		{Name: name, Type: dnsmsg.TypeSRV, Class: in, TTL: 60, Priority: 10, Weight: 5, Port: 8443, Target: "node1.example.com."},
+		{Name: name, Type: dnsmsg.TypeSRV, Class: in, TTL: 60, Priority: 0, Port: 7443, Target: "add.example.com."},
+		{Name: name, Type: dnsmsg.TypeSRV, Class: in, TTL: 60, Port: 7443, Target: "gone.example.com."},
+		{Name: "node1.example.com.", Type: dnsmsg.TypeA, Class: in, TTL: 30, IP: netip.MustParseAddr("192.0.2.1")},
+		{Name: "node1.example.com.", Type: dnsmsg.TypeAAAA, Class: in, TTL: 30, IP: netip.MustParseAddr("2001:db8::1")},
+		{Name: "add.example.com.", Type: dnsmsg.TypeA, Class: in, TTL: 60, IP: netip.MustParseAddr("192.0.2.2")},
+	}
+}
+
+func TestFind(t *testing.T) {
+	s := newServer(t, records()...)
+	f := &srv.Finder{Name: "_nih._tcp.example.com", Server: s.addr, MinTTL: time.Hour}
+
+	want := []peers.Peer{
+		{Name: "add", Addrs: []string{"192.0.2.2:7443"}, Source: peers.SourceDNS},
+		{Name: "node1", Addrs: []string{"192.0.2.1:8443", "[2001:db8::1]:8443", "192.0.2.1:7443", "[2001:db8::1]:7443"}, Source: peers.SourceDNS},
+	}
+	found, err := f.Find(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("Find = %+v\nwant %+v", found, want)
+	}
+
+	// Until they expire, the nodes found are not asked for again.
+	n := s.queries.Load()
+	if found, err := f.Find(context.Background()); err != nil || !reflect.DeepEqual(found, want) {
+		t.Errorf("Find again = %+v, %v", found, err)
+	}
+	if s.queries.Load() != n {
+		t.Errorf("Find again asked the server %d times", s.queries.Load()-n)
+	}
+
+	// A name without records has no nodes.
+	f = &srv.Finder{Name: "_nih._tcp.example.org.", Server: s.addr}
+	if found, err := f.Find(context.Background()); err != nil || len(found) != 0 {
+		t.Errorf("Find of an unknown name = %+v, %v", found, err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s := newServer(t, records()...)
+	f := &srv.Finder{Name: name, Server: s.addr, MinTTL: time.Millisecond, MaxTTL: 50 * time.Millisecond}
+	if _, err := f.Find(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once they expire, the records are asked for again.
+	s.mu.Lock()
+	s.records = s.records[2:]
+	s.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	found, err := f.Find(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []peers.Peer{{Name: "add", Addrs: []string{"192.0.2.2:7443"}, Source: peers.SourceDNS}}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("Find after expiry = %+v, want %+v", found, want)
+	}
+
+	// Without the server, the nodes found last are kept.
+	s.close()
+	time.Sleep(100 * time.Millisecond)
+	if found, err := f.Find(context.Background()); err != nil || !reflect.DeepEqual(found, want) {
+		t.Errorf("Find without the server = %+v, %v", found, err)
+	}
+
+	// But a Finder which never found any fails.
+	f = &srv.Finder{Name: name, Server: s.addr}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := f.Find(ctx); err == nil {
+		t.Error("Find without the server succeeded")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	s := newServer(t, records()...)
+	s.mu.Lock()
+	s.truncate = true
+	s.mu.Unlock()
+	f := &srv.Finder{Name: name, Server: s.addr}
+	found, err := f.Find(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Errorf("Find over TCP = %+v", found)
+	}
+}
@@ -0,0 +1,340 @@
+// Package pubsub delivers messages published to topics to the subscribers
+// of the topics, and decides who may publish and subscribe to which.
+//
+// Topics are names of segments separated by dots, such as trust.anchors.
+// Subscribers and rules name topics by patterns, in which a segment "*"
+// matches any one segment, and a last segment ">" matches one or more, so
+// that trust.* matches trust.anchors, and trust.> matches trust.anchors.v2
+// as well.
+//
+// A Bus delivers messages at most once to every subscription, which drops
+// messages it has no room for rather than holding up the others.
+package pubsub
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nih.software/trust"
+)
+
+// DefaultBuffer is the number of messages a subscription holds for its
+// reader unless configured otherwise.
+const DefaultBuffer = 64
+
+// seenFor is how long a Bus remembers the IDs of messages it delivered,
+// to deliver copies arriving by other paths not again.
+const seenFor = 10 * time.Minute
+
+// maxSeen bounds the IDs a Bus remembers.
+const maxSeen = 100000
+
+// A Message is a message published to a topic.
+type Message struct {
+	// ID identifies the message across the nodes it reaches.
+	ID    string `json:"id"`
+	Topic string `json:"topic"`
+
+	// From is the common name of the certificate of the publisher, or
+	// the name of the node for a publisher of its control socket.
+	From string    `json:"from"`
+	Time time.Time `json:"time"`
+	Data []byte    `json:"data,omitempty"`
+}
+
+// NewID returns a new random ID for a message.
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidTopic reports whether topic is the name of a topic: segments of
+// letters, digits, '-', and '_', separated by dots.
+func ValidTopic(topic string) bool {
+	return validPattern(topic, false)
+}
+
+// ValidPattern reports whether pattern is a pattern of topics: a topic
+// whose segments may also be "*", and whose last one may be ">".
+func ValidPattern(pattern string) bool {
+	return validPattern(pattern, true)
+}
+
+func validPattern(s string, wild bool) bool {
+	segs := strings.Split(s, ".")
+	for i, seg := range segs {
+		switch {
+		case seg == "":
+			return false
+		case wild && seg == "*":
+		case wild && seg == ">" && i == len(segs)-1:
+		case strings.Trim(seg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_") != "":
+			return false
+		}
+	}
+	return true
+}
+
+// Match reports whether the topic matches pattern.
+func Match(pattern, topic string) bool {
+	return covers(pattern, topic)
+}
+
+// covers reports whether every topic that matches sub matches pattern.
+// A topic matches itself only.
+func covers(pattern, sub string) bool {
+	ps, ss := strings.Split(pattern, "."), strings.Split(sub, ".")
+	for i, p := range ps {
+		if p == ">" {
+			return len(ss) > i
+		}
+		if i >= len(ss) {
+			return false
+		}
+		switch {
+		case ss[i] == ">":
+			return false
+		case p == "*":
+		case p != ss[i]:
+			return false
+		}
+	}
+	return len(ps) == len(ss)
+}
+
+// An Action is what a rule grants on topics.
+type Action string
+
+const (
+	Publish   Action = "publish"
+	Subscribe Action = "subscribe"
+)
+
+// A Rule grants the principals it lists the right to publish or subscribe
+// to the topics that match its pattern. A principal is "*", any peer of
+// the cluster; "name:NAME", the peer whose certificate has the common name
+// NAME; or "role:ROLE", the peers whose certificates grant ROLE, as
+// trust.HasRole reports.
+type Rule struct {
+	Topic     string   `json:"topic"`
+	Publish   []string `json:"publish,omitempty"`
+	Subscribe []string `json:"subscribe,omitempty"`
+}
+
+// A Policy is the rules of the topics of a node. A peer may publish to a
+// topic if a rule of a pattern it matches grants it to the peer, and may
+// subscribe to a pattern if a rule of a pattern that covers every topic
+// the pattern matches grants it.
+type Policy []Rule
+
+// LoadPolicy reads a policy from the JSON array of rules in the named file.
+func LoadPolicy(name string) (Policy, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("pubsub: %s: %v", name, err)
+	}
+	if err := p.Check(); err != nil {
+		return nil, fmt.Errorf("pubsub: %s: %v", name, err)
+	}
+	return p, nil
+}
+
+// Check returns an error if a rule of p has an invalid pattern or
+// principal.
+func (p Policy) Check() error {
+	for _, r := range p {
+		if !ValidPattern(r.Topic) {
+			return fmt.Errorf("invalid topic pattern %q", r.Topic)
+		}
+		for _, pr := range append(append([]string{}, r.Publish...), r.Subscribe...) {
+			kind, name, _ := strings.Cut(pr, ":")
+			if pr != "*" && (kind != "name" && kind != "role" || name == "") {
+				return fmt.Errorf("%s: invalid principal %q", r.Topic, pr)
+			}
+		}
+	}
+	return nil
+}
+
+// Allow reports whether the holder of leaf may take action on the topics
+// of pattern, a topic for Publish.
+func (p Policy) Allow(leaf *x509.Certificate, action Action, pattern string) bool {
+	for _, r := range p {
+		if !covers(r.Topic, pattern) {
+			continue
+		}
+		principals := r.Publish
+		if action == Subscribe {
+			principals = r.Subscribe
+		}
+		for _, pr := range principals {
+			if grants(pr, leaf) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func grants(principal string, leaf *x509.Certificate) bool {
+	kind, name, _ := strings.Cut(principal, ":")
+	switch {
+	case principal == "*":
+		return true
+	case kind == "name":
+		return leaf.Subject.CommonName == name
+	case kind == "role":
+		return trust.HasRole(leaf, name)
+	}
+	return false
+}
+
+// ErrClosed is the error of subscribing to a closed bus.
+var ErrClosed = errors.New("pubsub: bus closed")
+
+// A Bus delivers the messages published on a node to the subscriptions of
+// the node. The zero value is a bus ready to use.
+type Bus struct {
+	// Buffer is the number of messages every subscription holds.
+	// Zero means DefaultBuffer.
+	Buffer int
+
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	seen   map[string]time.Time
+	closed bool
+}
+
+// A Subscription receives the messages of the topics of its patterns.
+type Subscription struct {
+	// C receives the messages, until the subscription is closed.
+	C <-chan Message
+
+	c        chan Message
+	bus      *Bus
+	patterns []string
+	dropped  atomic.Int64
+}
+
+// Subscribe returns a subscription to the topics of patterns.
+func (b *Bus) Subscribe(patterns ...string) (*Subscription, error) {
+	if len(patterns) == 0 {
+		return nil, errors.New("pubsub: no topic to subscribe to")
+	}
+	for _, p := range patterns {
+		if !ValidPattern(p) {
+			return nil, fmt.Errorf("pubsub: invalid topic pattern %q", p)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if b.subs == nil {
+		b.subs = make(map[*Subscription]struct{})
+	}
+
+	n := b.Buffer
+	if n == 0 {
+		n = DefaultBuffer
+	}
+	c := make(chan Message, n)
+	s := &Subscription{C: c, c: c, bus: b, patterns: append([]string{}, patterns...)}
+	b.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Close ends s, closing its channel.
+func (s *Subscription) Close() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// Dropped returns the number of messages s dropped for want of room.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Deliver delivers m to the subscriptions of its topic, and reports
+// whether it did: false if the bus delivered a message of its ID already.
+func (b *Bus) Deliver(m Message) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return false
+	}
+
+	now := time.Now()
+	if b.seen == nil {
+		b.seen = make(map[string]time.Time)
+	}
+	if t, ok := b.seen[m.ID]; ok && now.Sub(t) < seenFor {
+		return false
+	}
+	if len(b.seen) >= maxSeen {
+		for id, t := range b.seen {
+			if now.Sub(t) >= seenFor {
+				delete(b.seen, id)
+			}
+		}
+		for id := range b.seen {
+			if len(b.seen) < maxSeen {
+				break
+			}
+			delete(b.seen, id)
+		}
+	}
+	b.seen[m.ID] = now
+
+	for s := range b.subs {
+		for _, p := range s.patterns {
+			if !Match(p, m.Topic) {
+				continue
+			}
+			select {
+			case s.c <- m:
+			default:
+				s.dropped.Add(1)
+			}
+			break
+		}
+	}
+	return true
+}
+
+// Close closes every subscription of b, and b to new ones.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,164 @@
+package pubsub_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nih.software/pubsub"
+)
+
+func TestMatch(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"trust.anchors", "trust.anchors", true},
+		{"trust.anchors", "trust.anchor", false},
+		{"trust.*", "trust.anchors", true},
+		{"trust.*", "trust", false},
+		{"trust.*", "trust.anchors.v2", false},
+		{"trust.>", "trust.anchors.v2", true},
+		{"trust.>", "trust", false},
+		{"*.anchors", "trust.anchors", true},
+		{">", "a.b.c", true},
+	} {
+		if got := pubsub.Match(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v", tt.pattern, tt.topic, got)
+		}
+	}
+
+	for topic, want := range map[string]bool{
+		"a.b-c.d_e": true, "a": true, "": false, "a..b": false, "a.*": false, "a b": false,
+	} {
+		if got := pubsub.ValidTopic(topic); got != want {
+			t.Errorf("ValidTopic(%q) = %v", topic, got)
+		}
+	}
+	for pattern, want := range map[string]bool{
+		"a.*": true, "a.>": true, "*.b": true, ">": true, "a.>.b": false, "a.b*": false,
+	} {
+		if got := pubsub.ValidPattern(pattern); got != want {
+			t.Errorf("ValidPattern(%q) = %v", pattern, got)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p := pubsub.Policy{
+		{Topic: "trust.>", Publish: []string{"role:ca"}, Subscribe: []string{"*"}},
+		{Topic: "config.*", Publish: []string{"name:admin"}, Subscribe: []string{"role:node"}},
+	}
+	if err := p.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert := func(cn string, ous ...string) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn, OrganizationalUnit: ous}}
+	}
+	ca, admin, node := cert("ca1", "ca"), cert("admin"), cert("node1", "node")
+
+	for _, tt := range []struct {
+		leaf    *x509.Certificate
+		action  pubsub.Action
+		pattern string
+		want    bool
+	}{
+		{ca, pubsub.Publish, "trust.anchors", true},
+		{node, pubsub.Publish, "trust.anchors", false},
+		{node, pubsub.Subscribe, "trust.anchors", true},
+		{node, pubsub.Subscribe, "trust.*", true},
+		{node, pubsub.Subscribe, ">", false},
+		{admin, pubsub.Publish, "config.peers", true},
+		{admin, pubsub.Publish, "config.peers.extra", false},
+		{admin, pubsub.Subscribe, "config.peers", false},
+		{node, pubsub.Subscribe, "config.*", true},
+		{node, pubsub.Subscribe, "config.>", false},
+		{admin, pubsub.Publish, "other", false},
+	} {
+		if got := p.Allow(tt.leaf, tt.action, tt.pattern); got != tt.want {
+			t.Errorf("Allow(%s, %s, %q) = %v", tt.leaf.Subject.CommonName, tt.action, tt.pattern, got)
+		}
+	}
+
+	for _, bad := range []pubsub.Policy{
+		{{Topic: "a..b"}},
+		{{Topic: "a", Publish: []string{"admin"}}},
+		{{Topic: "a", Subscribe: []string{"role:"}}},
+	} {
+		if err := bad.Check(); err == nil {
+			t.Errorf("Check(%+v) = nil", bad)
+		}
+	}
+
+	name := filepath.Join(t.TempDir(), "topics.json")
+	os.WriteFile(name, []byte(`[{"topic": "trust.>", "publish": ["role:ca"]}]`), 0600)
+	if p, err := pubsub.LoadPolicy(name); err != nil || len(p) != 1 || p[0].Publish[0] != "role:ca" {
+		t.Errorf("LoadPolicy = %+v, %v", p, err)
+	}
+	os.WriteFile(name, []byte(`[{"topic": "trust.>", "publish": ["ca"]}]`), 0600)
+	if _, err := pubsub.LoadPolicy(name); err == nil {
+		t.Error("LoadPolicy of an invalid principal succeeded")
+	}
+}
+
+func TestBus(t *testing.T) {
+	b := &pubsub.Bus{Buffer: 2}
+	trust, err := b.Subscribe("trust.>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := b.Subscribe(">", "trust.anchors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe("a..b"); err == nil {
+		t.Error("Subscribe of an invalid pattern succeeded")
+	}
+
+	m := pubsub.Message{ID: pubsub.NewID(), Topic: "trust.anchors", Data: []byte("x")}
+	if !b.Deliver(m) {
+		t.Fatal("Deliver = false")
+	}
+	if b.Deliver(m) {
+		t.Error("Deliver of a message again = true")
+	}
+	b.Deliver(pubsub.Message{ID: pubsub.NewID(), Topic: "config.peers"})
+
+	if got := <-trust.C; got.ID != m.ID || string(got.Data) != "x" {
+		t.Errorf("trust got %+v", got)
+	}
+	if got := <-all.C; got.ID != m.ID {
+		t.Errorf("all got %+v first", got)
+	}
+	if got := <-all.C; got.Topic != "config.peers" {
+		t.Errorf("all got %+v second", got)
+	}
+	select {
+	case got := <-trust.C:
+		t.Errorf("trust got %+v of another topic", got)
+	default:
+	}
+
+	// A subscription without room drops messages.
+	for range 3 {
+		b.Deliver(pubsub.Message{ID: pubsub.NewID(), Topic: "trust.anchors"})
+	}
+	if n := trust.Dropped(); n != 1 {
+		t.Errorf("dropped %d", n)
+	}
+
+	trust.Close()
+	trust.Close()
+	b.Close()
+	if _, ok := <-all.C; !ok {
+		t.Error("all closed with messages left")
+	}
+	for range all.C {
+	}
+	if _, err := b.Subscribe(">"); err != pubsub.ErrClosed {
+		t.Errorf("Subscribe after Close: %v", err)
+	}
+}
@@ -0,0 +1,1239 @@
+// Package raft replicates a log of commands across the servers of a
+// cluster by the Raft consensus algorithm (Ongaro and Ousterhout, 2014),
+// and applies the commands it commits, in the order of the log, to a state
+// machine on every server, so that their states agree.
+//
+// The servers elect a leader, which appends the commands proposed to its
+// log and replicates them to the others, its followers. A command is
+// committed once a majority of the servers stored it, and survives the
+// failure of any minority of them. A follower that hears from no leader
+// for an election timeout stands for election in a new term, and the
+// leader that a majority of the servers votes for replaces the old one,
+// which steps down as it learns of the new term, or once it failed to
+// reach a majority for an election timeout itself.
+//
+// The servers are the voters of the last configuration of the log, which
+// changes by a server at a time (Ongaro, 2014, §4.1): a change takes
+// effect on every server as it appends it, and the leader makes no other
+// until the first is committed. A server with no configuration, such as
+// one that is about to join, waits for a leader to replicate one to it.
+//
+// Every server compacts its log into a snapshot of its state machine once
+// it applied SnapshotThreshold entries past the last snapshot, and the
+// leader sends its snapshot to followers missing the entries it compacted.
+//
+// Servers exchange their messages over a Transport, such as the RPC
+// methods of package daemon, and keep their term, vote, log, and snapshot
+// in a directory.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"nih.software/log"
+)
+
+// Defaults of a Config.
+const (
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultElectionTimeout   = time.Second
+	DefaultSnapshotThreshold = 4096
+)
+
+// Limits of an AppendEntries request, but for its first entry.
+const (
+	maxAppendEntries = 256
+	maxAppendBytes   = 4 << 20
+)
+
+// snapshotTimeout bounds an InstallSnapshot request, which carries a whole
+// snapshot.
+const snapshotTimeout = 30 * time.Second
+
+var (
+	// ErrNotLeader is the error of asking a server that is not the
+	// leader for what only the leader does.
+	ErrNotLeader = errors.New("raft: not the leader")
+
+	// ErrLeadershipLost is the error of a proposal whose leader stepped
+	// down before it was committed. It may be committed all the same.
+	ErrLeadershipLost = errors.New("raft: leadership lost")
+
+	// ErrChangeInProgress is the error of a change of the configuration
+	// proposed before the last change, or the first entry of the term of
+	// the leader, is committed.
+	ErrChangeInProgress = errors.New("raft: configuration change in progress")
+
+	// ErrStopped is the error of a proposal to a node that stopped
+	// running.
+	ErrStopped = errors.New("raft: node stopped")
+)
+
+// A State is the role of a server in its term.
+type State string
+
+const (
+	Follower  State = "follower"
+	Candidate State = "candidate"
+	Leader    State = "leader"
+)
+
+// A Server is a voter of a configuration.
+type Server struct {
+	// ID names the server uniquely in the cluster.
+	ID string `json:"id"`
+
+	// Addr is the address the other servers reach the server at, if the
+	// transport needs one.
+	Addr string `json:"addr,omitempty"`
+}
+
+// An EntryType is what an entry of the log holds.
+type EntryType string
+
+const (
+	// EntryCommand is a command for the state machine.
+	EntryCommand EntryType = "command"
+
+	// EntryConfig is a configuration of the servers.
+	EntryConfig EntryType = "config"
+
+	// EntryNoop is the entry a leader appends as it is elected, to commit
+	// the entries of the terms before its own.
+	EntryNoop EntryType = "noop"
+)
+
+// An Entry is an entry of the log.
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type"`
+
+	// Data is the command of an EntryCommand.
+	Data []byte `json:"data,omitempty"`
+
+	// Servers are the voters of an EntryConfig.
+	Servers []Server `json:"servers,omitempty"`
+}
+
+// A Snapshot is the state of the state machine after the entries of the
+// log up to an index, which it replaces.
+type Snapshot struct {
+	// Index and Term are those of the last entry the snapshot replaces.
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+
+	// Servers are the voters of the configuration at Index.
+	Servers []Server `json:"servers"`
+
+	// Data is the snapshot of the state machine.
+	Data []byte `json:"data"`
+}
+
+// A VoteRequest is the request of a candidate for the vote of a server.
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+
+	// LastIndex and LastTerm are those of the last entry of the log of
+	// the candidate.
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+// A VoteResponse is the answer to a VoteRequest.
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// An AppendRequest carries the entries of the leader to a follower, and
+// the heartbeat of the leader if it has none.
+type AppendRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+
+	// PrevIndex and PrevTerm are those of the entry preceding Entries,
+	// which the follower must have for it to append them.
+	PrevIndex uint64  `json:"prev_index"`
+	PrevTerm  uint64  `json:"prev_term"`
+	Entries   []Entry `json:"entries,omitempty"`
+
+	// Commit is the index of the last entry committed.
+	Commit uint64 `json:"commit"`
+}
+
+// An AppendResponse is the answer to an AppendRequest.
+type AppendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+
+	// LastIndex is the index of the last entry of the follower, or, if it
+	// failed for an entry of another term at PrevIndex, of the last entry
+	// before that term: the leader sends the entries after it next.
+	LastIndex uint64 `json:"last_index"`
+}
+
+// A SnapshotRequest carries the snapshot of the leader to a follower
+// missing the entries it replaces.
+type SnapshotRequest struct {
+	Term     uint64   `json:"term"`
+	Leader   string   `json:"leader"`
+	Snapshot Snapshot `json:"snapshot"`
+}
+
+// A SnapshotResponse is the answer to a SnapshotRequest.
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// A Transport carries messages between servers. Its methods deliver a
+// request to the node of the server to and return its answer, and fail
+// unless it is the node of that server that answers.
+type Transport interface {
+	// RequestVote delivers req to the Node.HandleRequestVote of to.
+	RequestVote(ctx context.Context, to Server, req *VoteRequest) (*VoteResponse, error)
+
+	// AppendEntries delivers req to the Node.HandleAppendEntries of to.
+	AppendEntries(ctx context.Context, to Server, req *AppendRequest) (*AppendResponse, error)
+
+	// InstallSnapshot delivers req to the Node.HandleInstallSnapshot of
+	// to.
+	InstallSnapshot(ctx context.Context, to Server, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+// A StateMachine is the state the log of commands builds. A node calls its
+// methods one at a time.
+type StateMachine interface {
+	// Apply applies the command data of the entry of index, and returns
+	// the result of the proposal of the command. Every server must reach
+	// the same state applying the same commands.
+	Apply(index uint64, data []byte) any
+
+	// Snapshot returns the state, as Restore restores it.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the state with that of a snapshot.
+	Restore(data []byte) error
+}
+
+// Config configures a Node. ID, Transport, and StateMachine are required;
+// the durations and threshold are their default if zero.
+type Config struct {
+	// ID names the server of the node.
+	ID string
+
+	// Addr is the address the other servers reach the node at, if the
+	// transport needs one.
+	Addr string
+
+	Transport    Transport
+	StateMachine StateMachine
+
+	// Dir is the directory the node keeps its state in. Empty means the
+	// node keeps it in memory only, and starts anew every time.
+	Dir string
+
+	// Bootstrap has a node without state start a cluster of its server
+	// alone, which others join as its leader adds them. It is ignored if
+	// the node has state.
+	Bootstrap bool
+
+	// HeartbeatInterval is the time between the requests of a leader to
+	// a follower with no entries to replicate.
+	HeartbeatInterval time.Duration
+
+	// ElectionTimeout is the least time a follower hearing from no leader
+	// waits before it stands for election, and the time a leader waits
+	// for a majority to answer before it steps down. Followers wait up to
+	// twice it, at random, for one of them to stand before the others.
+	ElectionTimeout time.Duration
+
+	// SnapshotThreshold is the number of entries applied after which the
+	// node takes a snapshot and compacts its log.
+	SnapshotThreshold uint64
+}
+
+// Status is the state of a node.
+type Status struct {
+	ID     string `json:"id"`
+	State  State  `json:"state"`
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader,omitempty"`
+
+	LastIndex     uint64 `json:"last_index"`
+	Commit        uint64 `json:"commit"`
+	Applied       uint64 `json:"applied"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+
+	// Servers are the voters of the last configuration of the log.
+	Servers []Server `json:"servers"`
+}
+
+// A future is the outcome of an entry a leader appended, once the entry is
+// applied or the leader stepped down.
+type future struct {
+	term   uint64
+	done   chan struct{}
+	result any
+	err    error
+}
+
+func (f *future) resolve(result any, err error) {
+	f.result, f.err = result, err
+	close(f.done)
+}
+
+// A replicator sends the entries of the leader to a follower.
+type replicator struct {
+	trigger chan struct{}
+	stop    chan struct{}
+}
+
+// A Node is the server of a cluster on a node.
+type Node struct {
+	cfg Config
+
+	// applyMu is held while the state machine applies entries, takes a
+	// snapshot, or restores one. It is locked before mu.
+	applyMu sync.Mutex
+
+	mu       sync.Mutex
+	st       *storage
+	ctx      context.Context
+	stopped  bool
+	state    State
+	term     uint64
+	vote     string
+	leader   string
+	contact  time.Time // of the leader
+	deadline time.Time // of the election timeout
+
+	// log holds the entries after those the snapshot replaced.
+	log         []Entry
+	snapIndex   uint64
+	snapTerm    uint64
+	snapServers []Server
+
+	// servers is the last configuration of the log, the entry of
+	// configIndex.
+	servers     []Server
+	configIndex uint64
+
+	commit  uint64
+	applied uint64
+
+	// Of a leader: the next entry to send to each follower, the last it
+	// is known to have, and when it last answered.
+	next        map[string]uint64
+	match       map[string]uint64
+	acked       map[string]time.Time
+	replicators map[string]*replicator
+	futures     map[uint64]*future
+
+	wake    chan struct{}
+	applyCh chan struct{}
+}
+
+// New returns the node of cfg, read from its directory if it has one.
+func New(cfg Config) (*Node, error) {
+	if cfg.ID == "" || cfg.Transport == nil || cfg.StateMachine == nil {
+		return nil, errors.New("raft: a node needs an ID, a transport, and a state machine")
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+
+	st, hs, entries, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		cfg:     cfg,
+		st:      st,
+		ctx:     context.Background(),
+		state:   Follower,
+		term:    hs.Term,
+		vote:    hs.Vote,
+		log:     entries,
+		futures: make(map[uint64]*future),
+		wake:    make(chan struct{}, 1),
+		applyCh: make(chan struct{}, 1),
+	}
+	if snap := st.snapshot(); snap != nil {
+		if err := cfg.StateMachine.Restore(snap.Data); err != nil {
+			st.close()
+			return nil, fmt.Errorf("raft: restore snapshot %d: %v", snap.Index, err)
+		}
+		n.snapIndex, n.snapTerm, n.snapServers = snap.Index, snap.Term, snap.Servers
+		n.commit, n.applied = snap.Index, snap.Index
+	}
+
+	if cfg.Bootstrap && n.term == 0 && n.lastIndex() == 0 {
+		e := Entry{Index: 1, Term: 1, Type: EntryConfig, Servers: []Server{{ID: cfg.ID, Addr: cfg.Addr}}}
+		if err := st.saveState(hardState{Term: 1}); err != nil {
+			st.close()
+			return nil, err
+		}
+		if err := st.append([]Entry{e}); err != nil {
+			st.close()
+			return nil, err
+		}
+		n.term = 1
+		n.log = append(n.log, e)
+	}
+	n.updateConfig()
+	return n, nil
+}
+
+// ID returns the ID of the server of the node.
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+// Leader returns the ID of the leader the node knows of, or "" if it knows
+// of none.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// IsLeader reports whether the node is the leader.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state == Leader
+}
+
+// Servers returns the voters of the last configuration of the log.
+func (n *Node) Servers() []Server {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return slices.Clone(n.servers)
+}
+
+// Status returns the state of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		LastIndex:     n.lastIndex(),
+		Commit:        n.commit,
+		Applied:       n.applied,
+		SnapshotIndex: n.snapIndex,
+		Servers:       slices.Clone(n.servers),
+	}
+}
+
+// Run takes part in the elections and replication of the cluster, and
+// applies the entries committed to the state machine, until ctx is done.
+// The node stops then: it fails the proposals waiting and the requests of
+// other servers.
+func (n *Node) Run(ctx context.Context) {
+	n.mu.Lock()
+	n.ctx = ctx
+	n.resetDeadline()
+	n.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n.applyLoop(ctx)
+	}()
+
+	t := time.NewTimer(0)
+	defer t.Stop()
+	for {
+		n.mu.Lock()
+		now := time.Now()
+		var wait time.Duration
+		if n.state == Leader {
+			n.checkQuorum(now)
+			wait = n.cfg.HeartbeatInterval
+		} else {
+			if !now.Before(n.deadline) {
+				if n.isVoter(n.cfg.ID) {
+					n.campaign()
+				} else {
+					n.resetDeadline()
+				}
+			}
+			wait = n.deadline.Sub(now)
+		}
+		n.mu.Unlock()
+
+		t.Reset(wait)
+		select {
+		case <-t.C:
+		case <-n.wake:
+		case <-ctx.Done():
+			n.mu.Lock()
+			n.stopped = true
+			n.stopReplicators()
+			n.failFutures(ErrStopped)
+			n.state = Follower
+			n.mu.Unlock()
+
+			wg.Wait()
+			n.mu.Lock()
+			n.st.close()
+			n.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Propose appends the command data to the log of the leader, and returns
+// the result of its StateMachine.Apply once the leader applied it. It fails
+// with ErrNotLeader if the node is not the leader, and ErrLeadershipLost if
+// the leader steps down first. If ctx is done first, the command may be
+// applied all the same.
+func (n *Node) Propose(ctx context.Context, data []byte) (any, error) {
+	n.mu.Lock()
+	f, err := n.propose(Entry{Type: EntryCommand, Data: data})
+	n.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return wait(ctx, f)
+}
+
+// AddVoter adds s to the configuration, or changes its address if the
+// configuration has its ID, and returns once the change is committed. The
+// leader replicates its log to s as it adds it.
+func (n *Node) AddVoter(ctx context.Context, s Server) error {
+	return n.changeConfig(ctx, func(servers []Server) []Server {
+		for i := range servers {
+			if servers[i].ID == s.ID {
+				if servers[i] == s {
+					return nil
+				}
+				servers[i] = s
+				return servers
+			}
+		}
+		return append(servers, s)
+	})
+}
+
+// RemoveServer removes the server of id from the configuration, and
+// returns once the change is committed. A leader that removes its own
+// server steps down then.
+func (n *Node) RemoveServer(ctx context.Context, id string) error {
+	return n.changeConfig(ctx, func(servers []Server) []Server {
+		for i := range servers {
+			if servers[i].ID == id {
+				return slices.Delete(servers, i, i+1)
+			}
+		}
+		return nil
+	})
+}
+
+// changeConfig appends the configuration change makes of the last, unless
+// it returns nil for no change, and waits until it is committed.
+func (n *Node) changeConfig(ctx context.Context, change func([]Server) []Server) error {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	if t, _ := n.termAt(n.commit); n.configIndex > n.commit || t != n.term {
+		n.mu.Unlock()
+		return ErrChangeInProgress
+	}
+	servers := change(slices.Clone(n.servers))
+	if servers == nil {
+		n.mu.Unlock()
+		return nil
+	}
+	f, err := n.propose(Entry{Type: EntryConfig, Servers: servers})
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	_, err = wait(ctx, f)
+	return err
+}
+
+// propose appends e to the log of the leader, with its index and term, and
+// returns the future of its outcome. The caller must hold n.mu.
+func (n *Node) propose(e Entry) (*future, error) {
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	if n.state != Leader {
+		return nil, ErrNotLeader
+	}
+	if err := n.appendLocal(e); err != nil {
+		return nil, err
+	}
+	f := &future{term: n.term, done: make(chan struct{})}
+	n.futures[n.lastIndex()] = f
+	n.maybeCommit()
+	return f, nil
+}
+
+func wait(ctx context.Context, f *future) (any, error) {
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// appendLocal appends e to the log of the leader, with its index and term,
+// and has the followers sent it. The caller must hold n.mu.
+func (n *Node) appendLocal(e Entry) error {
+	e.Index, e.Term = n.lastIndex()+1, n.term
+	if err := n.st.append([]Entry{e}); err != nil {
+		log.Default().Warn("raft: append", "index", e.Index, "err", err)
+		return err
+	}
+	n.log = append(n.log, e)
+	if e.Type == EntryConfig {
+		n.servers, n.configIndex = e.Servers, e.Index
+		n.syncReplicators()
+	}
+	for _, r := range n.replicators {
+		select {
+		case r.trigger <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// HandleRequestVote answers the request of a candidate for the vote of the
+// node. The node votes for the first candidate of a term whose log is at
+// least as long as its own, but for none while it hears from a leader, so
+// that a server removed from the configuration, which hears from none,
+// does not disrupt the cluster.
+func (n *Node) HandleRequestVote(req *VoteRequest) (*VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	resp := &VoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	if n.state == Leader || n.leader != "" && time.Since(n.contact) < n.cfg.ElectionTimeout {
+		return resp, nil
+	}
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+		resp.Term = n.term
+	}
+
+	upToDate := req.LastTerm > n.lastTerm() || req.LastTerm == n.lastTerm() && req.LastIndex >= n.lastIndex()
+	if (n.vote == "" || n.vote == req.Candidate) && upToDate {
+		if err := n.st.saveState(hardState{Term: n.term, Vote: req.Candidate}); err != nil {
+			return nil, err
+		}
+		n.vote = req.Candidate
+		n.resetDeadline()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+// HandleAppendEntries appends the entries of the leader of req to the log
+// of the node, once it checked the log has the entry preceding them, in
+// place of any of another term.
+func (n *Node) HandleAppendEntries(req *AppendRequest) (*AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	resp := &AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	n.follow(req.Term, req.Leader)
+	resp.Term = n.term
+
+	if req.PrevIndex > n.lastIndex() {
+		return resp, nil
+	}
+	if req.PrevIndex >= n.snapIndex {
+		if t, _ := n.termAt(req.PrevIndex); t != req.PrevTerm {
+			// Skip the entries of that term at once.
+			i := req.PrevIndex - 1
+			for i > n.snapIndex && i > n.commit {
+				if u, _ := n.termAt(i); u != t {
+					break
+				}
+				i--
+			}
+			resp.LastIndex = i
+			return resp, nil
+		}
+	}
+
+	// The entries the snapshot replaced are committed, and so those of
+	// the leader.
+	entries := req.Entries
+	for len(entries) > 0 && entries[0].Index <= n.snapIndex {
+		entries = entries[1:]
+	}
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if t, _ := n.termAt(e.Index); t == e.Term {
+				continue
+			}
+			if e.Index <= n.commit {
+				return nil, fmt.Errorf("raft: leader %s replaces committed entry %d", req.Leader, e.Index)
+			}
+			log.Default().Info("raft: truncate", "leader", req.Leader, "index", e.Index)
+			n.log = n.log[:e.Index-n.snapIndex-1]
+			if err := n.st.rewrite(n.log); err != nil {
+				return nil, err
+			}
+			n.updateConfig()
+		}
+
+		rest := entries[i:]
+		if err := n.st.append(rest); err != nil {
+			return nil, err
+		}
+		n.log = append(n.log, rest...)
+		for _, e := range rest {
+			if e.Type == EntryConfig {
+				n.servers, n.configIndex = e.Servers, e.Index
+			}
+		}
+		break
+	}
+
+	if commit := min(req.Commit, req.PrevIndex+uint64(len(req.Entries))); commit > n.commit {
+		n.commit = commit
+		n.signalApply()
+	}
+	resp.Success = true
+	resp.LastIndex = n.lastIndex()
+	return resp, nil
+}
+
+// HandleInstallSnapshot replaces the state machine and log of the node
+// with the snapshot of the leader of req, unless the node has the entries
+// it replaces. The entries of the log after the snapshot are kept if the
+// log has the last entry it replaces.
+func (n *Node) HandleInstallSnapshot(req *SnapshotRequest) (*SnapshotResponse, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+	resp := &SnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	n.follow(req.Term, req.Leader)
+	resp.Term = n.term
+
+	snap := req.Snapshot
+	if snap.Index <= n.commit {
+		return resp, nil
+	}
+	if err := n.st.saveSnapshot(&snap); err != nil {
+		return nil, err
+	}
+	if err := n.cfg.StateMachine.Restore(snap.Data); err != nil {
+		return nil, fmt.Errorf("raft: restore snapshot %d: %v", snap.Index, err)
+	}
+	if t, ok := n.termAt(snap.Index); ok && t == snap.Term {
+		n.log = slices.Clone(n.log[snap.Index-n.snapIndex:])
+	} else {
+		n.log = nil
+	}
+	n.snapIndex, n.snapTerm, n.snapServers = snap.Index, snap.Term, snap.Servers
+	n.commit, n.applied = snap.Index, snap.Index
+	n.updateConfig()
+	if err := n.st.rewrite(n.log); err != nil {
+		return nil, err
+	}
+
+	log.Default().Info("raft: installed snapshot", "leader", req.Leader, "index", snap.Index)
+	return resp, nil
+}
+
+// follow has the node follow leader in term, of which it just heard.
+func (n *Node) follow(term uint64, leader string) {
+	if term > n.term || n.state != Follower {
+		n.stepDown(term)
+	}
+	if n.leader != leader {
+		log.Default().Info("raft: following", "leader", leader, "term", term)
+	}
+	n.leader = leader
+	n.contact = time.Now()
+	n.resetDeadline()
+}
+
+// stepDown has the node follow in term, which is at least its own, and
+// forget the vote of its old term. A leader stepping down fails the
+// proposals waiting with ErrLeadershipLost.
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		if err := n.st.saveState(hardState{Term: term}); err != nil {
+			log.Default().Warn("raft: save state", "term", term, "err", err)
+		}
+		n.term, n.vote = term, ""
+		if n.state == Follower {
+			n.leader = ""
+		}
+	}
+	if n.state == Leader {
+		log.Default().Info("raft: stepped down", "id", n.cfg.ID, "term", n.term)
+		n.stopReplicators()
+		n.failFutures(ErrLeadershipLost)
+		n.leader = ""
+	}
+	n.state = Follower
+	n.resetDeadline()
+}
+
+// campaign stands for election in the next term.
+func (n *Node) campaign() {
+	n.resetDeadline()
+	if err := n.st.saveState(hardState{Term: n.term + 1, Vote: n.cfg.ID}); err != nil {
+		log.Default().Warn("raft: save state", "term", n.term+1, "err", err)
+		return
+	}
+	n.term++
+	n.vote = n.cfg.ID
+	n.state = Candidate
+	n.leader = ""
+	log.Default().Debug("raft: campaign", "id", n.cfg.ID, "term", n.term)
+
+	req := &VoteRequest{Term: n.term, Candidate: n.cfg.ID, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()}
+	granted := map[string]bool{n.cfg.ID: true}
+	if n.count(func(s Server) bool { return granted[s.ID] }) >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, s := range n.servers {
+		if s.ID == n.cfg.ID {
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(n.ctx, n.cfg.ElectionTimeout)
+			resp, err := n.cfg.Transport.RequestVote(ctx, s, req)
+			cancel()
+			if err != nil {
+				log.Default().Debug("raft: request vote", "to", s.ID, "err", err)
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.state != Candidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			granted[s.ID] = true
+			if n.count(func(s Server) bool { return granted[s.ID] }) >= n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// becomeLeader has a candidate lead its term.
+func (n *Node) becomeLeader() {
+	log.Default().Info("raft: elected leader", "id", n.cfg.ID, "term", n.term)
+	n.state = Leader
+	n.leader = n.cfg.ID
+	n.next = make(map[string]uint64)
+	n.match = make(map[string]uint64)
+	n.acked = make(map[string]time.Time)
+	n.replicators = make(map[string]*replicator)
+	n.syncReplicators()
+	if err := n.appendLocal(Entry{Type: EntryNoop}); err != nil {
+		n.stepDown(n.term)
+		return
+	}
+	n.maybeCommit()
+}
+
+// checkQuorum steps the leader down unless a majority of the servers
+// answered it within the election timeout, as they would a leader they
+// follow.
+func (n *Node) checkQuorum(now time.Time) {
+	alive := n.count(func(s Server) bool {
+		return s.ID == n.cfg.ID || now.Sub(n.acked[s.ID]) < n.cfg.ElectionTimeout
+	})
+	if alive < n.quorum() {
+		log.Default().Warn("raft: lost a majority", "id", n.cfg.ID, "term", n.term)
+		n.stepDown(n.term)
+	}
+}
+
+// syncReplicators starts a replicator for every follower of the
+// configuration that has none, and stops those of servers it no longer
+// has.
+func (n *Node) syncReplicators() {
+	if n.state != Leader {
+		return
+	}
+	for _, s := range n.servers {
+		if s.ID == n.cfg.ID || n.replicators[s.ID] != nil {
+			continue
+		}
+		if _, ok := n.next[s.ID]; !ok {
+			n.next[s.ID] = n.lastIndex() + 1
+		}
+		n.acked[s.ID] = time.Now()
+		r := &replicator{trigger: make(chan struct{}, 1), stop: make(chan struct{})}
+		n.replicators[s.ID] = r
+		go n.replicate(s.ID, n.term, r)
+	}
+	for id, r := range n.replicators {
+		if !n.isVoter(id) {
+			close(r.stop)
+			delete(n.replicators, id)
+		}
+	}
+}
+
+func (n *Node) stopReplicators() {
+	for id, r := range n.replicators {
+		close(r.stop)
+		delete(n.replicators, id)
+	}
+}
+
+// replicate sends the entries of the leader of term to the follower of id,
+// as they are appended and every heartbeat interval, until r is stopped.
+func (n *Node) replicate(id string, term uint64, r *replicator) {
+	t := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer t.Stop()
+	for {
+		if more := n.send(id, term); more {
+			select {
+			case <-r.stop:
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case <-r.trigger:
+		case <-t.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// send sends the entries of the leader of term following those the
+// follower of id is known to have, or the snapshot of the leader if it
+// compacted them, and reports whether there are more to send.
+func (n *Node) send(id string, term uint64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != Leader || n.term != term {
+		return false
+	}
+	var to Server
+	for _, s := range n.servers {
+		if s.ID == id {
+			to = s
+		}
+	}
+
+	next := n.next[id]
+	if next <= n.snapIndex {
+		snap := n.st.snapshot()
+		req := &SnapshotRequest{Term: term, Leader: n.cfg.ID, Snapshot: *snap}
+		n.mu.Unlock()
+		ctx, cancel := context.WithTimeout(n.ctx, snapshotTimeout)
+		resp, err := n.cfg.Transport.InstallSnapshot(ctx, to, req)
+		cancel()
+		n.mu.Lock()
+
+		if err != nil {
+			log.Default().Debug("raft: install snapshot", "to", id, "err", err)
+			return false
+		}
+		if resp.Term > n.term {
+			n.stepDown(resp.Term)
+			return false
+		}
+		if n.state != Leader || n.term != term {
+			return false
+		}
+		log.Default().Info("raft: sent snapshot", "to", id, "index", snap.Index)
+		n.acked[id] = time.Now()
+		n.match[id] = max(n.match[id], snap.Index)
+		n.next[id] = max(n.next[id], snap.Index+1)
+		n.maybeCommit()
+		return n.next[id] <= n.lastIndex()
+	}
+
+	prevTerm, _ := n.termAt(next - 1)
+	req := &AppendRequest{Term: term, Leader: n.cfg.ID, PrevIndex: next - 1, PrevTerm: prevTerm, Commit: n.commit}
+	size := 0
+	for _, e := range n.log[next-n.snapIndex-1:] {
+		size += len(e.Data)
+		if len(req.Entries) > 0 && (len(req.Entries) == maxAppendEntries || size > maxAppendBytes) {
+			break
+		}
+		req.Entries = append(req.Entries, e)
+	}
+	n.mu.Unlock()
+	ctx, cancel := context.WithTimeout(n.ctx, n.cfg.ElectionTimeout)
+	resp, err := n.cfg.Transport.AppendEntries(ctx, to, req)
+	cancel()
+	n.mu.Lock()
+
+	if err != nil {
+		log.Default().Debug("raft: append entries", "to", id, "err", err)
+		return false
+	}
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return false
+	}
+	if n.state != Leader || n.term != term {
+		return false
+	}
+	n.acked[id] = time.Now()
+	if resp.Success {
+		if m := req.PrevIndex + uint64(len(req.Entries)); m > n.match[id] {
+			n.match[id] = m
+			n.maybeCommit()
+		}
+		n.next[id] = max(n.next[id], n.match[id]+1)
+	} else {
+		n.next[id] = max(1, min(req.PrevIndex, resp.LastIndex+1))
+	}
+	return n.next[id] <= n.lastIndex()
+}
+
+// maybeCommit commits the last entry of the term of the leader that a
+// majority of the servers has, and those before it.
+func (n *Node) maybeCommit() {
+	for i := n.lastIndex(); i > n.commit; i-- {
+		if t, _ := n.termAt(i); t != n.term {
+			break
+		}
+		has := n.count(func(s Server) bool { return s.ID == n.cfg.ID || n.match[s.ID] >= i })
+		if has >= n.quorum() {
+			n.commit = i
+			n.signalApply()
+			break
+		}
+	}
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// applyLoop applies the entries committed to the state machine, until
+// ctx is done.
+func (n *Node) applyLoop(ctx context.Context) {
+	for {
+		select {
+		case <-n.applyCh:
+		case <-ctx.Done():
+			return
+		}
+		for ctx.Err() == nil && n.applyBatch() {
+		}
+	}
+}
+
+// applyBatch applies the next entries committed, up to a batch of them,
+// resolves the futures of the leader for them, and takes a snapshot if
+// they make enough. A leader whose server was removed steps down once it
+// applied the removal. It reports whether it applied any.
+func (n *Node) applyBatch() bool {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	if n.applied >= n.commit {
+		n.mu.Unlock()
+		return false
+	}
+	from := n.applied - n.snapIndex
+	to := min(n.commit-n.snapIndex, from+maxAppendEntries)
+	entries := slices.Clone(n.log[from:to])
+	n.mu.Unlock()
+
+	results := make([]any, len(entries))
+	for i, e := range entries {
+		if e.Type == EntryCommand {
+			results[i] = n.cfg.StateMachine.Apply(e.Index, e.Data)
+		}
+	}
+
+	n.mu.Lock()
+	n.applied = entries[len(entries)-1].Index
+	for i, e := range entries {
+		if f := n.futures[e.Index]; f != nil {
+			delete(n.futures, e.Index)
+			if f.term == e.Term {
+				f.resolve(results[i], nil)
+			} else {
+				f.resolve(nil, ErrLeadershipLost)
+			}
+		}
+	}
+	if n.state == Leader && !n.isVoter(n.cfg.ID) && n.applied >= n.configIndex {
+		n.stepDown(n.term)
+	}
+	compact := n.applied-n.snapIndex >= n.cfg.SnapshotThreshold
+	n.mu.Unlock()
+
+	if compact {
+		n.snapshot()
+	}
+	return true
+}
+
+// snapshot takes a snapshot of the state machine, which has applied the
+// entries up to n.applied, and compacts the log up to it. The caller must
+// hold n.applyMu.
+func (n *Node) snapshot() {
+	data, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		log.Default().Warn("raft: snapshot", "err", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return
+	}
+
+	snap := &Snapshot{Index: n.applied, Servers: n.snapServers, Data: data}
+	snap.Term, _ = n.termAt(snap.Index)
+	for _, e := range slices.Backward(n.log[:snap.Index-n.snapIndex]) {
+		if e.Type == EntryConfig {
+			snap.Servers = e.Servers
+			break
+		}
+	}
+	if err := n.st.saveSnapshot(snap); err != nil {
+		log.Default().Warn("raft: snapshot", "index", snap.Index, "err", err)
+		return
+	}
+	n.log = slices.Clone(n.log[snap.Index-n.snapIndex:])
+	n.snapIndex, n.snapTerm, n.snapServers = snap.Index, snap.Term, snap.Servers
+	// The log read back skips the entries of the snapshot, if this fails.
+	if err := n.st.rewrite(n.log); err != nil {
+		log.Default().Warn("raft: compact", "index", snap.Index, "err", err)
+	}
+	log.Default().Debug("raft: snapshot", "index", snap.Index, "size", len(data))
+}
+
+// failFutures fails the futures waiting with err.
+func (n *Node) failFutures(err error) {
+	for i, f := range n.futures {
+		f.resolve(nil, err)
+		delete(n.futures, i)
+	}
+}
+
+// updateConfig finds the last configuration of the log, or that of the
+// snapshot.
+func (n *Node) updateConfig() {
+	for _, e := range slices.Backward(n.log) {
+		if e.Type == EntryConfig {
+			n.servers, n.configIndex = e.Servers, e.Index
+			return
+		}
+	}
+	n.servers, n.configIndex = n.snapServers, n.snapIndex
+}
+
+func (n *Node) resetDeadline() {
+	d := n.cfg.ElectionTimeout
+	n.deadline = time.Now().Add(d + rand.N(d))
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.log))
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) > 0 {
+		return n.log[len(n.log)-1].Term
+	}
+	return n.snapTerm
+}
+
+// termAt returns the term of the entry of index i, and whether the node
+// knows it: the log has the entry, or it is the last the snapshot
+// replaced.
+func (n *Node) termAt(i uint64) (uint64, bool) {
+	switch {
+	case i == n.snapIndex:
+		return n.snapTerm, true
+	case i < n.snapIndex || i > n.lastIndex():
+		return 0, false
+	}
+	return n.log[i-n.snapIndex-1].Term, true
+}
+
+func (n *Node) isVoter(id string) bool {
+	return slices.ContainsFunc(n.servers, func(s Server) bool { return s.ID == id })
+}
+
+// quorum is the number of servers of a majority of the configuration.
+func (n *Node) quorum() int {
+	return len(n.servers)/2 + 1
+}
+
+// count returns the number of servers of the configuration of which f is
+// true.
+func (n *Node) count(f func(Server) bool) int {
+	c := 0
+	for _, s := range n.servers {
+		if f(s) {
+			c++
+		}
+	}
+	return c
+}
@@ -0,0 +1,297 @@
+package raft_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"nih.software/raft"
+)
+
+// machine is a state machine of the commands applied, in order.
+type machine struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (m *machine) Apply(index uint64, data []byte) any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = append(m.commands, string(data))
+	return len(m.commands)
+}
+
+func (m *machine) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(m.commands)
+}
+
+func (m *machine) Restore(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.commands = nil
+	return json.Unmarshal(data, &m.commands)
+}
+
+func (m *machine) get() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.commands)
+}
+
+// network delivers messages between the nodes of a test in memory, but
+// not from or to nodes down.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*raft.Node
+	down  map[string]bool
+}
+
+// transport is the transport of the node of from.
+type transport struct {
+	net  *network
+	from string
+}
+
+func (t transport) node(to raft.Server) (*raft.Node, error) {
+	t.net.mu.Lock()
+	defer t.net.mu.Unlock()
+
+	n := t.net.nodes[to.ID]
+	if n == nil || t.net.down[to.ID] || t.net.down[t.from] {
+		return nil, errors.New("unreachable")
+	}
+	return n, nil
+}
+
+func (t transport) RequestVote(ctx context.Context, to raft.Server, req *raft.VoteRequest) (*raft.VoteResponse, error) {
+	n, err := t.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleRequestVote(req)
+}
+
+func (t transport) AppendEntries(ctx context.Context, to raft.Server, req *raft.AppendRequest) (*raft.AppendResponse, error) {
+	n, err := t.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleAppendEntries(req)
+}
+
+func (t transport) InstallSnapshot(ctx context.Context, to raft.Server, req *raft.SnapshotRequest) (*raft.SnapshotResponse, error) {
+	n, err := t.node(to)
+	if err != nil {
+		return nil, err
+	}
+	return n.HandleInstallSnapshot(req)
+}
+
+// A server is a node of a test with its state machine.
+type server struct {
+	*raft.Node
+	m    *machine
+	stop func()
+}
+
+// start starts the node id on the network, with its state in dir, running
+// until the test ends or it is stopped.
+func (nw *network) start(t *testing.T, dir, id string, bootstrap bool) *server {
+	t.Helper()
+	m := &machine{}
+	n, err := raft.New(raft.Config{
+		ID:                id,
+		Transport:         transport{net: nw, from: id},
+		StateMachine:      m,
+		Dir:               filepath.Join(dir, id),
+		Bootstrap:         bootstrap,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ElectionTimeout:   100 * time.Millisecond,
+		SnapshotThreshold: 32,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nw.mu.Lock()
+	nw.nodes[id] = n
+	delete(nw.down, id)
+	nw.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n.Run(ctx)
+	}()
+	stop := sync.OnceFunc(func() {
+		cancel()
+		<-done
+	})
+	t.Cleanup(stop)
+	return &server{n, m, stop}
+}
+
+func (nw *network) setDown(id string, down bool) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.down[id] = down
+}
+
+// waitFor waits up to 5 seconds for cond.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// leader waits for one of servers to lead, and returns it.
+func leader(t *testing.T, servers ...*server) *server {
+	t.Helper()
+	var l *server
+	waitFor(t, "a leader", func() bool {
+		for _, s := range servers {
+			if s.IsLeader() {
+				l = s
+				return true
+			}
+		}
+		return false
+	})
+	return l
+}
+
+// propose proposes count commands to the leader of servers, retrying
+// those that fail as leaders change.
+func propose(t *testing.T, prefix string, count int, servers ...*server) {
+	t.Helper()
+	for i := 0; i < count; {
+		l := leader(t, servers...)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := l.Propose(ctx, []byte(fmt.Sprint(prefix, i)))
+		cancel()
+		if err == nil {
+			i++
+		}
+	}
+}
+
+// converge waits for the state machines of servers to have applied the
+// same commands as the first.
+func converge(t *testing.T, servers ...*server) {
+	t.Helper()
+	waitFor(t, "the servers to converge", func() bool {
+		want := servers[0].m.get()
+		for _, s := range servers[1:] {
+			if !slices.Equal(s.m.get(), want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRaft(t *testing.T) {
+	dir := t.TempDir()
+	nw := &network{nodes: make(map[string]*raft.Node), down: make(map[string]bool)}
+	ctx := context.Background()
+
+	a := nw.start(t, dir, "a", true)
+	b := nw.start(t, dir, "b", false)
+	c := nw.start(t, dir, "c", false)
+	if l := leader(t, a, b, c); l != a {
+		t.Fatalf("%s leads, not the server bootstrapped", l.ID())
+	}
+	res, err := a.Propose(ctx, []byte("first"))
+	if err != nil || res != 1 {
+		t.Fatalf("Propose = %v, %v", res, err)
+	}
+	for _, s := range []*server{b, c} {
+		if err := a.AddVoter(ctx, raft.Server{ID: s.ID()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	propose(t, "x", 10, a)
+	converge(t, a, b, c)
+	if got := a.m.get(); len(got) != 11 || got[0] != "first" || got[10] != "x9" {
+		t.Errorf("applied %q", got)
+	}
+	if _, err := b.Propose(ctx, []byte("y")); err != raft.ErrNotLeader {
+		t.Errorf("follower proposal: %v", err)
+	}
+	if st := b.Status(); st.Leader != "a" || len(st.Servers) != 3 || st.State != raft.Follower {
+		t.Errorf("follower status %+v", st)
+	}
+
+	// The others elect a leader of their own when the leader fails, which
+	// steps down, and catches up once it is back.
+	nw.setDown("a", true)
+	l := leader(t, b, c)
+	waitFor(t, "the old leader to step down", func() bool { return !a.IsLeader() })
+	if _, err := a.Propose(ctx, []byte("lost")); err != raft.ErrNotLeader {
+		t.Errorf("proposal to a leader cut off: %v", err)
+	}
+	propose(t, "y", 50, b, c)
+	if st := l.Status(); st.SnapshotIndex == 0 {
+		t.Errorf("no snapshot after %d entries", st.Commit)
+	}
+	nw.setDown("a", false)
+	converge(t, l, a)
+	if a.IsLeader() {
+		t.Error("old leader leads again")
+	}
+
+	// A server joining gets the snapshot of the leader, and a server
+	// removed leaves the configuration.
+	d := nw.start(t, dir, "d", false)
+	if err := leader(t, a, b, c).AddVoter(ctx, raft.Server{ID: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	converge(t, l, d)
+	if err := leader(t, a, b, c, d).RemoveServer(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the removal", func() bool { return len(d.Servers()) == 3 })
+	c.stop()
+	propose(t, "z", 5, a, b, d)
+	converge(t, a, b, d)
+
+	// The leader removing itself steps down, and another takes over.
+	l = leader(t, a, b, d)
+	if err := l.RemoveServer(ctx, l.ID()); err != nil {
+		t.Fatal(err)
+	}
+	rest := slices.DeleteFunc([]*server{a, b, d}, func(s *server) bool { return s == l })
+	if nl := leader(t, rest...); nl == l || len(nl.Servers()) != 2 {
+		t.Errorf("leader %s with %+v after removing %s", nl.ID(), nl.Servers(), l.ID())
+	}
+	propose(t, "w", 3, rest...)
+	converge(t, rest...)
+	want := rest[0].m.get()
+
+	// The servers read their state back from their directory.
+	for _, s := range []*server{a, b, d} {
+		s.stop()
+	}
+	var again []*server
+	for _, s := range rest {
+		again = append(again, nw.start(t, dir, s.ID(), false))
+	}
+	leader(t, again...)
+	propose(t, "v", 1, again...)
+	converge(t, again...)
+	if got := again[0].m.get(); len(got) != len(want)+1 || !slices.Equal(got[:len(want)], want) {
+		t.Errorf("read back %d commands, want %d and one more", len(got), len(want))
+	}
+}
@@ -0,0 +1,231 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Files of the directory of a node.
+const (
+	stateFile    = "state.json"
+	logFile      = "log.jsonl"
+	snapshotFile = "snapshot.json"
+)
+
+// hardState is what a node must remember across restarts besides its log:
+// its term, and the server it voted for in it.
+type hardState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+}
+
+// storage keeps the state, log, and snapshot of a node in a directory, or
+// in memory only if it has none. The log is a file of an entry per line,
+// appended to and synced as entries arrive, and written anew when entries
+// are truncated or compacted.
+type storage struct {
+	dir  string
+	log  *os.File
+	snap *Snapshot
+}
+
+// openStorage reads the state, snapshot, and entries after the snapshot of
+// the node of dir. A last entry cut short by a crash is dropped.
+func openStorage(dir string) (*storage, hardState, []Entry, error) {
+	s := &storage{dir: dir}
+	var hs hardState
+	if dir == "" {
+		return s, hs, nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, hs, nil, err
+	}
+
+	if err := readJSON(filepath.Join(dir, stateFile), &hs); err != nil {
+		return nil, hs, nil, err
+	}
+	var snap Snapshot
+	if err := readJSON(filepath.Join(dir, snapshotFile), &snap); err != nil {
+		return nil, hs, nil, err
+	}
+	if snap.Index > 0 {
+		s.snap = &snap
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, hs, nil, err
+	}
+	var entries []Entry
+	var good int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// A line without its newline was cut short.
+			break
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			f.Close()
+			return nil, hs, nil, fmt.Errorf("raft: %s: %v", f.Name(), err)
+		}
+		good += int64(len(line))
+		if e.Index <= snap.Index {
+			continue
+		}
+		if len(entries) > 0 && e.Index != entries[len(entries)-1].Index+1 || len(entries) == 0 && e.Index != snap.Index+1 {
+			f.Close()
+			return nil, hs, nil, fmt.Errorf("raft: %s: entry %d out of order", f.Name(), e.Index)
+		}
+		entries = append(entries, e)
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, hs, nil, err
+	}
+	if _, err := f.Seek(good, 0); err != nil {
+		f.Close()
+		return nil, hs, nil, err
+	}
+	s.log = f
+	return s, hs, entries, nil
+}
+
+func readJSON(name string, v any) error {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("raft: %s: %v", name, err)
+	}
+	return nil
+}
+
+// saveState records the term and vote of the node.
+func (s *storage) saveState(hs hardState) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(&hs)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(s.dir, stateFile), data)
+}
+
+// append appends entries to the log, once they are on disk.
+func (s *storage) append(entries []Entry) error {
+	if s.dir == "" || len(entries) == 0 {
+		return nil
+	}
+	var buf []byte
+	for i := range entries {
+		line, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if _, err := s.log.Write(buf); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the log with entries.
+func (s *storage) rewrite(entries []Entry) error {
+	if s.dir == "" {
+		return nil
+	}
+	name := filepath.Join(s.dir, logFile)
+	tmp, err := os.CreateTemp(s.dir, logFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for i := range entries {
+		line, err := json.Marshal(&entries[i])
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	s.log.Close()
+	s.log = tmp
+	return nil
+}
+
+// saveSnapshot records snap as the snapshot of the node.
+func (s *storage) saveSnapshot(snap *Snapshot) error {
+	if s.dir != "" {
+		data, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(s.dir, snapshotFile), data); err != nil {
+			return err
+		}
+	}
+	s.snap = snap
+	return nil
+}
+
+// snapshot returns the snapshot of the node, or nil if it has none.
+func (s *storage) snapshot() *Snapshot {
+	return s.snap
+}
+
+func (s *storage) close() {
+	if s.log != nil {
+		s.log.Close()
+	}
+}
+
+// writeFile writes data to name atomically, and syncs it.
+func writeFile(name string, data []byte) error {
+	// CreateTemp creates the file with mode 0600.
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
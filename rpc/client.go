@@ -0,0 +1,133 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"nih.software/nihnet"
+	"nih.software/nihnet/mux"
+	"nih.software/trace"
+	"nih.software/trust"
+	"nih.software/wire"
+)
+
+// A Client calls the methods of a server over a connection. Its calls may
+// run concurrently.
+type Client struct {
+	sess *mux.Session
+}
+
+// NewClient returns a client calling methods over conn.
+func NewClient(conn net.Conn) *Client {
+	return &Client{sess: mux.Client(conn, nil)}
+}
+
+// Dial connects to the server at addr with the credentials of b.
+func Dial(ctx context.Context, b *trust.Bundle, addr string) (*Client, error) {
+	d := nihnet.Dialer{Bundle: b, NextProtos: []string{Proto}}
+	conn, err := d.Dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// Peer returns the verified identity of the server, if the connection of c
+// is a *nihnet.Conn.
+func (c *Client) Peer() (nihnet.Identity, bool) {
+	if conn, ok := c.sess.Conn().(*nihnet.Conn); ok {
+		return conn.Peer(), true
+	}
+	return nihnet.Identity{}, false
+}
+
+// Done returns a channel that is closed when the connection of c fails or
+// is closed, after which every call fails with CodeUnavailable.
+func (c *Client) Done() <-chan struct{} {
+	return c.sess.Done()
+}
+
+// Close closes the connection of c, failing the calls in progress.
+func (c *Client) Close() error {
+	return c.sess.Close()
+}
+
+// Call calls method with req and returns its result. The deadline of ctx
+// bounds the call on both ends, and canceling ctx cancels it on the server.
+// Errors other than those of dialing are *Error.
+func Call[Req, Resp any](ctx context.Context, c *Client, method string, req Req) (Resp, error) {
+	var resp Resp
+	err := c.call(ctx, method, req, &resp)
+	return resp, err
+}
+
+func (c *Client) call(ctx context.Context, method string, req, resp any) (err error) {
+	ctx, span := trace.Start(ctx, method, trace.Client, "rpc.method", method)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	params, err := wire.Marshal(req)
+	if err != nil {
+		return Errorf(CodeInvalidArgument, "%s: %v", method, err)
+	}
+
+	r := request{Method: method, Params: params, Trace: span.Traceparent()}
+	if dl, ok := ctx.Deadline(); ok {
+		r.Timeout = int64(time.Until(dl))
+		if r.Timeout <= 0 {
+			return &Error{Code: CodeDeadlineExceeded, Message: context.DeadlineExceeded.Error()}
+		}
+	}
+
+	st, err := c.sess.Open()
+	if err != nil {
+		return unavailable(ctx, err)
+	}
+	defer st.Close()
+
+	if dl, ok := ctx.Deadline(); ok {
+		st.SetDeadline(dl)
+	}
+	stop := context.AfterFunc(ctx, func() { st.Close() })
+	defer stop()
+
+	if err := newMsgWriter(st).write(r); err != nil {
+		return unavailable(ctx, err)
+	}
+	if err := st.CloseWrite(); err != nil {
+		return unavailable(ctx, err)
+	}
+
+	var res response
+	if err := newMsgReader(st).read(&res); err != nil {
+		return unavailable(ctx, err)
+	}
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if err := wire.Unmarshal(res.Result, resp); err != nil {
+		return Errorf(CodeUnknown, "%s: malformed result: %v", method, err)
+	}
+	return nil
+}
+
+// unavailable returns the error of a call that failed on the stream with err.
+func unavailable(ctx context.Context, err error) error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case ctx.Err() != nil:
+		return toError(ctx.Err())
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return &Error{Code: CodeDeadlineExceeded, Message: context.DeadlineExceeded.Error()}
+	default:
+		return &Error{Code: CodeUnavailable, Message: err.Error()}
+	}
+}
@@ -0,0 +1,42 @@
+package rpc
+
+import (
+	"errors"
+	"io"
+
+	"nih.software/wire"
+)
+
+// A msgReader reads the messages of a call from its stream.
+type msgReader struct {
+	dec *wire.Decoder
+}
+
+func newMsgReader(r io.Reader) *msgReader {
+	dec := wire.NewDecoder(r)
+	dec.SetMaxSize(maxMessage)
+	return &msgReader{dec: dec}
+}
+
+// read reads the next message into v. It returns io.EOF if the stream ended
+// before the message.
+func (mr *msgReader) read(v any) error {
+	err := mr.dec.Decode(v)
+	if errors.Is(err, wire.ErrTooLarge) {
+		return Errorf(CodeInvalidArgument, "message exceeds %d bytes", maxMessage)
+	}
+	return err
+}
+
+// A msgWriter writes the messages of a call to its stream.
+type msgWriter struct {
+	enc *wire.Encoder
+}
+
+func newMsgWriter(w io.Writer) *msgWriter {
+	return &msgWriter{enc: wire.NewEncoder(w)}
+}
+
+func (mw *msgWriter) write(v any) error {
+	return mw.enc.Encode(v)
+}
@@ -0,0 +1,213 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"nih.software/trust"
+)
+
+// DefaultMaxIdle and DefaultMaxAge bound the connections of a Pool that
+// does not bound them itself.
+const (
+	DefaultMaxIdle = 90 * time.Second
+	DefaultMaxAge  = 30 * time.Minute
+)
+
+// A Pool keeps a connection to every address it dialed, over which the
+// calls to that address run concurrently, sparing them a handshake each.
+// It dials the address again once the connection fails or is closed, its
+// server shuts down, it has been open for MaxAge, or it was dialed with
+// other credentials than those of Bundle, and closes the connections
+// without calls in progress for MaxIdle. A Pool must have Bundle set.
+type Pool struct {
+	// Bundle returns the credentials to dial with, such as those of a
+	// node that reloads them.
+	Bundle func() *trust.Bundle
+
+	// MaxIdle and MaxAge bound how long connections are kept without
+	// calls, and reused at all. Zero means DefaultMaxIdle and
+	// DefaultMaxAge.
+	MaxIdle time.Duration
+	MaxAge  time.Duration
+
+	mu      sync.Mutex
+	conns   map[string]*poolConn
+	retired []*poolConn
+	sweeper *time.Timer
+}
+
+// A poolConn is a connection of a pool.
+type poolConn struct {
+	c       *Client
+	bundle  *trust.Bundle
+	created time.Time
+	used    time.Time
+}
+
+func (p *Pool) maxIdle() time.Duration {
+	if p.MaxIdle > 0 {
+		return p.MaxIdle
+	}
+	return DefaultMaxIdle
+}
+
+func (p *Pool) maxAge() time.Duration {
+	if p.MaxAge > 0 {
+		return p.MaxAge
+	}
+	return DefaultMaxAge
+}
+
+// Client returns the client of the connection to addr, dialing it unless
+// the one kept is fit for use. The client is shared: callers must not
+// close it, but may Drop it, such as if its server stopped responding.
+func (p *Pool) Client(ctx context.Context, addr string) (*Client, error) {
+	b := p.Bundle()
+	now := time.Now()
+
+	p.mu.Lock()
+	if pc := p.conns[addr]; pc != nil {
+		if p.fit(pc, b, now) {
+			pc.used = now
+			p.mu.Unlock()
+			return pc.c, nil
+		}
+		delete(p.conns, addr)
+		p.retire(pc)
+	}
+	p.mu.Unlock()
+
+	c, err := Dial(ctx, b, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Another call may have dialed the address meanwhile.
+	if pc := p.conns[addr]; pc != nil && p.fit(pc, b, now) {
+		c.Close()
+		pc.used = now
+		return pc.c, nil
+	} else if pc != nil {
+		p.retire(pc)
+	}
+	if p.conns == nil {
+		p.conns = make(map[string]*poolConn)
+	}
+	p.conns[addr] = &poolConn{c: c, bundle: b, created: now, used: now}
+	// The sweeper stops while p keeps no connections.
+	if p.sweeper == nil {
+		p.sweeper = time.AfterFunc(p.sweepInterval(), p.sweep)
+	}
+	return c, nil
+}
+
+// fit reports whether pc may be reused at now for credentials b: it did
+// not fail, its server accepts calls, and it is of b and not too old. The
+// caller must hold p.mu.
+func (p *Pool) fit(pc *poolConn, b *trust.Bundle, now time.Time) bool {
+	select {
+	case <-pc.c.Done():
+		return false
+	default:
+	}
+	return !pc.c.sess.GoneAway() && pc.bundle == b && now.Sub(pc.created) < p.maxAge()
+}
+
+// retire has the sweeper close pc once its calls are done, leaving the
+// callers it was just returned to time to start theirs. The caller must
+// hold p.mu.
+func (p *Pool) retire(pc *poolConn) {
+	select {
+	case <-pc.c.Done():
+	default:
+		p.retired = append(p.retired, pc)
+	}
+}
+
+// Drop closes c, the client of the connection to addr, failing the calls
+// in progress, and forgets it so that the next call dials again.
+func (p *Pool) Drop(addr string, c *Client) {
+	p.mu.Lock()
+	if pc := p.conns[addr]; pc != nil && pc.c == c {
+		delete(p.conns, addr)
+	}
+	p.mu.Unlock()
+	c.Close()
+}
+
+// Close closes the connections of p, failing the calls in progress. Later
+// calls dial again.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, pc := range p.conns {
+		pc.c.Close()
+		delete(p.conns, addr)
+	}
+	for _, pc := range p.retired {
+		pc.c.Close()
+	}
+	p.retired = nil
+	if p.sweeper != nil {
+		p.sweeper.Stop()
+		p.sweeper = nil
+	}
+	return nil
+}
+
+func (p *Pool) sweepInterval() time.Duration {
+	return min(p.maxIdle(), p.maxAge()) / 2
+}
+
+// sweep closes the connections idle for MaxIdle, and those retired or
+// open for MaxAge once their calls are done, and runs again while p keeps
+// any.
+func (p *Pool) sweep() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sweeper == nil {
+		return // closed
+	}
+
+	// Connections retired now are closed by the next sweep at the earliest.
+	retired := p.retired[:0]
+	for _, pc := range p.retired {
+		select {
+		case <-pc.c.Done():
+			continue
+		default:
+		}
+		if pc.c.sess.NumStreams() == 0 {
+			pc.c.Close()
+			continue
+		}
+		retired = append(retired, pc)
+	}
+	p.retired = retired
+
+	now := time.Now()
+	for addr, pc := range p.conns {
+		busy := pc.c.sess.NumStreams() > 0
+		if busy {
+			pc.used = now
+		}
+		switch {
+		case !p.fit(pc, pc.bundle, now):
+			delete(p.conns, addr)
+			p.retire(pc)
+		case !busy && now.Sub(pc.used) >= p.maxIdle():
+			delete(p.conns, addr)
+			pc.c.Close()
+		}
+	}
+
+	if len(p.conns) == 0 && len(p.retired) == 0 {
+		p.sweeper = nil
+		return
+	}
+	p.sweeper.Reset(p.sweepInterval())
+}
@@ -0,0 +1,179 @@
+// Package rpc lets instances call each other's methods over mutual TLS.
+//
+// A Server serves the methods registered with Register on the streams of
+// multiplexed connections, and a Client calls them with Call. Every call
+// takes a stream of its own: the client writes the request and the server
+// the response, each encoded by package wire. Methods may require roles of the
+// caller, as granted by its certificate; the handler of a call finds the
+// verified identity of the caller with Peer. A Pool keeps the connections
+// of clients to servers, which the calls to each share.
+//
+// Streaming methods, registered with RegisterStream and called with
+// OpenStream, exchange any number of messages in either direction until
+// the handler returns. A method may read a single request and send many
+// responses, as for tailing logs; read many requests and send a single
+// response, as for uploading a file; or do both at once, as for the input
+// and output of a command.
+//
+// Deadlines of the caller's context travel with the request, as the time
+// left, and a call whose caller gives up is canceled on the server. Errors
+// reach the caller as *Error, with a Code telling what went wrong. So does
+// the span of the caller's context, of package trace: every call is a
+// span on the client, whose child is the span of the call on the server.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"nih.software/nihnet"
+)
+
+// ProtoName is the name of the RPC protocol, whose versions are negotiated
+// by ALPN as IDs such as "nih/1".
+const ProtoName = "nih"
+
+// Version is the version of the RPC protocol spoken by this package. It
+// changes with the framing of calls or the encoding of their messages.
+const Version = 1
+
+// Proto is the ALPN protocol ID of Version.
+const Proto = "nih/1"
+
+// maxMessage bounds the size of a request or response.
+const maxMessage = 16 << 20
+
+// A Code classifies an error, so that callers can react to it.
+type Code string
+
+const (
+	// CodeUnknown is the code of errors the method did not classify.
+	CodeUnknown Code = "unknown"
+
+	CodeInvalidArgument  Code = "invalid_argument"
+	CodeNotFound         Code = "not_found"
+	CodePermissionDenied Code = "permission_denied"
+	CodeUnimplemented    Code = "unimplemented"
+	CodeDeadlineExceeded Code = "deadline_exceeded"
+	CodeCanceled         Code = "canceled"
+
+	// CodeFailedPrecondition means that the server is not in the state the
+	// call requires, such as a record of the version the call expected.
+	CodeFailedPrecondition Code = "failed_precondition"
+
+	// CodeUnavailable means that the call did not reach a method, or its
+	// response did not arrive, because the connection failed or the server
+	// is shutting down. The call may succeed if tried again.
+	CodeUnavailable Code = "unavailable"
+
+	// CodeResourceExhausted means that the server refused the call, as
+	// the caller or all of them have as many calls in progress as it
+	// serves at once. The call may succeed if tried later.
+	CodeResourceExhausted Code = "resource_exhausted"
+)
+
+// An Error is the error of a call.
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// Errorf returns an error with code and a message formatted as by fmt.Sprintf.
+func Errorf(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return "rpc: " + e.Message
+}
+
+// Is reports whether e is the error of a context the call was bounded by,
+// so that errors.Is(err, context.DeadlineExceeded) holds for calls that ran
+// out of time on either end.
+func (e *Error) Is(target error) bool {
+	switch e.Code {
+	case CodeDeadlineExceeded:
+		return target == context.DeadlineExceeded
+	case CodeCanceled:
+		return target == context.Canceled
+	}
+	return false
+}
+
+// ErrorCode returns the code of err: that of an *Error it wraps, CodeUnknown
+// for other errors, and "" for nil.
+func ErrorCode(err error) Code {
+	if err == nil {
+		return ""
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeUnknown
+}
+
+// toError returns err as it reaches the caller.
+func toError(err error) *Error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: CodeDeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &Error{Code: CodeCanceled, Message: err.Error()}
+	default:
+		return &Error{Code: CodeUnknown, Message: err.Error()}
+	}
+}
+
+// A request is the message starting a call.
+type request struct {
+	Method string `json:"method"`
+
+	// Timeout is the time left until the deadline of the caller, if any.
+	Timeout int64 `json:"timeout_ns,omitempty"`
+
+	// Params is the encoding of the request of unary methods.
+	Params []byte `json:"params,omitempty"`
+
+	// Stream is set for streaming methods, whose requests follow as
+	// messages of their own.
+	Stream bool `json:"stream,omitempty"`
+
+	// Trace is the W3C traceparent of the span of the call on the
+	// client, whose child the server's span is.
+	Trace string `json:"trace,omitempty"`
+}
+
+// A response is the message ending a call, or a message of a streaming
+// call, which ends with a response with End or Error set.
+type response struct {
+	Result []byte `json:"result,omitempty"`
+	Error  *Error `json:"error,omitempty"`
+	End    bool   `json:"end,omitempty"`
+}
+
+type (
+	peerKey   struct{}
+	remoteKey struct{}
+)
+
+// Peer returns the verified identity of the caller of the method whose
+// context is ctx. It reports false if the connection of the call is not a
+// *nihnet.Conn, and so knows no identity.
+func Peer(ctx context.Context) (nihnet.Identity, bool) {
+	id, ok := ctx.Value(peerKey{}).(nihnet.Identity)
+	return id, ok
+}
+
+// RemoteAddr returns the address the caller of the method whose context is
+// ctx is connected from, or nil outside of a method.
+func RemoteAddr(ctx context.Context) net.Addr {
+	addr, _ := ctx.Value(remoteKey{}).(net.Addr)
+	return addr
+}
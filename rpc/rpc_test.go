@@ -0,0 +1,669 @@
+package rpc_test
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nih.software/nihnet"
+	"nih.software/rpc"
+	"nih.software/trace"
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+type echo struct {
+	Text string `json:"text"`
+}
+
+func bundles(t *testing.T, ous ...string) (server, client *trust.Bundle) {
+	t.Helper()
+
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+		Leaves:        2,
+		Options: []trustgen.Option{
+			trustgen.WithSubject(pkix.Name{CommonName: "node", OrganizationalUnit: ous}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundle := func(i int) *trust.Bundle {
+		b, err := trust.NewBundle(h.Chain(i), h.Leaves[i].Key, h.Roots())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	return bundle(0), bundle(1)
+}
+
+// serve serves s with b until the test ends, and returns its address and a
+// function stopping it.
+func serve(t *testing.T, s *rpc.Server, b *trust.Bundle) (string, func() error) {
+	t.Helper()
+
+	lc := nihnet.ListenConfig{Bundle: b, NextProtos: []string{rpc.Proto}}
+	ln, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(ctx, ln)
+	}()
+
+	stopped := false
+	stop := func() error {
+		if stopped {
+			return nil
+		}
+		stopped = true
+		cancel()
+		return <-errc
+	}
+	t.Cleanup(func() { stop() })
+
+	return ln.Addr().String(), stop
+}
+
+func TestCall(t *testing.T) {
+	if id := nihnet.ProtocolID(rpc.ProtoName, rpc.Version); rpc.Proto != id {
+		t.Fatalf("Proto = %s, want %s", rpc.Proto, id)
+	}
+
+	server, client := bundles(t, "ops")
+
+	s := rpc.NewServer()
+	rpc.Register(s, "test.Echo", nil, func(ctx context.Context, req echo) (echo, error) {
+		return req, nil
+	})
+	rpc.Register(s, "test.Whoami", nil, func(ctx context.Context, _ struct{}) (string, error) {
+		id, ok := rpc.Peer(ctx)
+		if !ok {
+			return "", errors.New("no peer")
+		}
+		if addr := rpc.RemoteAddr(ctx); addr == nil || !strings.HasPrefix(addr.String(), "127.0.0.1:") {
+			return "", fmt.Errorf("remote address %v", addr)
+		}
+		return id.Name(), nil
+	})
+	rpc.Register(s, "test.Missing", nil, func(ctx context.Context, _ struct{}) (struct{}, error) {
+		return struct{}{}, rpc.Errorf(rpc.CodeNotFound, "no such thing")
+	})
+	rpc.Register(s, "test.Admin", []string{"admin"}, func(ctx context.Context, _ struct{}) (struct{}, error) {
+		return struct{}{}, nil
+	})
+	rpc.Register(s, "test.Ops", []string{"admin", "ops"}, func(ctx context.Context, _ struct{}) (struct{}, error) {
+		return struct{}{}, nil
+	})
+	addr, _ := serve(t, s, server)
+
+	ctx := context.Background()
+	c, err := rpc.Dial(ctx, client, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got, err := rpc.Call[echo, echo](ctx, c, "test.Echo", echo{"hello"}); err != nil || got.Text != "hello" {
+		t.Errorf("Echo = %+v, %v", got, err)
+	}
+	if got, err := rpc.Call[struct{}, string](ctx, c, "test.Whoami", struct{}{}); err != nil || got != "node" {
+		t.Errorf("Whoami = %q, %v", got, err)
+	}
+	if id, ok := c.Peer(); !ok || id.Name() != "node" {
+		t.Errorf("Peer = %v, %v", id, ok)
+	}
+
+	for _, tt := range []struct {
+		method string
+		code   rpc.Code
+	}{
+		{"test.Missing", rpc.CodeNotFound},
+		{"test.Bogus", rpc.CodeUnimplemented},
+		{"test.Admin", rpc.CodePermissionDenied},
+		{"test.Ops", ""},
+	} {
+		_, err := rpc.Call[struct{}, struct{}](ctx, c, tt.method, struct{}{})
+		if code := rpc.ErrorCode(err); code != tt.code {
+			t.Errorf("%s: code %q, want %q (%v)", tt.method, code, tt.code, err)
+		}
+	}
+
+	if _, err := rpc.Call[string, echo](ctx, c, "test.Echo", "not an object"); rpc.ErrorCode(err) != rpc.CodeInvalidArgument {
+		t.Errorf("Echo(string): %v", err)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	server, client := bundles(t)
+
+	canceled := make(chan error, 1)
+	s := rpc.NewServer()
+	rpc.Register(s, "test.Wait", nil, func(ctx context.Context, _ struct{}) (struct{}, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return struct{}{}, ctx.Err()
+	})
+	addr, _ := serve(t, s, server)
+
+	c, err := rpc.Dial(context.Background(), client, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the deadline of the caller reaches the method
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := rpc.Call[struct{}, struct{}](ctx, c, "test.Wait", struct{}{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait with deadline: %v", err)
+	}
+	// the client gives up as the deadline passes, which may cancel the
+	// method before its own deadline does
+	if err := <-canceled; err == nil {
+		t.Error("method context not done")
+	}
+
+	// and so does canceling it
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := rpc.Call[struct{}, struct{}](ctx, c, "test.Wait", struct{}{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait canceled: %v", err)
+	}
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("method context: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("method not canceled")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server, client := bundles(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := rpc.NewServer()
+	rpc.Register(s, "test.Slow", nil, func(ctx context.Context, _ struct{}) (string, error) {
+		close(started)
+		<-release
+		return "done", nil
+	})
+	rpc.Register(s, "test.Fast", nil, func(ctx context.Context, _ struct{}) (string, error) {
+		return "done", nil
+	})
+	addr, stop := serve(t, s, server)
+
+	c, err := rpc.Dial(context.Background(), client, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	type result struct {
+		s   string
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		s, err := rpc.Call[struct{}, string](context.Background(), c, "test.Slow", struct{}{})
+		results <- result{s, err}
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+
+	// the call in progress finishes, but no new call starts
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		_, err := rpc.Call[struct{}, string](context.Background(), c, "test.Fast", struct{}{})
+		if rpc.ErrorCode(err) == rpc.CodeUnavailable {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("call while shutting down: %v", err)
+		}
+	}
+	close(release)
+
+	if r := <-results; r.err != nil || r.s != "done" {
+		t.Errorf("call in progress = %q, %v", r.s, r.err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("connection still open")
+	}
+}
+
+func TestStream(t *testing.T) {
+	server, client := bundles(t)
+
+	s := rpc.NewServer()
+
+	// server streaming: count to the number requested
+	rpc.RegisterStream(s, "test.Count", nil, func(ctx context.Context, ss *rpc.ServerStream[int, int]) error {
+		n, err := ss.Recv()
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= n; i++ {
+			if err := ss.Send(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// client streaming: sum the numbers sent
+	rpc.RegisterStream(s, "test.Sum", nil, func(ctx context.Context, ss *rpc.ServerStream[int, int]) error {
+		sum := 0
+		for {
+			n, err := ss.Recv()
+			if err == io.EOF {
+				return ss.Send(sum)
+			}
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return rpc.Errorf(rpc.CodeInvalidArgument, "negative %d", n)
+			}
+			sum += n
+		}
+	})
+
+	// bidirectional: echo every message as it arrives
+	canceled := make(chan error, 1)
+	rpc.RegisterStream(s, "test.Echo", nil, func(ctx context.Context, ss *rpc.ServerStream[echo, echo]) error {
+		for {
+			m, err := ss.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				canceled <- err
+				return err
+			}
+			if err := ss.Send(m); err != nil {
+				return err
+			}
+		}
+	})
+	addr, _ := serve(t, s, server)
+
+	ctx := context.Background()
+	c, err := rpc.Dial(ctx, client, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	recvAll := func(cs *rpc.ClientStream[int, int]) ([]int, error) {
+		var got []int
+		for {
+			n, err := cs.Recv()
+			if err == io.EOF {
+				return got, nil
+			}
+			if err != nil {
+				return got, err
+			}
+			got = append(got, n)
+		}
+	}
+
+	cs, err := rpc.OpenStream[int, int](ctx, c, "test.Count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.Send(3)
+	cs.CloseSend()
+	if got, err := recvAll(cs); err != nil || !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("Count = %v, %v", got, err)
+	}
+
+	for _, tt := range []struct {
+		send []int
+		want []int
+		code rpc.Code
+	}{
+		{[]int{1, 2, 3}, []int{6}, ""},
+		{nil, []int{0}, ""},
+		{[]int{1, -1}, nil, rpc.CodeInvalidArgument},
+	} {
+		cs, err := rpc.OpenStream[int, int](ctx, c, "test.Sum")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range tt.send {
+			if err := cs.Send(n); err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+		}
+		cs.CloseSend()
+		if got, err := recvAll(cs); rpc.ErrorCode(err) != tt.code || !slices.Equal(got, tt.want) {
+			t.Errorf("Sum(%v) = %v, %v", tt.send, got, err)
+		}
+	}
+
+	ectx, cancel := context.WithCancel(ctx)
+	es, err := rpc.OpenStream[echo, echo](ectx, c, "test.Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"a", "b"} {
+		if err := es.Send(echo{text}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := es.Recv(); err != nil || got.Text != text {
+			t.Errorf("Echo(%q) = %+v, %v", text, got, err)
+		}
+	}
+	cancel()
+	if _, err := es.Recv(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Recv after cancel: %v", err)
+	}
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("server Recv after cancel: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("method not canceled")
+	}
+
+	if _, err := rpc.Call[int, int](ctx, c, "test.Sum", 1); rpc.ErrorCode(err) != rpc.CodeUnimplemented {
+		t.Errorf("Call of a streaming method: %v", err)
+	}
+	us, err := rpc.OpenStream[int, int](ctx, c, "test.Bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.Recv(); rpc.ErrorCode(err) != rpc.CodeUnimplemented {
+		t.Errorf("OpenStream of an unknown method: %v", err)
+	}
+}
+
+// spans records the spans it exports.
+type spans struct {
+	mu   sync.Mutex
+	list []*trace.Span
+}
+
+func (s *spans) Export(span *trace.Span) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.list = append(s.list, span)
+}
+
+func (s *spans) find(name string, kind trace.Kind) *trace.Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, span := range s.list {
+		if span.Name == name && span.Kind == kind {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTrace(t *testing.T) {
+	rec := &spans{}
+	old := trace.Default()
+	trace.SetDefault(&trace.Tracer{Exporter: rec, Ratio: 1})
+	defer trace.SetDefault(old)
+
+	server, client := bundles(t)
+	s := rpc.NewServer()
+	rpc.Register(s, "test.Fail", nil, func(ctx context.Context, _ struct{}) (string, error) {
+		return trace.FromContext(ctx).TraceID.String(), rpc.Errorf(rpc.CodeNotFound, "no such thing")
+	})
+	rpc.Register(s, "test.Trace", nil, func(ctx context.Context, _ struct{}) (string, error) {
+		return trace.FromContext(ctx).TraceID.String(), nil
+	})
+	addr, _ := serve(t, s, server)
+
+	ctx, root := trace.Start(context.Background(), "test", trace.Internal)
+	c, err := rpc.Dial(ctx, client, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := rpc.Call[struct{}, string](ctx, c, "test.Trace", struct{}{})
+	if err != nil || got != root.TraceID.String() {
+		t.Errorf("trace on the server %q, %v, want %s", got, err, root.TraceID)
+	}
+	rpc.Call[struct{}, string](ctx, c, "test.Fail", struct{}{})
+	root.End()
+
+	call, served := rec.find("test.Trace", trace.Client), rec.find("test.Trace", trace.Server)
+	if call == nil || served == nil {
+		t.Fatalf("spans %+v", rec.list)
+	}
+	if call.Parent != root.SpanID || served.Parent != call.SpanID || served.TraceID != root.TraceID {
+		t.Errorf("call %+v, served %+v, root %+v", call.SpanContext, served, root.SpanContext)
+	}
+	if dial := rec.find("nihnet.Dial", trace.Client); dial == nil || dial.Parent != root.SpanID {
+		t.Errorf("dial %+v", dial)
+	}
+	if failed := rec.find("test.Fail", trace.Server); failed == nil || failed.Err() != "rpc: no such thing" {
+		t.Errorf("failed %+v", failed)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	server, client := bundles(t)
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	s := rpc.NewServer()
+	rpc.Register(s, "test.Slow", nil, func(ctx context.Context, _ struct{}) (string, error) {
+		started <- struct{}{}
+		<-release
+		return "done", nil
+	})
+	s.SetLimits(rpc.Limits{Calls: 10, PeerCalls: 1})
+	addr, _ := serve(t, s, server)
+
+	c, err := rpc.Dial(context.Background(), client, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	errc := make(chan error, 2)
+	slow := func() {
+		_, err := rpc.Call[struct{}, string](context.Background(), c, "test.Slow", struct{}{})
+		errc <- err
+	}
+	go slow()
+	<-started
+
+	// the peer has as many calls in progress as it may
+	_, err = rpc.Call[struct{}, string](context.Background(), c, "test.Slow", struct{}{})
+	if rpc.ErrorCode(err) != rpc.CodeResourceExhausted || !strings.Contains(err.Error(), "limit of 1 calls in progress of node") {
+		t.Errorf("call beyond the limit: %v", err)
+	}
+	if n := s.Refused(); n != 1 {
+		t.Errorf("Refused = %d, want 1", n)
+	}
+
+	s.SetLimits(rpc.Limits{})
+	go slow()
+	<-started
+	close(release)
+	for range 2 {
+		if err := <-errc; err != nil {
+			t.Errorf("call: %v", err)
+		}
+	}
+}
+
+// The calls of callers without an identity count by host, whatever the
+// port of their connections.
+func TestLimitsByAddress(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := rpc.NewServer()
+	rpc.Register(s, "test.Slow", nil, func(ctx context.Context, _ struct{}) (string, error) {
+		started <- struct{}{}
+		<-release
+		return "done", nil
+	})
+	s.SetLimits(rpc.Limits{PeerCalls: 1})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Serve(ctx, ln)
+
+	dial := func() *rpc.Client {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := rpc.NewClient(conn)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := rpc.Call[struct{}, string](context.Background(), dial(), "test.Slow", struct{}{})
+		errc <- err
+	}()
+	<-started
+
+	// admitted, the call would wait for release
+	callCtx, cancelCall := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCall()
+	_, err = rpc.Call[struct{}, string](callCtx, dial(), "test.Slow", struct{}{})
+	if rpc.ErrorCode(err) != rpc.CodeResourceExhausted || !strings.Contains(err.Error(), "of 127.0.0.1 reached") {
+		t.Errorf("call of another connection beyond the limit: %v", err)
+	}
+
+	close(release)
+	if err := <-errc; err != nil {
+		t.Errorf("call: %v", err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	server, client := bundles(t)
+
+	s := rpc.NewServer()
+	rpc.Register(s, "test.Remote", nil, func(ctx context.Context, _ struct{}) (string, error) {
+		return rpc.RemoteAddr(ctx).String(), nil
+	})
+	addr, _ := serve(t, s, server)
+
+	var mu sync.Mutex
+	b := client
+	p := &rpc.Pool{
+		Bundle: func() *trust.Bundle {
+			mu.Lock()
+			defer mu.Unlock()
+			return b
+		},
+		MaxIdle: 100 * time.Millisecond,
+		MaxAge:  time.Hour,
+	}
+	defer p.Close()
+
+	ctx := context.Background()
+	get := func() *rpc.Client {
+		t.Helper()
+		c, err := p.Client(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rpc.Call[struct{}, string](ctx, c, "test.Remote", struct{}{}); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	closed := func(c *rpc.Client) bool {
+		select {
+		case <-c.Done():
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+
+	c1 := get()
+	if c := get(); c != c1 {
+		t.Error("connection not reused")
+	}
+
+	p.Drop(addr, c1)
+	c2 := get()
+	if c2 == c1 {
+		t.Error("connection dropped reused")
+	}
+
+	// a failed connection is dialed again
+	c2.Close()
+	c3 := get()
+	if c3 == c2 {
+		t.Error("failed connection reused")
+	}
+
+	// so is one of other credentials, which is closed once idle
+	mu.Lock()
+	b = server
+	mu.Unlock()
+	c4 := get()
+	if c4 == c3 {
+		t.Error("connection of old credentials reused")
+	}
+	if !closed(c3) {
+		t.Error("connection of old credentials still open")
+	}
+
+	// idle connections are closed, and dialed again
+	if !closed(c4) {
+		t.Error("idle connection still open")
+	}
+	if c := get(); c == c4 {
+		t.Error("idle connection reused")
+	}
+
+	old := &rpc.Pool{Bundle: p.Bundle, MaxAge: 50 * time.Millisecond}
+	defer old.Close()
+	c5, err := old.Client(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if c, err := old.Client(ctx, addr); err != nil || c == c5 {
+		t.Errorf("connection beyond MaxAge reused: %v", err)
+	}
+	if !closed(c5) {
+		t.Error("connection beyond MaxAge still open")
+	}
+}
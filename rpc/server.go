@@ -0,0 +1,361 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nih.software/log"
+	"nih.software/nihnet"
+	"nih.software/nihnet/mux"
+	"nih.software/trace"
+	"nih.software/trust"
+	"nih.software/wire"
+)
+
+// requestTimeout bounds how long a server waits for the request of a call
+// after the stream was opened.
+const requestTimeout = 10 * time.Second
+
+// A method is a registered method of a server: unary, with call, or
+// streaming, with stream.
+type method struct {
+	roles  []string
+	call   func(ctx context.Context, params []byte) (any, error)
+	stream func(ctx context.Context, mr *msgReader, mw *msgWriter) error
+}
+
+// A Server serves registered methods.
+type Server struct {
+	mu      sync.Mutex
+	methods map[string]*method
+
+	limits    Limits
+	calls     int
+	peerCalls map[string]int
+	refused   int64
+}
+
+// Limits bound the calls a server serves at once, so that a misbehaving
+// peer cannot exhaust it. Zero fields mean no limit.
+type Limits struct {
+	// Calls bounds the calls of all peers.
+	Calls int
+
+	// PeerCalls bounds the calls of every peer, by the name of its
+	// certificate, or by its address on connections knowing no identity.
+	PeerCalls int
+}
+
+// NewServer returns a server without methods.
+func NewServer() *Server {
+	return &Server{methods: make(map[string]*method), peerCalls: make(map[string]int)}
+}
+
+// SetLimits changes the limits of s, for the calls started next. Calls
+// beyond them fail with CodeResourceExhausted.
+func (s *Server) SetLimits(l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+}
+
+// Refused returns how many calls s refused for its limits.
+func (s *Server) Refused() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refused
+}
+
+// Register adds the method name to s, served by h. Names are conventionally
+// those of the service and the method, such as "admin.Status". If roles is
+// not empty, only callers whose certificates grant one of them, as
+// trust.HasRole reports, may call the method.
+// Register panics if the name is empty or already registered.
+func Register[Req, Resp any](s *Server, name string, roles []string, h func(context.Context, Req) (Resp, error)) {
+	s.add(name, &method{
+		roles: slices.Clone(roles),
+		call: func(ctx context.Context, params []byte) (any, error) {
+			var req Req
+			if len(params) > 0 {
+				if err := wire.Unmarshal(params, &req); err != nil {
+					return nil, Errorf(CodeInvalidArgument, "%s: malformed params: %v", name, err)
+				}
+			}
+			return h(ctx, req)
+		},
+	})
+}
+
+func (s *Server) add(name string, m *method) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if name == "" || strings.ContainsAny(name, " /") {
+		panic("rpc: invalid method name " + name)
+	}
+	if _, ok := s.methods[name]; ok {
+		panic("rpc: duplicate method " + name)
+	}
+
+	s.methods[name] = m
+}
+
+// Methods returns the names of the methods of s in order.
+func (s *Server) Methods() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.methods))
+	for name := range s.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) lookup(name string) *method {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.methods[name]
+}
+
+// Serve serves the connections accepted by ln until ctx is canceled, then
+// closes ln and waits for the connections to finish as ServeConn does.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.ServeConn(ctx, conn)
+		}()
+	}
+}
+
+// ServeConn serves the calls on the streams of conn, usually a *nihnet.Conn,
+// until the client closes it or ctx is canceled. Then it tells the client to
+// open no more streams, and returns once the calls in progress have
+// finished. It returns nil unless the connection failed.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	sess := mux.Server(conn, nil)
+	defer sess.Close()
+
+	// Calls outlive ctx to finish gracefully, and are canceled if the
+	// connection fails.
+	base, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	base = context.WithValue(base, remoteKey{}, conn.RemoteAddr())
+	if c, ok := conn.(*nihnet.Conn); ok {
+		base = context.WithValue(base, peerKey{}, c.Peer())
+	}
+
+	var mu sync.Mutex
+	active, draining := 0, false
+
+	stop := context.AfterFunc(ctx, func() {
+		sess.GoAway()
+
+		mu.Lock()
+		defer mu.Unlock()
+		draining = true
+		if active == 0 {
+			sess.Close()
+		}
+	})
+	defer stop()
+
+	for {
+		st, err := sess.AcceptStream()
+		if err != nil {
+			if errors.Is(err, mux.ErrSessionClosed) {
+				return nil
+			}
+			return err
+		}
+
+		mu.Lock()
+		if draining {
+			mu.Unlock()
+			st.Close()
+			continue
+		}
+		active++
+		mu.Unlock()
+
+		go func() {
+			s.serveStream(base, st)
+
+			mu.Lock()
+			defer mu.Unlock()
+			active--
+			if draining && active == 0 {
+				sess.Close()
+			}
+		}()
+	}
+}
+
+// admit admits a call from the caller of ctx, returning the function
+// releasing it once served, or the error refusing it.
+func (s *Server) admit(ctx context.Context) (func(), *Error) {
+	peer := ""
+	if id, ok := Peer(ctx); ok {
+		peer = id.Name()
+	} else if addr := RemoteAddr(ctx); addr != nil {
+		// A peer opens connections from any port.
+		peer = addr.String()
+		if h, _, err := net.SplitHostPort(peer); err == nil {
+			peer = h
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err *Error
+	switch l := s.limits; {
+	case l.Calls > 0 && s.calls >= l.Calls:
+		err = Errorf(CodeResourceExhausted, "limit of %d calls in progress reached", l.Calls)
+	case l.PeerCalls > 0 && s.peerCalls[peer] >= l.PeerCalls:
+		err = Errorf(CodeResourceExhausted, "limit of %d calls in progress of %s reached", l.PeerCalls, peer)
+	}
+	if err != nil {
+		s.refused++
+		return nil, err
+	}
+	s.calls++
+	s.peerCalls[peer]++
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.calls--
+		if s.peerCalls[peer]--; s.peerCalls[peer] == 0 {
+			delete(s.peerCalls, peer)
+		}
+	}, nil
+}
+
+// serveStream serves the call on st.
+func (s *Server) serveStream(ctx context.Context, st *mux.Stream) {
+	defer st.Close()
+	start := time.Now()
+	mr, mw := newMsgReader(st), newMsgWriter(st)
+
+	// Calls count from their stream opening, so that waiting for their
+	// requests counts too.
+	release, refused := s.admit(ctx)
+	if release != nil {
+		defer release()
+	}
+
+	st.SetReadDeadline(start.Add(requestTimeout))
+	var req request
+	if err := mr.read(&req); err != nil {
+		mw.write(response{Error: Errorf(CodeInvalidArgument, "malformed request: %v", err)})
+		return
+	}
+	st.SetReadDeadline(time.Time{})
+
+	if refused != nil {
+		log.Default().Warn("rpc: call refused", "method", req.Method, "remote", RemoteAddr(ctx), "reason", refused.Message)
+		mw.write(response{Error: refused})
+		return
+	}
+
+	if sc, err := trace.ParseTraceparent(req.Trace); err == nil {
+		ctx = trace.ContextWithRemote(ctx, sc)
+	}
+	ctx, span := trace.Start(ctx, req.Method, trace.Server, "rpc.method", req.Method)
+	if id, ok := Peer(ctx); ok {
+		span.SetAttr("rpc.peer", id.Name())
+	}
+
+	result, err := s.call(ctx, st, &req, mr, mw)
+	span.SetError(err)
+	span.End()
+
+	attrs := []any{"method", req.Method, "duration", time.Since(start)}
+	if id, ok := Peer(ctx); ok {
+		attrs = append(attrs, "peer", id.Leaf().Subject.String(), "serial", id.Leaf().SerialNumber)
+	}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	log.Default().Debug("rpc: call", attrs...)
+
+	var resp response
+	switch {
+	case err != nil:
+		resp.Error = toError(err)
+	case req.Stream:
+		resp.End = true
+	default:
+		if resp.Result, err = wire.Marshal(result); err != nil {
+			resp.Error = Errorf(CodeUnknown, "malformed result: %v", err)
+		}
+	}
+	if err := mw.write(resp); err != nil {
+		log.Default().Debug("rpc: write response", "method", req.Method, "err", err)
+	}
+}
+
+// call authorizes req and calls its method.
+func (s *Server) call(ctx context.Context, st *mux.Stream, req *request, mr *msgReader, mw *msgWriter) (any, error) {
+	m := s.lookup(req.Method)
+	if m == nil {
+		return nil, Errorf(CodeUnimplemented, "unknown method %s", req.Method)
+	}
+	if streaming := m.stream != nil; streaming != req.Stream {
+		if streaming {
+			return nil, Errorf(CodeUnimplemented, "%s is a streaming method", req.Method)
+		}
+		return nil, Errorf(CodeUnimplemented, "%s is not a streaming method", req.Method)
+	}
+
+	if len(m.roles) > 0 {
+		id, ok := Peer(ctx)
+		if !ok || !trust.HasRole(id.Leaf(), m.roles...) {
+			return nil, Errorf(CodePermissionDenied, "%s requires a role of %s", req.Method, strings.Join(m.roles, ", "))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if req.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout))
+		defer cancel()
+	}
+
+	// The client resets the stream if it gives up on the call.
+	go func() {
+		select {
+		case <-st.Aborted():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if m.stream != nil {
+		return nil, m.stream(ctx, mr, mw)
+	}
+	return m.call(ctx, req.Params)
+}
@@ -0,0 +1,198 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"time"
+
+	"nih.software/nihnet/mux"
+	"nih.software/trace"
+	"nih.software/wire"
+)
+
+// RegisterStream adds the streaming method name to s, served by h, as
+// Register does for unary methods. The call ends when h returns: with the
+// error h returns, or successfully if it returns nil.
+func RegisterStream[Req, Resp any](s *Server, name string, roles []string, h func(context.Context, *ServerStream[Req, Resp]) error) {
+	s.add(name, &method{
+		roles: slices.Clone(roles),
+		stream: func(ctx context.Context, mr *msgReader, mw *msgWriter) error {
+			return h(ctx, &ServerStream[Req, Resp]{ctx: ctx, mr: mr, mw: mw})
+		},
+	})
+}
+
+// A ServerStream is the server's end of a streaming call. Recv and Send
+// may be called concurrently with each other, but not with themselves.
+type ServerStream[Req, Resp any] struct {
+	ctx context.Context
+	mr  *msgReader
+	mw  *msgWriter
+}
+
+// Recv returns the next request of the client. It returns io.EOF once the
+// client called CloseSend and all its requests were received.
+func (ss *ServerStream[Req, Resp]) Recv() (Req, error) {
+	var req Req
+	var raw []byte
+	if err := ss.mr.read(&raw); err != nil {
+		if err == io.EOF {
+			return req, io.EOF
+		}
+		return req, ss.fail(err)
+	}
+
+	if err := wire.Unmarshal(raw, &req); err != nil {
+		return req, Errorf(CodeInvalidArgument, "malformed request: %v", err)
+	}
+	return req, nil
+}
+
+// Send sends a response to the client.
+func (ss *ServerStream[Req, Resp]) Send(resp Resp) error {
+	data, err := wire.Marshal(resp)
+	if err != nil {
+		return Errorf(CodeUnknown, "malformed response: %v", err)
+	}
+
+	if err := ss.mw.write(response{Result: data}); err != nil {
+		return ss.fail(err)
+	}
+	return nil
+}
+
+// fail returns the error of an operation on the stream that failed with err.
+// The client resets the stream when it gives up on the call, which may
+// arrive before the context of the call is canceled for it.
+func (ss *ServerStream[Req, Resp]) fail(err error) error {
+	if errors.Is(err, mux.ErrStreamReset) {
+		return &Error{Code: CodeCanceled, Message: "call canceled by the client"}
+	}
+	return unavailable(ss.ctx, err)
+}
+
+// A ClientStream is the client's end of a streaming call. Recv and Send
+// may be called concurrently with each other, but not with themselves.
+type ClientStream[Req, Resp any] struct {
+	ctx  context.Context
+	span *trace.Span
+	st   *mux.Stream
+	stop func() bool
+	mr   *msgReader
+	mw   *msgWriter
+	err  error
+}
+
+// OpenStream starts a call of the streaming method, which lasts until the
+// server ends it, ctx is done, or the stream is closed. Close must be
+// called to release the stream unless Recv returned an error.
+func OpenStream[Req, Resp any](ctx context.Context, c *Client, method string) (*ClientStream[Req, Resp], error) {
+	ctx, span := trace.Start(ctx, method, trace.Client, "rpc.method", method, "rpc.stream", true)
+	fail := func(err error) error {
+		span.SetError(err)
+		span.End()
+		return err
+	}
+
+	r := request{Method: method, Stream: true, Trace: span.Traceparent()}
+	if dl, ok := ctx.Deadline(); ok {
+		r.Timeout = int64(time.Until(dl))
+		if r.Timeout <= 0 {
+			return nil, fail(&Error{Code: CodeDeadlineExceeded, Message: context.DeadlineExceeded.Error()})
+		}
+	}
+
+	st, err := c.sess.Open()
+	if err != nil {
+		return nil, fail(unavailable(ctx, err))
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		st.SetDeadline(dl)
+	}
+
+	cs := &ClientStream[Req, Resp]{
+		ctx:  ctx,
+		span: span,
+		st:   st,
+		stop: context.AfterFunc(ctx, func() { st.Close() }),
+		mr:   newMsgReader(st),
+		mw:   newMsgWriter(st),
+	}
+	if err := cs.mw.write(r); err != nil {
+		span.SetError(err)
+		cs.Close()
+		return nil, unavailable(ctx, err)
+	}
+	return cs, nil
+}
+
+// Send sends a request to the server. It returns io.EOF if the server
+// ended the call, whose error Recv returns.
+func (cs *ClientStream[Req, Resp]) Send(req Req) error {
+	data, err := wire.Marshal(req)
+	if err != nil {
+		return Errorf(CodeInvalidArgument, "malformed request: %v", err)
+	}
+
+	if err := cs.mw.write(data); err != nil {
+		if errors.Is(err, mux.ErrStreamReset) && cs.ctx.Err() == nil {
+			return io.EOF
+		}
+		return unavailable(cs.ctx, err)
+	}
+	return nil
+}
+
+// CloseSend tells the server that the client sends no more requests.
+func (cs *ClientStream[Req, Resp]) CloseSend() error {
+	if err := cs.st.CloseWrite(); err != nil {
+		return unavailable(cs.ctx, err)
+	}
+	return nil
+}
+
+// Recv returns the next response of the server. It returns io.EOF once the
+// server ended the call successfully, and the error of the call if it
+// failed.
+func (cs *ClientStream[Req, Resp]) Recv() (Resp, error) {
+	var resp Resp
+	if cs.err != nil {
+		return resp, cs.err
+	}
+
+	var res response
+	if err := cs.mr.read(&res); err != nil {
+		return resp, cs.end(unavailable(cs.ctx, err))
+	}
+
+	switch {
+	case res.Error != nil:
+		return resp, cs.end(res.Error)
+	case res.End:
+		return resp, cs.end(io.EOF)
+	}
+
+	if err := wire.Unmarshal(res.Result, &resp); err != nil {
+		return resp, Errorf(CodeUnknown, "malformed response: %v", err)
+	}
+	return resp, nil
+}
+
+// end records that the call ended with err, and releases the stream.
+func (cs *ClientStream[Req, Resp]) end(err error) error {
+	cs.err = err
+	if err != io.EOF {
+		cs.span.SetError(err)
+	}
+	cs.Close()
+	return err
+}
+
+// Close ends the call, canceling it on the server unless it already ended.
+func (cs *ClientStream[Req, Resp]) Close() error {
+	cs.stop()
+	cs.span.End()
+	return cs.st.Close()
+}
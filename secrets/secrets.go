@@ -0,0 +1,283 @@
+// Package secrets seals secrets to the public keys of certificates, so
+// that only the holders of their private keys may open them.
+//
+// A secret is encrypted with AES-256-GCM under a random key, which is
+// wrapped for every recipient: for an ECDSA key, with AES-256-GCM under a
+// key derived by HKDF-SHA-256 from an ECDH exchange with an ephemeral key
+// of the same curve; for an Ed25519 key, likewise over X25519, with the
+// birationally equivalent key; and for an RSA key, with RSA-OAEP-SHA-256.
+package secrets
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+)
+
+// ErrNotRecipient is the error of opening a secret with a key it was not
+// sealed to.
+var ErrNotRecipient = errors.New("secrets: not sealed to the key")
+
+// label is the context of the keys derived and wrapped.
+const label = "nih secret"
+
+// A Sealed is a sealed secret.
+type Sealed struct {
+	Recipients []Recipient `json:"recipients"`
+
+	// Nonce and Ciphertext are those of the secret under its key.
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// A Recipient is the key of a secret wrapped for a public key.
+type Recipient struct {
+	// Key is the Fingerprint of the public key.
+	Key string `json:"key"`
+
+	// Ephemeral is the public ECDH key of the exchange, for a key other
+	// than RSA.
+	Ephemeral []byte `json:"ephemeral,omitempty"`
+
+	Wrapped []byte `json:"wrapped"`
+}
+
+// Fingerprint returns the SHA-256 of the DER encoding of pub, in hex.
+func Fingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("secrets: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Seal seals data to the public keys of pubs.
+func Seal(data []byte, pubs ...crypto.PublicKey) (*Sealed, error) {
+	if len(pubs) == 0 {
+		return nil, errors.New("secrets: no recipient")
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	s := &Sealed{}
+	var err error
+	if s.Nonce, s.Ciphertext, err = encrypt(key, data); err != nil {
+		return nil, err
+	}
+	for _, pub := range pubs {
+		r, err := wrap(key, pub)
+		if err != nil {
+			return nil, err
+		}
+		s.Recipients = append(s.Recipients, *r)
+	}
+	return s, nil
+}
+
+// Recipient reports whether s was sealed to pub.
+func (s *Sealed) Recipient(pub crypto.PublicKey) bool {
+	fp, err := Fingerprint(pub)
+	return err == nil && slices.ContainsFunc(s.Recipients, func(r Recipient) bool { return r.Key == fp })
+}
+
+// Open opens s with key, the private key of one of its recipients.
+func (s *Sealed) Open(key crypto.Signer) ([]byte, error) {
+	fp, err := Fingerprint(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(s.Recipients, func(r Recipient) bool { return r.Key == fp })
+	if i < 0 {
+		return nil, ErrNotRecipient
+	}
+
+	dataKey, err := unwrap(&s.Recipients[i], key)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(dataKey, s.Nonce, s.Ciphertext)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(key, data []byte) (nonce, ciphertext []byte, err error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return nonce, aead.Seal(nil, nonce, data, []byte(label)), nil
+}
+
+func decrypt(key, nonce, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("secrets: malformed secret")
+	}
+	data, err := aead.Open(nil, nonce, ciphertext, []byte(label))
+	if err != nil {
+		return nil, errors.New("secrets: secret does not open")
+	}
+	return data, nil
+}
+
+// wrap wraps key for pub.
+func wrap(key []byte, pub crypto.PublicKey) (*Recipient, error) {
+	fp, err := Fingerprint(pub)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recipient{Key: fp}
+
+	if pub, ok := pub.(*rsa.PublicKey); ok {
+		if r.Wrapped, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, []byte(label)); err != nil {
+			return nil, fmt.Errorf("secrets: %w", err)
+		}
+		return r, nil
+	}
+
+	remote, err := ecdhPublic(pub)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := remote.Curve().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(remote)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	r.Ephemeral = eph.PublicKey().Bytes()
+
+	// Every exchange derives a key of its own, which a zero nonce is
+	// safe with.
+	aead, err := newGCM(deriveKey(shared, r.Ephemeral, remote.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	r.Wrapped = aead.Seal(nil, make([]byte, aead.NonceSize()), key, []byte(label))
+	return r, nil
+}
+
+// unwrap unwraps the key of r with key.
+func unwrap(r *Recipient, key crypto.Signer) ([]byte, error) {
+	if key, ok := key.(*rsa.PrivateKey); ok {
+		dataKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, r.Wrapped, []byte(label))
+		if err != nil {
+			return nil, errors.New("secrets: secret does not open")
+		}
+		return dataKey, nil
+	}
+
+	priv, err := ecdhPrivate(key)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := priv.Curve().NewPublicKey(r.Ephemeral)
+	if err != nil {
+		return nil, errors.New("secrets: malformed secret")
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %w", err)
+	}
+	aead, err := newGCM(deriveKey(shared, r.Ephemeral, priv.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), r.Wrapped, []byte(label))
+	if err != nil {
+		return nil, errors.New("secrets: secret does not open")
+	}
+	return dataKey, nil
+}
+
+// deriveKey derives a key from the shared secret of an exchange between
+// the public keys eph and remote, by HKDF-SHA-256 with both as the salt.
+func deriveKey(shared, eph, remote []byte) []byte {
+	extract := hmac.New(sha256.New, slices.Concat(eph, remote))
+	extract.Write(shared)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(label))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// ecdhPublic returns the ECDH key of pub.
+func ecdhPublic(pub crypto.PublicKey) (*ecdh.PublicKey, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		return pub.ECDH()
+	case ed25519.PublicKey:
+		return x25519Public(pub)
+	}
+	return nil, fmt.Errorf("secrets: cannot seal to a key of type %T", pub)
+}
+
+// ecdhPrivate returns the ECDH key of key.
+func ecdhPrivate(key crypto.Signer) (*ecdh.PrivateKey, error) {
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key.ECDH()
+	case ed25519.PrivateKey:
+		// The scalar of an Ed25519 key, which X25519 clamps alike.
+		h := sha512.Sum512(key.Seed())
+		return ecdh.X25519().NewPrivateKey(h[:32])
+	}
+	return nil, fmt.Errorf("secrets: cannot open with a key of type %T", key)
+}
+
+// p25519 is the prime of the field of Curve25519, 2^255 - 19.
+var p25519 = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// x25519Public returns the X25519 key of pub, the Montgomery u-coordinate
+// (1 + y) / (1 - y) of its point, as RFC 7748 maps it.
+func x25519Public(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("secrets: malformed Ed25519 key")
+	}
+	le := slices.Clone(pub)
+	le[31] &= 0x7f // the sign of x
+	slices.Reverse(le)
+	y := new(big.Int).SetBytes(le)
+
+	one := big.NewInt(1)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, p25519)
+	if den.Sign() == 0 {
+		return nil, errors.New("secrets: malformed Ed25519 key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, den.ModInverse(den, p25519))
+	u.Mod(u, p25519)
+
+	b := u.FillBytes(make([]byte, 32))
+	slices.Reverse(b)
+	return ecdh.X25519().NewPublicKey(b)
+}
@@ -0,0 +1,55 @@
+package secrets_test
+
+import (
+	"crypto"
+	"errors"
+	"testing"
+
+	"nih.software/secrets"
+	"nih.software/trust/trustgen"
+)
+
+func TestSeal(t *testing.T) {
+	var keys []crypto.Signer
+	var pubs []crypto.PublicKey
+	for _, kt := range []trustgen.KeyType{trustgen.Ed25519, trustgen.ECDSAP256, trustgen.ECDSAP384, trustgen.RSA2048} {
+		key, err := trustgen.GenerateKey(kt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		pubs = append(pubs, key.Public())
+	}
+
+	s, err := secrets.Seal([]byte("hunter2"), pubs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		data, err := s.Open(key)
+		if err != nil || string(data) != "hunter2" {
+			t.Errorf("key %d: %q, %v", i, data, err)
+		}
+		if !s.Recipient(key.Public()) {
+			t.Errorf("key %d: not a recipient", i)
+		}
+	}
+
+	other, err := trustgen.GenerateKey(trustgen.Ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Open(other); !errors.Is(err, secrets.ErrNotRecipient) {
+		t.Errorf("other key: %v", err)
+	}
+
+	// A recipient wrapping of another key does not open.
+	s.Recipients[0].Wrapped = s.Recipients[1].Wrapped
+	if _, err := s.Open(keys[0]); err == nil {
+		t.Error("opened with a tampered key")
+	}
+	s.Ciphertext[0] ^= 1
+	if _, err := s.Open(keys[1]); err == nil {
+		t.Error("opened a tampered secret")
+	}
+}
@@ -0,0 +1,261 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nih.software/log"
+)
+
+// Defaults of OTLP.
+const (
+	DefaultBatchSize     = 512
+	DefaultFlushInterval = 5 * time.Second
+)
+
+// otlpQueue is how many spans an OTLP exporter holds until it sends them;
+// it drops those that end once it is full.
+const otlpQueue = 4096
+
+// OTLP exports spans to a collector of OpenTelemetry, such as the
+// OpenTelemetry Collector or Jaeger, over OTLP/HTTP with JSON encoding,
+// in batches. Run sends them.
+type OTLP struct {
+	// Endpoint is the URL of the collector, such as
+	// http://localhost:4318, to whose /v1/traces the spans are posted,
+	// or the URL to post them to if it has a path.
+	Endpoint string
+
+	// Service and Instance are the service.name and service.instance.id
+	// of the spans, such as "nih" and the name of the node.
+	Service  string
+	Instance string
+
+	// Client sends the spans; nil means http.DefaultClient.
+	Client *http.Client
+
+	// BatchSize and FlushInterval bound how many spans are sent at once,
+	// and how long a span waits to be sent; zero means DefaultBatchSize
+	// and DefaultFlushInterval.
+	BatchSize     int
+	FlushInterval time.Duration
+
+	once    sync.Once
+	queue   chan *Span
+	dropped atomic.Int64
+}
+
+func (o *OTLP) init() {
+	o.once.Do(func() {
+		o.queue = make(chan *Span, otlpQueue)
+	})
+}
+
+// Export implements Exporter, queueing s to be sent.
+func (o *OTLP) Export(s *Span) {
+	o.init()
+	select {
+	case o.queue <- s:
+	default:
+		o.dropped.Add(1)
+	}
+}
+
+// Run sends the queued spans until ctx is done, then sends those left,
+// within a flush interval.
+func (o *OTLP) Run(ctx context.Context) {
+	o.init()
+	size, interval := o.BatchSize, o.FlushInterval
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func(ctx context.Context) {
+		if n := o.dropped.Swap(0); n > 0 {
+			log.Default().Warn("trace: spans dropped", "count", n)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := o.send(ctx, batch); err != nil {
+			log.Default().Warn("trace: export", "endpoint", o.Endpoint, "spans", len(batch), "err", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case s := <-o.queue:
+			batch = append(batch, s)
+			if len(batch) >= size {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), interval)
+			defer cancel()
+			for {
+				select {
+				case s := <-o.queue:
+					batch = append(batch, s)
+				default:
+					flush(fctx)
+					return
+				}
+			}
+		}
+	}
+}
+
+// send posts spans to the collector.
+func (o *OTLP) send(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(o.request(spans))
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(o.Endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return nil
+}
+
+// The messages of OTLP, in their JSON encoding, where IDs are in hex and
+// 64-bit integers are strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              Kind           `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+// otlpStatusError is the code of the status of a failed span.
+const otlpStatusError = 2
+
+func (o *OTLP) request(spans []*Span) *otlpRequest {
+	res := otlpResource{Attributes: []otlpKeyValue{otlpAttr("service.name", o.Service)}}
+	if o.Instance != "" {
+		res.Attributes = append(res.Attributes, otlpAttr("service.instance.id", o.Instance))
+	}
+	ss := otlpScopeSpans{Scope: otlpScope{Name: "nih.software/trace"}}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.Start.Add(s.Duration()).UnixNano(), 10),
+		}
+		if s.Parent.IsValid() {
+			span.ParentSpanID = s.Parent.String()
+		}
+		for _, a := range s.Attrs() {
+			span.Attributes = append(span.Attributes, otlpAttr(a.Key, a.Value))
+		}
+		if err := s.Err(); err != "" {
+			span.Status = &otlpStatus{Code: otlpStatusError, Message: err}
+		}
+		ss.Spans = append(ss.Spans, span)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{Resource: res, ScopeSpans: []otlpScopeSpans{ss}}}}
+}
+
+func otlpAttr(key string, value any) otlpKeyValue {
+	var v otlpValue
+	switch x := value.(type) {
+	case string:
+		v.StringValue = &x
+	case bool:
+		v.BoolValue = &x
+	case int:
+		s := strconv.Itoa(x)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &x
+	default:
+		s := fmt.Sprint(x)
+		v.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
@@ -0,0 +1,300 @@
+// Package trace records the spans of the operations of nih, such as the
+// RPC calls between nodes and the connections they dial, so that the
+// latency of a request crossing several nodes can be followed hop by hop.
+//
+// A span is started with Start, which makes it the child of the span of
+// its context, and ended with End. The context of a span crosses to
+// other nodes as a W3C traceparent, which package rpc sends with every
+// call, so that the spans of a call on both ends share a trace:
+//
+//	ctx, span := trace.Start(ctx, "kv.Apply", trace.Client)
+//	defer span.End()
+//
+// Spans are recorded by the Exporter of the default Tracer, which OTLP
+// sends to a collector of OpenTelemetry. Without one, spans are still
+// started to carry the traces of callers to the nodes called, but cost
+// little else.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A TraceID identifies a trace, the spans of an operation across nodes.
+type TraceID [16]byte
+
+// IsValid reports whether t is not zero.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// A SpanID identifies a span within its trace.
+type SpanID [8]byte
+
+// IsValid reports whether s is not zero.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext is what identifies a span across nodes.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+
+	// Sampled reports whether the spans of the trace are recorded. The
+	// node starting a trace decides, and the others follow.
+	Sampled bool
+}
+
+// IsValid reports whether sc identifies a span.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent returns sc as a W3C traceparent header, or "" if sc is
+// not valid.
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header of version 00, or of
+// a later version, of which it reads the fields of 00.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	var version, flags [1]byte
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 ||
+		!decodeHex(version[:], parts[0]) || !decodeHex(sc.TraceID[:], parts[1]) ||
+		!decodeHex(sc.SpanID[:], parts[2]) || !decodeHex(flags[:], parts[3]) || !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("trace: invalid traceparent %q", s)
+	}
+	sc.Sampled = flags[0]&1 != 0
+	return sc, nil
+}
+
+// decodeHex decodes s, of lower-case hex digits, to dst, which it must
+// fill exactly.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// A Kind tells the role of a span in a call, with the values of
+// OpenTelemetry.
+type Kind int
+
+const (
+	Internal Kind = 1 // an operation within a node
+	Server   Kind = 2 // the handling of a call from another node
+	Client   Kind = 3 // a call to another node
+)
+
+// An Attr is an attribute of a span. Values are strings, integers,
+// floats, booleans, or else formatted with %v.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// A Span is an operation of a trace.
+type Span struct {
+	Name   string
+	Kind   Kind
+	Parent SpanID
+	SpanContext
+
+	Start  time.Time
+	tracer *Tracer
+
+	mu       sync.Mutex
+	duration time.Duration
+	attrs    []Attr
+	err      string
+	ended    bool
+}
+
+// SetAttr sets the attribute key of s to value.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, Attr{key, value})
+}
+
+// SetError records that the operation of s failed with err, if not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End ends s, and has the tracer that started it export it if sampled.
+// Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.duration = time.Since(s.Start)
+	s.mu.Unlock()
+
+	if s.Sampled && s.tracer != nil && s.tracer.Exporter != nil {
+		s.tracer.Exporter.Export(s)
+	}
+}
+
+// Duration returns the duration of s, once ended.
+func (s *Span) Duration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.duration
+}
+
+// Attrs returns the attributes of s.
+func (s *Span) Attrs() []Attr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Attr(nil), s.attrs...)
+}
+
+// Err returns the message of the error of s, or "".
+func (s *Span) Err() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// An Exporter records the spans a Tracer samples, once they end. Export
+// is called from the goroutines ending them, and must not block.
+type Exporter interface {
+	Export(s *Span)
+}
+
+// A Tracer starts the spans of the traces a node takes part in.
+type Tracer struct {
+	// Exporter records the sampled spans. Nil records none.
+	Exporter Exporter
+
+	// Ratio is the fraction of the traces the node starts that it
+	// samples, from 0 for none to 1 for all. The traces of other nodes
+	// are sampled as they decided.
+	Ratio float64
+}
+
+var std atomic.Pointer[Tracer]
+
+func init() {
+	std.Store(&Tracer{})
+}
+
+// Default returns the shared tracer. Until SetDefault is called, it
+// exports no spans.
+func Default() *Tracer {
+	return std.Load()
+}
+
+// SetDefault replaces the shared tracer.
+// It is safe to call concurrently with Default.
+func SetDefault(t *Tracer) {
+	std.Store(t)
+}
+
+type (
+	spanKey   struct{}
+	remoteKey struct{}
+)
+
+// FromContext returns the context of the span of ctx, or of the remote
+// span ContextWithRemote gave it, or the zero SpanContext.
+func FromContext(ctx context.Context) SpanContext {
+	if s, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return s.SpanContext
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+// SpanFromContext returns the span of ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithRemote returns a copy of ctx whose spans are children of sc,
+// the span of a caller on another node.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Start starts a span of name and kind with the default tracer, as the
+// child of the span of ctx, if any, or the first of a new trace. It
+// returns a copy of ctx with the span. Attrs are key/value pairs, as
+// for SetAttr.
+func Start(ctx context.Context, name string, kind Kind, attrs ...any) (context.Context, *Span) {
+	return Default().Start(ctx, name, kind, attrs...)
+}
+
+// Start starts a span with t, as the function Start does.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, attrs ...any) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	s := &Span{Name: name, Kind: kind, Start: time.Now(), tracer: t}
+	if parent.IsValid() {
+		s.TraceID, s.Parent, s.Sampled = parent.TraceID, parent.SpanID, parent.Sampled
+	} else {
+		s.TraceID = TraceID(random(16))
+		s.Sampled = t.Exporter != nil && sample(s.TraceID, t.Ratio)
+	}
+	s.SpanID = SpanID(random(8))
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if key, ok := attrs[i].(string); ok {
+			s.attrs = append(s.attrs, Attr{key, attrs[i+1]})
+		}
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample reports whether to sample the trace of id, of which it takes
+// the last 8 bytes as a random number, as W3C trace IDs are random.
+func sample(id TraceID, ratio float64) bool {
+	switch {
+	case ratio >= 1:
+		return true
+	case ratio <= 0:
+		return false
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>11)/(1<<53) < ratio
+}
+
+func random(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
@@ -0,0 +1,134 @@
+package trace_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nih.software/trace"
+)
+
+func TestTraceparent(t *testing.T) {
+	const s = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := trace.ParseTraceparent(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("parsed %+v", sc)
+	}
+	if got := sc.Traceparent(); got != s {
+		t.Errorf("Traceparent() = %q", got)
+	}
+	if sc, err := trace.ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future"); err != nil || sc.Sampled {
+		t.Errorf("later version: %+v, %v", sc, err)
+	}
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+	} {
+		if _, err := trace.ParseTraceparent(s); err == nil {
+			t.Errorf("ParseTraceparent(%q) succeeded", s)
+		}
+	}
+}
+
+type recorder []*trace.Span
+
+func (r *recorder) Export(s *trace.Span) { *r = append(*r, s) }
+
+func TestStart(t *testing.T) {
+	var rec recorder
+	tr := &trace.Tracer{Exporter: &rec, Ratio: 1}
+
+	ctx, root := tr.Start(context.Background(), "root", trace.Internal, "n", 1)
+	_, child := tr.Start(ctx, "child", trace.Client)
+	child.SetError(errors.New("broken"))
+	child.End()
+	child.End()
+	root.End()
+	if len(rec) != 2 || rec[0] != child || rec[1] != root {
+		t.Fatalf("exported %v", rec)
+	}
+	if child.TraceID != root.TraceID || child.Parent != root.SpanID || root.Parent.IsValid() || !root.Sampled {
+		t.Errorf("root %+v, child %+v", root.SpanContext, child)
+	}
+	if a := root.Attrs(); len(a) != 1 || a[0] != (trace.Attr{Key: "n", Value: 1}) {
+		t.Errorf("attrs %v", a)
+	}
+
+	// The spans of a remote caller follow its trace and decision.
+	rec = nil
+	remote, _ := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, s := tr.Start(trace.ContextWithRemote(context.Background(), remote), "served", trace.Server)
+	s.End()
+	if s.TraceID != remote.TraceID || s.Parent != remote.SpanID || s.Sampled || len(rec) != 0 {
+		t.Errorf("served %+v, exported %v", s, rec)
+	}
+
+	none := &trace.Tracer{Exporter: &rec}
+	for range 100 {
+		if _, s := none.Start(context.Background(), "x", trace.Internal); s.Sampled {
+			t.Fatal("sampled with a ratio of 0")
+		}
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	got := make(chan map[string]any, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s", r.Method, r.URL)
+		}
+		var req map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		got <- req
+	}))
+	defer srv.Close()
+
+	o := &trace.OTLP{Endpoint: srv.URL, Service: "nih", Instance: "a", FlushInterval: time.Hour}
+	tr := &trace.Tracer{Exporter: o, Ratio: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		o.Run(ctx)
+	}()
+
+	_, s := tr.Start(context.Background(), "kv.Apply", trace.Client, "ok", true)
+	s.SetError(errors.New("broken"))
+	s.End()
+
+	// Spans left are sent once Run is done.
+	cancel()
+	<-done
+	req := <-got
+
+	rs := req["resourceSpans"].([]any)[0].(map[string]any)
+	attrs := rs["resource"].(map[string]any)["attributes"].([]any)
+	if len(attrs) != 2 || attrs[0].(map[string]any)["value"].(map[string]any)["stringValue"] != "nih" {
+		t.Errorf("resource %v", attrs)
+	}
+	span := rs["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)[0].(map[string]any)
+	if span["traceId"] != s.TraceID.String() || span["name"] != "kv.Apply" || span["kind"] != float64(trace.Client) {
+		t.Errorf("span %v", span)
+	}
+	if status := span["status"].(map[string]any); status["code"] != float64(2) || status["message"] != "broken" {
+		t.Errorf("status %v", status)
+	}
+	if _, ok := span["parentSpanId"]; ok {
+		t.Errorf("root span with a parent: %v", span)
+	}
+}
@@ -2,19 +2,26 @@
 package trust
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+
+	"nih.software/log"
+	"nih.software/trust/internal/pkcs8"
 )
 
 // Bundle collects the credentials required to communicate with the system.
 type Bundle struct {
-	cert  *tls.Certificate
-	roots *x509.CertPool
+	cert      *tls.Certificate
+	chain     []*x509.Certificate
+	roots     *x509.CertPool
+	rootCerts []*x509.Certificate
 }
 
 // NewBundle validates and bundles a set of initial credentials.
@@ -53,10 +60,18 @@ func NewBundle(chain []*x509.Certificate, signer crypto.Signer, roots []*x509.Ce
 	}
 
 	b := Bundle{
-		cert:  &cert,
-		roots: rootPool,
+		cert:      &cert,
+		chain:     chain,
+		roots:     rootPool,
+		rootCerts: roots,
 	}
 
+	log.Default().Debug("trust: loaded credentials",
+		"serial", leaf.SerialNumber,
+		"not_after", leaf.NotAfter,
+		"chain", len(chain),
+		"roots", len(roots))
+
 	return &b, nil
 }
 
@@ -91,11 +106,17 @@ func LoadCertificates(name string) (certs []*x509.Certificate, err error) {
 		return
 	}
 
+	return ParseCertificatesPEM(contents)
+}
+
+// ParseCertificatesPEM parses the certificates in the CERTIFICATE blocks of data,
+// skipping blocks of other types.
+func ParseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
 	var blk *pem.Block
 	var der []byte
 
 	for {
-		blk, contents = pem.Decode(contents)
+		blk, data = pem.Decode(data)
 		if blk == nil {
 			break
 		}
@@ -119,17 +140,104 @@ func LoadPrivateKey(name string) (key crypto.Signer, err error) {
 	}
 
 	blk, _ := pem.Decode(contents)
+	if blk != nil && blk.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("trust: load %s: private key is encrypted", name)
+	}
+
 	if blk == nil || blk.Type != "PRIVATE KEY" {
 		return nil, fmt.Errorf("trust: load %s: no private key found", name)
 	}
 
-	anyKey, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	return parsePrivateKey(blk.Bytes)
+}
+
+// ParsePrivateKeyPEM parses the first PRIVATE KEY block of data,
+// which must contain the PKCS #8, ASN.1 DER form of the key.
+// CERTIFICATE blocks before it are skipped,
+// so data may be a certificate chain concatenated with its key.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	for {
+		var blk *pem.Block
+		blk, data = pem.Decode(data)
+
+		switch {
+		case blk == nil:
+			return nil, errors.New("trust: no private key found")
+
+		case blk.Type == "CERTIFICATE":
+			continue
+
+		case blk.Type == "ENCRYPTED PRIVATE KEY":
+			return nil, errors.New("trust: private key is encrypted")
+
+		case blk.Type == "PRIVATE KEY":
+			return parsePrivateKey(blk.Bytes)
+
+		default:
+			return nil, errors.New("trust: no private key found")
+		}
+	}
+}
+
+// LoadEncryptedPrivateKey reads and parses a PEM-encoded private key from the named file.
+// The first thing in the file must be an ENCRYPTED PRIVATE KEY block containing a PKCS #8,
+// ASN.1 DER EncryptedPrivateKeyInfo, which is decrypted with passphrase.
+// An unencrypted PRIVATE KEY block is also accepted.
+func LoadEncryptedPrivateKey(name string, passphrase []byte) (key crypto.Signer, err error) {
+	contents, err := os.ReadFile(name)
 	if err != nil {
 		return
 	}
 
-	key = anyKey.(crypto.Signer)
-	return
+	blk, _ := pem.Decode(contents)
+	if blk == nil {
+		return nil, fmt.Errorf("trust: load %s: no private key found", name)
+	}
+
+	switch blk.Type {
+	case "PRIVATE KEY":
+		return parsePrivateKey(blk.Bytes)
+
+	case "ENCRYPTED PRIVATE KEY":
+		der, err := pkcs8.Decrypt(blk.Bytes, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("trust: load %s: %w", name, err)
+		}
+
+		return parsePrivateKey(der)
+
+	default:
+		return nil, fmt.Errorf("trust: load %s: no private key found", name)
+	}
+}
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	anyKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := anyKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("trust: private key cannot sign")
+	}
+
+	return key, nil
+}
+
+// Chain returns the certificate chain of the bundle, leaf first.
+func (b *Bundle) Chain() []*x509.Certificate {
+	return append([]*x509.Certificate(nil), b.chain...)
+}
+
+// Signer returns the private key of the leaf certificate of the bundle.
+func (b *Bundle) Signer() crypto.Signer {
+	return b.cert.PrivateKey.(crypto.Signer)
+}
+
+// Roots returns the CA certificates of the bundle.
+func (b *Bundle) Roots() []*x509.Certificate {
+	return append([]*x509.Certificate(nil), b.rootCerts...)
 }
 
 // TLSConfig returns a TLS configuration backed by the bundle.
@@ -158,18 +266,100 @@ func (b *Bundle) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certifi
 	return b.cert, nil
 }
 
+// A VerificationError reports that the certificate chain of a peer failed verification.
+// It is returned by TLS handshakes using a Bundle's configuration.
+type VerificationError struct {
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	return "trust: peer verification failed: " + e.Err.Error()
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
 func (b *Bundle) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return &VerificationError{Err: errors.New("no certificate")}
+	}
+
 	var chain []*x509.Certificate
 	for _, raw := range rawCerts {
 		crt, err := x509.ParseCertificate(raw)
 		if err != nil {
-			return err
+			return &VerificationError{Err: err}
 		}
 		chain = append(chain, crt)
 	}
 
-	if _, err := verifyChain(chain, b.roots); err != nil {
-		return err
+	leaf, err := verifyChain(chain, b.roots)
+	if err != nil {
+		log.Default().Debug("trust: peer verification failed", chainAttrs(chain, "err", err)...)
+		return &VerificationError{Err: err}
+	}
+
+	log.Default().Debug("trust: verified peer", chainAttrs(chain, "serial", leaf.SerialNumber)...)
+	return nil
+}
+
+// chainAttrs returns args followed by log attributes describing each certificate in chain.
+func chainAttrs(chain []*x509.Certificate, args ...any) []any {
+	for i, c := range chain {
+		args = append(args, slog.Group(fmt.Sprintf("chain[%d]", i),
+			"serial", c.SerialNumber,
+			"ski", fmt.Sprintf("%x", c.SubjectKeyId),
+			"aki", fmt.Sprintf("%x", c.AuthorityKeyId),
+			"not_before", c.NotBefore,
+			"not_after", c.NotAfter))
+	}
+	return args
+}
+
+// VerifyChain checks chain by the rules instances apply to each other's certificates:
+// chain[0] must be a leaf, followed by any intermediates leading to one of roots.
+// If chain[0] is a CA certificate instead, it is checked as an intermediate
+// or, if it is one of roots, as a root.
+func VerifyChain(chain, roots []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return errors.New("trust: empty chain")
+	}
+
+	rootPool := x509.NewCertPool()
+	for _, c := range roots {
+		rootPool.AddCert(c)
+	}
+
+	if !chain[0].IsCA {
+		if _, err := verifyChain(chain, rootPool); err != nil {
+			return fmt.Errorf("trust: %w", err)
+		}
+		return nil
+	}
+
+	for _, r := range roots {
+		if chain[0].Equal(r) {
+			if err := verifyRoot(r); err != nil {
+				return fmt.Errorf("trust: chain[0]: %w", err)
+			}
+			return nil
+		}
+	}
+
+	if err := linkChain(chain); err != nil {
+		return fmt.Errorf("trust: %w", err)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain {
+		intermediates.AddCert(c)
+	}
+
+	for i, c := range chain {
+		if err := verifyIntermediate(c, intermediates, rootPool); err != nil {
+			return fmt.Errorf("trust: chain[%d]: %w", i, err)
+		}
 	}
 
 	return nil
@@ -180,14 +370,21 @@ func verifyChain(chain []*x509.Certificate, roots *x509.CertPool) (leaf *x509.Ce
 		return nil, fmt.Errorf("chain[0]: %w", err)
 	}
 
+	if err := linkChain(chain); err != nil {
+		return nil, err
+	}
+
 	var intermediates *x509.CertPool
 	if len(chain) > 1 {
 		intermediates = x509.NewCertPool()
+		for _, c := range chain[1:] {
+			intermediates.AddCert(c)
+		}
+
 		for i, c := range chain[1:] {
-			if err := verifyIntermediate(c, roots); err != nil {
+			if err := verifyIntermediate(c, intermediates, roots); err != nil {
 				return nil, fmt.Errorf("chain[%d]: %w", i+1, err)
 			}
-			intermediates.AddCert(c)
 		}
 	}
 
@@ -203,12 +400,30 @@ func verifyChain(chain []*x509.Certificate, roots *x509.CertPool) (leaf *x509.Ce
 	return chain[0], nil
 }
 
-func verifyIntermediate(c *x509.Certificate, roots *x509.CertPool) error {
+// linkChain checks that each certificate names the next one as its issuer
+// when both carry key identifiers, so a misordered or mixed-up chain is reported
+// as such rather than as an unknown authority.
+func linkChain(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		aki, ski := chain[i].AuthorityKeyId, chain[i+1].SubjectKeyId
+		if len(aki) == 0 || len(ski) == 0 {
+			continue
+		}
+
+		if !bytes.Equal(aki, ski) {
+			return fmt.Errorf("chain[%d]: authority key identifier does not match chain[%d]", i, i+1)
+		}
+	}
+
+	return nil
+}
+
+func verifyIntermediate(c *x509.Certificate, intermediates, roots *x509.CertPool) error {
 	if err := validateCertificate(c); err != nil {
 		return err
 	}
 
-	if err := verifyCA(c, roots); err != nil {
+	if err := verifyCA(c, intermediates, roots); err != nil {
 		return err
 	}
 
@@ -223,19 +438,20 @@ func verifyRoot(c *x509.Certificate) error {
 	self := x509.NewCertPool()
 	self.AddCert(c)
 
-	if err := verifyCA(c, self); err != nil {
+	if err := verifyCA(c, nil, self); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func verifyCA(c *x509.Certificate, roots *x509.CertPool) error {
+func verifyCA(c *x509.Certificate, intermediates, roots *x509.CertPool) error {
 	if !c.IsCA {
 		return errors.New("not a CA")
 	}
 
-	if c.KeyUsage != x509.KeyUsageCertSign {
+	// CAs may additionally sign revocation lists
+	if c.KeyUsage&^x509.KeyUsageCRLSign != x509.KeyUsageCertSign {
 		return errors.New("invalid key usage")
 	}
 
@@ -244,7 +460,8 @@ func verifyCA(c *x509.Certificate, roots *x509.CertPool) error {
 	}
 
 	_, err := c.Verify(x509.VerifyOptions{
-		Roots: roots,
+		Intermediates: intermediates,
+		Roots:         roots,
 	})
 
 	return err
@@ -1,8 +1,12 @@
 package trust_test
 
 import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"io"
 	"net"
 	"os"
@@ -10,26 +14,25 @@ import (
 
 	"nih.software/trust"
 	"nih.software/trust/trustgen"
+	"nih.software/trust/trusttest"
 )
 
 func TestNewBundle(t *testing.T) {
-	rootCert, rootKey, err := trustgen.NewRoot()
-	if err != nil {
-		t.Fatal(err)
-	}
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+		Leaves:        1,
+	})
 
-	intCert, intKey, err := trustgen.NewIntermediate(rootCert, rootKey)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	leafCert, leafKey, err := trustgen.NewLeaf(intCert, intKey)
-	if err != nil {
-		t.Fatal(err)
-	}
+	rootCert := h.Root.Cert
+	intCert := h.Intermediates[0].Cert
+	leafCert, leafKey := h.Leaves[0].Cert, h.Leaves[0].Key
 
-	chain := []*x509.Certificate{leafCert, intCert}
-	roots := []*x509.Certificate{rootCert}
+	chain := h.Chain(0)
+	roots := h.Roots()
 
 	t.Run("good", func(t *testing.T) {
 		if _, err := trust.NewBundle(chain, leafKey, roots); err != nil {
@@ -154,6 +157,23 @@ func TestNewBundle(t *testing.T) {
 		}
 	})
 
+	t.Run("misordered chain", func(t *testing.T) {
+		h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+			Intermediates: 2,
+			Leaves:        1,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		chain := h.Chain(0)
+		chain[1], chain[2] = chain[2], chain[1]
+		if _, err := trust.NewBundle(chain, h.Leaves[0].Key, h.Roots()); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
 	t.Run("leaf basic constraints invalid", func(t *testing.T) {
 		leaf := *leafCert
 		leaf.BasicConstraintsValid = false
@@ -164,55 +184,231 @@ func TestNewBundle(t *testing.T) {
 	})
 }
 
+func TestNewBundleInvalid(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.NewCA(h.Intermediates[0].Cert, h.Intermediates[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		gen  func() (*x509.Certificate, crypto.Signer, error)
+	}{
+		{"expired", func() (*x509.Certificate, crypto.Signer, error) { return trusttest.Expired(ca) }},
+		{"not yet valid", func() (*x509.Certificate, crypto.Signer, error) { return trusttest.NotYetValid(ca) }},
+		{"wrong extended key usage", func() (*x509.Certificate, crypto.Signer, error) { return trusttest.WrongEKU(ca) }},
+		{"unknown issuer", trusttest.UnknownIssuer},
+		{"self-signed leaf", trusttest.SelfSignedLeaf},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			crt, key, err := tt.gen()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := trust.NewBundle(ca.ChainFor(crt), key, h.Roots()); err == nil {
+				t.Fatal("no error")
+			}
+		})
+	}
+}
+
 func TestLoadBundle(t *testing.T) {
 	dir := t.TempDir()
 	certFile := dir + "/cert.pem"
 	keyFile := dir + "/key.pem"
 	caFile := dir + "/ca.pem"
 
-	rootCert, rootKey, err := trustgen.NewRoot()
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+		Leaves:        1,
+	})
+
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	intCert, intKey, err := trustgen.NewIntermediate(rootCert, rootKey)
-	if err != nil {
+	certPEM := trustgen.PEMEncodeCertificates(h.Chain(0)...)
+
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
 		t.Fatal(err)
 	}
 
-	leafCert, leafKey, err := trustgen.NewLeaf(intCert, intKey)
-	if err != nil {
+	keyPEM := trustgen.PEMEncodePrivateKey(h.Leaves[0].Key)
+
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
 		t.Fatal(err)
 	}
 
-	certPEM := trustgen.PEMEncodeCertificates(leafCert, intCert)
-	if err != nil {
+	caPEM := trustgen.PEMEncodeCertificates(h.Roots()...)
+
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+	if _, err := trust.LoadPEM(certFile, keyFile, caFile); err != nil {
 		t.Fatal(err)
 	}
+}
+
+func TestLoadEncryptedPrivateKey(t *testing.T) {
+	keyFile := t.TempDir() + "/key.pem"
 
-	keyPEM := trustgen.PEMEncodePrivateKey(leafKey)
+	_, key, err := trustgen.NewRoot()
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	keyPEM := trustgen.PEMEncodePrivateKeyEncrypted(key, []byte("hunter2"))
 	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
 		t.Fatal(err)
 	}
 
-	caPEM := trustgen.PEMEncodeCertificates(rootCert)
+	t.Run("good", func(t *testing.T) {
+		got, err := trust.LoadEncryptedPrivateKey(keyFile, []byte("hunter2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !key.Public().(ed25519.PublicKey).Equal(got.Public()) {
+			t.Fatal("key mismatch")
+		}
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		if _, err := trust.LoadEncryptedPrivateKey(keyFile, []byte("hunter3")); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("unencrypted loader", func(t *testing.T) {
+		if _, err := trust.LoadPrivateKey(keyFile); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+func TestVerifyChain(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 2,
+		Leaves:        1,
+	})
+
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+	other, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{})
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if _, err := trust.LoadPEM(certFile, keyFile, caFile); err != nil {
+	tests := []struct {
+		name  string
+		chain []*x509.Certificate
+		roots []*x509.Certificate
+		ok    bool
+	}{
+		{"leaf", h.Chain(0), h.Roots(), true},
+		{"intermediates", h.Chain(0)[1:], h.Roots(), true},
+		{"root", h.Roots(), h.Roots(), true},
+		{"incomplete", h.Chain(0)[:2], h.Roots(), false},
+		{"wrong roots", h.Chain(0), other.Roots(), false},
+		{"foreign root", other.Roots(), h.Roots(), false},
+		{"empty", nil, h.Roots(), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := trust.VerifyChain(tt.chain, tt.roots)
+			if ok := err == nil; ok != tt.ok {
+				t.Fatalf("VerifyChain: %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestDialListen(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+		Leaves:        1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := trust.NewBundle(h.Chain(0), h.Leaves[0].Key, h.Roots())
+	if err != nil {
 		t.Fatal(err)
 	}
+
+	ln, err := id.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	t.Run("good", func(t *testing.T) {
+		conn, err := id.Dial(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if n := len(conn.ConnectionState().PeerCertificates); n != 2 {
+			t.Errorf("peer sent %d certificates, want 2", n)
+		}
+
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		conn.CloseWrite()
+
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Errorf("echoed %q", data)
+		}
+	})
+
+	t.Run("unknown root", func(t *testing.T) {
+		other, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{Leaves: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stranger, err := trust.NewBundle(other.Chain(0), other.Leaves[0].Key, other.Roots())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var verr *trust.VerificationError
+		if _, err := stranger.Dial(context.Background(), "tcp", ln.Addr().String()); !errors.As(err, &verr) {
+			t.Fatalf("got %v, want a VerificationError", err)
+		}
+	})
 }
@@ -0,0 +1,260 @@
+// Package pkcs8 implements password-based encryption of PKCS #8 private keys
+// using PBES2 with PBKDF2 and AES-CBC, as described in RFC 8018 and RFC 5958.
+package pkcs8
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Iterations is the PBKDF2 iteration count used for encryption.
+const Iterations = 600_000
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Encrypt encrypts a PKCS #8 PrivateKeyInfo,
+// returning the ASN.1 DER form of an EncryptedPrivateKeyInfo.
+func Encrypt(der, passphrase []byte) ([]byte, error) {
+	alg, data, err := EncryptPBES2(der, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: alg,
+		Data:      data,
+	})
+}
+
+// Decrypt decrypts an EncryptedPrivateKeyInfo,
+// returning the ASN.1 DER form of the PKCS #8 PrivateKeyInfo.
+func Decrypt(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, errors.New("pkcs8: trailing data")
+	}
+
+	return DecryptPBES2(info.Algorithm, info.Data, passphrase)
+}
+
+// EncryptPBES2 encrypts data with AES-256-CBC under a key derived from passphrase
+// by PBKDF2 with HMAC-SHA256. It returns the PBES2 algorithm identifier and the ciphertext.
+func EncryptPBES2(data, passphrase []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	var alg pkix.AlgorithmIdentifier
+
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return alg, nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return alg, nil, err
+	}
+
+	key := PBKDF2(sha256.New, passphrase, salt, Iterations, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return alg, nil, err
+	}
+
+	// PKCS #7 padding
+	n := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, len(data), len(data)+n)
+	copy(out, data)
+	for range n {
+		out = append(out, byte(n))
+	}
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, out)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: Iterations,
+		PRF: pkix.AlgorithmIdentifier{
+			Algorithm:  oidHMACWithSHA256,
+			Parameters: asn1.NullRawValue,
+		},
+	})
+
+	if err != nil {
+		return alg, nil, err
+	}
+
+	ivDER, err := asn1.Marshal(iv)
+	if err != nil {
+		return alg, nil, err
+	}
+
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBKDF2,
+			Parameters: asn1.RawValue{FullBytes: kdf},
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAES256CBC,
+			Parameters: asn1.RawValue{FullBytes: ivDER},
+		},
+	})
+
+	if err != nil {
+		return alg, nil, err
+	}
+
+	alg = pkix.AlgorithmIdentifier{
+		Algorithm:  oidPBES2,
+		Parameters: asn1.RawValue{FullBytes: params},
+	}
+
+	return alg, out, nil
+}
+
+// DecryptPBES2 decrypts data encrypted with PBES2, PBKDF2, and AES-CBC.
+func DecryptPBES2(alg pkix.AlgorithmIdentifier, data, passphrase []byte) ([]byte, error) {
+	if !alg.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("pkcs8: unsupported encryption algorithm %v", alg.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("pkcs8: unsupported key derivation function %v", params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+
+	prf := sha1.New
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+
+	default:
+		return nil, fmt.Errorf("pkcs8: unsupported PRF %v", kdf.PRF.Algorithm)
+	}
+
+	var keyLen int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen = 16
+
+	case scheme.Equal(oidAES192CBC):
+		keyLen = 24
+
+	case scheme.Equal(oidAES256CBC):
+		keyLen = 32
+
+	default:
+		return nil, fmt.Errorf("pkcs8: unsupported encryption scheme %v", scheme)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("pkcs8: invalid IV")
+	}
+
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("pkcs8: invalid ciphertext length")
+	}
+
+	block, err := aes.NewCipher(PBKDF2(prf, passphrase, kdf.Salt, kdf.IterationCount, keyLen))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	// a wrong passphrase almost always shows up as bad padding
+	n := int(out[len(out)-1])
+	if n == 0 || n > aes.BlockSize || n > len(out) {
+		return nil, errors.New("pkcs8: decryption failed")
+	}
+
+	for _, b := range out[len(out)-n:] {
+		if int(b) != n {
+			return nil, errors.New("pkcs8: decryption failed")
+		}
+	}
+
+	return out[:len(out)-n], nil
+}
+
+// PBKDF2 derives a key of keyLen bytes from password and salt, as specified in RFC 8018.
+func PBKDF2(h func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+
+	for i := 1; i <= blocks; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(i))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for range iter - 1 {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+
+	return dk[:keyLen]
+}
@@ -0,0 +1,47 @@
+package pkcs8_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"testing"
+
+	"nih.software/trust/internal/pkcs8"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 6070 test vector
+	want, _ := hex.DecodeString("4b007901b765489abead49d926f721d065a429c1")
+	got := pkcs8.PBKDF2(sha1.New, []byte("password"), []byte("salt"), 4096, 20)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%x != %x", got, want)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	plain := []byte("not really a private key")
+
+	der, err := pkcs8.Encrypt(plain, []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("good", func(t *testing.T) {
+		got, err := pkcs8.Decrypt(der, []byte("hunter2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("%q != %q", got, plain)
+		}
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		// padding can validate by chance, but never to the original plaintext
+		got, err := pkcs8.Decrypt(der, []byte("hunter3"))
+		if err == nil && bytes.Equal(got, plain) {
+			t.Fatal("decrypted with wrong passphrase")
+		}
+	})
+}
@@ -0,0 +1,301 @@
+// Package join implements enrollment of new nodes: a node without
+// credentials redeems a single-use join token at a CA node, which signs
+// the node's certificate request and returns its chain and the roots.
+//
+// A join token has the form ID.SECRET.PIN. ID and SECRET identify the token
+// in the CA node's Store; PIN is a hash of the root certificate, which the
+// joining node uses to authenticate the CA node before it sends the secret.
+//
+// Joining nodes connect to the daemon's port and negotiate Proto by ALPN,
+// which lets them hand shake without a client certificate. Nodes renewing
+// their certificate with Renew connect as peers instead, authenticated by
+// the certificate they renew.
+package join
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+// Proto is the ALPN protocol ID of join connections.
+const Proto = "nih-join/1"
+
+// maxResponseSize bounds the size of a response read by Join.
+const maxResponseSize = 1 << 20
+
+// Pin returns the pin of a root certificate for a join token:
+// the unpadded base64url encoding of the SHA-256 hash of its DER encoding.
+func Pin(root *x509.Certificate) string {
+	sum := sha256.Sum256(root.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Token returns the join token for a token created by a Store
+// and the root the joining node should trust.
+func Token(token string, root *x509.Certificate) string {
+	return token + "." + Pin(root)
+}
+
+// signRequest is the body of a request to /join/sign.
+type signRequest struct {
+	Token string `json:"token"`
+	CSR   string `json:"csr"`
+}
+
+// renewRequest is the body of a request to /join/renew.
+type renewRequest struct {
+	CSR string `json:"csr"`
+}
+
+// ErrRenewalRejected is returned by Renew if the CA node does not accept
+// the certificate the node authenticates with.
+var ErrRenewalRejected = errors.New("join: renewal rejected")
+
+// signResponse is the body of a response from /join/sign and /join/renew.
+type signResponse struct {
+	Chain string `json:"chain"`
+	Roots string `json:"roots"`
+}
+
+// A Result holds the credentials issued to a joining node.
+type Result struct {
+	// Chain is the node's certificate chain, leaf first.
+	Chain []*x509.Certificate
+
+	// Roots are the CA certificates of the cluster.
+	Roots []*x509.Certificate
+}
+
+// Join enrolls the node at the CA node listening on addr with a join token
+// and the certificate request for the node's key.
+//
+// Join fails with a *trust.VerificationError if the CA node's chain does not
+// lead to the root pinned by the token, and with ErrTokenRejected if the CA node
+// rejects the token.
+func Join(ctx context.Context, addr, token string, csr *x509.CertificateRequest) (*Result, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 || strings.Count(token, ".") != 2 {
+		return nil, errors.New("join: malformed token: want ID.SECRET.PIN")
+	}
+	token, pin := token[:i], token[i+1:]
+
+	// Fetch the roots without verifying the CA node, which is only safe
+	// because nothing secret is sent, then verify it with the pinned root.
+	var peer []*x509.Certificate
+	c := client(addr, func(chain []*x509.Certificate) error {
+		peer = chain
+		return nil
+	})
+
+	body, err := do(ctx, c, "GET", addr, "/join/roots", nil, ErrTokenRejected)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := trust.ParseCertificatesPEM(body)
+	if err != nil {
+		return nil, fmt.Errorf("join: roots: %w", err)
+	}
+
+	var pinned *x509.Certificate
+	for _, r := range roots {
+		if Pin(r) == pin {
+			pinned = r
+		}
+	}
+	if pinned == nil {
+		return nil, &trust.VerificationError{Err: errors.New("no root of the CA node matches the token's pin")}
+	}
+
+	pool := []*x509.Certificate{pinned}
+	if err := trust.VerifyChain(peer, pool); err != nil {
+		return nil, &trust.VerificationError{Err: err}
+	}
+
+	// From here on, every connection must lead to the pinned root.
+	c = client(addr, func(chain []*x509.Certificate) error {
+		if err := trust.VerifyChain(chain, pool); err != nil {
+			return &trust.VerificationError{Err: err}
+		}
+		return nil
+	})
+
+	req, err := json.Marshal(&signRequest{
+		Token: token,
+		CSR:   string(trustgen.PEMEncodeCertificateRequest(csr)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err = do(ctx, c, "POST", addr, "/join/sign", req, ErrTokenRejected)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := parseResult(body, csr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !containsCert(res.Roots, pinned) {
+		return nil, errors.New("join: the roots issued do not include the pinned root")
+	}
+
+	return res, nil
+}
+
+// Renew has the CA node listening on addr issue a certificate for the key
+// of csr in place of the leaf of b, which the node authenticates with. The
+// new certificate has the subject and names of that leaf, not those of
+// csr. The CA node must verify against the roots of b.
+//
+// Renew fails with ErrRenewalRejected if the CA node rejects the leaf of b,
+// such as one it did not issue.
+func Renew(ctx context.Context, b *trust.Bundle, addr string, csr *x509.CertificateRequest) (*Result, error) {
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: b.TLSConfig()}}
+
+	req, err := json.Marshal(&renewRequest{
+		CSR: string(trustgen.PEMEncodeCertificateRequest(csr)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := do(ctx, c, "POST", addr, "/join/renew", req, ErrRenewalRejected)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseResult(body, csr)
+}
+
+// parseResult parses the response to a request for the key of csr, and
+// checks that the chain issued is for that key and verifies.
+func parseResult(body []byte, csr *x509.CertificateRequest) (*Result, error) {
+	var resp signResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("join: sign: %w", err)
+	}
+
+	var res Result
+	var err error
+	if res.Chain, err = trust.ParseCertificatesPEM([]byte(resp.Chain)); err != nil {
+		return nil, fmt.Errorf("join: chain: %w", err)
+	}
+	if res.Roots, err = trust.ParseCertificatesPEM([]byte(resp.Roots)); err != nil {
+		return nil, fmt.Errorf("join: roots: %w", err)
+	}
+
+	if err := trust.VerifyChain(res.Chain, res.Roots); err != nil {
+		return nil, fmt.Errorf("join: issued chain: %w", err)
+	}
+
+	if !bytes.Equal(res.Chain[0].RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+		return nil, errors.New("join: issued certificate is not for the requested key")
+	}
+
+	return &res, nil
+}
+
+// client returns an HTTP client for join connections to addr
+// that passes the peer's chain to verify.
+func client(addr string, verify func([]*x509.Certificate) error) *http.Client {
+	config := &tls.Config{
+		NextProtos: []string{Proto},
+		MinVersion: tls.VersionTLS13,
+
+		// OK because VerifyPeerCertificate is called
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			var chain []*x509.Certificate
+			for _, raw := range rawCerts {
+				crt, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return &trust.VerificationError{Err: err}
+				}
+				chain = append(chain, crt)
+			}
+			return verify(chain)
+		},
+	}
+
+	return &http.Client{Transport: &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := tls.Dialer{Config: config}
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			if p := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; p != Proto {
+				conn.Close()
+				return nil, fmt.Errorf("join: %s does not accept joining nodes", addr)
+			}
+
+			return conn, nil
+		},
+	}}
+}
+
+// do sends a request to addr, and returns the body of the response, or
+// rejected if the status is Forbidden.
+func do(ctx context.Context, c *http.Client, method, addr, path string, body []byte, rejected error) ([]byte, error) {
+	defer c.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return data, nil
+	case http.StatusForbidden:
+		return nil, rejected
+	default:
+		return nil, fmt.Errorf("join: %s: %s: %s", path, resp.Status, bytes.TrimSpace(data))
+	}
+}
+
+func containsCert(certs []*x509.Certificate, c *x509.Certificate) bool {
+	for _, d := range certs {
+		if d.Equal(c) {
+			return true
+		}
+	}
+	return false
+}
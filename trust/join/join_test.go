@@ -0,0 +1,80 @@
+package join_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nih.software/trust/join"
+)
+
+func TestStore(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "ca", "tokens.json")
+	s, err := join.OpenStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(name string, ttl time.Duration) string {
+		token, err := s.Create(name, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	token := create("", time.Hour)
+	bound := create("node2", time.Hour)
+	expired := create("", -time.Second)
+	revoked := create("", time.Hour)
+
+	id, _, _ := strings.Cut(revoked, ".")
+	if err := s.Revoke(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke("nonsense"); !errors.Is(err, join.ErrTokenNotFound) {
+		t.Errorf("Revoke(nonsense): %v, want %v", err, join.ErrTokenNotFound)
+	}
+
+	// Another process redeems the tokens.
+	other, err := join.OpenStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		token string
+		name  string
+		err   error
+	}{
+		{token + "x", "node1", join.ErrTokenRejected},
+		{expired, "node1", join.ErrTokenRejected},
+		{revoked, "node1", join.ErrTokenRejected},
+		{"nonsense", "node1", join.ErrTokenRejected},
+		{token, "node1", nil},
+		{token, "node1", join.ErrTokenRejected},
+		{bound, "node1", join.ErrTokenRejected},
+		{bound, "node2", nil},
+	} {
+		if _, err := other.Redeem(tt.token, tt.name); !errors.Is(err, tt.err) {
+			t.Errorf("Redeem(%q, %q): %v, want %v", tt.token, tt.name, err, tt.err)
+		}
+	}
+
+	recs, err := s.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var valid int
+	for _, rec := range recs {
+		if rec.Valid(time.Now()) {
+			valid++
+		}
+	}
+	if len(recs) != 4 || valid != 0 {
+		t.Errorf("%d records, %d valid; want 4, 0", len(recs), valid)
+	}
+}
@@ -0,0 +1,180 @@
+package join
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"nih.software/log"
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+// maxRequestSize bounds the size of a sign request.
+const maxRequestSize = 64 << 10
+
+// Server is an HTTP handler signing the certificate requests of joining nodes
+// that present a valid token. It serves /join/roots and /join/sign, and
+// /join/renew to nodes renewing their certificate for a new key, which
+// authenticate with their current one.
+type Server struct {
+	// CA signs the certificates of joining nodes.
+	CA *trustgen.CA
+
+	// Roots are the CA certificates returned to joining nodes.
+	Roots []*x509.Certificate
+
+	// Tokens holds the join tokens.
+	Tokens *Store
+
+	// Lifetime is the lifetime of the certificates issued.
+	// Zero means the trustgen default.
+	Lifetime time.Duration
+}
+
+// ServeHTTP implements the join protocol.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/join/roots" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write(trustgen.PEMEncodeCertificates(s.Roots...))
+
+	case r.URL.Path == "/join/sign" && r.Method == http.MethodPost:
+		s.sign(w, r)
+
+	case r.URL.Path == "/join/renew" && r.Method == http.MethodPost:
+		s.renew(w, r)
+
+	case r.URL.Path == "/join/roots" || r.URL.Path == "/join/sign" || r.URL.Path == "/join/renew":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) sign(w http.ResponseWriter, r *http.Request) {
+	var req signRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+
+	csr, err := trustgen.ParseCertificateRequestPEM([]byte(req.CSR))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check the request before redeeming, so that a bad request
+	// does not use up the token.
+	rec, err := s.Tokens.Redeem(req.Token, csr.Subject.CommonName)
+	if errors.Is(err, ErrTokenRejected) {
+		log.Default().Warn("join: token rejected", "remote", r.RemoteAddr, "name", csr.Subject.CommonName)
+		http.Error(w, "token rejected", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Default().Error("join: redeem token", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// A token grants membership, not roles; those are up to the CA operator.
+	subject := csr.Subject
+	subject.OrganizationalUnit = nil
+
+	opts := []trustgen.Option{
+		trustgen.WithSubject(subject),
+		trustgen.WithDNSNames(csr.DNSNames...),
+		trustgen.WithIPAddresses(csr.IPAddresses...),
+	}
+	if s.Lifetime != 0 {
+		opts = append(opts, trustgen.WithLifetime(s.Lifetime))
+	}
+
+	crt, err := s.CA.SignLeaf(csr.PublicKey, opts...)
+	if err != nil {
+		log.Default().Error("join: sign", "token", rec.ID, "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Default().Info("join: signed", "token", rec.ID, "remote", r.RemoteAddr,
+		"subject", crt.Subject.String(), "serial", crt.SerialNumber)
+
+	s.respond(w, crt)
+}
+
+// renew signs the certificate request of a node for a new key. The node
+// authenticates with the client certificate of its connection, which must
+// be a leaf of s.Roots, and the new certificate has the subject, roles, and
+// names of that leaf, whatever the request asks for. Revoked leaves are
+// left to the TLS configuration of the connection to reject.
+func (s *Server) renew(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || r.TLS.NegotiatedProtocol == Proto || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+
+	chain := r.TLS.PeerCertificates
+	leaf := chain[0]
+	if err := trust.VerifyChain(chain, s.Roots); err != nil || leaf.IsCA {
+		log.Default().Warn("join: renewal rejected", "remote", r.RemoteAddr, "subject", leaf.Subject.String(), "err", err)
+		http.Error(w, "renewal rejected", http.StatusForbidden)
+		return
+	}
+
+	var req renewRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+
+	csr, err := trustgen.ParseCertificateRequestPEM([]byte(req.CSR))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := []trustgen.Option{
+		trustgen.WithSubject(leaf.Subject),
+		trustgen.WithDNSNames(leaf.DNSNames...),
+		trustgen.WithIPAddresses(leaf.IPAddresses...),
+	}
+	if s.Lifetime != 0 {
+		opts = append(opts, trustgen.WithLifetime(s.Lifetime))
+	}
+
+	crt, err := s.CA.SignLeaf(csr.PublicKey, opts...)
+	if err != nil {
+		log.Default().Error("join: renew", "subject", leaf.Subject.String(), "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Default().Info("join: renewed", "remote", r.RemoteAddr, "subject", crt.Subject.String(),
+		"serial", crt.SerialNumber, "previous", leaf.SerialNumber)
+
+	s.respond(w, crt)
+}
+
+// respond sends the chain of crt and the roots to a node.
+func (s *Server) respond(w http.ResponseWriter, crt *x509.Certificate) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&signResponse{
+		Chain: string(trustgen.PEMEncodeCertificates(s.CA.ChainFor(crt)...)),
+		Roots: string(trustgen.PEMEncodeCertificates(s.Roots...)),
+	})
+}
@@ -0,0 +1,254 @@
+package join
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrTokenRejected is returned for a token that does not exist, has expired,
+// has been used or revoked, or is bound to a different node name.
+var ErrTokenRejected = errors.New("join: token rejected")
+
+// ErrTokenNotFound is returned by Revoke for an unknown token ID.
+var ErrTokenNotFound = errors.New("join: token not found")
+
+// Store is a file-backed store of single-use join tokens.
+// Only a hash of each token's secret is stored.
+//
+// Every operation reads the file again, so that tokens created by one
+// process can be redeemed by another, such as the running daemon.
+type Store struct {
+	name string
+	mu   sync.Mutex
+}
+
+type storeData struct {
+	Tokens []*Record `json:"tokens"`
+}
+
+// Record describes a join token.
+type Record struct {
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	// Name is the common name the joining node must request,
+	// or empty if the token is not bound to a name.
+	Name string `json:"name,omitempty"`
+
+	// UsedAt is the zero time unless the token has been redeemed.
+	UsedAt time.Time `json:"used_at"`
+
+	// RevokedAt is the zero time unless the token has been revoked.
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// Used reports whether the token has been redeemed.
+func (r *Record) Used() bool {
+	return !r.UsedAt.IsZero()
+}
+
+// Revoked reports whether the token has been revoked.
+func (r *Record) Revoked() bool {
+	return !r.RevokedAt.IsZero()
+}
+
+// Valid reports whether the token can still be redeemed at t.
+func (r *Record) Valid(t time.Time) bool {
+	return !r.Used() && !r.Revoked() && t.Before(r.Expires)
+}
+
+// OpenStore opens the token store in the named file.
+// The file is created on first write if it does not exist.
+func OpenStore(name string) (*Store, error) {
+	s := &Store{name: name}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Create adds a token valid for ttl for a node named name, or any node
+// if name is empty, and returns it as "ID.SECRET".
+// The secret cannot be recovered later.
+func (s *Store) Create(name string, ttl time.Duration) (string, error) {
+	id := make([]byte, 6)
+	secret := make([]byte, 18)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	rec := &Record{
+		ID:      hex.EncodeToString(id),
+		Hash:    hashSecret(base64.RawURLEncoding.EncodeToString(secret)),
+		Created: now,
+		Expires: now.Add(ttl),
+		Name:    name,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.load()
+	if err != nil {
+		return "", err
+	}
+
+	data.Tokens = append(data.Tokens, rec)
+	if err := s.save(data); err != nil {
+		return "", err
+	}
+
+	return rec.ID + "." + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// Redeem marks the token "ID.SECRET" as used by the node named name.
+// It returns ErrTokenRejected if the token is unknown, expired, used,
+// revoked, or bound to another name, without using it up.
+func (s *Store) Redeem(token, name string) (*Record, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrTokenRejected
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rec := range data.Tokens {
+		if rec.ID != id {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(rec.Hash), []byte(hashSecret(secret))) != 1 ||
+			!rec.Valid(time.Now()) || rec.Name != "" && rec.Name != name {
+			return nil, ErrTokenRejected
+		}
+
+		rec.UsedAt = time.Now().UTC().Truncate(time.Second)
+		if err := s.save(data); err != nil {
+			return nil, err
+		}
+
+		return rec, nil
+	}
+
+	return nil, ErrTokenRejected
+}
+
+// Records returns the tokens in order of creation.
+func (s *Store) Records() ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return data.Tokens, nil
+}
+
+// Revoke marks the token with the given ID as revoked.
+// Revoking a token twice is not an error.
+func (s *Store) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range data.Tokens {
+		if rec.ID != id {
+			continue
+		}
+
+		if rec.Revoked() {
+			return nil
+		}
+
+		rec.RevokedAt = time.Now().UTC().Truncate(time.Second)
+		return s.save(data)
+	}
+
+	return ErrTokenNotFound
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// load reads the store. The caller must hold s.mu, except in OpenStore.
+func (s *Store) load() (*storeData, error) {
+	var data storeData
+
+	contents, err := os.ReadFile(s.name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &data, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &data); err != nil {
+		return nil, fmt.Errorf("join: open %s: %w", s.name, err)
+	}
+
+	return &data, nil
+}
+
+// save writes the store atomically and readable only by its owner.
+// The caller must hold s.mu.
+func (s *Store) save(data *storeData) error {
+	contents, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.name), 0700); err != nil {
+		return err
+	}
+
+	// CreateTemp creates the file with mode 0600.
+	tmp, err := os.CreateTemp(filepath.Dir(s.name), filepath.Base(s.name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.name)
+}
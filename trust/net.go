@@ -0,0 +1,29 @@
+package trust
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Dial connects to the address on the named network and completes
+// a mutually authenticated handshake with the credentials of the bundle.
+// The context bounds both the connection and the handshake.
+func (b *Bundle) Dial(ctx context.Context, network, addr string) (*tls.Conn, error) {
+	d := tls.Dialer{Config: b.TLSConfig()}
+
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*tls.Conn), nil
+}
+
+// Listen announces on the local network address and returns a listener
+// whose connections authenticate with the credentials of the bundle.
+// As with tls.Listen, the handshake of an accepted connection runs on its
+// first read or write, or on an explicit call to its Handshake method.
+func (b *Bundle) Listen(network, addr string) (net.Listener, error) {
+	return tls.Listen(network, addr, b.TLSConfig())
+}
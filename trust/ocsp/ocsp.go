@@ -0,0 +1,539 @@
+// Package ocsp implements the subset of the Online Certificate Status Protocol (RFC 6960)
+// needed to answer status queries for certificates issued by trustgen.
+package ocsp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Status is the revocation status of a certificate.
+type Status int
+
+const (
+	Good Status = iota
+	Revoked
+	Unknown
+)
+
+func (s Status) String() string {
+	switch s {
+	case Good:
+		return "good"
+	case Revoked:
+		return "revoked"
+	default:
+		return "unknown"
+	}
+}
+
+// ResponseStatus is the status of an OCSP response as a whole.
+type ResponseStatus int
+
+const (
+	Successful       ResponseStatus = 0
+	MalformedRequest ResponseStatus = 1
+	InternalError    ResponseStatus = 2
+	TryLater         ResponseStatus = 3
+	Unauthorized     ResponseStatus = 6
+)
+
+func (s ResponseStatus) Error() string {
+	switch s {
+	case MalformedRequest:
+		return "ocsp: malformed request"
+	case InternalError:
+		return "ocsp: internal error"
+	case TryLater:
+		return "ocsp: try later"
+	case Unauthorized:
+		return "ocsp: unauthorized"
+	default:
+		return fmt.Sprintf("ocsp: response status %d", int(s))
+	}
+}
+
+var (
+	oidBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+)
+
+type certID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type request struct {
+	Cert       certID
+	Extensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type tbsRequest struct {
+	Version       int              `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue    `asn1:"explicit,tag:1,optional"`
+	RequestList   []request        `asn1:""`
+	Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+	Signature  asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type basicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Version     int       `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID []byte    `asn1:"explicit,tag:2"`
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []singleResponse
+}
+
+type singleResponse struct {
+	CertID     certID
+	CertStatus asn1.RawValue
+	ThisUpdate time.Time `asn1:"generalized"`
+	NextUpdate time.Time `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// Request is a status query for a single certificate.
+type Request struct {
+	HashAlgorithm  crypto.Hash
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+// Response is the status of a single certificate.
+type Response struct {
+	SerialNumber     *big.Int
+	Status           Status
+	RevokedAt        time.Time
+	RevocationReason int
+	ProducedAt       time.Time
+	ThisUpdate       time.Time
+	NextUpdate       time.Time
+}
+
+// CreateRequest returns the DER form of a request for the status of cert, which was issued by issuer.
+func CreateRequest(cert, issuer *x509.Certificate) ([]byte, error) {
+	id, err := newCertID(crypto.SHA256, issuer, cert.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspRequest{
+		TBSRequest: tbsRequest{
+			RequestList: []request{{Cert: id}},
+		},
+	})
+}
+
+// ParseRequest parses a DER-encoded request. Only the first certificate in the request is returned.
+func ParseRequest(der []byte) (*Request, error) {
+	var req ocspRequest
+	if rest, err := asn1.Unmarshal(der, &req); err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, errors.New("ocsp: trailing data in request")
+	}
+
+	if len(req.TBSRequest.RequestList) == 0 {
+		return nil, errors.New("ocsp: empty request")
+	}
+
+	id := req.TBSRequest.RequestList[0].Cert
+	h, err := hashFromOID(id.HashAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	r := Request{
+		HashAlgorithm:  h,
+		IssuerNameHash: id.IssuerNameHash,
+		IssuerKeyHash:  id.IssuerKeyHash,
+		SerialNumber:   id.SerialNumber,
+	}
+
+	return &r, nil
+}
+
+// IssuedBy reports whether the request is for a certificate issued by issuer.
+func (r *Request) IssuedBy(issuer *x509.Certificate) bool {
+	id, err := newCertID(r.HashAlgorithm, issuer, r.SerialNumber)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(id.IssuerNameHash, r.IssuerNameHash) && bytes.Equal(id.IssuerKeyHash, r.IssuerKeyHash)
+}
+
+// CreateResponse returns the DER form of a successful response to req, signed by signer.
+// The responder certificate must be the issuer itself, or a delegated signer issued by it;
+// a delegated signer certificate is included in the response.
+func CreateResponse(issuer, responder *x509.Certificate, signer crypto.Signer, req *Request, resp *Response) ([]byte, error) {
+	id, err := newCertID(req.HashAlgorithm, issuer, req.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	var status asn1.RawValue
+	switch resp.Status {
+	case Good:
+		status = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}
+
+	case Revoked:
+		info, err := asn1.Marshal(revokedInfo{
+			RevocationTime: resp.RevokedAt.UTC(),
+			Reason:         asn1.Enumerated(resp.RevocationReason),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		var seq asn1.RawValue
+		if _, err := asn1.Unmarshal(info, &seq); err != nil {
+			return nil, err
+		}
+
+		status = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: seq.Bytes}
+
+	default:
+		status = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2}
+	}
+
+	keyHash, err := publicKeyHash(crypto.SHA1, responder)
+	if err != nil {
+		return nil, err
+	}
+
+	tbs, err := asn1.Marshal(responseData{
+		ResponderID: keyHash,
+		ProducedAt:  time.Now().UTC().Truncate(time.Second),
+		Responses: []singleResponse{{
+			CertID:     id,
+			CertStatus: status,
+			ThisUpdate: resp.ThisUpdate.UTC().Truncate(time.Second),
+			NextUpdate: resp.NextUpdate.UTC().Truncate(time.Second),
+		}},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	alg, sig, err := sign(signer, tbs)
+	if err != nil {
+		return nil, err
+	}
+
+	basic := basicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: alg,
+		Signature:          asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	}
+
+	if !responder.Equal(issuer) {
+		basic.Certificates = []asn1.RawValue{{FullBytes: responder.Raw}}
+	}
+
+	basicDER, err := asn1.Marshal(basic)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspResponse{
+		Status: asn1.Enumerated(Successful),
+		Response: responseBytes{
+			ResponseType: oidBasicResponse,
+			Response:     basicDER,
+		},
+	})
+}
+
+// CreateErrorResponse returns the DER form of an unsuccessful response.
+func CreateErrorResponse(status ResponseStatus) []byte {
+	der, err := asn1.Marshal(struct{ Status asn1.Enumerated }{asn1.Enumerated(status)})
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+// ParseResponse parses a DER-encoded response to a request for the status
+// of cert, which was issued by issuer, and verifies its signature, which
+// must be made by issuer or by a delegated OCSP signer issued by issuer.
+// The response must be for cert: of its serial number, and of the name
+// and key of issuer. An unsuccessful response is returned as a
+// ResponseStatus error.
+func ParseResponse(der []byte, cert, issuer *x509.Certificate) (*Response, error) {
+	var resp ocspResponse
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, err
+	}
+
+	if status := ResponseStatus(resp.Status); status != Successful {
+		return nil, status
+	}
+
+	if !resp.Response.ResponseType.Equal(oidBasicResponse) {
+		return nil, errors.New("ocsp: unsupported response type")
+	}
+
+	var basic basicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return nil, err
+	}
+
+	var data responseData
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &data); err != nil {
+		return nil, err
+	}
+
+	if len(data.Responses) == 0 {
+		return nil, errors.New("ocsp: empty response")
+	}
+
+	responder := issuer
+	if len(basic.Certificates) > 0 {
+		crt, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := crt.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("ocsp: responder certificate: %w", err)
+		}
+
+		if !hasOCSPSigning(crt) {
+			return nil, errors.New("ocsp: responder certificate is not authorized for OCSP signing")
+		}
+
+		responder = crt
+	}
+
+	alg, err := signatureAlgorithm(basic.SignatureAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := responder.CheckSignature(alg, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("ocsp: %w", err)
+	}
+
+	single, err := findResponse(data.Responses, cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	r := Response{
+		SerialNumber: single.CertID.SerialNumber,
+		ProducedAt:   data.ProducedAt,
+		ThisUpdate:   single.ThisUpdate,
+		NextUpdate:   single.NextUpdate,
+	}
+
+	switch single.CertStatus.Tag {
+	case 0:
+		r.Status = Good
+
+	case 1:
+		var info revokedInfo
+		seq := append([]byte{0x30}, single.CertStatus.FullBytes[1:]...)
+		if _, err := asn1.Unmarshal(seq, &info); err != nil {
+			return nil, err
+		}
+
+		r.Status = Revoked
+		r.RevokedAt = info.RevocationTime
+		r.RevocationReason = int(info.Reason)
+
+	default:
+		r.Status = Unknown
+	}
+
+	return &r, nil
+}
+
+// findResponse returns the response of responses for cert, issued by
+// issuer.
+func findResponse(responses []singleResponse, cert, issuer *x509.Certificate) (*singleResponse, error) {
+	for i := range responses {
+		id := responses[i].CertID
+		if id.SerialNumber == nil || id.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			continue
+		}
+
+		h, err := hashFromOID(id.HashAlgorithm.Algorithm)
+		if err != nil {
+			continue
+		}
+
+		want, err := newCertID(h, issuer, cert.SerialNumber)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(id.IssuerNameHash, want.IssuerNameHash) && bytes.Equal(id.IssuerKeyHash, want.IssuerKeyHash) {
+			return &responses[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("ocsp: no response for serial %v of the issuer", cert.SerialNumber)
+}
+
+func newCertID(h crypto.Hash, issuer *x509.Certificate, serial *big.Int) (certID, error) {
+	var id certID
+
+	oid, err := oidFromHash(h)
+	if err != nil {
+		return id, err
+	}
+
+	keyHash, err := publicKeyHash(h, issuer)
+	if err != nil {
+		return id, err
+	}
+
+	hh := h.New()
+	hh.Write(issuer.RawSubject)
+
+	id = certID{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.NullRawValue},
+		IssuerNameHash: hh.Sum(nil),
+		IssuerKeyHash:  keyHash,
+		SerialNumber:   serial,
+	}
+
+	return id, nil
+}
+
+func publicKeyHash(h crypto.Hash, c *x509.Certificate) ([]byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+
+	if _, err := asn1.Unmarshal(c.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+
+	hh := h.New()
+	hh.Write(spki.PublicKey.RightAlign())
+	return hh.Sum(nil), nil
+}
+
+func hashFromOID(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+
+	default:
+		return 0, fmt.Errorf("ocsp: unsupported hash algorithm %v", oid)
+	}
+}
+
+func oidFromHash(h crypto.Hash) (asn1.ObjectIdentifier, error) {
+	switch h {
+	case crypto.SHA1:
+		return oidSHA1, nil
+
+	case crypto.SHA256:
+		return oidSHA256, nil
+
+	default:
+		return nil, fmt.Errorf("ocsp: unsupported hash algorithm %v", h)
+	}
+}
+
+func signatureAlgorithm(oid asn1.ObjectIdentifier) (x509.SignatureAlgorithm, error) {
+	switch {
+	case oid.Equal(oidEd25519):
+		return x509.PureEd25519, nil
+
+	case oid.Equal(oidECDSAWithSHA256):
+		return x509.ECDSAWithSHA256, nil
+
+	case oid.Equal(oidSHA256WithRSA):
+		return x509.SHA256WithRSA, nil
+
+	default:
+		return 0, fmt.Errorf("ocsp: unsupported signature algorithm %v", oid)
+	}
+}
+
+func sign(signer crypto.Signer, msg []byte) (pkix.AlgorithmIdentifier, []byte, error) {
+	var alg pkix.AlgorithmIdentifier
+
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		sig, err := signer.Sign(rand.Reader, msg, crypto.Hash(0))
+		return pkix.AlgorithmIdentifier{Algorithm: oidEd25519}, sig, err
+
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, sig, err
+
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}, sig, err
+
+	default:
+		return alg, nil, fmt.Errorf("ocsp: unsupported key type %T", signer.Public())
+	}
+}
+
+func hasOCSPSigning(c *x509.Certificate) bool {
+	for _, u := range c.ExtKeyUsage {
+		if u == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package ocsp_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"nih.software/trust/ocsp"
+	"nih.software/trust/trustgen"
+)
+
+func TestResponder(t *testing.T) {
+	db, err := trustgen.OpenDB(filepath.Join(t.TempDir(), "issued.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootCert, rootKey, err := trustgen.NewRoot(trustgen.WithDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.NewCA(rootCert, rootKey, trustgen.WithDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signerCert, signerKey, err := ca.NewOCSPSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good, _, err := ca.NewLeaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, _, err := ca.NewLeaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Revoke(revoked.SerialNumber.Int64(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// never issued
+	unknown := *good
+	unknown.SerialNumber = big.NewInt(1 << 40)
+
+	rs := &ocsp.Responder{
+		Issuer: rootCert,
+		Cert:   signerCert,
+		Key:    signerKey,
+		DB:     db,
+	}
+
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		status ocsp.Status
+	}{
+		{"good", ocsp.Good},
+		{"revoked", ocsp.Revoked},
+		{"unknown", ocsp.Unknown},
+	}
+
+	for i, crt := range []*x509.Certificate{good, revoked, &unknown} {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ocsp.CreateRequest(crt, rootCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			httpResp, err := http.Post(srv.URL, "application/ocsp-request", bytes.NewReader(req))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer httpResp.Body.Close()
+
+			der, err := io.ReadAll(httpResp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp, err := ocsp.ParseResponse(der, crt, rootCert)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Status != tt.status {
+				t.Fatalf("status %v != %v", resp.Status, tt.status)
+			}
+
+			if resp.SerialNumber.Cmp(crt.SerialNumber) != 0 {
+				t.Fatalf("serial %v != %v", resp.SerialNumber, crt.SerialNumber)
+			}
+		})
+	}
+
+	t.Run("wrong issuer", func(t *testing.T) {
+		otherCert, _, err := trustgen.NewRoot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := ocsp.CreateRequest(good, otherCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		der, err := rs.Respond(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ocsp.ParseResponse(der, good, rootCert); err != ocsp.Unauthorized {
+			t.Fatalf("error %v != %v", err, ocsp.Unauthorized)
+		}
+	})
+
+	// The default CAs have no subject, like the root, and the database
+	// numbers their certificates in one sequence.
+	t.Run("other issuer", func(t *testing.T) {
+		inter, err := ca.NewIntermediate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leaf, _, err := inter.NewLeaf()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the serial of the leaf, as if the root issued it
+		req, err := ocsp.CreateRequest(leaf, rootCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		der, err := rs.Respond(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := ocsp.ParseResponse(der, leaf, rootCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.Status != ocsp.Unknown {
+			t.Fatalf("status %v != %v", resp.Status, ocsp.Unknown)
+		}
+	})
+
+	t.Run("other certificate", func(t *testing.T) {
+		req, err := ocsp.CreateRequest(revoked, rootCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		der, err := rs.Respond(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a valid response for revoked does not tell the status of good
+		if _, err := ocsp.ParseResponse(der, good, rootCert); err == nil {
+			t.Fatal("response for another serial accepted")
+		}
+	})
+}
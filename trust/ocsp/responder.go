@@ -0,0 +1,121 @@
+package ocsp
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"nih.software/trust/trustgen"
+)
+
+// Responder is an HTTP handler answering OCSP requests
+// from the certificates recorded in an issuance database.
+type Responder struct {
+	// Issuer is the CA whose certificates the responder reports on.
+	Issuer *x509.Certificate
+
+	// Cert and Key sign responses.
+	// Cert is either Issuer or a delegated signer from trustgen.NewOCSPSigner.
+	Cert *x509.Certificate
+	Key  crypto.Signer
+
+	// DB is the issuance database recording the issued certificates.
+	DB *trustgen.DB
+
+	// Validity is how long a response may be cached. Zero means one hour.
+	Validity time.Duration
+}
+
+// maxRequestSize bounds the size of a POSTed request.
+const maxRequestSize = 4096
+
+// ServeHTTP implements both the GET and POST methods of RFC 6960, appendix A.
+func (rs *Responder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var der []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		enc := strings.TrimPrefix(r.URL.Path, "/")
+		der, err = base64.StdEncoding.DecodeString(enc)
+
+	case http.MethodPost:
+		der, err = io.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		rs.write(w, CreateErrorResponse(MalformedRequest))
+		return
+	}
+
+	resp, err := rs.Respond(der)
+	if err != nil {
+		rs.write(w, CreateErrorResponse(InternalError))
+		return
+	}
+
+	rs.write(w, resp)
+}
+
+// Respond returns the DER-encoded response to a DER-encoded request.
+func (rs *Responder) Respond(der []byte) ([]byte, error) {
+	req, err := ParseRequest(der)
+	if err != nil {
+		return CreateErrorResponse(MalformedRequest), nil
+	}
+
+	if !req.IssuedBy(rs.Issuer) {
+		return CreateErrorResponse(Unauthorized), nil
+	}
+
+	validity := rs.Validity
+	if validity == 0 {
+		validity = time.Hour
+	}
+
+	now := time.Now()
+	resp := Response{
+		SerialNumber: req.SerialNumber,
+		Status:       Unknown,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(validity),
+	}
+
+	if rec := rs.lookup(req.SerialNumber); rec != nil {
+		resp.Status = Good
+		if rec.Revoked() {
+			resp.Status = Revoked
+			resp.RevokedAt = rec.RevokedAt
+			resp.RevocationReason = rec.Reason
+		}
+	}
+
+	return CreateResponse(rs.Issuer, rs.Cert, rs.Key, req, &resp)
+}
+
+func (rs *Responder) lookup(serial *big.Int) *trustgen.Record {
+	if !serial.IsInt64() {
+		return nil
+	}
+
+	rec := rs.DB.Lookup(serial.Int64())
+	if rec == nil || !rec.IssuedBy(rs.Issuer) {
+		return nil
+	}
+
+	return rec
+}
+
+func (rs *Responder) write(w http.ResponseWriter, resp []byte) {
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
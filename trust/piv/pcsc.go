@@ -0,0 +1,152 @@
+//go:build pcsc && cgo && (linux || darwin || freebsd)
+
+package piv
+
+/*
+#cgo linux freebsd pkg-config: libpcsclite
+#cgo darwin LDFLAGS: -framework PCSC
+
+#include <stdlib.h>
+
+#ifdef __APPLE__
+#include <PCSC/winscard.h>
+#include <PCSC/wintypes.h>
+#else
+#include <winscard.h>
+#endif
+
+static LONG nih_transmit(SCARDHANDLE card, DWORD proto, BYTE *cmd, DWORD n, BYTE *resp, DWORD *size) {
+	const SCARD_IO_REQUEST *pci = proto == SCARD_PROTOCOL_T0 ? SCARD_PCI_T0 : SCARD_PCI_T1;
+	return SCardTransmit(card, pci, cmd, n, NULL, resp, size);
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// reader is the Transport of a card in a PC/SC reader, which it holds in
+// a transaction so that other programs cannot come between its commands.
+type reader struct {
+	ctx   C.SCARDCONTEXT
+	card  C.SCARDHANDLE
+	proto C.DWORD
+}
+
+// OpenReader connects to the card in the PC/SC reader whose name contains
+// name, or in the first reader if name is empty.
+func OpenReader(name string) (Transport, error) {
+	var r reader
+	if rc := C.SCardEstablishContext(C.SCARD_SCOPE_SYSTEM, nil, nil, &r.ctx); rc != C.SCARD_S_SUCCESS {
+		return nil, pcscError("establish context", rc)
+	}
+
+	names, err := r.readers()
+	if err != nil {
+		C.SCardReleaseContext(r.ctx)
+		return nil, err
+	}
+
+	found := ""
+	for _, n := range names {
+		if strings.Contains(n, name) {
+			found = n
+			break
+		}
+	}
+	if found == "" {
+		C.SCardReleaseContext(r.ctx)
+		return nil, fmt.Errorf("piv: no reader %q among %q", name, names)
+	}
+
+	cname := C.CString(found)
+	defer C.free(unsafe.Pointer(cname))
+
+	rc := C.SCardConnect(r.ctx, cname, C.SCARD_SHARE_SHARED, C.SCARD_PROTOCOL_T0|C.SCARD_PROTOCOL_T1, &r.card, &r.proto)
+	if rc != C.SCARD_S_SUCCESS {
+		C.SCardReleaseContext(r.ctx)
+		return nil, pcscError("connect to "+found, rc)
+	}
+
+	if rc := C.SCardBeginTransaction(r.card); rc != C.SCARD_S_SUCCESS {
+		C.SCardDisconnect(r.card, C.SCARD_LEAVE_CARD)
+		C.SCardReleaseContext(r.ctx)
+		return nil, pcscError("begin transaction", rc)
+	}
+
+	return &r, nil
+}
+
+// readers returns the names of the readers.
+func (r *reader) readers() ([]string, error) {
+	var size C.DWORD
+	rc := C.SCardListReaders(r.ctx, nil, nil, &size)
+	if rc == C.SCARD_E_NO_READERS_AVAILABLE {
+		return nil, errors.New("piv: no PC/SC reader")
+	}
+	if rc != C.SCARD_S_SUCCESS {
+		return nil, pcscError("list readers", rc)
+	}
+
+	buf := make([]byte, size)
+	if rc := C.SCardListReaders(r.ctx, nil, (*C.char)(unsafe.Pointer(&buf[0])), &size); rc != C.SCARD_S_SUCCESS {
+		return nil, pcscError("list readers", rc)
+	}
+
+	// The names are a list of strings, each ending with NUL, ending with
+	// an empty string.
+	var names []string
+	for _, n := range bytes.Split(buf[:size], []byte{0}) {
+		if len(n) > 0 {
+			names = append(names, string(n))
+		}
+	}
+
+	return names, nil
+}
+
+func (r *reader) Transmit(apdu []byte) ([]byte, error) {
+	resp := make([]byte, 258) // the data and status of a short response
+	size := C.DWORD(len(resp))
+
+	rc := C.nih_transmit(r.card, r.proto, (*C.BYTE)(unsafe.Pointer(&apdu[0])), C.DWORD(len(apdu)),
+		(*C.BYTE)(unsafe.Pointer(&resp[0])), &size)
+	if rc != C.SCARD_S_SUCCESS {
+		return nil, pcscError("transmit", rc)
+	}
+
+	return resp[:size], nil
+}
+
+// Close ends the transaction and resets the card, so that the management
+// key authenticated with does not stay authenticated.
+func (r *reader) Close() error {
+	C.SCardEndTransaction(r.card, C.SCARD_LEAVE_CARD)
+	rc := C.SCardDisconnect(r.card, C.SCARD_RESET_CARD)
+	C.SCardReleaseContext(r.ctx)
+	if rc != C.SCARD_S_SUCCESS {
+		return pcscError("disconnect", rc)
+	}
+
+	return nil
+}
+
+var pcscMessages = map[uint32]string{
+	0x8010000c: "no card in the reader",
+	0x8010001d: "the PC/SC service is not running",
+	0x80100069: "the card was removed",
+	0x8010000b: "the card is in use by another program",
+}
+
+func pcscError(op string, rc C.LONG) error {
+	code := uint32(rc)
+	if msg, ok := pcscMessages[code]; ok {
+		return fmt.Errorf("piv: %s: %s", op, msg)
+	}
+	return fmt.Errorf("piv: %s: PC/SC error %#08x", op, code)
+}
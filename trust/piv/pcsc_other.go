@@ -0,0 +1,14 @@
+//go:build !pcsc || !cgo || !(linux || darwin || freebsd)
+
+package piv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// OpenReader fails in builds without PC/SC support; see the package
+// documentation.
+func OpenReader(name string) (Transport, error) {
+	return nil, fmt.Errorf("piv: PC/SC readers need a build with cgo and -tags pcsc: %w", errors.ErrUnsupported)
+}
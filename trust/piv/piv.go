@@ -0,0 +1,472 @@
+// Package piv generates keys on PIV smart cards, such as YubiKeys, and
+// stores the certificates issued for them, as NIST SP 800-73-4 specifies,
+// so that the private key of a node never leaves its card.
+//
+// A Card talks to its card through a Transport, which exchanges APDUs.
+// OpenReader returns the Transport of a card in a PC/SC reader; it needs cgo
+// and the PC/SC library of the system, pcsclite on Linux, and is only
+// available in builds with the pcsc tag:
+//
+//	go build -tags pcsc nih.software
+package piv
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// A Transport sends command APDUs to a card and returns its responses,
+// including the status word.
+type Transport interface {
+	Transmit(apdu []byte) ([]byte, error)
+	Close() error
+}
+
+// A Slot holds a key of the card and the certificate issued for it.
+type Slot struct {
+	Key    byte   // key reference, such as 0x9a
+	Object uint32 // data object of the certificate, such as 0x5fc105
+}
+
+// The slots of SP 800-73-4 for keys generated on the card.
+var (
+	SlotAuthentication     = Slot{0x9a, 0x5fc105}
+	SlotSignature          = Slot{0x9c, 0x5fc10a}
+	SlotKeyManagement      = Slot{0x9d, 0x5fc10b}
+	SlotCardAuthentication = Slot{0x9e, 0x5fc101}
+)
+
+var slots = []Slot{SlotAuthentication, SlotSignature, SlotKeyManagement, SlotCardAuthentication}
+
+func (s Slot) String() string {
+	return fmt.Sprintf("%02x", s.Key)
+}
+
+// ParseSlot returns the slot with the given name, as returned by Slot.String.
+func ParseSlot(name string) (Slot, error) {
+	for _, s := range slots {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+
+	return Slot{}, fmt.Errorf("piv: unknown slot %q: want 9a, 9c, 9d, or 9e", name)
+}
+
+// Algorithm is the algorithm of a key generated on the card.
+type Algorithm byte
+
+const (
+	RSA2048 Algorithm = 0x07
+	ECCP256 Algorithm = 0x11
+	ECCP384 Algorithm = 0x14
+)
+
+// The names of algorithms are those of the key types of trustgen.
+var algorithmNames = map[Algorithm]string{
+	RSA2048: "rsa-2048",
+	ECCP256: "ecdsa-p256",
+	ECCP384: "ecdsa-p384",
+}
+
+func (a Algorithm) String() string {
+	if name, ok := algorithmNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("Algorithm(%#02x)", byte(a))
+}
+
+// ParseAlgorithm returns the algorithm with the given name, as returned by
+// Algorithm.String.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for a, n := range algorithmNames {
+		if n == name {
+			return a, nil
+		}
+	}
+
+	return 0, fmt.Errorf("piv: unsupported key type %q: want ecdsa-p256, ecdsa-p384, or rsa-2048", name)
+}
+
+// DefaultManagementKey is the management key cards come with. It should be
+// changed before a card holds the key of a node, since anyone may use it to
+// replace the keys of the card.
+var DefaultManagementKey = []byte{
+	1, 2, 3, 4, 5, 6, 7, 8,
+	1, 2, 3, 4, 5, 6, 7, 8,
+	1, 2, 3, 4, 5, 6, 7, 8,
+}
+
+// ErrNotFound is returned for a slot without a certificate.
+var ErrNotFound = errors.New("piv: not found")
+
+// A StatusError is a status word with which the card refused a command.
+type StatusError uint16
+
+var statusMessages = map[StatusError]string{
+	0x6700: "wrong length",
+	0x6982: "security status not satisfied",
+	0x6983: "authentication method blocked",
+	0x6a80: "incorrect data",
+	0x6a81: "function not supported",
+	0x6a82: "not found",
+	0x6a86: "incorrect parameters",
+	0x6d00: "instruction not supported",
+}
+
+func (e StatusError) Error() string {
+	if msg, ok := statusMessages[e]; ok {
+		return fmt.Sprintf("piv: %s (%04x)", msg, uint16(e))
+	}
+	return fmt.Sprintf("piv: status %04x", uint16(e))
+}
+
+// Is reports whether e means target, so that errors.Is(err, ErrNotFound)
+// holds for a missing object.
+func (e StatusError) Is(target error) bool {
+	return target == ErrNotFound && e == 0x6a82
+}
+
+const (
+	insSelect       = 0xa4
+	insGenerateKey  = 0x47
+	insAuthenticate = 0x87
+	insGetData      = 0xcb
+	insPutData      = 0xdb
+	insGetResponse  = 0xc0
+	insGetMetadata  = 0xf7 // YubiKey extension
+)
+
+// keyManagementKey is the key reference of the management key, with which
+// the card authenticates changes to its keys and certificates.
+const keyManagementKey = 0x9b
+
+// The algorithms of management keys.
+const (
+	alg3DES   = 0x03
+	algAES128 = 0x08
+	algAES192 = 0x0a
+	algAES256 = 0x0c
+)
+
+var aesKeySizes = map[byte]int{algAES128: 16, algAES192: 24, algAES256: 32}
+
+// aid is the application identifier of PIV.
+var aid = []byte{0xa0, 0x00, 0x00, 0x03, 0x08}
+
+// A Card is the PIV application of a card.
+type Card struct {
+	t Transport
+}
+
+// Open selects the PIV application of the card of t.
+func Open(t Transport) (*Card, error) {
+	c := Card{t}
+	if _, err := c.transmit(insSelect, 0x04, 0x00, aid); err != nil {
+		return nil, fmt.Errorf("piv: select: %w", err)
+	}
+
+	return &c, nil
+}
+
+// Close closes the transport of the card.
+func (c *Card) Close() error {
+	return c.t.Close()
+}
+
+// Authenticate authenticates to the card with its management key, as
+// generating keys and storing certificates require. The algorithm of the
+// key is that the card reports, or Triple DES for cards that report none.
+func (c *Card) Authenticate(key []byte) error {
+	alg := byte(alg3DES)
+	if resp, err := c.transmit(insGetMetadata, 0x00, keyManagementKey, nil); err == nil {
+		if m, err := parseTLV(resp); err == nil && len(m[0x01]) == 1 {
+			alg = m[0x01][0]
+		}
+	}
+
+	var block cipher.Block
+	var err error
+	switch alg {
+	case alg3DES:
+		block, err = des.NewTripleDESCipher(key)
+	case algAES128, algAES192, algAES256:
+		if size := aesKeySizes[alg]; len(key) != size {
+			err = fmt.Errorf("%d bytes, but the card has an AES key of %d", len(key), size)
+		} else {
+			block, err = aes.NewCipher(key)
+		}
+	default:
+		err = fmt.Errorf("unsupported algorithm %#02x", alg)
+	}
+	if err != nil {
+		return fmt.Errorf("piv: management key: %w", err)
+	}
+	bs := block.BlockSize()
+
+	// Mutual authentication: decrypt the witness of the card to prove the
+	// key, and have the card encrypt a challenge to prove it in turn.
+	resp, err := c.transmit(insAuthenticate, alg, keyManagementKey, tlv(0x7c, tlv(0x80, nil)))
+	if err != nil {
+		return fmt.Errorf("piv: authenticate: %w", err)
+	}
+	witness, err := dynamicAuth(resp, 0x80, bs)
+	if err != nil {
+		return err
+	}
+	block.Decrypt(witness, witness)
+
+	challenge := make([]byte, bs)
+	if _, err := rand.Read(challenge); err != nil {
+		return err
+	}
+
+	resp, err = c.transmit(insAuthenticate, alg, keyManagementKey, tlv(0x7c, tlv(0x80, witness), tlv(0x81, challenge)))
+	if errors.Is(err, StatusError(0x6982)) {
+		return errors.New("piv: authenticate: wrong management key")
+	}
+	if err != nil {
+		return fmt.Errorf("piv: authenticate: %w", err)
+	}
+	got, err := dynamicAuth(resp, 0x82, bs)
+	if err != nil {
+		return err
+	}
+
+	want := make([]byte, bs)
+	block.Encrypt(want, challenge)
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return errors.New("piv: authenticate: the card does not hold the management key")
+	}
+
+	return nil
+}
+
+// dynamicAuth returns the value of tag in the dynamic authentication
+// template of resp, which must be of size bytes.
+func dynamicAuth(resp []byte, tag uint16, size int) ([]byte, error) {
+	m, err := parseTLV(resp)
+	if err == nil {
+		m, err = parseTLV(m[0x7c])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("piv: authenticate: %w", err)
+	}
+
+	v := m[tag]
+	if len(v) != size {
+		return nil, fmt.Errorf("piv: authenticate: response of %d bytes, want %d", len(v), size)
+	}
+
+	return v, nil
+}
+
+// GenerateKey generates a key of alg in slot, replacing the key the slot
+// held, and returns its public key. The private key cannot be read from
+// the card. It requires Authenticate.
+func (c *Card) GenerateKey(slot Slot, alg Algorithm) (crypto.PublicKey, error) {
+	if _, ok := algorithmNames[alg]; !ok {
+		return nil, fmt.Errorf("piv: unsupported algorithm %v", alg)
+	}
+
+	resp, err := c.transmit(insGenerateKey, 0x00, slot.Key, tlv(0xac, tlv(0x80, []byte{byte(alg)})))
+	if err != nil {
+		return nil, fmt.Errorf("piv: generate key in slot %v: %w", slot, err)
+	}
+
+	m, err := parseTLV(resp)
+	if err == nil {
+		m, err = parseTLV(m[0x7f49])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("piv: generated key: %w", err)
+	}
+
+	switch alg {
+	case RSA2048:
+		n, e := new(big.Int).SetBytes(m[0x81]), new(big.Int).SetBytes(m[0x82])
+		if n.BitLen() != 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("piv: generated key: invalid RSA public key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	default:
+		curve := ecdh.P256()
+		if alg == ECCP384 {
+			curve = ecdh.P384()
+		}
+
+		// Parsing the point with crypto/ecdh checks that it is on the
+		// curve; x509 then gives it as the *ecdsa.PublicKey it signs with.
+		k, err := curve.NewPublicKey(m[0x86])
+		if err != nil {
+			return nil, fmt.Errorf("piv: generated key: %w", err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParsePKIXPublicKey(der)
+	}
+}
+
+// SetCertificate stores crt in slot, replacing the certificate the slot
+// held. It requires Authenticate.
+func (c *Card) SetCertificate(slot Slot, crt *x509.Certificate) error {
+	obj := tlv(0x53, tlv(0x70, crt.Raw), tlv(0x71, []byte{0x00}), tlv(0xfe, nil))
+	if _, err := c.transmit(insPutData, 0x3f, 0xff, append(tlv(0x5c, slot.object()), obj...)); err != nil {
+		return fmt.Errorf("piv: store certificate in slot %v: %w", slot, err)
+	}
+
+	return nil
+}
+
+// Certificate returns the certificate stored in slot, or an error matching
+// ErrNotFound if there is none.
+func (c *Card) Certificate(slot Slot) (*x509.Certificate, error) {
+	resp, err := c.transmit(insGetData, 0x3f, 0xff, tlv(0x5c, slot.object()))
+	if err != nil {
+		return nil, fmt.Errorf("piv: certificate of slot %v: %w", slot, err)
+	}
+
+	m, err := parseTLV(resp)
+	if err == nil {
+		m, err = parseTLV(m[0x53])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("piv: certificate of slot %v: %w", slot, err)
+	}
+
+	if info := m[0x71]; len(info) > 0 && info[0] != 0 {
+		return nil, fmt.Errorf("piv: certificate of slot %v is compressed", slot)
+	}
+
+	return x509.ParseCertificate(m[0x70])
+}
+
+func (s Slot) object() []byte {
+	return []byte{byte(s.Object >> 16), byte(s.Object >> 8), byte(s.Object)}
+}
+
+// maxData is the most data of a short command APDU.
+const maxData = 0xff
+
+// transmit sends a command with data, chaining it over several APDUs if it
+// is too long for one, and returns the data of the response, which the
+// card may give in parts.
+func (c *Card) transmit(ins, p1, p2 byte, data []byte) ([]byte, error) {
+	for len(data) > maxData {
+		apdu := append([]byte{0x10, ins, p1, p2, maxData}, data[:maxData]...)
+		if _, err := c.send(apdu); err != nil {
+			return nil, err
+		}
+		data = data[maxData:]
+	}
+
+	// Without data, the length byte is Le, asking for up to 256 bytes.
+	return c.send(append([]byte{0x00, ins, p1, p2, byte(len(data))}, data...))
+}
+
+// send sends apdu, and asks for the rest of the response while the card
+// has more.
+func (c *Card) send(apdu []byte) ([]byte, error) {
+	var data []byte
+	for {
+		resp, err := c.t.Transmit(apdu)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) < 2 {
+			return nil, errors.New("piv: response without status")
+		}
+
+		n := len(resp) - 2
+		data = append(data, resp[:n]...)
+
+		switch sw := StatusError(binary.BigEndian.Uint16(resp[n:])); {
+		case sw == 0x9000:
+			return data, nil
+		case sw>>8 == 0x61:
+			apdu = []byte{0x00, insGetResponse, 0x00, 0x00, byte(sw)}
+		default:
+			return nil, sw
+		}
+	}
+}
+
+// tlv encodes the BER-TLV of tag, of one or two bytes, and values.
+func tlv(tag uint16, values ...[]byte) []byte {
+	var v []byte
+	for _, value := range values {
+		v = append(v, value...)
+	}
+
+	var b []byte
+	if tag > 0xff {
+		b = append(b, byte(tag>>8))
+	}
+	b = append(b, byte(tag))
+
+	switch n := len(v); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+
+	return append(b, v...)
+}
+
+// parseTLV returns the values of the BER-TLV data objects of data by tag.
+func parseTLV(data []byte) (map[uint16][]byte, error) {
+	m := make(map[uint16][]byte)
+	for len(data) > 0 {
+		tag := uint16(data[0])
+		data = data[1:]
+		if tag&0x1f == 0x1f {
+			if len(data) == 0 {
+				return nil, errors.New("truncated tag")
+			}
+			tag = tag<<8 | uint16(data[0])
+			data = data[1:]
+		}
+
+		if len(data) == 0 {
+			return nil, errors.New("truncated length")
+		}
+		n := int(data[0])
+		data = data[1:]
+		if n >= 0x80 {
+			size := n - 0x80
+			if size == 0 || size > 3 || len(data) < size {
+				return nil, errors.New("invalid length")
+			}
+			n = 0
+			for _, b := range data[:size] {
+				n = n<<8 | int(b)
+			}
+			data = data[size:]
+		}
+
+		if len(data) < n {
+			return nil, errors.New("truncated value")
+		}
+		m[tag] = data[:n:n]
+		data = data[n:]
+	}
+
+	return m, nil
+}
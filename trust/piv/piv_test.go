@@ -0,0 +1,304 @@
+package piv_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+
+	"nih.software/trust/piv"
+	"nih.software/trust/trustgen"
+)
+
+// card simulates the PIV application of a card, as a YubiKey implements
+// it, splitting long responses so that they must be asked for in parts.
+type card struct {
+	alg     byte // of the management key; 0 for cards without metadata
+	key     []byte
+	witness []byte
+	authed  bool
+
+	keys    map[byte]crypto.Signer
+	objects map[string][]byte
+	chained []byte
+	pending []byte
+}
+
+func newCard(alg byte) *card {
+	return &card{
+		alg:     alg,
+		key:     piv.DefaultManagementKey,
+		keys:    make(map[byte]crypto.Signer),
+		objects: make(map[string][]byte),
+	}
+}
+
+func (c *card) block() cipher.Block {
+	if c.alg == 0x0a {
+		b, _ := aes.NewCipher(c.key)
+		return b
+	}
+	b, _ := des.NewTripleDESCipher(c.key)
+	return b
+}
+
+func (c *card) Close() error { return nil }
+
+func (c *card) Transmit(apdu []byte) ([]byte, error) {
+	cla, ins, p1, p2 := apdu[0], apdu[1], apdu[2], apdu[3]
+	if ins == 0xc0 {
+		return c.respond(nil)
+	}
+	if len(apdu) > 5 && len(apdu) != 5+int(apdu[4]) {
+		return sw(0x6700), nil
+	}
+	data := apdu[5:]
+
+	if cla&0x10 != 0 {
+		c.chained = append(c.chained, data...)
+		return sw(0x9000), nil
+	}
+	data = append(c.chained, data...)
+	c.chained = nil
+
+	switch ins {
+	case 0xa4:
+		if !bytes.Equal(data, []byte{0xa0, 0x00, 0x00, 0x03, 0x08}) {
+			return sw(0x6a82), nil
+		}
+		return c.respond(nil)
+
+	case 0xf7:
+		if c.alg == 0 || p2 != 0x9b {
+			return sw(0x6d00), nil
+		}
+		return c.respond([]byte{0x01, 0x01, c.alg})
+
+	case 0x87:
+		if p2 != 0x9b || (c.alg != 0 && p1 != c.alg) || (c.alg == 0 && p1 != 0x03) {
+			return sw(0x6a86), nil
+		}
+		b := c.block()
+		m := parse(parse(data)[0x7c])
+		if w, ok := m[0x80]; ok && len(w) == 0 {
+			c.witness = make([]byte, b.BlockSize())
+			rand.Read(c.witness)
+			enc := make([]byte, b.BlockSize())
+			b.Encrypt(enc, c.witness)
+			return c.respond(append([]byte{0x7c, byte(2 + len(enc)), 0x80, byte(len(enc))}, enc...))
+		}
+		if c.witness == nil || !bytes.Equal(m[0x80], c.witness) {
+			c.witness = nil
+			return sw(0x6982), nil
+		}
+		c.witness, c.authed = nil, true
+		enc := make([]byte, b.BlockSize())
+		b.Encrypt(enc, m[0x81])
+		return c.respond(append([]byte{0x7c, byte(2 + len(enc)), 0x82, byte(len(enc))}, enc...))
+
+	case 0x47:
+		if !c.authed {
+			return sw(0x6982), nil
+		}
+		var key crypto.Signer
+		var pub []byte
+		alg := parse(parse(data)[0xac])[0x80]
+		switch alg[0] {
+		case 0x07:
+			k, _ := rsa.GenerateKey(rand.Reader, 2048)
+			key = k
+			pub = append(tlv(0x81, k.N.Bytes()), tlv(0x82, big.NewInt(int64(k.E)).Bytes())...)
+		case 0x11, 0x14:
+			curve := elliptic.P256()
+			if alg[0] == 0x14 {
+				curve = elliptic.P384()
+			}
+			k, _ := ecdsa.GenerateKey(curve, rand.Reader)
+			ecdh, _ := k.ECDH()
+			key = k
+			pub = tlv(0x86, ecdh.PublicKey().Bytes())
+		default:
+			return sw(0x6a80), nil
+		}
+		c.keys[p2] = key
+		return c.respond(append([]byte{0x7f}, tlv(0x49, pub)...))
+
+	case 0xdb:
+		if !c.authed {
+			return sw(0x6982), nil
+		}
+		m := parse(data)
+		c.objects[string(m[0x5c])] = m[0x53]
+		return c.respond(nil)
+
+	case 0xcb:
+		obj, ok := c.objects[string(parse(data)[0x5c])]
+		if !ok {
+			return sw(0x6a82), nil
+		}
+		return c.respond(tlv(0x53, obj))
+	}
+
+	return sw(0x6d00), nil
+}
+
+// respond gives up to 100 bytes of data, with 61xx while more remain.
+func (c *card) respond(data []byte) ([]byte, error) {
+	if data != nil {
+		c.pending = data
+	}
+	n := min(len(c.pending), 100)
+	resp := append([]byte(nil), c.pending[:n]...)
+	c.pending = c.pending[n:]
+	if len(c.pending) > 0 {
+		return append(resp, 0x61, byte(min(len(c.pending), 0xff))), nil
+	}
+	return append(resp, 0x90, 0x00), nil
+}
+
+func sw(sw uint16) []byte {
+	return []byte{byte(sw >> 8), byte(sw)}
+}
+
+func tlv(tag byte, v []byte) []byte {
+	switch n := len(v); {
+	case n < 0x80:
+		return append([]byte{tag, byte(n)}, v...)
+	case n <= 0xff:
+		return append([]byte{tag, 0x81, byte(n)}, v...)
+	default:
+		return append([]byte{tag, 0x82, byte(n >> 8), byte(n)}, v...)
+	}
+}
+
+// parse parses BER-TLV with tags of one byte.
+func parse(data []byte) map[byte][]byte {
+	m := make(map[byte][]byte)
+	for len(data) >= 2 {
+		tag, n := data[0], int(data[1])
+		data = data[2:]
+		if n > 0x80 {
+			size := n - 0x80
+			n = 0
+			for _, b := range data[:size] {
+				n = n<<8 | int(b)
+			}
+			data = data[size:]
+		}
+		m[tag], data = data[:n], data[n:]
+	}
+	return m
+}
+
+func TestCard(t *testing.T) {
+	root, rootKey, err := trustgen.NewRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := trustgen.NewCA(root, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		alg  byte
+		key  piv.Algorithm
+		slot piv.Slot
+	}{
+		{"3des", 0, piv.ECCP256, piv.SlotAuthentication},
+		{"aes", 0x0a, piv.ECCP384, piv.SlotCardAuthentication},
+		{"rsa", 0x03, piv.RSA2048, piv.SlotSignature},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := newCard(tt.alg)
+			c, err := piv.Open(sim)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, err := c.GenerateKey(tt.slot, tt.key); !errors.Is(err, piv.StatusError(0x6982)) {
+				t.Fatalf("GenerateKey without authentication: %v", err)
+			}
+
+			wrong := bytes.Repeat([]byte{9}, 24)
+			if err := c.Authenticate(wrong); err == nil || !strings.Contains(err.Error(), "wrong management key") {
+				t.Fatalf("Authenticate with a wrong key: %v", err)
+			}
+			if err := c.Authenticate(piv.DefaultManagementKey); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := c.Certificate(tt.slot); !errors.Is(err, piv.ErrNotFound) {
+				t.Fatalf("Certificate of an empty slot: %v", err)
+			}
+
+			pub, err := c.GenerateKey(tt.slot, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k, ok := pub.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(sim.keys[tt.slot.Key].Public()) {
+				t.Fatalf("GenerateKey = %T %v, not the key of the card", pub, pub)
+			}
+
+			crt, err := ca.SignLeaf(pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.SetCertificate(tt.slot, crt); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := c.Certificate(tt.slot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(crt) {
+				t.Fatal("Certificate is not the certificate stored")
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, name := range []string{"9a", "9c", "9d", "9e"} {
+		s, err := piv.ParseSlot(name)
+		if err != nil || s.String() != name {
+			t.Errorf("ParseSlot(%q) = %v, %v", name, s, err)
+		}
+	}
+	if _, err := piv.ParseSlot("82"); err == nil {
+		t.Error("ParseSlot(82) succeeded")
+	}
+
+	for _, name := range []string{"ecdsa-p256", "ecdsa-p384", "rsa-2048"} {
+		a, err := piv.ParseAlgorithm(name)
+		if err != nil || a.String() != name {
+			t.Errorf("ParseAlgorithm(%q) = %v, %v", name, a, err)
+		}
+		if _, err := trustgen.ParseKeyType(name); err != nil {
+			t.Errorf("%s is not a key type of trustgen", name)
+		}
+	}
+	if _, err := piv.ParseAlgorithm("ed25519"); err == nil {
+		t.Error("ParseAlgorithm(ed25519) succeeded")
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	// Without a reader, or a build with PC/SC, OpenReader fails cleanly.
+	if tr, err := piv.OpenReader("no such reader"); err == nil {
+		tr.Close()
+		t.Fatal("OpenReader succeeded")
+	}
+}
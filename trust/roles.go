@@ -0,0 +1,24 @@
+package trust
+
+import (
+	"crypto/x509"
+	"slices"
+)
+
+// Roles returns the roles granted to the holder of certificate c:
+// the organizational units of its subject, such as OU=admin.
+// Roles are chosen by whoever issues the certificate, and services
+// use them to authorize operations beyond membership of the cluster.
+func Roles(c *x509.Certificate) []string {
+	return slices.Clone(c.Subject.OrganizationalUnit)
+}
+
+// HasRole reports whether c grants any of roles.
+func HasRole(c *x509.Certificate, roles ...string) bool {
+	for _, r := range c.Subject.OrganizationalUnit {
+		if slices.Contains(roles, r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package trustgen
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"nih.software/trust"
+)
+
+// CA is a certificate authority that issues certificates under its own.
+type CA struct {
+	// Cert is the CA certificate.
+	Cert *x509.Certificate
+
+	// Key is the private key for Cert.
+	Key crypto.Signer
+
+	// Chain is Cert followed by any intermediates above it, excluding the root.
+	// It is appended to issued certificates by ChainFor.
+	Chain []*x509.Certificate
+
+	opts []Option
+}
+
+// NewCA returns a CA issuing certificates under cert.
+// The options are applied to every certificate the CA issues.
+func NewCA(cert *x509.Certificate, key crypto.Signer, opts ...Option) (*CA, error) {
+	if err := checkCA(cert, key); err != nil {
+		return nil, err
+	}
+
+	ca := CA{
+		Cert:  cert,
+		Key:   key,
+		Chain: []*x509.Certificate{cert},
+		opts:  opts,
+	}
+
+	return &ca, nil
+}
+
+// LoadCA loads a CA from the named PEM-encoded files.
+// The cert file must contain the CA CERTIFICATE block followed by any intermediates above it.
+// The key file must only contain a PRIVATE KEY block.
+func LoadCA(certFile, keyFile string, opts ...Option) (*CA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ParseCA(certPEM, keyPEM, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("trustgen: load CA from %s and %s: %w", certFile, keyFile, err)
+	}
+
+	return ca, nil
+}
+
+// ParseCA parses a CA from PEM-encoded data, as read by LoadCA.
+// certPEM and keyPEM may be the same data, holding both the chain and the key.
+func ParseCA(certPEM, keyPEM []byte, opts ...Option) (*CA, error) {
+	chain, err := trust.ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+
+	key, err := trust.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := NewCA(chain[0], key, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop a self-signed root; peers already have it
+	for _, c := range chain[1:] {
+		if c.CheckSignatureFrom(c) == nil {
+			break
+		}
+		ca.Chain = append(ca.Chain, c)
+	}
+
+	return ca, nil
+}
+
+// NewLeaf generates a leaf certificate issued by the CA, and its key.
+func (ca *CA) NewLeaf(opts ...Option) (*x509.Certificate, crypto.Signer, error) {
+	return NewLeaf(ca.Cert, ca.Key, ca.options(opts)...)
+}
+
+// NewIntermediate generates an intermediate CA issued by the CA.
+func (ca *CA) NewIntermediate(opts ...Option) (*CA, error) {
+	crt, key, err := NewIntermediate(ca.Cert, ca.Key, ca.options(opts)...)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := CA{
+		Cert:  crt,
+		Key:   key,
+		Chain: append([]*x509.Certificate{crt}, ca.Chain...),
+		opts:  ca.opts,
+	}
+
+	return &sub, nil
+}
+
+// NewOCSPSigner generates a delegated OCSP signing certificate issued by the CA, and its key.
+func (ca *CA) NewOCSPSigner(opts ...Option) (*x509.Certificate, crypto.Signer, error) {
+	return NewOCSPSigner(ca.Cert, ca.Key, ca.options(opts)...)
+}
+
+// SignLeaf issues a leaf certificate for an existing public key.
+// It is how to issue for a key kept on hardware such as a PIV card, with
+// package piv, or an HSM: generate the key on the device and pass its
+// public key, so that the private key never leaves the device. The key of the CA may be kept
+// on a device too, as any crypto.Signer.
+func (ca *CA) SignLeaf(pub crypto.PublicKey, opts ...Option) (*x509.Certificate, error) {
+	return createCertificate(leafTemplate(), ca.Cert, pub, ca.Key, newOptions(ca.options(opts)))
+}
+
+// SignIntermediate issues an intermediate CA certificate for an existing public key.
+func (ca *CA) SignIntermediate(pub crypto.PublicKey, opts ...Option) (*x509.Certificate, error) {
+	return createCertificate(intermediateTemplate(), ca.Cert, pub, ca.Key, newOptions(ca.options(opts)))
+}
+
+// ChainFor returns crt followed by the CA's chain,
+// in the order expected by trust.NewBundle.
+func (ca *CA) ChainFor(crt *x509.Certificate) []*x509.Certificate {
+	return append([]*x509.Certificate{crt}, ca.Chain...)
+}
+
+func (ca *CA) options(opts []Option) []Option {
+	return append(ca.opts[:len(ca.opts):len(ca.opts)], opts...)
+}
+
+func checkCA(cert *x509.Certificate, key crypto.Signer) error {
+	if !cert.IsCA {
+		return errors.New("trustgen: not a CA")
+	}
+
+	pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(key.Public()) {
+		return errors.New("trustgen: key does not match certificate")
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package trustgen_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+func TestLoadCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca.key")
+
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	intermed := h.Intermediates[0]
+	certPEM := trustgen.PEMEncodeCertificates(intermed.Cert, h.Root.Cert)
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyPEM := trustgen.PEMEncodePrivateKey(intermed.Key)
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.LoadCA(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ca.Chain) != 1 {
+		t.Fatalf("chain length %d != 1", len(ca.Chain))
+	}
+
+	t.Run("leaf", func(t *testing.T) {
+		crt, key, err := ca.NewLeaf()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := trust.NewBundle(ca.ChainFor(crt), key, h.Roots()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("intermediate", func(t *testing.T) {
+		sub, err := ca.NewIntermediate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crt, key, err := sub.NewLeaf()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := trust.NewBundle(sub.ChainFor(crt), key, h.Roots()); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("combined PEM", func(t *testing.T) {
+		data := append(append([]byte(nil), certPEM...), keyPEM...)
+
+		ca, err := trustgen.ParseCA(data, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !ca.Cert.Equal(intermed.Cert) || len(ca.Chain) != 1 {
+			t.Fatal("wrong CA")
+		}
+	})
+
+	t.Run("key mismatch", func(t *testing.T) {
+		if _, err := trustgen.NewCA(intermed.Cert, h.Root.Key); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("not a CA", func(t *testing.T) {
+		crt, key, err := ca.NewLeaf()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := trustgen.NewCA(crt, key); err == nil {
+			t.Fatal("no error")
+		}
+	})
+}
+
+// deviceSigner signs on a device, here a goroutine holding the key,
+// which the signer itself cannot reach.
+type deviceSigner struct {
+	pub  crypto.PublicKey
+	reqs chan<- deviceRequest
+}
+
+type deviceRequest struct {
+	digest []byte
+	opts   crypto.SignerOpts
+	sig    chan<- []byte
+	err    chan<- error
+}
+
+func newDeviceSigner(t *testing.T) *deviceSigner {
+	key, err := trustgen.GenerateKey(trustgen.ECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := make(chan deviceRequest)
+	t.Cleanup(func() { close(reqs) })
+	go func() {
+		for r := range reqs {
+			sig, err := key.Sign(rand.Reader, r.digest, r.opts)
+			r.sig <- sig
+			r.err <- err
+		}
+	}()
+
+	return &deviceSigner{pub: key.Public(), reqs: reqs}
+}
+
+func (s *deviceSigner) Public() crypto.PublicKey { return s.pub }
+
+func (s *deviceSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	sig, err := make(chan []byte, 1), make(chan error, 1)
+	s.reqs <- deviceRequest{digest, opts, sig, err}
+	return <-sig, <-err
+}
+
+func TestDeviceSigner(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := trustgen.NewCA(h.Root.Cert, h.Root.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a CA whose key is on a device
+	caKey := newDeviceSigner(t)
+	caCert, err := root.SignIntermediate(caKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.NewCA(caCert, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a leaf whose key is on a device
+	key := newDeviceSigner(t)
+	crt, err := ca.SignLeaf(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := trust.NewBundle(ca.ChainFor(crt), key, h.Roots()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,77 @@
+package trustgen
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// NewCSR generates a key and a certificate signing request for it.
+// Subject and subject alternative name options are copied into the request;
+// other options only affect key generation.
+func NewCSR(opts ...Option) (*x509.CertificateRequest, crypto.Signer, error) {
+	o := newOptions(opts)
+	key, err := o.generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var t x509.Certificate
+	o.apply(&t)
+
+	template := x509.CertificateRequest{
+		Subject:     t.Subject,
+		DNSNames:    t.DNSNames,
+		IPAddresses: t.IPAddresses,
+		URIs:        t.URIs,
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return csr, key, nil
+}
+
+// PEMEncodeCertificateRequest PEM-encodes the given request as a CERTIFICATE REQUEST block.
+func PEMEncodeCertificateRequest(csr *x509.CertificateRequest) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csr.Raw,
+	})
+}
+
+// ParseCertificateRequestPEM parses the first CERTIFICATE REQUEST block in data
+// and checks its signature.
+func ParseCertificateRequestPEM(data []byte) (*x509.CertificateRequest, error) {
+	for {
+		var blk *pem.Block
+		blk, data = pem.Decode(data)
+		if blk == nil {
+			return nil, fmt.Errorf("trustgen: no certificate request found")
+		}
+
+		if blk.Type != "CERTIFICATE REQUEST" {
+			continue
+		}
+
+		csr, err := x509.ParseCertificateRequest(blk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := csr.CheckSignature(); err != nil {
+			return nil, fmt.Errorf("trustgen: certificate request: %w", err)
+		}
+
+		return csr, nil
+	}
+}
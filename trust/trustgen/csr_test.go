@@ -0,0 +1,51 @@
+package trustgen_test
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"nih.software/trust"
+	"nih.software/trust/trustgen"
+)
+
+func TestCSR(t *testing.T) {
+	csr, key, err := trustgen.NewCSR(
+		trustgen.WithSubject(pkix.Name{CommonName: "node1"}),
+		trustgen.WithDNSNames("node1.local"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := trustgen.ParseCertificateRequestPEM(trustgen.PEMEncodeCertificateRequest(csr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Subject.CommonName != "node1" {
+		t.Errorf("common name %q != %q", parsed.Subject.CommonName, "node1")
+	}
+
+	rootCert, rootKey, err := trustgen.NewRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := trustgen.NewCA(rootCert, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := ca.SignLeaf(parsed.PublicKey,
+		trustgen.WithSubject(parsed.Subject),
+		trustgen.WithDNSNames(parsed.DNSNames...))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := trust.NewBundle(ca.ChainFor(crt), key, []*x509.Certificate{rootCert}); err != nil {
+		t.Fatal(err)
+	}
+}
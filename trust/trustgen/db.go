@@ -0,0 +1,286 @@
+package trustgen
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DB is a file-backed issuance database.
+// It hands out serial numbers that survive restarts
+// and records the subject and revocation state of every issued certificate.
+type DB struct {
+	name string
+
+	mu   sync.Mutex
+	data dbData
+}
+
+type dbData struct {
+	Serial    int64     `json:"serial"`
+	CRLNumber int64     `json:"crl_number"`
+	Certs     []*Record `json:"certs"`
+}
+
+// Record describes an issued certificate.
+type Record struct {
+	Serial  int64  `json:"serial"`
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer"`
+
+	// IssuerKeyID is the subject key identifier of the issuer, which
+	// tells CAs apart when their subjects do not, as they are empty by
+	// default. Records of older databases have none.
+	IssuerKeyID []byte `json:"issuer_key_id,omitempty"`
+
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	// RevokedAt is the zero time unless the certificate has been revoked.
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    int       `json:"reason,omitempty"`
+}
+
+// IssuedBy reports whether ca issued the certificate, by the key
+// identifier of ca, or by its subject for records without one.
+func (r *Record) IssuedBy(ca *x509.Certificate) bool {
+	if len(r.IssuerKeyID) > 0 {
+		return bytes.Equal(r.IssuerKeyID, ca.SubjectKeyId)
+	}
+	return r.Issuer == ca.Subject.String()
+}
+
+// Revoked reports whether the certificate has been revoked.
+func (r *Record) Revoked() bool {
+	return !r.RevokedAt.IsZero()
+}
+
+// OpenDB opens the issuance database stored in the named file.
+// The file is created on first write if it does not exist.
+func OpenDB(name string) (*DB, error) {
+	db := DB{name: name}
+
+	contents, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &db, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(contents, &db.data); err != nil {
+		return nil, fmt.Errorf("trustgen: open %s: %w", name, err)
+	}
+
+	return &db, nil
+}
+
+// NextSerial reserves and returns the next serial number.
+func (db *DB) NextSerial() (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.data.Serial++
+	if err := db.save(); err != nil {
+		db.data.Serial--
+		return 0, err
+	}
+
+	return db.data.Serial, nil
+}
+
+// Add records an issued certificate.
+func (db *DB) Add(crt *x509.Certificate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if !crt.SerialNumber.IsInt64() {
+		return errors.New("trustgen: serial number out of range")
+	}
+
+	r := Record{
+		Serial:      crt.SerialNumber.Int64(),
+		Subject:     crt.Subject.String(),
+		Issuer:      crt.Issuer.String(),
+		IssuerKeyID: crt.AuthorityKeyId,
+		NotBefore:   crt.NotBefore,
+		NotAfter:    crt.NotAfter,
+	}
+
+	// Self-signed certificates carry no authority key identifier.
+	if len(r.IssuerKeyID) == 0 && bytes.Equal(crt.RawIssuer, crt.RawSubject) && crt.CheckSignatureFrom(crt) == nil {
+		r.IssuerKeyID = crt.SubjectKeyId
+	}
+
+	db.data.Certs = append(db.data.Certs, &r)
+	if err := db.save(); err != nil {
+		db.data.Certs = db.data.Certs[:len(db.data.Certs)-1]
+		return err
+	}
+
+	return nil
+}
+
+// Lookup returns the record for the given serial number, or nil if there is none.
+func (db *DB) Lookup(serial int64) *Record {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, r := range db.data.Certs {
+		if r.Serial == serial {
+			c := *r
+			return &c
+		}
+	}
+
+	return nil
+}
+
+// Records returns a copy of every record, ordered by serial number.
+func (db *DB) Records() []*Record {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rs := make([]*Record, 0, len(db.data.Certs))
+	for _, r := range db.data.Certs {
+		c := *r
+		rs = append(rs, &c)
+	}
+
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].Serial < rs[j].Serial
+	})
+
+	return rs
+}
+
+// Revoke marks the certificate with the given serial number as revoked.
+// The reason is an RFC 5280 CRLReason code.
+func (db *DB) Revoke(serial int64, reason int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, r := range db.data.Certs {
+		if r.Serial != serial {
+			continue
+		}
+
+		if r.Revoked() {
+			return fmt.Errorf("trustgen: serial %d already revoked", serial)
+		}
+
+		r.RevokedAt = time.Now().UTC()
+		r.Reason = reason
+
+		if err := db.save(); err != nil {
+			r.RevokedAt = time.Time{}
+			r.Reason = 0
+			return err
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("trustgen: serial %d not found", serial)
+}
+
+// CRL creates a DER-encoded certificate revocation list signed by ca,
+// listing every revoked certificate issued by ca.
+// The list is valid for the given duration.
+func (db *DB) CRL(ca *x509.Certificate, signer crypto.Signer, validity time.Duration) ([]byte, error) {
+	now := time.Now()
+
+	var entries []x509.RevocationListEntry
+	for _, r := range db.Records() {
+		if !r.Revoked() || !r.IssuedBy(ca) {
+			continue
+		}
+
+		entries = append(entries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(r.Serial),
+			RevocationTime: r.RevokedAt,
+			ReasonCode:     r.Reason,
+		})
+	}
+
+	db.mu.Lock()
+	db.data.CRLNumber++
+	number := db.data.CRLNumber
+	err := db.save()
+	db.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    big.NewInt(number),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+	}
+
+	return x509.CreateRevocationList(nil, &template, ca, signer)
+}
+
+// save writes the database atomically. The caller must hold db.mu.
+func (db *DB) save() error {
+	contents, err := json.MarshalIndent(&db.data, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(db.name), filepath.Base(db.name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), db.name)
+}
+
+// PEMEncodeCRL PEM-encodes a DER-encoded revocation list, as returned by DB.CRL,
+// as an X509 CRL block.
+func PEMEncodeCRL(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "X509 CRL",
+		Bytes: der,
+	})
+}
+
+// ParseCRLPEM parses the first X509 CRL block in data.
+// It does not check the signature, which requires the issuer.
+func ParseCRLPEM(data []byte) (*x509.RevocationList, error) {
+	for {
+		var blk *pem.Block
+		blk, data = pem.Decode(data)
+		if blk == nil {
+			return nil, errors.New("trustgen: no revocation list found")
+		}
+
+		if blk.Type == "X509 CRL" {
+			return x509.ParseRevocationList(blk.Bytes)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package trustgen_test
+
+import (
+	"crypto"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nih.software/trust/trustgen"
+)
+
+func TestDB(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "issued.json")
+
+	db, err := trustgen.OpenDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootCert, rootKey, err := trustgen.NewRoot(trustgen.WithDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafCert, _, err := trustgen.NewLeaf(rootCert, rootKey, trustgen.WithDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := leafCert.SerialNumber.Int64(); n != 2 {
+		t.Fatalf("leaf serial %d != 2", n)
+	}
+
+	// serials survive reopening
+	db, err = trustgen.OpenDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.NextSerial(); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("next serial %d != 3", n)
+	}
+
+	if rs := db.Records(); len(rs) != 2 {
+		t.Fatalf("%d records != 2", len(rs))
+	}
+
+	t.Run("revoke", func(t *testing.T) {
+		if err := db.Revoke(2, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		if r := db.Lookup(2); r == nil || !r.Revoked() {
+			t.Fatal("not revoked")
+		}
+
+		if err := db.Revoke(2, 1); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("revoke unknown", func(t *testing.T) {
+		if err := db.Revoke(42, 0); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("crl", func(t *testing.T) {
+		der, err := db.CRL(rootCert, rootKey, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := crl.CheckSignatureFrom(rootCert); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(crl.RevokedCertificateEntries) != 1 {
+			t.Fatalf("%d entries != 1", len(crl.RevokedCertificateEntries))
+		}
+
+		if n := crl.RevokedCertificateEntries[0].SerialNumber.Int64(); n != 2 {
+			t.Fatalf("revoked serial %d != 2", n)
+		}
+	})
+}
+
+func TestDBIssuers(t *testing.T) {
+	db, err := trustgen.OpenDB(filepath.Join(t.TempDir(), "issued.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the default CAs have no subject, and so the same empty one
+	rootCert, rootKey, err := trustgen.NewRoot(trustgen.WithDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	interCert, interKey, err := trustgen.NewIntermediate(rootCert, rootKey, trustgen.WithDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafCert, _, err := trustgen.NewLeaf(interCert, interKey, trustgen.WithDB(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rootCert.Subject.String() != interCert.Subject.String() {
+		t.Fatalf("subjects %q and %q differ", rootCert.Subject, interCert.Subject)
+	}
+
+	leaf := db.Lookup(leafCert.SerialNumber.Int64())
+	if leaf == nil || !leaf.IssuedBy(interCert) || leaf.IssuedBy(rootCert) {
+		t.Fatalf("leaf record %+v", leaf)
+	}
+	if r := db.Lookup(rootCert.SerialNumber.Int64()); r == nil || !r.IssuedBy(rootCert) || r.IssuedBy(interCert) {
+		t.Fatalf("root record %+v", r)
+	}
+
+	if err := db.Revoke(leafCert.SerialNumber.Int64(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		cert *x509.Certificate
+		key  crypto.Signer
+		want int
+	}{
+		{"root", rootCert, rootKey, 0},
+		{"intermediate", interCert, interKey, 1},
+	} {
+		der, err := db.CRL(tt.cert, tt.key, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(crl.RevokedCertificateEntries); n != tt.want {
+			t.Errorf("%s CRL has %d entries, want %d", tt.name, n, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package trustgen
+
+import (
+	"crypto"
+	"crypto/x509"
+)
+
+// Credentials pairs a certificate with its private key.
+type Credentials struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// HierarchyOptions describes the shape of a generated hierarchy.
+type HierarchyOptions struct {
+	// Intermediates is the number of intermediate CAs between the root and the leaves.
+	// Each intermediate is signed by the one before it; the first is signed by the root.
+	Intermediates int
+
+	// Leaves is the number of leaves issued by the last CA in the hierarchy.
+	Leaves int
+
+	// Options are applied to every generated certificate.
+	Options []Option
+}
+
+// Hierarchy is a root CA, a line of intermediate CAs, and the leaves they issued.
+type Hierarchy struct {
+	Root          Credentials
+	Intermediates []Credentials
+	Leaves        []Credentials
+}
+
+// GenerateHierarchy generates a root, intermediates, and leaves in one call.
+func GenerateHierarchy(opts HierarchyOptions) (*Hierarchy, error) {
+	var h Hierarchy
+	var err error
+
+	h.Root.Cert, h.Root.Key, err = NewRoot(opts.Options...)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := h.Root
+	for range opts.Intermediates {
+		var c Credentials
+		c.Cert, c.Key, err = NewIntermediate(issuer.Cert, issuer.Key, opts.Options...)
+		if err != nil {
+			return nil, err
+		}
+
+		h.Intermediates = append(h.Intermediates, c)
+		issuer = c
+	}
+
+	for range opts.Leaves {
+		var c Credentials
+		c.Cert, c.Key, err = NewLeaf(issuer.Cert, issuer.Key, opts.Options...)
+		if err != nil {
+			return nil, err
+		}
+
+		h.Leaves = append(h.Leaves, c)
+	}
+
+	return &h, nil
+}
+
+// Chain returns the i'th leaf followed by the intermediates,
+// in the order expected by trust.NewBundle.
+func (h *Hierarchy) Chain(i int) []*x509.Certificate {
+	chain := []*x509.Certificate{h.Leaves[i].Cert}
+	for j := len(h.Intermediates) - 1; j >= 0; j-- {
+		chain = append(chain, h.Intermediates[j].Cert)
+	}
+
+	return chain
+}
+
+// Roots returns the root certificate in a slice, as expected by trust.NewBundle.
+func (h *Hierarchy) Roots() []*x509.Certificate {
+	return []*x509.Certificate{h.Root.Cert}
+}
@@ -0,0 +1,72 @@
+package trustgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+)
+
+// KeyType selects the algorithm of a generated key.
+type KeyType int
+
+const (
+	Ed25519 KeyType = iota
+	ECDSAP256
+	ECDSAP384
+	RSA2048
+	RSA4096
+)
+
+var keyTypeNames = map[KeyType]string{
+	Ed25519:   "ed25519",
+	ECDSAP256: "ecdsa-p256",
+	ECDSAP384: "ecdsa-p384",
+	RSA2048:   "rsa-2048",
+	RSA4096:   "rsa-4096",
+}
+
+func (t KeyType) String() string {
+	if name, ok := keyTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("KeyType(%d)", int(t))
+}
+
+// ParseKeyType returns the key type with the given name, as returned by KeyType.String.
+func ParseKeyType(name string) (KeyType, error) {
+	for t, n := range keyTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("trustgen: unknown key type %q", name)
+}
+
+// GenerateKey generates a private key of the given type.
+func GenerateKey(t KeyType) (crypto.Signer, error) {
+	switch t {
+	case Ed25519:
+		_, key, err := ed25519.GenerateKey(nil)
+		return key, err
+
+	case ECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	case ECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+
+	default:
+		return nil, fmt.Errorf("trustgen: unknown key type %v", t)
+	}
+}
@@ -0,0 +1,111 @@
+package trustgen
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"time"
+)
+
+// An Option configures how a certificate is generated.
+type Option func(*options)
+
+type options struct {
+	db       *DB
+	keyType  *KeyType
+	webPKI   bool
+	template []func(*x509.Certificate)
+}
+
+func newOptions(opts []Option) *options {
+	o := new(options)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *options) generateKey() (crypto.Signer, error) {
+	switch {
+	case o.keyType != nil:
+		return GenerateKey(*o.keyType)
+
+	case o.webPKI:
+		return GenerateKey(ECDSAP256)
+
+	default:
+		return GenerateKey(Ed25519)
+	}
+}
+
+func (o *options) apply(template *x509.Certificate) {
+	for _, f := range o.template {
+		f(template)
+	}
+}
+
+// WithDB draws serial numbers from db and records the issued certificate in it.
+func WithDB(db *DB) Option {
+	return func(o *options) {
+		o.db = db
+	}
+}
+
+// WithValidity overrides the validity period of the certificate.
+func WithValidity(notBefore, notAfter time.Time) Option {
+	return WithTemplate(func(c *x509.Certificate) {
+		c.NotBefore = notBefore
+		c.NotAfter = notAfter
+	})
+}
+
+// WithExtKeyUsage overrides the extended key usage of the certificate.
+func WithExtKeyUsage(usage ...x509.ExtKeyUsage) Option {
+	return WithTemplate(func(c *x509.Certificate) {
+		c.ExtKeyUsage = usage
+	})
+}
+
+// WithTemplate calls f to modify the certificate template before it is signed.
+// Changes to the serial number are overwritten.
+func WithTemplate(f func(*x509.Certificate)) Option {
+	return func(o *options) {
+		o.template = append(o.template, f)
+	}
+}
+
+// WithKeyType selects the algorithm of the generated key. The default is Ed25519.
+func WithKeyType(t KeyType) Option {
+	return func(o *options) {
+		o.keyType = &t
+	}
+}
+
+// WithSubject sets the subject name of the certificate.
+func WithSubject(name pkix.Name) Option {
+	return WithTemplate(func(c *x509.Certificate) {
+		c.Subject = name
+	})
+}
+
+// WithDNSNames adds DNS subject alternative names to the certificate.
+func WithDNSNames(names ...string) Option {
+	return WithTemplate(func(c *x509.Certificate) {
+		c.DNSNames = append(c.DNSNames, names...)
+	})
+}
+
+// WithIPAddresses adds IP address subject alternative names to the certificate.
+func WithIPAddresses(ips ...net.IP) Option {
+	return WithTemplate(func(c *x509.Certificate) {
+		c.IPAddresses = append(c.IPAddresses, ips...)
+	})
+}
+
+// WithLifetime sets the validity period of the certificate to d, starting now.
+func WithLifetime(d time.Duration) Option {
+	return WithTemplate(func(c *x509.Certificate) {
+		c.NotAfter = c.NotBefore.Add(d)
+	})
+}
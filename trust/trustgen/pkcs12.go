@@ -0,0 +1,294 @@
+package trustgen
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+
+	"nih.software/trust/internal/pkcs8"
+)
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidCertBag         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidShroudedKeyBag  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidLocalKeyID      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidFriendlyName    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+)
+
+const (
+	pkcs12MACIterations = 10_000
+
+	// diversifier selecting MAC key material in pkcs12KDF
+	pkcs12MACKeyID = 3
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MACData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type macData struct {
+	MAC        digestInfo
+	Salt       []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"explicit,tag:0"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID     asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"explicit,tag:0"`
+}
+
+// EncodePKCS12 encodes a leaf certificate, its key, and the rest of its chain as a PKCS #12 file,
+// protected by password. The key is encrypted with AES-256-CBC and PBKDF2,
+// and the file is authenticated with HMAC-SHA256, as OpenSSL 3 does by default.
+func EncodePKCS12(leaf *x509.Certificate, key crypto.Signer, chain []*x509.Certificate, password string) ([]byte, error) {
+	localKeyID := leaf.SubjectKeyId
+	if len(localKeyID) == 0 {
+		id, err := subjectKeyID(leaf.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		localKeyID = id
+	}
+
+	keyAttrs, err := bagAttributes(localKeyID, leaf.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	for i, c := range append([]*x509.Certificate{leaf}, chain...) {
+		bag, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: c.Raw})
+		if err != nil {
+			return nil, err
+		}
+
+		sb := safeBag{ID: oidCertBag, Value: asn1.RawValue{FullBytes: explicit0(bag)}}
+		if i == 0 {
+			sb.Attributes = keyAttrs
+		}
+
+		certBags = append(certBags, sb)
+	}
+
+	plainKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	shrouded, err := pkcs8.Encrypt(plainKey, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	keyBags := []safeBag{{
+		ID:         oidShroudedKeyBag,
+		Value:      asn1.RawValue{FullBytes: explicit0(shrouded)},
+		Attributes: keyAttrs,
+	}}
+
+	var safes []contentInfo
+	for _, bags := range [][]safeBag{certBags, keyBags} {
+		ci, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		safes = append(safes, ci)
+	}
+
+	authSafe, err := asn1.Marshal(safes)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	macKey := pkcs12KDF(sha256.New, bmpString(password), salt, pkcs12MACIterations, pkcs12MACKeyID, sha256.Size)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(authSafe)
+
+	content, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pfx{
+		Version: 3,
+		AuthSafe: contentInfo{
+			ContentType: oidData,
+			Content:     asn1.RawValue{FullBytes: explicit0(content)},
+		},
+		MACData: macData{
+			MAC: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			Salt:       salt,
+			Iterations: pkcs12MACIterations,
+		},
+	})
+}
+
+func dataContentInfo(bags []safeBag) (contentInfo, error) {
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	octets, err := asn1.Marshal(safeContents)
+	if err != nil {
+		return contentInfo{}, err
+	}
+
+	ci := contentInfo{
+		ContentType: oidData,
+		Content:     asn1.RawValue{FullBytes: explicit0(octets)},
+	}
+
+	return ci, nil
+}
+
+func bagAttributes(localKeyID []byte, friendlyName string) ([]pkcs12Attribute, error) {
+	id, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []pkcs12Attribute{{ID: oidLocalKeyID, Values: asn1.RawValue{FullBytes: set(id)}}}
+
+	if friendlyName != "" {
+		name := bmpString(friendlyName)
+		name = name[:len(name)-2]
+		der, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Bytes: name})
+		if err != nil {
+			return nil, err
+		}
+
+		attrs = append(attrs, pkcs12Attribute{ID: oidFriendlyName, Values: asn1.RawValue{FullBytes: set(der)}})
+	}
+
+	return attrs, nil
+}
+
+// explicit0 wraps DER in an [0] EXPLICIT tag.
+func explicit0(der []byte) []byte {
+	return wrap(0xa0, der)
+}
+
+// set wraps DER in a SET.
+func set(der []byte) []byte {
+	return wrap(0x31, der)
+}
+
+func wrap(tag byte, der []byte) []byte {
+	out, err := asn1.Marshal(asn1.RawValue{
+		Class:      int(tag >> 6),
+		Tag:        int(tag & 0x1f),
+		IsCompound: tag&0x20 != 0,
+		Bytes:      der,
+	})
+
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// bmpString encodes s as a NUL-terminated UTF-16 big-endian string, as PKCS #12 passwords are.
+func bmpString(s string) []byte {
+	var out []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		out = append(out, byte(r>>8), byte(r))
+	}
+	return append(out, 0, 0)
+}
+
+// pkcs12KDF derives key material as described in RFC 7292, appendix B.2.
+func pkcs12KDF(h func() hash.Hash, password, salt []byte, iter int, id byte, size int) []byte {
+	hh := h()
+	u, v := hh.Size(), hh.BlockSize()
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	d := make([]byte, v)
+	for i := range d {
+		d[i] = id
+	}
+
+	I := append(fill(salt), fill(password)...)
+	one := big.NewInt(1)
+	mod := new(big.Int).Lsh(one, uint(v*8))
+
+	var out []byte
+	for len(out) < size {
+		hh.Reset()
+		hh.Write(d)
+		hh.Write(I)
+		a := hh.Sum(nil)
+		for range iter - 1 {
+			hh.Reset()
+			hh.Write(a)
+			a = hh.Sum(a[:0])
+		}
+		out = append(out, a...)
+
+		if len(out) >= size {
+			break
+		}
+
+		b := new(big.Int).SetBytes(fill(a[:u])[:v])
+		for j := 0; j < len(I); j += v {
+			n := new(big.Int).SetBytes(I[j : j+v])
+			n.Add(n, b).Add(n, one).Mod(n, mod)
+			nb := n.Bytes()
+			clear(I[j : j+v])
+			copy(I[j+v-len(nb):j+v], nb)
+		}
+	}
+
+	return out[:size]
+}
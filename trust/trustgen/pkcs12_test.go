@@ -0,0 +1,162 @@
+package trustgen_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"testing"
+	"unicode/utf16"
+
+	"nih.software/trust/internal/pkcs8"
+	"nih.software/trust/trustgen"
+)
+
+var oidShroudedKeyBag = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+
+type testPFX struct {
+	Version  int
+	AuthSafe struct {
+		ContentType asn1.ObjectIdentifier
+		Content     []byte `asn1:"explicit,tag:0"`
+	}
+	MACData struct {
+		MAC struct {
+			Algorithm asn1.RawValue
+			Digest    []byte
+		}
+		Salt       []byte
+		Iterations int
+	}
+}
+
+type testSafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"explicit,tag:0"`
+	Attributes asn1.RawValue `asn1:"optional"`
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 1,
+		Leaves:        1,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := trustgen.EncodePKCS12(h.Leaves[0].Cert, h.Leaves[0].Key, h.Chain(0)[1:], "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pfx testPFX
+	if _, err := asn1.Unmarshal(der, &pfx); err != nil {
+		t.Fatal(err)
+	}
+
+	if pfx.Version != 3 {
+		t.Fatalf("version %d != 3", pfx.Version)
+	}
+
+	// certificates are stored unencrypted
+	for _, c := range h.Chain(0) {
+		if !bytes.Contains(pfx.AuthSafe.Content, c.Raw) {
+			t.Errorf("serial %v: certificate missing", c.SerialNumber)
+		}
+	}
+
+	want, err := x509.MarshalPKCS8PrivateKey(h.Leaves[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("password", func(t *testing.T) {
+		if !pkcs12MACValid(&pfx, "hunter2") {
+			t.Fatal("MAC invalid")
+		}
+
+		key, err := pkcs8.Decrypt(shroudedKey(t, &pfx), []byte("hunter2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(key, want) {
+			t.Fatal("decrypted key differs")
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		if pkcs12MACValid(&pfx, "hunter3") {
+			t.Fatal("MAC valid")
+		}
+
+		// the padding may happen to be valid, but not the key
+		key, err := pkcs8.Decrypt(shroudedKey(t, &pfx), []byte("hunter3"))
+		if err == nil && bytes.Equal(key, want) {
+			t.Fatal("key decrypted")
+		}
+	})
+}
+
+// pkcs12MACValid reports whether the HMAC-SHA256 of pfx is valid for
+// password, deriving its key as in RFC 7292, appendix B.2, which takes a
+// single round for a key of the size of the hash.
+func pkcs12MACValid(pfx *testPFX, password string) bool {
+	var pw []byte
+	for _, r := range utf16.Encode([]rune(password)) {
+		pw = append(pw, byte(r>>8), byte(r))
+	}
+	pw = append(pw, 0, 0)
+
+	fill := func(b []byte) []byte {
+		out := make([]byte, 64*((len(b)+63)/64))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	a := append(bytes.Repeat([]byte{3}, 64), fill(pfx.MACData.Salt)...)
+	a = append(a, fill(pw)...)
+	for range pfx.MACData.Iterations {
+		sum := sha256.Sum256(a)
+		a = sum[:]
+	}
+
+	mac := hmac.New(sha256.New, a)
+	mac.Write(pfx.AuthSafe.Content)
+	return hmac.Equal(mac.Sum(nil), pfx.MACData.MAC.Digest)
+}
+
+// shroudedKey returns the EncryptedPrivateKeyInfo of the key bag of pfx.
+func shroudedKey(t *testing.T, pfx *testPFX) []byte {
+	t.Helper()
+
+	var safes []struct {
+		ContentType asn1.ObjectIdentifier
+		Content     []byte `asn1:"explicit,tag:0"`
+	}
+
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content, &safes); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, safe := range safes {
+		var bags []testSafeBag
+		if _, err := asn1.Unmarshal(safe.Content, &bags); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, bag := range bags {
+			if bag.ID.Equal(oidShroudedKeyBag) {
+				return bag.Value.Bytes
+			}
+		}
+	}
+
+	t.Fatal("no shrouded key bag")
+	return nil
+}
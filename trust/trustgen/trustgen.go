@@ -4,32 +4,30 @@ package trustgen
 import (
 	"bytes"
 	"crypto"
-	"crypto/ed25519"
+	"crypto/sha1"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"math/big"
 	"sync/atomic"
 	"time"
+
+	"nih.software/trust/internal/pkcs8"
 )
 
 var serial = new(atomic.Int64)
 
-func NewRoot() (*x509.Certificate, crypto.Signer, error) {
-	_, key, err := ed25519.GenerateKey(nil)
+// NewRoot generates a self-signed root CA certificate and its key.
+func NewRoot(opts ...Option) (*x509.Certificate, crypto.Signer, error) {
+	o := newOptions(opts)
+	key, err := o.generateKey()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	now := time.Now()
-	template := x509.Certificate{
-		NotBefore:             now,
-		NotAfter:              now.AddDate(10, 0, 0),
-		KeyUsage:              x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-		IsCA:                  true,
-	}
-
-	crt, err := createCertificate(&template, &template, key.Public(), key)
+	template := rootTemplate()
+	crt, err := createCertificate(template, template, key.Public(), key, o)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -37,22 +35,31 @@ func NewRoot() (*x509.Certificate, crypto.Signer, error) {
 	return crt, key, nil
 }
 
-func NewIntermediate(ca *x509.Certificate, signer crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
-	_, key, err := ed25519.GenerateKey(nil)
+// NewIntermediate generates an intermediate CA certificate signed by ca, and its key.
+func NewIntermediate(ca *x509.Certificate, signer crypto.Signer, opts ...Option) (*x509.Certificate, crypto.Signer, error) {
+	o := newOptions(opts)
+	key, err := o.generateKey()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	now := time.Now()
-	template := x509.Certificate{
-		NotBefore:             now,
-		NotAfter:              now.AddDate(5, 0, 0),
-		KeyUsage:              x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-		IsCA:                  true,
+	crt, err := createCertificate(intermediateTemplate(), ca, key.Public(), signer, o)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	crt, err := createCertificate(&template, ca, key.Public(), signer)
+	return crt, key, nil
+}
+
+// NewLeaf generates a leaf certificate signed by ca, and its key.
+func NewLeaf(ca *x509.Certificate, signer crypto.Signer, opts ...Option) (*x509.Certificate, crypto.Signer, error) {
+	o := newOptions(opts)
+	key, err := o.generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crt, err := createCertificate(leafTemplate(), ca, key.Public(), signer, o)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -60,14 +67,49 @@ func NewIntermediate(ca *x509.Certificate, signer crypto.Signer) (*x509.Certific
 	return crt, key, nil
 }
 
-func NewLeaf(ca *x509.Certificate, signer crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
-	_, key, err := ed25519.GenerateKey(nil)
+// NewOCSPSigner generates a delegated OCSP signing certificate issued by ca, and its key.
+// The certificate carries the id-pkix-ocsp-nocheck extension,
+// so clients do not check its own revocation status.
+func NewOCSPSigner(ca *x509.Certificate, signer crypto.Signer, opts ...Option) (*x509.Certificate, crypto.Signer, error) {
+	o := newOptions(opts)
+	key, err := o.generateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crt, err := createCertificate(ocspTemplate(), ca, key.Public(), signer, o)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	return crt, key, nil
+}
+
+func rootTemplate() *x509.Certificate {
+	now := time.Now()
+	return &x509.Certificate{
+		NotBefore:             now,
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+}
+
+func intermediateTemplate() *x509.Certificate {
+	now := time.Now()
+	return &x509.Certificate{
+		NotBefore:             now,
+		NotAfter:              now.AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+}
+
+func leafTemplate() *x509.Certificate {
 	now := time.Now()
-	template := x509.Certificate{
+	return &x509.Certificate{
 		NotBefore: now,
 		NotAfter:  now.AddDate(1, 0, 0),
 		KeyUsage:  x509.KeyUsageDigitalSignature,
@@ -79,13 +121,6 @@ func NewLeaf(ca *x509.Certificate, signer crypto.Signer) (*x509.Certificate, cry
 
 		BasicConstraintsValid: true,
 	}
-
-	crt, err := createCertificate(&template, ca, key.Public(), signer)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	return crt, key, nil
 }
 
 // PEMEncodeCertificates PEM-encodes the given certificates as CERTIFICATE blocks.
@@ -121,12 +156,110 @@ func PEMEncodePrivateKey(key crypto.Signer) []byte {
 	})
 }
 
-func createCertificate(template *x509.Certificate, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer) (*x509.Certificate, error) {
-	template.SerialNumber = big.NewInt(serial.Add(1))
+// PEMEncodePrivateKeyEncrypted PEM-encodes the given key as an ENCRYPTED PRIVATE KEY block.
+// The block contains the key in PKCS #8, ASN.1 DER form,
+// encrypted with AES-256-CBC under a key derived from passphrase with PBKDF2.
+func PEMEncodePrivateKeyEncrypted(key crypto.Signer, passphrase []byte) []byte {
+	plain, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	bytes, err := pkcs8.Encrypt(plain, passphrase)
+	if err != nil {
+		panic(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "ENCRYPTED PRIVATE KEY",
+		Bytes: bytes,
+	})
+}
+
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+func ocspTemplate() *x509.Certificate {
+	now := time.Now()
+	return &x509.Certificate{
+		NotBefore:   now,
+		NotAfter:    now.AddDate(0, 3, 0),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+
+		// NULL
+		ExtraExtensions: []pkix.Extension{{Id: oidOCSPNoCheck, Value: []byte{0x05, 0x00}}},
+
+		BasicConstraintsValid: true,
+	}
+}
+
+func createCertificate(template *x509.Certificate, parent *x509.Certificate, pub crypto.PublicKey, priv crypto.Signer, o *options) (*x509.Certificate, error) {
+	o.apply(template)
+
+	if len(template.SubjectKeyId) == 0 {
+		id, err := subjectKeyID(pub)
+		if err != nil {
+			return nil, err
+		}
+		template.SubjectKeyId = id
+	}
+
+	// x509 only sets this itself when the issuer and subject names differ
+	if template != parent && len(template.AuthorityKeyId) == 0 {
+		template.AuthorityKeyId = parent.SubjectKeyId
+	}
+
+	if o.webPKI {
+		if err := prepareWebPKI(template, parent, pub, priv.Public()); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.db != nil {
+		n, err := o.db.NextSerial()
+		if err != nil {
+			return nil, err
+		}
+		template.SerialNumber = big.NewInt(n)
+	} else {
+		template.SerialNumber = big.NewInt(serial.Add(1))
+	}
+
 	der, err := x509.CreateCertificate(nil, template, parent, pub, priv)
 	if err != nil {
 		return nil, err
 	}
 
-	return x509.ParseCertificate(der)
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.db != nil {
+		if err := o.db.Add(crt); err != nil {
+			return nil, err
+		}
+	}
+
+	return crt, nil
+}
+
+// subjectKeyID computes a key identifier as described in RFC 5280, section 4.2.1.2, method (1).
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+
+	id := sha1.Sum(spki.PublicKey.Bytes)
+	return id[:], nil
 }
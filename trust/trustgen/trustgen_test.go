@@ -1,6 +1,7 @@
 package trustgen_test
 
 import (
+	"bytes"
 	"crypto/x509"
 	"encoding/pem"
 	"testing"
@@ -81,3 +82,38 @@ func TestPEMEncode(t *testing.T) {
 		t.Fatal("leftover key PEM")
 	}
 }
+
+func TestGenerateHierarchy(t *testing.T) {
+	h, err := trustgen.GenerateHierarchy(trustgen.HierarchyOptions{
+		Intermediates: 2,
+		Leaves:        3,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.Intermediates) != 2 {
+		t.Fatalf("%d intermediates != 2", len(h.Intermediates))
+	}
+
+	if len(h.Leaves) != 3 {
+		t.Fatalf("%d leaves != 3", len(h.Leaves))
+	}
+
+	for _, c := range []*x509.Certificate{h.Root.Cert, h.Intermediates[0].Cert, h.Leaves[0].Cert} {
+		if len(c.SubjectKeyId) == 0 {
+			t.Errorf("serial %v: no subject key identifier", c.SerialNumber)
+		}
+	}
+
+	if !bytes.Equal(h.Leaves[0].Cert.AuthorityKeyId, h.Intermediates[1].Cert.SubjectKeyId) {
+		t.Error("leaf authority key identifier does not match issuer")
+	}
+
+	for i := range h.Leaves {
+		if _, err := trust.NewBundle(h.Chain(i), h.Leaves[i].Key, h.Roots()); err != nil {
+			t.Fatalf("leaf %d: %v", i, err)
+		}
+	}
+}
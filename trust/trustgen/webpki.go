@@ -0,0 +1,89 @@
+package trustgen
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxWebPKILeafLifetime is the longest leaf lifetime accepted by browsers.
+const MaxWebPKILeafLifetime = 398 * 24 * time.Hour
+
+// WithWebPKI enforces the constraints browsers place on public-web certificates,
+// so the generated credentials can be used for local HTTPS development:
+// leaves must have at least one subject alternative name and a lifetime of at most 398 days,
+// keys, of the certificate and of the CA signing it, must be ECDSA on
+// P-256, P-384, or P-521, or RSA of at least 2048 bits (ECDSA P-256 is
+// generated unless WithKeyType is given), and CAs get a default subject name.
+func WithWebPKI() Option {
+	return func(o *options) {
+		o.webPKI = true
+	}
+}
+
+func prepareWebPKI(c, parent *x509.Certificate, pub, issuer crypto.PublicKey) error {
+	// RFC 5280 requires a non-empty issuer name
+	if c.IsCA && c.Subject.String() == "" {
+		c.Subject.CommonName = "nih dev intermediate CA"
+		if c == parent {
+			c.Subject.CommonName = "nih dev root CA"
+		}
+	}
+
+	return checkWebPKI(c, pub, issuer)
+}
+
+func checkWebPKI(c *x509.Certificate, pub, issuer crypto.PublicKey) error {
+	if err := checkWebPKIKey(pub); err != nil {
+		return fmt.Errorf("trustgen: web PKI: %w", err)
+	}
+
+	if err := checkWebPKIKey(issuer); err != nil {
+		return fmt.Errorf("trustgen: web PKI: issuer: %w", err)
+	}
+
+	if c.IsCA {
+		return nil
+	}
+
+	if c.NotAfter.Sub(c.NotBefore) > MaxWebPKILeafLifetime {
+		return errors.New("trustgen: web PKI: leaf lifetime exceeds 398 days")
+	}
+
+	if len(c.DNSNames) == 0 && len(c.IPAddresses) == 0 {
+		return errors.New("trustgen: web PKI: leaf has no subject alternative names")
+	}
+
+	return nil
+}
+
+// checkWebPKIKey checks pub is of a type and size the baseline
+// requirements allow.
+func checkWebPKIKey(pub crypto.PublicKey) error {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return nil
+		}
+		return fmt.Errorf("ECDSA curve %s is not supported by browsers", k.Curve.Params().Name)
+
+	case *rsa.PublicKey:
+		if n := k.N.BitLen(); n < 2048 || n%8 != 0 {
+			return fmt.Errorf("RSA keys of %d bits are not supported by browsers", n)
+		}
+		return nil
+
+	case ed25519.PublicKey:
+		return errors.New("Ed25519 keys are not supported by browsers")
+
+	default:
+		return fmt.Errorf("%T keys are not supported by browsers", pub)
+	}
+}
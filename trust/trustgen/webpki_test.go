@@ -0,0 +1,99 @@
+package trustgen_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	"nih.software/trust/trustgen"
+)
+
+func TestWebPKI(t *testing.T) {
+	rootCert, rootKey, err := trustgen.NewRoot(trustgen.WithWebPKI())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rootCert.Subject.CommonName == "" {
+		t.Error("root has no subject")
+	}
+
+	t.Run("good", func(t *testing.T) {
+		leafCert, leafKey, err := trustgen.NewLeaf(rootCert, rootKey,
+			trustgen.WithWebPKI(),
+			trustgen.WithDNSNames("localhost"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := leafKey.(*ecdsa.PrivateKey); !ok {
+			t.Errorf("key type %T is not ECDSA", leafKey)
+		}
+
+		if len(leafCert.SubjectKeyId) == 0 {
+			t.Error("no subject key identifier")
+		}
+
+		if string(leafCert.AuthorityKeyId) != string(rootCert.SubjectKeyId) {
+			t.Error("authority key identifier does not match root")
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(rootCert)
+
+		_, err = leafCert.Verify(x509.VerifyOptions{
+			DNSName: "localhost",
+			Roots:   roots,
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("no SAN", func(t *testing.T) {
+		if _, _, err := trustgen.NewLeaf(rootCert, rootKey, trustgen.WithWebPKI()); err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("lifetime", func(t *testing.T) {
+		_, _, err := trustgen.NewLeaf(rootCert, rootKey,
+			trustgen.WithWebPKI(),
+			trustgen.WithDNSNames("localhost"),
+			trustgen.WithLifetime(400*24*time.Hour))
+
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		_, _, err := trustgen.NewLeaf(rootCert, rootKey,
+			trustgen.WithWebPKI(),
+			trustgen.WithDNSNames("localhost"),
+			trustgen.WithKeyType(trustgen.Ed25519))
+
+		if err == nil {
+			t.Fatal("no error")
+		}
+	})
+
+	t.Run("Ed25519 issuer", func(t *testing.T) {
+		edCert, edKey, err := trustgen.NewRoot(trustgen.WithKeyType(trustgen.Ed25519))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = trustgen.NewLeaf(edCert, edKey,
+			trustgen.WithWebPKI(),
+			trustgen.WithDNSNames("localhost"))
+
+		if err == nil || !strings.Contains(err.Error(), "issuer") {
+			t.Fatalf("err = %v, want an error of the issuer key", err)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+// Package trusttest generates validly signed but otherwise unacceptable credentials
+// for exercising the verification failure paths of the trust package.
+package trusttest
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/x509"
+	"math/big"
+	"time"
+
+	"nih.software/trust/trustgen"
+)
+
+// Expired issues a leaf under ca that expired an hour ago.
+func Expired(ca *trustgen.CA) (*x509.Certificate, crypto.Signer, error) {
+	now := time.Now()
+	return ca.NewLeaf(trustgen.WithValidity(now.Add(-48*time.Hour), now.Add(-time.Hour)))
+}
+
+// NotYetValid issues a leaf under ca that becomes valid in an hour.
+func NotYetValid(ca *trustgen.CA) (*x509.Certificate, crypto.Signer, error) {
+	now := time.Now()
+	return ca.NewLeaf(trustgen.WithValidity(now.Add(time.Hour), now.Add(48*time.Hour)))
+}
+
+// WrongEKU issues a leaf under ca that is only valid for client authentication.
+func WrongEKU(ca *trustgen.CA) (*x509.Certificate, crypto.Signer, error) {
+	return ca.NewLeaf(trustgen.WithExtKeyUsage(x509.ExtKeyUsageClientAuth))
+}
+
+// UnknownIssuer issues a leaf under a freshly generated, untrusted root.
+func UnknownIssuer() (*x509.Certificate, crypto.Signer, error) {
+	rootCert, rootKey, err := trustgen.NewRoot()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return trustgen.NewLeaf(rootCert, rootKey)
+}
+
+// SelfSignedLeaf generates a leaf certificate signed by its own key.
+func SelfSignedLeaf() (*x509.Certificate, crypto.Signer, error) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    now,
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageServerAuth,
+		},
+
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(nil, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return crt, key, nil
+}
@@ -0,0 +1,358 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+var errTruncated = errors.New("wire: unexpected end of data")
+
+// A decoder decodes values from the front of data.
+type decoder struct {
+	data  []byte
+	depth int
+}
+
+func (d *decoder) decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("wire: cannot decode into %T", v)
+	}
+	return d.value(rv.Elem())
+}
+
+func (d *decoder) value(v reflect.Value) error {
+	if v.Type() == timeType {
+		return d.time(v)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.byte()
+		if err != nil {
+			return err
+		}
+		if b > 1 {
+			return fmt.Errorf("wire: invalid bool %d", b)
+		}
+		v.SetBool(b == 1)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := d.varint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(x) {
+			return fmt.Errorf("wire: %d overflows %s", x, v.Type())
+		}
+		v.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(x) {
+			return fmt.Errorf("wire: %d overflows %s", x, v.Type())
+		}
+		v.SetUint(x)
+	case reflect.Float32, reflect.Float64:
+		if len(d.data) < 8 {
+			return errTruncated
+		}
+		bits := binary.BigEndian.Uint64(d.data)
+		d.data = d.data[8:]
+		f := math.Float64frombits(bits)
+		if v.Kind() == reflect.Float32 && math.Float64bits(float64(float32(f))) != bits {
+			return fmt.Errorf("wire: %v overflows %s", f, v.Type())
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			if len(b) == 0 {
+				v.SetZero()
+			} else {
+				v.SetBytes(bytes.Clone(b))
+			}
+			return nil
+		}
+		return d.slice(v)
+	case reflect.Array:
+		return d.array(v)
+	case reflect.Map:
+		return d.mapping(v)
+	case reflect.Pointer:
+		b, err := d.byte()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case 0:
+			v.SetZero()
+			return nil
+		case 1:
+		default:
+			return fmt.Errorf("wire: invalid pointer tag %d", b)
+		}
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+		p := reflect.New(v.Type().Elem())
+		if err := d.value(p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Struct:
+		return d.structure(v)
+	default:
+		return fmt.Errorf("wire: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (d *decoder) enter() error {
+	if d.depth >= maxDepth {
+		return errors.New("wire: value nested too deeply")
+	}
+	d.depth++
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+func (d *decoder) byte() (byte, error) {
+	if len(d.data) == 0 {
+		return 0, errTruncated
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b, nil
+}
+
+// uvarint decodes a varint, which must be of the fewest bytes encoding its
+// value.
+func (d *decoder) uvarint() (uint64, error) {
+	x, n := binary.Uvarint(d.data)
+	switch {
+	case n == 0:
+		return 0, errTruncated
+	case n < 0:
+		return 0, errors.New("wire: varint overflows 64 bits")
+	case n > 1 && d.data[n-1] == 0:
+		return 0, errors.New("wire: non-canonical varint")
+	}
+	d.data = d.data[n:]
+	return x, nil
+}
+
+func (d *decoder) varint() (int64, error) {
+	ux, err := d.uvarint()
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x, err
+}
+
+// count decodes the number of elements of a sequence, each of which takes
+// at least a byte, so that a count larger than the data left is malformed.
+func (d *decoder) count() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.data)) {
+		return 0, errTruncated
+	}
+	return int(n), nil
+}
+
+// bytes decodes a length followed by as many bytes, which it returns without
+// copying.
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *decoder) time(v reflect.Value) error {
+	sec, err := d.varint()
+	if err != nil {
+		return err
+	}
+	nsec, err := d.uvarint()
+	if err != nil {
+		return err
+	}
+	if nsec >= 1e9 {
+		return fmt.Errorf("wire: invalid nanoseconds %d", nsec)
+	}
+
+	t := time.Unix(sec, int64(nsec)).UTC()
+	if t.Unix() != sec {
+		return fmt.Errorf("wire: time %d out of range", sec)
+	}
+	v.Set(reflect.ValueOf(t))
+	return nil
+}
+
+func (d *decoder) slice(v reflect.Value) error {
+	n, err := d.count()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		v.SetZero()
+		return nil
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	// grow the slice with its elements, rather than trusting n with its
+	// size
+	s := reflect.MakeSlice(v.Type(), 0, min(n, 1024))
+	elem := reflect.New(v.Type().Elem()).Elem()
+	for range n {
+		elem.SetZero()
+		if err := d.value(elem); err != nil {
+			return err
+		}
+		s = reflect.Append(s, elem)
+	}
+	v.Set(s)
+	return nil
+}
+
+func (d *decoder) array(v reflect.Value) error {
+	n, err := d.count()
+	if err != nil {
+		return err
+	}
+	if n != v.Len() {
+		return fmt.Errorf("wire: %d elements for %s", n, v.Type())
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	for i := range n {
+		if err := d.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) mapping(v reflect.Value) error {
+	n, err := d.count()
+	if err != nil {
+		return err
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	t := v.Type()
+	m := reflect.MakeMapWithSize(t, min(n, 1024))
+	key := reflect.New(t.Key()).Elem()
+	elem := reflect.New(t.Elem()).Elem()
+	var prev []byte
+	for i := range n {
+		start := d.data
+		key.SetZero()
+		if err := d.value(key); err != nil {
+			return err
+		}
+		raw := start[:len(start)-len(d.data)]
+		if i > 0 && bytes.Compare(prev, raw) >= 0 {
+			return errors.New("wire: map keys out of order")
+		}
+		prev = raw
+
+		elem.SetZero()
+		if err := d.value(elem); err != nil {
+			return err
+		}
+		m.SetMapIndex(key, elem)
+		// keys of distinct encodings may still be equal, such as 0 and -0
+		if m.Len() != i+1 {
+			return errors.New("wire: duplicate map key")
+		}
+	}
+	v.Set(m)
+	return nil
+}
+
+func (d *decoder) structure(v reflect.Value) error {
+	info := structInfoOf(v.Type())
+	if info.err != nil {
+		return info.err
+	}
+	n, err := d.count()
+	if err != nil {
+		return err
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	v.SetZero()
+	var prev string
+	for i := range n {
+		name, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if i > 0 && string(name) <= prev {
+			return errors.New("wire: fields out of order")
+		}
+		prev = string(name)
+
+		data, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		f, ok := info.byName[prev]
+		if !ok {
+			// a field of a later version of the struct
+			continue
+		}
+		if bytes.Equal(data, f.zero) {
+			return fmt.Errorf("wire: field %s of %s present with zero value", f.name, v.Type())
+		}
+
+		sub := decoder{data: data, depth: d.depth}
+		if err := sub.value(v.Field(f.index)); err != nil {
+			return err
+		}
+		if len(sub.data) > 0 {
+			return fmt.Errorf("wire: field %s of %s has %d bytes left over", f.name, v.Type(), len(sub.data))
+		}
+	}
+	return nil
+}
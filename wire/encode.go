@@ -0,0 +1,254 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// An encoder appends the encodings of values to buf.
+type encoder struct {
+	buf   []byte
+	depth int
+}
+
+func (e *encoder) encode(v any) error {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		return errors.New("wire: cannot encode nil")
+	}
+	return e.value(rv)
+}
+
+func (e *encoder) value(v reflect.Value) error {
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		e.buf = binary.AppendVarint(e.buf, t.Unix())
+		e.buf = binary.AppendUvarint(e.buf, uint64(t.Nanosecond()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.buf = binary.AppendVarint(e.buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.buf = binary.AppendUvarint(e.buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.buf = binary.AppendUvarint(e.buf, uint64(v.Len()))
+		e.buf = append(e.buf, v.String()...)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.buf = binary.AppendUvarint(e.buf, uint64(v.Len()))
+			e.buf = append(e.buf, v.Bytes()...)
+			return nil
+		}
+		return e.seq(v)
+	case reflect.Array:
+		return e.seq(v)
+	case reflect.Map:
+		return e.mapping(v)
+	case reflect.Pointer:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0)
+			return nil
+		}
+		if err := e.enter(); err != nil {
+			return err
+		}
+		defer e.leave()
+		e.buf = append(e.buf, 1)
+		return e.value(v.Elem())
+	case reflect.Struct:
+		return e.structure(v)
+	default:
+		return fmt.Errorf("wire: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// enter and leave bound the nesting of the value encoded, so that it can be
+// decoded, and values referring to themselves fail.
+func (e *encoder) enter() error {
+	if e.depth >= maxDepth {
+		return errors.New("wire: value nested too deeply")
+	}
+	e.depth++
+	return nil
+}
+
+func (e *encoder) leave() {
+	e.depth--
+}
+
+func (e *encoder) seq(v reflect.Value) error {
+	if err := e.enter(); err != nil {
+		return err
+	}
+	defer e.leave()
+
+	e.buf = binary.AppendUvarint(e.buf, uint64(v.Len()))
+	for i := range v.Len() {
+		if err := e.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) mapping(v reflect.Value) error {
+	if err := e.enter(); err != nil {
+		return err
+	}
+	defer e.leave()
+
+	// entries are offsets into sub.buf: the key spans [start, mid), and the
+	// element [mid, end)
+	type entry struct {
+		start, mid, end int
+	}
+	entries := make([]entry, 0, v.Len())
+	sub := encoder{depth: e.depth}
+	for it := v.MapRange(); it.Next(); {
+		start := len(sub.buf)
+		if err := sub.value(it.Key()); err != nil {
+			return err
+		}
+		mid := len(sub.buf)
+		if err := sub.value(it.Value()); err != nil {
+			return err
+		}
+		entries = append(entries, entry{start, mid, len(sub.buf)})
+	}
+	key := func(en entry) []byte { return sub.buf[en.start:en.mid] }
+
+	slices.SortFunc(entries, func(a, b entry) int {
+		return bytes.Compare(key(a), key(b))
+	})
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(entries)))
+	for i, en := range entries {
+		if i > 0 && bytes.Equal(key(en), key(entries[i-1])) {
+			return fmt.Errorf("wire: keys of %s with the same encoding", v.Type())
+		}
+		e.buf = append(e.buf, sub.buf[en.start:en.end]...)
+	}
+	return nil
+}
+
+func (e *encoder) structure(v reflect.Value) error {
+	info := structInfoOf(v.Type())
+	if info.err != nil {
+		return info.err
+	}
+	if err := e.enter(); err != nil {
+		return err
+	}
+	defer e.leave()
+
+	type part struct {
+		f          *field
+		start, end int
+	}
+	var parts []part
+	sub := encoder{depth: e.depth}
+	for i := range info.fields {
+		f := &info.fields[i]
+		start := len(sub.buf)
+		if err := sub.value(v.Field(f.index)); err != nil {
+			return err
+		}
+		if bytes.Equal(sub.buf[start:], f.zero) {
+			sub.buf = sub.buf[:start]
+			continue
+		}
+		parts = append(parts, part{f, start, len(sub.buf)})
+	}
+
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(parts)))
+	for _, p := range parts {
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(p.f.name)))
+		e.buf = append(e.buf, p.f.name...)
+		e.buf = binary.AppendUvarint(e.buf, uint64(p.end-p.start))
+		e.buf = append(e.buf, sub.buf[p.start:p.end]...)
+	}
+	return nil
+}
+
+// A field is an encoded field of a struct.
+type field struct {
+	name  string
+	index int
+	zero  []byte // the encoding of the zero value of the field
+}
+
+// A structInfo describes the encoding of a struct type.
+type structInfo struct {
+	fields []field // in the order of their names
+	byName map[string]*field
+	err    error
+}
+
+var structInfos sync.Map // reflect.Type → *structInfo
+
+func structInfoOf(t reflect.Type) *structInfo {
+	if info, ok := structInfos.Load(t); ok {
+		return info.(*structInfo)
+	}
+
+	info := &structInfo{byName: make(map[string]*field)}
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		name := sf.Name
+		tag, ok := sf.Tag.Lookup("wire")
+		if !ok {
+			tag = sf.Tag.Get("json")
+		}
+		if tag, _, _ = strings.Cut(tag, ","); tag != "" {
+			name = tag
+		}
+		if name == "-" {
+			continue
+		}
+
+		var e encoder
+		if err := e.value(reflect.Zero(sf.Type)); err != nil {
+			info.err = fmt.Errorf("%w in field %s of %s", err, sf.Name, t)
+			break
+		}
+		info.fields = append(info.fields, field{name: name, index: i, zero: e.buf})
+	}
+
+	slices.SortFunc(info.fields, func(a, b field) int {
+		return strings.Compare(a.name, b.name)
+	})
+	for i := range info.fields {
+		f := &info.fields[i]
+		if _, ok := info.byName[f.name]; ok && info.err == nil {
+			info.err = fmt.Errorf("wire: %s has several fields named %q", t, f.name)
+		}
+		info.byName[f.name] = f
+	}
+
+	actual, _ := structInfos.LoadOrStore(t, info)
+	return actual.(*structInfo)
+}
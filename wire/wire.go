@@ -0,0 +1,161 @@
+// Package wire encodes the messages instances exchange, such as those of
+// the RPC layer, in a compact binary form.
+//
+// The encoding is deterministic: a value has exactly one encoding, and
+// Unmarshal rejects any other, so that equal values encode to equal bytes
+// and encoded messages may be hashed or signed. It covers a small set of
+// types, and the Go type of a value is its schema:
+//
+//   - booleans, as a byte of 0 or 1
+//   - signed integers, as zigzag varints, and unsigned ones as varints
+//   - floating-point numbers, as the 8 big-endian bytes of their float64
+//   - strings and byte slices, as their length followed by their bytes
+//   - slices and arrays, as their length followed by their elements
+//   - maps, as their length followed by their entries, in the order of the
+//     encodings of their keys
+//   - pointers, as 0 for nil, or 1 followed by the value pointed to
+//   - time.Time, as the seconds since the Unix epoch followed by the
+//     nanoseconds, decoded in UTC
+//   - structs, as the number of their fields that are not zero, followed by
+//     their names and their encodings, prefixed by their length, in the
+//     order of the names
+//
+// A field is named by its wire tag, or else by its json tag, or else by the
+// name of the field, and is skipped if the tag is "-". Unexported fields are
+// skipped. Fields of zero value are left out, and fields a struct does not
+// have are skipped when decoding it, so that fields can be added to a
+// message without breaking older peers.
+//
+// An Encoder frames every message it writes with Version and its length, so
+// that a Decoder can bound the size of the messages it reads and reject
+// those of other versions.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Version is the version of the encoding, which frames of messages begin
+// with.
+const Version = 1
+
+// DefaultMaxSize bounds the size of the messages a Decoder reads unless
+// configured otherwise.
+const DefaultMaxSize = 16 << 20
+
+// maxDepth bounds the nesting of pointers, slices, maps, and structs in a
+// decoded value.
+const maxDepth = 64
+
+// ErrTooLarge is returned by Decode for a message larger than the maximum.
+var ErrTooLarge = errors.New("wire: message too large")
+
+// Marshal returns the encoding of v. A pointer is encoded as such, so
+// Unmarshal(data, &x) decodes Marshal(x), not Marshal(&x).
+func Marshal(v any) ([]byte, error) {
+	var e encoder
+	if err := e.encode(v); err != nil {
+		return nil, err
+	}
+	return e.buf, nil
+}
+
+// Unmarshal decodes data into v, which must be a non-nil pointer. It fails
+// if data is not the encoding of a value of the type v points to, or has
+// bytes left over.
+func Unmarshal(data []byte, v any) error {
+	d := decoder{data: data}
+	if err := d.decode(v); err != nil {
+		return err
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("wire: %d bytes left over", len(d.data))
+	}
+	return nil
+}
+
+// An Encoder writes framed messages to a stream.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewEncoder returns an encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes a frame of the encoding of v: Version, the length of the
+// encoding as a varint, and the encoding.
+func (enc *Encoder) Encode(v any) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	enc.buf = append(enc.buf[:0], Version)
+	enc.buf = binary.AppendUvarint(enc.buf, uint64(len(data)))
+	enc.buf = append(enc.buf, data...)
+	_, err = enc.w.Write(enc.buf)
+	return err
+}
+
+// A Decoder reads framed messages from a stream.
+type Decoder struct {
+	r       *bufio.Reader
+	maxSize int
+	buf     []byte
+}
+
+// NewDecoder returns a decoder reading from r, with messages of up to
+// DefaultMaxSize bytes.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), maxSize: DefaultMaxSize}
+}
+
+// SetMaxSize sets the maximum size of the messages dec reads.
+func (dec *Decoder) SetMaxSize(n int) {
+	dec.maxSize = n
+}
+
+// Decode reads the next frame and decodes its message into v. It returns
+// io.EOF if the stream ends before the frame, and io.ErrUnexpectedEOF if it
+// ends within it.
+func (dec *Decoder) Decode(v any) error {
+	version, err := dec.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != Version {
+		return fmt.Errorf("wire: unsupported version %d", version)
+	}
+
+	n, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		return unexpected(err)
+	}
+	if n > uint64(dec.maxSize) {
+		return ErrTooLarge
+	}
+
+	if uint64(cap(dec.buf)) < n {
+		dec.buf = make([]byte, n)
+	}
+	dec.buf = dec.buf[:n]
+	if _, err := io.ReadFull(dec.r, dec.buf); err != nil {
+		return unexpected(err)
+	}
+
+	return Unmarshal(dec.buf, v)
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,318 @@
+package wire_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"nih.software/wire"
+)
+
+type Inner struct {
+	Name  string   `json:"name"`
+	Tags  []string `json:"tags,omitempty"`
+	Count uint16
+}
+
+type message struct {
+	Bool    bool           `json:"bool"`
+	Int     int            `json:"int"`
+	Int8    int8           `wire:"i8"`
+	Uint    uint64         `json:"uint"`
+	Float   float64        `json:"float"`
+	Float32 float32        `json:"float32"`
+	String  string         `json:"string"`
+	Bytes   []byte         `json:"bytes"`
+	Ints    []int          `json:"ints"`
+	Array   [3]int32       `json:"array"`
+	Map     map[string]int `json:"map"`
+	Set     map[int]bool   `json:"set"`
+	Ptr     *Inner         `json:"ptr"`
+	Nil     *Inner         `json:"nil"`
+	Inner   Inner          `json:"inner"`
+	Inners  []Inner        `json:"inners"`
+	Time    time.Time      `json:"time"`
+	Times   map[string]time.Time
+	Elapsed time.Duration `json:"elapsed"`
+	Skipped string        `json:"-"`
+	hidden  string
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := message{
+		Bool:    true,
+		Int:     -1 << 40,
+		Int8:    -128,
+		Uint:    math.MaxUint64,
+		Float:   math.Inf(-1),
+		Float32: 1.5,
+		String:  "héllo",
+		Bytes:   []byte{0, 1, 0xff},
+		Ints:    []int{3, -2, 0},
+		Array:   [3]int32{1, 0, -1},
+		Map:     map[string]int{"b": 2, "a": 1, "": 0},
+		Set:     map[int]bool{-1: true, 300: false},
+		Ptr:     &Inner{Name: "p", Tags: []string{"x"}},
+		Inner:   Inner{Count: 7},
+		Inners:  []Inner{{}, {Name: "i"}},
+		Time:    time.Date(2024, 2, 29, 12, 30, 0, 123456789, time.FixedZone("X", 3600)),
+		Times:   map[string]time.Time{"epoch": time.Unix(0, 0).UTC(), "zero": {}},
+		Elapsed: 90 * time.Second,
+	}
+	data, err := wire.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got message
+	if err := wire.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Time.Equal(m.Time) || got.Time.Location() != time.UTC {
+		t.Errorf("Time = %v, want %v in UTC", got.Time, m.Time)
+	}
+	want := m
+	want.Time = m.Time.UTC()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal = %+v\nwant %+v", got, want)
+	}
+
+	// equal values encode to equal bytes, whatever the order of their maps
+	for range 10 {
+		m.Map = map[string]int{"a": 1, "": 0, "b": 2}
+		again, err := wire.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, data) {
+			t.Fatalf("Marshal not deterministic:\n%x\n%x", again, data)
+		}
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		v    any
+		want string
+	}{
+		{false, "00"},
+		{true, "01"},
+		{0, "00"},
+		{-1, "01"},
+		{1, "02"},
+		{-64, "7f"},
+		{64, "8001"},
+		{uint(300), "ac02"},
+		{1.0, "3ff0000000000000"},
+		{"", "00"},
+		{"hi", "026869"},
+		{[]byte("hi"), "026869"},
+		{[]int(nil), "00"},
+		{[2]bool{true, false}, "020100"},
+		{map[string]bool{"b": true, "a": false}, "02016100016201"},
+		{(*int)(nil), "00"},
+		{new(int), "0100"},
+		{Inner{}, "00"},
+		{Inner{Name: "n", Count: 1}, "0205436f756e740101046e616d6502016e"},
+		{time.Unix(-1, 5), "0105"},
+	} {
+		got, err := wire.Marshal(tt.v)
+		if err != nil {
+			t.Errorf("Marshal(%#v): %v", tt.v, err)
+			continue
+		}
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("Marshal(%#v) = %x, want %s", tt.v, got, tt.want)
+		}
+	}
+
+	for _, v := range []any{
+		nil,
+		struct{ F any }{},
+		map[float64]int{math.NaN(): 1, math.NaN(): 2},
+		func() {},
+	} {
+		if data, err := wire.Marshal(v); err == nil {
+			t.Errorf("Marshal(%#v) = %x, want error", v, data)
+		}
+	}
+}
+
+// TestCanonical tests that Unmarshal rejects every encoding of a value other
+// than the one Marshal returns for it.
+func TestCanonical(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data string
+		v    any
+	}{
+		{"bool", "02", new(bool)},
+		{"overlong varint", "8000", new(int)},
+		{"overflowing varint", "ffffffffffffffffff7f", new(uint64)},
+		{"int8 overflow", "8002", new(int8)},
+		{"uint8 overflow", "8002", new(uint8)},
+		{"float32 precision", "3ff0000000000001", new(float32)},
+		{"truncated float", "3ff0", new(float64)},
+		{"truncated string", "0368", new(string)},
+		{"trailing bytes", "0000", new(int)},
+		{"array length", "0101", new([2]bool)},
+		{"slice count", "05", new([]int)},
+		{"pointer tag", "02", new(*int)},
+		{"map order", "02016201016101", new(map[string]bool)},
+		{"map duplicate", "02016101016101", new(map[string]bool)},
+		{"map zero keys", "02000000000000000000800000000000000000", new(map[float64]bool)},
+		{"field order", "02046e616d6502016e05436f756e740101", new(Inner)},
+		{"field zero", "0105436f756e740100", new(Inner)},
+		{"field left over", "0105436f756e74020101", new(Inner)},
+		{"nanoseconds", "008094ebdc03", new(time.Time)},
+	} {
+		data, err := hex.DecodeString(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := wire.Unmarshal(data, tt.v); err == nil {
+			t.Errorf("%s: Unmarshal(%s) = %v, want error", tt.name, tt.data, reflect.ValueOf(tt.v).Elem())
+		}
+	}
+}
+
+func TestEvolution(t *testing.T) {
+	type v1 struct {
+		Name string `json:"name"`
+	}
+	type v2 struct {
+		Name  string `json:"name"`
+		Added []int  `json:"added"`
+		Zulu  bool   `json:"zulu"`
+	}
+
+	data, err := wire.Marshal(v2{Name: "n", Added: []int{1}, Zulu: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old v1
+	if err := wire.Unmarshal(data, &old); err != nil || old.Name != "n" {
+		t.Errorf("v1 from v2 = %+v, %v", old, err)
+	}
+
+	data, err = wire.Marshal(v1{Name: "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := v2{Added: []int{2}}
+	if err := wire.Unmarshal(data, &updated); err != nil || !reflect.DeepEqual(updated, v2{Name: "n"}) {
+		t.Errorf("v2 from v1 = %+v, %v", updated, err)
+	}
+}
+
+func TestDepth(t *testing.T) {
+	type list struct {
+		Next *list
+	}
+	var l *list
+	for range 100 {
+		l = &list{Next: l}
+	}
+	if _, err := wire.Marshal(l); err == nil {
+		t.Error("Marshal of a deep value succeeded")
+	}
+
+	// a slice of one slice of one slice ..., then of none
+	type nested []nested
+	data := append(bytes.Repeat([]byte{1}, 1000), 0)
+	var n nested
+	if err := wire.Unmarshal(data, &n); err == nil {
+		t.Error("Unmarshal of a deep value succeeded")
+	}
+}
+
+func TestStream(t *testing.T) {
+	var buf bytes.Buffer
+	enc := wire.NewEncoder(&buf)
+	for _, s := range []string{"a", "bc", ""} {
+		if err := enc.Encode(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := hex.EncodeToString(buf.Bytes()); got != "010201610103026263010100" {
+		t.Errorf("frames = %s", got)
+	}
+
+	data := buf.Bytes()
+	dec := wire.NewDecoder(bytes.NewReader(data))
+	for _, want := range []string{"a", "bc", ""} {
+		var s string
+		if err := dec.Decode(&s); err != nil || s != want {
+			t.Errorf("Decode = %q, %v, want %q", s, err, want)
+		}
+	}
+	var s string
+	if err := dec.Decode(&s); err != io.EOF {
+		t.Errorf("Decode at end = %v", err)
+	}
+
+	dec = wire.NewDecoder(bytes.NewReader(data[:6]))
+	dec.Decode(&s)
+	if err := dec.Decode(&s); err != io.ErrUnexpectedEOF {
+		t.Errorf("Decode of a truncated frame = %v", err)
+	}
+
+	dec = wire.NewDecoder(bytes.NewReader(data))
+	dec.SetMaxSize(2)
+	dec.Decode(&s)
+	if err := dec.Decode(&s); !errors.Is(err, wire.ErrTooLarge) {
+		t.Errorf("Decode of a large frame = %v", err)
+	}
+
+	dec = wire.NewDecoder(bytes.NewReader([]byte{wire.Version + 1, 1, 0}))
+	if err := dec.Decode(&s); err == nil {
+		t.Error("Decode of another version succeeded")
+	}
+}
+
+// FuzzUnmarshal tests that Unmarshal fails on malformed data without
+// panicking, and that the data it accepts is the encoding of the value
+// decoded, but for the fields the value does not have.
+func FuzzUnmarshal(f *testing.F) {
+	for _, v := range []any{
+		message{},
+		message{Int: 1, Map: map[string]int{"a": 1}, Ptr: &Inner{Name: "p"}},
+		message{Times: map[string]time.Time{"t": time.Unix(1, 1)}, Array: [3]int32{1, 2, 3}},
+	} {
+		data, err := wire.Marshal(v)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	roundTrip := func(t *testing.T, data []byte) ([]byte, bool) {
+		var m message
+		if err := wire.Unmarshal(data, &m); err != nil {
+			return nil, false
+		}
+		again, err := wire.Marshal(m)
+		if err != nil {
+			t.Fatalf("Marshal(%+v): %v", m, err)
+		}
+		return again, true
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		again, ok := roundTrip(t, data)
+		if !ok {
+			return
+		}
+		if len(again) > len(data) {
+			t.Fatalf("Unmarshal accepted %x, which encodes as the longer %x", data, again)
+		}
+		if twice, ok := roundTrip(t, again); !ok || !bytes.Equal(twice, again) {
+			t.Fatalf("Unmarshal accepted %x, which encodes as %x, then as %x", data, again, twice)
+		}
+	})
+}